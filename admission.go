@@ -0,0 +1,117 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// admissionTraceSize is the number of admission decisions kept by
+// Config.TraceAdmissions.
+const admissionTraceSize = 256
+
+// AdmissionRecord tells why the default policy admitted or rejected a new key
+// for which there wasn't room. See Config.TraceAdmissions.
+type AdmissionRecord struct {
+	// Key is the hash of the candidate key.
+	Key uint64
+	// Cost is the cost of the candidate, including the internal cost unless
+	// Config.IgnoreInternalCost is set.
+	Cost int64
+	// Estimate is the frequency estimate of the candidate.
+	Estimate int64
+	// Victims are the least frequently used keys of the samples the candidate
+	// was compared with, in order. All of them but the last were evicted for
+	// it if the candidate was rejected.
+	Victims []AdmissionVictim
+	// Forced is set for SetForce, which evicts the victims without
+	// comparing them with the candidate.
+	Forced bool
+	// Admitted is whether the candidate was admitted. A rejected candidate
+	// without victims was rejected because every resident key is pinned.
+	Admitted bool
+	// Used and MaxCost are the cost used in the cache and its capacity when
+	// the decision started.
+	Used    int64
+	MaxCost int64
+}
+
+// AdmissionVictim is a key an AdmissionRecord's candidate was compared with.
+type AdmissionVictim struct {
+	Key      uint64
+	Cost     int64
+	Estimate int64
+	// Evicted is whether the key was evicted to make room for the candidate.
+	Evicted bool
+}
+
+// admissionTrace keeps the last admission decisions sampled, in a ring.
+type admissionTrace struct {
+	rate    uint32
+	mu      sync.Mutex
+	records [admissionTraceSize]AdmissionRecord
+	// next is the index of the next record, and n the number of records kept.
+	next, n int
+}
+
+func newAdmissionTrace(rate int) *admissionTrace {
+	if rate <= 0 {
+		return nil
+	}
+	return &admissionTrace{rate: uint32(rate)}
+}
+
+// sample returns whether to trace the next admission decision.
+func (t *admissionTrace) sample() bool {
+	return t != nil && z.FastRand()%t.rate == 0
+}
+
+func (t *admissionTrace) add(r *AdmissionRecord) {
+	t.mu.Lock()
+	t.records[t.next] = *r
+	t.next = (t.next + 1) % admissionTraceSize
+	if t.n < admissionTraceSize {
+		t.n++
+	}
+	t.mu.Unlock()
+}
+
+// list returns the records kept, oldest first.
+func (t *admissionTrace) list() []AdmissionRecord {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	records := make([]AdmissionRecord, 0, t.n)
+	for i := t.next - t.n; i < t.next; i++ {
+		records = append(records, t.records[(i+admissionTraceSize)%admissionTraceSize])
+	}
+	return records
+}
+
+// AdmissionTrace returns the last admission decisions sampled with
+// Config.TraceAdmissions, up to 256, oldest first. It returns nil if
+// TraceAdmissions isn't set.
+func (c *Cache) AdmissionTrace() []AdmissionRecord {
+	if c == nil {
+		return nil
+	}
+	return c.admissions.list()
+}
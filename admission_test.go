@@ -0,0 +1,119 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmissionTrace(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		TraceAdmissions:    1,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 1; i <= 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	for n := 0; n < 3; n++ {
+		for i := 1; i <= 10; i++ {
+			c.Get(i)
+		}
+	}
+	c.Flush()
+	// Keys with room aren't traced.
+	require.Empty(t, c.AdmissionTrace())
+
+	// A key less popular than its victim is rejected.
+	c.Set(11, 11, 1)
+	c.Wait()
+	trace := c.AdmissionTrace()
+	require.Len(t, trace, 1)
+	r := trace[0]
+	keyHash, _ := c.keyToHash(11)
+	require.Equal(t, keyHash, r.Key)
+	require.Equal(t, int64(1), r.Cost)
+	require.False(t, r.Admitted)
+	require.False(t, r.Forced)
+	require.Equal(t, int64(10), r.Used)
+	require.Equal(t, int64(10), r.MaxCost)
+	require.Len(t, r.Victims, 1)
+	require.False(t, r.Victims[0].Evicted)
+	require.True(t, r.Victims[0].Estimate > r.Estimate)
+
+	// One more popular evicts it.
+	for n := 0; n < 5; n++ {
+		c.Get(12)
+	}
+	c.Flush()
+	c.Set(12, 12, 1)
+	c.Wait()
+	trace = c.AdmissionTrace()
+	require.Len(t, trace, 2)
+	r = trace[1]
+	require.True(t, r.Admitted)
+	require.Len(t, r.Victims, 1)
+	require.True(t, r.Victims[0].Evicted)
+	require.True(t, r.Victims[0].Estimate <= r.Estimate)
+	_, ok := c.GetLocal(12)
+	require.True(t, ok)
+}
+
+func TestAdmissionTraceRing(t *testing.T) {
+	var trace *admissionTrace
+	require.Nil(t, trace.list())
+	require.False(t, trace.sample())
+	trace = newAdmissionTrace(1)
+	require.True(t, trace.sample())
+	for i := 1; i <= admissionTraceSize+10; i++ {
+		trace.add(&AdmissionRecord{Key: uint64(i)})
+	}
+	records := trace.list()
+	require.Len(t, records, admissionTraceSize)
+	require.Equal(t, uint64(11), records[0].Key)
+	require.Equal(t, uint64(admissionTraceSize+10), records[len(records)-1].Key)
+}
+
+func TestAdmissionTraceConfig(t *testing.T) {
+	_, err := NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		TraceAdmissions: -1,
+	})
+	require.Error(t, err)
+
+	// Custom policies record nothing.
+	c, err := NewCache(&Config{
+		NumCounters:     100,
+		MaxCost:         10,
+		BufferItems:     64,
+		TraceAdmissions: 1,
+		Policy:          NewLRUPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Nil(t, c.AdmissionTrace())
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+const (
+	// ageShards is the number of locks the keys of an ageIndex are spread
+	// over.
+	ageShards = 64
+	// ageReportSamples is the most items AgeReport looks at.
+	ageReportSamples = 1024
+	// idleSweepShards is the number of shards of an ageIndex swept for idle
+	// items on every cleanup, so that a whole sweep takes 16 of them.
+	idleSweepShards = ageShards / 16
+)
+
+// entryAge holds when an item was set and last read, as Unix times, and the
+// seconds it may go unread, or 0 if it may forever.
+type entryAge struct {
+	setAt   int64
+	readAt  int64 // Updated atomically.
+	maxIdle int64
+}
+
+type ageShard struct {
+	sync.RWMutex
+	ages map[uint64]*entryAge
+}
+
+// ageIndex keeps the entryAge of every item in the cache, for
+// Config.TrackAge. A key is only in it while it's in the store, like in
+// tagIndex.
+type ageIndex struct {
+	clock  *coarseClock
+	shards [ageShards]ageShard
+	// sweep is the next shard sweepIdle goes over.
+	sweep int
+}
+
+func newAgeIndex(clock *coarseClock) *ageIndex {
+	a := &ageIndex{clock: clock}
+	for i := range a.shards {
+		a.shards[i].ages = make(map[uint64]*entryAge)
+	}
+	return a
+}
+
+func (a *ageIndex) shard(key uint64) *ageShard {
+	return &a.shards[key%ageShards]
+}
+
+// set records that the key has been added to the store now, with maxIdle, or
+// only sets maxIdle if it's already there, as updates keep the age of an item.
+func (a *ageIndex) set(key uint64, maxIdle int64) {
+	if a == nil {
+		return
+	}
+	s := a.shard(key)
+	s.Lock()
+	if age, ok := s.ages[key]; ok {
+		age.maxIdle = maxIdle
+	} else {
+		now := a.clock.now()
+		s.ages[key] = &entryAge{setAt: now, readAt: now, maxIdle: maxIdle}
+	}
+	s.Unlock()
+}
+
+// idle returns whether the key has gone unread for longer than it may.
+func (a *ageIndex) idle(key uint64) bool {
+	if a == nil {
+		return false
+	}
+	now := a.clock.now()
+	s := a.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	age, ok := s.ages[key]
+	return ok && age.idle(now)
+}
+
+func (age *entryAge) idle(now int64) bool {
+	return age.maxIdle > 0 && now-atomic.LoadInt64(&age.readAt) > age.maxIdle
+}
+
+// takeIdle forgets the idle keys of the next n shards, and returns them.
+func (a *ageIndex) takeIdle(n int) []uint64 {
+	now := a.clock.now()
+	var keys []uint64
+	for ; n > 0; n-- {
+		s := &a.shards[a.sweep]
+		a.sweep = (a.sweep + 1) % ageShards
+		s.Lock()
+		for key, age := range s.ages {
+			if age.idle(now) {
+				delete(s.ages, key)
+				keys = append(keys, key)
+			}
+		}
+		s.Unlock()
+	}
+	return keys
+}
+
+// read records that the key has been read now.
+func (a *ageIndex) read(key uint64) {
+	if a == nil {
+		return
+	}
+	now := a.clock.now()
+	s := a.shard(key)
+	s.RLock()
+	if age, ok := s.ages[key]; ok && atomic.LoadInt64(&age.readAt) != now {
+		atomic.StoreInt64(&age.readAt, now)
+	}
+	s.RUnlock()
+}
+
+func (a *ageIndex) get(key uint64) (entryAge, bool) {
+	s := a.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	age, ok := s.ages[key]
+	if !ok {
+		return entryAge{}, false
+	}
+	return entryAge{
+		setAt:   age.setAt,
+		readAt:  atomic.LoadInt64(&age.readAt),
+		maxIdle: age.maxIdle,
+	}, true
+}
+
+func (a *ageIndex) del(key uint64) {
+	if a == nil {
+		return
+	}
+	s := a.shard(key)
+	s.Lock()
+	delete(s.ages, key)
+	s.Unlock()
+}
+
+func (a *ageIndex) clear() {
+	if a == nil {
+		return
+	}
+	for i := range a.shards {
+		s := &a.shards[i]
+		s.Lock()
+		s.ages = make(map[uint64]*entryAge)
+		s.Unlock()
+	}
+}
+
+// sweepIdle deletes the idle items of the next shards of the age index, the
+// way expired items are cleaned up. It's called by processItems.
+func (c *Cache) sweepIdle(onExpire itemCallback) int {
+	if c.ages == nil {
+		return 0
+	}
+	var swept int
+	for _, key := range c.ages.takeIdle(idleSweepShards) {
+		conflict, value, ok := c.store.Del(key, 0)
+		if !ok {
+			continue
+		}
+		cost := c.policy.Cost(key)
+		c.policy.Del(key)
+		onExpire(&Item{Key: key, Conflict: conflict, Value: value, Cost: cost})
+		swept++
+	}
+	return swept
+}
+
+// idleSeconds returns the seconds an item may go unread given maxIdle, the
+// MaxIdle of its SetOptions, rounded up, or 0 if it may forever.
+func (c *Cache) idleSeconds(maxIdle time.Duration) int64 {
+	switch {
+	case maxIdle < 0:
+		return 0
+	case maxIdle == 0:
+		maxIdle = c.maxIdle
+	}
+	return int64((maxIdle + time.Second - 1) / time.Second)
+}
+
+// AgeReport tells how long the items of a cache have been in it, and how long
+// since they were last read, over a sample of them. See Cache.AgeReport.
+type AgeReport struct {
+	// Sampled is the number of items the report is made of.
+	Sampled int
+	// Age has the percentiles of the time since the items were set. An
+	// update doesn't reset it.
+	Age AgePercentiles
+	// Idle has the percentiles of the time since the items were last read by
+	// a Get, or set if they haven't been since.
+	Idle AgePercentiles
+}
+
+// AgePercentiles holds percentiles of durations, to the second.
+type AgePercentiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+// AgeReport reports the ages and idle times of up to 1024 items of the cache,
+// picked at random, or all of them in smaller caches. It requires
+// Config.TrackAge, and returns an empty report without it. The items are
+// visited like in Range, so the report is cheap enough to be made on demand,
+// but isn't meant to be made on every request.
+func (c *Cache) AgeReport() AgeReport {
+	if c == nil || c.isClosed() || c.ages == nil {
+		return AgeReport{}
+	}
+	now := c.clock.Now().Unix()
+	var sample []entryAge
+	seen := 0
+	c.store.Range(func(i storeItem) bool {
+		if i.expiration != 0 && i.expiration <= now {
+			return true
+		}
+		age, ok := c.ages.get(i.key)
+		if !ok {
+			// Not applied by processItems yet.
+			return true
+		}
+		seen++
+		if len(sample) < ageReportSamples {
+			sample = append(sample, age)
+		} else if j := int(z.FastRand() % uint32(seen)); j < ageReportSamples {
+			sample[j] = age
+		}
+		return true
+	})
+	ages := make([]int64, len(sample))
+	idle := make([]int64, len(sample))
+	for j, age := range sample {
+		ages[j] = now - age.setAt
+		idle[j] = now - age.readAt
+	}
+	return AgeReport{
+		Sampled: len(sample),
+		Age:     agePercentiles(ages),
+		Idle:    agePercentiles(idle),
+	}
+}
+
+// agePercentiles returns the percentiles of the durations, in seconds, by
+// nearest rank.
+func agePercentiles(secs []int64) AgePercentiles {
+	if len(secs) == 0 {
+		return AgePercentiles{}
+	}
+	sort.Slice(secs, func(i, j int) bool { return secs[i] < secs[j] })
+	at := func(p int) time.Duration {
+		// The smallest value with at least p% of them at or below it.
+		rank := (p*len(secs) + 99) / 100
+		if rank < 1 {
+			rank = 1
+		}
+		s := secs[rank-1]
+		if s < 0 {
+			// The system clock stepped back.
+			s = 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	return AgePercentiles{P50: at(50), P90: at(90), P99: at(99), Max: at(100)}
+}
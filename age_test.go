@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheAgeReport(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		TrackAge:           true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Key i is set i seconds in, and the report is made at 100s.
+	for i := 0; i < 100; i++ {
+		require.True(t, c.Set(i, i, 1))
+		c.Wait()
+		clock.Add(time.Second)
+	}
+	for i := 0; i < 50; i++ {
+		_, ok := c.Get(i)
+		require.True(t, ok)
+	}
+	// Updates and Peeks don't count.
+	require.True(t, c.Set(99, "x", 1))
+	c.Wait()
+	c.Peek(98)
+	report := c.AgeReport()
+	require.Equal(t, 100, report.Sampled)
+	require.Equal(t, AgePercentiles{
+		P50: 50 * time.Second,
+		P90: 90 * time.Second,
+		P99: 99 * time.Second,
+		Max: 100 * time.Second,
+	}, report.Age)
+	// Half the keys were just read, the others are as old as they are idle.
+	require.Equal(t, AgePercentiles{
+		P50: 0,
+		P90: 40 * time.Second,
+		P99: 49 * time.Second,
+		Max: 50 * time.Second,
+	}, report.Idle)
+
+	// Deleted keys are forgotten, and come back as new ones.
+	c.Del(0)
+	c.Wait()
+	require.Equal(t, 99, c.AgeReport().Sampled)
+	require.True(t, c.Set(0, 0, 1))
+	c.Wait()
+	clock.Add(time.Second)
+	require.Equal(t, 100, c.AgeReport().Sampled)
+	keyHash, _ := c.keyToHash(0)
+	age, ok := c.ages.get(keyHash)
+	require.True(t, ok)
+	require.Equal(t, clock.Now().Unix()-1, age.setAt)
+
+	c.Clear()
+	require.Equal(t, AgeReport{}, c.AgeReport())
+}
+
+func TestCacheAgeReportDisabled(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	require.Equal(t, AgeReport{}, c.AgeReport())
+}
+
+func TestAgePercentiles(t *testing.T) {
+	require.Equal(t, AgePercentiles{}, agePercentiles(nil))
+	require.Equal(t, AgePercentiles{
+		P50: 2 * time.Second,
+		P90: 3 * time.Second,
+		P99: 3 * time.Second,
+		Max: 3 * time.Second,
+	}, agePercentiles([]int64{3, 1, 2}))
+}
+
+func TestCacheMaxIdle(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	var mu sync.Mutex
+	var expired []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+		MaxIdle:            10 * time.Second,
+		OnExpire: func(item *Item) {
+			mu.Lock()
+			expired = append(expired, item.Key)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.SetWithTTL(2, 2, 1, 5*time.Second))
+	require.True(t, c.SetWithOptions(3, 3, 1, SetOptions{MaxIdle: -1}))
+	require.True(t, c.SetWithOptions(4, 4, 1, SetOptions{TTL: 30 * time.Second, MaxIdle: 20 * time.Second}))
+	require.True(t, c.SetWithTTL(5, 5, 1, 30*time.Second))
+	c.Wait()
+	at := func(secs int, f func()) {
+		clock.Add(time.Unix(1e9+int64(secs), 0).Sub(clock.Now()))
+		f()
+	}
+	has := func(key int) bool {
+		_, ok := c.Get(key)
+		return ok
+	}
+
+	at(4, func() {
+		require.True(t, has(1))
+		require.True(t, has(2))
+	})
+	// The TTL comes first.
+	at(6, func() { require.False(t, has(2)) })
+	// Being idle comes first.
+	at(11, func() {
+		_, ok := c.Peek(5)
+		require.False(t, ok)
+		require.False(t, has(5))
+		require.False(t, c.Touch(5, 0))
+	})
+	// Touch and GetAndTouch count as reads.
+	at(12, func() {
+		require.True(t, c.Touch(1, 0))
+		require.True(t, has(4))
+	})
+	at(20, func() {
+		_, ok := c.GetAndTouch(1, 0)
+		require.True(t, ok)
+	})
+	at(24, func() { require.True(t, has(4)) })
+	at(31, func() {
+		require.False(t, has(1))
+		// Read 7 seconds ago, but the TTL is up.
+		require.False(t, has(4))
+		require.True(t, has(3))
+	})
+
+	// Idle items are deleted like expired ones.
+	at(90, func() { c.Wait() })
+	require.Equal(t, 1, c.Len())
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Slice(expired, func(i, j int) bool { return expired[i] < expired[j] })
+	require.Equal(t, []uint64{1, 2, 4, 5}, expired)
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+// arcPolicy is an Adaptive Replacement Cache policy. Resident keys are split
+// between t1, for keys accessed once since they were added, and t2, for keys
+// accessed more than once. b1 and b2 are ghost lists remembering the keys
+// recently evicted from t1 and t2 respectively. A new key found in a ghost
+// list moves the target size of t1 towards the list it was found in, so the
+// policy adapts to the workload favoring recency or frequency.
+//
+// All sizes are costs rather than key counts, and the ghost lists are bounded
+// so that resident and ghost keys never add up to more than twice MaxCost, and
+// to NumCounters keys each.
+type arcPolicy struct {
+	t1, t2      arcList
+	b1, b2      *GhostRegistry
+	numCounters int64
+	maxCost     int64
+	// target is the cost t1 should hold.
+	target int64
+	elems  map[uint64]*list.Element
+	// adapted is the candidate target was last adapted for, so that it's only
+	// adapted once per candidate even if Evict is called repeatedly for it.
+	adapted    uint64
+	hasAdapted bool
+}
+
+type arcList struct {
+	list *list.List
+	cost int64
+}
+
+type arcEntry struct {
+	key  uint64
+	cost int64
+	in   *arcList
+}
+
+// NewARCPolicy returns an Adaptive Replacement Cache Policy, which adapts to
+// workloads switching between favoring recently and frequently used keys. It
+// can be used as Config.Policy.
+func NewARCPolicy(numCounters, maxCost int64) Policy {
+	p := &arcPolicy{numCounters: numCounters, maxCost: maxCost}
+	p.Clear()
+	return p
+}
+
+// move moves elem to the front of the given list.
+func (p *arcPolicy) move(elem *list.Element, to *arcList) {
+	e := elem.Value.(*arcEntry)
+	p.remove(elem)
+	e.in = to
+	to.cost += e.cost
+	p.elems[e.key] = to.list.PushFront(e)
+}
+
+func (p *arcPolicy) remove(elem *list.Element) {
+	e := elem.Value.(*arcEntry)
+	e.in.list.Remove(elem)
+	e.in.cost -= e.cost
+	delete(p.elems, e.key)
+}
+
+// adapt moves the target size of t1 if candidate is found in a ghost list.
+func (p *arcPolicy) adapt(candidate uint64) {
+	if p.hasAdapted && p.adapted == candidate {
+		return
+	}
+	p.adapted, p.hasAdapted = candidate, true
+	if cost, ok := p.b1.Lookup(candidate); ok {
+		p.target += cost * ghostRatio(p.b2.Cost(), p.b1.Cost())
+		if p.target > p.maxCost {
+			p.target = p.maxCost
+		}
+	} else if cost, ok := p.b2.Lookup(candidate); ok {
+		p.target -= cost * ghostRatio(p.b1.Cost(), p.b2.Cost())
+		if p.target < 0 {
+			p.target = 0
+		}
+	}
+}
+
+func (p *arcPolicy) Add(key uint64, cost int64) {
+	p.adapt(key)
+	p.hasAdapted = false
+	if _, ok := p.elems[key]; ok {
+		p.Update(key, cost)
+		return
+	}
+	to := &p.t1
+	// A ghost hit: the key was evicted too early.
+	if p.b1.Remove(key) || p.b2.Remove(key) {
+		to = &p.t2
+	}
+	e := &arcEntry{key: key, cost: cost, in: to}
+	to.cost += cost
+	p.elems[key] = to.list.PushFront(e)
+	p.trimGhosts()
+}
+
+// trimGhosts forgets the oldest ghost keys so that t1 and b1 hold at most
+// maxCost, and all four lists at most twice as much.
+func (p *arcPolicy) trimGhosts() {
+	p.b1.Trim(p.maxCost - p.t1.cost)
+	p.b2.Trim(2*p.maxCost - p.t1.cost - p.t2.cost - p.b1.Cost())
+}
+
+func (p *arcPolicy) Update(key uint64, cost int64) {
+	if elem, ok := p.elems[key]; ok {
+		e := elem.Value.(*arcEntry)
+		e.in.cost += cost - e.cost
+		e.cost = cost
+	}
+}
+
+func (p *arcPolicy) Del(key uint64) {
+	if elem, ok := p.elems[key]; ok {
+		p.remove(elem)
+	}
+}
+
+func (p *arcPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		if elem, ok := p.elems[key]; ok {
+			p.move(elem, &p.t2)
+		}
+	}
+}
+
+func (p *arcPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+// EvictSkipping takes the victim from the other list if every key of the one
+// it would evict from is skipped.
+func (p *arcPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	p.adapt(candidate)
+	from := [2]*arcList{&p.t2, &p.t1}
+	ghosts := [2]*GhostRegistry{p.b2, p.b1}
+	if p.t1.list.Len() > 0 && (p.t2.list.Len() == 0 || p.t1.cost > p.target ||
+		(p.t1.cost == p.target && p.b2.Contains(candidate))) {
+		from[0], from[1] = from[1], from[0]
+		ghosts[0], ghosts[1] = ghosts[1], ghosts[0]
+	}
+	for n, l := range from {
+		elem := lastUnskipped(l.list, func(elem *list.Element) uint64 {
+			return elem.Value.(*arcEntry).key
+		}, skip)
+		if elem == nil {
+			continue
+		}
+		e := elem.Value.(*arcEntry)
+		p.remove(elem)
+		ghosts[n].Add(e.key, e.cost)
+		p.trimGhosts()
+		return e.key, true
+	}
+	return 0, false
+}
+
+func (p *arcPolicy) Resize(maxCost int64) {
+	p.maxCost = maxCost
+	if p.target > maxCost {
+		p.target = maxCost
+	}
+	p.trimGhosts()
+}
+
+func (p *arcPolicy) Clear() {
+	p.t1 = arcList{list: list.New()}
+	p.t2 = arcList{list: list.New()}
+	p.b1 = NewGhostRegistry(int(p.numCounters))
+	p.b2 = NewGhostRegistry(int(p.numCounters))
+	p.target = 0
+	p.elems = make(map[uint64]*list.Element)
+	p.hasAdapted = false
+}
+
+// ghostRatio returns how much faster the target should move towards the ghost
+// list of cost hit, given the cost of the other ghost list.
+func ghostRatio(other, hit int64) int64 {
+	if hit == 0 || other <= hit {
+		return 1
+	}
+	return other / hit
+}
@@ -0,0 +1,81 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestARCPolicyLists(t *testing.T) {
+	p := NewARCPolicy(100, 4).(*arcPolicy)
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+	}
+	p.Access([]uint64{1, 2, 5})
+	require.Equal(t, int64(2), p.t1.cost)
+	require.Equal(t, int64(2), p.t2.cost)
+
+	// t1 is over its target of 0, so its oldest key becomes a ghost.
+	victim, ok := p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	require.True(t, p.b1.Contains(3))
+	p.Add(5, 1)
+
+	// Adding a ghost from b1 grows the target of t1 and puts the key in t2.
+	victim, ok = p.Evict(3)
+	require.True(t, ok)
+	require.Equal(t, int64(1), p.target)
+	require.Equal(t, uint64(4), victim)
+	p.Add(3, 1)
+	require.True(t, p.elems[3].Value.(*arcEntry).in == &p.t2)
+	require.Equal(t, int64(1), p.target)
+}
+
+func TestARCPolicyGhostsBounded(t *testing.T) {
+	p := NewARCPolicy(100, 10).(*arcPolicy)
+	for key := uint64(0); key < 1000; key++ {
+		if p.t1.cost+p.t2.cost >= 10 {
+			_, ok := p.Evict(key)
+			require.True(t, ok)
+		}
+		p.Add(key, 1)
+		p.Access([]uint64{key / 2})
+		require.True(t, p.t1.cost+p.b1.Cost() <= 10)
+		require.True(t, p.t1.cost+p.t2.cost+p.b1.Cost()+p.b2.Cost() <= 20)
+		require.Equal(t, int(p.t1.cost+p.t2.cost), len(p.elems))
+		require.Equal(t, int(p.b1.Cost()+p.b2.Cost()), p.b1.Len()+p.b2.Len())
+	}
+}
+
+func TestARCPolicyDel(t *testing.T) {
+	p := NewARCPolicy(100, 4).(*arcPolicy)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Access([]uint64{2})
+	victim, ok := p.Evict(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+	p.Add(3, 1)
+	p.Update(3, 2)
+	require.Equal(t, int64(2), p.t1.cost)
+	// Deleting a ghost or a missing key does nothing.
+	p.Del(1)
+	p.Del(4)
+	require.True(t, p.b1.Contains(1))
+	p.Del(2)
+	p.Del(3)
+	require.Zero(t, p.t1.cost)
+	require.Zero(t, p.t2.cost)
+	p.Clear()
+	require.Empty(t, p.elems)
+	_, ok = p.Evict(4)
+	require.False(t, ok)
+}
+
+func TestARCPolicyHitRatio(t *testing.T) {
+	keys := scanTrace(50, 100, 200)
+	lru := policyHitRatio(NewSLRUPolicyWithRatio(1)(100, 100), 100, keys)
+	arc := policyHitRatio(NewARCPolicy(100, 100), 100, keys)
+	require.True(t, arc > lru+0.1, "arc: %.3f, lru: %.3f", arc, lru)
+}
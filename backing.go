@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// BackingStore is a second-level store behind the cache, such as Redis or a
+// disk cache, set as Config.Backing. It's called with the original keys, never
+// while the cache holds a lock, and has to be safe for concurrent use.
+type BackingStore interface {
+	// Get returns the value of the key, and whether it was found.
+	Get(key interface{}) (interface{}, bool)
+	// Set stores the value of the key.
+	Set(key, value interface{})
+	// Del deletes the key.
+	Del(key interface{})
+}
+
+// MapBackingStore is a BackingStore holding the values in memory, mostly
+// useful in tests.
+type MapBackingStore struct {
+	mu   sync.Mutex
+	data map[interface{}]interface{}
+}
+
+// NewMapBackingStore returns an empty MapBackingStore.
+func NewMapBackingStore() *MapBackingStore {
+	return &MapBackingStore{data: make(map[interface{}]interface{})}
+}
+
+func (s *MapBackingStore) Get(key interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+func (s *MapBackingStore) Set(key, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[key] = value
+}
+
+func (s *MapBackingStore) Del(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
+// Len returns the number of keys in the store.
+func (s *MapBackingStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// backing is the Config.Backing of a cache. With write-back, it also remembers
+// the original key of every item in the cache, as the cache only keeps their
+// hashes, so that evicted values can be written back under their key.
+type backing struct {
+	store     BackingStore
+	writeBack bool
+	mu        sync.Mutex
+	keys      map[uint64]interface{}
+}
+
+func newBacking(store BackingStore, writeBack bool) *backing {
+	if store == nil {
+		return nil
+	}
+	b := &backing{store: store, writeBack: writeBack}
+	if writeBack {
+		b.keys = make(map[uint64]interface{})
+	}
+	return b
+}
+
+// remember records the original key of a stored item, if it has one.
+func (b *backing) remember(i *Item) {
+	if b == nil || !b.writeBack || i.origKey == nil {
+		return
+	}
+	b.mu.Lock()
+	b.keys[i.Key] = i.origKey
+	b.mu.Unlock()
+}
+
+// forget drops the original key of an item leaving the cache, and returns it.
+func (b *backing) forget(key uint64) interface{} {
+	if b == nil || !b.writeBack {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	orig := b.keys[key]
+	delete(b.keys, key)
+	return orig
+}
+
+// writeItem writes the value of an item that couldn't stay in the cache to the
+// store, if write-back is on and the item's original key is known.
+func (b *backing) writeItem(i *Item) {
+	if b == nil || !b.writeBack || i.origKey == nil {
+		return
+	}
+	b.store.Set(i.origKey, i.Value)
+}
+
+func (b *backing) clear() {
+	if b == nil || !b.writeBack {
+		return
+	}
+	b.mu.Lock()
+	b.keys = make(map[uint64]interface{})
+	b.mu.Unlock()
+}
+
+// GetLocal works like Get, but doesn't consult Config.Backing on a miss.
+func (c *Cache) GetLocal(key interface{}) (interface{}, bool) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.get(keyHash, conflictHash)
+}
+
+// DelLocal works like Del, but doesn't delete the key from Config.Backing.
+func (c *Cache) DelLocal(key interface{}) (interface{}, bool) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.del(keyHash, conflictHash)
+}
+
+// getBacking looks up a key missing from the cache in Config.Backing, and Sets
+// the value it finds, which still has to be admitted by the policy.
+func (c *Cache) getBacking(key interface{}) (interface{}, bool) {
+	value, ok := c.backing.store.Get(key)
+	if !ok {
+		return nil, false
+	}
+	c.Set(key, value, 0)
+	return c.readValue(0, value), true
+}
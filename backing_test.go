@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheBacking(t *testing.T) {
+	l2 := NewMapBackingStore()
+	l2.Set(1, "one")
+	l2.Set(2, "two")
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Backing:            l2,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, ok := c.GetLocal(1)
+	require.False(t, ok)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	c.Wait()
+	// The value found is now cached.
+	val, ok = c.GetLocal(1)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	_, ok = c.Get(3)
+	require.False(t, ok)
+
+	// Sets don't reach the backing store without write-back.
+	require.True(t, c.Set(3, "three", 1))
+	c.Wait()
+	_, ok = l2.Get(3)
+	require.False(t, ok)
+
+	// Del goes through, DelLocal doesn't.
+	c.Get(2)
+	c.Wait()
+	_, ok = c.DelLocal(2)
+	require.True(t, ok)
+	_, ok = l2.Get(2)
+	require.True(t, ok)
+	_, ok = c.Del(1)
+	require.True(t, ok)
+	_, ok = l2.Get(1)
+	require.False(t, ok)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+}
+
+func TestCacheWriteBack(t *testing.T) {
+	l2 := NewMapBackingStore()
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Backing:            l2,
+		WriteBack:          true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i*10, 1))
+	}
+	c.Wait()
+	require.Equal(t, 4, c.Len())
+	require.Equal(t, 6, l2.Len())
+	// Every value is in one place or the other.
+	for i := 0; i < 10; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok, "key %d", i)
+		require.Equal(t, i*10, val)
+		c.Wait()
+	}
+	// The original keys are only kept for the items in the cache.
+	require.Len(t, c.backing.keys, c.Len())
+
+	// Expired values aren't written back.
+	c.Clear()
+	require.Empty(t, c.backing.keys)
+	require.True(t, c.SetWithTTL("x", "y", 1, time.Second))
+	c.Wait()
+	_, ok := c.GetLocal("x")
+	require.True(t, ok)
+	clock.Add(10 * time.Second)
+	c.Wait()
+	_, ok = c.GetLocal("x")
+	require.False(t, ok)
+	_, ok = l2.Get("x")
+	require.False(t, ok)
+	require.Len(t, c.backing.keys, c.Len())
+}
+
+func TestCacheBackingConfig(t *testing.T) {
+	_, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		WriteBack:   true,
+	})
+	require.Error(t, err)
+}
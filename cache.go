@@ -21,8 +21,11 @@ package ristretto
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,20 +37,80 @@ import (
 var (
 	// TODO: find the optimal value for this or make it configurable
 	setBufSize = 32 * 1024
+	// trimBatchSize is the number of items evicted at a time after MaxCost is
+	// lowered, so that the policy isn't locked for long.
+	trimBatchSize = 128
+	// repairBatchSize is the number of keys checked for ghosts on every
+	// cleanup, see repair.
+	repairBatchSize = 256
 )
 
 type itemCallback func(*Item)
 
+// itemSize is the internal cost of an item of a Config.NewMap store, whose
+// entries the cache knows nothing about: the size of the item itself.
 const itemSize = int64(unsafe.Sizeof(storeItem{}))
 
+// mapLoad is the share of the slots of a Go map in use, on average. Maps
+// double once they're 7/8 full, so they're between 7/16 and 7/8 full, and a
+// half errs on the side of overcounting.
+const mapLoad = 0.5
+
+// mapEntryCost estimates the memory taken by an entry of a Go map whose key
+// and value take slot bytes, along with its control byte.
+func mapEntryCost(slot uintptr) int64 {
+	return int64(math.Ceil(float64(slot+1) / mapLoad))
+}
+
+// internalCost estimates the memory taken by the cache for every item, besides
+// the value: the entry of its store, and the cost kept by the policy, which is
+// kept for custom policies too. The entries of the expiration buckets, for
+// items with a TTL, aren't counted. It's 0 with Config.IgnoreInternalCost.
+func internalCost(config *Config) int64 {
+	var cost int64
+	switch {
+	case config.IgnoreInternalCost:
+		return 0
+	case config.NewMap != nil:
+		cost = itemSize
+	case config.StoreEncoded && config.OffHeap:
+		cost = mapEntryCost(unsafe.Sizeof(uint64(0)) + unsafe.Sizeof(slabEntry{}))
+	case config.StoreEncoded:
+		cost = mapEntryCost(unsafe.Sizeof(uint64(0)) + unsafe.Sizeof(arenaEntry{}))
+	default:
+		cost = mapEntryCost(unsafe.Sizeof(uint64(0)) + unsafe.Sizeof(storeItem{}))
+	}
+	cost += mapEntryCost(unsafe.Sizeof(uint64(0)) + unsafe.Sizeof(int64(0)))
+	if config.TrackAge || config.MaxIdle > 0 {
+		cost += mapEntryCost(2*unsafe.Sizeof(uint64(0))) + int64(unsafe.Sizeof(entryAge{}))
+	}
+	return cost
+}
+
 // Cache is a thread-safe implementation of a hashmap with a TinyLFU admission
 // policy and a Sampled LFU eviction policy. You can use the same Cache instance
 // from as many goroutines as you want.
+//
+// A nil *Cache can be used as a cache that's turned off, and a closed one
+// behaves the same: reads miss, Sets report the value as not stored, Dels and
+// the other changes do nothing, callbacks passed to Range and the like aren't
+// called, and the sizes and counters read 0. Calls that return an error, such
+// as SetEntry and SaveTo, return ErrClosed. GetOrCompute calls the loader
+// without caching its value, and a closed cache still goes through to
+// Config.Loader and Config.Writer. Metrics is a field, so it can't be read
+// from a nil cache, but a nil *Metrics reads 0 as well; Close resets the
+// counters like Clear.
 type Cache struct {
 	// store is the central concurrent hashmap where key-value items are stored.
 	store store
 	// policy determines what gets let in to the cache and what gets kicked out.
 	policy policy
+	// shadow runs Config.ShadowPolicy, if set.
+	shadow *shadowPolicy
+	// classifier is Config.Classifier, and classNames the names of the cost
+	// classes of Config.Classes, if set.
+	classifier func(key string) int
+	classNames []string
 	// getBuf is a custom ring buffer implementation that gets pushed to when
 	// keys are read.
 	getBuf *ringBuffer
@@ -58,6 +121,10 @@ type Cache struct {
 	onEvict itemCallback
 	// onReject is called when an item is rejected via admission policy.
 	onReject itemCallback
+	// onExpire is called for items removed because they expired.
+	onExpire itemCallback
+	// callbacks runs onEvict and onExpire, if EvictWorkers is set.
+	callbacks *callbackPool
 	// onExit is called whenever a value goes out of scope from the cache.
 	onExit (func(interface{}))
 	// KeyToHash function is used to customize the key hashing algorithm.
@@ -66,20 +133,129 @@ type Cache struct {
 	keyToHash func(interface{}) (uint64, uint64)
 	// stop is used to stop the processItems goroutine.
 	stop chan struct{}
-	// indicates whether cache is closed.
-	isClosed bool
+	// trim tells the processItems goroutine to evict the items that no longer
+	// fit after MaxCost has been lowered.
+	trim chan struct{}
+	// shed passes the requests of EvictN and EvictCost to the processItems
+	// goroutine.
+	shed chan *shedRequest
+	// done is closed once the cache is closed, releasing any caller blocked on
+	// setBuf.
+	done chan struct{}
+	// closed is set to 1 once Close is called. It's accessed atomically.
+	closed uint32
+	// lifecycleMu serializes Clear and Close, as both have to stop the
+	// processItems goroutine.
+	lifecycleMu sync.Mutex
 	// cost calculates cost from a value.
 	cost func(value interface{}) int64
-	// ignoreInternalCost dictates whether to ignore the cost of internally storing
-	// the item in the cost calculation.
-	ignoreInternalCost bool
+	// internalCost is the cost of internally storing an item, added to the
+	// cost of every item, or 0 if Config.IgnoreInternalCost is set.
+	internalCost int64
+	// maxItemCost is the max cost of an item, if not 0.
+	maxItemCost int64
 	// cleanupTicker is used to periodically check for entries whose TTL has passed.
-	cleanupTicker *time.Ticker
+	cleanupTicker Ticker
+	// clock is where the time comes from, within Config.ClockPrecision.
+	clock *coarseClock
+	// lifeKeys is the number of admission times kept to track life expectancy.
+	lifeKeys int
+	// lifeSampleRate is one in how many keys have their life expectancy
+	// tracked.
+	lifeSampleRate uint64
+	// metricsLabels are the formatted labels for MetricsHandler.
+	metricsLabels string
+	// metricsName is the name the metrics are published under, if any.
+	metricsName string
+	// logger gets the events of the cache, and the LogDebug ones too if
+	// logDebug is set, which the callers check first so that nothing is built
+	// for the events skipped.
+	logger   Logger
+	logDebug bool
+	// tracer is Config.Tracer.
+	tracer Tracer
+	// order keeps the updates of a key in the same order in the store and
+	// the policy.
+	order setOrder
+	// ages holds when the items were set and last read, if Config.TrackAge or
+	// Config.MaxIdle is set.
+	ages *ageIndex
+	// maxIdle is Config.MaxIdle.
+	maxIdle time.Duration
+	// victims holds the last evicted items, if Config.VictimCacheSize is set.
+	victims *victimCache
+	// negativeTTL and negativeCost are the TTL and cost of the entries set
+	// by SetNegative.
+	negativeTTL  time.Duration
+	negativeCost int64
+	// hintWeight is the frequency up to which Hint raises a key.
+	hintWeight int64
+	// latency times the sampled operations, if Config.SampleLatency is set.
+	latency *latencySampler
+	// admissions keeps the decisions sampled by Config.TraceAdmissions, if
+	// set.
+	admissions *admissionTrace
+	// synchronous is Config.Synchronous.
+	synchronous bool
+	// blockingSets is Config.BlockingSets.
+	blockingSets bool
+	// pending holds the buffered Sets of new keys for Config.ReadYourWrites,
+	// if set.
+	pending *pendingSets
+	// defaultTTL is the TTL of the items set without one.
+	defaultTTL time.Duration
+	// calls are the GetOrCompute loads in flight.
+	calls *calls
+	// tags indexes the keys by the tags given to SetWithOptions.
+	tags *tagIndex
+	// events sends the events to the subscribers. See Subscribe.
+	events *eventHub
+	// backing is the second-level store behind the cache, if any.
+	backing *backing
+	// loader and writer are the Config.Loader and Config.Writer of
+	// ReadThrough and SetThrough.
+	loader func(key interface{}) (interface{}, int64, error)
+	writer func(key, value interface{}) error
+	// writeLocks serializes the SetThroughs of each key.
+	writeLocks writeLocks
+	// namespaces are the views returned by Namespace.
+	namespaces namespaces
+	// pressure is the degradation set by SetPressure.
+	pressure pressureState
+	// frozen is set by Freeze, once writers, the number of writes running,
+	// drops to zero. frozenMap then holds the *frozenMap Gets read from.
+	frozen    uint32
+	writers   int32
+	frozenMap atomic.Value
+	// draining is set while Drain runs, holding drainMu, which writes wait
+	// for.
+	draining uint32
+	drainMu  sync.Mutex
+	// propagateLoaderCancel passes the caller's context to loaders as is.
+	propagateLoaderCancel bool
+	// freshFor and staleFor are the ages at which values loaded by
+	// GetOrCompute become stale and expire. freshFor is 0 if stale values
+	// aren't served.
+	freshFor time.Duration
+	staleFor time.Duration
+	// encodeValue and decodeValue convert values for snapshots, and for the
+	// store if storeEncoded is set.
+	encodeValue  func(value interface{}) ([]byte, error)
+	decodeValue  func(data []byte) (interface{}, error)
+	storeEncoded bool
+	// copyOnRead is Config.CopyOnRead.
+	copyOnRead bool
+	// params are the parameters of the config, served by DebugHandler.
+	params ConfigParams
 	// Metrics contains a running log of important statistics like hits, misses,
 	// and dropped items.
 	Metrics *Metrics
 }
 
+// defaultBufferItems is the size of the Get buffer stripes when
+// Config.BufferItems is zero.
+const defaultBufferItems = 64
+
 // Config is passed to NewCache for creating new Cache instances.
 type Config struct {
 	// NumCounters determines the number of counters (keys) to keep that hold
@@ -94,6 +270,22 @@ type Config struct {
 	// internally rounded up to the nearest power of 2, so the space usage
 	// may be a little larger than 3 bytes * NumCounters.
 	NumCounters int64
+	// DoorkeeperBits is the size, in bits, of the doorkeeper: a bloom filter
+	// in front of the access counters that absorbs the first access to each
+	// key, so that keys seen only once don't pollute the counters. It's
+	// cleared every time the counters are halved.
+	//
+	// When zero, the doorkeeper is sized for NumCounters keys with a 1% false
+	// positive rate, which takes about a byte per counter. Set it to a
+	// negative value to disable the doorkeeper.
+	DoorkeeperBits int64
+	// AgingFactor controls how quickly access counters forget old traffic:
+	// all counters are halved (and the doorkeeper cleared) every
+	// AgingFactor * NumCounters recorded Gets, so a key that was hot a while
+	// ago doesn't keep beating the keys that are hot now. Lower values adapt
+	// faster to changing traffic but remember less. It defaults to 1 when
+	// zero.
+	AgingFactor float64
 	// MaxCost can be considered as the cache capacity, in whatever units you
 	// choose to use.
 	//
@@ -103,38 +295,379 @@ type Config struct {
 	// eviction process will take care of making room for the new item and not
 	// overflowing the MaxCost value.
 	MaxCost int64
-	// BufferItems determines the size of Get buffers.
+	// MaxEntries is the max number of items in the cache, on top of MaxCost,
+	// for bounding the memory taken by the items themselves when they're
+	// small. Items are evicted as soon as either limit would be exceeded. 0
+	// means there's no limit on the number of items.
+	MaxEntries int64
+	// HighWatermark and LowWatermark batch the evictions made for new items.
+	// Once admitting one would take the cost of the items over HighWatermark
+	// times MaxCost, items are evicted until it's down to LowWatermark times
+	// MaxCost, in one go, instead of one victim at a time. New items are then
+	// admitted without evicting until the high watermark is hit again. Both
+	// are shares of MaxCost between 0 and 1: HighWatermark defaults to 1 and
+	// LowWatermark to HighWatermark, which evicts just what each new item
+	// needs. Replacing values and UpdateCost only evict down to the high
+	// watermark, and MaxEntries isn't batched.
+	HighWatermark float64
+	LowWatermark  float64
+	// MinResidency keeps the items admitted less than that long ago from
+	// being picked as eviction victims, so that an item written and then read
+	// shortly after isn't evicted in between by the items written after it.
+	// MinResidencyAdmissions does the same for the items admitted less than
+	// that many items ago. With both set, an item is young until both have
+	// passed. Young items are still evicted when every item that isn't pinned
+	// is young, and they can still be rejected when they're new. 0, the
+	// default, protects no item.
+	MinResidency           time.Duration
+	MinResidencyAdmissions int64
+	// StoreShards is the number of independently locked maps the items are
+	// spread over, which must be a power of two. More shards make Sets, Gets
+	// and Dels of different keys less likely to wait for each other. By
+	// default, it's the power of two at or above 4 per GOMAXPROCS, and at
+	// least 256.
+	StoreShards int
+	// NewMap, if set, returns the Map the items are held in, in place of the
+	// default sharded map, such as NewSyncMap for read-mostly workloads.
+	// StoreShards can't be set along with it.
+	NewMap func() Map
+	// MaxItemCost is the max cost of a single item, not counting its internal
+	// cost. Bigger items are rejected before reaching the policy, so that
+	// admitting one doesn't evict most of the cache, and counted in
+	// Metrics.SetsRejectedTooLarge. 0 means there's no per-item limit.
+	MaxItemCost int64
+	// EvictionSamples is the number of resident keys sampled when looking for
+	// an eviction victim; the least frequently used key of the sample is
+	// evicted. Larger samples get closer to an exact LFU at the cost of slower
+	// evictions. It defaults to 5 when zero.
+	EvictionSamples int
+	// TraceAdmissions, when positive, records one in every TraceAdmissions
+	// admission decisions of new keys for which there isn't room, picked at
+	// random, for Cache.AdmissionTrace: the frequency estimates of the key
+	// and of the victims it was compared with, and the outcome. The other
+	// decisions only draw a random number.
+	TraceAdmissions int
+	// Policy, if set, creates the policy that picks eviction victims in place
+	// of the default TinyLFU admission and Sampled LFU eviction, for example
+	// NewClockPolicy. It's called with NumCounters and MaxCost.
+	// DoorkeeperBits, EvictionSamples and TraceAdmissions only apply to the
+	// default policy.
+	Policy func(numCounters, maxCost int64) Policy
+	// ShadowPolicy, if set, creates a policy that runs in the shadow of the
+	// one picking the victims, to see how it would do on the same traffic
+	// without acting on its decisions. It's called like Policy, and told
+	// about the same accesses, Sets, Dels and expirations, and the cache
+	// keeps the keys it would have let in, up to MaxCost and MaxEntries, but
+	// not their values. Every Get of the cache is counted as a hit or a miss
+	// of the shadow, for Metrics.ShadowRatio. It requires Metrics.
+	ShadowPolicy func(numCounters, maxCost int64) Policy
+	// Classifier, if set, sorts the keys into the classes of Classes, by
+	// index: keys that aren't strings, and indexes out of range, go to the
+	// first one. The keys of a class only take their share of MaxCost, and
+	// only evict each other, picked by the policy of the class, while every
+	// class shares the hashmap and the buffers of the cache. The class of a
+	// key is decided when it's first Set, and it keeps it until it leaves the
+	// cache. The keys of namespaces aren't classified. It requires Classes.
+	Classifier func(key string) int
+	// Classes are the key classes of Classifier. Their shares can't add up to
+	// more than 1. Policy and the options of the default policy apply to the
+	// keys outside of every class, such as those of namespaces.
+	Classes []KeyClass
+	// BufferItems determines the size of Get buffers. It's the number of keys
+	// each buffer stripe accumulates before handing them over to the policy as
+	// a single batch.
 	//
 	// Unless you have a rare use case, using `64` as the BufferItems value
-	// results in good performance.
+	// results in good performance. It defaults to 64 when zero.
 	BufferItems int64
+	// BufferStripes is the number of stripes the Get buffer is split into when
+	// BufferMode is BufferLossless or BufferBlocking. More stripes mean less
+	// contention on Get at the cost of more memory. It defaults to GOMAXPROCS
+	// when zero. Lossy buffers always use one stripe per processor.
+	BufferStripes int
+	// BufferMode determines whether the Get buffers may drop access records
+	// when the policy is busy. The default, BufferLossy, is the fastest. Use
+	// BufferLossless when exact access counts matter more than throughput, for
+	// example with small hot sets or when benchmarking policies.
+	BufferMode BufferMode
+	// BufferTimeout is how long a Get waits for the policy to take a full
+	// stripe with BufferBlocking. 0 means as long as it takes.
+	BufferTimeout time.Duration
+	// OnBufferDrop is called with the number of access records dropped
+	// whenever a lossy Get buffer can't hand a batch over to the policy. It
+	// runs on the Get path, so it should be cheap. Dropped records are also
+	// counted by Metrics.GetsDropped.
+	OnBufferDrop func(n int)
+	// SetBufferItems is the number of Sets, and of Dels and cost updates, the
+	// Set buffer holds until the policy applies them. It defaults to 32768
+	// when zero.
+	SetBufferItems int
+	// BlockingSets makes a Set finding the Set buffer full wait for room,
+	// rather than being dropped and counted by Metrics.SetsDropped. Sets
+	// still return before the policy decides whether to admit their item.
+	BlockingSets bool
+	// ReadYourWrites makes a Get find the value of a Set still in the Set
+	// buffer, so that a goroutine getting a key it just Set doesn't miss. The
+	// value is served until the policy applies the Set; if it rejects the
+	// item, Gets miss from then on. It costs the Sets of new keys a map
+	// insert, and Gets that miss a map lookup.
+	ReadYourWrites bool
+	// Synchronous applies every operation to the policy before returning from
+	// it, bypassing the buffers: Gets record their access right away, and
+	// Sets, Dels and UpdateCosts wait for the admission and evictions they
+	// cause, as if followed by Wait. Nothing is dropped, so the policy sees
+	// exactly the operations made, in order, which makes its decisions
+	// reproducible in tests. It's much slower than the buffered path, and
+	// callbacks run while it waits mustn't call into the cache unless
+	// EvictWorkers hands them over to other goroutines.
+	Synchronous bool
+	// Seed, if not 0, seeds the randomness of the default policy: where the
+	// eviction candidates are picked from, which otherwise follows the random
+	// order Go iterates over maps in, and the seeds of the rows of the
+	// frequency sketch, otherwise drawn from the time. Along with
+	// Synchronous, the same operations made in the same order on caches with
+	// the same Config then give the same admissions, rejections and
+	// evictions, so that a recorded trace replays the same way.
+	//
+	// The guarantee only holds with Synchronous: the buffers drop Gets and
+	// Sets depending on the timing of the goroutines, which no seed fixes.
+	// Nor does it hold for the items expiring within the same second, which
+	// are removed in any order, for a Policy, which has a randomness of its
+	// own, such as the seed of NewRandomPolicy, or across processes for
+	// string and []byte keys, whose hashes from the default KeyToHash depend
+	// on a seed picked by every process. The seeds spreading the keys over
+	// the hashmap shards stay random, as they don't change what's stored, and
+	// so does the sampling done for the metrics and traces.
+	Seed int64
 	// Metrics determines whether cache statistics are kept during the cache's
 	// lifetime. There *is* some overhead to keeping statistics, so you should
 	// only set this flag to true when testing or throughput performance isn't a
 	// major factor.
 	Metrics bool
+	// LifeExpectancyKeys is the maximum number of admission times remembered
+	// to compute Metrics.LifeExpectancySeconds. Past that, the admission times
+	// of random keys are forgotten; the other metrics aren't affected. It
+	// defaults to 100,000 when zero.
+	LifeExpectancyKeys int
+	// LifeExpectancySampleRate, when greater than 1, only tracks the life
+	// expectancy of one in every LifeExpectancySampleRate keys, picked by
+	// their hash, to spend less memory and time on it. The other metrics are
+	// still exact.
+	LifeExpectancySampleRate int
+	// Logger, if set, is given the noteworthy events of the cache, such as
+	// changes of MaxCost, passes of the cleanup of expired items, or failures
+	// to load a snapshot.
+	Logger Logger
+	// Tracer, if set, is told when Gets, Sets, Dels and loads start and end,
+	// to trace them. See Tracer.
+	Tracer Tracer
+	// LogDebug also gives the LogDebug events to Logger, some of which happen
+	// while serving Gets and Sets, such as dropped Gets and Sets or key
+	// conflicts. Without it, they're skipped before anything is built.
+	LogDebug bool
+	// RatioWindow, if set along with Metrics, also counts the hits and misses
+	// of every interval of this length, for Metrics.RatioWindow. Intervals
+	// start on multiples of RatioWindow since the Unix epoch of the Clock.
+	RatioWindow time.Duration
+	// RatioWindowBuckets is the number of intervals of RatioWindow kept, 60
+	// when zero, which bounds the length of time Metrics.RatioWindow can
+	// cover.
+	RatioWindowBuckets int
+	// CostBuckets are the upper bounds of the buckets of
+	// Metrics.CostHistogram, positive and in ascending order. They're the
+	// powers of two from 64 to 64M when empty. Metrics has to be set too.
+	CostBuckets []int64
+	// SampleLatency, when positive, times the phases of one in every
+	// SampleLatency Gets and Sets, picked at random, and of the callbacks,
+	// for Metrics.Latency: the lookup in the store, the hand-off to the
+	// buffers, the admission by the policy and the callbacks themselves. The
+	// operations that aren't sampled only draw a random number. Metrics has
+	// to be set too.
+	SampleLatency int
+	// MetricsLabels are the labels attached to the metrics served by
+	// Cache.MetricsHandler, to tell caches apart.
+	MetricsLabels map[string]string
+	// MetricsName, if set, publishes the metrics with expvar under this name.
+	// Only one open cache can hold it at a time, Close freeing it for the
+	// next one, and Metrics has to be set too.
+	MetricsName string
 	// OnEvict is called for every eviction and passes the hashed key, value,
-	// and cost to the function.
+	// and cost to the function. Items removed because they expired aren't
+	// evicted, and go to OnExpire instead.
 	OnEvict func(item *Item)
+	// OnExpire is called for every item removed because its TTL has passed.
+	// Every item leaving the cache on its own is passed to exactly one of
+	// OnEvict and OnExpire, once.
+	OnExpire func(item *Item)
+	// EvictWorkers is the number of goroutines calling OnEvict and OnExpire
+	// (and OnExit for their values), so that slow callbacks don't hold up the
+	// Sets. A single worker calls them in order. By default, they're called
+	// by the goroutine applying the Sets, before Wait returns. Close waits for
+	// the queued callbacks to be called.
+	EvictWorkers int
+	// EvictQueueSize is the number of callbacks queued for EvictWorkers, 1024
+	// by default.
+	EvictQueueSize int
+	// DropEvictCallbacks skips OnEvict and OnExpire when the EvictWorkers
+	// queue is full, rather than waiting for room, and counts them in
+	// Metrics.CallbacksDropped. OnExit is still called for their values.
+	DropEvictCallbacks bool
 	// OnReject is called for every rejection done via the policy.
 	OnReject func(item *Item)
 	// OnExit is called whenever a value is removed from cache. This can be
 	// used to do manual memory deallocation. Would also be called on eviction
-	// and rejection of the value.
+	// and rejection of the value. RefCounted values are released right after
+	// it, so OnExit can still use them.
 	OnExit func(val interface{})
 	// KeyToHash function is used to customize the key hashing algorithm.
 	// Each key will be hashed using the provided function. If keyToHash value
 	// is not set, the default keyToHash function is used.
 	KeyToHash func(key interface{}) (uint64, uint64)
 	// Cost evaluates a value and outputs a corresponding cost. This function
-	// is ran after Set is called for a new item or an item update with a cost
-	// param of 0.
+	// is ran after Set is called for a new item with a cost param of 0, from
+	// the goroutine applying the Sets but outside of the policy's lock, and by
+	// Set itself for an update of a key in the cache. A cost that isn't
+	// positive rejects the item, and counts it in Metrics.SetsRejectedByCost;
+	// a rejected update leaves the old value in place. So does a panic, which
+	// is recovered like those of the other callbacks.
 	Cost func(value interface{}) int64
 	// IgnoreInternalCost set to true indicates to the cache that the cost of
 	// internally storing the value should be ignored. This is useful when the
 	// cost passed to set is not using bytes as units. Keep in mind that setting
 	// this to true will increase the memory usage.
+	//
+	// Otherwise every item is charged an estimate of the memory taken by its
+	// entries in the store and the policy, in bytes, on top of its cost: a
+	// bit over 100 bytes with the built-in stores, or the size of the item
+	// with Config.NewMap. Metrics.InternalCostAdded tells it apart from the
+	// costs of the values.
 	IgnoreInternalCost bool
+	// Clock is where the cache gets the time from, to expire items and track
+	// their life expectancy. It defaults to the system clock; tests can use a
+	// MockClock to control time.
+	Clock Clock
+	// ClockPrecision is how often the cache refreshes the time it reads from
+	// the system clock. Gets and Sets read the time to expire items, and
+	// caching it spares them a call to time.Now, so items may expire up to
+	// ClockPrecision early or late, on top of expiration times being kept to
+	// the second. It defaults to 10ms; set it to a negative value for the cache
+	// to read the clock every time. Clocks other than the system clock, such
+	// as a MockClock, are always read every time.
+	ClockPrecision time.Duration
+	// DefaultTTL is the TTL of the items added by Set and the other methods
+	// that don't take one, such as SetMulti, SetForce, SetIfAbsent, Warm and
+	// GetOrCompute. SetWithTTL still uses its own, so a ttl of 0 sets an item
+	// that never expires. Items restored by LoadCache keep the expiration
+	// time they were saved with. Zero, the default, means no expiration.
+	DefaultTTL time.Duration
+	// NegativeTTL is the TTL of the entries added by SetNegative with a ttl
+	// of 0, usually shorter than DefaultTTL so that keys showing up in the
+	// underlying data are soon found. Zero, the default, means DefaultTTL.
+	NegativeTTL time.Duration
+	// NegativeCost is the cost of the entries added by SetNegative. It
+	// defaults to 1 when zero.
+	NegativeCost int64
+	// VictimCacheSize is the number of the last evicted items kept aside, so
+	// that a Get of one of them finds its value still, and Sets it again
+	// through admission. The items don't count against MaxCost. Items that
+	// were deleted, expired, or set with tags or through a Namespace are
+	// never kept, and the values are only passed to OnExit once they leave
+	// the victim cache. Zero, the default, keeps none.
+	VictimCacheSize int
+	// HintWeight is the estimated access frequency up to which Hint raises a
+	// key, so that hints alone can't make a key look more popular than that
+	// many Gets would. It defaults to 1: a hinted key competes for admission
+	// like a key seen once. Hints have no effect with a custom Policy.
+	HintWeight int64
+	// TrackAge keeps the time every item was set and last read by a Get, to the
+	// second, for Cache.AgeReport. It takes 24 bytes per item, plus an entry of
+	// the index holding them, counted in the internal cost.
+	TrackAge bool
+	// MaxIdle expires the items that haven't been read by a Get for that long,
+	// to the second, on top of any TTL: whichever comes first wins. Touch and
+	// GetAndTouch count as reads, Sets of a key already in the cache and Peek
+	// don't. SetOptions.MaxIdle overrides it for an item. Idle items miss right
+	// away, and are deleted along with expired ones, calling OnExpire. It keeps
+	// the read times like TrackAge does, at the same cost. 0, the default,
+	// never expires idle items.
+	MaxIdle time.Duration
+	// PropagateLoaderCancel passes the context of the GetOrComputeCtx call that
+	// starts a load to the loader as is, so cancelling it fails the load for
+	// every caller waiting on it. By default the loader gets a context with
+	// the same values that is only cancelled once no caller waits for the
+	// load anymore.
+	PropagateLoaderCancel bool
+	// FreshFor and StaleFor make GetOrCompute serve stale values while they're
+	// refreshed in the background. A value loaded by GetOrCompute is returned
+	// as is for FreshFor. Then, until StaleFor has passed since it was loaded,
+	// it's still returned right away, but the first call to find it stale also
+	// starts a load in the background that replaces it. If the load fails,
+	// the stale value stays, and the next call tries again. Past StaleFor, the
+	// value expires and callers wait for a load as on any miss. Loaded values
+	// get StaleFor as their TTL instead of DefaultTTL, and like TTLs, ages are
+	// counted in seconds. Values Set by other means are fresh until they
+	// expire. StaleFor must be longer than FreshFor.
+	FreshFor time.Duration
+	StaleFor time.Duration
+	// EncodeValue turns a value into bytes for Cache.SaveTo.
+	EncodeValue func(value interface{}) ([]byte, error)
+	// DecodeValue turns the bytes written by EncodeValue back into a value for
+	// LoadCache.
+	DecodeValue func(data []byte) (interface{}, error)
+	// StoreEncoded, if set, keeps the values encoded with EncodeValue in the
+	// store rather than as they are, and decodes them with DecodeValue on the
+	// way out. The encoded values are packed in large byte slices indexed by
+	// entries without pointers, so millions of items don't leave millions of
+	// pointers for the garbage collector to scan, at the cost of encoding
+	// every Set and decoding every Get. A Set whose value fails to encode
+	// returns false, and a value that fails to decode is reported missing.
+	// Callbacks, Range and Del are still given the values as they were Set,
+	// or decoded. Without Cost or Config.Cost, an item costs the length of its
+	// encoded value. It requires both EncodeValue and DecodeValue, and can't
+	// be used with NewMap.
+	StoreEncoded bool
+	// OffHeap, along with StoreEncoded, keeps the encoded values in slabs of
+	// fixed-size slots allocated with z.Calloc, which are out of the Go heap
+	// when built with the jemalloc tag, rather than in Go byte slices. A
+	// value takes a slot of the smallest power of two that fits it, from 16
+	// bytes to 1MB, or a block of its own if it's larger, and the slot is
+	// reused once the value is gone. Gets copy the value out of its slot
+	// before decoding it. Close the cache to give the memory back.
+	OffHeap bool
+	// CopyOnRead, if set, has Gets return a copy of the []byte values and of
+	// the values implementing Cloner, so that callers changing them don't
+	// change the cached value under the other readers. The []byte copies are
+	// taken from pools of buffers, which callers can give back with
+	// Cache.Release, and the bytes copied are counted in Metrics. Other values
+	// are returned as they are. Cache.GetCopy copies without it.
+	CopyOnRead bool
+	// Backing, if set, is a second-level store behind the cache. A Get that
+	// misses looks the key up in Backing, and Sets the value it finds, which
+	// still goes through admission, before returning it. Del deletes the key
+	// from Backing first, and then from the cache. GetLocal and DelLocal skip
+	// Backing, and so do the other lookups and deletions, which only have the
+	// hashes of the keys, such as GetMulti, Peek, DelFunc, InvalidateTag and
+	// the uint64 key methods.
+	//
+	// The cache and Backing aren't updated atomically: a Get that misses
+	// concurrently with a Del can bring back the value Del is deleting, and
+	// a Set only reaches Backing once its value leaves the cache, and only if
+	// WriteBack is set.
+	Backing BackingStore
+	// WriteBack writes the values evicted from the cache, or rejected by it,
+	// to Backing, so that it holds every value Set. They're written by the
+	// OnEvict and OnReject callbacks, so a Get that misses before the write
+	// doesn't find the value in either place. Values that expire, or are
+	// removed by Clear or Close, aren't written back, nor are items set
+	// without their original key, such as those of LoadCache and SetUint.
+	// The original keys of the items are only kept when WriteBack is set.
+	WriteBack bool
+	// Loader loads the value of a key missing from the cache, along with its
+	// cost, for ReadThrough. It returns ErrNotFound if the key doesn't exist.
+	Loader func(key interface{}) (value interface{}, cost int64, err error)
+	// Writer persists a value for SetThrough, which only caches it if Writer
+	// succeeds.
+	Writer func(key, value interface{}) error
 }
 
 type itemFlag byte
@@ -143,6 +676,8 @@ const (
 	itemNew itemFlag = iota
 	itemDelete
 	itemUpdate
+	// itemCost only changes the cost of a key, see UpdateCost.
+	itemCost
 )
 
 // Item is passed to setBuf so items can eventually be added to the cache.
@@ -153,53 +688,446 @@ type Item struct {
 	Value      interface{}
 	Cost       int64
 	Expiration int64
-	wg         *sync.WaitGroup
+	wait       chan struct{}
+	// force skips admission, see SetForce.
+	force bool
+	// replace, set on an itemDelete of Replace, leaves the key if an update
+	// written after the deletion is pending.
+	replace bool
+	// ifAbsent, if set, only lets the item in if its key isn't in the cache
+	// yet, and receives the outcome. See SetIfAbsent.
+	ifAbsent chan setOutcome
+	// tags replace the tags of the key once the item is stored. See
+	// SetWithOptions.
+	tags []string
+	// priority is passed on to a PriorityPolicy once the item is stored, if
+	// it isn't 0.
+	priority float64
+	// maxIdle is SetOptions.MaxIdle.
+	maxIdle time.Duration
+	// origKey is the original key of the item, for Config.WriteBack, if known.
+	origKey interface{}
+	// ns is the namespace of the item, if any. It's only known for the items
+	// Set through one and for evicted items.
+	ns *Namespace
+	// encoded is the value encoded for Config.StoreEncoded, if it is.
+	encoded []byte
+	// victim is set for an evicted item kept by the victim cache, which passes
+	// the value to onExit once it's done with it.
+	victim bool
+	// sampled is set for a Set timed by Config.SampleLatency.
+	sampled bool
+	// entry receives the outcome of a SetEntry.
+	entry *entryResult
+	// group, if set, holds the items of a SetGroup, which this item only
+	// carries through the Set buffer.
+	group *itemGroup
+	// batch, if set, holds the keys of a DelMulti, which this item only
+	// carries through the Set buffer.
+	batch *delBatch
+	// sets, if set, holds the items of a SetMulti for the keys that weren't in
+	// the cache, which this item only carries through the Set buffer.
+	sets []*Item
+}
+
+type setOutcome byte
+
+const (
+	setStored setOutcome = iota
+	setExists
+	setRejected
+)
+
+// report sends the outcome of a SetIfAbsent or a SetEntry, if the item comes
+// from one.
+func (i *Item) report(outcome setOutcome) {
+	if i.ifAbsent != nil {
+		i.ifAbsent <- outcome
+	}
+	if e := i.entry; e != nil {
+		e.Stored = outcome == setStored
+		if i.flag == itemUpdate {
+			e.Updated = e.Stored
+		}
+		close(e.done)
+	}
+}
+
+// MustNewCache works like NewCache, but panics on configuration errors, for
+// caches configured with constants.
+func MustNewCache(config *Config) *Cache {
+	c, err := NewCache(config)
+	if err != nil {
+		panic("ristretto: " + err.Error())
+	}
+	return c
 }
 
 // NewCache returns a new Cache instance and any configuration errors, if any.
+// The configuration errors name the field of Config at fault, along with its
+// value.
 func NewCache(config *Config) (*Cache, error) {
 	switch {
-	case config.NumCounters == 0:
-		return nil, errors.New("NumCounters can't be zero")
-	case config.MaxCost == 0:
-		return nil, errors.New("MaxCost can't be zero")
-	case config.BufferItems == 0:
-		return nil, errors.New("BufferItems can't be zero")
-	}
-	policy := newPolicy(config.NumCounters, config.MaxCost)
+	case config == nil:
+		return nil, errors.New("Config can't be nil")
+	case config.NumCounters <= 0:
+		return nil, fmt.Errorf("NumCounters must be positive, got %d", config.NumCounters)
+	case config.MaxCost <= 0:
+		return nil, fmt.Errorf("MaxCost must be positive, got %d", config.MaxCost)
+	case config.MaxEntries < 0:
+		return nil, fmt.Errorf("MaxEntries can't be negative, got %v", config.MaxEntries)
+	case config.MaxItemCost < 0:
+		return nil, fmt.Errorf("MaxItemCost can't be negative, got %v", config.MaxItemCost)
+	case config.StoreShards < 0 || config.StoreShards&(config.StoreShards-1) != 0:
+		return nil, fmt.Errorf("StoreShards must be a power of two, got %d", config.StoreShards)
+	case config.StoreShards != 0 && config.NewMap != nil:
+		return nil, errors.New("StoreShards can't be set with NewMap")
+	case config.StoreEncoded && (config.EncodeValue == nil || config.DecodeValue == nil):
+		return nil, errors.New("StoreEncoded requires EncodeValue and DecodeValue")
+	case config.StoreEncoded && config.NewMap != nil:
+		return nil, errors.New("StoreEncoded can't be set with NewMap")
+	case config.OffHeap && !config.StoreEncoded:
+		return nil, errors.New("OffHeap requires StoreEncoded")
+	case config.EvictWorkers < 0:
+		return nil, fmt.Errorf("EvictWorkers can't be negative, got %v", config.EvictWorkers)
+	case config.EvictQueueSize < 0:
+		return nil, fmt.Errorf("EvictQueueSize can't be negative, got %v", config.EvictQueueSize)
+	case config.BufferItems < 0:
+		return nil, fmt.Errorf("BufferItems can't be negative, got %d", config.BufferItems)
+	case config.BufferMode < BufferLossy || config.BufferMode > BufferBlocking:
+		return nil, fmt.Errorf("unknown BufferMode %d", config.BufferMode)
+	case config.BufferTimeout < 0:
+		return nil, fmt.Errorf("BufferTimeout can't be negative, got %v", config.BufferTimeout)
+	case config.BufferTimeout != 0 && config.BufferMode != BufferBlocking:
+		return nil, errors.New("BufferTimeout requires BufferMode BufferBlocking")
+	case config.Synchronous && config.BufferMode != BufferLossy:
+		return nil, errors.New("Synchronous can't be set with BufferMode")
+	case config.SetBufferItems < 0:
+		return nil, fmt.Errorf("SetBufferItems can't be negative, got %v", config.SetBufferItems)
+	case config.BufferStripes < 0:
+		return nil, fmt.Errorf("BufferStripes can't be negative, got %v", config.BufferStripes)
+	case config.EvictionSamples < 0:
+		return nil, fmt.Errorf("EvictionSamples can't be negative, got %v", config.EvictionSamples)
+	case config.TraceAdmissions < 0:
+		return nil, fmt.Errorf("TraceAdmissions can't be negative, got %v", config.TraceAdmissions)
+	case config.AgingFactor < 0:
+		return nil, fmt.Errorf("AgingFactor can't be negative, got %v", config.AgingFactor)
+	case config.HighWatermark < 0 || config.HighWatermark > 1:
+		return nil, fmt.Errorf("HighWatermark must be between 0 and 1, got %v", config.HighWatermark)
+	case config.LowWatermark < 0 || config.LowWatermark > 1:
+		return nil, fmt.Errorf("LowWatermark must be between 0 and 1, got %v", config.LowWatermark)
+	case config.HighWatermark != 0 && config.LowWatermark > config.HighWatermark:
+		return nil, fmt.Errorf("LowWatermark can't be over HighWatermark, got %v and %v",
+			config.LowWatermark, config.HighWatermark)
+	case config.MinResidency < 0:
+		return nil, fmt.Errorf("MinResidency can't be negative, got %v", config.MinResidency)
+	case config.MinResidencyAdmissions < 0:
+		return nil, fmt.Errorf("MinResidencyAdmissions can't be negative, got %v",
+			config.MinResidencyAdmissions)
+	case config.LifeExpectancyKeys < 0:
+		return nil, fmt.Errorf("LifeExpectancyKeys can't be negative, got %v", config.LifeExpectancyKeys)
+	case config.LifeExpectancySampleRate < 0:
+		return nil, fmt.Errorf("LifeExpectancySampleRate can't be negative, got %v", config.LifeExpectancySampleRate)
+	case config.DefaultTTL < 0:
+		return nil, fmt.Errorf("DefaultTTL can't be negative, got %v", config.DefaultTTL)
+	case config.NegativeTTL < 0:
+		return nil, fmt.Errorf("NegativeTTL can't be negative, got %v", config.NegativeTTL)
+	case config.NegativeCost < 0:
+		return nil, fmt.Errorf("NegativeCost can't be negative, got %v", config.NegativeCost)
+	case config.VictimCacheSize < 0:
+		return nil, fmt.Errorf("VictimCacheSize can't be negative, got %v", config.VictimCacheSize)
+	case config.MaxIdle < 0:
+		return nil, fmt.Errorf("MaxIdle can't be negative, got %v", config.MaxIdle)
+	case config.HintWeight < 0:
+		return nil, fmt.Errorf("HintWeight can't be negative, got %v", config.HintWeight)
+	case config.MetricsName != "" && !config.Metrics:
+		return nil, errors.New("MetricsName requires Metrics")
+	case !validCostBuckets(config.CostBuckets):
+		return nil, errors.New("CostBuckets must be positive and ascending")
+	case len(config.CostBuckets) > 0 && !config.Metrics:
+		return nil, errors.New("CostBuckets requires Metrics")
+	case config.SampleLatency < 0:
+		return nil, fmt.Errorf("SampleLatency can't be negative, got %v", config.SampleLatency)
+	case config.SampleLatency != 0 && !config.Metrics:
+		return nil, errors.New("SampleLatency requires Metrics")
+	case config.RatioWindow < 0:
+		return nil, fmt.Errorf("RatioWindow can't be negative, got %v", config.RatioWindow)
+	case config.RatioWindowBuckets < 0:
+		return nil, fmt.Errorf("RatioWindowBuckets can't be negative, got %v", config.RatioWindowBuckets)
+	case config.RatioWindow != 0 && !config.Metrics:
+		return nil, errors.New("RatioWindow requires Metrics")
+	case config.RatioWindowBuckets != 0 && config.RatioWindow == 0:
+		return nil, errors.New("RatioWindowBuckets requires RatioWindow")
+	case config.FreshFor < 0:
+		return nil, fmt.Errorf("FreshFor can't be negative, got %v", config.FreshFor)
+	case config.StaleFor != 0 && config.FreshFor == 0:
+		return nil, errors.New("StaleFor requires FreshFor")
+	case config.FreshFor > 0 && config.StaleFor <= config.FreshFor:
+		return nil, fmt.Errorf("StaleFor must be longer than FreshFor, got %v and %v",
+			config.StaleFor, config.FreshFor)
+	case config.WriteBack && config.Backing == nil:
+		return nil, errors.New("WriteBack requires Backing")
+	case config.ShadowPolicy != nil && !config.Metrics:
+		return nil, errors.New("ShadowPolicy requires Metrics")
+	case config.Classifier != nil && len(config.Classes) == 0:
+		return nil, errors.New("Classifier requires Classes")
+	case len(config.Classes) > 0 && config.Classifier == nil:
+		return nil, errors.New("Classes requires Classifier")
+	case !validClasses(config.Classes):
+		return nil, errors.New("the Shares of Classes must be positive and add up to 1 at most")
+	}
+	var policy policy
+	if config.Policy != nil {
+		custom := config.Policy(config.NumCounters, config.MaxCost)
+		if custom == nil {
+			return nil, errors.New("Policy returned a nil Policy")
+		}
+		policy = newCustomPolicy(custom, config.MaxCost, config.MaxEntries)
+	} else {
+		policy = newPolicy(config.NumCounters, config.MaxCost, config.MaxEntries,
+			config.DoorkeeperBits, config.EvictionSamples, config.AgingFactor)
+	}
+	var classNames []string
+	if len(config.Classes) > 0 {
+		classPolicies, err := newClassPolicies(config.Classes, config.NumCounters, config.MaxCost)
+		if err != nil {
+			policy.Close()
+			return nil, err
+		}
+		shares := make([]float64, len(config.Classes))
+		classNames = make([]string, len(config.Classes))
+		for i, class := range config.Classes {
+			shares[i], classNames[i] = class.Share, keyClassName(i)
+		}
+		policy.SetKeyClasses(classPolicies, shares)
+	}
+	var shadow Policy
+	if config.ShadowPolicy != nil {
+		if shadow = config.ShadowPolicy(config.NumCounters, config.MaxCost); shadow == nil {
+			policy.Close()
+			return nil, errors.New("ShadowPolicy returned a nil Policy")
+		}
+	}
+	if config.HighWatermark != 0 || config.LowWatermark != 0 {
+		high := config.HighWatermark
+		if high == 0 {
+			high = 1
+		}
+		low := config.LowWatermark
+		if low == 0 {
+			low = high
+		}
+		policy.SetWatermarks(high, low)
+	}
+	var clock Clock = systemClock{}
+	if config.Clock != nil {
+		clock = config.Clock
+	}
+	if config.MinResidency > 0 || config.MinResidencyAdmissions > 0 {
+		policy.SetMinResidency(config.MinResidency, config.MinResidencyAdmissions, clock)
+	}
+	if config.Seed != 0 {
+		policy.SetSeed(config.Seed)
+	}
+	precision := config.ClockPrecision
+	if precision == 0 {
+		precision = defaultClockPrecision
+	}
+	bufferItems := config.BufferItems
+	if bufferItems == 0 {
+		bufferItems = defaultBufferItems
+	}
+	shards := config.StoreShards
+	if shards == 0 {
+		shards = defaultShards()
+	}
+	negativeTTL := config.NegativeTTL
+	if negativeTTL == 0 {
+		negativeTTL = config.DefaultTTL
+	}
+	negativeCost := config.NegativeCost
+	if negativeCost == 0 {
+		negativeCost = 1
+	}
+	hintWeight := config.HintWeight
+	if hintWeight == 0 {
+		hintWeight = 1
+	}
+	var getBuf *ringBuffer
+	switch config.BufferMode {
+	case BufferLossless:
+		getBuf = newLosslessRingBuffer(policy, bufferItems, config.BufferStripes)
+	case BufferBlocking:
+		getBuf = newBlockingRingBuffer(policy, bufferItems, config.BufferStripes,
+			config.BufferTimeout)
+	default:
+		getBuf = newRingBuffer(policy, bufferItems)
+	}
+	setBufItems := setBufSize
+	if config.SetBufferItems > 0 {
+		setBufItems = config.SetBufferItems
+	}
 	cache := &Cache{
-		store:              newStore(),
-		policy:             policy,
-		getBuf:             newRingBuffer(policy, config.BufferItems),
-		setBuf:             make(chan *Item, setBufSize),
-		keyToHash:          config.KeyToHash,
-		stop:               make(chan struct{}),
-		cost:               config.Cost,
-		ignoreInternalCost: config.IgnoreInternalCost,
-		cleanupTicker:      time.NewTicker(time.Duration(bucketDurationSecs) * time.Second / 2),
+		policy:                policy,
+		classifier:            config.Classifier,
+		classNames:            classNames,
+		getBuf:                getBuf,
+		setBuf:                make(chan *Item, setBufItems),
+		keyToHash:             config.KeyToHash,
+		stop:                  make(chan struct{}),
+		trim:                  make(chan struct{}, 1),
+		shed:                  make(chan *shedRequest),
+		done:                  make(chan struct{}),
+		cost:                  config.Cost,
+		internalCost:          internalCost(config),
+		cleanupTicker:         clock.NewTicker(time.Duration(bucketDurationSecs) * time.Second / 2),
+		clock:                 newCoarseClock(clock, precision),
+		lifeKeys:              config.LifeExpectancyKeys,
+		lifeSampleRate:        uint64(config.LifeExpectancySampleRate),
+		metricsLabels:         formatLabels(config.MetricsLabels),
+		logger:                config.Logger,
+		logDebug:              config.LogDebug && config.Logger != nil,
+		synchronous:           config.Synchronous,
+		blockingSets:          config.BlockingSets,
+		pending:               newPendingSets(config.ReadYourWrites),
+		defaultTTL:            config.DefaultTTL,
+		negativeTTL:           negativeTTL,
+		negativeCost:          negativeCost,
+		hintWeight:            hintWeight,
+		maxIdle:               config.MaxIdle,
+		calls:                 newCalls(),
+		tags:                  newTagIndex(),
+		events:                newEventHub(),
+		propagateLoaderCancel: config.PropagateLoaderCancel,
+		freshFor:              config.FreshFor,
+		staleFor:              config.StaleFor,
+		maxItemCost:           config.MaxItemCost,
+		encodeValue:           config.EncodeValue,
+		decodeValue:           config.DecodeValue,
+		storeEncoded:          config.StoreEncoded,
+		copyOnRead:            config.CopyOnRead,
+		params:                debugParams(config),
+		backing:               newBacking(config.Backing, config.WriteBack),
+		loader:                config.Loader,
+		writer:                config.Writer,
+		tracer:                config.Tracer,
+	}
+	if cache.logger == nil {
+		cache.logger = nopLogger{}
+	}
+	onConflict := cache.countConflict
+	switch {
+	case config.NewMap != nil:
+		cache.store = newMapStore(config.NewMap(), cache.clock, onConflict)
+	case config.StoreEncoded:
+		var m Map = newArenaMap(shards)
+		if config.OffHeap {
+			if config.StoreShards == 0 {
+				shards = slabShards()
+			}
+			m = newSlabMap(shards)
+		}
+		cache.store = newCodecStore(newMapStore(m, cache.clock, onConflict),
+			config.EncodeValue, config.DecodeValue)
+	default:
+		cache.store = newStoreWith(cache.clock, shards, onConflict)
+	}
+	if cache.lifeKeys == 0 {
+		cache.lifeKeys = 100000
+	}
+	if cache.lifeSampleRate == 0 {
+		cache.lifeSampleRate = 1
 	}
 	cache.onExit = func(val interface{}) {
 		if config.OnExit != nil && val != nil {
-			config.OnExit(val)
+			cache.guard("OnExit", func() { config.OnExit(val) })
+		}
+		if rc, ok := val.(RefCounted); ok {
+			cache.guard("Release", rc.Release)
+		}
+	}
+	cache.victims = newVictimCache(config.VictimCacheSize, cache.onExit)
+	if config.TrackAge || config.MaxIdle > 0 {
+		cache.ages = newAgeIndex(cache.clock)
+	}
+	if config.EvictWorkers > 0 {
+		size := config.EvictQueueSize
+		if size == 0 {
+			size = defaultEvictQueueSize
 		}
+		cache.callbacks = newCallbackPool(config.EvictWorkers, size,
+			config.DropEvictCallbacks)
 	}
-	cache.onEvict = func(item *Item) {
+	cache.onEvict = cache.async(func(item *Item) {
 		if config.OnEvict != nil {
-			config.OnEvict(item)
+			cache.guard("OnEvict", func() { config.OnEvict(item) })
+		}
+		if item.ns != nil {
+			item.ns.evicted(item)
+		}
+		cache.guard("Backing", func() { cache.backing.writeItem(item) })
+		if !item.victim {
+			cache.onExit(item.Value)
+		}
+	})
+	cache.onExpire = cache.async(func(item *Item) {
+		if config.OnExpire != nil {
+			cache.guard("OnExpire", func() { config.OnExpire(item) })
 		}
 		cache.onExit(item.Value)
-	}
+	})
 	cache.onReject = func(item *Item) {
 		if config.OnReject != nil {
-			config.OnReject(item)
+			cache.guard("OnReject", func() { config.OnReject(item) })
 		}
+		cache.guard("Backing", func() { cache.backing.writeItem(item) })
 		cache.onExit(item.Value)
 	}
+	getBuf.onDrop = func(keys []uint64) {
+		cache.Metrics.add(dropGets, keys[0], uint64(len(keys)))
+		if cache.logDebug {
+			cache.logger.Log(LogDebug, "get buffer full, accesses dropped", "accesses", len(keys))
+		}
+		if config.OnBufferDrop != nil {
+			cache.guard("OnBufferDrop", func() { config.OnBufferDrop(len(keys)) })
+		}
+	}
 	if cache.keyToHash == nil {
 		cache.keyToHash = z.KeyToHash
 	}
+	if config.TraceAdmissions > 0 && config.Policy == nil {
+		cache.admissions = newAdmissionTrace(config.TraceAdmissions)
+		policy.TraceAdmissions(cache.admissions)
+	}
 	if config.Metrics {
 		cache.collectMetrics()
+		if len(config.CostBuckets) > 0 {
+			cache.Metrics.costs = newCostHistogram(config.CostBuckets)
+		}
+		if config.RatioWindow > 0 {
+			cache.Metrics.window = newRatioWindow(cache.clock, config.RatioWindow,
+				config.RatioWindowBuckets)
+		}
+		cache.latency = newLatencySampler(config.SampleLatency)
+		cache.Metrics.latency = cache.latency
+		if shadow != nil {
+			cache.shadow = newShadowPolicy(shadow, config.MaxCost, config.MaxEntries, cache.Metrics)
+			policy.SetShadow(cache.shadow)
+		}
+	}
+	if config.MetricsName != "" {
+		if err := publishMetrics(config.MetricsName, func() *Metrics {
+			return cache.Metrics
+		}); err != nil {
+			policy.Close()
+			cache.cleanupTicker.Stop()
+			if cache.callbacks != nil {
+				cache.callbacks.close()
+			}
+			cache.clock.close()
+			return nil, err
+		}
+		cache.metricsName = config.MetricsName
 	}
 	// NOTE: benchmarks seem to show that performance decreases the more
 	//       goroutines we have running cache.processItems(), so 1 should
@@ -208,30 +1136,247 @@ func NewCache(config *Config) (*Cache, error) {
 	return cache, nil
 }
 
+// Wait blocks until all the Sets and Dels issued before it have been applied.
+// It returns right away if the cache is closed, including while waiting.
 func (c *Cache) Wait() {
-	if c == nil || c.isClosed {
+	if c == nil || c.isClosed() {
 		return
 	}
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	c.setBuf <- &Item{wg: wg}
-	wg.Wait()
+	wait := make(chan struct{})
+	select {
+	case c.setBuf <- &Item{wait: wait}:
+	case <-c.done:
+		return
+	}
+	select {
+	case <-wait:
+	case <-c.done:
+	}
+}
+
+// waitSynchronous waits for the Set buffer to be applied with
+// Config.Synchronous.
+func (c *Cache) waitSynchronous() {
+	if c.synchronous {
+		c.Wait()
+	}
+}
+
+// Flush hands the Gets still sitting in the Get buffers over to the policy and
+// blocks until the policy has recorded them, along with every Get it had been
+// handed before. Together with Wait, it makes the policy's view of the traffic
+// deterministic, which is mostly useful in tests.
+//
+// Lossless buffers are always emptied. Lossy buffers only give up the batches
+// that aren't in use by concurrent Gets, and may still have dropped records
+// before Flush was called. It's safe to call Flush concurrently with traffic,
+// and it returns right away if the cache is closed.
+func (c *Cache) Flush() {
+	if c == nil || c.isClosed() {
+		return
+	}
+	c.policy.Flush(c.getBuf.Flush())
+}
+
+// isClosed returns true once Close has been called.
+func (c *Cache) isClosed() bool {
+	return atomic.LoadUint32(&c.closed) == 1
 }
 
 // Get returns the value (if any) and a boolean representing whether the
 // value was found or not. The value can be nil and the boolean can be true at
-// the same time.
+// the same time. A miss is looked up in Config.Backing, if set.
 func (c *Cache) Get(key interface{}) (interface{}, bool) {
-	if c == nil || c.isClosed || key == nil {
+	if c == nil || c.isClosed() || key == nil {
 		return nil, false
 	}
 	keyHash, conflictHash := c.keyToHash(key)
-	c.getBuf.Push(keyHash)
+	return c.getHashed(key, keyHash, conflictHash)
+}
+
+// getHashed implements Get for a key that isn't nil, given its hashes.
+func (c *Cache) getHashed(key interface{}, keyHash, conflictHash uint64) (interface{}, bool) {
+	if c.tracer != nil {
+		end := c.tracer.Start("get", traceKey(key, 0))
+		value, ok := c.getKey(key, keyHash, conflictHash)
+		end(ok, nil)
+		return value, ok
+	}
+	return c.getKey(key, keyHash, conflictHash)
+}
+
+// getKey implements Get for a key that isn't nil, without tracing it.
+func (c *Cache) getKey(key interface{}, keyHash, conflictHash uint64) (interface{}, bool) {
+	value, presence := c.lookup(keyHash, conflictHash)
+	if presence == Unknown && c.backing != nil {
+		return c.getBacking(key)
+	}
+	return value, presence == Present
+}
+
+// GetUint works like Get for a uint64 key, without boxing the key in an
+// interface. The key is used as its own hash, as the default Config.KeyToHash
+// does, so GetUint(k) finds the value of Set(k, ...) unless KeyToHash is set.
+func (c *Cache) GetUint(key uint64) (interface{}, bool) {
+	if c == nil || c.isClosed() {
+		return nil, false
+	}
+	if c.tracer != nil {
+		end := c.tracer.Start("get", traceKey(nil, key))
+		value, ok := c.get(key, 0)
+		end(ok, nil)
+		return value, ok
+	}
+	return c.get(key, 0)
+}
+
+func (c *Cache) get(keyHash, conflictHash uint64) (interface{}, bool) {
+	value, presence := c.lookup(keyHash, conflictHash)
+	return value, presence == Present
+}
+
+// lookup implements get, telling apart the keys known to be absent.
+func (c *Cache) lookup(keyHash, conflictHash uint64) (interface{}, Presence) {
+	if value, presence, ok := c.lookupFrozen(keyHash, conflictHash); ok {
+		return value, presence
+	}
+	if c.latency.sample() {
+		return c.lookupSampled(keyHash, conflictHash)
+	}
+	c.push(keyHash)
 	value, ok := c.store.Get(keyHash, conflictHash)
-	if ok {
-		c.Metrics.add(hit, keyHash, 1)
-	} else {
+	return c.found(keyHash, conflictHash, value, ok)
+}
+
+// lookupSampled works like lookup, timing its phases.
+func (c *Cache) lookupSampled(keyHash, conflictHash uint64) (interface{}, Presence) {
+	start := time.Now()
+	c.push(keyHash)
+	start = c.latency.since(PhaseBufferPush, start)
+	value, ok := c.store.Get(keyHash, conflictHash)
+	c.latency.since(PhaseMapLookup, start)
+	return c.found(keyHash, conflictHash, value, ok)
+}
+
+// found finishes a lookup that found value in the store if ok, looking in the
+// victim cache otherwise.
+func (c *Cache) found(keyHash, conflictHash uint64, value interface{}, ok bool) (interface{}, Presence) {
+	if !ok {
+		value, ok = c.pending.get(keyHash, conflictHash)
+	}
+	if !ok && c.victims != nil {
+		if value, ok := c.readmit(keyHash, conflictHash); ok {
+			c.Metrics.add(victimHits, keyHash, 1)
+			c.shadow.lookup(keyHash)
+			return c.readValue(keyHash, value), Present
+		}
+	}
+	return c.presence(keyHash, value, ok)
+}
+
+// presence counts a lookup that found value if ok, and returns what it found.
+func (c *Cache) presence(keyHash uint64, value interface{}, ok bool) (interface{}, Presence) {
+	c.shadow.lookup(keyHash)
+	if !ok || c.ages.idle(keyHash) {
 		c.Metrics.add(miss, keyHash, 1)
+		return nil, Unknown
+	}
+	c.ages.read(keyHash)
+	switch {
+	case value == Negative:
+		c.Metrics.add(negativeHits, keyHash, 1)
+		return nil, KnownAbsent
+	}
+	c.Metrics.add(hit, keyHash, 1)
+	return c.readValue(keyHash, value), Present
+}
+
+// GetMulti looks up several keys at once. The returned slices hold the value
+// of every key and whether it was found, at the same index as the key. The
+// accesses are recorded with a single buffer push and each hashmap shard is
+// locked only once. Like Get, it finds the values held by the victim cache
+// and admits them again. GetMultiMap returns the values found by key instead.
+func (c *Cache) GetMulti(keys []interface{}) ([]interface{}, []bool) {
+	values := make([]interface{}, len(keys))
+	found := make([]bool, len(keys))
+	if c == nil || c.isClosed() || len(keys) == 0 {
+		return values, found
+	}
+	keyHashes := make([]uint64, len(keys))
+	conflicts := make([]uint64, len(keys))
+	hasNil := false
+	for i, key := range keys {
+		if key == nil {
+			hasNil = true
+			continue
+		}
+		keyHashes[i], conflicts[i] = c.keyToHash(key)
+	}
+	if c.isFrozen() {
+		for i, key := range keys {
+			if key != nil {
+				var presence Presence
+				values[i], presence = c.lookup(keyHashes[i], conflicts[i])
+				found[i] = presence == Present
+			}
+		}
+		return values, found
+	}
+	c.store.GetMulti(keyHashes, conflicts, values, found)
+	if hasNil {
+		accessed := make([]uint64, 0, len(keys))
+		for i := range keys {
+			if keys[i] != nil {
+				accessed = append(accessed, keyHashes[i])
+			}
+		}
+		c.pushMulti(accessed)
+	} else {
+		c.pushMulti(keyHashes)
+	}
+	for i := range keys {
+		if keys[i] == nil {
+			// Nil keys are never stored.
+			values[i], found[i] = nil, false
+			continue
+		}
+		var presence Presence
+		values[i], presence = c.found(keyHashes[i], conflicts[i], values[i], found[i])
+		found[i] = presence == Present
+	}
+	return values, found
+}
+
+// push records the access of a Get.
+func (c *Cache) push(keyHash uint64) {
+	if c.synchronous {
+		c.policy.Flush([]uint64{keyHash})
+		return
+	}
+	c.getBuf.Push(keyHash)
+}
+
+// pushMulti records the accesses of GetMulti.
+func (c *Cache) pushMulti(keys []uint64) {
+	if c.synchronous {
+		c.policy.Flush(keys)
+		return
+	}
+	c.getBuf.PushMulti(keys)
+}
+
+// Peek works like Get but doesn't record the access, so it neither affects the
+// admission and eviction decisions of the policy nor counts as a hit or miss in
+// the metrics. Expired items, and the ones set by SetNegative, are reported as
+// missing.
+func (c *Cache) Peek(key interface{}) (interface{}, bool) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, ok := c.store.Get(keyHash, conflictHash)
+	if value == Negative || c.ages.idle(keyHash) {
+		return nil, false
 	}
 	return value, ok
 }
@@ -241,23 +1386,364 @@ func (c *Cache) Get(key interface{}) (interface{}, bool) {
 // it returns true, there's still a chance it could be dropped by the policy if
 // its determined that the key-value item isn't worth keeping, but otherwise the
 // item will be added and other items will be evicted in order to make room.
+// Config.OnReject is called for items that are dropped by the policy, so
+// callers that need to know whether the value was stored can use it. Replacing
+// the value of a key with a costlier one evicts other items if needed, as
+// UpdateCost does, while a value whose cost is over Config.MaxItemCost or
+// MaxCost is rejected, and Set returns false leaving the old value in place.
+// Replacing values is never dropped, and waits for room in the Set buffer
+// instead: of the concurrent Sets of a key, the last one to write its value is
+// also the one whose cost the policy keeps.
+//
+// Set doesn't wait for the policy: it hands the item over to the Set buffer,
+// which the policy drains in the background, and returns true once the item is
+// in it. A full buffer drops the Set, unless Config.BlockingSets is set. Until
+// the policy admits the item, a Get of a new key misses, even from the
+// goroutine that called Set, unless Config.ReadYourWrites is set; Wait closes
+// that window. Close drops the Sets still buffered, calling Config.OnExit for
+// their values. SetEntry waits for the outcome instead, and reports it.
 //
 // To dynamically evaluate the items cost using the Config.Coster function, set
 // the cost parameter to 0 and Coster will be ran when needed in order to find
 // the items true cost.
+//
+// The item expires after Config.DefaultTTL, if set.
 func (c *Cache) Set(key, value interface{}, cost int64) bool {
-	return c.SetWithTTL(key, value, cost, 0*time.Second)
+	if c == nil {
+		return false
+	}
+	return c.SetWithTTL(key, value, cost, c.defaultTTL)
+}
+
+// SetMulti works like calling Set for every key-value pair at the same index of
+// keys, values and costs, and reports the result of each Set. The keys already
+// in the cache are updated one by one, as Set does. The others go through the
+// Set buffer as a single batch, which is kept or dropped as a whole, and are
+// written to the store with each hashmap shard locked only once. Their cost is
+// worked out by Config.Cost before SetMulti returns, rather than by the
+// policy. A key given several times is set in order, the later pairs after
+// the batch. If the slices don't all have the same length, nothing is set.
+func (c *Cache) SetMulti(keys, values []interface{}, costs []int64) []bool {
+	added := make([]bool, len(keys))
+	if c == nil || c.isClosed() || len(values) != len(keys) || len(costs) != len(keys) {
+		return added
+	}
+	if !c.beginWrite() {
+		return added
+	}
+	expiration := c.defaultExpiration()
+	batch := make([]*Item, 0, len(keys))
+	batched := make([]int, 0, len(keys))
+	// seen holds the keys of the batch, so that a key given again is set
+	// after it.
+	seen := make(map[uint64]struct{}, len(keys))
+	var later []int
+	hashes := make([]uint64, len(keys))
+	conflicts := make([]uint64, len(keys))
+	for n, key := range keys {
+		if key == nil {
+			continue
+		}
+		keyHash, conflictHash := c.keyToHash(key)
+		if _, ok := seen[keyHash]; ok || c.store.Has(keyHash) {
+			hashes[n], conflicts[n] = keyHash, conflictHash
+			later = append(later, n)
+			continue
+		}
+		i := &Item{
+			flag:       itemNew,
+			Key:        keyHash,
+			Conflict:   conflictHash,
+			Value:      values[n],
+			Cost:       costs[n],
+			Expiration: expiration,
+			origKey:    key,
+		}
+		if !c.groupCost(i) {
+			c.onReject(i)
+			continue
+		}
+		seen[keyHash] = struct{}{}
+		// The evicted value of the key, if kept, is stale now.
+		c.victims.drop(keyHash)
+		c.pending.add(i)
+		batch, batched = append(batch, i), append(batched, n)
+	}
+	if len(batch) > 0 && c.sendBatch(&Item{sets: batch}) {
+		for _, n := range batched {
+			added[n] = true
+		}
+	} else {
+		for _, i := range batch {
+			c.pending.done(i)
+		}
+	}
+	// setHashed begins writes of its own, which can't nest with one that
+	// Drain waits for.
+	c.endWrite()
+	for _, n := range later {
+		added[n] = c.setHashed(keys[n], hashes[n], conflicts[n], values[n], costs[n],
+			c.defaultTTL, false, SetOptions{})
+	}
+	return added
+}
+
+// sendBatch hands the batch of a SetMulti over to processItems like Set does
+// with an item, dropping it if the Set buffer is full, and returns whether it
+// was sent.
+func (c *Cache) sendBatch(b *Item) bool {
+	if c.synchronous || c.blockingSets {
+		if !c.send(b) {
+			return false
+		}
+		c.waitSynchronous()
+		return true
+	}
+	select {
+	case c.setBuf <- b:
+		return true
+	default:
+		for _, i := range b.sets {
+			c.Metrics.add(dropSets, i.Key, 1)
+		}
+		if c.logDebug {
+			c.logger.Log(LogDebug, "set buffer full, set batch dropped", "keys", len(b.sets))
+		}
+		return false
+	}
+}
+
+// Warm inserts the key-value pairs at the same index of keys, values and costs
+// straight into the cache, for populating it before it serves traffic. Unlike
+// Set, it doesn't go through the Set buffer or the admission policy, so the
+// pairs don't compete with each other and nothing is evicted: the pairs that
+// don't fit in MaxCost, or whose key is already in the cache, are skipped.
+// Access frequencies and metrics other than the added keys and cost are left
+// untouched. It returns the number of pairs inserted.
+func (c *Cache) Warm(keys, values []interface{}, costs []int64) int {
+	if len(values) != len(keys) || len(costs) != len(keys) {
+		panic("ristretto: Warm needs the same number of keys, values and costs")
+	}
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	inserted := 0
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		keyHash, conflictHash := c.keyToHash(key)
+		item := &Item{
+			origKey:    key,
+			Key:        keyHash,
+			Conflict:   conflictHash,
+			Value:      values[i],
+			Cost:       costs[i],
+			Expiration: c.defaultExpiration(),
+		}
+		if c.insert(item, c.classOf(item)) {
+			inserted++
+		}
+	}
+	return inserted
+}
+
+// insert adds a new item of the given cost class straight to the store if the
+// policy has room for it, without going through the Set buffer or admission.
+// It works out the cost of the item the same way processItems does.
+func (c *Cache) insert(i *Item, class string) bool {
+	if !c.beginWrite() {
+		return false
+	}
+	defer c.endWrite()
+	if !c.encodeItem(i) {
+		return false
+	}
+	if i.Cost == 0 && c.cost != nil {
+		if i.Cost = c.costOf(i.Value); i.Cost <= 0 {
+			c.Metrics.add(rejectCosts, i.Key, 1)
+			return false
+		}
+	}
+	if c.tooLarge(i) {
+		c.Metrics.add(rejectLarge, i.Key, 1)
+		return false
+	}
+	if i.Cost == 0 {
+		i.Cost = 1
+	}
+	i.Cost += c.internalCost
+	if !c.policy.AddIfRoom(i.Key, i.Cost, class) {
+		return false
+	}
+	c.victims.drop(i.Key)
+	c.shadow.set(i.Key, i.Cost)
+	c.store.Set(i)
+	c.ages.set(i.Key, c.idleSeconds(i.maxIdle))
+	c.backing.remember(i)
+	c.Metrics.add(keyAdd, i.Key, 1)
+	return true
 }
 
 // SetWithTTL works like Set but adds a key-value pair to the cache that will expire
 // after the specified TTL (time to live) has passed. A zero value means the value never
-// expires, which is identical to calling Set. A negative value is a no-op and the value
+// expires, even if Config.DefaultTTL is set. A negative value is a no-op and the value
 // is discarded.
 func (c *Cache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
-	if c == nil || c.isClosed || key == nil {
+	return c.set(key, value, cost, ttl, false)
+}
+
+// SetForce works like Set but skips admission, so the item is stored unless it
+// costs more than MaxCost, evicting whatever the eviction policy picks to make
+// room. It also waits for room in the Set buffer rather than dropping the item.
+// This is meant for items that must be cached no matter how rarely they are
+// used; Pin them to keep them from being the next eviction victims.
+func (c *Cache) SetForce(key, value interface{}, cost int64) bool {
+	if c == nil {
+		return false
+	}
+	return c.set(key, value, cost, c.defaultTTL, true)
+}
+
+// defaultExpiration returns the expiration time of an item set now with
+// Config.DefaultTTL, or 0 if there's no default TTL.
+func (c *Cache) defaultExpiration() int64 {
+	if c.defaultTTL == 0 {
+		return 0
+	}
+	return c.clock.Now().Add(c.defaultTTL).Unix()
+}
+
+// tooLarge returns whether the cost of the item, not counting its internal
+// cost, is over MaxItemCost.
+func (c *Cache) tooLarge(i *Item) bool {
+	return c.maxItemCost > 0 && i.Cost > c.maxItemCost
+}
+
+// canReplace tells whether the item can replace the value of its key, which is
+// in the cache, and reports the rejection otherwise. Once written, an update
+// can only be rejected by deleting the key, so Config.Cost is called right
+// away, rather than by processItems, and the cost is checked against the
+// limits before the old value is replaced.
+func (c *Cache) canReplace(i *Item) bool {
+	if i.Cost == 0 && c.cost != nil {
+		if i.Cost = c.costOf(i.Value); i.Cost <= 0 {
+			c.Metrics.add(rejectCosts, i.Key, 1)
+			i.entry.reject(RejectCost)
+			c.publish(EventReject, i)
+			c.onReject(i)
+			return false
+		}
+		if c.tooLarge(i) {
+			c.Metrics.add(rejectLarge, i.Key, 1)
+			i.entry.reject(RejectTooLarge)
+			c.publish(EventReject, i)
+			c.onReject(i)
+			return false
+		}
+	}
+	if i.Cost+c.internalCost > c.policy.MaxCost() {
+		// It could never fit, like a new item.
+		c.Metrics.add(rejectSets, i.Key, 1)
+		i.entry.reject(RejectTooLarge)
+		c.publish(EventReject, i)
+		c.onReject(i)
+		return false
+	}
+	return true
+}
+
+// set implements SetWithTTL, and SetForce if force is set.
+func (c *Cache) set(key, value interface{}, cost int64, ttl time.Duration, force bool) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.setHashed(key, keyHash, conflictHash, value, cost, ttl, force, SetOptions{})
+}
+
+// SetOptions are the options of SetWithOptions.
+type SetOptions struct {
+	// TTL is the TTL of the item. If it's 0, the item expires after
+	// Config.DefaultTTL, like with Set.
+	TTL time.Duration
+	// Tags are the tags of the item, for InvalidateTag. They replace the tags
+	// the key had before, if any; a Set without tags removes them all. Tags
+	// starting with a NUL byte are reserved for Namespace.
+	Tags []string
+	// Priority weighs the item against the others when the Config.Policy is a
+	// PriorityPolicy, such as NewHyperbolicPolicy, and is ignored otherwise.
+	// Items with a higher priority are kept longer. 0 keeps the priority the
+	// key has, which for a new key is the policy's default: 1 for
+	// NewHyperbolicPolicy.
+	Priority float64
+	// MaxIdle overrides Config.MaxIdle for the item, if it's not 0. A negative
+	// MaxIdle keeps the item from expiring for being idle. It's ignored by
+	// caches without Config.MaxIdle or Config.TrackAge, which don't keep read
+	// times.
+	MaxIdle time.Duration
+	// ns is the namespace of the item, if it's set through one.
+	ns *Namespace
+	// entry is set for a SetEntry.
+	entry *entryResult
+}
+
+// SetWithOptions works like Set, with the TTL, tags and priority given by opts. Tags are
+// attached to the item once it's stored, and are dropped when it leaves the
+// cache, whichever way it does. They aren't saved in snapshots. A tagged Set
+// waits for room in the Set buffer like SetForce, so that the tags aren't lost
+// when the item is already in the cache.
+func (c *Cache) SetWithOptions(key, value interface{}, cost int64, opts SetOptions) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.setHashed(key, keyHash, conflictHash, value, cost, ttl, false, opts)
+}
+
+// InvalidateTag deletes every item with the tag, like Del, and returns the
+// number of items deleted. Items set with the tag while InvalidateTag runs may
+// or may not be deleted.
+func (c *Cache) InvalidateTag(tag string) int {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	keys, conflicts := c.tags.tagged(tag)
+	deleted := 0
+	for i, key := range keys {
+		if _, ok := c.del(key, conflicts[i]); ok {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// SetUint works like Set for a uint64 key, which is used as its own hash like
+// in GetUint.
+func (c *Cache) SetUint(key uint64, value interface{}, cost int64) bool {
+	if c == nil || c.isClosed() {
 		return false
 	}
+	return c.setHashed(nil, key, 0, value, cost, c.defaultTTL, false, SetOptions{})
+}
 
+// setHashed implements set once the key is hashed, SetWithOptions and
+// SetEntry. The TTL of opts is ignored in favor of ttl. key is the original
+// key, if known.
+func (c *Cache) setHashed(key interface{}, keyHash, conflictHash uint64, value interface{},
+	cost int64, ttl time.Duration, force bool, opts SetOptions) (stored bool) {
+	if c.tracer != nil {
+		end := c.tracer.Start("set", traceKey(key, keyHash))
+		defer func() { end(stored, nil) }()
+	}
+	if !c.beginWrite() {
+		return false
+	}
+	defer c.endWrite()
 	var expiration int64
 	switch {
 	case ttl == 0:
@@ -265,12 +1751,16 @@ func (c *Cache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration
 		break
 	case ttl < 0:
 		// Treat this a a no-op.
+		opts.entry.reject(RejectTTL)
 		return false
 	default:
-		expiration = time.Now().Add(ttl).Unix()
+		expiration = c.clock.Now().Add(ttl).Unix()
+	}
+	tags := opts.Tags
+	if opts.ns != nil {
+		tags = opts.ns.withTags(opts.Tags)
 	}
 
-	keyHash, conflictHash := c.keyToHash(key)
 	i := &Item{
 		flag:       itemNew,
 		Key:        keyHash,
@@ -278,47 +1768,397 @@ func (c *Cache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration
 		Value:      value,
 		Cost:       cost,
 		Expiration: expiration,
+		force:      force,
+		tags:       tags,
+		priority:   opts.Priority,
+		maxIdle:    opts.MaxIdle,
+		origKey:    key,
+		ns:         opts.ns,
+		entry:      opts.entry,
+	}
+	if !c.encodeItem(i) {
+		i.entry.reject(RejectEncode)
+		c.replaceFailed(i)
+		return false
+	}
+	if c.tooLarge(i) {
+		c.Metrics.add(rejectLarge, keyHash, 1)
+		i.entry.reject(RejectTooLarge)
+		c.onReject(i)
+		c.replaceFailed(i)
+		return false
+	}
+	if c.store.Has(keyHash) && !c.canReplace(i) {
+		c.replaceFailed(i)
+		return false
+	}
+	// The evicted value of the key, if kept, is stale now.
+	c.victims.drop(keyHash)
+	var start time.Time
+	sampled := c.latency.sample()
+	if sampled {
+		i.sampled = true
+		start = time.Now()
 	}
 	// cost is eventually updated. The expiration must also be immediately updated
-	// to prevent items from being prematurely removed from the map.
-	if prev, ok := c.store.Update(i); ok {
-		c.onExit(prev)
+	// to prevent items from being prematurely removed from the map. The
+	// updates of a key reach the Set buffer in the order they were written,
+	// and are never dropped, so that the cost of the value left is the one
+	// the policy gets last.
+	order := c.order.stripe(keyHash)
+	order.writes.Lock()
+	prev, ok := order.update(c.store, i)
+	if sampled {
+		start = c.latency.since(PhaseMapLookup, start)
+	}
+	if ok {
 		i.flag = itemUpdate
+		sent := c.send(i)
+		order.writes.Unlock()
+		if sampled {
+			c.latency.since(PhaseBufferPush, start)
+		}
+		c.onExit(prev)
+		if sent {
+			c.waitSynchronous()
+		}
+		return sent
+	}
+	order.writes.Unlock()
+	c.pending.add(i)
+	if c.synchronous || c.blockingSets || force || len(opts.Tags) > 0 || i.entry != nil {
+		if !c.send(i) {
+			c.pending.done(i)
+			return false
+		}
+		if sampled {
+			c.latency.since(PhaseBufferPush, start)
+		}
+		c.waitSynchronous()
+		return true
 	}
 	// Attempt to send item to policy.
 	select {
 	case c.setBuf <- i:
+		if sampled {
+			c.latency.since(PhaseBufferPush, start)
+		}
 		return true
 	default:
-		if i.flag == itemUpdate {
-			// Return true if this was an update operation since we've already
-			// updated the store. For all the other operations (set/delete), we
-			// return false which means the item was not inserted.
-			return true
-		}
+		c.pending.done(i)
 		c.Metrics.add(dropSets, keyHash, 1)
+		if c.logDebug {
+			c.logger.Log(LogDebug, "set buffer full, set dropped", "key", keyHash)
+		}
 		return false
 	}
 }
 
-// Del deletes the key-value item from the cache if it exists.
-func (c *Cache) Del(key interface{}) {
-	if c == nil || c.isClosed || key == nil {
-		return
+// send hands the item over to processItems, waiting for room in the Set buffer
+// if needed. It returns false if the cache is closed.
+func (c *Cache) send(i *Item) bool {
+	select {
+	case c.setBuf <- i:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// UpdateCost changes the cost of an item in place, for values that grow or
+// shrink after they're set. If the cache goes over MaxCost as a result, other
+// items are evicted until it fits again; the item itself never is. A cost of
+// 0 counts as 1, like in Set, and Config.Cost isn't called. UpdateCost returns
+// false if the key isn't in the cache, which includes an item whose Set is
+// still buffered; call Wait first. The new cost is applied asynchronously,
+// after the Sets already buffered, and has no effect if the item is gone by
+// then.
+func (c *Cache) UpdateCost(key interface{}, cost int64) bool {
+	if c == nil || c.isClosed() || key == nil || cost < 0 {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		return false
+	}
+	select {
+	case c.setBuf <- &Item{
+		flag:     itemCost,
+		Key:      keyHash,
+		Conflict: conflictHash,
+		Cost:     cost,
+	}:
+		c.waitSynchronous()
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Pin keeps the item from being evicted to make room for other items, until
+// it's unpinned, deleted or expired, whatever the policy. Replacing its value
+// with Set keeps it pinned. Pinned items still count against MaxCost:
+// once the cache is full of them, new items are rejected, and lowering MaxCost
+// won't evict them. Pin returns false if the key isn't in the cache, which
+// includes an item whose Set is still buffered; call Wait first.
+func (c *Cache) Pin(key interface{}) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		return false
+	}
+	return c.policy.Pin(keyHash)
+}
+
+// Unpin makes a pinned item evictable again. It returns false if the item
+// wasn't pinned.
+func (c *Cache) Unpin(key interface{}) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if c.store.Conflicts(keyHash, conflictHash) {
+		// The pinned item is another key with the same hash.
+		return false
+	}
+	return c.policy.Unpin(keyHash)
+}
+
+// SetIfAbsent stores the key-value pair only if the key isn't in the cache,
+// deciding atomically with respect to other Sets of the same key. Like Set, it
+// goes through admission, but it never drops the item in the Set buffer and
+// waits for the outcome instead. It returns whether the item was stored, and
+// if it wasn't, whether that's because the key was already present rather
+// than because the policy rejected it (or the cache is closed).
+func (c *Cache) SetIfAbsent(key, value interface{}, cost int64) (stored, exists bool) {
+	if c == nil {
+		return false, false
+	}
+	return c.setIfAbsent(key, value, cost, c.defaultExpiration())
+}
+
+// setIfAbsent implements SetIfAbsent, for an item expiring at expiration.
+func (c *Cache) setIfAbsent(key, value interface{}, cost, expiration int64) (stored, exists bool) {
+	if c.isClosed() || key == nil {
+		return false, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if c.tracer != nil {
+		end := c.tracer.Start("set", traceKey(key, keyHash))
+		defer func() { end(stored, nil) }()
+	}
+	if !c.beginWrite() {
+		return false, false
+	}
+	defer c.endWrite()
+	if c.store.Conflicts(keyHash, conflictHash) {
+		c.countConflict(keyHash)
+		return false, false
+	}
+	if _, ok := c.store.Get(keyHash, conflictHash); ok {
+		return false, true
+	}
+	c.victims.drop(keyHash)
+	i := &Item{
+		flag:       itemNew,
+		Key:        keyHash,
+		Conflict:   conflictHash,
+		Value:      value,
+		Cost:       cost,
+		Expiration: expiration,
+		ifAbsent:   make(chan setOutcome, 1),
+		origKey:    key,
+	}
+	if !c.encodeItem(i) {
+		return false, false
+	}
+	if c.tooLarge(i) {
+		c.Metrics.add(rejectLarge, keyHash, 1)
+		c.onReject(i)
+		return false, false
+	}
+	select {
+	case c.setBuf <- i:
+	case <-c.done:
+		return false, false
+	}
+	select {
+	case outcome := <-i.ifAbsent:
+		return outcome == setStored, outcome == setExists
+	case <-c.done:
+		return false, false
+	}
+}
+
+// Update atomically replaces the value of the key with the one fn returns,
+// given the current value and whether the key is in the cache, if fn also
+// returns true. fn runs while holding the lock of the store shard the key is
+// in, so it must be quick; it may use other keys, but a key sharing that shard
+// deadlocks, and so does the key itself.
+//
+// A key in the cache keeps its TTL and tags. If Config.Cost is set, it's
+// called under the same lock for the new value, which isn't written if its
+// cost is rejected; otherwise the key keeps its cost. A missing key is added
+// like with SetIfAbsent, going through admission, and fn is called again in
+// case another Set adds the key first. Update returns whether the value was
+// written.
+func (c *Cache) Update(key interface{}, fn func(old interface{}, exists bool) (interface{}, bool)) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	if !c.beginWrite() {
+		return false
+	}
+	defer c.endWrite()
+	keyHash, conflictHash := c.keyToHash(key)
+	for {
+		if c.store.Conflicts(keyHash, conflictHash) {
+			c.countConflict(keyHash)
+			return false
+		}
+		var value interface{}
+		var write, exists bool
+		var cost int64
+		prev, replaced := c.store.Compute(keyHash, conflictHash,
+			func(old interface{}, ok bool) (interface{}, bool) {
+				value, write = fn(old, ok)
+				exists = ok
+				if !write || !ok || c.cost == nil {
+					return value, write
+				}
+				cost = c.costOf(value)
+				switch {
+				case cost <= 0:
+					c.Metrics.add(rejectCosts, keyHash, 1)
+					return nil, false
+				case c.tooLarge(&Item{Cost: cost}):
+					c.Metrics.add(rejectLarge, keyHash, 1)
+					return nil, false
+				}
+				return value, true
+			})
+		if replaced {
+			c.onExit(prev)
+			if c.cost == nil {
+				return true
+			}
+			select {
+			case c.setBuf <- &Item{
+				flag:     itemCost,
+				Key:      keyHash,
+				Conflict: conflictHash,
+				Cost:     cost,
+			}:
+				c.waitSynchronous()
+			case <-c.done:
+			}
+			return true
+		}
+		if !write || exists {
+			return false
+		}
+		stored, found := c.setIfAbsent(key, value, 0, c.defaultExpiration())
+		if !found {
+			return stored
+		}
+	}
+}
+
+// Del deletes the key-value item from the cache if it exists. It returns the
+// removed value and whether the key was present. When several goroutines
+// delete the same key concurrently, only one of them observes the value.
+//
+// An explicit Del is not an eviction, so OnEvict isn't called. OnExit is still
+// called for the removed value before Del returns. The key is also deleted
+// from Config.Backing, if set.
+func (c *Cache) Del(key interface{}) (interface{}, bool) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, false
 	}
 	keyHash, conflictHash := c.keyToHash(key)
+	return c.delHashed(key, keyHash, conflictHash)
+}
+
+// delHashed implements Del for a key that isn't nil, given its hashes.
+func (c *Cache) delHashed(key interface{}, keyHash, conflictHash uint64) (interface{}, bool) {
+	if c.backing != nil {
+		c.backing.store.Del(key)
+	}
+	if c.tracer != nil {
+		end := c.tracer.Start("del", traceKey(key, keyHash))
+		value, ok := c.del(keyHash, conflictHash)
+		end(ok, nil)
+		return value, ok
+	}
+	return c.del(keyHash, conflictHash)
+}
+
+// DelUint works like Del for a uint64 key, which is used as its own hash like
+// in GetUint.
+func (c *Cache) DelUint(key uint64) (interface{}, bool) {
+	if c == nil || c.isClosed() {
+		return nil, false
+	}
+	if c.tracer != nil {
+		end := c.tracer.Start("del", traceKey(nil, key))
+		value, ok := c.del(key, 0)
+		end(ok, nil)
+		return value, ok
+	}
+	return c.del(key, 0)
+}
+
+// DelFunc deletes every item for which f returns true, and returns the number
+// of items deleted. f is passed the items as Range visits them, with the key
+// and conflict hashes rather than the original key, so f has to tell the items
+// apart by those or by their value. Like Range, DelFunc doesn't lock the whole
+// cache and tolerates concurrent Sets; a key set again after f saw its previous
+// value may be deleted as well. The items are removed like with Del, so OnExit
+// is called for them and OnEvict isn't.
+func (c *Cache) DelFunc(f func(item *Item) bool) int {
+	deleted := 0
+	c.Range(func(item *Item) bool {
+		if f(item) {
+			if _, ok := c.del(item.Key, item.Conflict); ok {
+				deleted++
+			}
+		}
+		return true
+	})
+	return deleted
+}
+
+func (c *Cache) del(keyHash, conflictHash uint64) (interface{}, bool) {
+	if !c.beginWrite() {
+		return nil, false
+	}
+	defer c.endWrite()
+	return c.delUngated(keyHash, conflictHash)
+}
+
+// delUngated implements del once the write has begun.
+func (c *Cache) delUngated(keyHash, conflictHash uint64) (interface{}, bool) {
+	c.victims.forget(keyHash)
+	c.pending.del(keyHash)
 	// Delete immediately.
-	_, prev := c.store.Del(keyHash, conflictHash)
+	_, prev, ok := c.store.Del(keyHash, conflictHash)
 	c.onExit(prev)
 	// If we've set an item, it would be applied slightly later.
 	// So we must push the same item to `setBuf` with the deletion flag.
 	// This ensures that if a set is followed by a delete, it will be
 	// applied in the correct order.
-	c.setBuf <- &Item{
+	select {
+	case c.setBuf <- &Item{
 		flag:     itemDelete,
 		Key:      keyHash,
 		Conflict: conflictHash,
+	}:
+		c.waitSynchronous()
+	case <-c.done:
 	}
+	return prev, ok
 }
 
 // GetTTL returns the TTL for the specified key and a bool that is true if the
@@ -328,108 +2168,532 @@ func (c *Cache) GetTTL(key interface{}) (time.Duration, bool) {
 		return 0, false
 	}
 
-	keyHash, conflictHash := c.keyToHash(key)
-	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
-		// not found
-		return 0, false
+	keyHash, conflictHash := c.keyToHash(key)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		// not found
+		return 0, false
+	}
+
+	expiration := c.store.Expiration(keyHash)
+	if expiration == 0 {
+		// found but no expiration
+		return 0, true
+	}
+
+	ttl := time.Unix(expiration, 0)
+	now := c.clock.Now()
+	if now.After(ttl) {
+		// found but expired
+		return 0, false
+	}
+
+	return ttl.Sub(now), true
+}
+
+// Touch sets the expiration of the item to ttl from now, without changing its
+// value or going through the policy. As with SetWithTTL, a ttl of zero means
+// the item never expires. Touch returns false, and does nothing, if the key
+// isn't in the cache, has already expired, or ttl is negative.
+func (c *Cache) Touch(key interface{}, ttl time.Duration) bool {
+	if c == nil || c.isClosed() || key == nil || ttl < 0 {
+		return false
+	}
+	var expiration int64
+	if ttl > 0 {
+		expiration = c.clock.Now().Add(ttl).Unix()
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if !c.beginWrite() {
+		return false
+	}
+	defer c.endWrite()
+	if c.ages.idle(keyHash) {
+		return false
+	}
+	if !c.store.Touch(keyHash, conflictHash, expiration) {
+		return false
+	}
+	c.ages.read(keyHash)
+	return true
+}
+
+// GetAndTouch works like Get, but also sets the expiration of the item to ttl
+// from now, as Touch does. The value is read and the expiration set under the
+// same lock, so the item can't expire in between. An item that has already
+// expired is a miss and stays expired. GetAndTouch returns false, and does
+// nothing, if ttl is negative.
+func (c *Cache) GetAndTouch(key interface{}, ttl time.Duration) (interface{}, bool) {
+	if c == nil || c.isClosed() || key == nil || ttl < 0 {
+		return nil, false
+	}
+	var expiration int64
+	if ttl > 0 {
+		expiration = c.clock.Now().Add(ttl).Unix()
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	if !c.beginWrite() {
+		return c.get(keyHash, conflictHash)
+	}
+	defer c.endWrite()
+	c.push(keyHash)
+	var value interface{}
+	var ok bool
+	if !c.ages.idle(keyHash) {
+		// Idle items aren't touched, and presence counts them as misses.
+		value, ok = c.store.GetAndTouch(keyHash, conflictHash, expiration)
+	}
+	value, presence := c.presence(keyHash, value, ok)
+	return value, presence == Present
+}
+
+// Close clears the cache and stops all goroutines. It's idempotent and safe to
+// call while other goroutines are still using the cache: once Close has been
+// called, the cache behaves like a nil one, as described on Cache.
+func (c *Cache) Close() {
+	if c == nil {
+		return
+	}
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	if c.isClosed() {
+		return
+	}
+	c.clear()
+
+	atomic.StoreUint32(&c.closed, 1)
+	close(c.done)
+	// Block until processItems goroutine is returned.
+	c.stop <- struct{}{}
+	// setBuf is deliberately left open so that concurrent Sets and Dels don't
+	// panic, but anyone left waiting on it is released.
+	c.drainSetBuf()
+	c.policy.Close()
+	c.cleanupTicker.Stop()
+	c.clock.close()
+	c.events.close()
+	if c.callbacks != nil {
+		c.callbacks.close()
+	}
+	if c.metricsName != "" {
+		unpublishMetrics(c.metricsName)
+	}
+}
+
+// Subscribe returns a channel receiving an Event whenever a key is admitted,
+// rejected, updated, evicted, expires or is deleted, along with a function to
+// unsubscribe, which closes the channel. The channel holds up to size events;
+// events that don't fit are dropped rather than holding up the cache, and are
+// counted by Metrics.EventsDropped. Close closes the channels of all the
+// subscribers, and Subscribe returns a closed channel once the cache is closed.
+//
+// The events are sent by the goroutine applying the Sets, in the order it does
+// so; Sets dropped or rejected before they reach it, such as one over
+// Config.MaxItemCost, don't send any.
+func (c *Cache) Subscribe(size int) (<-chan Event, func()) {
+	if c == nil {
+		ch := make(chan Event)
+		close(ch)
+		return ch, func() {}
+	}
+	ch, ok := c.events.subscribe(size)
+	if !ok {
+		return ch, func() {}
+	}
+	return ch, func() { c.events.unsubscribe(ch) }
+}
+
+// setPriority passes the priority of a stored item on to the policy.
+func (c *Cache) setPriority(i *Item) {
+	if i.priority != 0 {
+		c.policy.SetPriority(i.Key, i.priority)
 	}
+}
 
-	expiration := c.store.Expiration(keyHash)
-	if expiration == 0 {
-		// found but no expiration
-		return 0, true
+// publish sends an event for the item to the subscribers, if any.
+func (c *Cache) publish(t EventType, i *Item) {
+	if !c.events.active() {
+		return
+	}
+	e := Event{
+		Type:     t,
+		Key:      i.Key,
+		Conflict: i.Conflict,
+		Cost:     i.Cost,
+		Time:     c.clock.Now(),
+	}
+	if dropped := c.events.send(e); dropped > 0 {
+		c.Metrics.add(dropEvents, i.Key, uint64(dropped))
 	}
+}
 
-	ttl := time.Unix(expiration, 0)
-	if time.Now().After(ttl) {
-		// found but expired
-		return 0, false
+// guard calls the callback of the Config with the given name, recovering from a
+// panic in it. The callbacks mostly run on the goroutine applying the Sets,
+// which would otherwise die, so the store and the policy are always brought
+// back in sync before one is called. The panics are counted in
+// Metrics.CallbackPanics and logged as LogError events.
+func (c *Cache) guard(name string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.Metrics.add(panicCallbacks, 0, 1)
+			c.logger.Log(LogError, "callback panicked", "callback", name, "panic", r)
+		}
+	}()
+	if c.latency.sample() {
+		defer c.latency.since(PhaseCallback, time.Now())
 	}
+	f()
+}
 
-	return time.Until(ttl), true
+// costOf returns the cost of the value given by Config.Cost, or 0 if it
+// panics, so that the item is rejected.
+func (c *Cache) costOf(value interface{}) (cost int64) {
+	c.guard("Cost", func() { cost = c.cost(value) })
+	return cost
 }
 
-// Close stops all goroutines and closes all channels.
-func (c *Cache) Close() {
-	if c == nil || c.isClosed {
-		return
+// repair removes up to n keys the policy has but the store doesn't, so that
+// they don't take up room forever. Such ghosts can only be left by a Set or
+// a Del interrupted halfway.
+func (c *Cache) repair(n int) {
+	for _, key := range c.policy.Sample(n) {
+		if !c.store.Has(key) {
+			c.policy.Del(key)
+			c.Metrics.add(ghostsRemoved, key, 1)
+		}
 	}
-	c.Clear()
+}
 
-	// Block until processItems goroutine is returned.
-	c.stop <- struct{}{}
-	close(c.stop)
-	close(c.setBuf)
-	c.policy.Close()
-	c.isClosed = true
+// async makes f run on the eviction workers, if there are any. The items
+// whose callback is dropped still have their value passed to onExit.
+func (c *Cache) async(f itemCallback) itemCallback {
+	if c.callbacks == nil {
+		return f
+	}
+	return func(item *Item) {
+		if !c.callbacks.run(f, item) {
+			c.Metrics.add(dropCallbacks, item.Key, 1)
+			if !item.victim {
+				c.onExit(item.Value)
+			}
+		}
+	}
 }
 
 // Clear empties the hashmap and zeroes all policy counters. Note that this is
 // not an atomic operation (but that shouldn't be a problem as it's assumed that
-// Set/Get calls won't be occurring until after this).
+// Set/Get calls won't be occurring until after this). Items removed by Clear
+// are not reported to OnEvict, but OnExit is still called for their values.
 func (c *Cache) Clear() {
-	if c == nil || c.isClosed {
+	if c == nil {
+		return
+	}
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	if c.isClosed() || c.isFrozen() {
 		return
 	}
+	c.clear()
+}
+
+// clear implements Clear. The caller must hold lifecycleMu.
+func (c *Cache) clear() {
 	// Block until processItems goroutine is returned.
 	c.stop <- struct{}{}
 
 	// Clear out the setBuf channel.
-loop:
+	c.drainSetBuf()
+
+	// Clear value hashmap and policy data.
+	c.policy.Clear()
+	c.shadow.clear()
+	c.store.Clear(func(i *Item) {
+		c.onExit(i.Value)
+	})
+	c.tags.clear()
+	c.pending.clear()
+	c.ages.clear()
+	c.backing.clear()
+	c.victims.clear()
+	// Only reset metrics if they're enabled.
+	if c.Metrics != nil {
+		c.Metrics.Clear()
+	}
+	// Restart processItems goroutine.
+	go c.processItems()
+}
+
+// drainSetBuf empties setBuf without applying the items. The processItems
+// goroutine must not be running.
+func (c *Cache) drainSetBuf() {
 	for {
 		select {
 		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
+			if i.wait != nil {
+				close(i.wait)
+				continue
+			}
+			if i.group != nil {
+				c.rejectGroup(i.group)
+				i.group.done <- false
+				continue
+			}
+			if i.batch != nil {
+				for _, key := range i.batch.keys {
+					c.victims.deleted(key)
+				}
+				continue
+			}
+			if i.sets != nil {
+				for _, item := range i.sets {
+					c.pending.done(item)
+					c.onExit(item.Value)
+				}
 				continue
 			}
 			if i.flag != itemUpdate {
 				// In itemUpdate, the value is already set in the store.  So, no need to call
-				// onEvict here.
-				c.onEvict(i)
+				// onExit here.
+				c.pending.done(i)
+				c.onExit(i.Value)
+			} else {
+				c.order.stripe(i.Key).done(i.Key)
+			}
+			if i.flag == itemDelete {
+				c.victims.deleted(i.Key)
 			}
+			i.entry.reject(RejectDropped)
+			i.report(setRejected)
 		default:
-			break loop
+			return
 		}
 	}
+}
 
-	// Clear value hashmap and policy data.
-	c.policy.Clear()
-	c.store.Clear(c.onEvict)
-	// Only reset metrics if they're enabled.
-	if c.Metrics != nil {
-		c.Metrics.Clear()
+// Range calls f for every item in the cache until f returns false. Keys are
+// only stored as hashes, so the items carry the key and conflict hashes rather
+// than the original key. Cost doesn't include the internal cost, even if
+// IgnoreInternalCost isn't set.
+//
+// Range doesn't block Sets and Dels, and f may use the cache. The items are
+// copied a shard at a time, so items set or deleted while Range is running
+// may or may not be visited; items that are visited are never visited twice.
+// Expired items are skipped.
+func (c *Cache) Range(f func(item *Item) bool) {
+	if c == nil || c.isClosed() {
+		return
 	}
-	// Restart processItems goroutine.
-	go c.processItems()
+	now := c.clock.Now().Unix()
+	c.store.Range(func(i storeItem) bool {
+		if i.expiration != 0 && i.expiration <= now {
+			return true
+		}
+		cost := c.policy.Cost(i.key)
+		if cost < 0 {
+			// Deleted since its shard was copied.
+			return true
+		}
+		cost -= c.internalCost
+		return f(&Item{
+			Key:        i.key,
+			Conflict:   i.conflict,
+			Value:      i.value,
+			Cost:       cost,
+			Expiration: i.expiration,
+		})
+	})
+}
+
+// Keys returns the key hashes of the items in the cache, as visited by Range.
+func (c *Cache) Keys() []uint64 {
+	var keys []uint64
+	c.Range(func(item *Item) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	return keys
 }
 
-// MaxCost returns the max cost of the cache.
+// MaxCost returns the max cost of the cache, or 0 once it's closed.
 func (c *Cache) MaxCost() int64 {
-	if c == nil {
+	if c == nil || c.isClosed() {
 		return 0
 	}
 	return c.policy.MaxCost()
 }
 
-// UpdateMaxCost updates the maxCost of an existing cache.
+// MaxEntries returns the max number of items of the cache, or 0 if it's
+// unlimited.
+func (c *Cache) MaxEntries() int64 {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.policy.MaxEntries()
+}
+
+// SketchCounters returns the number of counters in each row of the frequency
+// sketch, which is NumCounters rounded up to a power of 2, or 0 if the policy
+// doesn't use one.
+func (c *Cache) SketchCounters() int64 {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.policy.SketchCounters()
+}
+
+// WindowRatio returns the share of MaxCost currently given to the window of a
+// W-TinyLFU policy, which changes over time with NewAdaptiveWTinyLFUPolicy. It
+// returns 0 for other policies.
+func (c *Cache) WindowRatio() float64 {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.policy.WindowRatio()
+}
+
+// UsedCost returns the sum of the costs of the items admitted by the policy,
+// including their internal cost unless IgnoreInternalCost is set. Sets still
+// sitting in the internal buffers are not accounted for until they are
+// processed.
+func (c *Cache) UsedCost() int64 {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.policy.Used()
+}
+
+// Len returns the number of items stored in the cache. It reads from the
+// hashmap rather than the policy, so it reflects deletions immediately but may
+// briefly include items that have expired and not yet been cleaned up.
+func (c *Cache) Len() int {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.store.Len()
+}
+
+// UpdateMaxCost updates the maxCost of an existing cache. If it's lowered below
+// the cost of the items in the cache, items are evicted (and OnEvict called for
+// them) in the background until they fit. The eviction happens in small
+// batches, so Gets and Sets keep being served in the meantime. While the cache
+// is degraded by SetPressure, the new max cost is lowered in turn.
 func (c *Cache) UpdateMaxCost(maxCost int64) {
-	if c == nil {
+	if c == nil || c.isClosed() || c.isFrozen() {
 		return
 	}
+	c.pressure.Lock()
+	defer c.pressure.Unlock()
+	previous := c.policy.MaxCost()
+	if c.pressure.active {
+		// Keep it lowered until the pressure subsides.
+		previous, c.pressure.maxCost = c.pressure.maxCost, maxCost
+		lowered, _ := pressureEffects(maxCost, c.pressure.level)
+		c.setMaxCost(lowered)
+	} else {
+		c.setMaxCost(maxCost)
+	}
+	c.logger.Log(LogInfo, "max cost updated", "from", previous, "to", maxCost)
+}
+
+// setMaxCost updates the max cost of the policy, and trims the cache to it.
+func (c *Cache) setMaxCost(maxCost int64) {
 	c.policy.UpdateMaxCost(maxCost)
+	c.shadow.resize(maxCost)
+	c.requestTrim()
+}
+
+// UpdateQuota limits the items of the Namespace with the given name to a
+// fraction of MaxCost, or removes its limit if fraction isn't positive. Once a
+// namespace is at its quota, its new items can only evict its own items, and
+// still have to be admitted against them, so that a namespace flooding the
+// cache can't push the others out. If the namespace is over its new quota, its
+// items are evicted in the background until it fits, like after
+// UpdateMaxCost. Quotas apply to the default policy and to custom ones, the
+// victims then being picked by the cache.
+func (c *Cache) UpdateQuota(namespace string, fraction float64) {
+	if c == nil || c.isClosed() || c.isFrozen() {
+		return
+	}
+	c.policy.SetQuota(namespace, fraction)
+	c.requestTrim()
+}
+
+// shedRequest asks processItems to evict a batch of up to n items, or items
+// worth cost if it's positive, and send back the ones evicted.
+type shedRequest struct {
+	n       int
+	cost    int64
+	evicted chan []*Item
+}
+
+// EvictN evicts up to n items, the ones the policy would evict first to make
+// room for new items, and returns how many were evicted. OnEvict is called for
+// each of them. Pinned items are never evicted. The items are evicted in
+// small batches, so Gets and Sets keep being served in the meantime.
+func (c *Cache) EvictN(n int) int {
+	evicted := 0
+	for evicted < n {
+		size := n - evicted
+		if size > trimBatchSize {
+			size = trimBatchSize
+		}
+		batch := c.shedBatch(&shedRequest{n: size})
+		evicted += len(batch)
+		if len(batch) == 0 {
+			break
+		}
+	}
+	return evicted
+}
+
+// EvictCost evicts items, as EvictN does, until their costs add up to at least
+// cost or there are no more evictable items, and returns the cost freed.
+func (c *Cache) EvictCost(cost int64) int64 {
+	var freed int64
+	for freed < cost {
+		batch := c.shedBatch(&shedRequest{n: trimBatchSize, cost: cost - freed})
+		for _, item := range batch {
+			freed += item.Cost
+		}
+		if len(batch) == 0 {
+			break
+		}
+	}
+	return freed
+}
+
+// shedBatch has processItems handle r, and returns the items it evicted.
+func (c *Cache) shedBatch(r *shedRequest) []*Item {
+	if c == nil || c.isClosed() || c.isFrozen() {
+		return nil
+	}
+	r.evicted = make(chan []*Item, 1)
+	select {
+	case c.shed <- r:
+	case <-c.done:
+		return nil
+	}
+	return <-r.evicted
+}
+
+// requestTrim asks processItems to evict a batch of items if they don't fit.
+func (c *Cache) requestTrim() {
+	select {
+	case c.trim <- struct{}{}:
+	default:
+		// A trim is already pending.
+	}
 }
 
 // processItems is ran by goroutines processing the Set buffer.
 func (c *Cache) processItems() {
 	startTs := make(map[uint64]time.Time)
-	numToKeep := 100000 // TODO: Make this configurable via options.
+	numToKeep := c.lifeKeys
 
 	trackAdmission := func(key uint64) {
-		if c.Metrics == nil {
+		if c.Metrics == nil || key%c.lifeSampleRate != 0 {
 			return
 		}
-		startTs[key] = time.Now()
+		startTs[key] = c.clock.Now()
 		if len(startTs) > numToKeep {
 			for k := range startTs {
 				if len(startTs) <= numToKeep {
@@ -439,67 +2703,336 @@ func (c *Cache) processItems() {
 			}
 		}
 	}
-	onEvict := func(i *Item) {
+	trackExit := func(i *Item) {
 		if ts, has := startTs[i.Key]; has {
-			c.Metrics.trackEviction(int64(time.Since(ts) / time.Second))
+			c.Metrics.trackEviction(int64(c.clock.Now().Sub(ts) / time.Second))
 			delete(startTs, i.Key)
 		}
+	}
+	onEvict := func(i *Item) {
+		trackExit(i)
+		i.ns = c.namespaceOf(i.Key)
+		// Items with tags, including the ones of namespaces, would come back
+		// without them.
+		if i.ns == nil && !c.tags.has(i.Key) {
+			i.victim = c.victims.add(i, i.Cost)
+		}
+		c.tags.del(i.Key)
+		c.ages.del(i.Key)
+		i.origKey = c.backing.forget(i.Key)
+		c.publish(EventEvict, i)
 		if c.onEvict != nil {
 			c.onEvict(i)
 		}
 	}
+	onExpire := func(i *Item) {
+		trackExit(i)
+		c.shadow.del(i.Key)
+		c.tags.del(i.Key)
+		c.ages.del(i.Key)
+		c.backing.forget(i.Key)
+		c.publish(EventExpire, i)
+		if c.onExpire != nil {
+			c.onExpire(i)
+		}
+	}
+
+	evictVictims := func(victims []*Item) []*Item {
+		// Take all the victims out of the store before calling any callback,
+		// so the store agrees with the policy by the time one runs.
+		evicted := victims[:0]
+		for _, victim := range victims {
+			// Fetch the value while deleting it so the callback gets exactly
+			// what was removed from the store.
+			var ok bool
+			if c.victims != nil {
+				victim.Expiration = c.store.Expiration(victim.Key)
+			}
+			victim.Conflict, victim.Value, ok = c.store.Del(victim.Key, 0)
+			if ok {
+				evicted = append(evicted, victim)
+			}
+		}
+		for _, victim := range evicted {
+			onEvict(victim)
+		}
+		return evicted
+	}
+
+	// rejectItem drops an item whose value Config.Cost didn't give a positive
+	// cost, or one over MaxItemCost, counting it as t. Set has already stored
+	// the value of an update, so the key goes.
+	rejectItem := func(i *Item, t metricType) {
+		c.Metrics.add(t, i.Key, 1)
+		if i.flag == itemUpdate {
+			c.policy.Del(i.Key)
+			c.store.Del(i.Key, i.Conflict)
+			c.tags.del(i.Key)
+			c.ages.del(i.Key)
+			c.backing.forget(i.Key)
+		}
+		switch t {
+		case rejectCosts:
+			i.entry.reject(RejectCost)
+		default:
+			i.entry.reject(RejectTooLarge)
+		}
+		c.publish(EventReject, i)
+		c.onReject(i)
+		i.report(setRejected)
+		if i.flag == itemNew {
+			c.pending.done(i)
+		}
+	}
 
 	for {
 		select {
 		case i := <-c.setBuf:
-			if i.wg != nil {
-				i.wg.Done()
+			if i.wait != nil {
+				close(i.wait)
+				continue
+			}
+			if i.group != nil {
+				c.applyGroup(i.group, evictVictims, trackAdmission)
+				continue
+			}
+			if i.batch != nil {
+				c.applyDelBatch(i.batch)
+				continue
+			}
+			if i.sets != nil {
+				c.applySetBatch(i.sets, evictVictims, trackAdmission)
+				continue
+			}
+			if i.flag == itemUpdate && c.order.stripe(i.Key).done(i.Key) {
+				// The value was evicted before the key was admitted again, so
+				// its cost would be charged to the newer value.
+				i.entry.update()
+				i.report(setStored)
 				continue
 			}
 			// Calculate item cost value if new or update.
-			if i.Cost == 0 && c.cost != nil && i.flag != itemDelete {
-				i.Cost = c.cost(i.Value)
+			if i.Cost == 0 && c.cost != nil && (i.flag == itemNew || i.flag == itemUpdate) {
+				if i.Cost = c.costOf(i.Value); i.Cost <= 0 {
+					rejectItem(i, rejectCosts)
+					continue
+				}
+				if c.tooLarge(i) {
+					rejectItem(i, rejectLarge)
+					continue
+				}
 			}
-			if !c.ignoreInternalCost {
-				// Add the cost of internally storing the object.
-				i.Cost += itemSize
+			// An item without a cost would never count against MaxCost, so
+			// treat it as the smallest possible unit instead.
+			if i.Cost == 0 && i.flag != itemDelete {
+				i.Cost = 1
 			}
+			// Add the cost of internally storing the object.
+			i.Cost += c.internalCost
 
 			switch i.flag {
 			case itemNew:
-				victims, added := c.policy.Add(i.Key, i.Cost)
+				if c.store.Conflicts(i.Key, i.Conflict) {
+					// Another key has the same hash. The slot only holds one
+					// of them, so the key already in it stays.
+					c.countConflict(i.Key)
+					i.entry.reject(RejectConflict)
+					c.publish(EventReject, i)
+					c.onReject(i)
+					i.report(setRejected)
+					break
+				}
+				c.shadow.set(i.Key, i.Cost)
+				if i.ifAbsent != nil {
+					if _, ok := c.store.Get(i.Key, i.Conflict); ok {
+						i.ifAbsent <- setExists
+						break
+					}
+				}
+				prev, updated, present := c.order.stripe(i.Key).updateIfLatest(c.store, i)
+				if present && !updated {
+					// The key has been updated since this Set, which has
+					// lost to the newer value.
+					c.onExit(i.Value)
+					i.entry.update()
+					i.report(setStored)
+					break
+				}
+				if updated {
+					// A Set buffered before this one has already admitted the
+					// key, so apply this one as an update instead of dropping
+					// the newer value.
+					c.onExit(prev)
+					victims, _ := c.policy.UpdateCost(i.Key, i.Cost)
+					i.entry.evicted(evictVictims(victims))
+					c.tags.set(i.Key, i.Conflict, i.tags)
+					c.ages.set(i.Key, c.idleSeconds(i.maxIdle))
+					c.backing.remember(i)
+					c.setPriority(i)
+					c.pinEntry(i)
+					c.publish(EventUpdate, i)
+					i.entry.update()
+					i.report(setStored)
+					break
+				}
+				add := c.policy.Add
+				switch class := c.classOf(i); {
+				case class != "":
+					add = func(key uint64, cost int64) ([]*Item, bool) {
+						return c.policy.AddClass(key, cost, class, i.force)
+					}
+				case i.force:
+					add = c.policy.AddForce
+				}
+				var victims []*Item
+				var added bool
+				if i.sampled {
+					start := time.Now()
+					victims, added = add(i.Key, i.Cost)
+					c.latency.since(PhasePolicy, start)
+				} else {
+					victims, added = add(i.Key, i.Cost)
+				}
+				// The policy has admitted the item and dropped its victims, so
+				// update the store to match before calling any callback.
 				if added {
 					c.store.Set(i)
+					c.tags.set(i.Key, i.Conflict, i.tags)
+					c.ages.set(i.Key, c.idleSeconds(i.maxIdle))
+					c.backing.remember(i)
+					c.setPriority(i)
+					c.pinEntry(i)
 					c.Metrics.add(keyAdd, i.Key, 1)
 					trackAdmission(i.Key)
+				}
+				i.entry.evicted(evictVictims(victims))
+				if added {
+					c.publish(EventAdmit, i)
+					i.report(setStored)
 				} else {
+					i.entry.reject(RejectAdmission)
+					c.publish(EventReject, i)
 					c.onReject(i)
-				}
-				for _, victim := range victims {
-					victim.Conflict, victim.Value = c.store.Del(victim.Key, 0)
-					onEvict(victim)
+					i.report(setRejected)
 				}
 
 			case itemUpdate:
-				c.policy.Update(i.Key, i.Cost)
+				c.shadow.set(i.Key, i.Cost)
+				if i.Cost > c.policy.MaxCost() {
+					// The max cost was lowered since Set checked it.
+					rejectItem(i, rejectSets)
+					continue
+				}
+				// A larger value makes room for itself like UpdateCost.
+				victims, _ := c.policy.UpdateCost(i.Key, i.Cost)
+				i.entry.evicted(evictVictims(victims))
+				c.tags.set(i.Key, i.Conflict, i.tags)
+				c.ages.set(i.Key, c.idleSeconds(i.maxIdle))
+				c.backing.remember(i)
+				c.setPriority(i)
+				c.pinEntry(i)
+				c.publish(EventUpdate, i)
+				i.report(setStored)
+
+			case itemCost:
+				c.shadow.update(i.Key, i.Cost)
+				victims, updated := c.policy.UpdateCost(i.Key, i.Cost)
+				evictVictims(victims)
+				if updated {
+					c.publish(EventUpdate, i)
+				}
 
 			case itemDelete:
+				if i.replace {
+					value, ok := c.order.stripe(i.Key).delIfLatest(c.store, i.Key, i.Conflict)
+					if !ok {
+						// The key isn't there, or a newer value is.
+						c.victims.deleted(i.Key)
+						break
+					}
+					c.onExit(value)
+				}
+				if c.store.Conflicts(i.Key, i.Conflict) {
+					// The key was never in the cache, and the policy tracks
+					// the other key with the same hash.
+					break
+				}
+				if c.events.active() {
+					// Only the Del that removed the key from the store has
+					// the policy still tracking it.
+					if i.Cost = c.policy.Cost(i.Key); i.Cost >= 0 {
+						c.publish(EventDelete, i)
+					}
+				}
 				c.policy.Del(i.Key) // Deals with metrics updates.
-				_, val := c.store.Del(i.Key, i.Conflict)
+				c.shadow.del(i.Key)
+				c.tags.del(i.Key)
+				c.ages.del(i.Key)
+				c.backing.forget(i.Key)
+				_, val, _ := c.store.Del(i.Key, i.Conflict)
 				c.onExit(val)
+				c.victims.deleted(i.Key)
 			}
-		case <-c.cleanupTicker.C:
-			c.store.Cleanup(c.policy, onEvict)
+			if i.flag == itemNew {
+				c.pending.done(i)
+			}
+		case <-c.trim:
+			if c.isFrozen() {
+				break
+			}
+			victims := c.policy.Trim(trimBatchSize)
+			evictVictims(victims)
+			if len(victims) == trimBatchSize {
+				// There may be more to evict. Do it on a later iteration so
+				// that pending Sets aren't held up.
+				c.requestTrim()
+			}
+		case r := <-c.shed:
+			if c.isFrozen() {
+				r.evicted <- nil
+				break
+			}
+			r.evicted <- evictVictims(c.policy.Shed(r.n, r.cost))
+		case <-c.cleanupTicker.C():
+			if c.isFrozen() {
+				// Expired items are left to the frozen table to skip.
+				break
+			}
+			if !c.logDebug {
+				c.store.Cleanup(c.policy, onExpire)
+				c.sweepIdle(onExpire)
+				c.repair(repairBatchSize)
+				continue
+			}
+			var expired int
+			c.store.Cleanup(c.policy, func(i *Item) {
+				expired++
+				onExpire(i)
+			})
+			expired += c.sweepIdle(onExpire)
+			c.repair(repairBatchSize)
+			c.logger.Log(LogDebug, "expired items cleaned up", "items", expired)
 		case <-c.stop:
 			return
 		}
 	}
 }
 
+// countConflict counts a lookup or a Set finding the hash of its key held by
+// another key.
+func (c *Cache) countConflict(key uint64) {
+	c.Metrics.add(keyConflicts, key, 1)
+	if c.logDebug {
+		c.logger.Log(LogDebug, "key conflict", "key", key)
+	}
+}
+
 // collectMetrics just creates a new *Metrics instance and adds the pointers
 // to the cache and policy instances.
 func (c *Cache) collectMetrics() {
 	c.Metrics = newMetrics()
+	c.Metrics.internalCost = uint64(c.internalCost)
+	c.calls.metrics = c.Metrics
 	c.policy.CollectMetrics(c.Metrics)
 }
 
@@ -523,6 +3056,45 @@ const (
 	// floor.
 	dropGets
 	keepGets
+	// The following keeps track of the Sets rejected because Config.Cost
+	// didn't give their value a positive cost.
+	rejectCosts
+	// The following keeps track of the Sets rejected for a cost over
+	// Config.MaxItemCost.
+	rejectLarge
+	// The following keeps track of the OnEvict and OnExpire callbacks skipped
+	// because the EvictWorkers queue was full.
+	dropCallbacks
+	// The following keeps track of the callbacks of the Config that panicked.
+	panicCallbacks
+	// The following keeps track of the keys the policy had but the store
+	// didn't, removed from the policy.
+	ghostsRemoved
+	// The following keeps track of the lookups and Sets that found their key's
+	// hash held by another key.
+	keyConflicts
+	// The following keeps track of the events dropped for subscribers whose
+	// channel was full.
+	dropEvents
+	// The following keeps track of the background refreshes of stale values
+	// that failed.
+	refreshErrors
+	// The following keeps track of the lookups that found an entry set by
+	// SetNegative.
+	negativeHits
+	// The following keeps track of the lookups that found their key in the
+	// victim cache.
+	victimHits
+	// The following keeps track of the hints that raised the frequency of
+	// their key.
+	hints
+	// The following keeps track of the bytes copied by Config.CopyOnRead and
+	// GetCopy.
+	bytesCopied
+	// The following 2 keep track of the hits and misses the Config.ShadowPolicy
+	// would have had.
+	shadowHit
+	shadowMiss
 	// This should be the final enum. Other enums should be set before this.
 	doNotUse
 )
@@ -547,6 +3119,34 @@ func stringFor(t metricType) string {
 		return "sets-dropped"
 	case rejectSets:
 		return "sets-rejected" // by policy.
+	case rejectCosts:
+		return "sets-rejected-by-cost"
+	case rejectLarge:
+		return "sets-rejected-too-large"
+	case dropCallbacks:
+		return "callbacks-dropped"
+	case panicCallbacks:
+		return "callbacks-panicked"
+	case ghostsRemoved:
+		return "ghosts-removed"
+	case keyConflicts:
+		return "keys-conflicted"
+	case dropEvents:
+		return "events-dropped"
+	case refreshErrors:
+		return "refresh-errors"
+	case negativeHits:
+		return "negative-hits"
+	case victimHits:
+		return "victim-hits"
+	case hints:
+		return "hints"
+	case bytesCopied:
+		return "bytes-copied"
+	case shadowHit:
+		return "shadow-hits"
+	case shadowMiss:
+		return "shadow-misses"
 	case dropGets:
 		return "gets-dropped"
 	case keepGets:
@@ -558,22 +3158,50 @@ func stringFor(t metricType) string {
 
 // Metrics is a snapshot of performance statistics for the lifetime of a cache instance.
 type Metrics struct {
-	all [doNotUse][]*uint64
+	// loadsInFlight comes first to be 64-bit aligned. It's a gauge rather than
+	// a counter, so Clear leaves it alone.
+	loadsInFlight int64
+	// all holds the counters of every metric, each striped over slots summed
+	// on read, so that processors counting at the same time don't write to
+	// the same cache line.
+	all [doNotUse][]paddedCounter
 
 	mu   sync.RWMutex
 	life *z.HistogramData // Tracks the life expectancy of a key.
+	// window, if set, also counts the hits and misses of the last intervals.
+	window *ratioWindow
+	costs  *costHistogram
+	// latency, if set, holds the durations timed by Config.SampleLatency.
+	latency *latencySampler
+	// internalCost is the internal cost of every item, which every key added
+	// or evicted accounts for.
+	internalCost uint64
+}
+
+// paddedCounter is a counter taking a whole cache line.
+type paddedCounter struct {
+	n uint64
+	_ [cacheLineSize - 8]byte
+}
+
+// metricSlots returns the number of slots the counters of a metric are striped
+// over: a power of two no smaller than GOMAXPROCS, and at least 8.
+func metricSlots() int {
+	slots := 8
+	for slots < runtime.GOMAXPROCS(0) {
+		slots <<= 1
+	}
+	return slots
 }
 
 func newMetrics() *Metrics {
 	s := &Metrics{
-		life: z.NewHistogramData(z.HistogramBounds(1, 16)),
+		life:  z.NewHistogramData(z.HistogramBounds(1, 16)),
+		costs: newCostHistogram(nil),
 	}
+	slots := metricSlots()
 	for i := 0; i < doNotUse; i++ {
-		s.all[i] = make([]*uint64, 256)
-		slice := s.all[i]
-		for j := range slice {
-			slice[j] = new(uint64)
-		}
+		s.all[i] = make([]paddedCounter, slots)
 	}
 	return s
 }
@@ -583,10 +3211,13 @@ func (p *Metrics) add(t metricType, hash, delta uint64) {
 		return
 	}
 	valp := p.all[t]
-	// Avoid false sharing by padding at least 64 bytes of space between two
-	// atomic counters which would be incremented.
-	idx := (hash % 25) * 10
-	atomic.AddUint64(valp[idx], delta)
+	// The hash alone would send every count of a hot key to the same slot, so
+	// it's mixed with the per-thread random source.
+	idx := (hash ^ uint64(z.FastRand())) & uint64(len(valp)-1)
+	atomic.AddUint64(&valp[idx].n, delta)
+	if p.window != nil && (t == hit || t == miss) {
+		p.window.add(t, idx, delta)
+	}
 }
 
 func (p *Metrics) get(t metricType) uint64 {
@@ -596,7 +3227,7 @@ func (p *Metrics) get(t metricType) uint64 {
 	valp := p.all[t]
 	var total uint64
 	for i := range valp {
-		total += atomic.LoadUint64(valp[i])
+		total += atomic.LoadUint64(&valp[i].n)
 	}
 	return total
 }
@@ -626,16 +3257,47 @@ func (p *Metrics) KeysEvicted() uint64 {
 	return p.get(keyEvict)
 }
 
-// CostAdded is the sum of costs that have been added (successful Set calls).
+// CostAdded is the sum of costs that have been added (successful Set calls),
+// including the internal cost of the items; see InternalCostAdded.
 func (p *Metrics) CostAdded() uint64 {
 	return p.get(costAdd)
 }
 
-// CostEvicted is the sum of all costs that have been evicted.
+// CostEvicted is the sum of all costs that have been evicted, including the
+// internal cost of the items; see InternalCostEvicted.
 func (p *Metrics) CostEvicted() uint64 {
 	return p.get(costEvict)
 }
 
+// LoadsInFlight is the number of GetOrCompute loads and background refreshes
+// in flight. Unlike the other metrics, it goes down as well as up, and isn't
+// reset by Clear.
+func (p *Metrics) LoadsInFlight() int64 {
+	if p == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&p.loadsInFlight)
+}
+
+// InternalCostAdded is the part of CostAdded charged for internally storing
+// the items, unless Config.IgnoreInternalCost is set. The rest is the cost of
+// the values themselves.
+func (p *Metrics) InternalCostAdded() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.KeysAdded() * p.internalCost
+}
+
+// InternalCostEvicted is the part of CostEvicted charged for internally
+// storing the items.
+func (p *Metrics) InternalCostEvicted() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.KeysEvicted() * p.internalCost
+}
+
 // SetsDropped is the number of Set calls that don't make it into internal
 // buffers (due to contention or some other reason).
 func (p *Metrics) SetsDropped() uint64 {
@@ -647,6 +3309,111 @@ func (p *Metrics) SetsRejected() uint64 {
 	return p.get(rejectSets)
 }
 
+// SetsRejectedByCost is the number of Set calls rejected because Config.Cost
+// returned a cost that isn't positive.
+func (p *Metrics) SetsRejectedByCost() uint64 {
+	return p.get(rejectCosts)
+}
+
+// SetsRejectedTooLarge is the number of Set calls rejected for a cost over
+// Config.MaxItemCost.
+func (p *Metrics) SetsRejectedTooLarge() uint64 {
+	return p.get(rejectLarge)
+}
+
+// CallbacksDropped is the number of OnEvict and OnExpire calls skipped because
+// the Config.EvictWorkers queue was full. See Config.DropEvictCallbacks.
+func (p *Metrics) CallbacksDropped() uint64 {
+	return p.get(dropCallbacks)
+}
+
+// CallbackPanics is the number of calls to the callbacks of the Config that
+// panicked, loaders aside. The panics are recovered so that the cache stays
+// consistent, and logged with Config.Logger.
+func (p *Metrics) CallbackPanics() uint64 {
+	return p.get(panicCallbacks)
+}
+
+// GhostsRemoved is the number of keys found tracked by the policy but missing
+// from the store, and removed from the policy, including the ones a custom
+// Policy picked as victims.
+func (p *Metrics) GhostsRemoved() uint64 {
+	return p.get(ghostsRemoved)
+}
+
+// KeyConflicts is the number of lookups and Sets that found the hash of their
+// key held by another key, going by the second hash of Config.KeyToHash. Such a
+// lookup is a miss, and such a Set is rejected, so neither sees the other key's
+// value.
+func (p *Metrics) KeyConflicts() uint64 {
+	return p.get(keyConflicts)
+}
+
+// EventsDropped is the number of events not sent to a subscriber because its
+// channel was full, counted once per subscriber. See Cache.Subscribe.
+func (p *Metrics) EventsDropped() uint64 {
+	return p.get(dropEvents)
+}
+
+// RefreshErrors is the number of background refreshes of stale values that
+// failed, leaving the stale value in place. See Config.FreshFor.
+func (p *Metrics) RefreshErrors() uint64 {
+	return p.get(refreshErrors)
+}
+
+// NegativeHits is the number of lookups that found an entry set by
+// SetNegative. They count as neither hits nor misses.
+func (p *Metrics) NegativeHits() uint64 {
+	return p.get(negativeHits)
+}
+
+// VictimHits is the number of lookups that missed the cache but found their
+// key in the victim cache, and admitted it again. See Config.VictimCacheSize.
+// They count as neither hits nor misses.
+func (p *Metrics) VictimHits() uint64 {
+	return p.get(victimHits)
+}
+
+// Hints is the number of keys passed to Hint whose estimated access frequency
+// was raised. Keys already at Config.HintWeight aren't counted. Hints aren't
+// counted as hits or misses either.
+func (p *Metrics) Hints() uint64 {
+	return p.get(hints)
+}
+
+// BytesCopied is the number of bytes of the []byte values copied by Gets with
+// Config.CopyOnRead, and by GetCopy.
+func (p *Metrics) BytesCopied() uint64 {
+	return p.get(bytesCopied)
+}
+
+// ShadowHits is the number of Gets that would have been hits with the
+// Config.ShadowPolicy picking the victims. It's only counted when ShadowPolicy
+// is set.
+func (p *Metrics) ShadowHits() uint64 {
+	return p.get(shadowHit)
+}
+
+// ShadowMisses is the number of Gets that would have missed with the
+// Config.ShadowPolicy picking the victims. It's only counted when ShadowPolicy
+// is set.
+func (p *Metrics) ShadowMisses() uint64 {
+	return p.get(shadowMiss)
+}
+
+// ShadowRatio is the hit ratio the cache would have had with the
+// Config.ShadowPolicy, to compare with Ratio.
+func (p *Metrics) ShadowRatio() float64 {
+	if p == nil {
+		return 0.0
+	}
+	hits, misses := p.get(shadowHit), p.get(shadowMiss)
+	if hits == 0 && misses == 0 {
+		return 0.0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
 // GetsDropped is the number of Get counter increments that are dropped
 // internally.
 func (p *Metrics) GetsDropped() uint64 {
@@ -696,12 +3463,21 @@ func (p *Metrics) Clear() {
 	}
 	for i := 0; i < doNotUse; i++ {
 		for j := range p.all[i] {
-			atomic.StoreUint64(p.all[i][j], 0)
+			atomic.StoreUint64(&p.all[i][j].n, 0)
 		}
 	}
 	p.mu.Lock()
 	p.life = z.NewHistogramData(z.HistogramBounds(1, 16))
 	p.mu.Unlock()
+	if p.window != nil {
+		p.window.clear()
+	}
+	p.costs.clear()
+	if p.latency != nil {
+		for phase := range p.latency.hists {
+			p.latency.hists[phase].clear()
+		}
+	}
 }
 
 // String returns a string representation of the metrics.
@@ -718,3 +3494,82 @@ func (p *Metrics) String() string {
 	fmt.Fprintf(&buf, "hit-ratio: %.2f", p.Ratio())
 	return buf.String()
 }
+
+// metricsJSON is the JSON representation of Metrics. Fields are only ever
+// added to it, so that tools reading it keep working.
+type metricsJSON struct {
+	Hits         uint64  `json:"hits"`
+	Misses       uint64  `json:"misses"`
+	KeysAdded    uint64  `json:"keys_added"`
+	KeysUpdated  uint64  `json:"keys_updated"`
+	KeysEvicted  uint64  `json:"keys_evicted"`
+	CostAdded    uint64  `json:"cost_added"`
+	CostEvicted  uint64  `json:"cost_evicted"`
+	SetsDropped  uint64  `json:"sets_dropped"`
+	SetsRejected uint64  `json:"sets_rejected"`
+	GetsDropped  uint64  `json:"gets_dropped"`
+	GetsKept     uint64  `json:"gets_kept"`
+	GetsTotal    uint64  `json:"gets_total"`
+	HitRatio     float64 `json:"hit_ratio"`
+
+	SetsRejectedByCost   uint64  `json:"sets_rejected_by_cost"`
+	SetsRejectedTooLarge uint64  `json:"sets_rejected_too_large"`
+	CallbacksDropped     uint64  `json:"callbacks_dropped"`
+	CallbackPanics       uint64  `json:"callback_panics"`
+	GhostsRemoved        uint64  `json:"ghosts_removed"`
+	KeyConflicts         uint64  `json:"key_conflicts"`
+	EventsDropped        uint64  `json:"events_dropped"`
+	RefreshErrors        uint64  `json:"refresh_errors"`
+	NegativeHits         uint64  `json:"negative_hits"`
+	VictimHits           uint64  `json:"victim_hits"`
+	Hints                uint64  `json:"hints"`
+	BytesCopied          uint64  `json:"bytes_copied"`
+	ShadowHits           uint64  `json:"shadow_hits"`
+	ShadowMisses         uint64  `json:"shadow_misses"`
+	ShadowHitRatio       float64 `json:"shadow_hit_ratio"`
+	InternalCostAdded    uint64  `json:"internal_cost_added"`
+	InternalCostEvicted  uint64  `json:"internal_cost_evicted"`
+	LoadsInFlight        int64   `json:"loads_in_flight"`
+}
+
+// MarshalJSON returns the counters of the metrics as a JSON object, along with
+// the total number of Gets and the hit ratio.
+func (p *Metrics) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(metricsJSON{
+		Hits:         p.Hits(),
+		Misses:       p.Misses(),
+		KeysAdded:    p.KeysAdded(),
+		KeysUpdated:  p.KeysUpdated(),
+		KeysEvicted:  p.KeysEvicted(),
+		CostAdded:    p.CostAdded(),
+		CostEvicted:  p.CostEvicted(),
+		SetsDropped:  p.SetsDropped(),
+		SetsRejected: p.SetsRejected(),
+		GetsDropped:  p.GetsDropped(),
+		GetsKept:     p.GetsKept(),
+		GetsTotal:    p.Hits() + p.Misses(),
+		HitRatio:     p.Ratio(),
+
+		SetsRejectedByCost:   p.SetsRejectedByCost(),
+		SetsRejectedTooLarge: p.SetsRejectedTooLarge(),
+		CallbacksDropped:     p.CallbacksDropped(),
+		CallbackPanics:       p.CallbackPanics(),
+		GhostsRemoved:        p.GhostsRemoved(),
+		KeyConflicts:         p.KeyConflicts(),
+		EventsDropped:        p.EventsDropped(),
+		RefreshErrors:        p.RefreshErrors(),
+		NegativeHits:         p.NegativeHits(),
+		VictimHits:           p.VictimHits(),
+		Hints:                p.Hints(),
+		BytesCopied:          p.BytesCopied(),
+		ShadowHits:           p.ShadowHits(),
+		ShadowMisses:         p.ShadowMisses(),
+		ShadowHitRatio:       p.ShadowRatio(),
+		InternalCostAdded:    p.InternalCostAdded(),
+		InternalCostEvicted:  p.InternalCostEvicted(),
+		LoadsInFlight:        p.LoadsInFlight(),
+	})
+}
@@ -1,16 +1,23 @@
 package ristretto
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/dgryski/go-farm"
 	"github.com/stretchr/testify/require"
 )
 
@@ -39,6 +46,136 @@ func TestCacheKeyToHash(t *testing.T) {
 	require.Equal(t, 3, keyToHashCount)
 }
 
+func TestCacheKeyToHashEquivalent(t *testing.T) {
+	// Caches hashing keys differently give the same answers.
+	newCache := func(keyToHash func(key interface{}) (uint64, uint64)) *Cache {
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            1000,
+			IgnoreInternalCost: true,
+			BufferItems:        64,
+			KeyToHash:          keyToHash,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	caches := []*Cache{
+		newCache(nil),
+		newCache(func(key interface{}) (uint64, uint64) {
+			k := key.(string)
+			return farm.Fingerprint64([]byte(k)), xxhash.Sum64String(k)
+		}),
+	}
+	defer func() {
+		for _, c := range caches {
+			c.Close()
+		}
+	}()
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("https://example.com/%d", r.Intn(200))
+		op, value := r.Intn(4), r.Int()
+		var results []interface{}
+		for _, c := range caches {
+			switch op {
+			case 0:
+				val, ok := c.Del(key)
+				results = append(results, val, ok)
+			case 1:
+				stored, exists := c.SetIfAbsent(key, value, 1)
+				results = append(results, stored, exists)
+			case 2:
+				results = append(results, c.SetForce(key, value, 1))
+			default:
+				val, ok := c.Get(key)
+				results = append(results, val, ok)
+			}
+			c.Wait()
+		}
+		half := len(results) / 2
+		require.Equal(t, results[:half], results[half:], "op %d on %s", op, key)
+	}
+	require.Equal(t, caches[0].Len(), caches[1].Len())
+}
+
+func TestCacheKeyConflicts(t *testing.T) {
+	// Every key gets the same first hash, so only the second one tells them
+	// apart.
+	keyToHash := func(key interface{}) (uint64, uint64) {
+		return 1, xxhash.Sum64String(key.(string))
+	}
+	var rejected []interface{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		KeyToHash:          keyToHash,
+		OnReject: func(item *Item) {
+			rejected = append(rejected, item.Value)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set("a", "value of a", 1))
+	c.Wait()
+	c.Set("b", "value of b", 2)
+	c.Wait()
+	val, ok := c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, "value of a", val)
+	_, ok = c.Get("b")
+	require.False(t, ok)
+	require.Equal(t, []interface{}{"value of b"}, rejected)
+	require.Equal(t, int64(1), c.UsedCost())
+
+	stored, exists := c.SetIfAbsent("b", "value of b", 1)
+	require.False(t, stored)
+	require.False(t, exists)
+
+	// Deleting a key that collides leaves the other one alone.
+	_, ok = c.Del("b")
+	require.False(t, ok)
+	c.Wait()
+	val, ok = c.Get("a")
+	require.True(t, ok)
+	require.Equal(t, "value of a", val)
+	require.Equal(t, int64(1), c.UsedCost())
+	require.Equal(t, uint64(3), c.Metrics.KeyConflicts())
+
+	// Neither can it unpin the other key.
+	require.True(t, c.Pin("a"))
+	require.False(t, c.Unpin("b"))
+	require.True(t, c.Unpin("a"))
+
+	// Whichever key holds the slot at any time, a Get only ever sees the value
+	// of its own key.
+	var wrong uint64
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "c", "d"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				switch i % 3 {
+				case 0:
+					c.Set(key, key, 1)
+				case 1:
+					c.Del(key)
+				}
+				if val, ok := c.Get(key); ok && val != key {
+					atomic.AddUint64(&wrong, 1)
+				}
+			}
+		}(key)
+	}
+	wg.Wait()
+	require.Zero(t, atomic.LoadUint64(&wrong))
+}
+
 func TestCacheMaxCost(t *testing.T) {
 	charset := "abcdefghijklmnopqrstuvwxyz0123456789"
 	key := func() []byte {
@@ -116,24 +253,217 @@ func TestUpdateMaxCost(t *testing.T) {
 	c.Del(1)
 }
 
-func TestNewCache(t *testing.T) {
-	_, err := NewCache(&Config{
-		NumCounters: 0,
-	})
-	require.Error(t, err)
+func TestUpdateMaxCostShrink(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"slru":    NewSLRUPolicy,
+		"arc":     NewARCPolicy,
+		"lru":     NewLRUPolicy,
+		"lirs":    NewLIRSPolicy,
+		"2q":      NewTwoQueuePolicy,
+		"hyper":   NewHyperbolicPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var evicted int64
+			c, err := NewCache(&Config{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+				OnEvict: func(item *Item) {
+					atomic.AddInt64(&evicted, 1)
+				},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 1000; i++ {
+				require.True(t, c.Set(i, i, 1))
+			}
+			c.Wait()
+			require.Equal(t, int64(1000), c.UsedCost())
+
+			// Keep the cache busy while it shrinks.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 1000; i++ {
+					c.Get(i)
+				}
+			}()
+			c.UpdateMaxCost(100)
+			<-done
+			for start := time.Now(); c.UsedCost() > 100; time.Sleep(time.Millisecond) {
+				require.True(t, time.Since(start) < time.Second, "cache didn't shrink")
+			}
+			c.Wait()
+			require.Equal(t, int64(100), c.UsedCost())
+			require.Equal(t, 100, c.Len())
+			require.Equal(t, int64(900), atomic.LoadInt64(&evicted))
 
-	_, err = NewCache(&Config{
-		NumCounters: 100,
-		MaxCost:     0,
-	})
-	require.Error(t, err)
+			// Growing again only raises the limit.
+			c.UpdateMaxCost(200)
+			c.Wait()
+			require.Equal(t, 100, c.Len())
+		})
+	}
+}
 
-	_, err = NewCache(&Config{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 0,
-	})
-	require.Error(t, err)
+func TestCacheEvictN(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default":  nil,
+		"lru":      NewLRUPolicy,
+		"wtinylfu": NewWTinyLFUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var evicted int64
+			c, err := NewCache(&Config{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+				OnEvict: func(item *Item) {
+					atomic.AddInt64(&evicted, 1)
+				},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 500; i++ {
+				require.True(t, c.Set(i, i, 2))
+			}
+			c.Wait()
+			require.True(t, c.Pin(0))
+
+			// More than a batch, with Gets going on.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 1000; i++ {
+					c.Get(i % 500)
+				}
+			}()
+			require.Equal(t, 300, c.EvictN(300))
+			<-done
+			require.Equal(t, int64(300), atomic.LoadInt64(&evicted))
+			require.Equal(t, 200, c.Len())
+			require.Equal(t, int64(400), c.UsedCost())
+
+			// At least the cost asked for is freed.
+			require.Equal(t, int64(6), c.EvictCost(5))
+			require.Equal(t, 197, c.Len())
+
+			// Only the pinned item is left.
+			require.Equal(t, 196, c.EvictN(1000))
+			require.Zero(t, c.EvictCost(100))
+			_, ok := c.Get(0)
+			require.True(t, ok)
+			require.Equal(t, int64(2), c.UsedCost())
+		})
+	}
+
+	c, err := NewCache(&Config{NumCounters: 100, MaxCost: 10, BufferItems: 64})
+	require.NoError(t, err)
+	c.Close()
+	require.Zero(t, c.EvictN(1))
+	require.Zero(t, c.EvictCost(1))
+}
+
+func TestNewCache(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+		}
+	}
+	newMap := func() Map { return NewSyncMap() }
+	codec := func(c *Config) {
+		c.EncodeValue = func(interface{}) ([]byte, error) { return nil, nil }
+		c.DecodeValue = func([]byte) (interface{}, error) { return nil, nil }
+	}
+	for _, tc := range []struct {
+		err    string
+		config func(c *Config)
+	}{
+		{"NumCounters must be positive, got 0", func(c *Config) { c.NumCounters = 0 }},
+		{"NumCounters must be positive, got -1", func(c *Config) { c.NumCounters = -1 }},
+		{"MaxCost must be positive, got 0", func(c *Config) { c.MaxCost = 0 }},
+		{"MaxCost must be positive, got -5", func(c *Config) { c.MaxCost = -5 }},
+		{"MaxEntries can't be negative, got -1", func(c *Config) { c.MaxEntries = -1 }},
+		{"MaxItemCost can't be negative, got -1", func(c *Config) { c.MaxItemCost = -1 }},
+		{"StoreShards must be a power of two, got 3", func(c *Config) { c.StoreShards = 3 }},
+		{"StoreShards must be a power of two, got -4", func(c *Config) { c.StoreShards = -4 }},
+		{"StoreShards can't be set with NewMap", func(c *Config) {
+			c.StoreShards = 4
+			c.NewMap = newMap
+		}},
+		{"StoreEncoded requires EncodeValue and DecodeValue", func(c *Config) { c.StoreEncoded = true }},
+		{"StoreEncoded can't be set with NewMap", func(c *Config) {
+			codec(c)
+			c.StoreEncoded = true
+			c.NewMap = newMap
+		}},
+		{"OffHeap requires StoreEncoded", func(c *Config) { c.OffHeap = true }},
+		{"EvictWorkers can't be negative, got -1", func(c *Config) { c.EvictWorkers = -1 }},
+		{"EvictQueueSize can't be negative, got -1", func(c *Config) { c.EvictQueueSize = -1 }},
+		{"BufferItems can't be negative, got -64", func(c *Config) { c.BufferItems = -64 }},
+		{"unknown BufferMode 7", func(c *Config) { c.BufferMode = 7 }},
+		{"BufferTimeout can't be negative, got -1s", func(c *Config) {
+			c.BufferMode = BufferBlocking
+			c.BufferTimeout = -time.Second
+		}},
+		{"BufferTimeout requires BufferMode BufferBlocking", func(c *Config) { c.BufferTimeout = time.Second }},
+		{"Synchronous can't be set with BufferMode", func(c *Config) {
+			c.Synchronous = true
+			c.BufferMode = BufferLossless
+		}},
+		{"BufferStripes can't be negative, got -1", func(c *Config) { c.BufferStripes = -1 }},
+		{"EvictionSamples can't be negative, got -1", func(c *Config) { c.EvictionSamples = -1 }},
+		{"AgingFactor can't be negative, got -0.5", func(c *Config) { c.AgingFactor = -0.5 }},
+		{"HighWatermark must be between 0 and 1, got 1.5", func(c *Config) { c.HighWatermark = 1.5 }},
+		{"LowWatermark must be between 0 and 1, got -0.5", func(c *Config) { c.LowWatermark = -0.5 }},
+		{"LowWatermark can't be over HighWatermark, got 0.9 and 0.8", func(c *Config) {
+			c.HighWatermark = 0.8
+			c.LowWatermark = 0.9
+		}},
+		{"LifeExpectancyKeys can't be negative, got -1", func(c *Config) { c.LifeExpectancyKeys = -1 }},
+		{"LifeExpectancySampleRate can't be negative, got -1", func(c *Config) { c.LifeExpectancySampleRate = -1 }},
+		{"DefaultTTL can't be negative, got -1m0s", func(c *Config) { c.DefaultTTL = -time.Minute }},
+		{"NegativeTTL can't be negative, got -1m0s", func(c *Config) { c.NegativeTTL = -time.Minute }},
+		{"NegativeCost can't be negative, got -1", func(c *Config) { c.NegativeCost = -1 }},
+		{"VictimCacheSize can't be negative, got -1", func(c *Config) { c.VictimCacheSize = -1 }},
+		{"HintWeight can't be negative, got -1", func(c *Config) { c.HintWeight = -1 }},
+		{"MaxIdle can't be negative, got -1s", func(c *Config) { c.MaxIdle = -time.Second }},
+		{"MetricsName requires Metrics", func(c *Config) { c.MetricsName = "x" }},
+		{"CostBuckets must be positive and ascending", func(c *Config) {
+			c.Metrics = true
+			c.CostBuckets = []int64{2, 1}
+		}},
+		{"CostBuckets requires Metrics", func(c *Config) { c.CostBuckets = []int64{1} }},
+		{"RatioWindow can't be negative, got -1s", func(c *Config) { c.RatioWindow = -time.Second }},
+		{"RatioWindowBuckets can't be negative, got -1", func(c *Config) { c.RatioWindowBuckets = -1 }},
+		{"RatioWindow requires Metrics", func(c *Config) { c.RatioWindow = time.Second }},
+		{"RatioWindowBuckets requires RatioWindow", func(c *Config) { c.RatioWindowBuckets = 1 }},
+		{"FreshFor can't be negative, got -1s", func(c *Config) { c.FreshFor = -time.Second }},
+		{"StaleFor requires FreshFor", func(c *Config) { c.StaleFor = time.Second }},
+		{"StaleFor must be longer than FreshFor, got 1s and 2s", func(c *Config) {
+			c.FreshFor = 2 * time.Second
+			c.StaleFor = time.Second
+		}},
+		{"WriteBack requires Backing", func(c *Config) { c.WriteBack = true }},
+		{"Policy returned a nil Policy", func(c *Config) {
+			c.Policy = func(int64, int64) Policy { return nil }
+		}},
+	} {
+		config := valid()
+		tc.config(config)
+		_, err := NewCache(config)
+		require.EqualError(t, err, tc.err)
+		require.PanicsWithValue(t, "ristretto: "+tc.err, func() { MustNewCache(config) })
+	}
+	_, err := NewCache(nil)
+	require.EqualError(t, err, "Config can't be nil")
 
 	c, err := NewCache(&Config{
 		NumCounters: 100,
@@ -143,6 +473,15 @@ func TestNewCache(t *testing.T) {
 	})
 	require.NoError(t, err)
 	require.NotNil(t, c)
+	c.Close()
+
+	// BufferItems has a default.
+	c = MustNewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+	})
+	defer c.Close()
+	require.Equal(t, defaultBufferItems, c.getBuf.batches.size())
 }
 
 func TestNilCache(t *testing.T) {
@@ -182,6 +521,48 @@ func TestSetAfterClose(t *testing.T) {
 	require.False(t, c.Set(1, 1, 1))
 }
 
+func TestCloseConcurrentUse(t *testing.T) {
+	c, err := newTestCache()
+	require.NoError(t, err)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Set(i, i, 1)
+				c.Get(i)
+				c.Del(i)
+				c.Wait()
+			}
+		}(i)
+	}
+	time.Sleep(wait)
+	var closers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			c.Close()
+		}()
+	}
+	closers.Wait()
+	close(stop)
+	wg.Wait()
+
+	require.False(t, c.Set(1, 1, 1))
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	c.Wait()
+}
+
 func TestClearAfterClose(t *testing.T) {
 	c, err := newTestCache()
 	require.NoError(t, err)
@@ -214,6 +595,168 @@ func TestDelAfterClose(t *testing.T) {
 	c.Del(1)
 }
 
+// unusableCaches returns a nil cache and a closed one, which every method
+// treats alike.
+func unusableCaches(t *testing.T) map[string]*Cache {
+	closed, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		Writer:      func(key, value interface{}) error { return nil },
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			return "loaded", 1, nil
+		},
+	})
+	require.NoError(t, err)
+	require.True(t, closed.Set(1, 1, 1))
+	closed.Wait()
+	closed.Close()
+	return map[string]*Cache{"nil": nil, "closed": closed}
+}
+
+func TestCacheUnusable(t *testing.T) {
+	for name, c := range unusableCaches(t) {
+		t.Run(name, func(t *testing.T) {
+			never := func(*Item) bool {
+				t.Fatal("called back")
+				return true
+			}
+			val, ok := c.Get(1)
+			require.False(t, ok)
+			require.Nil(t, val)
+			_, ok = c.GetUint(1)
+			require.False(t, ok)
+			_, ok = c.GetLocal(1)
+			require.False(t, ok)
+			_, ok = c.GetCopy(1)
+			require.False(t, ok)
+			_, ok = c.Peek(1)
+			require.False(t, ok)
+			_, ok = c.GetAndTouch(1, time.Second)
+			require.False(t, ok)
+			ttl, ok := c.GetTTL(1)
+			require.False(t, ok)
+			require.Zero(t, ttl)
+			val, presence := c.Lookup(1)
+			require.Nil(t, val)
+			require.Equal(t, Unknown, presence)
+			values, found := c.GetMulti([]interface{}{1, 2})
+			require.Equal(t, []interface{}{nil, nil}, values)
+			require.Equal(t, []bool{false, false}, found)
+			hits, misses := c.GetMultiMap([]interface{}{1, 2, 1})
+			require.Empty(t, hits)
+			require.Equal(t, []interface{}{1, 2}, misses)
+			info, ok := c.EntryInfo(1)
+			require.False(t, ok)
+			require.Zero(t, info)
+
+			require.False(t, c.Set(1, 1, 1))
+			require.False(t, c.SetUint(1, 1, 1))
+			require.False(t, c.SetWithTTL(1, 1, 1, time.Second))
+			require.False(t, c.SetWithOptions(1, 1, 1, SetOptions{Tags: []string{"a"}}))
+			require.False(t, c.SetForce(1, 1, 1))
+			require.False(t, c.SetNegative(1, time.Second))
+			stored, exists := c.SetIfAbsent(1, 1, 1)
+			require.False(t, stored)
+			require.False(t, exists)
+			require.Equal(t, []bool{false, false}, c.SetMulti([]interface{}{1, 2},
+				[]interface{}{1, 2}, []int64{1, 1}))
+			require.Zero(t, c.Warm([]interface{}{1}, []interface{}{1}, []int64{1}))
+			require.False(t, c.Update(1, func(interface{}, bool) (interface{}, bool) {
+				t.Fatal("called back")
+				return nil, false
+			}))
+			require.False(t, c.UpdateCost(1, 2))
+			require.False(t, c.Touch(1, time.Second))
+			require.False(t, c.Pin(1))
+			require.False(t, c.Unpin(1))
+			res, err := c.SetEntry(1, 1, EntryOptions{})
+			require.Equal(t, ErrClosed, err)
+			require.False(t, res.Stored)
+			c.Hint(1, 2)
+
+			val, ok = c.Del(1)
+			require.False(t, ok)
+			require.Nil(t, val)
+			_, ok = c.DelUint(1)
+			require.False(t, ok)
+			_, ok = c.DelLocal(1)
+			require.False(t, ok)
+			require.Zero(t, c.DelFunc(never))
+			require.Zero(t, c.InvalidateTag("a"))
+			require.Zero(t, c.EvictN(1))
+			require.Zero(t, c.EvictCost(1))
+			require.Zero(t, c.Drain(never))
+			c.Range(never)
+			require.Empty(t, c.Keys())
+			require.Zero(t, c.Len())
+			require.Zero(t, c.UsedCost())
+			require.Zero(t, c.MaxCost())
+			require.Zero(t, c.MaxEntries())
+			require.Zero(t, c.SketchCounters())
+			require.Zero(t, c.WindowRatio())
+			require.Empty(t, c.TopKeys(1))
+			require.Zero(t, c.EstimateFrequency(1))
+			require.Empty(t, c.AdmissionTrace())
+			require.Zero(t, c.AgeReport())
+			require.Zero(t, c.Pressure())
+			require.Zero(t, c.BufferStats())
+			require.False(t, c.Frozen())
+
+			value, err := c.GetOrCompute(1, func() (interface{}, int64, error) {
+				return 2, 1, nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, 2, value)
+			// A closed cache still goes through to its loader and writer, a
+			// nil one has neither.
+			val, ok, err = c.ReadThrough(1)
+			if c == nil {
+				require.Error(t, err)
+				require.Error(t, c.SetThrough(1, 1, 1))
+			} else {
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.Equal(t, "loaded", val)
+				require.NoError(t, c.SetThrough(1, 1, 1))
+			}
+			require.Equal(t, ErrClosed, c.SaveTo(ioutil.Discard))
+
+			ch, unsubscribe := c.Subscribe(1)
+			_, open := <-ch
+			require.False(t, open)
+			unsubscribe()
+
+			ns := c.Namespace("ns")
+			require.False(t, ns.Set(1, 1, 1))
+			_, ok = ns.Get(1)
+			require.False(t, ok)
+			require.Zero(t, ns.Len())
+			require.Zero(t, ns.DropAll())
+			require.Zero(t, ns.UsedCost())
+			require.Zero(t, ns.Hits())
+
+			for _, handler := range []http.Handler{c.MetricsHandler(), c.DebugHandler()} {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				require.Equal(t, http.StatusOK, rec.Code)
+			}
+
+			c.Release(make([]byte, 64))
+			c.UpdateMaxCost(100)
+			c.UpdateQuota("ns", 0.5)
+			c.SetPressure(1)
+			c.Freeze()
+			c.Wait()
+			c.Flush()
+			c.Clear()
+			c.Close()
+			require.Zero(t, c.MaxCost())
+		})
+	}
+}
+
 func TestCacheProcessItems(t *testing.T) {
 	m := &sync.Mutex{}
 	evicted := make(map[uint64]struct{})
@@ -310,10 +853,46 @@ func TestCacheProcessItems(t *testing.T) {
 	m.Unlock()
 
 	defer func() {
-		require.NotNil(t, recover())
+		require.Nil(t, recover())
 	}()
 	c.Close()
-	c.setBuf <- &Item{flag: itemNew}
+	require.False(t, c.Set(1, 1, 1))
+}
+
+func TestCacheOnEvictValue(t *testing.T) {
+	evicted := make(map[uint64]interface{})
+	costs := make(map[uint64]int64)
+	m := &sync.Mutex{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            3,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(item *Item) {
+			m.Lock()
+			defer m.Unlock()
+			evicted[item.Key] = item.Value
+			costs[item.Key] = item.Cost
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, fmt.Sprintf("value-%d", i), 1))
+	}
+	c.Wait()
+	// Admitting a cost 3 item evicts everything else.
+	require.True(t, c.Set(3, "value-3", 3))
+	c.Wait()
+
+	m.Lock()
+	defer m.Unlock()
+	require.Len(t, evicted, 3)
+	for key, val := range evicted {
+		require.Equal(t, fmt.Sprintf("value-%d", key), val)
+		require.Equal(t, int64(1), costs[key])
+	}
 }
 
 func TestCacheGet(t *testing.T) {
@@ -350,157 +929,1735 @@ func TestCacheGet(t *testing.T) {
 	require.Nil(t, val)
 }
 
-// retrySet calls SetWithTTL until the item is accepted by the cache.
-func retrySet(t *testing.T, c *Cache, key, value int, cost int64, ttl time.Duration) {
-	for {
-		if set := c.SetWithTTL(key, value, cost, ttl); !set {
-			time.Sleep(wait)
-			continue
-		}
-
-		time.Sleep(wait)
-		val, ok := c.Get(key)
-		require.True(t, ok)
-		require.NotNil(t, val)
-		require.Equal(t, value, val.(int))
-		return
-	}
-}
-
-func TestCacheSet(t *testing.T) {
+func TestCachePeek(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
+		BufferItems:        1,
 		IgnoreInternalCost: true,
-		BufferItems:        64,
 		Metrics:            true,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
-	retrySet(t, c, 1, 1, 1, 0)
-
-	c.Set(1, 2, 2)
-	val, ok := c.store.Get(z.KeyToHash(1))
+	key, conflict := z.KeyToHash(1)
+	c.store.Set(&Item{Key: key, Conflict: conflict, Value: 1})
+	val, ok := c.Peek(1)
 	require.True(t, ok)
-	require.Equal(t, 2, val.(int))
-
-	c.stop <- struct{}{}
-	for i := 0; i < setBufSize; i++ {
-		key, conflict := z.KeyToHash(1)
-		c.setBuf <- &Item{
-			flag:     itemUpdate,
-			Key:      key,
-			Conflict: conflict,
-			Value:    1,
-			Cost:     1,
-		}
-	}
-	require.False(t, c.Set(2, 2, 1))
-	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
-	close(c.setBuf)
-	close(c.stop)
+	require.Equal(t, 1, val)
 
-	c = nil
-	require.False(t, c.Set(1, 1, 1))
-}
+	val, ok = c.Peek(2)
+	require.False(t, ok)
+	require.Nil(t, val)
 
-func TestCacheInternalCost(t *testing.T) {
-	c, err := NewCache(&Config{
-		NumCounters: 100,
-		MaxCost:     10,
-		BufferItems: 64,
-		Metrics:     true,
-	})
-	require.NoError(t, err)
+	key, conflict = z.KeyToHash(3)
+	c.store.Set(&Item{Key: key, Conflict: conflict, Value: 3,
+		Expiration: time.Now().Add(-time.Second).Unix()})
+	_, ok = c.Peek(3)
+	require.False(t, ok)
 
-	// Get should return false because the cache's cost is too small to store the item
-	// when accounting for the internal cost.
-	c.SetWithTTL(1, 1, 1, 0)
 	time.Sleep(wait)
-	_, ok := c.Get(1)
+	require.Equal(t, uint64(0), c.Metrics.Hits())
+	require.Equal(t, uint64(0), c.Metrics.Misses())
+	require.Equal(t, uint64(0), c.Metrics.GetsKept())
+	require.Equal(t, uint64(0), c.Metrics.GetsDropped())
+
+	c = nil
+	_, ok = c.Peek(1)
 	require.False(t, ok)
 }
 
-func TestRecacheWithTTL(t *testing.T) {
+func TestCacheGetNilValue(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
-		IgnoreInternalCost: true,
 		BufferItems:        64,
-		Metrics:            true,
+		IgnoreInternalCost: true,
 	})
-
 	require.NoError(t, err)
+	defer c.Close()
 
-	// Set initial value for key = 1
-	insert := c.SetWithTTL(1, 1, 1, 5*time.Second)
-	require.True(t, insert)
-	time.Sleep(2 * time.Second)
-
-	// Get value from cache for key = 1
+	require.True(t, c.Set(1, nil, 1))
+	c.Wait()
 	val, ok := c.Get(1)
 	require.True(t, ok)
-	require.NotNil(t, val)
-	require.Equal(t, 1, val)
-
-	// Wait for expiration
-	time.Sleep(5 * time.Second)
+	require.Nil(t, val)
 
-	// The cached value for key = 1 should be gone
-	val, ok = c.Get(1)
+	val, ok = c.Get(2)
 	require.False(t, ok)
 	require.Nil(t, val)
-
-	// Set new value for key = 1
-	insert = c.SetWithTTL(1, 2, 1, 5*time.Second)
-	require.True(t, insert)
-	time.Sleep(2 * time.Second)
-
-	// Get value from cache for key = 1
-	val, ok = c.Get(1)
-	require.True(t, ok)
-	require.NotNil(t, val)
-	require.Equal(t, 2, val)
 }
 
-func TestCacheSetWithTTL(t *testing.T) {
-	m := &sync.Mutex{}
-	evicted := make(map[uint64]struct{})
+func TestCacheGetMulti(t *testing.T) {
 	c, err := NewCache(&Config{
-		NumCounters:        100,
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	keys := make([]interface{}, 0, 20)
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i*10, 1))
+		keys = append(keys, i, 100+i)
+	}
+	c.Wait()
+	keys = append(keys, nil)
+
+	values, found := c.GetMulti(keys)
+	require.Len(t, values, len(keys))
+	require.Len(t, found, len(keys))
+	for i, key := range keys {
+		if key == nil || key.(int) >= 100 {
+			require.False(t, found[i])
+			require.Nil(t, values[i])
+			continue
+		}
+		require.True(t, found[i])
+		require.Equal(t, key.(int)*10, values[i])
+	}
+	require.Equal(t, uint64(10), c.Metrics.Hits())
+	require.Equal(t, uint64(10), c.Metrics.Misses())
+
+	c = nil
+	values, found = c.GetMulti([]interface{}{1})
+	require.Nil(t, values[0])
+	require.False(t, found[0])
+}
+
+func TestCacheSetMulti(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	added := c.SetMulti([]interface{}{1, 2, nil}, []interface{}{"a", "b", "c"},
+		[]int64{1, 1, 1})
+	require.Equal(t, []bool{true, true, false}, added)
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "b", val)
+
+	require.Equal(t, []bool{false}, c.SetMulti([]interface{}{1}, nil, nil))
+}
+
+func TestCacheWarm(t *testing.T) {
+	evicted := 0
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		OnEvict: func(item *Item) {
+			evicted++
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	keys := make([]interface{}, 20)
+	values := make([]interface{}, 20)
+	costs := make([]int64, 20)
+	for i := range keys {
+		keys[i], values[i], costs[i] = i, i, 1
+	}
+	require.Equal(t, 10, c.Warm(keys, values, costs))
+	// Inserted straight away, without waiting for the buffers.
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCost())
+	require.Equal(t, uint64(10), c.Metrics.KeysAdded())
+	for i := 0; i < 10; i++ {
+		require.Zero(t, c.policy.Frequency(uint64(i)))
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i, val)
+	}
+	_, ok := c.Get(10)
+	require.False(t, ok)
+	// Keys already in the cache are skipped.
+	c.Del(0)
+	c.Wait()
+	require.Equal(t, 1, c.Warm([]interface{}{0, 1}, []interface{}{"a", "b"}, []int64{1, 1}))
+	val, _ := c.Get(1)
+	require.Equal(t, 1, val)
+
+	require.Zero(t, evicted)
+
+	// Normal Sets evict as usual afterwards.
+	require.True(t, c.Set(100, 100, 5))
+	c.Wait()
+	require.True(t, c.UsedCost() <= 10)
+
+	require.Panics(t, func() {
+		c.Warm([]interface{}{1}, nil, nil)
+	})
+}
+
+func TestCacheRange(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i*10, int64(i+1)))
+	}
+	c.Wait()
+
+	seen := make(map[uint64]*Item)
+	c.Range(func(item *Item) bool {
+		_, dup := seen[item.Key]
+		require.False(t, dup)
+		seen[item.Key] = item
+		return true
+	})
+	require.Len(t, seen, 10)
+	for i := 0; i < 10; i++ {
+		item := seen[uint64(i)]
+		require.NotNil(t, item)
+		require.Equal(t, i*10, item.Value)
+		require.Equal(t, int64(i+1), item.Cost)
+	}
+	require.ElementsMatch(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, c.Keys())
+
+	visited := 0
+	c.Range(func(item *Item) bool {
+		visited++
+		return visited < 3
+	})
+	require.Equal(t, 3, visited)
+
+	c.Close()
+	require.Empty(t, c.Keys())
+}
+
+func TestCacheRangeConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := (g*1000 + i) % 2000
+				c.Set(key, key, 1)
+				c.Del((key + 500) % 2000)
+			}
+		}(g)
+	}
+	for i := 0; i < 20; i++ {
+		seen := make(map[uint64]bool)
+		c.Range(func(item *Item) bool {
+			require.False(t, seen[item.Key])
+			seen[item.Key] = true
+			require.Equal(t, int(item.Key), item.Value)
+			// Items set from f may or may not be visited, but must not
+			// deadlock.
+			c.Set(int(item.Key)+2000, int(item.Key)+2000, 1)
+			return true
+		})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestCacheFlush(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+		BufferMode:  BufferLossless,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		c.Get(1)
+	}
+	c.Flush()
+	require.Equal(t, int64(10), c.policy.Frequency(1))
+	require.Equal(t, uint64(10), c.Metrics.GetsKept())
+
+	// Safe to call alongside Gets.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(i)
+				if i%100 == 0 {
+					c.Flush()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Flush()
+	require.Equal(t, uint64(4010), c.Metrics.GetsKept())
+
+	c.Close()
+	c.Flush()
+}
+
+// retrySet calls SetWithTTL until the item is accepted by the cache.
+func retrySet(t *testing.T, c *Cache, key, value int, cost int64, ttl time.Duration) {
+	for {
+		if set := c.SetWithTTL(key, value, cost, ttl); !set {
+			continue
+		}
+
+		c.Wait()
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.NotNil(t, val)
+		require.Equal(t, value, val.(int))
+		return
+	}
+}
+
+func TestCacheSet(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+
+	retrySet(t, c, 1, 1, 1, 0)
+
+	c.Set(1, 2, 2)
+	val, ok := c.store.Get(z.KeyToHash(1))
+	require.True(t, ok)
+	require.Equal(t, 2, val.(int))
+
+	c.stop <- struct{}{}
+	for i := 0; i < setBufSize; i++ {
+		key, conflict := z.KeyToHash(1)
+		c.setBuf <- &Item{
+			flag:     itemUpdate,
+			Key:      key,
+			Conflict: conflict,
+			Value:    1,
+			Cost:     1,
+		}
+	}
+	require.False(t, c.Set(2, 2, 1))
+	require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+	close(c.setBuf)
+	close(c.stop)
+
+	c = nil
+	require.False(t, c.Set(1, 1, 1))
+}
+
+func TestCacheSetBuffer(t *testing.T) {
+	for _, blocking := range []bool{false, true} {
+		t.Run(fmt.Sprintf("blocking=%v", blocking), func(t *testing.T) {
+			// The policy is held up costing the first item, so the Sets
+			// after it stay in the buffer.
+			started, release := make(chan struct{}), make(chan struct{})
+			c, err := NewCache(&Config{
+				NumCounters:        100,
+				MaxCost:            100,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Metrics:            true,
+				SetBufferItems:     4,
+				BlockingSets:       blocking,
+				Cost: func(value interface{}) int64 {
+					if value == 0 {
+						close(started)
+						<-release
+					}
+					return 1
+				},
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			require.True(t, c.Set(0, 0, 0))
+			<-started
+			for i := 1; i <= 4; i++ {
+				require.True(t, c.Set(i, i, 0))
+			}
+			// The Sets are in the buffer, but not in the cache yet.
+			_, ok := c.Get(1)
+			require.False(t, ok)
+
+			set := make(chan bool)
+			go func() { set <- c.Set(5, 5, 0) }()
+			if blocking {
+				select {
+				case <-set:
+					t.Fatal("Set didn't wait for room in the buffer")
+				case <-time.After(10 * time.Millisecond):
+				}
+				close(release)
+				require.True(t, <-set)
+			} else {
+				require.False(t, <-set)
+				require.Equal(t, uint64(1), c.Metrics.SetsDropped())
+				close(release)
+			}
+			c.Wait()
+			for i := 0; i <= 4; i++ {
+				val, ok := c.Get(i)
+				require.True(t, ok)
+				require.Equal(t, i, val)
+			}
+			_, ok = c.Get(5)
+			require.Equal(t, blocking, ok)
+		})
+	}
+}
+
+func TestCacheSetUpdateBuffered(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(key int) {
+			defer wg.Done()
+			// The second Set is buffered before the first one is applied, so
+			// both reach the policy as new items.
+			c.Set(key, 1, 1)
+			c.Set(key, 2, 1)
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+	for key := 0; key < 8; key++ {
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, 2, val)
+	}
+}
+
+func TestCacheSetRejected(t *testing.T) {
+	rejected := make(chan uint64, 10)
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		OnReject: func(item *Item) {
+			rejected <- item.Key
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Fill the cache and make every resident key much hotter than the
+	// candidate.
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	for n := 0; n < 50; n++ {
+		for i := 0; i < 10; i++ {
+			c.Get(i)
+		}
+	}
+	c.Flush()
+
+	// Set accepts the item into its buffer but the policy rejects it.
+	require.True(t, c.Set(100, 100, 1))
+	c.Wait()
+	select {
+	case key := <-rejected:
+		require.Equal(t, uint64(100), key)
+	default:
+		t.Fatal("expected the cold item to be rejected")
+	}
+	_, ok := c.Get(100)
+	require.False(t, ok)
+}
+
+func TestCacheOnRejectUpdates(t *testing.T) {
+	var rejected []*Item
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		OnReject: func(item *Item) {
+			rejected = append(rejected, item)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	// Updates of resident keys are never rejected, even when they grow.
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, -i, 2))
+	}
+	c.Wait()
+	require.Empty(t, rejected)
+	require.Zero(t, c.Metrics.SetsRejected())
+
+	require.True(t, c.Set(100, "big", 100))
+	c.Wait()
+	require.Len(t, rejected, 1)
+	require.Equal(t, uint64(100), rejected[0].Key)
+	require.Equal(t, "big", rejected[0].Value)
+	require.Equal(t, int64(100), rejected[0].Cost)
+	require.Equal(t, uint64(1), c.Metrics.SetsRejected())
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		MaxEntries:         5,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		c.SetForce(i, i, 1)
+	}
+	c.Wait()
+	require.Equal(t, 5, c.Len())
+	require.Equal(t, int64(5), c.UsedCost())
+	require.Equal(t, int64(5), c.MaxEntries())
+	require.Equal(t, uint64(15), c.Metrics.KeysEvicted())
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxEntries:  -1,
+		BufferItems: 64,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheWatermarks(t *testing.T) {
+	// usedCosts returns the used cost after each of n new items, once the cache
+	// is full.
+	usedCosts := func(high, low float64, n int) []int64 {
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            100,
+			IgnoreInternalCost: true,
+			BufferItems:        64,
+			HighWatermark:      high,
+			LowWatermark:       low,
+		})
+		require.NoError(t, err)
+		defer c.Close()
+		for i := 0; i < 100; i++ {
+			require.True(t, c.SetForce(i, i, 1))
+		}
+		used := make([]int64, n)
+		for i := range used {
+			require.True(t, c.SetForce(100+i, i, 1))
+			c.Wait()
+			used[i] = c.UsedCost()
+		}
+		return used
+	}
+
+	// By default, every new item evicts one.
+	for _, used := range usedCosts(0, 0, 50) {
+		require.Equal(t, int64(100), used)
+	}
+	// Otherwise the used cost drops to the low watermark once it hits the
+	// high one, and climbs back up.
+	used := usedCosts(1, 0.8, 50)
+	for i := range used {
+		require.Equal(t, int64(80+i%21), used[i], "item %d", i)
+	}
+	// Below MaxCost, the high watermark is never crossed.
+	used = usedCosts(0.9, 0.5, 40)
+	require.Equal(t, int64(90), used[30])
+	require.Equal(t, int64(50), used[31])
+}
+
+func TestCacheMaxItemCost(t *testing.T) {
+	var rejected []*Item
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		MaxItemCost:        10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(value.(string)))
+		},
+		OnReject: func(item *Item) {
+			rejected = append(rejected, item)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, "a", 10))
+	require.False(t, c.Set(2, "b", 11))
+	require.False(t, c.SetForce(3, "c", 11))
+	stored, exists := c.SetIfAbsent(4, "d", 11)
+	require.False(t, stored)
+	require.False(t, exists)
+	require.Zero(t, c.Warm([]interface{}{5}, []interface{}{"e"}, []int64{11}))
+	c.Wait()
+	_, ok := c.Get(1)
+	require.True(t, ok)
+	for _, key := range []int{2, 3, 4, 5} {
+		_, ok := c.Get(key)
+		require.False(t, ok, "key %d", key)
+	}
+	require.Equal(t, uint64(4), c.Metrics.SetsRejectedTooLarge())
+	require.Zero(t, c.Metrics.SetsRejected())
+	require.Len(t, rejected, 3)
+
+	// Costs worked out by Config.Cost are capped as well.
+	require.True(t, c.Set(6, "0123456789", 0))
+	require.True(t, c.Set(7, "0123456789a", 0))
+	c.Wait()
+	_, ok = c.Get(6)
+	require.True(t, ok)
+	_, ok = c.Get(7)
+	require.False(t, ok)
+	require.Equal(t, uint64(5), c.Metrics.SetsRejectedTooLarge())
+
+	// A rejected update leaves the old value alone.
+	require.False(t, c.Set(1, "big", 100))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		MaxItemCost: -1,
+		BufferItems: 64,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheUpdateCost(t *testing.T) {
+	var evicted []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(item *Item) {
+			evicted = append(evicted, item.Key)
+		},
+	})
+	require.NoError(t, err)
+
+	require.False(t, c.UpdateCost(1, 5))
+	for i := 1; i <= 5; i++ {
+		require.True(t, c.SetForce(i, i, 2))
+	}
+	c.Wait()
+	require.True(t, c.UpdateCost(1, 6))
+	require.False(t, c.UpdateCost(1, -1))
+	c.Wait()
+	require.Len(t, evicted, 2)
+	require.NotContains(t, evicted, uint64(1))
+	require.Equal(t, int64(6), c.policy.Cost(1))
+	require.Equal(t, int64(10), c.UsedCost())
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	c.Close()
+
+	// Concurrent cost updates and evictions of the same keys keep the used
+	// cost in line with the costs of the keys.
+	c, err = NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rd := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				key := rd.Intn(50)
+				if rd.Intn(2) == 0 {
+					c.SetForce(key, key, int64(rd.Intn(10)+1))
+				} else {
+					c.UpdateCost(key, int64(rd.Intn(30)+1))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	var sum int64
+	for _, cost := range p.evict.keyCosts {
+		sum += cost
+	}
+	used := p.evict.used
+	p.Unlock()
+	require.Equal(t, sum, used)
+	require.True(t, sum <= 100, "used: %d", sum)
+}
+
+func TestCacheEvictWorkers(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var evicted []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		EvictWorkers:       1,
+		OnEvict: func(item *Item) {
+			<-release
+			mu.Lock()
+			evicted = append(evicted, item.Key)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+
+	// The stuck callback doesn't hold up the Sets.
+	for i := 0; i < 20; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, 10, c.Len())
+	close(release)
+	// Close waits for the queued callbacks.
+	c.Close()
+	require.Len(t, evicted, 10)
+
+	release = make(chan struct{})
+	var exited int32
+	c, err = NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		EvictWorkers:       1,
+		EvictQueueSize:     1,
+		DropEvictCallbacks: true,
+		OnEvict: func(item *Item) {
+			<-release
+		},
+		OnExit: func(val interface{}) {
+			atomic.AddInt32(&exited, 1)
+		},
+	})
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	// One callback running and one queued, the others dropped, with their
+	// values still passed to OnExit.
+	dropped := c.Metrics.CallbacksDropped()
+	require.True(t, dropped >= 8, "dropped %d", dropped)
+	require.Equal(t, int32(dropped), atomic.LoadInt32(&exited))
+	close(release)
+	c.Close()
+	require.Equal(t, int32(20), atomic.LoadInt32(&exited))
+
+	_, err = NewCache(&Config{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		EvictWorkers: -1,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheStoreShards(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		StoreShards:        4,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Len(t, c.store.(*shardedMap).shards, 4)
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+
+	for _, shards := range []int{-1, 3, 12} {
+		_, err = NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			StoreShards: shards,
+		})
+		require.Error(t, err, "shards %d", shards)
+	}
+}
+
+func TestCacheRepair(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	// A key the policy has but the store doesn't takes up room until the
+	// next cleanup.
+	_, added := c.policy.Add(2, 5)
+	require.True(t, added)
+	require.Equal(t, int64(6), c.UsedCost())
+	clock.Add(time.Duration(bucketDurationSecs) * time.Second)
+	c.Wait()
+	require.False(t, c.policy.Has(2))
+	require.True(t, c.policy.Has(1))
+	require.Equal(t, int64(1), c.UsedCost())
+	require.Equal(t, uint64(1), c.Metrics.GhostsRemoved())
+}
+
+func TestCacheCallbackPanics(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		OnEvict: func(item *Item) {
+			panic("evict")
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	// Every victim left the store even though the callbacks panicked.
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCost())
+	require.Equal(t, uint64(10), c.Metrics.CallbackPanics())
+}
+
+func TestCacheCallbackPanicsEveryKind(t *testing.T) {
+	logger := &captureLogger{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Logger:             logger,
+		Cost: func(value interface{}) int64 {
+			if value == "bad" {
+				panic("cost")
+			}
+			return 1
+		},
+		OnEvict:  func(item *Item) { panic("evict") },
+		OnReject: func(item *Item) { panic("reject") },
+		OnExit:   func(val interface{}) { panic("exit") },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// A panicking Cost rejects the item, and OnReject and OnExit panic too.
+	require.True(t, c.Set("bad", "bad", 0))
+	c.Wait()
+	_, ok := c.Get("bad")
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.SetsRejectedByCost())
+	require.Equal(t, uint64(3), c.Metrics.CallbackPanics())
+	var callbacks []interface{}
+	for _, e := range logger.find("callback panicked") {
+		require.Equal(t, LogError, e.level)
+		callbacks = append(callbacks, e.keyvals[1])
+	}
+	require.Equal(t, []interface{}{"Cost", "OnReject", "OnExit"}, callbacks)
+
+	// The cache keeps working.
+	for i := 0; i < 20; i++ {
+		require.True(t, c.SetForce(i, i, 0))
+	}
+	c.Wait()
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCost())
+	require.Equal(t, uint64(3+20), c.Metrics.CallbackPanics())
+	val, ok := c.Get(19)
+	require.True(t, ok)
+	require.Equal(t, 19, val)
+}
+
+func TestCacheEmptyKey(t *testing.T) {
+	// The empty string, and keys hashing to 0, are keys like any other: they
+	// can be evicted and deleted, and their eviction is reported.
+	for _, policy := range []func(numCounters, maxCost int64) Policy{nil, NewSLRUPolicy} {
+		for _, key := range []interface{}{"", 0, "key"} {
+			var evicted []*Item
+			c, err := NewCache(&Config{
+				NumCounters:        100,
+				MaxCost:            1,
+				IgnoreInternalCost: true,
+				BufferItems:        64,
+				Policy:             policy,
+				OnEvict: func(item *Item) {
+					evicted = append(evicted, item)
+				},
+			})
+			require.NoError(t, err)
+
+			require.True(t, c.Set(key, "value", 1))
+			c.Wait()
+			val, ok := c.Get(key)
+			require.True(t, ok, "key %q", key)
+			require.Equal(t, "value", val)
+
+			require.True(t, c.SetForce("other", "other", 1))
+			c.Wait()
+			_, ok = c.Get(key)
+			require.False(t, ok, "key %q", key)
+			require.Len(t, evicted, 1, "key %q", key)
+			keyHash, _ := z.KeyToHash(key)
+			require.Equal(t, keyHash, evicted[0].Key)
+			require.Equal(t, "value", evicted[0].Value)
+			require.Equal(t, 1, c.Len())
+
+			require.True(t, c.SetForce(key, "again", 1))
+			c.Wait()
+			val, ok = c.Del(key)
+			require.True(t, ok, "key %q", key)
+			require.Equal(t, "again", val)
+			c.Wait()
+			require.False(t, c.policy.Has(keyHash))
+			c.Close()
+		}
+	}
+}
+
+func TestCacheCostFunc(t *testing.T) {
+	var rejected []interface{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(value.(string)))
+		},
+		OnReject: func(item *Item) {
+			rejected = append(rejected, item.Value)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, "abc", 0))
+	// An explicit cost wins over the function.
+	require.True(t, c.Set(2, "ab", 5))
+	c.Wait()
+	require.Equal(t, int64(3), c.policy.Cost(1))
+	require.Equal(t, int64(5), c.policy.Cost(2))
+
+	require.True(t, c.Set(3, "", 0))
+	c.Wait()
+	_, ok := c.Get(3)
+	require.False(t, ok)
+	require.Equal(t, []interface{}{""}, rejected)
+	require.Equal(t, uint64(1), c.Metrics.SetsRejectedByCost())
+	require.Zero(t, c.Metrics.SetsRejected())
+
+	// Replacing a value works out its cost again.
+	require.True(t, c.Set(1, "abcdef", 0))
+	c.Wait()
+	require.Equal(t, int64(6), c.policy.Cost(1))
+	require.Equal(t, int64(11), c.UsedCost())
+
+	// And a replacement without a cost is rejected, keeping the old value.
+	require.False(t, c.Set(1, "", 0))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "abcdef", val)
+	require.Equal(t, int64(6), c.policy.Cost(1))
+	require.Equal(t, int64(11), c.UsedCost())
+	require.Equal(t, uint64(2), c.Metrics.SetsRejectedByCost())
+
+	require.Zero(t, c.Warm([]interface{}{4}, []interface{}{""}, []int64{0}))
+	require.Equal(t, uint64(3), c.Metrics.SetsRejectedByCost())
+}
+
+func TestCacheSetReplaceCost(t *testing.T) {
+	var rejected []interface{}
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		MaxItemCost:        8,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		OnReject: func(item *Item) {
+			rejected = append(rejected, item.Value)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+
+	// Growing makes room for the new cost.
+	require.True(t, c.Set(0, "big", 6))
+	c.Wait()
+	require.Equal(t, int64(6), c.policy.Cost(0))
+	require.Equal(t, int64(10), c.UsedCost())
+	require.Equal(t, 5, c.Len())
+	require.True(t, c.Set(0, "bigger", 8))
+	c.Wait()
+	require.Equal(t, int64(8), c.policy.Cost(0))
+	require.LessOrEqual(t, c.UsedCost(), int64(10))
+	require.Less(t, c.Len(), 5)
+
+	// Shrinking frees the difference.
+	used := c.UsedCost()
+	require.True(t, c.Set(0, "small", 2))
+	c.Wait()
+	require.Equal(t, int64(2), c.policy.Cost(0))
+	require.Equal(t, used-6, c.UsedCost())
+
+	// A cost over MaxItemCost, or over MaxCost with a higher MaxItemCost,
+	// keeps the old value.
+	require.False(t, c.Set(0, "huge", 9))
+	c.maxItemCost = 100
+	require.False(t, c.Set(0, "huger", 11))
+	c.Wait()
+	val, ok := c.Get(0)
+	require.True(t, ok)
+	require.Equal(t, "small", val)
+	require.Equal(t, int64(2), c.policy.Cost(0))
+	require.Equal(t, []interface{}{"huge", "huger"}, rejected)
+	require.Equal(t, uint64(1), c.Metrics.SetsRejectedTooLarge())
+}
+
+func TestCacheSetReplaceCostConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            200,
+		MaxItemCost:        40,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(value.(string)))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 2000; i++ {
+				// Some values are too costly, and don't replace the old one.
+				c.Set(r.Intn(20), strings.Repeat("x", r.Intn(50)), 0)
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+
+	// Every value left is charged its own cost, and they fit.
+	var total int64
+	c.Range(func(item *Item) bool {
+		value := item.Value.(string)
+		require.NotZero(t, len(value))
+		require.LessOrEqual(t, len(value), 40)
+		require.Equal(t, int64(len(value)), c.policy.Cost(item.Key))
+		total += int64(len(value))
+		return true
+	})
+	require.Equal(t, c.UsedCost(), total)
+	require.LessOrEqual(t, total, int64(200))
+}
+
+func TestCacheSetForce(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	for n := 0; n < 10; n++ {
+		for i := 0; i < 10; i++ {
+			c.Get(i)
+		}
+	}
+	c.Flush()
+
+	require.True(t, c.Set(100, 100, 1))
+	c.Wait()
+	_, ok := c.Get(100)
+	require.False(t, ok)
+
+	require.True(t, c.SetForce(100, 100, 1))
+	c.Wait()
+	val, ok := c.Get(100)
+	require.True(t, ok)
+	require.Equal(t, 100, val)
+	require.True(t, c.Pin(100))
+	require.False(t, c.Pin(101))
+
+	// The pinned item survives the next forced Sets.
+	for i := 200; i < 220; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	_, ok = c.Get(100)
+	require.True(t, ok)
+	require.True(t, c.UsedCost() <= 10)
+
+	require.True(t, c.Unpin(100))
+	require.False(t, c.Unpin(100))
+	c.Close()
+	require.False(t, c.SetForce(1, 1, 1))
+	require.False(t, c.Pin(1))
+}
+
+func TestCachePinPolicies(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default":  nil,
+		"slru":     NewSLRUPolicy,
+		"arc":      NewARCPolicy,
+		"lru":      NewLRUPolicy,
+		"lirs":     NewLIRSPolicy,
+		"2q":       NewTwoQueuePolicy,
+		"hyper":    NewHyperbolicPolicy,
+		"wtinylfu": NewWTinyLFUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        1000,
+				MaxCost:            10,
+				IgnoreInternalCost: true,
+				BufferItems:        64,
+				BufferMode:         BufferLossless,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 10; i++ {
+				require.True(t, c.Set(i, i, 1))
+			}
+			c.Wait()
+			for i := 0; i < 5; i++ {
+				require.True(t, c.Pin(i))
+			}
+			// Replacing the value of a pinned item keeps it pinned.
+			require.True(t, c.Set(0, "new", 1))
+			c.Wait()
+
+			for i := 100; i < 200; i++ {
+				require.True(t, c.SetForce(i, i, 1))
+			}
+			c.Wait()
+			for i := 0; i < 5; i++ {
+				_, ok := c.Get(i)
+				require.True(t, ok, "key %d", i)
+			}
+			val, _ := c.Get(0)
+			require.Equal(t, "new", val)
+
+			// Once everything is pinned, new items are rejected.
+			for i := 5; i < 200; i++ {
+				c.Pin(i)
+			}
+			require.True(t, c.SetForce(300, 300, 1))
+			c.Wait()
+			_, ok := c.Get(300)
+			require.False(t, ok)
+			require.Equal(t, 10, c.Len())
+
+			// Pinned items can still be deleted.
+			c.Del(0)
+			c.Wait()
+			require.False(t, c.Unpin(0))
+			require.True(t, c.Set(300, 300, 1))
+			c.Wait()
+			_, ok = c.Get(300)
+			require.True(t, ok)
+		})
+	}
+}
+
+// youngHitRatio Sets a stream of new keys with SetForce next to hot keys read
+// beforehand, reads every new key lag Sets later, and returns the ratio of
+// those reads that hit.
+func youngHitRatio(t *testing.T, cfg Config, lag int) float64 {
+	cfg.NumCounters = 10000
+	cfg.MaxCost = 100
+	cfg.IgnoreInternalCost = true
+	cfg.Synchronous = true
+	c, err := NewCache(&cfg)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 80; i++ {
+		require.True(t, c.Set(i, i, 1))
+		for j := 0; j < 4; j++ {
+			c.Get(i)
+		}
+	}
+	hits, reads := 0, 0
+	for i := 1000; i < 3000; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+		if mock, ok := cfg.Clock.(*MockClock); ok {
+			mock.Add(time.Millisecond)
+		}
+		if i-lag < 1000 {
+			continue
+		}
+		reads++
+		if _, ok := c.Get(i - lag); ok {
+			hits++
+		}
+	}
+	require.LessOrEqual(t, c.UsedCost(), int64(100))
+	return float64(hits) / float64(reads)
+}
+
+func TestCacheMinResidency(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"random":  NewRandomPolicy(1, 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Sampled victims are often the new keys, not yet read.
+			without := youngHitRatio(t, Config{Policy: policy}, 10)
+			admissions := youngHitRatio(t, Config{
+				Policy:                 policy,
+				MinResidencyAdmissions: 20,
+			}, 10)
+			residency := youngHitRatio(t, Config{
+				Policy:       policy,
+				MinResidency: 20 * time.Millisecond,
+				Clock:        NewMockClock(time.Unix(1e9, 0)),
+			}, 10)
+			require.Less(t, without, 0.99)
+			require.GreaterOrEqual(t, admissions, 0.99)
+			require.GreaterOrEqual(t, residency, 0.99)
+
+			// Young keys are still evicted once every key is young.
+			youngHitRatio(t, Config{Policy: policy, MinResidencyAdmissions: 1000}, 10)
+		})
+	}
+
+	for _, cfg := range []Config{
+		{MinResidency: -time.Second},
+		{MinResidencyAdmissions: -1},
+	} {
+		cfg.NumCounters = 100
+		cfg.MaxCost = 10
+		cfg.BufferItems = 64
+		_, err := NewCache(&cfg)
+		require.Error(t, err)
+	}
+}
+
+func TestCachePinConcurrent(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"lru":     NewLRUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        1000,
+				MaxCost:            50,
+				IgnoreInternalCost: true,
+				BufferItems:        64,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(seed))
+					for i := 0; i < 2000; i++ {
+						key := r.Intn(200)
+						switch r.Intn(5) {
+						case 0:
+							c.Pin(key)
+						case 1:
+							c.Unpin(key)
+						case 2:
+							c.Del(key)
+						default:
+							c.SetForce(key, key, 1)
+						}
+					}
+				}(int64(g))
+			}
+			wg.Wait()
+			c.Wait()
+
+			require.True(t, c.UsedCost() <= 50)
+			// Only keys in the cache stay pinned.
+			p := c.policy.(*defaultPolicy)
+			p.Lock()
+			defer p.Unlock()
+			for key := range p.evict.pinned {
+				_, ok := p.evict.keyCosts[key]
+				require.True(t, ok)
+			}
+		})
+	}
+}
+
+func TestCacheSetIfAbsent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	stored, exists := c.SetIfAbsent(1, "a", 1)
+	require.True(t, stored)
+	require.False(t, exists)
+	// Stored synchronously.
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+
+	stored, exists = c.SetIfAbsent(1, "b", 1)
+	require.False(t, stored)
+	require.True(t, exists)
+	val, _ = c.Get(1)
+	require.Equal(t, "a", val)
+
+	stored, exists = c.SetIfAbsent(2, "big", 100)
+	require.False(t, stored)
+	require.False(t, exists)
+
+	// Only one of the concurrent fills wins.
+	var wins int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			if stored, _ := c.SetIfAbsent(3, g, 1); stored {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), wins)
+
+	c.Close()
+	stored, exists = c.SetIfAbsent(4, "d", 1)
+	require.False(t, stored)
+	require.False(t, exists)
+}
+
+func TestCacheUpdate(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	prepend := func(s string) func(interface{}, bool) (interface{}, bool) {
+		return func(old interface{}, exists bool) (interface{}, bool) {
+			if !exists {
+				return s, true
+			}
+			return s + old.(string), true
+		}
+	}
+	require.True(t, c.Update(1, prepend("a")))
+	// A missing key is stored synchronously, like with SetIfAbsent.
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	require.True(t, c.Update(1, prepend("b")))
+	val, _ = c.Get(1)
+	require.Equal(t, "ba", val)
+
+	var seen bool
+	require.False(t, c.Update(1, func(old interface{}, exists bool) (interface{}, bool) {
+		seen = exists
+		return "c", false
+	}))
+	require.True(t, seen)
+	val, _ = c.Get(1)
+	require.Equal(t, "ba", val)
+	require.False(t, c.Update(2, func(interface{}, bool) (interface{}, bool) {
+		return "c", false
+	}))
+	_, ok = c.Get(2)
+	require.False(t, ok)
+
+	// The TTL stays.
+	require.True(t, c.SetWithTTL(3, "x", 1, time.Minute))
+	c.Wait()
+	require.True(t, c.Update(3, prepend("y")))
+	ttl, ok := c.GetTTL(3)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, ttl)
+	clock.Add(2 * time.Minute)
+	// And an expired key is missing.
+	require.True(t, c.Update(3, func(old interface{}, exists bool) (interface{}, bool) {
+		seen = exists
+		return "z", true
+	}))
+	require.False(t, seen)
+	val, _ = c.Get(3)
+	require.Equal(t, "z", val)
+	ttl, _ = c.GetTTL(3)
+	require.Zero(t, ttl)
+
+	c.Close()
+	require.False(t, c.Update(1, prepend("d")))
+}
+
+func TestCacheUpdateCoster(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		MaxItemCost:        10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(value.(string)))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	set := func(s string) func(interface{}, bool) (interface{}, bool) {
+		return func(interface{}, bool) (interface{}, bool) {
+			return s, true
+		}
+	}
+	require.True(t, c.Update(1, set("ab")))
+	c.Wait()
+	require.Equal(t, int64(2), c.UsedCost())
+	require.True(t, c.Update(1, set("abcde")))
+	c.Wait()
+	require.Equal(t, int64(5), c.UsedCost())
+
+	// Values whose cost is rejected aren't written.
+	require.False(t, c.Update(1, set("")))
+	require.False(t, c.Update(1, set("abcdefghijk")))
+	val, _ := c.Get(1)
+	require.Equal(t, "abcde", val)
+	require.Equal(t, uint64(1), c.Metrics.SetsRejectedByCost())
+	require.Equal(t, uint64(1), c.Metrics.SetsRejectedTooLarge())
+}
+
+func TestCacheUpdateConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	incr := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+	var failed int32
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				// Every goroutine starts on a missing key.
+				if !c.Update(i%4, incr) {
+					atomic.AddInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Zero(t, atomic.LoadInt32(&failed))
+	sum := 0
+	for key := 0; key < 4; key++ {
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		sum += val.(int)
+	}
+	require.Equal(t, 1000, sum)
+}
+
+func TestCacheUpdateOtherShard(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	sm := c.store.(*shardedMap)
+	other := 2
+	for sm.index(uint64(other)) == sm.index(1) {
+		other++
+	}
+	require.True(t, c.Set(other, "other", 1))
+	c.Wait()
+	require.True(t, c.Set(1, "one", 1))
+	c.Wait()
+	// fn can use keys held by other shards.
+	require.True(t, c.Update(1, func(old interface{}, exists bool) (interface{}, bool) {
+		val, _ := c.Get(other)
+		return old.(string) + val.(string), true
+	}))
+	val, _ := c.Get(1)
+	require.Equal(t, "oneother", val)
+}
+
+func TestCacheInternalCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+
+	// Get should return false because the cache's cost is too small to store the item
+	// when accounting for the internal cost.
+	c.SetWithTTL(1, 1, 1, 0)
+	time.Sleep(wait)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+}
+
+func TestCacheSetCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// A cost of zero without a Cost function is charged as one.
+	require.True(t, c.Set(1, 1, 0))
+	c.Wait()
+	key, _ := z.KeyToHash(1)
+	require.Equal(t, int64(1), c.policy.Cost(key))
+
+	// Updating the key with a different cost adjusts the accounting.
+	require.True(t, c.Set(1, 1, 4))
+	c.Wait()
+	require.Equal(t, int64(4), c.policy.Cost(key))
+	require.Equal(t, int64(6), c.policy.Cap())
+
+	// An item bigger than the whole cache is refused without evicting anything.
+	require.True(t, c.Set(2, 2, 11))
+	c.Wait()
+	_, ok := c.Get(2)
+	require.False(t, ok)
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestRecacheWithTTL(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Clock:              clock,
+	})
+
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Set initial value for key = 1
+	insert := c.SetWithTTL(1, 1, 1, 5*time.Second)
+	require.True(t, insert)
+	c.Wait()
+	clock.Add(2 * time.Second)
+
+	// Get value from cache for key = 1
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+	require.Equal(t, 1, val)
+
+	// Wait for expiration
+	clock.Add(5 * time.Second)
+	c.Wait()
+
+	// The cached value for key = 1 should be gone
+	val, ok = c.Get(1)
+	require.False(t, ok)
+	require.Nil(t, val)
+
+	// Set new value for key = 1
+	insert = c.SetWithTTL(1, 2, 1, 5*time.Second)
+	require.True(t, insert)
+	c.Wait()
+	clock.Add(2 * time.Second)
+
+	// Get value from cache for key = 1
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.NotNil(t, val)
+	require.Equal(t, 2, val)
+}
+
+func TestCacheSetWithTTL(t *testing.T) {
+	m := &sync.Mutex{}
+	evicted := make(map[uint64]struct{})
+	var policyEvictions int32
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
 		Metrics:            true,
 		OnEvict: func(item *Item) {
+			atomic.AddInt32(&policyEvictions, 1)
+		},
+		OnExpire: func(item *Item) {
 			m.Lock()
 			defer m.Unlock()
 			evicted[item.Key] = struct{}{}
 		},
+		Clock: clock,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
 	retrySet(t, c, 1, 1, 1, time.Second)
 
-	// Sleep to make sure the item has expired after execution resumes.
-	time.Sleep(2 * time.Second)
+	clock.Add(2 * time.Second)
 	val, ok := c.Get(1)
 	require.False(t, ok)
 	require.Nil(t, val)
 
-	// Sleep to ensure that the bucket where the item was stored has been cleared
+	// Move far enough for the bucket where the item was stored to be cleared
 	// from the expiraton map.
-	time.Sleep(5 * time.Second)
+	clock.Add(10 * time.Second)
+	c.Wait()
 	m.Lock()
 	require.Equal(t, 1, len(evicted))
 	_, ok = evicted[1]
 	require.True(t, ok)
 	m.Unlock()
+	// The expired item must also be gone from the policy.
+	require.False(t, c.policy.Has(1))
+	require.Zero(t, atomic.LoadInt32(&policyEvictions))
 
 	// Verify that expiration times are overwritten.
 	retrySet(t, c, 2, 1, 1, time.Second)
 	retrySet(t, c, 2, 2, 1, 100*time.Second)
-	time.Sleep(3 * time.Second)
+	clock.Add(3 * time.Second)
 	val, ok = c.Get(2)
 	require.True(t, ok)
 	require.Equal(t, 2, val.(int))
@@ -508,7 +2665,7 @@ func TestCacheSetWithTTL(t *testing.T) {
 	// Verify that entries with no expiration are overwritten.
 	retrySet(t, c, 3, 1, 1, 0)
 	retrySet(t, c, 3, 2, 1, time.Second)
-	time.Sleep(3 * time.Second)
+	clock.Add(3 * time.Second)
 	val, ok = c.Get(3)
 	require.False(t, ok)
 	require.Nil(t, val)
@@ -539,33 +2696,329 @@ func TestCacheDel(t *testing.T) {
 	c.Del(1)
 }
 
+func TestCacheDelReturnsValue(t *testing.T) {
+	var evicted int32
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(item *Item) {
+			atomic.AddInt32(&evicted, 1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	val, ok := c.Del(1)
+	require.False(t, ok)
+	require.Nil(t, val)
+
+	require.True(t, c.Set(1, 10, 1))
+	c.Wait()
+	val, ok = c.Del(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	c.Wait()
+	require.Equal(t, int32(0), atomic.LoadInt32(&evicted))
+
+	// Only one of the concurrent deletes observes the value.
+	require.True(t, c.Set(2, 20, 1))
+	c.Wait()
+	var found int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := c.Del(2); ok {
+				atomic.AddInt32(&found, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), atomic.LoadInt32(&found))
+}
+
 func TestCacheDelWithTTL(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	retrySet(t, c, 3, 1, 1, 10*time.Second)
+	clock.Add(time.Second)
+	// Delete the item
+	c.Del(3)
+	// Ensure the key is deleted.
+	val, ok := c.Get(3)
+	require.False(t, ok)
+	require.Nil(t, val)
+}
+
+func TestCacheDelFunc(t *testing.T) {
+	var evicted, exited uint64
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		OnEvict: func(item *Item) {
+			atomic.AddUint64(&evicted, 1)
+		},
+		OnExit: func(val interface{}) {
+			atomic.AddUint64(&exited, 1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 40; i++ {
+		require.True(t, c.Set(i, fmt.Sprintf("tenant:%d:object:%d", i%2, i), 1))
+	}
+	c.Wait()
+	require.Equal(t, 40, c.Len())
+
+	deleted := c.DelFunc(func(item *Item) bool {
+		return strings.HasPrefix(item.Value.(string), "tenant:1:")
+	})
+	require.Equal(t, 20, deleted)
+	c.Wait()
+	require.Equal(t, 20, c.Len())
+	require.Equal(t, int64(20), c.UsedCost())
+	for i := 0; i < 40; i++ {
+		_, ok := c.Get(i)
+		require.Equal(t, i%2 == 0, ok, "key %d", i)
+	}
+	require.Zero(t, atomic.LoadUint64(&evicted))
+	require.Equal(t, uint64(20), atomic.LoadUint64(&exited))
+
+	// Sets may run at the same time.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 40; i < 80; i++ {
+			c.Set(i, "other", 1)
+		}
+	}()
+	require.Equal(t, 20, c.DelFunc(func(item *Item) bool {
+		return item.Value != "other"
+	}))
+	<-done
+	c.Wait()
+	require.Zero(t, c.DelFunc(func(item *Item) bool {
+		return item.Value != "other"
+	}))
+	require.Zero(t, atomic.LoadUint64(&evicted))
+}
+
+func TestCacheTouch(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.False(t, c.Touch(1, time.Hour))
+	require.True(t, c.SetWithTTL(1, 1, 1, time.Second))
+	c.Wait()
+	require.True(t, c.Touch(1, time.Hour))
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Hour, ttl)
+	require.False(t, c.Touch(1, -time.Second))
+	// Touch doesn't count as an update.
+	require.Zero(t, c.Metrics.KeysUpdated())
+
+	require.True(t, c.Touch(1, 0))
+	ttl, ok = c.GetTTL(1)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+
+	// An expired item can't be brought back.
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Second))
+	c.Wait()
+	clock.Add(2 * time.Second)
+	require.False(t, c.Touch(2, time.Hour))
+	_, ok = c.Get(2)
+	require.False(t, ok)
+}
+
+func TestCacheGetAndTouch(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, ok := c.GetAndTouch(1, time.Hour)
+	require.False(t, ok)
+	require.True(t, c.SetWithTTL(1, "a", 1, time.Second))
+	c.Wait()
+	val, ok := c.GetAndTouch(1, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Hour, ttl)
+	_, ok = c.GetAndTouch(1, -time.Second)
+	require.False(t, ok)
+	require.Equal(t, uint64(1), c.Metrics.Hits())
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+
+	// An expired item is a miss and isn't brought back.
+	require.True(t, c.SetWithTTL(2, "b", 1, time.Second))
+	c.Wait()
+	clock.Add(2 * time.Second)
+	_, ok = c.GetAndTouch(2, time.Hour)
+	require.False(t, ok)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+}
+
+func TestCacheGetAndTouchCleanup(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for key := 0; key < 200; key++ {
+		require.True(t, c.SetWithTTL(key, key, 1, time.Second))
+	}
+	c.Wait()
+	// The even keys are kept alive from now on, while the odd ones expire.
+	for key := 0; key < 200; key += 2 {
+		_, ok := c.GetAndTouch(key, time.Minute)
+		require.True(t, ok)
+	}
+	clock.Add(2 * time.Second)
+
+	var lost, resurrected int32
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for key := 0; key < 200; key++ {
+				_, ok := c.GetAndTouch(key, time.Minute)
+				if key%2 == 0 && !ok {
+					atomic.AddInt32(&lost, 1)
+				}
+				if key%2 == 1 && ok {
+					atomic.AddInt32(&resurrected, 1)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.store.Cleanup(c.policy, nil)
+		}
+	}()
+	// The even keys would expire halfway through unless they're touched, and
+	// the cleanup ticker sweeps along with the goroutine above.
+	for i := 0; i < 15; i++ {
+		clock.Add(8 * time.Second)
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	require.Zero(t, atomic.LoadInt32(&lost))
+	require.Zero(t, atomic.LoadInt32(&resurrected))
+	for key := 0; key < 200; key++ {
+		_, ok := c.Get(key)
+		require.Equal(t, key%2 == 0, ok, "key %d", key)
+	}
+}
+
+func TestCacheDefaultTTL(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
+		DefaultTTL:         time.Hour,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	require.True(t, c.SetWithTTL(2, 2, 1, 0))
+	require.True(t, c.SetWithTTL(3, 3, 1, time.Minute))
+	require.True(t, c.SetForce(4, 4, 1))
+	stored, _ := c.SetIfAbsent(5, 5, 1)
+	require.True(t, stored)
+	require.Equal(t, 1, c.Warm([]interface{}{6}, []interface{}{6}, []int64{1}))
+	c.Wait()
+
+	for _, key := range []int{1, 4, 5, 6} {
+		ttl, ok := c.GetTTL(key)
+		require.True(t, ok)
+		require.InDelta(t, float64(time.Hour), float64(ttl), float64(2*time.Second), "key %d", key)
+	}
+	ttl, ok := c.GetTTL(2)
+	require.True(t, ok)
+	require.Zero(t, ttl)
+	ttl, ok = c.GetTTL(3)
+	require.True(t, ok)
+	require.True(t, ttl <= time.Minute)
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		DefaultTTL:  -time.Second,
 	})
-	require.NoError(t, err)
-	retrySet(t, c, 3, 1, 1, 10*time.Second)
-	time.Sleep(1 * time.Second)
-	// Delete the item
-	c.Del(3)
-	// Ensure the key is deleted.
-	val, ok := c.Get(3)
-	require.False(t, ok)
-	require.Nil(t, val)
+	require.Error(t, err)
 }
 
 func TestCacheGetTTL(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
 		Metrics:            true,
+		Clock:              clock,
 	})
 	require.NoError(t, err)
+	defer c.Close()
 
 	// try expiration with valid ttl item
 	{
@@ -578,8 +3031,7 @@ func TestCacheGetTTL(t *testing.T) {
 
 		ttl, ok := c.GetTTL(1)
 		require.True(t, ok)
-		require.WithinDuration(t,
-			time.Now().Add(expiration), time.Now().Add(ttl), 1*time.Second)
+		require.Equal(t, expiration, ttl)
 
 		c.Del(1)
 
@@ -614,7 +3066,7 @@ func TestCacheGetTTL(t *testing.T) {
 		require.True(t, ok)
 		require.Equal(t, 3, val.(int))
 
-		time.Sleep(time.Second)
+		clock.Add(2 * time.Second)
 
 		ttl, ok := c.GetTTL(3)
 		require.False(t, ok)
@@ -623,12 +3075,19 @@ func TestCacheGetTTL(t *testing.T) {
 }
 
 func TestCacheClear(t *testing.T) {
+	var evicted, exited int32
 	c, err := NewCache(&Config{
 		NumCounters:        100,
 		MaxCost:            10,
 		IgnoreInternalCost: true,
 		BufferItems:        64,
 		Metrics:            true,
+		OnEvict: func(item *Item) {
+			atomic.AddInt32(&evicted, 1)
+		},
+		OnExit: func(val interface{}) {
+			atomic.AddInt32(&exited, 1)
+		},
 	})
 	require.NoError(t, err)
 
@@ -640,6 +3099,9 @@ func TestCacheClear(t *testing.T) {
 
 	c.Clear()
 	require.Equal(t, uint64(0), c.Metrics.KeysAdded())
+	require.Equal(t, int32(0), atomic.LoadInt32(&evicted))
+	require.Equal(t, int32(10), atomic.LoadInt32(&exited))
+	require.Equal(t, int64(10), c.policy.Cap())
 
 	for i := 0; i < 10; i++ {
 		val, ok := c.Get(i)
@@ -648,6 +3110,133 @@ func TestCacheClear(t *testing.T) {
 	}
 }
 
+func TestCacheBufferDrops(t *testing.T) {
+	var dropped int64
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 1,
+		Metrics:     true,
+		OnBufferDrop: func(n int) {
+			atomic.AddInt64(&dropped, int64(n))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Hold the policy lock so it can't take any more batches: at most one
+	// batch is being processed and three more fit in its channel, the rest
+	// must be dropped.
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	for i := 0; i < 100; i++ {
+		c.Get(i)
+	}
+	p.Unlock()
+	require.True(t, atomic.LoadInt64(&dropped) >= 96)
+	require.Equal(t, uint64(atomic.LoadInt64(&dropped)), c.Metrics.GetsDropped())
+	require.Equal(t, uint64(100), c.Metrics.GetsDropped()+c.Metrics.GetsKept())
+}
+
+func TestCacheLosslessBuffer(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   1000,
+		MaxCost:       10,
+		BufferItems:   64,
+		BufferMode:    BufferLossless,
+		BufferStripes: 2,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Len(t, c.getBuf.stripes, 2)
+
+	for i := 0; i < 64*len(c.getBuf.stripes); i++ {
+		c.Get(1)
+	}
+	time.Sleep(wait)
+	c.policy.(*defaultPolicy).Lock()
+	defer c.policy.(*defaultPolicy).Unlock()
+	require.Equal(t, int64(16), c.policy.(*defaultPolicy).admit.Estimate(1))
+}
+
+func TestCacheBlockingBuffer(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   1000,
+		MaxCost:       10,
+		BufferItems:   4,
+		BufferMode:    BufferBlocking,
+		BufferStripes: 2,
+		Metrics:       true,
+	})
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(i % 10)
+			}
+		}()
+	}
+	wg.Wait()
+	// Every Get reached the policy but the ones still buffered.
+	require.Zero(t, c.Metrics.GetsDropped())
+	require.Equal(t, 8000, int(c.Metrics.GetsKept())+len(c.getBuf.Flush()))
+
+	// Gets waiting on the policy are let go on Close.
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Get(i)
+			}
+		}()
+	}
+	c.Close()
+	wg.Wait()
+
+	_, err = NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		BufferMode:    BufferBlocking,
+		BufferTimeout: -time.Second,
+	})
+	require.Error(t, err)
+}
+
+func TestCacheLenAndUsedCost(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 2))
+	}
+	c.Wait()
+	require.Equal(t, 5, c.Len())
+	require.Equal(t, int64(10), c.UsedCost())
+
+	c.Del(0)
+	require.Equal(t, 4, c.Len())
+	c.Wait()
+	require.Equal(t, int64(8), c.UsedCost())
+
+	c.Close()
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, int64(0), c.UsedCost())
+
+	c = nil
+	require.Equal(t, 0, c.Len())
+	require.Equal(t, int64(0), c.UsedCost())
+}
+
 func TestCacheMetrics(t *testing.T) {
 	c, err := NewCache(&Config{
 		NumCounters:        100,
@@ -664,6 +3253,11 @@ func TestCacheMetrics(t *testing.T) {
 	time.Sleep(wait)
 	m := c.Metrics
 	require.Equal(t, uint64(10), m.KeysAdded())
+
+	// Items bigger than the whole cache are counted as rejected.
+	c.Set(100, 100, 11)
+	time.Sleep(wait)
+	require.Equal(t, uint64(1), m.SetsRejected())
 }
 
 func TestMetrics(t *testing.T) {
@@ -676,15 +3270,44 @@ func TestNilMetrics(t *testing.T) {
 		m.Hits,
 		m.Misses,
 		m.KeysAdded,
+		m.KeysUpdated,
 		m.KeysEvicted,
+		m.CostAdded,
 		m.CostEvicted,
 		m.SetsDropped,
 		m.SetsRejected,
+		m.SetsRejectedByCost,
+		m.SetsRejectedTooLarge,
+		m.CallbacksDropped,
+		m.CallbackPanics,
+		m.GhostsRemoved,
+		m.KeyConflicts,
+		m.EventsDropped,
+		m.RefreshErrors,
+		m.NegativeHits,
+		m.VictimHits,
+		m.Hints,
+		m.BytesCopied,
+		m.ShadowHits,
+		m.ShadowMisses,
+		m.InternalCostAdded,
+		m.InternalCostEvicted,
 		m.GetsDropped,
 		m.GetsKept,
 	} {
 		require.Equal(t, uint64(0), f())
 	}
+	require.Zero(t, m.Ratio())
+	require.Zero(t, m.ShadowRatio())
+	require.Zero(t, m.RatioWindow(time.Minute))
+	require.Zero(t, m.CostHistogram())
+	require.Zero(t, m.Latency(PhaseMapLookup))
+	require.Nil(t, m.LifeExpectancySeconds())
+	require.Equal(t, "", m.String())
+	m.Clear()
+	b, err := json.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, "null", string(b))
 }
 
 func TestMetricsAddGet(t *testing.T) {
@@ -699,6 +3322,28 @@ func TestMetricsAddGet(t *testing.T) {
 	require.Equal(t, uint64(0), m.Hits())
 }
 
+func TestMetricsAddConcurrent(t *testing.T) {
+	m := newMetrics()
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				// Half of the counts are for the same hot key.
+				m.add(hit, uint64(g*i%2), 1)
+				m.add(costAdd, uint64(i), uint64(g))
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, uint64(32*1000), m.Hits())
+	require.Equal(t, uint64(1000*31*32/2), m.CostAdded())
+	m.Clear()
+	require.Zero(t, m.Hits())
+	require.Zero(t, m.CostAdded())
+}
+
 func TestMetricsRatio(t *testing.T) {
 	m := newMetrics()
 	require.Equal(t, float64(0), m.Ratio())
@@ -713,6 +3358,61 @@ func TestMetricsRatio(t *testing.T) {
 	require.Equal(t, float64(0), m.Ratio())
 }
 
+func TestCacheLifeExpectancyBounded(t *testing.T) {
+	for _, tc := range []struct {
+		keys, rate int
+		min, max   int64
+	}{
+		{keys: 5, rate: 1, min: 4, max: 5},
+		{keys: 0, rate: 4, min: 2, max: 3},
+	} {
+		c, err := NewCache(&Config{
+			NumCounters:              100,
+			MaxCost:                  10,
+			BufferItems:              64,
+			IgnoreInternalCost:       true,
+			Metrics:                  true,
+			LifeExpectancyKeys:       tc.keys,
+			LifeExpectancySampleRate: tc.rate,
+		})
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			require.True(t, c.Set(i, i, 1))
+		}
+		c.Wait()
+		c.UpdateMaxCost(1)
+		for start := time.Now(); c.Metrics.KeysEvicted() < 9; time.Sleep(time.Millisecond) {
+			require.True(t, time.Since(start) < time.Second)
+		}
+		c.Wait()
+		// Evictions are all counted, but only the tracked keys make it to the
+		// life expectancy histogram.
+		require.Equal(t, uint64(9), c.Metrics.KeysEvicted())
+		count := c.Metrics.LifeExpectancySeconds().Count
+		require.True(t, count >= tc.min && count <= tc.max, "count: %d", count)
+		c.Close()
+	}
+}
+
+func TestMetricsJSON(t *testing.T) {
+	m := newMetrics()
+	m.internalCost = 2
+	m.loadsInFlight = 3
+	for i := 0; i < doNotUse; i++ {
+		m.add(metricType(i), 1, uint64(i+1))
+	}
+	got, err := json.MarshalIndent(m, "", "  ")
+	require.NoError(t, err)
+	want, err := ioutil.ReadFile("testdata/metrics.json")
+	require.NoError(t, err)
+	require.Equal(t, string(want), string(got)+"\n")
+
+	m = nil
+	got, err = json.Marshal(m)
+	require.NoError(t, err)
+	require.Equal(t, "null", string(got))
+}
+
 func TestMetricsString(t *testing.T) {
 	m := newMetrics()
 	m.add(hit, 1, 1)
@@ -914,6 +3614,7 @@ func TestRistrettoCalloc(t *testing.T) {
 }
 
 func TestRistrettoCallocTTL(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
 	maxCacheSize := 1 << 20
 	config := &Config{
 		// Use 5% of cache memory for storing counters.
@@ -924,6 +3625,7 @@ func TestRistrettoCallocTTL(t *testing.T) {
 		OnExit: func(val interface{}) {
 			z.Free(val.([]byte))
 		},
+		Clock: clock,
 	}
 	r, err := NewCache(config)
 	require.NoError(t, err)
@@ -949,10 +3651,192 @@ func TestRistrettoCallocTTL(t *testing.T) {
 		}()
 	}
 	wg.Wait()
-	time.Sleep(5 * time.Second)
+	r.Wait()
+	clock.Add(10 * time.Second)
+	r.Wait()
 	require.Zero(t, z.NumAllocBytes())
 }
 
+func TestCacheUintKeys(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetUint(1, "one", 1))
+	c.Wait()
+	val, ok := c.GetUint(1)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	// The uint64 methods see the same items as the others.
+	val, ok = c.Get(uint64(1))
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	require.True(t, c.Set(uint64(2), "two", 1))
+	c.Wait()
+	val, ok = c.GetUint(2)
+	require.True(t, ok)
+	require.Equal(t, "two", val)
+	require.Equal(t, uint64(3), c.Metrics.Hits())
+
+	val, ok = c.DelUint(2)
+	require.True(t, ok)
+	require.Equal(t, "two", val)
+	_, ok = c.GetUint(2)
+	require.False(t, ok)
+	_, ok = c.DelUint(2)
+	require.False(t, ok)
+
+	c.Close()
+	require.False(t, c.SetUint(3, 3, 1))
+	_, ok = c.GetUint(1)
+	require.False(t, ok)
+	var nilCache *Cache
+	_, ok = nilCache.GetUint(1)
+	require.False(t, ok)
+}
+
+func TestCacheGetUintAllocs(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for key := uint64(0); key < 100; key++ {
+		c.SetUint(key, key, 1)
+	}
+	c.Wait()
+	var key uint64
+	allocs := testing.AllocsPerRun(1000, func() {
+		c.GetUint(key % 100)
+		key++
+	})
+	require.Zero(t, allocs)
+}
+
+func TestCacheGetAllocs(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            1000,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	// The keys are boxed beforehand, as boxing a string or a slice to pass it
+	// as an interface is the caller's allocation.
+	keys := make([]interface{}, 0, 300)
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("bytes-%d", i)), i)
+	}
+	for _, key := range keys {
+		c.Set(key, 1, 1)
+	}
+	c.Wait()
+	for _, key := range keys {
+		_, ok := c.Get(key)
+		require.True(t, ok, "%v", key)
+	}
+	var i int
+	allocs := testing.AllocsPerRun(1000, func() {
+		c.Get(keys[i%len(keys)])
+		i++
+	})
+	require.Zero(t, allocs)
+	missing := interface{}("missing")
+	allocs = testing.AllocsPerRun(1000, func() {
+		c.Get(missing)
+	})
+	require.Zero(t, allocs)
+}
+
+func BenchmarkCacheGet(b *testing.B) {
+	c, err := NewCache(&Config{
+		NumCounters: 1e5,
+		MaxCost:     1e4,
+		BufferItems: 64,
+	})
+	require.NoError(b, err)
+	defer c.Close()
+	keys := make([]interface{}, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		c.Set(keys[i], i, 1)
+	}
+	c.Wait()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i%len(keys)])
+	}
+}
+
+// BenchmarkCacheGetTTL compares Gets of items without a TTL, which don't read
+// the clock, to Gets of items with one, reading the cached time or calling
+// time.Now.
+func BenchmarkCacheGetTTL(b *testing.B) {
+	cases := []struct {
+		name      string
+		ttl       time.Duration
+		precision time.Duration
+	}{
+		{"none", 0, 0},
+		{"coarse", time.Hour, 0},
+		{"exact", time.Hour, -1},
+	}
+	for _, tc := range cases {
+		b.Run(tc.name, func(b *testing.B) {
+			c, err := NewCache(&Config{
+				NumCounters:    1e5,
+				MaxCost:        1e4,
+				BufferItems:    64,
+				ClockPrecision: tc.precision,
+			})
+			require.NoError(b, err)
+			defer c.Close()
+			keys := make([]interface{}, 1000)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", i)
+				c.SetWithTTL(keys[i], i, 1, tc.ttl)
+			}
+			c.Wait()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Get(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkCacheGetUint(b *testing.B) {
+	c, err := NewCache(&Config{
+		NumCounters: 1e5,
+		MaxCost:     1e4,
+		BufferItems: 64,
+	})
+	require.NoError(b, err)
+	defer c.Close()
+	for key := uint64(0); key < 1000; key++ {
+		c.SetUint(key, key, 1)
+	}
+	c.Wait()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetUint(uint64(i % 1000))
+	}
+}
+
 func newTestCache() (*Cache, error) {
 	return NewCache(&Config{
 		NumCounters: 100,
@@ -961,3 +3845,238 @@ func newTestCache() (*Cache, error) {
 		Metrics:     true,
 	})
 }
+
+func BenchmarkCacheGetParallel(b *testing.B) {
+	modes := map[string]BufferMode{"lossy": BufferLossy, "lossless": BufferLossless}
+	for name, mode := range modes {
+		for _, procs := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/procs=%d", name, procs), func(b *testing.B) {
+				c, err := NewCache(&Config{
+					NumCounters: 1e5,
+					MaxCost:     1e4,
+					BufferItems: 64,
+					BufferMode:  mode,
+				})
+				require.NoError(b, err)
+				defer c.Close()
+				for i := 0; i < 1000; i++ {
+					c.Set(i, i, 1)
+				}
+				c.Wait()
+				b.SetParallelism(procs)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						c.Get(i % 1000)
+					}
+				})
+			})
+		}
+	}
+}
+
+// BenchmarkCacheContention runs Get-heavy and mixed workloads with metrics from
+// many goroutines, where counters sharing cache lines show.
+func BenchmarkCacheContention(b *testing.B) {
+	for _, workload := range []struct {
+		name string
+		// sets is how many operations out of 10 are Sets.
+		sets int
+	}{
+		{"get", 0},
+		{"mixed", 3},
+	} {
+		for _, goroutines := range []int{16, 32} {
+			name := fmt.Sprintf("%s/goroutines=%d", workload.name, goroutines)
+			sets := workload.sets
+			b.Run(name, func(b *testing.B) {
+				c, err := NewCache(&Config{
+					NumCounters: 1e5,
+					MaxCost:     1e4,
+					BufferItems: 64,
+					Metrics:     true,
+				})
+				require.NoError(b, err)
+				defer c.Close()
+				for i := 0; i < 1000; i++ {
+					c.Set(i, i, 1)
+				}
+				c.Wait()
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for g := 0; g < goroutines; g++ {
+					wg.Add(1)
+					go func(g int) {
+						defer wg.Done()
+						for i := g; i < b.N; i += goroutines {
+							if i%10 < sets {
+								c.Set(i%1000, i, 1)
+							} else {
+								c.Get(i % 1000)
+							}
+						}
+					}(g)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// countingPolicy is a Policy counting the keys it's given to track.
+type countingPolicy struct {
+	Policy
+	adds int32
+}
+
+func (p *countingPolicy) Add(key uint64, cost int64) {
+	atomic.AddInt32(&p.adds, 1)
+	p.Policy.Add(key, cost)
+}
+
+func TestCachePolicyConstructedOnce(t *testing.T) {
+	// Policies may have side effects when built, such as starting goroutines,
+	// so NewCache builds exactly one, and uses that one.
+	var built []*countingPolicy
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Policy: func(numCounters, maxCost int64) Policy {
+			p := &countingPolicy{Policy: NewLRUPolicy(numCounters, maxCost)}
+			built = append(built, p)
+			return p
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Len(t, built, 1)
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, int32(5), atomic.LoadInt32(&built[0].adds))
+}
+
+func TestCacheSynchronous(t *testing.T) {
+	// Without buffers in the way, every policy makes the same choices on the
+	// same operations. The victims below pin them down.
+	tests := []struct {
+		name    string
+		policy  func(numCounters, maxCost int64) Policy
+		victims []uint64
+	}{
+		{"default", nil, []uint64{4, 3}},
+		{"lru", NewLRUPolicy, []uint64{4, 1}},
+		{"clock", NewClockPolicy, []uint64{4, 1}},
+		{"slru", NewSLRUPolicy, []uint64{4, 5}},
+		{"2q", NewTwoQueuePolicy, []uint64{1, 2}},
+		{"arc", NewARCPolicy, []uint64{4, 5}},
+		{"lirs", NewLIRSPolicy, []uint64{4, 5}},
+		{"hyperbolic", NewHyperbolicPolicy, []uint64{4, 3}},
+		{"wtinylfu", NewWTinyLFUPolicy, []uint64{4, 1}},
+	}
+	for _, test := range tests {
+		var victims, rejected []uint64
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            4,
+			IgnoreInternalCost: true,
+			Synchronous:        true,
+			Policy:             test.policy,
+			OnEvict:            func(item *Item) { victims = append(victims, item.Key) },
+			OnReject:           func(item *Item) { rejected = append(rejected, item.Key) },
+		})
+		require.NoError(t, err)
+		for i := 1; i <= 4; i++ {
+			require.True(t, c.Set(i, i, 1))
+		}
+		for _, key := range []int{1, 1, 1, 3, 3, 2, 5, 5, 5, 5} {
+			c.Get(key)
+		}
+		require.True(t, c.Set(5, 5, 1))
+		// The Set is applied by the time it returns.
+		require.Equal(t, test.victims[:1], victims, test.name)
+		for _, key := range []int{2, 2, 6, 6} {
+			c.Get(key)
+		}
+		require.True(t, c.Set(6, 6, 1))
+		require.Equal(t, test.victims, victims, test.name)
+		require.Empty(t, rejected, test.name)
+		require.Equal(t, 4, c.Len(), test.name)
+		_, ok := c.Del(6)
+		require.True(t, ok)
+		require.Equal(t, int64(3), c.UsedCost(), test.name)
+		c.Close()
+	}
+}
+
+func TestCacheCustomGhostVictims(t *testing.T) {
+	var victims []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            4,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Synchronous:        true,
+		Policy: func(numCounters, maxCost int64) Policy {
+			return resurrectingPolicy{NewLRUPolicy(numCounters, maxCost).(*lruPolicy)}
+		},
+		OnEvict: func(item *Item) { victims = append(victims, item.Key) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The misses leave the policy with keys the cache doesn't have, which
+	// are the least recently used.
+	for i := 100; i < 104; i++ {
+		c.Get(i)
+	}
+	for i := 1; i <= 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	require.Equal(t, []uint64{1}, victims)
+	_, ok := c.Get(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), c.Metrics.GhostsRemoved())
+}
+
+func TestCacheSetLastWriteWins(t *testing.T) {
+	// The value left and the cost the policy keeps are from the same Set,
+	// whether the key starts out in the cache or not.
+	for _, present := range []bool{true, false} {
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            1000,
+			IgnoreInternalCost: true,
+			BufferItems:        64,
+		})
+		require.NoError(t, err)
+		if present {
+			require.True(t, c.Set("key", 0, 1))
+			c.Wait()
+		}
+		var wg sync.WaitGroup
+		for g := 1; g <= 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					c.Set("key", g, int64(g))
+				}
+			}(g)
+		}
+		wg.Wait()
+		c.Wait()
+		val, ok := c.Get("key")
+		require.True(t, ok)
+		require.Contains(t, []int{1, 2, 3, 4, 5, 6, 7, 8}, val)
+		require.Equal(t, int64(val.(int)), c.UsedCost())
+		for i := range c.order {
+			require.Empty(t, c.order[i].pending)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// defaultEvictQueueSize is the number of callbacks queued for the eviction
+// workers when Config.EvictQueueSize isn't set.
+const defaultEvictQueueSize = 1024
+
+// callbackPool runs the OnEvict and OnExpire callbacks on worker goroutines,
+// so that slow callbacks don't hold up the goroutine applying the Sets. With
+// a single worker, the callbacks run in the order the items left the cache.
+type callbackPool struct {
+	items chan callbackItem
+	// drop is set to drop the callbacks that don't fit in items, rather than
+	// wait for room.
+	drop bool
+	wg   sync.WaitGroup
+}
+
+type callbackItem struct {
+	f    itemCallback
+	item *Item
+}
+
+func newCallbackPool(workers, size int, drop bool) *callbackPool {
+	p := &callbackPool{
+		items: make(chan callbackItem, size),
+		drop:  drop,
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *callbackPool) worker() {
+	defer p.wg.Done()
+	for ci := range p.items {
+		ci.f(ci.item)
+	}
+}
+
+// run queues f to be called with item. It returns false if the callback was
+// dropped because the queue is full.
+func (p *callbackPool) run(f itemCallback, item *Item) bool {
+	ci := callbackItem{f, item}
+	if !p.drop {
+		p.items <- ci
+		return true
+	}
+	select {
+	case p.items <- ci:
+		return true
+	default:
+		return false
+	}
+}
+
+// close waits for the queued callbacks to be called. run mustn't be called
+// after close.
+func (p *callbackPool) close() {
+	close(p.items)
+	p.wg.Wait()
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackPoolOrder(t *testing.T) {
+	p := newCallbackPool(1, 4, false)
+	var keys []uint64
+	for key := uint64(0); key < 100; key++ {
+		require.True(t, p.run(func(item *Item) {
+			keys = append(keys, item.Key)
+		}, &Item{Key: key}))
+	}
+	p.close()
+	require.Len(t, keys, 100)
+	for i, key := range keys {
+		require.Equal(t, uint64(i), key)
+	}
+}
+
+func TestCallbackPoolDrop(t *testing.T) {
+	p := newCallbackPool(2, 1, true)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var called int
+	f := func(item *Item) {
+		<-release
+		mu.Lock()
+		called++
+		mu.Unlock()
+	}
+	run := 0
+	for i := 0; i < 10; i++ {
+		if p.run(f, &Item{}) {
+			run++
+		}
+	}
+	// At most two workers and one queued callback.
+	require.True(t, run >= 1 && run <= 3)
+	close(release)
+	p.close()
+	require.Equal(t, run, called)
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// KeyClass is a class of keys of Config.Classes: the keys Config.Classifier
+// sorts into it share a part of MaxCost, and only evict each other.
+type KeyClass struct {
+	// Share is the share of MaxCost the keys of the class can take, between 0
+	// and 1.
+	Share float64 `json:"share"`
+	// Policy is the name of the policy picking the victims among the keys of
+	// the class, one of those registered with RegisterPolicy, such as "lru".
+	// It's given a share of NumCounters and MaxCost. Empty or "tinylfu", the
+	// victims are sampled and compared with the new keys by the frequency
+	// estimates of the cache, like the default policy does.
+	Policy string `json:"policy"`
+}
+
+// keyClassPrefix starts the names of the cost classes of Config.Classes, so
+// that they don't clash with the names of namespaces.
+const keyClassPrefix = "\x00class\x00"
+
+func keyClassName(class int) string {
+	return keyClassPrefix + strconv.Itoa(class)
+}
+
+// validClasses returns whether the shares of the key classes are positive and
+// add up to 1 at most, leaving room for rounding.
+func validClasses(classes []KeyClass) bool {
+	var sum float64
+	for _, class := range classes {
+		if class.Share <= 0 || class.Share > 1 {
+			return false
+		}
+		sum += class.Share
+	}
+	return sum <= 1+1e-9
+}
+
+// newClassPolicies returns the policies of the key classes, nil for the ones
+// using the default policy, created with their share of numCounters and
+// maxCost.
+func newClassPolicies(classes []KeyClass, numCounters, maxCost int64) ([]Policy, error) {
+	policies := make([]Policy, len(classes))
+	for i, class := range classes {
+		newPolicy, err := lookupPolicy(class.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("unknown Classes[%d].Policy %q", i, class.Policy)
+		}
+		if newPolicy == nil {
+			continue
+		}
+		counters := int64(class.Share * float64(numCounters))
+		if counters < 1 {
+			counters = 1
+		}
+		if policies[i] = newPolicy(counters, int64(class.Share*float64(maxCost))); policies[i] == nil {
+			return nil, fmt.Errorf("Classes[%d].Policy returned a nil Policy", i)
+		}
+	}
+	return policies, nil
+}
+
+// classOf returns the cost class of the key of a new item: that of its
+// namespace, or its key class if Config.Classifier is set. Keys that aren't
+// strings, and those the classifier puts out of range, are in the first key
+// class.
+func (c *Cache) classOf(i *Item) string {
+	switch {
+	case i.ns != nil:
+		return i.ns.name
+	case c.classNames == nil:
+		return ""
+	}
+	class := 0
+	if key, ok := i.origKey.(string); ok {
+		class = c.classifier(key)
+	}
+	return c.className(class)
+}
+
+// className returns the name of the cost class of the key class at the given
+// index, or of the first one if it's out of range.
+func (c *Cache) className(class int) string {
+	if c.classNames == nil {
+		return ""
+	}
+	if class < 0 || class >= len(c.classNames) {
+		class = 0
+	}
+	return c.classNames[class]
+}
+
+// ClassUsedCost returns the sum of the costs of the items of the key class of
+// Config.Classes at the given index admitted by the policy, like UsedCost.
+func (c *Cache) ClassUsedCost(class int) int64 {
+	if c == nil || c.isClosed() || class < 0 || class >= len(c.classNames) {
+		return 0
+	}
+	return c.policy.ClassUsed(c.classNames[class])
+}
+
+func (p *defaultPolicy) SetKeyClasses(policies []Policy, shares []float64) {
+	p.Lock()
+	defer p.Unlock()
+	p.classes = make([]*costClass, len(policies))
+	for i, policy := range policies {
+		cls := p.evict.class(keyClassName(i))
+		cls.quota, cls.policy = shares[i], policy
+		p.classes[i] = cls
+		if policy != nil {
+			p.classPolicies = true
+		}
+	}
+}
+
+func (p *defaultPolicy) KeyClass(key uint64) int {
+	if len(p.classes) == 0 {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	if cls, ok := p.evict.keyClasses[key]; ok {
+		for i, c := range p.classes {
+			if c == cls {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// accessClasses passes a batch of accesses on to the policies of the key
+// classes: those of the keys of a class to its policy, and those of the keys
+// not in the cache to every one of them, as their class isn't known until
+// they're Set.
+func (p *defaultPolicy) accessClasses(items []uint64) {
+	p.Lock()
+	defer p.Unlock()
+	for _, cls := range p.classes {
+		cls.batch = cls.batch[:0]
+	}
+	for _, key := range items {
+		if cls, ok := p.evict.keyClasses[key]; ok {
+			if cls.policy != nil {
+				cls.batch = append(cls.batch, key)
+			}
+			continue
+		}
+		for _, cls := range p.classes {
+			if cls.policy != nil {
+				cls.batch = append(cls.batch, key)
+			}
+		}
+	}
+	for _, cls := range p.classes {
+		if len(cls.batch) > 0 {
+			cls.policy.Access(cls.batch)
+		}
+	}
+}
+
+// delClass tells the policy of the class of a key leaving the cache, if it has
+// one, that it's gone, when it's not the one that picked the key as a victim.
+func (p *defaultPolicy) delClass(key uint64) {
+	if cls, ok := p.evict.keyClasses[key]; ok && cls.policy != nil {
+		cls.policy.Del(key)
+	}
+}
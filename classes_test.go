@@ -0,0 +1,214 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// classifyPrefix puts the keys starting with "b:" in the second class, and
+// the others in the first one.
+func classifyPrefix(key string) int {
+	if strings.HasPrefix(key, "b:") {
+		return 1
+	}
+	return 0
+}
+
+// classWorkload returns the keys and costs of a workload: metadata keys
+// drawn from a skewed distribution, which suits LFU, and blobs mostly seen
+// again shortly after they're first seen, which suits LRU.
+func classWorkload(blob bool, n int) ([]string, []int64) {
+	r := rand.New(rand.NewSource(1))
+	keys, costs := make([]string, n), make([]int64, n)
+	z := rand.NewZipf(r, 1.2, 1, 5000)
+	for i := range keys {
+		if blob {
+			keys[i], costs[i] = fmt.Sprintf("b:%d", i/4-r.Intn(40)), 10
+		} else {
+			keys[i], costs[i] = fmt.Sprintf("m:%d", z.Uint64()), 1
+		}
+	}
+	return keys, costs
+}
+
+// runClassWorkload Gets the keys in turn, Setting the ones missed, and
+// returns the hit ratio of each workload.
+func runClassWorkload(c *Cache, workloads ...[]string) []float64 {
+	hits := make([]int, len(workloads))
+	for i := range workloads[0] {
+		for w, keys := range workloads {
+			key := keys[i]
+			if _, ok := c.Get(key); ok {
+				hits[w]++
+				continue
+			}
+			cost := int64(1)
+			if strings.HasPrefix(key, "b:") {
+				cost = 10
+			}
+			c.Set(key, key, cost)
+			c.Wait()
+		}
+	}
+	ratios := make([]float64, len(workloads))
+	for w := range workloads {
+		ratios[w] = float64(hits[w]) / float64(len(workloads[w]))
+	}
+	return ratios
+}
+
+func newClassCache(t *testing.T, maxCost int64, policy func(numCounters, maxCost int64) Policy,
+	classes ...KeyClass) *Cache {
+	config := &Config{
+		NumCounters:        10000,
+		MaxCost:            maxCost,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Policy:             policy,
+	}
+	if len(classes) > 0 {
+		config.Classifier, config.Classes = classifyPrefix, classes
+	}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheClasses(t *testing.T) {
+	meta, _ := classWorkload(false, 20000)
+	blobs, _ := classWorkload(true, 20000)
+
+	c := newClassCache(t, 1000, nil, KeyClass{Share: 0.3}, KeyClass{Share: 0.7, Policy: "lru"})
+	defer c.Close()
+	ratios := runClassWorkload(c, meta, blobs)
+	require.LessOrEqual(t, c.ClassUsedCost(0), int64(300))
+	require.LessOrEqual(t, c.ClassUsedCost(1), int64(700))
+	require.Greater(t, c.ClassUsedCost(1), int64(600))
+	require.Equal(t, c.UsedCost(), c.ClassUsedCost(0)+c.ClassUsedCost(1))
+
+	// Each class does as well as a cache of its own with the same share and
+	// policy would.
+	dedicated := newClassCache(t, 300, nil)
+	defer dedicated.Close()
+	metaRatio := runClassWorkload(dedicated, meta)[0]
+	dedicated = newClassCache(t, 700, NewLRUPolicy)
+	defer dedicated.Close()
+	blobRatio := runClassWorkload(dedicated, blobs)[0]
+	require.InDelta(t, metaRatio, ratios[0], 0.03)
+	require.InDelta(t, blobRatio, ratios[1], 0.03)
+
+	// The other way around, both do worse.
+	c = newClassCache(t, 1000, nil, KeyClass{Share: 0.3, Policy: "lru"}, KeyClass{Share: 0.7})
+	defer c.Close()
+	swapped := runClassWorkload(c, meta, blobs)
+	require.Less(t, swapped[0], ratios[0])
+	require.Less(t, swapped[1], ratios[1])
+}
+
+func TestCacheClassesAggregate(t *testing.T) {
+	config := newSnapshotConfig()
+	config.BufferMode = BufferLossless
+	config.Classifier = classifyPrefix
+	config.Classes = []KeyClass{{Share: 0.5, Policy: "clock"}, {Share: 0.5, Policy: "lru"}}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("m:%d", i), "m", 1)
+		c.Set(fmt.Sprintf("b:%d", i), "b", 5)
+		c.Wait()
+	}
+	// A class only evicts its own keys.
+	require.Equal(t, int64(50), c.ClassUsedCost(0))
+	require.Equal(t, int64(50), c.ClassUsedCost(1))
+	require.Equal(t, 60, c.Len())
+	// Keys that aren't strings are in the first class.
+	require.True(t, c.Set(1, "m", 1))
+	c.Wait()
+	_, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, int64(50), c.ClassUsedCost(0))
+	require.Equal(t, 60, c.Len())
+
+	// Del and Warm go to the class of the key.
+	_, ok = c.Del("b:99")
+	require.True(t, ok)
+	c.Wait()
+	require.Equal(t, int64(45), c.ClassUsedCost(1))
+	require.Equal(t, 1, c.Warm([]interface{}{"b:x", "b:y"}, []interface{}{"b", "b"}, []int64{5, 5}))
+	require.Equal(t, int64(50), c.ClassUsedCost(1))
+	require.Equal(t, int64(50), c.ClassUsedCost(0))
+
+	// The snapshot keeps the class of every key.
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+	loaded, err := LoadCache(config, &buf)
+	require.NoError(t, err)
+	defer loaded.Close()
+	require.Equal(t, c.Len(), loaded.Len())
+	require.Equal(t, int64(50), loaded.ClassUsedCost(0))
+	require.Equal(t, int64(50), loaded.ClassUsedCost(1))
+	require.True(t, loaded.Set("b:z", "b", 5))
+	loaded.Wait()
+	require.Equal(t, int64(50), loaded.ClassUsedCost(1))
+	require.Equal(t, int64(50), loaded.ClassUsedCost(0))
+
+	c.Clear()
+	require.Zero(t, c.Len())
+	require.Zero(t, c.ClassUsedCost(0))
+	require.Zero(t, c.ClassUsedCost(1))
+	require.True(t, c.Set("b:1", "b", 5))
+	c.Wait()
+	require.Equal(t, int64(5), c.ClassUsedCost(1))
+
+	// Lowering MaxCost trims every class to its share.
+	c.UpdateMaxCost(20)
+	c.Wait()
+	require.LessOrEqual(t, c.UsedCost(), int64(20))
+}
+
+func TestCacheClassesConfig(t *testing.T) {
+	for _, test := range []struct {
+		classifier func(string) int
+		classes    []KeyClass
+		err        string
+	}{
+		{classifyPrefix, nil, "Classifier requires Classes"},
+		{nil, []KeyClass{{Share: 1}}, "Classes requires Classifier"},
+		{classifyPrefix, []KeyClass{{Share: 0}}, "the Shares of Classes must be positive and add up to 1 at most"},
+		{classifyPrefix, []KeyClass{{Share: 0.6}, {Share: 0.6}}, "the Shares of Classes must be positive and add up to 1 at most"},
+		{classifyPrefix, []KeyClass{{Share: 1, Policy: "lfu"}}, `unknown Classes[0].Policy "lfu"`},
+	} {
+		_, err := NewCache(&Config{
+			NumCounters: 100,
+			MaxCost:     10,
+			BufferItems: 64,
+			Classifier:  test.classifier,
+			Classes:     test.classes,
+		})
+		require.EqualError(t, err, test.err)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// clockPolicy is a CLOCK eviction policy: resident keys sit in a circular
+// buffer with a reference bit that's set whenever they're accessed. To find a
+// victim, the hand sweeps the buffer clearing reference bits until it reaches a
+// key whose bit is already clear. Every candidate is admitted.
+type clockPolicy struct {
+	slots []clockSlot
+	// index maps each tracked key to its slot.
+	index map[uint64]int
+	// free holds the slots emptied by Del, to be reused by Add.
+	free []int
+	hand int
+}
+
+type clockSlot struct {
+	key  uint64
+	ref  bool
+	used bool
+}
+
+// NewClockPolicy returns a CLOCK Policy, which favors recently accessed keys
+// and costs a couple of words per key. It can be used as Config.Policy.
+func NewClockPolicy(numCounters, maxCost int64) Policy {
+	return &clockPolicy{
+		index: make(map[uint64]int),
+	}
+}
+
+func (p *clockPolicy) Add(key uint64, cost int64) {
+	slot := clockSlot{key: key, used: true}
+	if n := len(p.free); n > 0 {
+		i := p.free[n-1]
+		p.free = p.free[:n-1]
+		p.slots[i] = slot
+		p.index[key] = i
+		return
+	}
+	p.slots = append(p.slots, slot)
+	p.index[key] = len(p.slots) - 1
+}
+
+func (p *clockPolicy) Update(key uint64, cost int64) {}
+
+func (p *clockPolicy) Del(key uint64) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	delete(p.index, key)
+	p.slots[i] = clockSlot{}
+	p.free = append(p.free, i)
+}
+
+func (p *clockPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		if i, ok := p.index[key]; ok {
+			p.slots[i].ref = true
+		}
+	}
+}
+
+func (p *clockPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+// EvictSkipping passes over the skipped keys without clearing their reference
+// bits.
+func (p *clockPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	if len(p.index) == 0 {
+		return 0, false
+	}
+	// Two full sweeps are enough: the first one clears every reference bit.
+	for n := 0; n < 2*len(p.slots); n++ {
+		slot := &p.slots[p.hand]
+		p.hand = (p.hand + 1) % len(p.slots)
+		if !slot.used || skip != nil && skip(slot.key) {
+			continue
+		}
+		if slot.ref {
+			slot.ref = false
+			continue
+		}
+		victim := slot.key
+		p.Del(victim)
+		return victim, true
+	}
+	return 0, false
+}
+
+func (p *clockPolicy) Resize(maxCost int64) {}
+
+func (p *clockPolicy) Clear() {
+	p.slots = p.slots[:0]
+	p.index = make(map[uint64]int)
+	p.free = p.free[:0]
+	p.hand = 0
+}
@@ -0,0 +1,78 @@
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockPolicyEvict(t *testing.T) {
+	p := NewClockPolicy(100, 3)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Add(3, 1)
+	p.Access([]uint64{1, 3, 4})
+
+	victim, ok := p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), victim)
+	// The first sweep cleared the reference bit of 1, so it goes before 3
+	// which hasn't been passed by the hand yet.
+	victim, ok = p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+	victim, ok = p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	_, ok = p.Evict(5)
+	require.False(t, ok)
+}
+
+func TestClockPolicyDel(t *testing.T) {
+	p := NewClockPolicy(100, 3).(*clockPolicy)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Del(1)
+	p.Del(3)
+	p.Add(3, 1)
+	require.Len(t, p.slots, 2)
+	require.Equal(t, 0, p.index[3])
+
+	victim, ok := p.Evict(4)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	p.Clear()
+	_, ok = p.Evict(4)
+	require.False(t, ok)
+}
+
+func TestCacheClockPolicy(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            3,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		Policy:             NewClockPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	c.Get(1)
+	c.Get(3)
+	time.Sleep(wait)
+
+	// 2 is the only key that wasn't touched, so it makes room for 4.
+	require.True(t, c.Set(4, 4, 1))
+	c.Wait()
+	_, ok := c.Get(2)
+	require.False(t, ok)
+	for _, key := range []int{1, 3, 4} {
+		_, ok := c.Get(key)
+		require.True(t, ok)
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// encodeItem encodes the value of an item for a cache with
+// Config.StoreEncoded, and makes the length of the bytes its cost if it has
+// none and there's no Config.Cost. It returns false if the value can't be
+// encoded.
+func (c *Cache) encodeItem(i *Item) bool {
+	if !c.storeEncoded {
+		return true
+	}
+	data, err := c.encodeValue(i.Value)
+	if err != nil {
+		return false
+	}
+	i.encoded = data
+	if i.Cost == 0 && c.cost == nil {
+		i.Cost = int64(len(data))
+	}
+	return true
+}
+
+// codecStore is the store of a cache with Config.StoreEncoded. It holds the
+// values encoded in the store it wraps, and decodes them on the way out, so
+// the rest of the cache only sees decoded values. A value that fails to
+// decode is reported missing by Get and its like, and nil elsewhere.
+type codecStore struct {
+	store
+	encode func(value interface{}) ([]byte, error)
+	decode func(data []byte) (interface{}, error)
+}
+
+func newCodecStore(s store, encode func(interface{}) ([]byte, error),
+	decode func([]byte) (interface{}, error)) *codecStore {
+	return &codecStore{store: s, encode: encode, decode: decode}
+}
+
+// decodeValue decodes a value read from the wrapped store.
+func (s *codecStore) decodeValue(value interface{}) (interface{}, bool) {
+	data, ok := value.([]byte)
+	if !ok {
+		return nil, false
+	}
+	decoded, err := s.decode(data)
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// encodeItem returns a copy of the item holding its encoded value, using the
+// bytes from Cache.encodeItem if there are any.
+func (s *codecStore) encodeItem(i *Item) (*Item, bool) {
+	data := i.encoded
+	if data == nil {
+		var err error
+		if data, err = s.encode(i.Value); err != nil {
+			return nil, false
+		}
+	}
+	encoded := *i
+	encoded.Value = data
+	return &encoded, true
+}
+
+// decodeItems wraps a callback so that it gets the items decoded.
+func (s *codecStore) decodeItems(f itemCallback) itemCallback {
+	if f == nil {
+		return nil
+	}
+	return func(i *Item) {
+		i.Value, _ = s.decodeValue(i.Value)
+		f(i)
+	}
+}
+
+func (s *codecStore) Get(key, conflict uint64) (interface{}, bool) {
+	value, ok := s.store.Get(key, conflict)
+	if !ok {
+		return nil, false
+	}
+	return s.decodeValue(value)
+}
+
+func (s *codecStore) GetMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	s.store.GetMulti(keys, conflicts, values, found)
+	for i := range keys {
+		if found[i] {
+			values[i], found[i] = s.decodeValue(values[i])
+		}
+	}
+}
+
+func (s *codecStore) Set(i *Item) {
+	if i == nil {
+		return
+	}
+	if encoded, ok := s.encodeItem(i); ok {
+		s.store.Set(encoded)
+	}
+}
+
+func (s *codecStore) SetMulti(items []*Item) {
+	encoded := make([]*Item, 0, len(items))
+	for _, i := range items {
+		if e, ok := s.encodeItem(i); ok {
+			encoded = append(encoded, e)
+		}
+	}
+	s.store.SetMulti(encoded)
+}
+
+func (s *codecStore) Del(key, conflict uint64) (uint64, interface{}, bool) {
+	conflict, value, ok := s.store.Del(key, conflict)
+	if ok {
+		value, _ = s.decodeValue(value)
+	}
+	return conflict, value, ok
+}
+
+func (s *codecStore) DelMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	s.store.DelMulti(keys, conflicts, values, found)
+	for i := range keys {
+		if found[i] {
+			values[i], _ = s.decodeValue(values[i])
+		}
+	}
+}
+
+func (s *codecStore) Update(newItem *Item) (interface{}, bool) {
+	encoded, ok := s.encodeItem(newItem)
+	if !ok {
+		return nil, false
+	}
+	prev, ok := s.store.Update(encoded)
+	if !ok {
+		return nil, false
+	}
+	prev, _ = s.decodeValue(prev)
+	return prev, true
+}
+
+func (s *codecStore) Compute(key, conflict uint64,
+	f func(value interface{}, ok bool) (interface{}, bool)) (interface{}, bool) {
+	var old interface{}
+	_, replaced := s.store.Compute(key, conflict, func(value interface{}, ok bool) (interface{}, bool) {
+		if ok {
+			old, ok = s.decodeValue(value)
+		}
+		newValue, write := f(old, ok)
+		if !write {
+			return nil, false
+		}
+		data, err := s.encode(newValue)
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	})
+	if !replaced {
+		return nil, false
+	}
+	return old, true
+}
+
+func (s *codecStore) Cleanup(policy policy, onExpire itemCallback) {
+	s.store.Cleanup(policy, s.decodeItems(onExpire))
+}
+
+func (s *codecStore) Clear(onEvict itemCallback) {
+	s.store.Clear(s.decodeItems(onEvict))
+}
+
+func (s *codecStore) GetAndTouch(key, conflict uint64, expiration int64) (interface{}, bool) {
+	value, ok := s.store.GetAndTouch(key, conflict, expiration)
+	if !ok {
+		return nil, false
+	}
+	return s.decodeValue(value)
+}
+
+func (s *codecStore) DelExpired(key, conflict uint64, now int64) (interface{}, bool) {
+	value, ok := s.store.DelExpired(key, conflict, now)
+	if ok {
+		value, _ = s.decodeValue(value)
+	}
+	return value, ok
+}
+
+func (s *codecStore) Range(f func(storeItem) bool) {
+	s.store.Range(func(item storeItem) bool {
+		item.value, _ = s.decodeValue(item.value)
+		return f(item)
+	})
+}
+
+// arenaEntry locates an encoded value in the arena of its shard. It holds no
+// pointers, so that the garbage collector doesn't have to scan the entries.
+type arenaEntry struct {
+	conflict   uint64
+	expiration int64
+	off        int
+	n          int
+}
+
+// arenaShard holds the values of its keys one after the other in a single
+// byte slice. The bytes of a value are never written over, so the slices
+// handed out by Get stay valid: deleted and replaced values are only dropped
+// when the arena fills up and is copied without them.
+type arenaShard struct {
+	sync.RWMutex
+	entries map[uint64]arenaEntry
+	arena   []byte
+	// live is the number of bytes of the arena still in use.
+	live int
+}
+
+// arenaMap is the Map of a cache with Config.StoreEncoded. It only holds
+// []byte values, sharded like the default store.
+type arenaMap struct {
+	shards []arenaShard
+	mask   uint64
+	seed   uint64
+}
+
+func newArenaMap(shards int) *arenaMap {
+	m := &arenaMap{
+		shards: make([]arenaShard, shards),
+		mask:   uint64(shards - 1),
+		seed:   randomSeed(),
+	}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[uint64]arenaEntry)
+	}
+	return m
+}
+
+func (m *arenaMap) shard(key uint64) *arenaShard {
+	return &m.shards[mixHash(key^m.seed)&m.mask]
+}
+
+func (m *arenaMap) Get(key uint64) (MapItem, bool) {
+	s := m.shard(key)
+	s.RLock()
+	e, ok := s.entries[key]
+	if !ok {
+		s.RUnlock()
+		return MapItem{}, false
+	}
+	data := s.arena[e.off : e.off+e.n : e.off+e.n]
+	s.RUnlock()
+	return MapItem{Key: key, Conflict: e.conflict, Value: data, Expiration: e.expiration}, true
+}
+
+func (m *arenaMap) Set(item MapItem) {
+	data, _ := item.Value.([]byte)
+	s := m.shard(item.Key)
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.entries[item.Key]; ok {
+		if old.n == len(data) && (old.n == 0 || &s.arena[old.off] == &data[0]) {
+			// The value is the one already there, as for a new expiration.
+			old.conflict, old.expiration = item.Conflict, item.Expiration
+			s.entries[item.Key] = old
+			return
+		}
+		s.live -= old.n
+	}
+	if cap(s.arena)-len(s.arena) < len(data) && len(s.arena)-s.live >= s.live {
+		// Most of the arena is garbage, so copy the rest rather than grow it.
+		s.compact(len(data))
+	}
+	s.entries[item.Key] = arenaEntry{
+		conflict:   item.Conflict,
+		expiration: item.Expiration,
+		off:        len(s.arena),
+		n:          len(data),
+	}
+	s.arena = append(s.arena, data...)
+	s.live += len(data)
+}
+
+// compact moves the values in use to a new arena, with room for extra more
+// bytes. It must be called with the lock held.
+func (s *arenaShard) compact(extra int) {
+	arena := make([]byte, 0, 2*(s.live+extra))
+	for key, e := range s.entries {
+		off := len(arena)
+		arena = append(arena, s.arena[e.off:e.off+e.n]...)
+		e.off = off
+		s.entries[key] = e
+	}
+	s.arena = arena
+}
+
+func (m *arenaMap) Del(key uint64) {
+	s := m.shard(key)
+	s.Lock()
+	if e, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.live -= e.n
+	}
+	if len(s.entries) == 0 {
+		s.arena = s.arena[:0:0]
+		s.live = 0
+	}
+	s.Unlock()
+}
+
+func (m *arenaMap) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.entries)
+		s.RUnlock()
+	}
+	return n
+}
+
+func (m *arenaMap) Range(f func(MapItem) bool) {
+	var items []MapItem
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		items = items[:0]
+		for key, e := range s.entries {
+			items = append(items, MapItem{
+				Key:        key,
+				Conflict:   e.conflict,
+				Value:      s.arena[e.off : e.off+e.n : e.off+e.n],
+				Expiration: e.expiration,
+			})
+		}
+		s.RUnlock()
+		for _, item := range items {
+			if !f(item) {
+				return
+			}
+		}
+	}
+}
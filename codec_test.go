@@ -0,0 +1,249 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Values that are strings are encoded as is, and "bad" values fail to encode.
+// Bytes starting with '!' fail to decode.
+func encodeTestValue(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok || s == "bad" {
+		return nil, errors.New("can't encode")
+	}
+	return []byte(s), nil
+}
+
+func decodeTestValue(data []byte) (interface{}, error) {
+	if len(data) > 0 && data[0] == '!' {
+		return nil, errors.New("can't decode")
+	}
+	return string(data), nil
+}
+
+func newEncodedCache(t *testing.T, onEvict func(*Item)) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            20,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		EncodeValue:        encodeTestValue,
+		DecodeValue:        decodeTestValue,
+		StoreEncoded:       true,
+		OnEvict:            onEvict,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheStoreEncoded(t *testing.T) {
+	evicted := make(chan interface{}, 10)
+	c := newEncodedCache(t, func(item *Item) {
+		evicted <- item.Value
+	})
+	defer c.Close()
+
+	require.True(t, c.Set(1, "abcd", 0))
+	require.True(t, c.SetWithTTL(2, "ef", 0, time.Hour))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "abcd", val)
+	// The cost defaults to the length of the encoded value.
+	require.Equal(t, int64(6), c.UsedCost())
+	_, ok = c.store.(*codecStore).store.Get(c.keyToHash(1))
+	require.True(t, ok)
+
+	require.True(t, c.Update(2, func(old interface{}, exists bool) (interface{}, bool) {
+		return old.(string) + "gh", true
+	}))
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	require.Equal(t, "efgh", val)
+	require.True(t, c.Touch(2, time.Hour))
+	val, ok = c.GetAndTouch(2, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, "efgh", val)
+
+	values := map[interface{}]bool{}
+	c.Range(func(item *Item) bool {
+		values[item.Value] = true
+		return true
+	})
+	require.Equal(t, map[interface{}]bool{"abcd": true, "efgh": true}, values)
+
+	// Evicted values are decoded, and so are deleted ones.
+	for i := 3; i < 10; i++ {
+		c.Set(i, "0123456789", 0)
+		c.Wait()
+	}
+	select {
+	case val := <-evicted:
+		require.IsType(t, "", val)
+	case <-time.After(time.Second):
+		t.Fatal("nothing was evicted")
+	}
+	c.Set(20, "x", 1)
+	c.Wait()
+	if _, ok := c.Get(20); ok {
+		val, ok = c.Del(20)
+		require.True(t, ok)
+		require.Equal(t, "x", val)
+	}
+}
+
+func TestCacheStoreEncodedErrors(t *testing.T) {
+	c := newEncodedCache(t, nil)
+	defer c.Close()
+
+	// Values that fail to encode aren't Set, and don't replace the old one.
+	require.False(t, c.Set(1, "bad", 1))
+	require.False(t, c.Set(1, 42, 1))
+	require.True(t, c.Set(1, "good", 1))
+	c.Wait()
+	require.False(t, c.Set(1, "bad", 1))
+	require.False(t, c.Update(1, func(old interface{}, exists bool) (interface{}, bool) {
+		return "bad", true
+	}))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "good", val)
+
+	// Values that fail to decode are missing.
+	require.True(t, c.Set(2, "!oops", 1))
+	c.Wait()
+	require.Equal(t, 2, c.Len())
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	_, ok = c.GetAndTouch(2, time.Hour)
+	require.False(t, ok)
+	values, found := c.GetMulti([]interface{}{1, 2})
+	require.Equal(t, []bool{true, false}, found)
+	require.Equal(t, "good", values[0])
+	_, ok = c.Del(2)
+	require.True(t, ok)
+}
+
+func TestCacheStoreEncodedConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{StoreEncoded: true, EncodeValue: encodeTestValue},
+		{StoreEncoded: true, DecodeValue: decodeTestValue},
+		{
+			StoreEncoded: true,
+			EncodeValue:  encodeTestValue,
+			DecodeValue:  decodeTestValue,
+			NewMap:       NewSyncMap,
+		},
+	} {
+		config.NumCounters = 100
+		config.MaxCost = 10
+		config.BufferItems = 64
+		_, err := NewCache(config)
+		require.Error(t, err)
+	}
+}
+
+func TestArenaMap(t *testing.T) {
+	m := newArenaMap(1)
+	var held [][]byte
+	for round := 0; round < 50; round++ {
+		for key := uint64(0); key < 10; key++ {
+			value := []byte(fmt.Sprintf("%d-%d", key, round))
+			m.Set(MapItem{Key: key, Conflict: key, Value: value})
+			item, ok := m.Get(key)
+			require.True(t, ok)
+			held = append(held, item.Value.([]byte))
+		}
+	}
+	// Compaction kept the values, and left the ones handed out alone.
+	for key := uint64(0); key < 10; key++ {
+		item, ok := m.Get(key)
+		require.True(t, ok)
+		require.Equal(t, key, item.Conflict)
+		require.Equal(t, fmt.Sprintf("%d-49", key), string(item.Value.([]byte)))
+	}
+	for i, value := range held {
+		require.Equal(t, fmt.Sprintf("%d-%d", i%10, i/10), string(value))
+	}
+	require.True(t, len(m.shards[0].arena) < 10*len(held))
+
+	// The values handed out can't be appended to in place.
+	item, _ := m.Get(0)
+	_ = append(item.Value.([]byte), 'x')
+	item, _ = m.Get(1)
+	require.Equal(t, "1-49", string(item.Value.([]byte)))
+
+	m.Del(0)
+	require.Equal(t, 9, m.Len())
+	n := 0
+	m.Range(func(MapItem) bool {
+		n++
+		return true
+	})
+	require.Equal(t, 9, n)
+}
+
+// BenchmarkStoreEncodedGC reports how long a garbage collection takes with the
+// store full of values, as they are, encoded or off the heap. The 10M entries
+// case is skipped with -short.
+func BenchmarkStoreEncodedGC(b *testing.B) {
+	for _, entries := range []int{1e5, 1e6, 1e7} {
+		for _, layout := range []struct {
+			name  string
+			store func() store
+		}{
+			{"interface", newStore},
+			{"encoded", func() store {
+				return newCodecStore(newMapStore(newArenaMap(defaultShards()), systemClock{}, nil),
+					encodeTestValue, decodeTestValue)
+			}},
+			{"offheap", func() store {
+				return newCodecStore(newMapStore(newSlabMap(slabShards()), systemClock{}, nil),
+					encodeTestValue, decodeTestValue)
+			}},
+		} {
+			b.Run(fmt.Sprintf("entries=%d/%s", entries, layout.name), func(b *testing.B) {
+				if entries > 1e6 && testing.Short() {
+					b.Skip("skipping the 10M entries case in short mode")
+				}
+				s := layout.store()
+				for key := 0; key < entries; key++ {
+					value := "value-" + strconv.Itoa(key)
+					data, _ := encodeTestValue(value)
+					s.Set(&Item{Key: uint64(key), Value: value, encoded: data})
+				}
+				runtime.GC()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					runtime.GC()
+				}
+				b.StopTimer()
+				runtime.KeepAlive(s)
+			})
+		}
+	}
+}
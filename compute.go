@@ -0,0 +1,291 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLoaderPanicked is returned by GetOrCompute to the callers that were
+// waiting on a loader that panicked. The caller that started the load gets the
+// panic.
+var ErrLoaderPanicked = errors.New("ristretto: loader panicked")
+
+// call is a GetOrCompute load in flight. Its fields are set before done is
+// closed.
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+	// panic holds what the loader panicked with, if it did.
+	panic    interface{}
+	panicked bool
+	// refresh is set for the background load of a stale value.
+	refresh bool
+	// waiters is the number of callers waiting for the load, guarded by the
+	// lock of calls. The last one to stop waiting before the load is done
+	// removes the call and cancels its loader.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+type callKey struct {
+	key, conflict uint64
+}
+
+// calls keeps track of the loads in flight, so that there's at most one per
+// key. A call is removed as soon as its load is done or nobody waits for it
+// anymore, so that keys requested once don't pile up.
+type calls struct {
+	sync.Mutex
+	m map[callKey]*call
+	// metrics, if set, counts the calls in flight.
+	metrics *Metrics
+}
+
+func newCalls() *calls {
+	return &calls{m: make(map[callKey]*call)}
+}
+
+// add registers the call of the key. The lock has to be held.
+func (cs *calls) add(k callKey, cl *call) {
+	cs.m[k] = cl
+	if cs.metrics != nil {
+		atomic.AddInt64(&cs.metrics.loadsInFlight, 1)
+	}
+}
+
+// remove removes the call of the key, unless it's been replaced by a newer
+// one. The lock has to be held.
+func (cs *calls) remove(k callKey, cl *call) {
+	if cs.m[k] != cl {
+		return
+	}
+	delete(cs.m, k)
+	if cs.metrics != nil {
+		atomic.AddInt64(&cs.metrics.loadsInFlight, -1)
+	}
+}
+
+// leave stops counting a caller among the waiters of the call of the key. If
+// it was the last one, and the load isn't a refresh, the call is removed and
+// its loader cancelled: the next caller starts a load of its own.
+func (cs *calls) leave(k callKey, cl *call) {
+	cs.Lock()
+	defer cs.Unlock()
+	cl.waiters--
+	if cl.waiters > 0 || cl.refresh {
+		return
+	}
+	cs.remove(k, cl)
+	cl.cancel()
+}
+
+// GetOrCompute returns the value of the key if it's in the cache. Otherwise it
+// calls loader, Sets the value it returns along with its cost, and returns the
+// value. Concurrent calls for the same key share a single call to loader:
+// all of them wait for it and get the same value or error. The errors of
+// loader are returned as a *LoadError. They aren't cached, so the next call
+// after a failed load tries again.
+//
+// The value is Set with SetIfAbsent, so it still has to be admitted by the
+// policy, and GetOrCompute returns once it's been decided. A nil key, or a
+// closed cache, skips the cache and only calls loader. With Config.FreshFor,
+// stale values are returned while loader replaces them in the background.
+func (c *Cache) GetOrCompute(key interface{},
+	loader func() (value interface{}, cost int64, err error)) (interface{}, error) {
+	return c.GetOrComputeCtx(context.Background(), key,
+		func(context.Context) (interface{}, int64, error) {
+			return loader()
+		})
+}
+
+// GetOrComputeCtx works like GetOrCompute, but any caller can stop waiting for
+// the load by cancelling its ctx, in which case it gets ctx.Err() while the
+// load goes on for the others. The loader runs in its own goroutine with a
+// context carrying the values of the ctx of the call that started the load,
+// but neither its deadline nor its cancellation, so that an impatient caller
+// can't fail the load for everyone; loaders have to bound their own run time.
+// Set Config.PropagateLoaderCancel to pass that ctx to the loader as is
+// instead. Once every caller has stopped waiting, the load is forgotten and
+// the context of its loader cancelled either way, so the next call for the key
+// starts a new load.
+//
+// If the loader panics, the call that started the load panics with the same
+// value, unless it stopped waiting, and the others get ErrLoaderPanicked.
+func (c *Cache) GetOrComputeCtx(ctx context.Context, key interface{},
+	loader func(ctx context.Context) (value interface{}, cost int64, err error)) (interface{}, error) {
+	if c == nil || c.isClosed() || key == nil {
+		value, _, err := loader(ctx)
+		return value, loadError(key, err)
+	}
+	if c.tracer != nil {
+		end := c.tracer.Start("get", traceKey(key, 0))
+		value, hit, err := c.getOrCompute(ctx, key, loader)
+		end(hit, err)
+		return value, err
+	}
+	value, _, err := c.getOrCompute(ctx, key, loader)
+	return value, err
+}
+
+// getOrCompute implements GetOrComputeCtx for a key that isn't nil, telling
+// whether the value was found in the cache.
+func (c *Cache) getOrCompute(ctx context.Context, key interface{},
+	loader func(context.Context) (interface{}, int64, error)) (interface{}, bool, error) {
+	keyHash, conflictHash := c.keyToHash(key)
+	if value, ok := c.getKey(key, keyHash, conflictHash); ok {
+		if c.freshFor > 0 {
+			c.revalidate(ctx, key, loader)
+		}
+		return value, true, nil
+	}
+	k := callKey{keyHash, conflictHash}
+
+	c.calls.Lock()
+	cl, ok := c.calls.m[k]
+	owner := !ok
+	if owner {
+		// A load may have completed since the Get above.
+		if value, ok := c.store.Get(keyHash, conflictHash); ok && value != Negative {
+			c.calls.Unlock()
+			return value, true, nil
+		}
+		var loadCtx context.Context = detachedContext{ctx}
+		if c.propagateLoaderCancel {
+			loadCtx = ctx
+		}
+		cl = &call{done: make(chan struct{})}
+		loadCtx, cl.cancel = context.WithCancel(loadCtx)
+		c.calls.add(k, cl)
+		go c.load(loadCtx, key, k, cl, loader)
+	}
+	cl.waiters++
+	c.calls.Unlock()
+
+	select {
+	case <-cl.done:
+		if owner && cl.panicked {
+			panic(cl.panic)
+		}
+		return cl.value, false, cl.err
+	case <-ctx.Done():
+		c.calls.leave(k, cl)
+		return nil, false, ctx.Err()
+	}
+}
+
+// revalidate starts a background load of the value of the key if it's stale
+// and there's no load of it in flight already. The load gets a context
+// detached from ctx, as no caller waits for it.
+func (c *Cache) revalidate(ctx context.Context, key interface{},
+	loader func(context.Context) (interface{}, int64, error)) {
+	keyHash, conflictHash := c.keyToHash(key)
+	expiration := c.store.Expiration(keyHash)
+	if expiration == 0 {
+		return
+	}
+	staleAt := time.Unix(expiration, 0).Add(c.freshFor - c.staleFor)
+	if c.clock.Now().Before(staleAt) {
+		return
+	}
+	k := callKey{keyHash, conflictHash}
+	c.calls.Lock()
+	if _, ok := c.calls.m[k]; ok {
+		c.calls.Unlock()
+		return
+	}
+	cl := &call{done: make(chan struct{}), refresh: true}
+	loadCtx, cancel := context.WithCancel(detachedContext{ctx})
+	cl.cancel = cancel
+	c.calls.add(k, cl)
+	c.calls.Unlock()
+	go c.load(loadCtx, key, k, cl, loader)
+}
+
+// loadedExpiration returns the expiration time of a value loaded now.
+func (c *Cache) loadedExpiration() int64 {
+	if c.freshFor == 0 {
+		return c.defaultExpiration()
+	}
+	return c.clock.Now().Add(c.staleFor).Unix()
+}
+
+// load runs loader for the call cl and Sets its value. The call is removed,
+// unless its waiters already did, and they're released even if loader
+// panics. A refresh replaces the
+// stale value, or leaves it if loader fails or panics.
+func (c *Cache) load(ctx context.Context, key interface{}, k callKey, cl *call,
+	loader func(context.Context) (interface{}, int64, error)) {
+	var end func(bool, error)
+	if c.tracer != nil {
+		end = c.tracer.Start("load", traceKey(key, k.key))
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			cl.value, cl.err = nil, ErrLoaderPanicked
+			cl.panic, cl.panicked = r, true
+		}
+		if end != nil {
+			// End the load before releasing the callers waiting for it.
+			end(cl.err == nil, cl.err)
+		}
+		if cl.refresh && cl.err != nil {
+			c.Metrics.add(refreshErrors, k.key, 1)
+		}
+		c.calls.Lock()
+		c.calls.remove(k, cl)
+		c.calls.Unlock()
+		cl.cancel()
+		close(cl.done)
+	}()
+	value, cost, err := loader(ctx)
+	cl.value, cl.err = value, loadError(key, err)
+	switch {
+	case err != nil:
+	case cl.refresh:
+		c.SetWithTTL(key, value, cost, c.staleFor)
+	default:
+		c.setIfAbsent(key, value, cost, c.loadedExpiration())
+	}
+}
+
+// loadError returns the error of a loader of the key as a LoadError, if any.
+func loadError(key interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &LoadError{Key: key, Err: err}
+}
+
+// detachedContext carries the values of a context, but not its deadline or
+// cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,506 @@
+package ristretto
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newComputeCache(t *testing.T) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+// computeConcurrently calls GetOrCompute for key from n goroutines while
+// loader blocks on release, and returns the results once they're all done.
+func computeConcurrently(c *Cache, key int, n int, release chan struct{},
+	loader func() (interface{}, int64, error)) ([]interface{}, []error) {
+	values := make([]interface{}, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				// The goroutine that runs a panicking loader panics too.
+				if r := recover(); r != nil {
+					errs[i] = ErrLoaderPanicked
+				}
+			}()
+			values[i], errs[i] = c.GetOrCompute(key, loader)
+		}(i)
+	}
+	time.Sleep(wait)
+	close(release)
+	wg.Wait()
+	return values, errs
+}
+
+func TestCacheGetOrCompute(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	var loads int32
+	release := make(chan struct{})
+	values, errs := computeConcurrently(c, 1, 100, release, func() (interface{}, int64, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return "a", 1, nil
+	})
+	require.Equal(t, int32(1), loads)
+	for i := range values {
+		require.NoError(t, errs[i])
+		require.Equal(t, "a", values[i])
+	}
+	require.Empty(t, c.calls.m)
+
+	// The value was Set, so the loader isn't needed anymore.
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	val, err := c.GetOrCompute(1, func() (interface{}, int64, error) {
+		t.Fatal("loader called for a cached key")
+		return nil, 0, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "a", val)
+}
+
+func TestCacheGetOrComputeError(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	var loads int32
+	errLoad := errors.New("load failed")
+	release := make(chan struct{})
+	_, errs := computeConcurrently(c, 1, 10, release, func() (interface{}, int64, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return nil, 0, errLoad
+	})
+	require.Equal(t, int32(1), loads)
+	for _, err := range errs {
+		var le *LoadError
+		require.True(t, errors.As(err, &le))
+		require.Equal(t, 1, le.Key)
+		require.Equal(t, errLoad, le.Err)
+		require.True(t, errors.Is(err, errLoad))
+	}
+	require.Empty(t, c.calls.m)
+	_, ok := c.Get(1)
+	require.False(t, ok)
+
+	// Errors aren't cached.
+	val, err := c.GetOrCompute(1, func() (interface{}, int64, error) {
+		return "b", 1, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "b", val)
+}
+
+func TestCacheGetOrComputePanic(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	release := make(chan struct{})
+	_, errs := computeConcurrently(c, 1, 10, release, func() (interface{}, int64, error) {
+		<-release
+		panic("boom")
+	})
+	for _, err := range errs {
+		require.Equal(t, ErrLoaderPanicked, err)
+	}
+	require.Empty(t, c.calls.m)
+
+	require.Panics(t, func() {
+		c.GetOrCompute(2, func() (interface{}, int64, error) {
+			panic("boom")
+		})
+	})
+	require.Empty(t, c.calls.m)
+}
+
+func TestCacheGetOrComputeClosed(t *testing.T) {
+	c := newComputeCache(t)
+	c.Close()
+	val, err := c.GetOrCompute(1, func() (interface{}, int64, error) {
+		return "a", 1, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "a", val)
+}
+
+type ctxKey struct{}
+
+func TestCacheGetOrComputeCtxCancelledWaiter(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	release := make(chan struct{})
+	loaded := make(chan interface{}, 1)
+	go func() {
+		val, err := c.GetOrComputeCtx(context.Background(), 1,
+			func(context.Context) (interface{}, int64, error) {
+				<-release
+				return "a", 1, nil
+			})
+		require.NoError(t, err)
+		loaded <- val
+	}()
+	time.Sleep(wait)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.GetOrComputeCtx(ctx, 1, func(context.Context) (interface{}, int64, error) {
+		t.Fatal("loader called while a load is in flight")
+		return nil, 0, nil
+	})
+	require.Equal(t, context.Canceled, err)
+
+	// The shared load isn't affected.
+	close(release)
+	require.Equal(t, "a", <-loaded)
+}
+
+func TestCacheGetOrComputeCtxCancelledOwner(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	release := make(chan struct{})
+	var loaderErr error
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "v"))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.GetOrComputeCtx(ctx, 1, func(ctx context.Context) (interface{}, int64, error) {
+			<-release
+			require.Equal(t, "v", ctx.Value(ctxKey{}))
+			loaderErr = ctx.Err()
+			return "a", 1, nil
+		})
+		// The loader fails with the cancellation, unless the caller sees it
+		// first.
+		require.True(t, errors.Is(err, context.Canceled))
+	}()
+	time.Sleep(wait)
+
+	waiter := make(chan interface{})
+	go func() {
+		val, err := c.GetOrComputeCtx(context.Background(), 1,
+			func(context.Context) (interface{}, int64, error) {
+				return "b", 1, nil
+			})
+		require.NoError(t, err)
+		waiter <- val
+	}()
+	time.Sleep(wait)
+	cancel()
+	<-done
+
+	// The loader doesn't see the cancellation, and the waiter gets its value.
+	close(release)
+	require.Equal(t, "a", <-waiter)
+	require.NoError(t, loaderErr)
+}
+
+func TestCacheGetOrComputeCtxPropagate(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:           1000,
+		MaxCost:               100,
+		BufferItems:           64,
+		PropagateLoaderCancel: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.GetOrComputeCtx(ctx, 1, func(ctx context.Context) (interface{}, int64, error) {
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		})
+		// The loader fails with the cancellation, unless the caller sees it
+		// first.
+		require.True(t, errors.Is(err, context.Canceled))
+	}()
+	time.Sleep(wait)
+
+	// The cancellation of the caller that started the load fails it for
+	// everyone.
+	waiter := make(chan error)
+	go func() {
+		_, err := c.GetOrComputeCtx(context.Background(), 1,
+			func(context.Context) (interface{}, int64, error) {
+				return "b", 1, nil
+			})
+		waiter <- err
+	}()
+	time.Sleep(wait)
+	cancel()
+	<-done
+	require.True(t, errors.Is(<-waiter, context.Canceled))
+}
+
+func TestCacheGetOrComputeCtxPanicAfterOwnerLeft(t *testing.T) {
+	c := newComputeCache(t)
+	defer c.Close()
+
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := c.GetOrComputeCtx(ctx, 1, func(context.Context) (interface{}, int64, error) {
+		<-release
+		panic("boom")
+	})
+	require.Equal(t, context.Canceled, err)
+
+	// Nobody waits for the load anymore, so the next call starts its own.
+	require.Empty(t, c.calls.m)
+	val, err := c.GetOrComputeCtx(context.Background(), 1,
+		func(context.Context) (interface{}, int64, error) {
+			return "b", 1, nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, "b", val)
+	// Nobody is left to panic, and the process keeps running.
+	close(release)
+	time.Sleep(wait)
+	require.Empty(t, c.calls.m)
+}
+
+func TestCacheGetOrComputeCtxAllWaitersLeft(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 1000,
+		MaxCost:     100,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	loaderDone := make(chan error, 1)
+	release := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := c.GetOrComputeCtx(ctx, 1, func(ctx context.Context) (interface{}, int64, error) {
+				<-ctx.Done()
+				<-release
+				loaderDone <- ctx.Err()
+				return "a", 1, ctx.Err()
+			})
+			errs <- err
+		}()
+	}
+	time.Sleep(wait)
+	require.Equal(t, int64(1), c.Metrics.LoadsInFlight())
+	cancel()
+	require.Equal(t, context.Canceled, <-errs)
+	require.Equal(t, context.Canceled, <-errs)
+	// The last waiter removed the call, and cancelled its loader.
+	require.Empty(t, c.calls.m)
+	require.Zero(t, c.Metrics.LoadsInFlight())
+
+	// The key is requested again before the first load is done: the new load
+	// isn't removed by the old one.
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	loaded := make(chan interface{})
+	go func() {
+		val, err := c.GetOrCompute(1, func() (interface{}, int64, error) {
+			close(started)
+			<-finish
+			return "b", 1, nil
+		})
+		require.NoError(t, err)
+		loaded <- val
+	}()
+	<-started
+	close(release)
+	require.Equal(t, context.Canceled, <-loaderDone)
+	time.Sleep(wait)
+	c.calls.Lock()
+	require.Len(t, c.calls.m, 1)
+	c.calls.Unlock()
+	require.Equal(t, int64(1), c.Metrics.LoadsInFlight())
+	close(finish)
+	require.Equal(t, "b", <-loaded)
+	require.Empty(t, c.calls.m)
+	require.Zero(t, c.Metrics.LoadsInFlight())
+}
+
+func TestCacheGetOrComputeChurn(t *testing.T) {
+	n := 1 << 20
+	if testing.Short() {
+		n = 1 << 14
+	}
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	goroutines := runtime.NumGoroutine()
+
+	// Every key is requested once, from one of the workers, and its load
+	// returns a value, fails, panics or is given up on.
+	var wg sync.WaitGroup
+	workers := 8
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				i := i
+				compute := func(ctx context.Context) {
+					defer func() { recover() }()
+					c.GetOrComputeCtx(ctx, i, func(ctx context.Context) (interface{}, int64, error) {
+						switch i % 4 {
+						case 1:
+							return nil, 0, errors.New("load failed")
+						case 2:
+							panic("boom")
+						case 3:
+							<-ctx.Done()
+							return nil, 0, ctx.Err()
+						}
+						return i, 1, nil
+					})
+				}
+				if i%4 == 3 {
+					ctx, cancel := context.WithCancel(context.Background())
+					cancel()
+					compute(ctx)
+				} else {
+					compute(context.Background())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		c.calls.Lock()
+		left := len(c.calls.m)
+		c.calls.Unlock()
+		if left == 0 && c.Metrics.LoadsInFlight() == 0 && runtime.NumGoroutine() <= goroutines {
+			break
+		}
+		require.True(t, time.Since(start) < 5*time.Second,
+			"%d calls, %d loads in flight and %d goroutines left, started with %d",
+			left, c.Metrics.LoadsInFlight(), runtime.NumGoroutine(), goroutines)
+	}
+}
+
+func TestCacheGetOrComputeStale(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+		FreshFor:           10 * time.Second,
+		StaleFor:           time.Minute,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	// refreshed waits for the background refresh to be done.
+	refreshed := func() {
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			c.calls.Lock()
+			n := len(c.calls.m)
+			c.calls.Unlock()
+			if n == 0 {
+				break
+			}
+			require.True(t, time.Since(start) < time.Second, "refresh didn't finish")
+		}
+		c.Wait()
+	}
+
+	var loads int32
+	load := func(value string, err error) func() (interface{}, int64, error) {
+		return func() (interface{}, int64, error) {
+			atomic.AddInt32(&loads, 1)
+			return value, 1, err
+		}
+	}
+	val, err := c.GetOrCompute(1, load("a", nil))
+	require.NoError(t, err)
+	require.Equal(t, "a", val)
+	ttl, _ := c.GetTTL(1)
+	require.Equal(t, time.Minute, ttl)
+
+	// Fresh values are returned as is.
+	clock.Add(5 * time.Second)
+	val, err = c.GetOrCompute(1, load("b", nil))
+	require.NoError(t, err)
+	require.Equal(t, "a", val)
+	require.Equal(t, int32(1), atomic.LoadInt32(&loads))
+
+	// Stale ones too, while a single load replaces them.
+	clock.Add(10 * time.Second)
+	release := make(chan struct{})
+	values, errs := computeConcurrently(c, 1, 100, release, func() (interface{}, int64, error) {
+		<-release
+		return load("b", nil)()
+	})
+	for i := range values {
+		require.NoError(t, errs[i])
+		require.Equal(t, "a", values[i])
+	}
+	refreshed()
+	require.Equal(t, int32(2), atomic.LoadInt32(&loads))
+	val, _ = c.Get(1)
+	require.Equal(t, "b", val)
+
+	// A failed refresh leaves the stale value.
+	clock.Add(15 * time.Second)
+	val, err = c.GetOrCompute(1, load("", errors.New("origin down")))
+	require.NoError(t, err)
+	require.Equal(t, "b", val)
+	refreshed()
+	val, _ = c.Get(1)
+	require.Equal(t, "b", val)
+	require.Equal(t, uint64(1), c.Metrics.RefreshErrors())
+
+	// Past StaleFor, callers wait for the load.
+	clock.Add(time.Minute)
+	val, err = c.GetOrCompute(1, load("c", nil))
+	require.NoError(t, err)
+	require.Equal(t, "c", val)
+	require.Equal(t, int32(4), atomic.LoadInt32(&loads))
+}
+
+func TestCacheGetOrComputeStaleConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{FreshFor: -time.Second},
+		{StaleFor: time.Second},
+		{FreshFor: time.Second, StaleFor: time.Second},
+	} {
+		config.NumCounters, config.MaxCost, config.BufferItems = 100, 10, 64
+		_, err := NewCache(config)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Cloner is implemented by values that can be copied by Config.CopyOnRead and
+// GetCopy. Clone returns a copy the caller can change without touching the
+// cached value.
+type Cloner interface {
+	Clone() interface{}
+}
+
+const (
+	// copyMinShift and copyMaxShift bound the size classes of the buffers
+	// pooled for the copies of []byte values, from 64 bytes to 64KB. Larger
+	// values are copied to buffers of their own.
+	copyMinShift = 6
+	copyMaxShift = 16
+)
+
+// copyPools holds the buffers of every size class, along with a pool of the
+// empty holders of the buffers, so that putting a buffer back doesn't
+// allocate.
+var copyPools struct {
+	classes [copyMaxShift - copyMinShift + 1]sync.Pool
+	holders sync.Pool
+}
+
+// copyClass returns the size class of a buffer of n bytes, and false if it's
+// too large to be pooled.
+func copyClass(n int) (int, bool) {
+	if n <= 1<<copyMinShift {
+		return 0, true
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > copyMaxShift {
+		return 0, false
+	}
+	return shift - copyMinShift, true
+}
+
+// copyBytes returns a copy of b, in a pooled buffer if it's small enough.
+func copyBytes(b []byte) []byte {
+	class, ok := copyClass(len(b))
+	var buf []byte
+	if !ok {
+		buf = make([]byte, len(b))
+		copy(buf, b)
+		return buf
+	}
+	if h, _ := copyPools.classes[class].Get().(*[]byte); h != nil {
+		buf = *h
+		*h = nil
+		copyPools.holders.Put(h)
+	} else {
+		buf = make([]byte, 1<<uint(class+copyMinShift))
+	}
+	buf = buf[:len(b)]
+	copy(buf, b)
+	return buf
+}
+
+// Release gives back a []byte returned by a Get with Config.CopyOnRead, or by
+// GetCopy, for later copies to reuse. The caller must not use b afterwards.
+// Buffers that weren't handed out by the cache are ignored, as long as their
+// capacity isn't one of its size classes, so releasing is optional.
+func (c *Cache) Release(b []byte) {
+	n := cap(b)
+	class, ok := copyClass(n)
+	if !ok || n != 1<<uint(class+copyMinShift) {
+		return
+	}
+	h, _ := copyPools.holders.Get().(*[]byte)
+	if h == nil {
+		h = new([]byte)
+	}
+	*h = b[:n]
+	copyPools.classes[class].Put(h)
+}
+
+// copyValue returns a copy of a []byte or Cloner value, counting the bytes
+// copied, and any other value as it is.
+func (c *Cache) copyValue(keyHash uint64, value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		c.Metrics.add(bytesCopied, keyHash, uint64(len(v)))
+		return copyBytes(v)
+	case Cloner:
+		return v.Clone()
+	}
+	return value
+}
+
+// readValue returns the value read from the cache for a Get, copied if
+// Config.CopyOnRead is set.
+func (c *Cache) readValue(keyHash uint64, value interface{}) interface{} {
+	if !c.copyOnRead {
+		return value
+	}
+	return c.copyValue(keyHash, value)
+}
+
+// GetCopy works like Get, but returns a copy of a []byte or Cloner value
+// whether or not Config.CopyOnRead is set. Pass the []byte copies to Release
+// once done with them.
+func (c *Cache) GetCopy(key interface{}) (interface{}, bool) {
+	value, ok := c.Get(key)
+	if !ok || c.copyOnRead {
+		return value, ok
+	}
+	return c.copyValue(0, value), true
+}
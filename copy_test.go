@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// clonedValue is a Cloner counting its clones.
+type clonedValue struct {
+	n      int
+	clones *int
+}
+
+func (v *clonedValue) Clone() interface{} {
+	*v.clones++
+	return &clonedValue{n: v.n, clones: v.clones}
+}
+
+func TestCacheCopyOnRead(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		CopyOnRead:         true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var clones int
+	require.True(t, c.Set(1, []byte("abc"), 1))
+	require.True(t, c.Set(2, &clonedValue{n: 2, clones: &clones}, 1))
+	require.True(t, c.Set(3, "str", 1))
+	c.Wait()
+
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	b := val.([]byte)
+	b[0] = 'x'
+	val, _ = c.Get(1)
+	require.Equal(t, []byte("abc"), val)
+	require.Equal(t, uint64(6), c.Metrics.BytesCopied())
+
+	val, ok = c.Get(2)
+	require.True(t, ok)
+	val.(*clonedValue).n = 3
+	val, _ = c.Get(2)
+	require.Equal(t, 2, val.(*clonedValue).n)
+	require.Equal(t, 2, clones)
+
+	val, ok = c.Get(3)
+	require.True(t, ok)
+	require.Equal(t, "str", val)
+
+	// A released buffer is reused by a later copy. The pool may drop it, so
+	// this only checks that reusing it doesn't corrupt the values.
+	c.Release(b)
+	c.Release(nil)
+	c.Release(make([]byte, 3))
+	val, _ = c.Get(1)
+	require.Equal(t, []byte("abc"), val)
+	require.Equal(t, 64, cap(val.([]byte)))
+}
+
+func TestCacheGetCopy(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1 << 20,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	large := make([]byte, 100<<10)
+	require.True(t, c.Set(1, []byte("abc"), 1))
+	require.True(t, c.Set(2, large, 1))
+	c.Wait()
+
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	copied, ok := c.GetCopy(1)
+	require.True(t, ok)
+	copied.([]byte)[0] = 'x'
+	require.Equal(t, []byte("abc"), val)
+	_, ok = c.GetCopy(3)
+	require.False(t, ok)
+
+	// Values larger than the largest size class get a buffer of their own.
+	copied, _ = c.GetCopy(2)
+	require.Len(t, copied, len(large))
+	require.Equal(t, len(large), cap(copied.([]byte)))
+	require.Equal(t, uint64(3+len(large)), c.Metrics.BytesCopied())
+}
+
+func TestCopyClass(t *testing.T) {
+	for _, tc := range []struct {
+		n, class int
+		ok       bool
+	}{
+		{0, 0, true},
+		{64, 0, true},
+		{65, 1, true},
+		{128, 1, true},
+		{1000, 4, true},
+		{64 << 10, 10, true},
+		{64<<10 + 1, 0, false},
+	} {
+		class, ok := copyClass(tc.n)
+		require.Equal(t, tc.ok, ok, "n=%d", tc.n)
+		require.Equal(t, tc.class, class, "n=%d", tc.n)
+	}
+}
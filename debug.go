@@ -0,0 +1,270 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// debugTopKeys is the number of hot keys DebugHandler lists by default.
+	debugTopKeys = 10
+	// debugKeysLimit and debugKeysMaxLimit are the default and largest
+	// number of keys in a page of the listing of DebugHandler.
+	debugKeysLimit    = 100
+	debugKeysMaxLimit = 1000
+)
+
+// debugInfo is the response of DebugHandler. The field names are part of the
+// API of the handler, and don't change.
+type debugInfo struct {
+	Metrics *Metrics      `json:"metrics"`
+	Policy  debugPolicy   `json:"policy"`
+	Buffers debugBuffers  `json:"buffers"`
+	TopKeys []debugHotKey `json:"top_keys"`
+	Keys    *debugKeys    `json:"keys,omitempty"`
+	// Latency is only served with Config.SampleLatency, by phase name.
+	Latency map[string]debugLatency `json:"latency,omitempty"`
+}
+
+type debugPolicy struct {
+	Name           string       `json:"name"`
+	MaxCost        int64        `json:"max_cost"`
+	UsedCost       int64        `json:"used_cost"`
+	MaxEntries     int64        `json:"max_entries"`
+	Len            int          `json:"len"`
+	SketchCounters int64        `json:"sketch_counters"`
+	WindowRatio    float64      `json:"window_ratio"`
+	Params         ConfigParams `json:"params"`
+}
+
+type debugBuffers struct {
+	SetBufferLen      int    `json:"set_buffer_len"`
+	SetBufferCap      int    `json:"set_buffer_cap"`
+	GetBatchesPending int    `json:"get_batches_pending"`
+	GetBatchesCap     int    `json:"get_batches_cap"`
+	SetsDropped       uint64 `json:"sets_dropped"`
+	GetsDropped       uint64 `json:"gets_dropped"`
+	GetsKept          uint64 `json:"gets_kept"`
+	CallbacksDropped  uint64 `json:"callbacks_dropped"`
+	EventsDropped     uint64 `json:"events_dropped"`
+	// The fill of the stripes of the Get buffer, if lossless, and what went
+	// through it, from BufferStats.
+	GetStripes []int  `json:"get_stripes,omitempty"`
+	GetPushes  uint64 `json:"get_pushes"`
+	GetDrains  uint64 `json:"get_drains"`
+	GetDrops   uint64 `json:"get_drops"`
+}
+
+// debugLatency is the distribution of the durations of a phase, in
+// nanoseconds.
+type debugLatency struct {
+	Count uint64 `json:"count"`
+	Mean  int64  `json:"mean_ns"`
+	P50   int64  `json:"p50_ns"`
+	P90   int64  `json:"p90_ns"`
+	P99   int64  `json:"p99_ns"`
+	Max   int64  `json:"max_ns"`
+}
+
+type debugHotKey struct {
+	Key       uint64 `json:"key"`
+	Frequency int64  `json:"frequency"`
+	Cost      int64  `json:"cost"`
+}
+
+// debugKey is a key of the listing of DebugHandler. TTLSeconds is 0 for keys
+// that never expire.
+type debugKey struct {
+	Key        uint64  `json:"key"`
+	Cost       int64   `json:"cost"`
+	TTLSeconds float64 `json:"ttl_seconds"`
+}
+
+type debugKeys struct {
+	Total      int        `json:"total"`
+	Offset     int        `json:"offset"`
+	NextOffset int        `json:"next_offset,omitempty"`
+	Items      []debugKey `json:"items"`
+}
+
+// debugParams returns the parameters of the config for DebugHandler, with the
+// policy named "custom" if it isn't registered.
+func debugParams(config *Config) ConfigParams {
+	p, err := config.Params()
+	if err != nil {
+		copyParams(reflect.ValueOf(&p).Elem(), reflect.ValueOf(config).Elem())
+		p.Policy = "custom"
+	}
+	return p
+}
+
+// DebugHandler returns a handler serving what's going on inside the cache as
+// a JSON object, meant to be mounted under a path such as /debug/cache. It
+// holds the metrics, or null if Config.Metrics isn't set, the policy and the
+// parameters of the config, how full the buffers are along with the counts of
+// what they dropped, the hottest keys as told by TopKeys, and the latencies of
+// Metrics.Latency if Config.SampleLatency is set.
+//
+// The query parameter top sets the number of hot keys, 10 by default. With
+// keys=true, the response also lists the keys in the cache, by hash, with
+// their cost and TTL, a page of limit keys (100 by default, up to 1000)
+// starting at offset at a time. Listing the keys goes over the whole cache,
+// like Range, and TopKeys over the whole policy while holding its lock, so
+// neither should be requested often on a busy cache. Nothing served is
+// recorded as a Get. The handler of a nil cache serves null.
+func (c *Cache) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("null"))
+			return
+		}
+		query := r.URL.Query()
+		top, err := queryInt(query.Get("top"), debugTopKeys)
+		if err != nil || top < 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		info := c.debugInfo(top)
+		if list := query.Get("keys"); list != "" {
+			ok, err := strconv.ParseBool(list)
+			if err != nil {
+				http.Error(w, "invalid keys", http.StatusBadRequest)
+				return
+			}
+			offset, err := queryInt(query.Get("offset"), 0)
+			if err != nil || offset < 0 {
+				http.Error(w, "invalid offset", http.StatusBadRequest)
+				return
+			}
+			limit, err := queryInt(query.Get("limit"), debugKeysLimit)
+			if err != nil || limit <= 0 || limit > debugKeysMaxLimit {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			if ok {
+				info.Keys = c.debugKeys(offset, limit)
+			}
+		}
+		body, err := json.Marshal(info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+// queryInt parses the value of a query parameter, or returns def if it's
+// empty.
+func queryInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+func (c *Cache) debugInfo(top int) *debugInfo {
+	info := &debugInfo{
+		Metrics: c.Metrics,
+		Policy: debugPolicy{
+			Name:           c.params.Policy,
+			MaxCost:        c.MaxCost(),
+			UsedCost:       c.UsedCost(),
+			MaxEntries:     c.MaxEntries(),
+			Len:            c.Len(),
+			SketchCounters: c.SketchCounters(),
+			WindowRatio:    c.WindowRatio(),
+			Params:         c.params,
+		},
+		Buffers: debugBuffers{
+			SetBufferLen:     len(c.setBuf),
+			SetBufferCap:     cap(c.setBuf),
+			SetsDropped:      c.Metrics.get(dropSets),
+			GetsDropped:      c.Metrics.get(dropGets),
+			GetsKept:         c.Metrics.get(keepGets),
+			CallbacksDropped: c.Metrics.get(dropCallbacks),
+			EventsDropped:    c.Metrics.get(dropEvents),
+		},
+		TopKeys: []debugHotKey{},
+	}
+	if info.Policy.Name == "" {
+		info.Policy.Name = defaultPolicyName
+	}
+	info.Buffers.GetBatchesPending, info.Buffers.GetBatchesCap = c.policy.Pending()
+	stats := c.getBuf.stats()
+	info.Buffers.GetStripes = stats.Stripes
+	info.Buffers.GetPushes, info.Buffers.GetDrains, info.Buffers.GetDrops =
+		stats.Pushes, stats.Drains, stats.Drops
+	if c.latency != nil {
+		info.Latency = make(map[string]debugLatency)
+		for phase := LatencyPhase(0); phase < numLatencyPhases; phase++ {
+			hist := c.Metrics.Latency(phase)
+			info.Latency[phase.String()] = debugLatency{
+				Count: hist.Count,
+				Mean:  int64(hist.Mean()),
+				P50:   int64(hist.Percentile(50)),
+				P90:   int64(hist.Percentile(90)),
+				P99:   int64(hist.Percentile(99)),
+				Max:   int64(hist.Max),
+			}
+		}
+	}
+	for _, k := range c.TopKeys(top) {
+		info.TopKeys = append(info.TopKeys, debugHotKey{
+			Key:       k.Key,
+			Frequency: k.Frequency,
+			Cost:      k.Cost - c.internalCost,
+		})
+	}
+	return info
+}
+
+// debugKeys returns the page of the keys in the cache, sorted by hash, of at
+// most limit keys starting at offset.
+func (c *Cache) debugKeys(offset, limit int) *debugKeys {
+	now := c.clock.Now()
+	var all []debugKey
+	c.Range(func(item *Item) bool {
+		k := debugKey{Key: item.Key, Cost: item.Cost}
+		if item.Expiration != 0 {
+			k.TTLSeconds = time.Unix(item.Expiration, 0).Sub(now).Seconds()
+		}
+		all = append(all, k)
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+	keys := &debugKeys{Total: len(all), Offset: offset, Items: []debugKey{}}
+	if offset >= len(all) {
+		return keys
+	}
+	end := offset + limit
+	if end < len(all) {
+		keys.NextOffset = end
+	} else {
+		end = len(all)
+	}
+	keys.Items = append(keys.Items, all[offset:end]...)
+	return keys
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func debugGet(t *testing.T, c *Cache, url string, code int) map[string]interface{} {
+	rec := httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+	require.Equal(t, code, rec.Code, rec.Body.String())
+	if code != 200 {
+		return nil
+	}
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	return body
+}
+
+func TestCacheDebugHandler(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		require.True(t, c.SetWithTTL(i, i, int64(i+1), time.Duration(i)*time.Minute))
+	}
+	c.Wait()
+	for i := 0; i < 3; i++ {
+		c.Get(4)
+	}
+	c.Flush()
+	hits := c.Metrics.Hits()
+
+	body := debugGet(t, c, "/debug/cache", 200)
+	require.Equal(t, float64(hits), body["metrics"].(map[string]interface{})["hits"])
+	policy := body["policy"].(map[string]interface{})
+	require.Equal(t, "tinylfu", policy["name"])
+	require.Equal(t, float64(100), policy["max_cost"])
+	require.Equal(t, float64(15), policy["used_cost"])
+	require.Equal(t, float64(5), policy["len"])
+	require.Equal(t, float64(100), policy["params"].(map[string]interface{})["max_cost"])
+	buffers := body["buffers"].(map[string]interface{})
+	for _, name := range []string{"set_buffer_len", "set_buffer_cap", "get_batches_pending",
+		"get_batches_cap", "sets_dropped", "gets_dropped", "gets_kept",
+		"callbacks_dropped", "events_dropped", "get_pushes", "get_drains", "get_drops"} {
+		require.Contains(t, buffers, name)
+	}
+	top := body["top_keys"].([]interface{})
+	require.Len(t, top, 5)
+	hot := top[0].(map[string]interface{})
+	key, _ := c.keyToHash(4)
+	require.Equal(t, float64(key), hot["key"])
+	require.Equal(t, float64(5), hot["cost"])
+	require.True(t, hot["frequency"].(float64) > 0)
+	require.NotContains(t, body, "keys")
+	// Nothing served counts as a Get.
+	require.Equal(t, hits, c.Metrics.Hits())
+
+	top = debugGet(t, c, "/debug/cache?top=2", 200)["top_keys"].([]interface{})
+	require.Len(t, top, 2)
+	require.Empty(t, debugGet(t, c, "/debug/cache?top=0", 200)["top_keys"])
+
+	// The keys are listed by hash, a page at a time.
+	var listed []float64
+	offset := "0"
+	for pages := 0; offset != ""; pages++ {
+		require.True(t, pages < 3)
+		keys := debugGet(t, c, "/debug/cache?keys=true&limit=2&offset="+offset, 200)["keys"].(map[string]interface{})
+		require.Equal(t, float64(5), keys["total"])
+		for _, item := range keys["items"].([]interface{}) {
+			item := item.(map[string]interface{})
+			listed = append(listed, item["key"].(float64))
+			var ttl float64
+			for i := 0; i < 5; i++ {
+				if h, _ := c.keyToHash(i); float64(h) == item["key"] {
+					require.Equal(t, float64(i+1), item["cost"])
+					ttl = (time.Duration(i) * time.Minute).Seconds()
+				}
+			}
+			require.Equal(t, ttl, item["ttl_seconds"])
+		}
+		offset = ""
+		if next, ok := keys["next_offset"]; ok {
+			offset = strconv.Itoa(int(next.(float64)))
+		}
+	}
+	require.Len(t, listed, 5)
+	for i := 1; i < len(listed); i++ {
+		require.True(t, listed[i-1] < listed[i])
+	}
+	keys := debugGet(t, c, "/debug/cache?keys=1&offset=10", 200)["keys"].(map[string]interface{})
+	require.Empty(t, keys["items"])
+	require.NotContains(t, debugGet(t, c, "/debug/cache?keys=false", 200), "keys")
+
+	for _, query := range []string{"top=-1", "top=x", "keys=maybe", "keys=1&offset=-1",
+		"keys=1&limit=0", "keys=1&limit=1001"} {
+		debugGet(t, c, "/debug/cache?"+query, 400)
+	}
+}
+
+func TestCacheDebugHandlerPolicy(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Policy:      NewLRUPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.Set(1, 1, 1)
+	c.Wait()
+	body := debugGet(t, c, "/debug/cache", 200)
+	require.Nil(t, body["metrics"])
+	require.Equal(t, "lru", body["policy"].(map[string]interface{})["name"])
+	// The LRU policy keeps no frequencies.
+	require.Empty(t, body["top_keys"])
+
+	custom, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Policy: func(numCounters, maxCost int64) Policy {
+			return NewLRUPolicy(numCounters, maxCost)
+		},
+	})
+	require.NoError(t, err)
+	defer custom.Close()
+	body = debugGet(t, custom, "/debug/cache", 200)
+	require.Equal(t, "custom", body["policy"].(map[string]interface{})["name"])
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"sort"
+	"sync/atomic"
+)
+
+// Drain removes the items from the cache, the most valuable first, passing
+// each of them to f before it goes, until f returns false or the cache is
+// empty, and returns the number of items removed. It's meant for shutdowns,
+// to persist the items most worth keeping, for instance to Set them in the
+// next cache, within the time left.
+//
+// The order is the policy's own: decreasing estimated access frequency for
+// the default policy, and for a custom Policy, the reverse of the order its
+// Evict would pick the items in. To learn it, a custom Policy is asked for
+// every key it tracks as a victim, and then given them back with Add, the
+// least valuable first, as if they were added again.
+//
+// Writes to the cache, from any goroutine, wait for Drain to finish, so f and
+// the callbacks the removals trigger mustn't write to the cache. Expired items
+// are skipped. Drain does nothing on a frozen cache.
+func (c *Cache) Drain(f func(item *Item) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	if c.isClosed() || c.isFrozen() {
+		return 0
+	}
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	atomic.StoreUint32(&c.draining, 1)
+	defer atomic.StoreUint32(&c.draining, 0)
+	for atomic.LoadInt32(&c.writers) != 0 {
+		runtime.Gosched()
+	}
+	c.Wait()
+
+	items := make(map[uint64]storeItem, c.store.Len())
+	now := c.clock.now()
+	c.store.Range(func(i storeItem) bool {
+		if i.expiration == 0 || i.expiration >= now {
+			items[i.key] = i
+		}
+		return true
+	})
+	drained := 0
+	for _, key := range c.policy.Ranked() {
+		i, ok := items[key]
+		if !ok {
+			continue
+		}
+		more := f(&Item{
+			Key:        i.key,
+			Conflict:   i.conflict,
+			Value:      i.value,
+			Cost:       c.policy.Cost(key) - c.internalCost,
+			Expiration: i.expiration,
+		})
+		c.delUngated(i.key, i.conflict)
+		drained++
+		if !more {
+			break
+		}
+	}
+	c.Wait()
+	c.logger.Log(LogInfo, "cache drained", "items", drained)
+	return drained
+}
+
+func (p *defaultPolicy) Ranked() []uint64 {
+	p.Lock()
+	defer p.Unlock()
+	if p.custom == nil {
+		keys := make([]uint64, 0, len(p.evict.keyCosts))
+		freqs := make(map[uint64]int64, len(p.evict.keyCosts))
+		for key := range p.evict.keyCosts {
+			keys = append(keys, key)
+			freqs[key] = p.admit.Estimate(key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if freqs[keys[i]] != freqs[keys[j]] {
+				return freqs[keys[i]] > freqs[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		return keys
+	}
+	keys := make([]uint64, 0, len(p.evict.keyCosts))
+	taken := make(map[uint64]struct{}, len(p.evict.keyCosts))
+	for ghosts := 0; len(keys) < len(p.evict.keyCosts); {
+		victim, ok := p.custom.Evict(0)
+		if !ok {
+			break
+		}
+		_, tracked := p.evict.keyCosts[victim]
+		if _, dup := taken[victim]; !tracked || dup {
+			if ghosts++; ghosts > maxGhostVictims {
+				break
+			}
+			continue
+		}
+		taken[victim] = struct{}{}
+		keys = append(keys, victim)
+	}
+	for _, key := range keys {
+		p.custom.Add(key, p.evict.keyCosts[key])
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	// Keys the custom policy didn't give up come last.
+	for key := range p.evict.keyCosts {
+		if _, ok := taken[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newDrainCache(t *testing.T, policy func(numCounters, maxCost int64) Policy) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Policy:             policy,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func drainKeys(c *Cache, n int) []int {
+	var keys []int
+	c.Drain(func(item *Item) bool {
+		keys = append(keys, item.Value.(int))
+		return len(keys) < n
+	})
+	return keys
+}
+
+func TestCacheDrain(t *testing.T) {
+	c := newDrainCache(t, nil)
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+		require.True(t, c.Set(i, i, 1))
+		for j := 0; j < i; j++ {
+			c.Get(i)
+		}
+	}
+
+	// The most frequently used keys come first, and are removed.
+	require.Equal(t, []int{5, 4}, drainKeys(c, 2))
+	require.Equal(t, 3, c.Len())
+	_, ok := c.Get(5)
+	require.False(t, ok)
+	require.Equal(t, []int{3, 2, 1}, drainKeys(c, 10))
+	require.Zero(t, c.Len())
+	require.Zero(t, c.UsedCost())
+	require.Zero(t, c.Drain(func(*Item) bool { return true }))
+}
+
+func TestCacheDrainCustomPolicy(t *testing.T) {
+	c := newDrainCache(t, NewLRUPolicy)
+	defer c.Close()
+	for i := 1; i <= 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Get(2)
+
+	// The most recently used keys come first.
+	require.Equal(t, []int{2, 5}, drainKeys(c, 2))
+	// The keys left are still tracked in the same order, and evicted first
+	// for new keys.
+	require.Equal(t, 3, c.Len())
+	for i := 6; i <= 13; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	require.Equal(t, 10, c.Len())
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, []int{13, 12, 11}, drainKeys(c, 3))
+}
+
+func TestCacheDrainBlocksWrites(t *testing.T) {
+	c := newDrainCache(t, nil)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+
+	inDrain, release := make(chan struct{}), make(chan struct{})
+	drained := make(chan int)
+	go func() {
+		drained <- c.Drain(func(*Item) bool {
+			select {
+			case <-inDrain:
+			default:
+				close(inDrain)
+			}
+			<-release
+			return true
+		})
+	}()
+	<-inDrain
+	set := make(chan bool)
+	go func() { set <- c.Set(10, 10, 1) }()
+	select {
+	case <-set:
+		t.Fatal("Set didn't wait for Drain")
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Gets go on.
+	_, ok := c.Get(1)
+	require.True(t, ok)
+	close(release)
+	require.Equal(t, 3, <-drained)
+	require.True(t, <-set)
+	val, ok := c.Get(10)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+}
@@ -0,0 +1,246 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "time"
+
+// RejectReason tells why SetEntry didn't store an item.
+type RejectReason byte
+
+const (
+	// RejectNone is the reason of the items that were stored.
+	RejectNone RejectReason = iota
+	// RejectAdmission is given when the policy didn't admit the item, which
+	// includes a new item costing more than MaxCost.
+	RejectAdmission
+	// RejectCost is given when Config.Cost didn't give the value a positive
+	// cost.
+	RejectCost
+	// RejectTooLarge is given when the item costs more than
+	// Config.MaxItemCost, or when a value replacing another costs more than
+	// MaxCost.
+	RejectTooLarge
+	// RejectConflict is given when another key with the same hash is in the
+	// cache.
+	RejectConflict
+	// RejectTTL is given for a negative TTL.
+	RejectTTL
+	// RejectEncode is given when Config.StoreEncoded couldn't encode the
+	// value.
+	RejectEncode
+	// RejectDropped is given when Clear dropped the item from the Set buffer
+	// before it was applied.
+	RejectDropped
+)
+
+// String returns the name of the reason.
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNone:
+		return "none"
+	case RejectAdmission:
+		return "admission"
+	case RejectCost:
+		return "cost"
+	case RejectTooLarge:
+		return "too large"
+	case RejectConflict:
+		return "conflict"
+	case RejectTTL:
+		return "ttl"
+	case RejectEncode:
+		return "encode"
+	case RejectDropped:
+		return "dropped"
+	default:
+		return "unknown"
+	}
+}
+
+// EntryOptions are the options of SetEntry. The zero value sets the item like
+// Set does.
+type EntryOptions struct {
+	// Cost is the cost of the item, as passed to Set. 0 lets Config.Cost
+	// work it out, if set, and counts as 1 otherwise.
+	Cost int64
+	// TTL is the TTL of the item. If it's 0, the item expires after
+	// Config.DefaultTTL, like with Set. A negative TTL rejects the item.
+	TTL time.Duration
+	// Tags, Priority and MaxIdle work like in SetOptions.
+	Tags     []string
+	Priority float64
+	MaxIdle  time.Duration
+	// Pin pins the item once it's stored, like Pin.
+	Pin bool
+	// SkipAdmission stores the item without going through admission, like
+	// SetForce.
+	SkipAdmission bool
+}
+
+// Result is the outcome of a SetEntry. More fields may be added to it, so it
+// should be built with field names, if at all.
+type Result struct {
+	// Stored is set if the value is in the cache, and Updated if it replaced
+	// the value of a key that already was.
+	Stored  bool
+	Updated bool
+	// Victims are the hashes of the keys evicted to make room for the item,
+	// as the cache doesn't keep the original keys.
+	Victims []uint64
+	// RejectedReason tells why the item wasn't stored, if it wasn't.
+	RejectedReason RejectReason
+}
+
+// err returns the error of SetEntry for the result.
+func (r Result) err() error {
+	switch {
+	case r.Stored:
+		return nil
+	case r.RejectedReason == RejectTooLarge:
+		return ErrTooLarge
+	default:
+		return ErrRejected
+	}
+}
+
+// entryResult is filled in with the outcome of a SetEntry while its item goes
+// through the cache, and done is closed once it's known. Its methods do
+// nothing on nil, for the items of the other Sets.
+type entryResult struct {
+	Result
+	pin bool
+	// replace is set for a Replace, whose item deletes the old value of the
+	// key if it's rejected before reaching the Set buffer.
+	replace bool
+	done    chan struct{}
+}
+
+// reject records why the item wasn't stored, unless a reason already was.
+func (e *entryResult) reject(reason RejectReason) {
+	if e != nil && e.RejectedReason == RejectNone {
+		e.RejectedReason = reason
+	}
+}
+
+// evicted records the victims evicted for the item.
+func (e *entryResult) evicted(victims []*Item) {
+	if e == nil {
+		return
+	}
+	for _, victim := range victims {
+		e.Victims = append(e.Victims, victim.Key)
+	}
+}
+
+// update records that the item replaced the value of its key.
+func (e *entryResult) update() {
+	if e != nil {
+		e.Updated = true
+	}
+}
+
+// pinEntry pins the stored item of a SetEntry with EntryOptions.Pin.
+func (c *Cache) pinEntry(i *Item) {
+	if i.entry != nil && i.entry.pin {
+		c.policy.Pin(i.Key)
+	}
+}
+
+// SetEntry works like Set with the options given by opts, but waits for the
+// policy to decide on the item and returns the outcome. It goes the same way
+// through the cache as Set, SetWithTTL and SetWithOptions, which only hand the
+// item over to the Set buffer; SetEntry also waits for room in it rather than
+// being dropped. An item that isn't stored gets ErrTooLarge or ErrRejected,
+// along with the Result telling why. The error is ErrClosed or ErrFrozen if
+// the cache can't take Sets, and ErrInvalidKey for a nil key.
+func (c *Cache) SetEntry(key, value interface{}, opts EntryOptions) (Result, error) {
+	return c.setEntry(key, value, opts, false)
+}
+
+// setEntry implements SetEntry, and Replace if replace is set.
+func (c *Cache) setEntry(key, value interface{}, opts EntryOptions, replace bool) (Result, error) {
+	switch {
+	case c == nil || c.isClosed():
+		return Result{}, ErrClosed
+	case key == nil:
+		return Result{}, ErrInvalidKey
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+	e := &entryResult{pin: opts.Pin, replace: replace, done: make(chan struct{})}
+	keyHash, conflictHash := c.keyToHash(key)
+	sent := c.setHashed(key, keyHash, conflictHash, value, opts.Cost, ttl, opts.SkipAdmission, SetOptions{
+		Tags:     opts.Tags,
+		Priority: opts.Priority,
+		MaxIdle:  opts.MaxIdle,
+		entry:    e,
+	})
+	if !sent {
+		switch {
+		case e.RejectedReason != RejectNone:
+			return e.Result, e.Result.err()
+		case c.isFrozen():
+			return Result{}, ErrFrozen
+		default:
+			return Result{}, ErrClosed
+		}
+	}
+	select {
+	case <-e.done:
+		return e.Result, e.Result.err()
+	case <-c.done:
+		return Result{}, ErrClosed
+	}
+}
+
+// Replace swaps the value of the key for value with the given cost, like a Del
+// followed by a Set, but without the key leaving the cache in between. A key
+// in the cache is updated in place, keeping its standing in the policy, so
+// that a hot key can't be evicted or rejected for it, while a key that isn't
+// goes through admission like any Set. Like SetEntry, Replace waits for room
+// in the Set buffer and for the outcome, and it returns whether the key ended
+// up in the cache with the new value. If it didn't, the old value is deleted,
+// so that it can't be read past its replacement, unless a Set of the key has
+// replaced it since; unlike Del, Config.Backing is left alone. The TTL is
+// Config.DefaultTTL.
+func (c *Cache) Replace(key, value interface{}, cost int64) bool {
+	if c == nil || c.isClosed() || key == nil {
+		return false
+	}
+	res, err := c.setEntry(key, value, EntryOptions{Cost: cost}, true)
+	return err == nil && res.Stored
+}
+
+// replaceFailed deletes the old value of the key of a Replace whose item was
+// rejected before reaching the Set buffer. The deletion is pushed to the Set
+// buffer along with the updates of the key, so that processItems only applies
+// it if no update written after it is pending. The caller has begun a write.
+func (c *Cache) replaceFailed(i *Item) {
+	if i.entry == nil || !i.entry.replace {
+		return
+	}
+	order := c.order.stripe(i.Key)
+	order.writes.Lock()
+	c.victims.forget(i.Key)
+	sent := c.send(&Item{flag: itemDelete, Key: i.Key, Conflict: i.Conflict, replace: true})
+	order.writes.Unlock()
+	if sent {
+		c.waitSynchronous()
+	}
+}
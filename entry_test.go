@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newEntryCache(t *testing.T, config *Config) *Cache {
+	config.NumCounters = 1000
+	config.MaxCost = 10
+	config.BufferItems = 64
+	config.IgnoreInternalCost = true
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheSetEntry(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c := newEntryCache(t, &Config{DefaultTTL: time.Minute, Clock: clock})
+	defer c.Close()
+	keyHash := func(key interface{}) uint64 {
+		h, _ := c.keyToHash(key)
+		return h
+	}
+
+	// The zero value of the options works like Set.
+	res, err := c.SetEntry(1, "one", EntryOptions{})
+	require.NoError(t, err)
+	require.Equal(t, Result{Stored: true}, res)
+	require.True(t, c.Set(2, "two", 0))
+	c.Wait()
+	for _, key := range []int{1, 2} {
+		_, ok := c.Get(key)
+		require.True(t, ok)
+		ttl, ok := c.GetTTL(key)
+		require.True(t, ok)
+		require.Equal(t, time.Minute, ttl)
+		require.Equal(t, int64(1), c.policy.Cost(keyHash(key)))
+	}
+
+	res, err = c.SetEntry(1, "uno", EntryOptions{Cost: 2, TTL: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, Result{Stored: true, Updated: true}, res)
+	val, _ := c.Get(1)
+	require.Equal(t, "uno", val)
+	ttl, _ := c.GetTTL(1)
+	require.Equal(t, time.Hour, ttl)
+	require.Equal(t, int64(2), c.policy.Cost(keyHash(1)))
+
+	res, err = c.SetEntry(3, 3, EntryOptions{TTL: -1})
+	require.Equal(t, ErrRejected, err)
+	require.Equal(t, Result{RejectedReason: RejectTTL}, res)
+	require.Equal(t, "ttl", res.RejectedReason.String())
+}
+
+func TestCacheSetEntryAdmission(t *testing.T) {
+	c := newEntryCache(t, &Config{BufferMode: BufferLossless})
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	for n := 0; n < 10; n++ {
+		for i := 0; i < 10; i++ {
+			c.Get(i)
+		}
+	}
+	c.Flush()
+
+	res, err := c.SetEntry(100, 100, EntryOptions{})
+	require.Equal(t, ErrRejected, err)
+	require.False(t, res.Stored)
+	require.Equal(t, RejectAdmission, res.RejectedReason)
+
+	res, err = c.SetEntry(100, 100, EntryOptions{SkipAdmission: true})
+	require.NoError(t, err)
+	require.True(t, res.Stored)
+	require.Len(t, res.Victims, 1)
+	require.Equal(t, 10, c.Len())
+	require.False(t, c.store.Has(res.Victims[0]))
+	_, ok := c.Get(100)
+	require.True(t, ok)
+}
+
+func TestCacheSetEntryRejected(t *testing.T) {
+	c := newEntryCache(t, &Config{
+		MaxItemCost: 5,
+		KeyToHash: func(key interface{}) (uint64, uint64) {
+			// Keys collide in pairs.
+			k := key.(int)
+			return uint64(k / 2), uint64(k)
+		},
+		Cost: func(value interface{}) int64 {
+			return int64(value.(int))
+		},
+	})
+	defer c.Close()
+
+	for _, tc := range []struct {
+		key, value int
+		cost       int64
+		reason     RejectReason
+	}{
+		{1, 0, 0, RejectCost},
+		{2, 6, 0, RejectTooLarge},
+		{3, 1, 6, RejectTooLarge},
+		{4, 1, 1, RejectNone},
+		{5, 1, 1, RejectConflict},
+	} {
+		res, err := c.SetEntry(tc.key, tc.value, EntryOptions{Cost: tc.cost})
+		switch tc.reason {
+		case RejectNone:
+			require.NoError(t, err)
+		case RejectTooLarge:
+			require.Equal(t, ErrTooLarge, err, "key %d", tc.key)
+		default:
+			require.Equal(t, ErrRejected, err, "key %d", tc.key)
+		}
+		require.Equal(t, tc.reason == RejectNone, res.Stored, "key %d", tc.key)
+		require.Equal(t, tc.reason, res.RejectedReason, "key %d", tc.key)
+	}
+	// A replacement over MaxItemCost leaves the old value.
+	res, err := c.SetEntry(4, 6, EntryOptions{})
+	require.Equal(t, ErrTooLarge, err)
+	require.Equal(t, Result{RejectedReason: RejectTooLarge}, res)
+	val, ok := c.Get(4)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+}
+
+func TestCacheSetEntryPin(t *testing.T) {
+	c := newEntryCache(t, &Config{})
+	defer c.Close()
+	res, err := c.SetEntry("pinned", 1, EntryOptions{Pin: true, SkipAdmission: true})
+	require.NoError(t, err)
+	require.True(t, res.Stored)
+	for i := 0; i < 100; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	_, ok := c.Get("pinned")
+	require.True(t, ok)
+	require.True(t, c.Unpin("pinned"))
+}
+
+func TestCacheSetEntryErrors(t *testing.T) {
+	c := newEntryCache(t, &Config{})
+	_, err := c.SetEntry(nil, 1, EntryOptions{})
+	require.Equal(t, ErrInvalidKey, err)
+	c.Freeze()
+	_, err = c.SetEntry(1, 1, EntryOptions{})
+	require.Equal(t, ErrFrozen, err)
+	c.Close()
+	_, err = c.SetEntry(1, 1, EntryOptions{})
+	require.Equal(t, ErrClosed, err)
+	var nilCache *Cache
+	_, err = nilCache.SetEntry(1, 1, EntryOptions{})
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestCacheReplace(t *testing.T) {
+	c := newEntryCache(t, &Config{Synchronous: true, MaxItemCost: 5})
+	defer c.Close()
+	keyHash, _ := c.keyToHash("hot")
+
+	// A missing key is Set.
+	require.True(t, c.Replace("hot", 0, 1))
+	for i := 0; i < 10; i++ {
+		c.Get("hot")
+	}
+	// Cold keys churn through the full cache between the Replaces, and the
+	// hot key never leaves it.
+	for i := 1; i <= 500; i++ {
+		c.Set(1000+i, i, 1)
+		require.True(t, c.Replace("hot", i, 1+int64(i%2)))
+		val, ok := c.Get("hot")
+		require.True(t, ok, "replace %d", i)
+		require.Equal(t, i, val)
+		require.Equal(t, 1+int64(i%2), c.policy.Cost(keyHash))
+	}
+	require.NotZero(t, c.Len())
+
+	// Del+Set takes the key out of the cache in between.
+	_, ok := c.Del("hot")
+	require.True(t, ok)
+	_, ok = c.Get("hot")
+	require.False(t, ok)
+	c.Set("hot", 0, 1)
+
+	// A replacement that can't be stored takes the old value out too.
+	require.True(t, c.Replace("hot", 1, 1))
+	require.False(t, c.Replace("hot", 2, 6))
+	_, ok = c.Get("hot")
+	require.False(t, ok)
+	require.False(t, c.Replace(nil, 1, 1))
+}
+
+func TestCacheReplaceConcurrent(t *testing.T) {
+	c := newEntryCache(t, &Config{})
+	defer c.Close()
+	require.True(t, c.Replace("hot", 0, 1))
+	done := make(chan struct{})
+	misses := make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-done:
+				misses <- n
+				return
+			default:
+			}
+			if _, ok := c.Get("hot"); !ok {
+				n++
+			}
+		}
+	}()
+	// The value is swapped in place, so a concurrent Get never misses it.
+	for i := 1; i <= 1000; i++ {
+		require.True(t, c.Replace("hot", i, 1+int64(i%2)))
+	}
+	close(done)
+	require.Zero(t, <-misses)
+}
+
+func TestCacheReplaceRejectedConcurrent(t *testing.T) {
+	l2 := NewMapBackingStore()
+	l2.Set("hot", -1)
+	c := newEntryCache(t, &Config{MaxItemCost: 5, Backing: l2})
+	defer c.Close()
+	keyHash, _ := c.keyToHash("hot")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			c.SetEntry("hot", i, EntryOptions{Cost: 1})
+		}
+	}()
+	// Every replacement is too large, and only takes out the values set
+	// before it.
+	for i := 0; i < 1000; i++ {
+		require.False(t, c.Replace("hot", i, 6))
+	}
+	wg.Wait()
+	c.Wait()
+	_, ok := l2.Get("hot")
+	require.True(t, ok)
+	_, ok = c.GetLocal("hot")
+	require.Equal(t, ok, c.policy.Cost(keyHash) >= 0)
+
+	// A value set after the last Replace stays, until the next one.
+	res, err := c.SetEntry("hot", "last", EntryOptions{Cost: 1})
+	require.NoError(t, err)
+	require.True(t, res.Stored)
+	val, ok := c.GetLocal("hot")
+	require.True(t, ok)
+	require.Equal(t, "last", val)
+	require.False(t, c.Replace("hot", 0, 6))
+	c.Wait()
+	_, ok = c.GetLocal("hot")
+	require.False(t, ok)
+	require.Less(t, c.policy.Cost(keyHash), int64(0))
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of the methods of Cache that return one. Other than these and
+// the errors below, they may return ErrFrozen, ErrNotFound and
+// ErrLoaderPanicked.
+var (
+	// ErrClosed is returned for a closed cache, including one closed while
+	// the method was waiting.
+	ErrClosed = errors.New("ristretto: cache is closed")
+	// ErrInvalidKey is returned for a nil key.
+	ErrInvalidKey = errors.New("ristretto: invalid key")
+	// ErrRejected is returned by SetEntry when the item isn't stored for any
+	// reason other than its cost.
+	ErrRejected = errors.New("ristretto: set rejected")
+	// ErrTooLarge is returned by SetEntry when the item costs more than
+	// Config.MaxItemCost, or more than MaxCost for a value replacing another.
+	ErrTooLarge = errors.New("ristretto: item too large")
+)
+
+// LoadError is returned by GetOrCompute and ReadThrough when the loader fails,
+// holding the key and what the loader returned.
+type LoadError struct {
+	Key interface{}
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("ristretto: loading key %v: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the error of the loader.
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// WriteError is returned by SetThrough when Config.Writer fails, holding the
+// key and what the writer returned.
+type WriteError struct {
+	Key interface{}
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("ristretto: writing key %v: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the error of the writer.
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
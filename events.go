@@ -0,0 +1,149 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is what happened to a key in an Event.
+type EventType byte
+
+const (
+	// EventAdmit is sent when a new key is stored.
+	EventAdmit EventType = iota
+	// EventReject is sent when a Set is rejected, by the policy or otherwise.
+	EventReject
+	// EventUpdate is sent when the value or cost of a key already in the
+	// cache is replaced.
+	EventUpdate
+	// EventEvict is sent when a key is evicted to make room for others.
+	EventEvict
+	// EventExpire is sent when a key is removed because its TTL has passed.
+	EventExpire
+	// EventDelete is sent when a key is deleted with Del or the like.
+	EventDelete
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventAdmit:
+		return "admit"
+	case EventReject:
+		return "reject"
+	case EventUpdate:
+		return "update"
+	case EventEvict:
+		return "evict"
+	case EventExpire:
+		return "expire"
+	case EventDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is sent to the subscribers of a cache whenever a key is admitted,
+// rejected, updated or leaves the cache. See Cache.Subscribe.
+type Event struct {
+	Type EventType
+	// Key and Conflict are the hashes of the key.
+	Key      uint64
+	Conflict uint64
+	// Cost is the cost of the item, including the internal cost unless
+	// Config.IgnoreInternalCost is set. It's 0 for EventDelete.
+	Cost int64
+	Time time.Time
+}
+
+// eventHub sends the events to the subscribers. Events are only ever sent by
+// the goroutine applying the Sets, and never block it: an event is dropped for
+// a subscriber whose channel is full.
+type eventHub struct {
+	// n is the number of subscribers, read without the lock so that caches
+	// without any don't take it. It comes first to be 64-bit aligned.
+	n int64
+	sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+// active returns whether there are any subscribers.
+func (h *eventHub) active() bool {
+	return atomic.LoadInt64(&h.n) > 0
+}
+
+func (h *eventHub) subscribe(size int) (chan Event, bool) {
+	ch := make(chan Event, size)
+	h.Lock()
+	defer h.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, false
+	}
+	h.subs[ch] = struct{}{}
+	atomic.AddInt64(&h.n, 1)
+	return ch, true
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subs[ch]; !ok {
+		return
+	}
+	delete(h.subs, ch)
+	atomic.AddInt64(&h.n, -1)
+	close(ch)
+}
+
+// send sends the event to every subscriber with room for it, and returns the
+// number of subscribers it was dropped for.
+func (h *eventHub) send(e Event) int {
+	h.Lock()
+	defer h.Unlock()
+	dropped := 0
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// close closes the channels of all the subscribers. Later subscribers get a
+// closed channel.
+func (h *eventHub) close() {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = nil
+	h.closed = true
+	atomic.StoreInt64(&h.n, 0)
+}
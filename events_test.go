@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSubscribe(t *testing.T) {
+	start := time.Unix(1e9, 0)
+	clock := NewMockClock(start)
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            2,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	events, unsubscribe := c.Subscribe(100)
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	require.True(t, c.Set(1, 1, 2))
+	c.Wait()
+	c.Del(1)
+	c.Del(1)
+	require.True(t, c.SetWithTTL(2, 2, 1, time.Second))
+	c.Wait()
+	clock.Add(10 * time.Second)
+	require.True(t, c.Set(3, 3, 3))
+	require.True(t, c.Set(4, 4, 2))
+	c.Wait()
+	require.True(t, c.SetForce(5, 5, 1))
+	c.Wait()
+
+	type event struct {
+		typ  EventType
+		key  uint64
+		cost int64
+	}
+	want := []event{
+		{EventAdmit, 1, 1},
+		{EventUpdate, 1, 2},
+		{EventDelete, 1, 2},
+		{EventAdmit, 2, 1},
+		{EventExpire, 2, 1},
+		{EventReject, 3, 3},
+		{EventAdmit, 4, 2},
+		{EventEvict, 4, 2},
+		{EventAdmit, 5, 1},
+	}
+	for _, w := range want {
+		e := <-events
+		require.Equal(t, w, event{e.Type, e.Key, e.Cost})
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+	require.Zero(t, c.Metrics.EventsDropped())
+
+	unsubscribe()
+	unsubscribe()
+	_, ok := <-events
+	require.False(t, ok)
+}
+
+func TestCacheSubscribeDrop(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	full, _ := c.Subscribe(1)
+	roomy, _ := c.Subscribe(10)
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, uint64(2), c.Metrics.EventsDropped())
+	require.Len(t, full, 1)
+	require.Len(t, roomy, 3)
+
+	// Close closes every channel, and later ones start closed.
+	c.Close()
+	for range roomy {
+	}
+	for range full {
+	}
+	closed, unsubscribe := c.Subscribe(1)
+	_, ok := <-closed
+	require.False(t, ok)
+	unsubscribe()
+
+	var nilCache *Cache
+	closed, _ = nilCache.Subscribe(1)
+	_, ok = <-closed
+	require.False(t, ok)
+}
+
+func TestEventTypeString(t *testing.T) {
+	require.Equal(t, "admit", EventAdmit.String())
+	require.Equal(t, "delete", EventDelete.String())
+	require.Equal(t, "unknown", EventType(100).String())
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// promMetric is a metric served by the handler returned by Cache.MetricsHandler.
+type promMetric struct {
+	name  string
+	kind  string
+	help  string
+	value func(c *Cache) float64
+}
+
+func promCounter(name, help string, t metricType) promMetric {
+	return promMetric{name, "counter", help, func(c *Cache) float64 {
+		return float64(c.Metrics.get(t))
+	}}
+}
+
+var promMetrics = []promMetric{
+	promCounter("cache_hits_total", "Number of Gets that found a value.", hit),
+	promCounter("cache_misses_total", "Number of Gets that didn't find a value.", miss),
+	promCounter("cache_keys_added_total", "Number of keys added.", keyAdd),
+	promCounter("cache_keys_updated_total", "Number of keys updated.", keyUpdate),
+	promCounter("cache_evictions_total", "Number of keys evicted.", keyEvict),
+	promCounter("cache_cost_added_total", "Sum of the costs of the keys added.", costAdd),
+	promCounter("cache_cost_evicted_total", "Sum of the costs of the keys evicted.", costEvict),
+	promCounter("cache_sets_dropped_total", "Number of Sets dropped by the buffers.", dropSets),
+	promCounter("cache_sets_rejected_total", "Number of Sets rejected by the policy.", rejectSets),
+	promCounter("cache_sets_rejected_by_cost_total",
+		"Number of Sets rejected for a cost that isn't positive.", rejectCosts),
+	promCounter("cache_sets_rejected_too_large_total",
+		"Number of Sets rejected for a cost over the max item cost.", rejectLarge),
+	promCounter("cache_callbacks_dropped_total",
+		"Number of eviction callbacks skipped for a full queue.", dropCallbacks),
+	promCounter("cache_callback_panics_total",
+		"Number of callback calls that panicked.", panicCallbacks),
+	promCounter("cache_ghosts_removed_total",
+		"Number of keys tracked by the policy but missing from the store.", ghostsRemoved),
+	promCounter("cache_key_conflicts_total",
+		"Number of lookups and Sets that found their key's hash held by another key.", keyConflicts),
+	promCounter("cache_events_dropped_total",
+		"Number of events dropped for subscribers with a full channel.", dropEvents),
+	promCounter("cache_refresh_errors_total",
+		"Number of failed background refreshes of stale values.", refreshErrors),
+	promCounter("cache_negative_hits_total",
+		"Number of lookups that found a key known to be absent.", negativeHits),
+	promCounter("cache_victim_hits_total",
+		"Number of lookups that found their key in the victim cache.", victimHits),
+	promCounter("cache_hints_total",
+		"Number of hinted keys whose frequency was raised.", hints),
+	promCounter("cache_bytes_copied_total",
+		"Number of bytes of the values copied for Gets with CopyOnRead.", bytesCopied),
+	promCounter("cache_shadow_hits_total",
+		"Number of Gets that would have been hits with the shadow policy.", shadowHit),
+	promCounter("cache_shadow_misses_total",
+		"Number of Gets that would have been misses with the shadow policy.", shadowMiss),
+	{"cache_hit_ratio", "gauge", "Share of the Gets that found a value.",
+		func(c *Cache) float64 { return c.Metrics.Ratio() }},
+	{"cache_shadow_hit_ratio", "gauge", "Share of the Gets that would have found a value with the shadow policy.",
+		func(c *Cache) float64 { return c.Metrics.ShadowRatio() }},
+	promCounter("cache_gets_dropped_total", "Number of Gets not recorded by the policy.", dropGets),
+	promCounter("cache_gets_kept_total", "Number of Gets recorded by the policy.", keepGets),
+	{"cache_internal_cost_added_total", "counter",
+		"Part of the costs of the keys added charged for storing them.",
+		func(c *Cache) float64 { return float64(c.Metrics.InternalCostAdded()) }},
+	{"cache_internal_cost_evicted_total", "counter",
+		"Part of the costs of the keys evicted charged for storing them.",
+		func(c *Cache) float64 { return float64(c.Metrics.InternalCostEvicted()) }},
+	{"cache_loads_in_flight", "gauge", "Number of GetOrCompute loads and background refreshes in flight.",
+		func(c *Cache) float64 { return float64(c.Metrics.LoadsInFlight()) }},
+	{"cache_cost_used", "gauge", "Sum of the costs of the keys in the cache.",
+		func(c *Cache) float64 { return float64(c.UsedCost()) }},
+	{"cache_cost_max", "gauge", "Maximum cost of the cache.",
+		func(c *Cache) float64 { return float64(c.MaxCost()) }},
+	{"cache_items", "gauge", "Number of items in the cache.",
+		func(c *Cache) float64 { return float64(c.Len()) }},
+	{"cache_items_max", "gauge", "Maximum number of items of the cache, or 0 if unlimited.",
+		func(c *Cache) float64 { return float64(c.MaxEntries()) }},
+	{"cache_sketch_counters", "gauge", "Number of counters in each row of the frequency sketch.",
+		func(c *Cache) float64 { return float64(c.SketchCounters()) }},
+	{"cache_window_ratio", "gauge", "Share of the maximum cost given to the W-TinyLFU window, or 0 for other policies.",
+		func(c *Cache) float64 { return c.WindowRatio() }},
+	{"cache_get_buffer_fill", "gauge", "Number of keys held by the stripes of a lossless Get buffer.",
+		func(c *Cache) float64 { return float64(c.BufferStats().fill()) }},
+	{"cache_get_buffer_pushes_total", "counter", "Number of keys pushed to the Get buffer.",
+		func(c *Cache) float64 { return float64(c.BufferStats().Pushes) }},
+	{"cache_get_buffer_drains_total", "counter", "Number of batches of keys handed from the Get buffer to the policy.",
+		func(c *Cache) float64 { return float64(c.BufferStats().Drains) }},
+	{"cache_get_buffer_drops_total", "counter", "Number of keys dropped by the Get buffer.",
+		func(c *Cache) float64 { return float64(c.BufferStats().Drops) }},
+	{"cache_pressure", "gauge", "Last heap pressure level passed to SetPressure.",
+		func(c *Cache) float64 { return c.Pressure().Level }},
+	{"cache_admission_margin", "gauge",
+		"Estimated accesses a new key needs over the key it would evict to be admitted.",
+		func(c *Cache) float64 { return float64(c.Pressure().AdmissionMargin) }},
+}
+
+// MetricsHandler returns a handler serving the cache's metrics in the
+// Prometheus text exposition format, labeled with Config.MetricsLabels. The
+// counters stay at zero unless Config.Metrics is set, and are reset by Clear
+// and Close. The handler of a nil cache serves no metrics.
+func (c *Cache) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(c.prometheusText())
+	})
+}
+
+func (c *Cache) prometheusText() []byte {
+	if c == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, m := range promMetrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.kind)
+		fmt.Fprintf(&buf, "%s%s %v\n", m.name, c.metricsLabels, m.value(c))
+	}
+	c.writePromHistogram(&buf)
+	c.writePromLatency(&buf)
+	return buf.Bytes()
+}
+
+// formatLabels returns labels in the exposition format, sorted by name, or an
+// empty string if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escaper.Replace(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// published holds the metrics served under the names published with expvar.
+// expvar can't take a name back, so each name is published once, as a Func
+// reading the metrics held here, and is free again once its entry is cleared.
+var published = struct {
+	sync.Mutex
+	metrics map[string]func() *Metrics
+}{metrics: make(map[string]func() *Metrics)}
+
+// publishMetrics publishes the metrics returned by metrics with expvar under
+// name, until unpublishMetrics is called for it.
+func publishMetrics(name string, metrics func() *Metrics) error {
+	published.Lock()
+	defer published.Unlock()
+	held, ok := published.metrics[name]
+	switch {
+	case held != nil:
+		return fmt.Errorf("expvar %q is already published", name)
+	case !ok && expvar.Get(name) != nil:
+		return fmt.Errorf("expvar %q is already published outside of ristretto", name)
+	case !ok:
+		expvar.Publish(name, expvar.Func(func() interface{} {
+			published.Lock()
+			metrics := published.metrics[name]
+			published.Unlock()
+			if metrics == nil {
+				return nil
+			}
+			return metrics()
+		}))
+	}
+	published.metrics[name] = metrics
+	return nil
+}
+
+// unpublishMetrics frees name for the next cache, the name serving null until
+// then.
+func unpublishMetrics(name string) {
+	published.Lock()
+	published.metrics[name] = nil
+	published.Unlock()
+}
@@ -0,0 +1,203 @@
+package ristretto
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// scrape serves a request with the cache's metrics handler and returns the
+// samples by metric name, checking that every sample has the wanted labels.
+func scrape(t *testing.T, c *Cache, labels string) map[string]float64 {
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, 200, rec.Code)
+	require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			require.Len(t, fields, 4)
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndexByte(line, ' ')
+		require.True(t, sep > 0, line)
+		name := line[:sep]
+		// The buckets of histograms have their bound after the other labels.
+		le := leLabel.FindStringSubmatch(name)
+		if le != nil {
+			name = strings.TrimSuffix(strings.Replace(name, le[0], "", 1), "{}")
+		}
+		require.True(t, strings.HasSuffix(name, labels), line)
+		name = strings.TrimSuffix(name, labels)
+		family := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if types[strings.TrimSuffix(name, suffix)] == "histogram" {
+				family = strings.TrimSuffix(name, suffix)
+			}
+		}
+		require.Contains(t, types, family)
+		require.Equal(t, le != nil, strings.HasSuffix(name, "_bucket"), line)
+		if le != nil {
+			name += `{le="` + le[1] + `"}`
+		}
+		value, err := strconv.ParseFloat(line[sep+1:], 64)
+		require.NoError(t, err)
+		samples[name] = value
+	}
+	require.NoError(t, scanner.Err())
+	// Histograms have a bucket for every bound, one with no bound, a sum and
+	// a count.
+	require.Len(t, samples, len(promMetrics)+len(defaultCostBuckets)+3)
+	return samples
+}
+
+var leLabel = regexp.MustCompile(`,?le="([^"]*)"`)
+
+func TestCacheMetricsHandler(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       1000,
+		BufferItems:   64,
+		Metrics:       true,
+		MetricsLabels: map[string]string{"name": "users", "shard": `a"b\c`},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	labels := `{name="users",shard="a\"b\\c"}`
+
+	before := scrape(t, c, labels)
+	require.Zero(t, before["cache_hits_total"])
+	require.Equal(t, float64(1000), before["cache_cost_max"])
+
+	c.Set(1, 1, 1)
+	c.Wait()
+	c.Get(1)
+	c.Get(2)
+
+	after := scrape(t, c, labels)
+	require.Equal(t, float64(1), after["cache_hits_total"])
+	require.Equal(t, float64(1), after["cache_misses_total"])
+	require.Equal(t, float64(1), after["cache_keys_added_total"])
+	require.Equal(t, float64(c.UsedCost()), after["cache_cost_used"])
+	require.Equal(t, float64(1), after["cache_items"])
+	require.Equal(t, float64(1), after[`cache_cost_admitted_bucket{le="256"}`])
+	require.Equal(t, float64(1), after[`cache_cost_admitted_bucket{le="+Inf"}`])
+	require.Equal(t, float64(1), after["cache_cost_admitted_count"])
+	require.Equal(t, float64(c.UsedCost()), after["cache_cost_admitted_sum"])
+}
+
+func TestCacheMetricsHandlerNoLabels(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.Get(1)
+	require.Zero(t, scrape(t, c, "")["cache_misses_total"])
+}
+
+func TestFormatLabels(t *testing.T) {
+	require.Equal(t, "", formatLabels(nil))
+	require.Equal(t, `{a="1",b="x\ny"}`, formatLabels(map[string]string{"b": "x\ny", "a": "1"}))
+}
+
+func TestCacheMetricsName(t *testing.T) {
+	config := &Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		MetricsName: "ristretto_test_cache",
+	}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	c.Get(1)
+
+	v := expvar.Get("ristretto_test_cache")
+	require.NotNil(t, v)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(v.String()), &m))
+	require.Equal(t, float64(1), m["misses"])
+
+	_, err = NewCache(config)
+	require.Error(t, err)
+	if expvar.Get("ristretto_test_foreign") == nil {
+		expvar.Publish("ristretto_test_foreign", expvar.Func(func() interface{} { return 1 }))
+	}
+	config.MetricsName = "ristretto_test_foreign"
+	_, err = NewCache(config)
+	require.Error(t, err)
+
+	config.MetricsName = "ristretto_test_no_metrics"
+	config.Metrics = false
+	_, err = NewCache(config)
+	require.Error(t, err)
+}
+
+func TestCacheMetricsNameReuse(t *testing.T) {
+	config := &Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		MetricsName: "ristretto_test_reuse",
+	}
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	c.Get(1)
+	c.Close()
+	require.Equal(t, "null", expvar.Get("ristretto_test_reuse").String())
+
+	// Once closed, the name serves the next cache.
+	c, err = NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("ristretto_test_reuse").String()), &m))
+	require.Equal(t, float64(0), m["misses"])
+}
+
+func TestCacheMetricsNameConcurrent(t *testing.T) {
+	config := &Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		MetricsName: "ristretto_test_concurrent",
+	}
+	caches := make(chan *Cache, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(caches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c, err := NewCache(config); err == nil {
+				caches <- c
+			}
+		}()
+	}
+	wg.Wait()
+	close(caches)
+	require.Len(t, caches, 1)
+	(<-caches).Close()
+}
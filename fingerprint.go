@@ -0,0 +1,158 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// fingerprintSeed is added to the hashes of the keys before mixing them, so
+// that a key of 0 doesn't add 0 to the fingerprint.
+const fingerprintSeed = 0x9e3779b97f4a7c15
+
+// fingerprintOf returns what an item adds to the Fingerprint of the cache. The
+// conflict hash stands for the key when there's one, as the default
+// KeyToHash hashes strings and byte slices with a seed that changes with every
+// process, but their conflict hash with xxhash, which doesn't.
+func fingerprintOf(key, conflict uint64) uint64 {
+	if conflict != 0 {
+		return mixHash(conflict + fingerprintSeed)
+	}
+	return mixHash(key + fingerprintSeed)
+}
+
+// Fingerprint returns a checksum of the keys in the cache, which doesn't depend
+// on the order they were added in, so that replicas holding the same keys
+// have the same fingerprint, short of a hash collision. It's kept up to date
+// by the writes of the hashmap, so it takes the same time whatever the number
+// of items, and only sees the keys: replicas holding different values for the
+// same keys have the same fingerprint.
+//
+// Keys are told apart by their conflict hash, or their key hash for the keys
+// without one, such as the integers with the default Config.KeyToHash, so a
+// KeyToHash returning hashes that change from one process to the next makes
+// fingerprints useless across processes. Like Len, it counts the items that
+// have expired but haven't been cleaned up yet. Sketch tells how much two
+// caches with different fingerprints differ.
+func (c *Cache) Fingerprint() uint64 {
+	if c == nil || c.isClosed() {
+		return 0
+	}
+	return c.store.Fingerprint()
+}
+
+// KeySketch is a k-minimum-values sketch of the keys in a cache, returned by
+// Cache.Sketch, to estimate how much two caches differ. It's meant to be sent
+// over to another replica, and has no reference to the cache.
+type KeySketch struct {
+	// Hashes are the smallest fingerprints of the keys, in increasing order,
+	// or all of them if the cache holds no more than k keys.
+	Hashes []uint64 `json:"hashes"`
+	// Len is the number of keys sketched.
+	Len int `json:"len"`
+}
+
+// uint64Heap is a max-heap of uint64s.
+type uint64Heap []uint64
+
+func (h uint64Heap) Len() int            { return len(h) }
+func (h uint64Heap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h uint64Heap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *uint64Heap) Push(x interface{}) { *h = append(*h, x.(uint64)) }
+func (h *uint64Heap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Sketch returns a sketch of the keys in the cache keeping the k smallest of
+// their fingerprints, as in Fingerprint. Unlike Fingerprint, it goes over
+// every item, one hashmap shard at a time, so it isn't a snapshot of a cache
+// being written to. The larger k, the closer the estimates of the sketch: their
+// relative error is about 1/sqrt(k).
+func (c *Cache) Sketch(k int) KeySketch {
+	if c == nil || c.isClosed() || k <= 0 {
+		return KeySketch{}
+	}
+	var sketch KeySketch
+	smallest := make(uint64Heap, 0, k)
+	c.store.Range(func(item storeItem) bool {
+		sketch.Len++
+		h := fingerprintOf(item.key, item.conflict)
+		switch {
+		case len(smallest) < k:
+			heap.Push(&smallest, h)
+		case h < smallest[0]:
+			smallest[0] = h
+			heap.Fix(&smallest, 0)
+		}
+		return true
+	})
+	sort.Slice(smallest, func(i, j int) bool { return smallest[i] < smallest[j] })
+	sketch.Hashes = smallest
+	return sketch
+}
+
+// complete returns whether the sketch holds the fingerprint of every key.
+func (s KeySketch) complete() bool {
+	return len(s.Hashes) >= s.Len
+}
+
+// Similarity estimates the Jaccard index of the keys of the two sketches: the
+// share of the keys in either that are in both. Two empty sketches are alike.
+// It's exact if both sketches hold every key.
+func (s KeySketch) Similarity(other KeySketch) float64 {
+	if s.Len == 0 && other.Len == 0 {
+		return 1
+	}
+	k := len(s.Hashes)
+	if len(other.Hashes) < k {
+		k = len(other.Hashes)
+	}
+	if s.complete() && other.complete() {
+		k = s.Len + other.Len
+	}
+	// Walk the k smallest fingerprints of the union, counting the ones in
+	// both.
+	var union, both int
+	for i, j := 0, 0; union < k && (i < len(s.Hashes) || j < len(other.Hashes)); union++ {
+		switch {
+		case j == len(other.Hashes) || (i < len(s.Hashes) && s.Hashes[i] < other.Hashes[j]):
+			i++
+		case i == len(s.Hashes) || other.Hashes[j] < s.Hashes[i]:
+			j++
+		default:
+			both++
+			i++
+			j++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return float64(both) / float64(union)
+}
+
+// Difference estimates the number of keys in either sketch but not both,
+// going by Similarity and the number of keys of each. It's exact if both
+// sketches hold every key.
+func (s KeySketch) Difference(other KeySketch) float64 {
+	j := s.Similarity(other)
+	return float64(s.Len+other.Len) * (1 - j) / (1 + j)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+// scanFingerprint computes the fingerprint of the cache from its items.
+func scanFingerprint(c *Cache) uint64 {
+	var sum uint64
+	c.store.Range(func(item storeItem) bool {
+		sum += fingerprintOf(item.key, item.conflict)
+		return true
+	})
+	return sum
+}
+
+func TestCacheFingerprint(t *testing.T) {
+	for _, newMap := range []func() Map{nil, NewSyncMap} {
+		clock := NewMockClock(time.Unix(1e9, 0))
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            50,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Clock:              clock,
+			NewMap:             newMap,
+		})
+		require.NoError(t, err)
+		require.Zero(t, c.Fingerprint())
+
+		rng := rand.New(rand.NewSource(1))
+		key := func() interface{} {
+			if rng.Intn(2) == 0 {
+				return rng.Intn(100)
+			}
+			return string(rune('a' + rng.Intn(26)))
+		}
+		for op := 0; op < 20000; op++ {
+			switch n := rng.Intn(100); {
+			case n < 50:
+				c.Set(key(), op, 1+int64(rng.Intn(3)))
+			case n < 65:
+				c.SetWithTTL(key(), op, 1, time.Duration(1+rng.Intn(3))*time.Second)
+			case n < 80:
+				c.Del(key())
+			case n < 85:
+				c.SetGroup([]Entry{{Key: key(), Value: op, Cost: 1}, {Key: key(), Value: op, Cost: 1}})
+			case n < 95:
+				clock.Add(time.Second)
+			case n < 96:
+				c.Clear()
+			default:
+				c.Wait()
+				require.Equal(t, scanFingerprint(c), c.Fingerprint(), "op %d", op)
+			}
+		}
+		c.Wait()
+		require.NotZero(t, c.Len())
+		require.Equal(t, scanFingerprint(c), c.Fingerprint())
+		c.Close()
+		require.Zero(t, c.Fingerprint())
+	}
+}
+
+func TestCacheFingerprintReplicas(t *testing.T) {
+	newCache := func(keyToHash func(key interface{}) (uint64, uint64)) *Cache {
+		c, err := NewCache(&Config{
+			NumCounters:        10000,
+			MaxCost:            10000,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			KeyToHash:          keyToHash,
+		})
+		require.NoError(t, err)
+		return c
+	}
+	// The key hashes of the replicas differ, as the ones of strings do from
+	// one process to the next, but their conflict hashes don't.
+	a := newCache(nil)
+	defer a.Close()
+	b := newCache(func(key interface{}) (uint64, uint64) {
+		if s, ok := key.(string); ok {
+			return z.MemHashString(s) ^ 1, xxhash.Sum64String(s)
+		}
+		return z.KeyToHash(key)
+	})
+	defer b.Close()
+	// Set in a different order.
+	for i := 0; i < 1000; i++ {
+		require.True(t, a.Set(i, i, 1))
+		require.True(t, a.Set(string(rune(i+'0')), i, 1))
+		require.True(t, b.Set(999-i, i, 1))
+		require.True(t, b.Set(string(rune(999-i+'0')), i, 1))
+	}
+	a.Wait()
+	b.Wait()
+	require.Equal(t, 2000, a.Len())
+	require.Equal(t, 2000, b.Len())
+	require.Equal(t, a.Fingerprint(), b.Fingerprint())
+	require.Equal(t, 1.0, a.Sketch(64).Similarity(b.Sketch(64)))
+	require.Zero(t, a.Sketch(64).Difference(b.Sketch(64)))
+
+	// b misses 100 of the keys of a and has 100 of its own.
+	for i := 0; i < 100; i++ {
+		b.Del(i)
+		require.True(t, b.Set(i+5000, i, 1))
+	}
+	b.Wait()
+	require.NotEqual(t, a.Fingerprint(), b.Fingerprint())
+	require.Equal(t, 200.0, a.Sketch(4000).Difference(b.Sketch(4000)))
+	sa, sb := a.Sketch(256), b.Sketch(256)
+	require.Len(t, sa.Hashes, 256)
+	require.Equal(t, 2000, sa.Len)
+	require.InDelta(t, 200, sa.Difference(sb), 100)
+	require.InDelta(t, 1800.0/2100, sa.Similarity(sb), 0.1)
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+)
+
+// ErrFrozen is returned by the methods that can't write to a cache once Freeze
+// has been called.
+var ErrFrozen = errors.New("ristretto: cache is frozen")
+
+// frozenEntry is an item of a frozenMap.
+type frozenEntry struct {
+	key        uint64
+	conflict   uint64
+	expiration int64
+	value      interface{}
+}
+
+// frozenMap is the read-only table a frozen cache serves Gets from: the items
+// packed in a slice, and an open-addressing index of them probed linearly.
+// Nothing in it changes once built, so it's read without locks.
+type frozenMap struct {
+	entries []frozenEntry
+	// index holds the position in entries of every key plus one, or 0 for an
+	// empty slot. Its size is a power of two at least twice the number of
+	// entries.
+	index []uint32
+	mask  uint64
+	// seed is mixed into the keys, like in shardedMap, so that keys colliding
+	// in the index can't be made on purpose.
+	seed uint64
+}
+
+func newFrozenMap(items []storeItem) *frozenMap {
+	size := 2
+	for size < 2*len(items) {
+		size *= 2
+	}
+	m := &frozenMap{
+		entries: make([]frozenEntry, len(items)),
+		index:   make([]uint32, size),
+		mask:    uint64(size - 1),
+		seed:    randomSeed(),
+	}
+	for n, item := range items {
+		m.entries[n] = frozenEntry{
+			key:        item.key,
+			conflict:   item.conflict,
+			expiration: item.expiration,
+			value:      item.value,
+		}
+		i := m.slot(item.key)
+		for m.index[i] != 0 {
+			i = (i + 1) & m.mask
+		}
+		m.index[i] = uint32(n + 1)
+	}
+	return m
+}
+
+func (m *frozenMap) slot(key uint64) uint64 {
+	return mixHash(key^m.seed) & m.mask
+}
+
+// get returns the value of the key if it matches the conflict hash and hasn't
+// expired by the time of clock.
+func (m *frozenMap) get(key, conflict uint64, clock *coarseClock) (interface{}, bool) {
+	for i := m.slot(key); m.index[i] != 0; i = (i + 1) & m.mask {
+		e := &m.entries[m.index[i]-1]
+		if e.key != key {
+			continue
+		}
+		if conflict != 0 && conflict != e.conflict {
+			return nil, false
+		}
+		if e.expiration != 0 && clock.now() > e.expiration {
+			return nil, false
+		}
+		return e.value, true
+	}
+	return nil, false
+}
+
+// Freeze makes the cache read-only, for caches that are only read once warmed
+// up. It applies the Sets still in the buffers, and then copies the items into
+// a packed, immutable table that Gets read without taking locks or recording
+// their accesses, so that they scale with the number of cores. Items still
+// expire, but their TTLs and the policy no longer change, and neither do the
+// idle times of Config.MaxIdle, so idle items aren't expired either.
+//
+// From then on, the methods writing to the cache do nothing: Set and the other
+// Sets return false, Del and InvalidateTag delete nothing, Touch returns
+// false, GetAndTouch works like Get, Clear, UpdateMaxCost, UpdateQuota,
+// SetPressure, EvictN and EvictCost do nothing, SetEntry returns ErrFrozen,
+// and SetThrough returns it without writing to the underlying store. The
+// writes running when Freeze is called are waited for, and are either applied
+// before the cache is frozen or refused. Freeze can't be undone, and calling
+// it again does nothing.
+func (c *Cache) Freeze() {
+	if c == nil {
+		return
+	}
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	if c.isClosed() || c.isFrozen() {
+		return
+	}
+	atomic.StoreUint32(&c.frozen, 1)
+	// Writers check the flag after counting themselves, so the ones not
+	// counted yet will see it.
+	for atomic.LoadInt32(&c.writers) != 0 {
+		runtime.Gosched()
+	}
+	c.Wait()
+	var items []storeItem
+	now := c.clock.now()
+	c.store.Range(func(i storeItem) bool {
+		if i.expiration == 0 || i.expiration >= now {
+			items = append(items, i)
+		}
+		return true
+	})
+	c.frozenMap.Store(newFrozenMap(items))
+	c.logger.Log(LogInfo, "cache frozen", "items", len(items))
+}
+
+// Frozen returns whether Freeze has been called.
+func (c *Cache) Frozen() bool {
+	return c != nil && c.isFrozen()
+}
+
+func (c *Cache) isFrozen() bool {
+	return atomic.LoadUint32(&c.frozen) == 1
+}
+
+// beginWrite counts a write to the cache for Freeze and Drain, and returns
+// false if the cache is frozen, in which case the write mustn't happen. While
+// Drain runs, it waits for it to finish. endWrite has to be called once a
+// write that began is done.
+func (c *Cache) beginWrite() bool {
+	for {
+		atomic.AddInt32(&c.writers, 1)
+		if c.isFrozen() {
+			c.endWrite()
+			return false
+		}
+		if atomic.LoadUint32(&c.draining) == 0 {
+			return true
+		}
+		c.endWrite()
+		// Drain holds drainMu until it's done.
+		c.drainMu.Lock()
+		c.drainMu.Unlock()
+	}
+}
+
+func (c *Cache) endWrite() {
+	atomic.AddInt32(&c.writers, -1)
+}
+
+// lookupFrozen implements lookup for a frozen cache, if the table is built.
+func (c *Cache) lookupFrozen(keyHash, conflictHash uint64) (interface{}, Presence, bool) {
+	m, _ := c.frozenMap.Load().(*frozenMap)
+	if m == nil {
+		return nil, Unknown, false
+	}
+	c.shadow.lookup(keyHash)
+	value, ok := m.get(keyHash, conflictHash, c.clock)
+	switch {
+	case !ok:
+		c.Metrics.add(miss, keyHash, 1)
+		return nil, Unknown, true
+	case value == Negative:
+		c.Metrics.add(negativeHits, keyHash, 1)
+		return nil, KnownAbsent, true
+	}
+	c.Metrics.add(hit, keyHash, 1)
+	return c.readValue(keyHash, value), Present, true
+}
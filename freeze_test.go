@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheFreeze(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	var exited int32
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+		OnExit: func(interface{}) {
+			atomic.AddInt32(&exited, 1)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 50; i++ {
+		require.True(t, c.Set(i, i*10, 1))
+	}
+	require.True(t, c.SetWithTTL("short", "lived", 1, time.Second))
+	require.True(t, c.SetNegative("gone", 0))
+	require.False(t, c.Frozen())
+	// The Sets still buffered make it in.
+	c.Freeze()
+	c.Freeze()
+	require.True(t, c.Frozen())
+
+	for i := 0; i < 50; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok, "key %d", i)
+		require.Equal(t, i*10, val)
+	}
+	_, ok := c.Get(50)
+	require.False(t, ok)
+	val, ok := c.GetLocal("short")
+	require.True(t, ok)
+	require.Equal(t, "lived", val)
+	_, presence := c.Lookup("gone")
+	require.Equal(t, KnownAbsent, presence)
+	values, found := c.GetMulti([]interface{}{1, nil, 50, 2})
+	require.Equal(t, []interface{}{10, nil, nil, 20}, values)
+	require.Equal(t, []bool{true, false, false, true}, found)
+	require.Equal(t, uint64(53), c.Metrics.Hits())
+
+	// Nothing writes anymore.
+	require.False(t, c.Set(1, "new", 1))
+	require.False(t, c.Set(100, "new", 1))
+	stored, _ := c.SetIfAbsent(100, "new", 1)
+	require.False(t, stored)
+	require.False(t, c.Update(1, func(interface{}, bool) (interface{}, bool) { return "new", true }))
+	require.Zero(t, c.Warm([]interface{}{101}, []interface{}{"new"}, []int64{1}))
+	_, ok = c.Del(1)
+	require.False(t, ok)
+	require.False(t, c.Touch(1, time.Hour))
+	val, ok = c.GetAndTouch(1, time.Hour)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	c.UpdateMaxCost(1)
+	require.Equal(t, int64(100), c.MaxCost())
+	require.Zero(t, c.EvictN(10))
+	c.Clear()
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, 10, val)
+	require.Equal(t, 52, c.Len())
+	require.Zero(t, atomic.LoadInt32(&exited))
+
+	// Items still expire, without being removed.
+	clock.Add(10 * time.Second)
+	_, ok = c.Get("short")
+	require.False(t, ok)
+	require.Zero(t, atomic.LoadInt32(&exited))
+}
+
+func TestCacheFreezeSetThrough(t *testing.T) {
+	s := &throughStore{}
+	c := newThroughCache(t, s)
+	defer c.Close()
+	require.NoError(t, c.SetThrough(1, "a", 1))
+	c.Freeze()
+	require.Equal(t, ErrFrozen, c.SetThrough(1, "b", 1))
+	val, _ := s.Get(1)
+	require.Equal(t, "a", val)
+}
+
+func TestCacheFreezeConcurrent(t *testing.T) {
+	for round := 0; round < 5; round++ {
+		var exited sync.Map
+		c, err := NewCache(&Config{
+			NumCounters:        10000,
+			MaxCost:            100,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			OnExit: func(val interface{}) {
+				exited.Store(val, true)
+			},
+		})
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := i % 200
+					// Every value is unique, so it's only let go once.
+					c.Set(key, fmt.Sprintf("%d-%d", g, i), 1)
+					if i%7 == 0 {
+						c.Del(key)
+					}
+				}
+			}(g)
+		}
+		time.Sleep(10 * time.Millisecond)
+		c.Freeze()
+		close(stop)
+		wg.Wait()
+
+		// The frozen table agrees with the store, and none of the values it
+		// serves have been let go.
+		n := 0
+		c.Range(func(item *Item) bool {
+			n++
+			val, ok := c.get(item.Key, item.Conflict)
+			require.True(t, ok)
+			require.Equal(t, item.Value, val)
+			_, gone := exited.Load(val)
+			require.False(t, gone, "value %v", val)
+			return true
+		})
+		require.Equal(t, c.Len(), n)
+		require.LessOrEqual(t, c.UsedCost(), int64(100))
+		c.Close()
+	}
+}
+
+func BenchmarkCacheGetFrozen(b *testing.B) {
+	for _, frozen := range []bool{false, true} {
+		b.Run(fmt.Sprintf("frozen=%v", frozen), func(b *testing.B) {
+			c, err := NewCache(&Config{
+				NumCounters: 1e5,
+				MaxCost:     1e4,
+				BufferItems: 64,
+			})
+			require.NoError(b, err)
+			defer c.Close()
+			for i := uint64(0); i < 1000; i++ {
+				c.SetUint(i, i, 1)
+			}
+			c.Wait()
+			if frozen {
+				c.Freeze()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := uint64(0); pb.Next(); i++ {
+					c.GetUint(i % 1000)
+				}
+			})
+		})
+	}
+}
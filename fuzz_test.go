@@ -0,0 +1,171 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fuzzMaxCost is the MaxCost of the cache fuzzed by FuzzCache.
+const fuzzMaxCost = 8
+
+// The operations FuzzCache decodes from its input, each from three bytes: the
+// operation, the key and an argument.
+const (
+	fuzzGet = iota
+	fuzzSet
+	fuzzSetWithTTL
+	fuzzDel
+	fuzzClear
+	fuzzEvictN
+	fuzzPin
+	fuzzTouch
+	fuzzWait
+	fuzzAdvance
+	numFuzzOps
+)
+
+// fuzzModel is what FuzzCache knows the cache should agree with.
+type fuzzModel struct {
+	sync.Mutex
+	// values holds every value ever Set for a key.
+	values map[int]map[int]bool
+	// sets counts the Sets of a key, and evictions the OnEvict calls for it,
+	// which can't outnumber them.
+	sets      map[int]int
+	evictions map[int]int
+}
+
+// set records a value about to be Set for the key.
+func (m *fuzzModel) set(key, value int) {
+	m.Lock()
+	defer m.Unlock()
+	if m.values[key] == nil {
+		m.values[key] = make(map[int]bool)
+	}
+	m.values[key][value] = true
+	m.sets[key]++
+}
+
+func (m *fuzzModel) evicted(t *testing.T, item *Item) {
+	m.Lock()
+	defer m.Unlock()
+	key := int(item.Key)
+	m.evictions[key]++
+	if m.evictions[key] > m.sets[key] {
+		t.Errorf("key %d evicted %d times after %d Sets", key, m.evictions[key], m.sets[key])
+	}
+}
+
+func (m *fuzzModel) checkValue(t *testing.T, key int, value interface{}) {
+	m.Lock()
+	defer m.Unlock()
+	v, ok := value.(int)
+	if !ok || !m.values[key][v] {
+		t.Fatalf("key %d has value %v, which was never Set for it", key, value)
+	}
+}
+
+func checkFuzzCost(t *testing.T, c *Cache) {
+	c.Wait()
+	if used := c.UsedCost(); used > fuzzMaxCost {
+		t.Fatalf("used cost is %d, over the MaxCost of %d", used, fuzzMaxCost)
+	}
+}
+
+// FuzzCache runs the operations decoded from its input on a small cache, and
+// checks the cache against a model of what it was told: Gets only return values
+// Set for their key, a deleted key is gone once Wait returns, the used cost
+// stays within MaxCost once Wait returns, and an item is evicted at most once
+// per Set. Try it with go test -fuzz FuzzCache.
+func FuzzCache(f *testing.F) {
+	f.Add([]byte{fuzzSet, 1, 1, fuzzGet, 1, 0, fuzzDel, 1, 0, fuzzGet, 1, 0})
+	f.Add([]byte{
+		fuzzSet, 1, 3, fuzzSet, 2, 3, fuzzSet, 3, 3, fuzzSet, 4, 3,
+		fuzzWait, 0, 0, fuzzEvictN, 0, 2, fuzzSet, 1, 0, fuzzWait, 0, 0,
+	})
+	f.Add([]byte{
+		fuzzSetWithTTL, 1, 1, fuzzPin, 1, 0, fuzzTouch, 1, 4,
+		fuzzAdvance, 0, 3, fuzzGet, 1, 0, fuzzClear, 0, 0, fuzzSet, 1, 1,
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &fuzzModel{
+			values:    make(map[int]map[int]bool),
+			sets:      make(map[int]int),
+			evictions: make(map[int]int),
+		}
+		clock := NewMockClock(time.Unix(1e9, 0))
+		c, err := NewCache(&Config{
+			NumCounters:        64,
+			MaxCost:            fuzzMaxCost,
+			BufferItems:        1,
+			IgnoreInternalCost: true,
+			Clock:              clock,
+			KeyToHash: func(key interface{}) (uint64, uint64) {
+				return uint64(key.(int)), 0
+			},
+			OnEvict: func(item *Item) { m.evicted(t, item) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		var next int
+		for ; len(data) >= 3; data = data[3:] {
+			op, key, arg := int(data[0])%numFuzzOps, int(data[1])%16, int(data[2])
+			switch op {
+			case fuzzGet:
+				if value, ok := c.Get(key); ok {
+					m.checkValue(t, key, value)
+				}
+			case fuzzSet, fuzzSetWithTTL:
+				next++
+				ttl := time.Duration(0)
+				if op == fuzzSetWithTTL {
+					ttl = time.Duration(arg%4+1) * time.Second
+				}
+				// The value is in the model before the cache can return it.
+				m.set(key, next)
+				c.SetWithTTL(key, next, int64(arg%4+1), ttl)
+			case fuzzDel:
+				c.Del(key)
+				c.Wait()
+				if value, ok := c.Peek(key); ok {
+					t.Fatalf("deleted key %d still has value %v", key, value)
+				}
+			case fuzzClear:
+				c.Clear()
+			case fuzzEvictN:
+				c.EvictN(arg % 4)
+			case fuzzPin:
+				c.Pin(key)
+			case fuzzTouch:
+				c.Touch(key, time.Duration(arg%4)*time.Second)
+			case fuzzWait:
+				checkFuzzCost(t, c)
+			case fuzzAdvance:
+				clock.Add(time.Duration(arg%8) * time.Second)
+			}
+		}
+		checkFuzzCost(t, c)
+	})
+}
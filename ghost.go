@@ -0,0 +1,177 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// GhostRegistry remembers keys that have left the cache, along with the cost
+// they had, for policies that tell apart the keys they've seen before, such as
+// ARC and 2Q. It only keeps 32-bit fingerprints of the keys, and at most a
+// fixed number of them, forgetting the oldest first, so its memory is bounded
+// whatever the keys. Two keys with the same fingerprint are taken for the
+// same key, which happens about Len times in 2^32.
+//
+// A GhostRegistry isn't safe for concurrent use; the Policy using it is
+// called by one goroutine at a time.
+type GhostRegistry struct {
+	// entries is a ring of the ghosts, the oldest at head. Removed ghosts
+	// leave holes, with a zero fingerprint, until they're the oldest.
+	entries []ghostEntry
+	head, n int
+	// first is the sequence number of the entry at head. index maps the
+	// fingerprints to the sequence number of their entry.
+	first    uint64
+	index    map[uint32]uint64
+	cost     int64
+	capacity int
+}
+
+type ghostEntry struct {
+	fingerprint uint32
+	cost        int64
+}
+
+// NewGhostRegistry returns an empty GhostRegistry holding up to capacity keys,
+// at least 1. Its memory grows with the keys it holds.
+func NewGhostRegistry(capacity int) *GhostRegistry {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &GhostRegistry{index: make(map[uint32]uint64), capacity: capacity}
+}
+
+// ghostFingerprint returns the fingerprint of a key, which is never 0.
+func ghostFingerprint(key uint64) uint32 {
+	f := uint32(key>>32) ^ uint32(key)
+	if f == 0 {
+		f = 1
+	}
+	return f
+}
+
+// entry returns the entry with the sequence number seq.
+func (g *GhostRegistry) entry(seq uint64) *ghostEntry {
+	return &g.entries[(g.head+int(seq-g.first))%len(g.entries)]
+}
+
+// Add remembers the key with the given cost, in place of what was remembered
+// for it, forgetting the oldest key if the registry is full.
+func (g *GhostRegistry) Add(key uint64, cost int64) {
+	g.Remove(key)
+	if g.n == g.capacity {
+		g.removeOldest()
+	}
+	if g.n == len(g.entries) {
+		g.grow()
+	}
+	f := ghostFingerprint(key)
+	seq := g.first + uint64(g.n)
+	g.n++
+	*g.entry(seq) = ghostEntry{fingerprint: f, cost: cost}
+	g.index[f] = seq
+	g.cost += cost
+}
+
+// grow doubles the room in the ring, up to the capacity.
+func (g *GhostRegistry) grow() {
+	size := 2 * len(g.entries)
+	if size == 0 {
+		size = 16
+	}
+	if size > g.capacity {
+		size = g.capacity
+	}
+	entries := make([]ghostEntry, size)
+	for i := 0; i < g.n; i++ {
+		entries[i] = *g.entry(g.first + uint64(i))
+	}
+	g.entries, g.head = entries, 0
+}
+
+// removeOldest forgets the oldest entry, and the holes after it.
+func (g *GhostRegistry) removeOldest() {
+	for oldest := true; g.n > 0; oldest = false {
+		e := &g.entries[g.head]
+		if e.fingerprint != 0 {
+			if !oldest {
+				return
+			}
+			delete(g.index, e.fingerprint)
+			g.cost -= e.cost
+		}
+		*e = ghostEntry{}
+		g.head = (g.head + 1) % len(g.entries)
+		g.first++
+		g.n--
+	}
+}
+
+// Lookup returns the cost remembered for the key, and whether it's
+// remembered.
+func (g *GhostRegistry) Lookup(key uint64) (int64, bool) {
+	seq, ok := g.index[ghostFingerprint(key)]
+	if !ok {
+		return 0, false
+	}
+	return g.entry(seq).cost, true
+}
+
+// Contains returns whether the key is remembered.
+func (g *GhostRegistry) Contains(key uint64) bool {
+	_, ok := g.index[ghostFingerprint(key)]
+	return ok
+}
+
+// Remove forgets the key, and returns whether it was remembered.
+func (g *GhostRegistry) Remove(key uint64) bool {
+	f := ghostFingerprint(key)
+	seq, ok := g.index[f]
+	if !ok {
+		return false
+	}
+	delete(g.index, f)
+	e := g.entry(seq)
+	g.cost -= e.cost
+	*e = ghostEntry{}
+	if seq == g.first {
+		g.removeOldest()
+	}
+	return true
+}
+
+// Trim forgets the oldest keys until the costs of the others add up to at most
+// maxCost.
+func (g *GhostRegistry) Trim(maxCost int64) {
+	for g.cost > maxCost && g.n > 0 {
+		g.removeOldest()
+	}
+}
+
+// Len returns the number of keys remembered.
+func (g *GhostRegistry) Len() int {
+	return len(g.index)
+}
+
+// Cost returns the sum of the costs of the keys remembered.
+func (g *GhostRegistry) Cost() int64 {
+	return g.cost
+}
+
+// Clear forgets every key.
+func (g *GhostRegistry) Clear() {
+	g.entries, g.head, g.n, g.first = nil, 0, 0, 0
+	g.index = make(map[uint32]uint64)
+	g.cost = 0
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGhostRegistry(t *testing.T) {
+	g := NewGhostRegistry(4)
+	for key := uint64(1); key <= 4; key++ {
+		g.Add(key, int64(key))
+	}
+	require.Equal(t, 4, g.Len())
+	require.Equal(t, int64(10), g.Cost())
+	cost, ok := g.Lookup(3)
+	require.True(t, ok)
+	require.Equal(t, int64(3), cost)
+
+	// The oldest key goes first.
+	g.Add(5, 5)
+	require.False(t, g.Contains(1))
+	require.True(t, g.Contains(2))
+	require.Equal(t, int64(14), g.Cost())
+
+	// Adding a key again replaces it, as the newest.
+	g.Add(2, 1)
+	require.Equal(t, 4, g.Len())
+	g.Add(6, 1)
+	require.False(t, g.Contains(3))
+	require.True(t, g.Contains(2))
+
+	require.True(t, g.Remove(4))
+	require.False(t, g.Remove(4))
+	require.False(t, g.Contains(4))
+	require.Equal(t, 3, g.Len())
+	require.Equal(t, int64(7), g.Cost())
+
+	// Trim goes from the oldest, skipping the holes.
+	g.Trim(2)
+	require.Equal(t, []bool{false, true, true}, []bool{g.Contains(5), g.Contains(2), g.Contains(6)})
+	require.Equal(t, int64(2), g.Cost())
+
+	g.Clear()
+	require.Zero(t, g.Len())
+	require.Zero(t, g.Cost())
+	require.False(t, g.Contains(6))
+}
+
+func TestGhostRegistryRing(t *testing.T) {
+	// Whatever the Adds and Removes, the registry holds the last keys added
+	// and not removed.
+	const capacity = 100
+	g := NewGhostRegistry(capacity)
+	r := rand.New(rand.NewSource(1))
+	// order has the keys added and not removed, the oldest first.
+	var order []uint64
+	for i := 0; i < 20000; i++ {
+		key := uint64(r.Intn(300)) + 1
+		order = removeKey(order, key)
+		if r.Intn(3) == 0 {
+			g.Remove(key)
+			require.False(t, g.Contains(key))
+		} else {
+			g.Add(key, 1)
+			order = append(order, key)
+		}
+		kept := 0
+		for j := len(order) - 1; j >= 0 && g.Contains(order[j]); j-- {
+			kept++
+		}
+		require.True(t, kept > 0 || len(order) == 0)
+		require.Equal(t, kept, g.Len())
+		require.Equal(t, int64(kept), g.Cost())
+		require.True(t, g.n <= capacity)
+		require.True(t, len(g.entries) <= capacity)
+	}
+}
+
+func removeKey(keys []uint64, key uint64) []uint64 {
+	for i, k := range keys {
+		if k == key {
+			return append(keys[:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+func TestGhostRegistryFalsePositives(t *testing.T) {
+	// With as many ghosts as a cache of a million keys would have, few keys
+	// that were never added are taken for ghosts.
+	const capacity = 1 << 20
+	g := NewGhostRegistry(capacity)
+	r := rand.New(rand.NewSource(1))
+	added := make(map[uint64]struct{}, capacity)
+	for len(added) < capacity {
+		key := r.Uint64()
+		added[key] = struct{}{}
+		g.Add(key, 1)
+	}
+	falsePositives := 0
+	const probes = 1 << 20
+	for i := 0; i < probes; i++ {
+		key := r.Uint64()
+		if _, ok := added[key]; !ok && g.Contains(key) {
+			falsePositives++
+		}
+	}
+	// The expected rate is capacity / 2^32, about 0.02%.
+	rate := float64(falsePositives) / probes
+	require.True(t, rate < 0.001, "false positive rate %.5f", rate)
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "time"
+
+// Entry is a key-value pair of SetGroup, with its cost as passed to Set.
+type Entry struct {
+	Key   interface{}
+	Value interface{}
+	Cost  int64
+	// TTL is the TTL of the item. If it's 0, the item expires after
+	// Config.DefaultTTL, like with Set.
+	TTL time.Duration
+}
+
+// itemGroup carries the items of a SetGroup through the Set buffer, and
+// receives whether they were stored.
+type itemGroup struct {
+	items []*Item
+	done  chan bool
+}
+
+// SetGroup stores all the entries or none of them, for values that are only
+// right together, such as an object and the indexes derived from it. The
+// group goes through admission as one: the policy decides on it as it would
+// for its most frequently read key, and evicts what the whole group needs.
+// The values are then written at once, so that Gets see the values of either
+// none or all of the group, although its items may still be evicted, deleted
+// or replaced one by one afterwards.
+//
+// If one entry can't be stored, for its cost, a conflict or the policy, none
+// is, and the policy is left as it was. Nothing is stored either for a nil
+// key, a key given twice or a negative TTL. SetGroup waits for the outcome,
+// and returns whether the entries were stored. The items have no tags, and
+// Config.Classes quotas are only enforced on the next Sets of their class.
+// A Set of one of the keys racing with SetGroup may leave either value.
+// Caches with Config.NewMap can't store groups, as their Map is read without
+// waiting for the writes of the cache.
+func (c *Cache) SetGroup(items []Entry) (stored bool) {
+	if c == nil || c.isClosed() || len(items) == 0 {
+		return false
+	}
+	if !c.beginWrite() {
+		return false
+	}
+	defer c.endWrite()
+	g := &itemGroup{items: make([]*Item, 0, len(items)), done: make(chan bool, 1)}
+	keys := make(map[uint64]struct{}, len(items))
+	now := c.clock.Now()
+	for _, entry := range items {
+		if entry.Key == nil || entry.TTL < 0 {
+			return false
+		}
+		ttl := entry.TTL
+		if ttl == 0 {
+			ttl = c.defaultTTL
+		}
+		var expiration int64
+		if ttl > 0 {
+			expiration = now.Add(ttl).Unix()
+		}
+		keyHash, conflictHash := c.keyToHash(entry.Key)
+		if _, ok := keys[keyHash]; ok {
+			return false
+		}
+		keys[keyHash] = struct{}{}
+		g.items = append(g.items, &Item{
+			Key:        keyHash,
+			Conflict:   conflictHash,
+			Value:      entry.Value,
+			Cost:       entry.Cost,
+			Expiration: expiration,
+			origKey:    entry.Key,
+		})
+	}
+	for _, i := range g.items {
+		if !c.groupCost(i) {
+			c.rejectGroup(g)
+			return false
+		}
+	}
+	for _, i := range g.items {
+		// The evicted value of the key, if kept, is stale now.
+		c.victims.drop(i.Key)
+	}
+	if !c.send(&Item{group: g}) {
+		return false
+	}
+	select {
+	case stored = <-g.done:
+		return stored
+	case <-c.done:
+		return false
+	}
+}
+
+// groupCost works out the cost of an item of a SetGroup or of the batch of a
+// SetMulti the same way processItems does, and returns false if the item can't
+// be stored.
+func (c *Cache) groupCost(i *Item) bool {
+	if !c.encodeItem(i) {
+		return false
+	}
+	if i.Cost == 0 && c.cost != nil {
+		if i.Cost = c.costOf(i.Value); i.Cost <= 0 {
+			c.Metrics.add(rejectCosts, i.Key, 1)
+			return false
+		}
+	}
+	if c.tooLarge(i) {
+		c.Metrics.add(rejectLarge, i.Key, 1)
+		return false
+	}
+	if i.Cost == 0 {
+		i.Cost = 1
+	}
+	i.Cost += c.internalCost
+	return true
+}
+
+// rejectGroup reports the items of a group that wasn't stored.
+func (c *Cache) rejectGroup(g *itemGroup) {
+	for _, i := range g.items {
+		c.publish(EventReject, i)
+		c.onReject(i)
+	}
+}
+
+// applyGroup stores the items of a SetGroup, if the policy admits them, and
+// reports the outcome. It's called by processItems, which passes its
+// evictVictims and trackAdmission.
+func (c *Cache) applyGroup(g *itemGroup, evictVictims func([]*Item) []*Item,
+	trackAdmission func(uint64)) {
+	n := len(g.items)
+	keys := make([]uint64, n)
+	costs := make([]int64, n)
+	var classes []string
+	for idx, i := range g.items {
+		keys[idx], costs[idx] = i.Key, i.Cost
+		if class := c.classOf(i); class != "" {
+			if classes == nil {
+				classes = make([]string, n)
+			}
+			classes[idx] = class
+		}
+	}
+	prev := make([]interface{}, n)
+	replaced := make([]bool, n)
+	var victims []*Item
+	stored := c.store.SetGroup(g.items, prev, replaced, func() bool {
+		var added bool
+		victims, added = c.policy.AddGroup(keys, costs, classes)
+		return added
+	})
+	if !stored {
+		// A group rejected once victims were evicted leaves them out.
+		evictVictims(victims)
+		c.rejectGroup(g)
+		g.done <- false
+		return
+	}
+	for idx, i := range g.items {
+		c.shadow.set(i.Key, i.Cost)
+		c.tags.set(i.Key, i.Conflict, nil)
+		c.ages.set(i.Key, c.idleSeconds(0))
+		c.backing.remember(i)
+		if replaced[idx] {
+			c.onExit(prev[idx])
+		} else {
+			c.Metrics.add(keyAdd, i.Key, 1)
+			trackAdmission(i.Key)
+		}
+	}
+	evictVictims(victims)
+	for idx, i := range g.items {
+		if replaced[idx] {
+			c.publish(EventUpdate, i)
+		} else {
+			c.publish(EventAdmit, i)
+		}
+	}
+	g.done <- true
+}
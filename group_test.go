@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newGroupCache(t *testing.T, policy func(int64, int64) Policy) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		MaxItemCost:        5,
+		Policy:             policy,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func groupOf(keys ...interface{}) []Entry {
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, Entry{Key: key, Value: fmt.Sprint(key, "-v"), Cost: 1})
+	}
+	return entries
+}
+
+func TestCacheSetGroup(t *testing.T) {
+	c := newGroupCache(t, nil)
+	defer c.Close()
+
+	require.True(t, c.SetGroup(groupOf("a", "b", "c")))
+	for _, key := range []string{"a", "b", "c"} {
+		val, ok := c.Get(key)
+		require.True(t, ok)
+		require.Equal(t, key+"-v", val)
+	}
+	require.Equal(t, int64(3), c.UsedCost())
+
+	// A group replaces the values of the keys already there.
+	group := groupOf("a", "d")
+	group[0].Value, group[0].Cost = "new", 2
+	require.True(t, c.SetGroup(group))
+	val, _ := c.Get("a")
+	require.Equal(t, "new", val)
+	require.Equal(t, int64(5), c.UsedCost())
+
+	// One entry too large rejects the whole group, with no trace in the
+	// policy.
+	group = groupOf("e", "f", "a")
+	group[1].Cost = 6
+	require.False(t, c.SetGroup(group))
+	for _, key := range []string{"e", "f"} {
+		_, ok := c.Get(key)
+		require.False(t, ok)
+		keyHash, _ := c.keyToHash(key)
+		require.False(t, c.policy.Has(keyHash))
+	}
+	val, _ = c.Get("a")
+	require.Equal(t, "new", val)
+	require.Equal(t, int64(5), c.UsedCost())
+
+	require.False(t, c.SetGroup(nil))
+	require.False(t, c.SetGroup(groupOf("e", nil)))
+	require.False(t, c.SetGroup(groupOf("e", "e")))
+	group = groupOf("e")
+	group[0].TTL = -1
+	require.False(t, c.SetGroup(group))
+	// The group as a whole can't cost more than MaxCost.
+	require.False(t, c.SetGroup(groupOf(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)))
+	_, ok := c.Get("e")
+	require.False(t, ok)
+	require.Equal(t, 4, c.Len())
+
+	c.Close()
+	require.False(t, c.SetGroup(groupOf("e")))
+	var nilCache *Cache
+	require.False(t, nilCache.SetGroup(groupOf("e")))
+}
+
+func TestCacheSetGroupEvict(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"lru":     NewLRUPolicy,
+		"slru":    NewSLRUPolicy,
+		"random":  NewRandomPolicy(1, 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var evicted []uint64
+			c, err := NewCache(&Config{
+				NumCounters:        1000,
+				MaxCost:            10,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+				OnEvict:            func(item *Item) { evicted = append(evicted, item.Key) },
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			// The oldest keys belong to the group, and grow, but the room is
+			// made among the others.
+			require.True(t, c.SetGroup(groupOf("a", "b")))
+			for i := 0; i < 8; i++ {
+				require.True(t, c.SetForce(i, i, 1))
+			}
+			c.Wait()
+			group := groupOf("a", "b", "c")
+			for i := range group {
+				group[i].Cost = 2
+			}
+			require.True(t, c.SetGroup(group))
+			for _, key := range []string{"a", "b", "c"} {
+				_, ok := c.Get(key)
+				require.True(t, ok, key)
+			}
+			require.Equal(t, int64(10), c.UsedCost())
+			require.Len(t, evicted, 4)
+			for _, key := range []string{"a", "b", "c"} {
+				keyHash, _ := c.keyToHash(key)
+				require.NotContains(t, evicted, keyHash)
+			}
+
+			// A pinned key is kept out of the victims, and a group that would
+			// only fit without the pinned keys is rejected as a whole.
+			require.True(t, c.Pin("a"))
+			require.True(t, c.Pin("b"))
+			require.False(t, c.SetGroup([]Entry{
+				{Key: "x", Value: 1, Cost: 4},
+				{Key: "y", Value: 1, Cost: 3},
+			}))
+			_, ok := c.Get("x")
+			require.False(t, ok)
+			_, ok = c.Get("c")
+			require.True(t, ok)
+			require.Equal(t, int64(10), c.UsedCost())
+		})
+	}
+}
+
+func TestCacheSetGroupAdmission(t *testing.T) {
+	// Gets are applied right away, so that none is dropped.
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		require.True(t, c.SetForce(i, i, 1))
+	}
+	c.Wait()
+	for n := 0; n < 5; n++ {
+		for i := 0; i < 10; i++ {
+			c.Get(i)
+		}
+	}
+	c.Flush()
+
+	// The new keys aren't worth the keys they would replace.
+	require.False(t, c.SetGroup(groupOf("a", "b")))
+	require.Equal(t, 10, c.Len())
+	_, ok := c.Get("a")
+	require.False(t, ok)
+
+	// One frequently read key takes the group in.
+	for n := 0; n < 10; n++ {
+		c.Get("a")
+	}
+	c.Flush()
+	require.True(t, c.SetGroup(groupOf("a", "b")))
+	for _, key := range []string{"a", "b"} {
+		_, ok := c.Get(key)
+		require.True(t, ok, key)
+	}
+	require.Equal(t, 10, c.Len())
+}
+
+func TestCacheSetGroupNewMap(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		NewMap:      NewSyncMap,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.False(t, c.SetGroup(groupOf("a", "b")))
+	_, ok := c.Get("a")
+	require.False(t, ok)
+}
+
+func TestCacheSetGroupConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	const keys = 8
+	group := func(gen int) []Entry {
+		entries := make([]Entry, keys)
+		for k := range entries {
+			entries[k] = Entry{Key: k, Value: gen, Cost: 1}
+		}
+		return entries
+	}
+	require.True(t, c.SetGroup(group(0)))
+
+	// Gets made one after the other see the same generation, or a later one,
+	// in whatever order they go over the keys.
+	var stop int32
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(reverse bool) {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				last := -1
+				for k := 0; k < keys; k++ {
+					key := k
+					if reverse {
+						key = keys - 1 - k
+					}
+					val, ok := c.Get(key)
+					require.True(t, ok)
+					gen := val.(int)
+					require.GreaterOrEqual(t, gen, last, "key %d", key)
+					last = gen
+				}
+			}
+		}(r%2 == 1)
+	}
+	for gen := 1; gen <= 2000; gen++ {
+		require.True(t, c.SetGroup(group(gen)))
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+}
@@ -0,0 +1,67 @@
+//go:build !race
+// +build !race
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The race detector makes the heap grow on its own, and takes several times the
+// memory of the million items, so the heap is only measured without it.
+
+func TestCacheInternalCostHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sets a million items")
+	}
+	const n = 1000000
+	c, err := NewCache(&Config{
+		NumCounters: 10 * n,
+		MaxCost:     1 << 40,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for i := 0; i < n; i++ {
+		for !c.Set(uint64(i), true, 1) {
+			c.Wait()
+		}
+	}
+	c.Wait()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	require.Equal(t, n, c.Len())
+
+	// The values take no memory of their own, so what the cache takes is all
+	// internal cost. The estimate doesn't follow every doubling of the maps,
+	// hence the slack.
+	growth := float64(after.HeapAlloc) - float64(before.HeapAlloc)
+	used := float64(c.UsedCost())
+	require.InEpsilon(t, growth, used, 0.3, "heap growth %.0f, used cost %.0f", growth, used)
+	require.Equal(t, uint64(n)*uint64(c.internalCost), c.Metrics.InternalCostAdded())
+	require.Equal(t, uint64(n), c.Metrics.CostAdded()-c.Metrics.InternalCostAdded())
+}
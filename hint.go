@@ -0,0 +1,47 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// Hint tells the cache that the keys are likely to be Set soon, such as the
+// next page of results, so that they compete for admission like keys that
+// have been asked for rather than never-seen ones. It records an access of
+// each key with the admission policy, without looking the keys up, and
+// without counting hits or misses.
+//
+// Hints only raise the estimated frequency of a key up to Config.HintWeight,
+// however many times it's hinted, and the estimates age like those of Gets, so
+// hints can't keep a key around on their own. They're counted by
+// Metrics.Hints.
+func (c *Cache) Hint(keys ...interface{}) {
+	if c == nil || c.isClosed() || len(keys) == 0 {
+		return
+	}
+	hashes := make([]uint64, 0, len(keys))
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		keyHash, _ := c.keyToHash(key)
+		hashes = append(hashes, keyHash)
+	}
+	if len(hashes) == 0 {
+		return
+	}
+	if raised := c.policy.Hint(hashes, c.hintWeight); raised > 0 {
+		c.Metrics.add(hints, hashes[0], uint64(raised))
+	}
+}
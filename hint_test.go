@@ -0,0 +1,66 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheHint(t *testing.T) {
+	for _, weight := range []int64{0, 3} {
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            4,
+			IgnoreInternalCost: true,
+			Synchronous:        true,
+			Metrics:            true,
+			HintWeight:         weight,
+		})
+		require.NoError(t, err)
+		for i := 1; i <= 4; i++ {
+			require.True(t, c.Set(i, i, 1))
+			c.Get(i)
+		}
+
+		// A key that was never seen loses to the keys in the cache, and the
+		// same key hinted beforehand wins.
+		c.Set(5, 5, 1)
+		_, ok := c.Peek(5)
+		require.False(t, ok)
+		c.Hint(6, nil)
+		c.Set(6, 6, 1)
+		_, ok = c.Peek(6)
+		require.True(t, ok)
+
+		// Hints only go up to the weight.
+		for i := 0; i < 10; i++ {
+			c.Hint(7)
+		}
+		max := weight
+		if max == 0 {
+			max = 1
+		}
+		keyHash, _ := c.keyToHash(7)
+		require.Equal(t, max, c.policy.Frequency(keyHash))
+		require.Equal(t, uint64(max+1), c.Metrics.Hints())
+		require.Equal(t, uint64(4), c.Metrics.Hits())
+		require.Equal(t, uint64(0), c.Metrics.Misses())
+		c.Close()
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// defaultCostBuckets are the bounds of the buckets of Metrics.CostHistogram
+// when Config.CostBuckets is empty: the powers of two from 64 to 64M.
+var defaultCostBuckets = func() []int64 {
+	var bounds []int64
+	for b := int64(64); b <= 64<<20; b <<= 1 {
+		bounds = append(bounds, b)
+	}
+	return bounds
+}()
+
+// CostHistogram is the distribution of the costs of the items admitted to the
+// cache, as returned by Metrics.CostHistogram. Updates of the cost of an item
+// already in the cache aren't counted.
+type CostHistogram struct {
+	// Bounds are the inclusive upper bounds of the buckets, in ascending
+	// order.
+	Bounds []int64
+	// Counts holds the number of items of every bucket, the items costing
+	// more than the previous bound and up to Bounds[i] for Counts[i]. The
+	// last bucket, with no bound, holds the items costing more than every
+	// bound.
+	Counts []uint64
+	// Count is the number of items, and Sum the sum of their costs.
+	Count uint64
+	Sum   uint64
+}
+
+// costHistogram counts the costs of the admitted items. Admissions are
+// counted by the goroutine of the policy, or under its lock, so the counters
+// aren't striped.
+type costHistogram struct {
+	bounds []int64
+	counts []uint64
+	sum    uint64
+}
+
+func newCostHistogram(bounds []int64) *costHistogram {
+	if len(bounds) == 0 {
+		bounds = defaultCostBuckets
+	}
+	return &costHistogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *costHistogram) add(cost int64) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return h.bounds[i] >= cost })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(cost))
+}
+
+func (h *costHistogram) get() CostHistogram {
+	hist := CostHistogram{
+		Bounds: append([]int64(nil), h.bounds...),
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    atomic.LoadUint64(&h.sum),
+	}
+	for i := range h.counts {
+		hist.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		hist.Count += hist.Counts[i]
+	}
+	return hist
+}
+
+func (h *costHistogram) clear() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.sum, 0)
+}
+
+// validCostBuckets returns whether the bounds are positive and ascending.
+func validCostBuckets(bounds []int64) bool {
+	for i, b := range bounds {
+		if b <= 0 || (i > 0 && b <= bounds[i-1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// CostHistogram returns the distribution of the costs of the items admitted,
+// in the buckets of Config.CostBuckets.
+func (p *Metrics) CostHistogram() CostHistogram {
+	if p == nil {
+		return CostHistogram{}
+	}
+	return p.costs.get()
+}
+
+// trackCost counts the cost of an admitted item.
+func (p *Metrics) trackCost(cost int64) {
+	if p == nil {
+		return
+	}
+	p.costs.add(cost)
+}
+
+// writePromHistogram writes the histogram of the admitted costs in the
+// Prometheus text exposition format, with the labels of the cache.
+func (c *Cache) writePromHistogram(buf *bytes.Buffer) {
+	const name = "cache_cost_admitted"
+	hist := c.Metrics.CostHistogram()
+	if c.Metrics == nil {
+		// Serve empty buckets, like the counters staying at zero.
+		hist = newCostHistogram(nil).get()
+	}
+	fmt.Fprintf(buf, "# HELP %s Costs of the keys admitted.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+	labels := func(le string) string {
+		if c.metricsLabels == "" {
+			return `{le="` + le + `"}`
+		}
+		return c.metricsLabels[:len(c.metricsLabels)-1] + `,le="` + le + `"}`
+	}
+	var total uint64
+	for i, bound := range hist.Bounds {
+		total += hist.Counts[i]
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, labels(strconv.FormatInt(bound, 10)), total)
+	}
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", name, labels("+Inf"), hist.Count)
+	fmt.Fprintf(buf, "%s_sum%s %d\n", name, c.metricsLabels, hist.Sum)
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, c.metricsLabels, hist.Count)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsCostHistogram(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"lru":     NewLRUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        100,
+				MaxCost:            1e4,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Metrics:            true,
+				CostBuckets:        []int64{10, 100, 1000},
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i, cost := range []int64{1, 10, 11, 100, 5000} {
+				require.True(t, c.SetForce(i, i, cost))
+			}
+			c.Wait()
+			// Updates aren't admissions.
+			require.True(t, c.Set(0, 0, 50))
+			c.Wait()
+
+			hist := c.Metrics.CostHistogram()
+			require.Equal(t, []int64{10, 100, 1000}, hist.Bounds)
+			require.Equal(t, []uint64{2, 2, 0, 1}, hist.Counts)
+			require.Equal(t, uint64(5), hist.Count)
+			require.Equal(t, uint64(5122), hist.Sum)
+
+			c.Metrics.Clear()
+			hist = c.Metrics.CostHistogram()
+			require.Equal(t, []uint64{0, 0, 0, 0}, hist.Counts)
+			require.Zero(t, hist.Sum)
+		})
+	}
+}
+
+func TestMetricsCostHistogramDefault(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1 << 30,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.SetForce(1, 1, 64))
+	require.True(t, c.SetForce(2, 2, 65))
+	require.True(t, c.SetForce(3, 3, 64<<20+1))
+	c.Wait()
+	hist := c.Metrics.CostHistogram()
+	require.Len(t, hist.Bounds, 21)
+	require.Equal(t, int64(64), hist.Bounds[0])
+	require.Equal(t, int64(64<<20), hist.Bounds[20])
+	require.Equal(t, uint64(1), hist.Counts[0])
+	require.Equal(t, uint64(1), hist.Counts[1])
+	require.Equal(t, uint64(1), hist.Counts[21])
+
+	var nilMetrics *Metrics
+	require.Empty(t, nilMetrics.CostHistogram().Counts)
+}
+
+func TestMetricsCostHistogramConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{CostBuckets: []int64{0, 10}, Metrics: true},
+		{CostBuckets: []int64{10, 10}, Metrics: true},
+		{CostBuckets: []int64{100, 10}, Metrics: true},
+		{CostBuckets: []int64{10}},
+	} {
+		config.NumCounters = 100
+		config.MaxCost = 10
+		config.BufferItems = 64
+		_, err := NewCache(config)
+		require.Error(t, err, "%v", config.CostBuckets)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// hyperbolicSamples is the number of keys a hyperbolic policy samples to pick
+// a victim.
+const hyperbolicSamples = 64
+
+// hyperbolicPolicy is a hyperbolic caching policy. Every key is scored by the
+// number of times it's been accessed over the time it's been in the cache,
+// times its priority, and the victim is the key with the lowest score among a
+// sample. Unlike with LFU, a key that's been popular once doesn't stay forever,
+// as its score decays with its age, and a key with a high priority, such as one
+// that's expensive to compute again, outlives more popular keys. Every
+// candidate is admitted.
+//
+// Time is counted in Adds and accesses, so that the scores don't depend on
+// how fast the traffic comes.
+type hyperbolicPolicy struct {
+	entries map[uint64]*hyperbolicEntry
+	samples int
+	now     int64
+}
+
+type hyperbolicEntry struct {
+	// inserted is the time the key was added, and hits its number of
+	// accesses, counting the Add.
+	inserted int64
+	hits     int64
+	priority float64
+}
+
+// NewHyperbolicPolicy returns a hyperbolic caching Policy, which picks its
+// victims by how often keys are accessed since they were added, weighted by the
+// priority given to Cache.SetWithOptions. It can be used as Config.Policy.
+func NewHyperbolicPolicy(numCounters, maxCost int64) Policy {
+	return &hyperbolicPolicy{
+		entries: make(map[uint64]*hyperbolicEntry),
+		samples: hyperbolicSamples,
+	}
+}
+
+func (p *hyperbolicPolicy) Add(key uint64, cost int64) {
+	p.now++
+	p.entries[key] = &hyperbolicEntry{inserted: p.now, hits: 1, priority: 1}
+}
+
+func (p *hyperbolicPolicy) Update(key uint64, cost int64) {}
+
+func (p *hyperbolicPolicy) SetPriority(key uint64, priority float64) {
+	if e, ok := p.entries[key]; ok {
+		e.priority = priority
+	}
+}
+
+func (p *hyperbolicPolicy) Del(key uint64) {
+	delete(p.entries, key)
+}
+
+func (p *hyperbolicPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		p.now++
+		if e, ok := p.entries[key]; ok {
+			e.hits++
+		}
+	}
+}
+
+// score returns the priority of the key to stay in the cache.
+func (p *hyperbolicPolicy) score(e *hyperbolicEntry) float64 {
+	// A key added just now has been in the cache for one unit of time.
+	age := p.now - e.inserted + 1
+	return e.priority * float64(e.hits) / float64(age)
+}
+
+func (p *hyperbolicPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+// EvictSkipping leaves the skipped keys out of the sample.
+func (p *hyperbolicPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	var victim uint64
+	var lowest *hyperbolicEntry
+	n := 0
+	// Go randomizes the order of map iteration, which makes for the sample.
+	for key, e := range p.entries {
+		if skip != nil && skip(key) {
+			continue
+		}
+		if lowest == nil || p.score(e) < p.score(lowest) {
+			victim, lowest = key, e
+		}
+		if n++; n == p.samples {
+			break
+		}
+	}
+	if lowest == nil {
+		return 0, false
+	}
+	delete(p.entries, victim)
+	return victim, true
+}
+
+func (p *hyperbolicPolicy) Resize(maxCost int64) {}
+
+func (p *hyperbolicPolicy) Clear() {
+	p.entries = make(map[uint64]*hyperbolicEntry)
+	p.now = 0
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperbolicPolicy(t *testing.T) {
+	p := NewHyperbolicPolicy(100, 2).(*hyperbolicPolicy)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	for i := 0; i < 10; i++ {
+		p.Access([]uint64{2})
+	}
+	victim, ok := p.Evict(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+
+	// With a high enough priority, the cold key outlives the hot one.
+	p.Add(1, 1)
+	p.SetPriority(1, 1000)
+	p.SetPriority(4, 1000)
+	victim, ok = p.Evict(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), victim)
+
+	p.Del(1)
+	_, ok = p.Evict(3)
+	require.False(t, ok)
+}
+
+func TestHyperbolicPolicyDecay(t *testing.T) {
+	p := NewHyperbolicPolicy(100, 2).(*hyperbolicPolicy)
+	p.Add(1, 1)
+	for i := 0; i < 5; i++ {
+		p.Access([]uint64{1})
+	}
+	// Time passes with accesses to other keys.
+	for i := 0; i < 1000; i++ {
+		p.Access([]uint64{100})
+	}
+	p.Add(2, 1)
+	p.Access([]uint64{2, 2})
+	// 1 has been accessed more, but long ago.
+	victim, ok := p.Evict(3)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+
+	p.Clear()
+	require.Empty(t, p.entries)
+	require.Zero(t, p.now)
+}
+
+func TestCacheHyperbolicPolicy(t *testing.T) {
+	for _, priority := range []float64{0, 1000} {
+		c, err := NewCache(&Config{
+			NumCounters:        100,
+			MaxCost:            2,
+			BufferItems:        64,
+			BufferMode:         BufferLossless,
+			IgnoreInternalCost: true,
+			Policy:             NewHyperbolicPolicy,
+		})
+		require.NoError(t, err)
+		// 1 is expensive to compute again, and rarely used, while 2 is
+		// cheap and hot.
+		require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{Priority: priority}))
+		require.True(t, c.Set(2, 2, 1))
+		c.Wait()
+		for i := 0; i < 10; i++ {
+			c.Get(2)
+		}
+		c.Flush()
+		require.True(t, c.SetForce(3, 3, 1))
+		c.Wait()
+		_, ok1 := c.Get(1)
+		_, ok2 := c.Get(2)
+		if priority == 0 {
+			require.False(t, ok1)
+			require.True(t, ok2)
+		} else {
+			require.True(t, ok1)
+			require.False(t, ok2)
+		}
+		c.Close()
+	}
+}
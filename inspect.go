@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// EntryInfo is what the cache knows about a key, as returned by
+// Cache.EntryInfo. The fields the policy can't tell are left zero, with their
+// flag unset.
+type EntryInfo struct {
+	// Cost is the cost of the item charged by the policy.
+	Cost int64
+	// TTL is the time left before the item expires, or 0 if it never does.
+	TTL time.Duration
+	// Frequency is the estimated number of recent Gets of the key, as used
+	// for admission, if HasFrequency is set. Keys not in the cache may have
+	// one too.
+	Frequency    int64
+	HasFrequency bool
+	// Position is the rank of the key among the Positions keys tracked by the
+	// policy, in the order they would be evicted, 0 being the next victim, if
+	// HasPosition is set.
+	Position    int
+	Positions   int
+	HasPosition bool
+}
+
+// InspectablePolicy is a Policy that can tell Cache.EntryInfo where a key
+// stands. Inspect is called, like the other methods, under the lock of the
+// cache policy, and fills in the fields of info it knows about, along with
+// their flags.
+type InspectablePolicy interface {
+	Policy
+	Inspect(key uint64, info *EntryInfo)
+}
+
+// EntryInfo returns what the cache knows about the key, and whether it's in
+// the cache and not expired. The access frequency is filled in for missing
+// keys too, if the policy keeps one, to tell why a key isn't admitted.
+//
+// EntryInfo is meant for debugging: it briefly takes the lock of the policy,
+// and may walk its keys, but it isn't recorded as a Get nor counted in the
+// metrics. The Gets still in the buffers aren't taken into account.
+func (c *Cache) EntryInfo(key interface{}) (EntryInfo, bool) {
+	var info EntryInfo
+	if c == nil || c.isClosed() || key == nil {
+		return info, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.policy.Inspect(keyHash, &info)
+	if _, ok := c.store.Get(keyHash, conflictHash); !ok {
+		return info, false
+	}
+	if cost := c.policy.Cost(keyHash); cost >= 0 {
+		info.Cost = cost
+	}
+	if expiration := c.store.Expiration(keyHash); expiration != 0 {
+		ttl := time.Unix(expiration, 0).Sub(c.clock.Now())
+		if ttl <= 0 {
+			return info, false
+		}
+		info.TTL = ttl
+	}
+	return info, true
+}
+
+// KeyFreq is a key returned by Cache.TopKeys, with its estimated access
+// frequency and its cost.
+type KeyFreq struct {
+	// Key is the hash of the key, as seen by Range.
+	Key       uint64
+	Frequency int64
+	Cost      int64
+}
+
+// TopKeys returns the k keys of the items in the cache with the highest
+// estimated access frequency, hottest first, as told by the policy like for
+// EntryInfo. It returns nil if the cache is empty or the policy keeps no
+// frequencies, such as the LRU policy. Keys with the same estimate come in no
+// particular order, and as the estimates are small saturating counters, the
+// hottest keys often share the same one.
+//
+// TopKeys is meant for debugging: it goes over every key of the policy while
+// holding its lock, which stalls the Sets and the Gets handed to the policy
+// meanwhile.
+func (c *Cache) TopKeys(k int) []KeyFreq {
+	if c == nil || c.isClosed() || k <= 0 {
+		return nil
+	}
+	return c.policy.TopKeys(k)
+}
+
+// EstimateFrequency returns the estimated access frequency of the key, as the
+// policy uses it to admit keys, without counting it as an access, for callers
+// that want to tell hot keys apart. It's 0 for keys the policy hasn't seen
+// since its counters were last aged, and for policies keeping no frequencies:
+// custom policies have to be an InspectablePolicy filling in
+// EntryInfo.Frequency. The estimates are small saturating counters, halved
+// whenever the policy ages them.
+//
+// The counters of the default policy are read without taking any lock, so
+// that it can be called on every request. A custom policy is asked under the
+// lock of the policy.
+func (c *Cache) EstimateFrequency(key interface{}) uint64 {
+	if c == nil || c.isClosed() || key == nil {
+		return 0
+	}
+	keyHash, _ := c.keyToHash(key)
+	return uint64(c.policy.Estimate(keyHash))
+}
+
+func (p *defaultPolicy) Estimate(key uint64) int64 {
+	if p.admit != nil {
+		// The counters are read atomically.
+		return p.admit.Estimate(key)
+	}
+	custom, ok := p.custom.(InspectablePolicy)
+	if !ok {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	var info EntryInfo
+	custom.Inspect(key, &info)
+	return info.Frequency
+}
+
+// keyFreqHeap is a min-heap of keys by frequency.
+type keyFreqHeap []KeyFreq
+
+func (h keyFreqHeap) Len() int            { return len(h) }
+func (h keyFreqHeap) Less(i, j int) bool  { return h[i].Frequency < h[j].Frequency }
+func (h keyFreqHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyFreqHeap) Push(x interface{}) { *h = append(*h, x.(KeyFreq)) }
+func (h *keyFreqHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func (p *defaultPolicy) TopKeys(k int) []KeyFreq {
+	p.Lock()
+	defer p.Unlock()
+	custom, _ := p.custom.(InspectablePolicy)
+	if p.admit == nil && custom == nil {
+		return nil
+	}
+	top := make(keyFreqHeap, 0, k)
+	for key, cost := range p.evict.keyCosts {
+		var freq int64
+		if p.admit != nil {
+			freq = p.admit.Estimate(key)
+		} else {
+			var info EntryInfo
+			custom.Inspect(key, &info)
+			if !info.HasFrequency {
+				return nil
+			}
+			freq = info.Frequency
+		}
+		switch {
+		case len(top) < k:
+			heap.Push(&top, KeyFreq{Key: key, Frequency: freq, Cost: cost})
+		case freq > top[0].Frequency:
+			top[0] = KeyFreq{Key: key, Frequency: freq, Cost: cost}
+			heap.Fix(&top, 0)
+		}
+	}
+	if len(top) == 0 {
+		return nil
+	}
+	sort.Slice(top, func(i, j int) bool { return top[i].Frequency > top[j].Frequency })
+	return top
+}
+
+func (p *defaultPolicy) Inspect(key uint64, info *EntryInfo) {
+	p.Lock()
+	defer p.Unlock()
+	if p.admit != nil {
+		info.Frequency = p.admit.Estimate(key)
+		info.HasFrequency = true
+		return
+	}
+	if custom, ok := p.custom.(InspectablePolicy); ok {
+		custom.Inspect(key, info)
+	}
+}
+
+func (p *lruPolicy) Inspect(key uint64, info *EntryInfo) {
+	if _, ok := p.elems[key]; !ok {
+		return
+	}
+	info.Positions = p.list.Len()
+	info.HasPosition = true
+	for elem := p.list.Back(); elem.Value.(uint64) != key; elem = elem.Prev() {
+		info.Position++
+	}
+}
+
+func (p *wtinyLFUPolicy) Inspect(key uint64, info *EntryInfo) {
+	info.Frequency = p.admit.Estimate(key)
+	info.HasFrequency = true
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheEntryInfo(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithTTL(1, "one", 3, time.Minute))
+	require.True(t, c.Set(2, "two", 1))
+	c.Wait()
+	for i := 0; i < 4; i++ {
+		c.Get(1)
+	}
+	c.Flush()
+
+	info, ok := c.EntryInfo(1)
+	require.True(t, ok)
+	require.Equal(t, int64(3), info.Cost)
+	require.Equal(t, time.Minute, info.TTL)
+	require.True(t, info.HasFrequency)
+	require.Equal(t, int64(4), info.Frequency)
+	require.False(t, info.HasPosition)
+	info, ok = c.EntryInfo(2)
+	require.True(t, ok)
+	require.Equal(t, int64(1), info.Cost)
+	require.Zero(t, info.TTL)
+
+	// Asking doesn't count as a Get.
+	hits := c.Metrics.Hits()
+	for i := 0; i < 10; i++ {
+		c.EntryInfo(1)
+	}
+	c.Flush()
+	require.Equal(t, hits, c.Metrics.Hits())
+	info, _ = c.EntryInfo(1)
+	require.Equal(t, int64(4), info.Frequency)
+
+	// Missing keys still have a frequency.
+	c.Get(3)
+	c.Flush()
+	info, ok = c.EntryInfo(3)
+	require.False(t, ok)
+	require.Equal(t, int64(1), info.Frequency)
+	require.Zero(t, info.Cost)
+
+	clock.Add(2 * time.Minute)
+	_, ok = c.EntryInfo(1)
+	require.False(t, ok)
+}
+
+func TestCacheEntryInfoPosition(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Policy:             NewLRUPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		require.True(t, c.Set(i, i, 1))
+		c.Wait()
+	}
+	c.Get(0)
+	c.Flush()
+
+	for key, pos := range map[int]int{1: 0, 2: 1, 4: 3, 0: 4} {
+		info, ok := c.EntryInfo(key)
+		require.True(t, ok)
+		require.True(t, info.HasPosition)
+		require.Equal(t, pos, info.Position, "key %d", key)
+		require.Equal(t, 5, info.Positions)
+		require.False(t, info.HasFrequency)
+	}
+	// The LRU policy gives no frequency, and no position for missing keys.
+	info, ok := c.EntryInfo(5)
+	require.False(t, ok)
+	require.Equal(t, EntryInfo{}, info)
+
+	c, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Policy:      NewWTinyLFUPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	info, _ = c.EntryInfo(1)
+	require.True(t, info.HasFrequency)
+}
+
+func TestCacheTopKeys(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default":  nil,
+		"wtinylfu": NewWTinyLFUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        1e4,
+				MaxCost:            2000,
+				BufferItems:        64,
+				BufferMode:         BufferLossless,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 1000; i++ {
+				require.True(t, c.SetForce(i, i, int64(i%3+1)))
+			}
+			c.Wait()
+			zipf := rand.NewZipf(rand.New(rand.NewSource(1)), 1.5, 1, 999)
+			for i := 0; i < 200; i++ {
+				c.Get(int(zipf.Uint64()))
+			}
+			c.Flush()
+
+			top := c.TopKeys(3)
+			require.Len(t, top, 3)
+			hottest, _ := c.keyToHash(0)
+			var found bool
+			for i, kf := range top {
+				if i > 0 {
+					require.True(t, kf.Frequency <= top[i-1].Frequency)
+				}
+				info, ok := c.EntryInfo(0)
+				if kf.Key == hottest {
+					require.True(t, ok)
+					require.Equal(t, info.Frequency, kf.Frequency)
+					require.Equal(t, int64(1), kf.Cost)
+					found = true
+				}
+			}
+			require.True(t, found, "%v", top)
+			require.Len(t, c.TopKeys(2000), 1000)
+		})
+	}
+
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             NewLRUPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	require.Nil(t, c.TopKeys(1))
+}
+
+func TestCacheEstimateFrequency(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.Zero(t, c.EstimateFrequency(1))
+	require.Zero(t, c.EstimateFrequency(nil))
+	var last uint64
+	for i := 0; i < 10; i++ {
+		c.Get(1)
+		est := c.EstimateFrequency(1)
+		require.Greater(t, est, last)
+		last = est
+	}
+	// Estimating isn't an access.
+	require.Equal(t, last, c.EstimateFrequency(1))
+	require.Equal(t, uint64(10), last)
+
+	// Once the counters are aged, the estimate is halved.
+	for i := 0; i < 990; i++ {
+		c.Get(2)
+	}
+	require.LessOrEqual(t, c.EstimateFrequency(1), last/2)
+	require.NotZero(t, c.EstimateFrequency(1))
+
+	var nilCache *Cache
+	require.Zero(t, nilCache.EstimateFrequency(1))
+}
+
+func TestCacheEstimateFrequencyCustomPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy func(numCounters, maxCost int64) Policy
+		counts bool
+	}{
+		{"lru", NewLRUPolicy, false},
+		{"wtinylfu", NewWTinyLFUPolicy, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        1000,
+				MaxCost:            10,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Synchronous:        true,
+				Policy:             tc.policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			require.True(t, c.Set(1, 1, 1))
+			for i := 0; i < 5; i++ {
+				c.Get(1)
+			}
+			require.Equal(t, tc.counts, c.EstimateFrequency(1) > 0)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// LatencyPhase is a step of the operations timed with Config.SampleLatency.
+type LatencyPhase int
+
+const (
+	// PhaseMapLookup is the lookup of the key in the store, by a Get or by a
+	// Set updating a value.
+	PhaseMapLookup LatencyPhase = iota
+	// PhaseBufferPush is the hand-off of a Get to the Get buffer, or of a Set
+	// to the Set buffer.
+	PhaseBufferPush
+	// PhasePolicy is the admission of a new key by the policy, evictions
+	// included, on the goroutine applying the Sets.
+	PhasePolicy
+	// PhaseCallback is a call of a callback of the Config, such as OnEvict.
+	PhaseCallback
+	numLatencyPhases
+)
+
+var latencyPhaseNames = [numLatencyPhases]string{
+	PhaseMapLookup:  "map_lookup",
+	PhaseBufferPush: "buffer_push",
+	PhasePolicy:     "policy",
+	PhaseCallback:   "callback",
+}
+
+// String returns the name of the phase, as used by MetricsHandler and
+// DebugHandler.
+func (p LatencyPhase) String() string {
+	if p < 0 || p >= numLatencyPhases {
+		return fmt.Sprintf("LatencyPhase(%d)", int(p))
+	}
+	return latencyPhaseNames[p]
+}
+
+// latencySubBits sets the precision of the latency histograms: every power of
+// two is split into 1<<latencySubBits buckets, so a duration is known within
+// 12.5%, like in an HDR histogram.
+const latencySubBits = 3
+
+// latencyBuckets is the number of buckets needed for every uint64.
+const latencyBuckets = (64 - latencySubBits + 1) << latencySubBits
+
+// latencyBucket returns the bucket of a duration in nanoseconds.
+func latencyBucket(ns uint64) int {
+	if ns < 1<<latencySubBits {
+		return int(ns)
+	}
+	exp := uint(bits.Len64(ns) - 1)
+	sub := int(ns>>(exp-latencySubBits)) & (1<<latencySubBits - 1)
+	return int(exp-latencySubBits+1)<<latencySubBits + sub
+}
+
+// latencyBucketMax returns the largest duration in nanoseconds of a bucket.
+func latencyBucketMax(b int) uint64 {
+	if b < 1<<latencySubBits {
+		return uint64(b)
+	}
+	exp := uint(b>>latencySubBits) + latencySubBits - 1
+	sub := uint64(b & (1<<latencySubBits - 1))
+	width := uint64(1) << (exp - latencySubBits)
+	return (1<<latencySubBits+sub)*width + width - 1
+}
+
+// latencyHistogram counts the durations of a phase. It's updated atomically,
+// as only the sampled operations write to it.
+type latencyHistogram struct {
+	counts [latencyBuckets]uint64
+	sum    uint64
+	max    uint64
+}
+
+func (h *latencyHistogram) add(d time.Duration) {
+	ns := uint64(d)
+	if d < 0 {
+		ns = 0
+	}
+	atomic.AddUint64(&h.counts[latencyBucket(ns)], 1)
+	atomic.AddUint64(&h.sum, ns)
+	for {
+		max := atomic.LoadUint64(&h.max)
+		if ns <= max || atomic.CompareAndSwapUint64(&h.max, max, ns) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) get() LatencyHistogram {
+	hist := LatencyHistogram{
+		Sum:    time.Duration(atomic.LoadUint64(&h.sum)),
+		Max:    time.Duration(atomic.LoadUint64(&h.max)),
+		counts: make([]uint64, latencyBuckets),
+	}
+	for i := range h.counts {
+		hist.counts[i] = atomic.LoadUint64(&h.counts[i])
+		hist.Count += hist.counts[i]
+	}
+	return hist
+}
+
+func (h *latencyHistogram) clear() {
+	for i := range h.counts {
+		atomic.StoreUint64(&h.counts[i], 0)
+	}
+	atomic.StoreUint64(&h.sum, 0)
+	atomic.StoreUint64(&h.max, 0)
+}
+
+// LatencyHistogram is the distribution of the durations of a phase, as
+// returned by Metrics.Latency.
+type LatencyHistogram struct {
+	// Count is the number of durations recorded, Sum their sum and Max the
+	// longest.
+	Count uint64
+	Sum   time.Duration
+	Max   time.Duration
+	// counts holds the number of durations of every bucket.
+	counts []uint64
+}
+
+// Mean returns the mean duration, or 0 if there's none.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns the duration p percent of the durations recorded are no
+// longer than, within 12.5%, or 0 if there's none. p is in [0, 100].
+func (h LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.Count))
+	if rank == 0 {
+		rank = 1
+	}
+	var total uint64
+	for b, n := range h.counts {
+		total += n
+		if total >= rank {
+			if d := time.Duration(latencyBucketMax(b)); d < h.Max {
+				return d
+			}
+			break
+		}
+	}
+	return h.Max
+}
+
+// latencySampler holds the histograms of the phases, and picks the operations
+// timed.
+type latencySampler struct {
+	rate  uint32
+	hists [numLatencyPhases]latencyHistogram
+}
+
+func newLatencySampler(rate int) *latencySampler {
+	if rate <= 0 {
+		return nil
+	}
+	return &latencySampler{rate: uint32(rate)}
+}
+
+// sample returns whether to time the current operation. It's called by every
+// Get and Set, so it's just a branch if sampling is off.
+func (s *latencySampler) sample() bool {
+	return s != nil && z.FastRand()%s.rate == 0
+}
+
+// since records the time a phase took from start, and returns the time it
+// ended, where the next phase starts.
+func (s *latencySampler) since(phase LatencyPhase, start time.Time) time.Time {
+	now := time.Now()
+	s.hists[phase].add(now.Sub(start))
+	return now
+}
+
+// Latency returns the distribution of the durations of the phase, across the
+// operations sampled with Config.SampleLatency. It's empty if sampling is off.
+func (p *Metrics) Latency(phase LatencyPhase) LatencyHistogram {
+	if p == nil || p.latency == nil || phase < 0 || phase >= numLatencyPhases {
+		return LatencyHistogram{}
+	}
+	return p.latency.hists[phase].get()
+}
+
+// latencyQuantiles are the quantiles of the latencies served by
+// MetricsHandler.
+var latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+// writePromLatency writes the latencies of the phases in the Prometheus text
+// exposition format, as a summary labeled with the phase, if sampling is on.
+func (c *Cache) writePromLatency(buf *bytes.Buffer) {
+	const name = "cache_latency_seconds"
+	if c.Metrics == nil || c.Metrics.latency == nil {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP %s Durations of the phases of the sampled operations.\n", name)
+	fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+	labels := func(extra string) string {
+		if c.metricsLabels == "" {
+			return "{" + extra + "}"
+		}
+		return c.metricsLabels[:len(c.metricsLabels)-1] + "," + extra + "}"
+	}
+	for phase := LatencyPhase(0); phase < numLatencyPhases; phase++ {
+		hist := c.Metrics.Latency(phase)
+		label := fmt.Sprintf(`phase="%s"`, phase)
+		for _, q := range latencyQuantiles {
+			fmt.Fprintf(buf, "%s%s %v\n", name, labels(fmt.Sprintf(`%s,quantile="%v"`, label, q)),
+				hist.Percentile(q*100).Seconds())
+		}
+		fmt.Fprintf(buf, "%s_sum%s %v\n", name, labels(label), hist.Sum.Seconds())
+		fmt.Fprintf(buf, "%s_count%s %d\n", name, labels(label), hist.Count)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	prev := -1
+	for _, ns := range []uint64{0, 1, 7, 8, 9, 15, 16, 17, 100, 1000, 12345, 1e9, 1e12,
+		math.MaxUint64 >> 1, math.MaxUint64} {
+		b := latencyBucket(ns)
+		require.True(t, b >= prev, "%d", ns)
+		require.True(t, b < latencyBuckets, "%d", ns)
+		require.True(t, ns <= latencyBucketMax(b), "%d", ns)
+		if b > 0 {
+			require.True(t, ns > latencyBucketMax(b-1), "%d", ns)
+		}
+		// HDR-style precision.
+		require.True(t, float64(latencyBucketMax(b)-ns) <= float64(ns)/8, "%d", ns)
+		prev = b
+	}
+	require.Equal(t, latencyBuckets-1, latencyBucket(math.MaxUint64))
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	require.Zero(t, h.get().Percentile(99))
+	for i := 1; i <= 1000; i++ {
+		h.add(time.Duration(i) * time.Microsecond)
+	}
+	hist := h.get()
+	require.Equal(t, uint64(1000), hist.Count)
+	require.Equal(t, time.Millisecond, hist.Max)
+	require.Equal(t, 500500*time.Nanosecond, hist.Mean())
+	for _, p := range []float64{50, 90, 99} {
+		want := time.Duration(p*10) * time.Microsecond
+		got := hist.Percentile(p)
+		require.True(t, got >= want && got <= want+want/8, "p%v: %v", p, got)
+	}
+	require.Equal(t, time.Millisecond, hist.Percentile(100))
+	h.clear()
+	require.Zero(t, h.get().Count)
+}
+
+func TestCacheSampleLatency(t *testing.T) {
+	var evicted int
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		SampleLatency:      1,
+		OnEvict:            func(*Item) { evicted++ },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+		c.Get(i)
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	require.NotZero(t, evicted)
+	for phase := LatencyPhase(0); phase < numLatencyPhases; phase++ {
+		hist := c.Metrics.Latency(phase)
+		require.NotZero(t, hist.Count, phase.String())
+		require.True(t, hist.Percentile(99) <= hist.Max, phase.String())
+	}
+	require.True(t, c.Metrics.Latency(PhaseMapLookup).Count >= 200)
+
+	text := scrapeText(c)
+	require.Contains(t, text, `cache_latency_seconds{phase="policy",quantile="0.99"}`)
+	require.Contains(t, text, `cache_latency_seconds_count{phase="callback"}`)
+	latency := debugGet(t, c, "/debug/cache", 200)["latency"].(map[string]interface{})
+	require.Len(t, latency, int(numLatencyPhases))
+	require.NotZero(t, latency["buffer_push"].(map[string]interface{})["count"])
+
+	c.Metrics.Clear()
+	require.Zero(t, c.Metrics.Latency(PhasePolicy).Count)
+
+	// Nothing is timed without sampling.
+	plain, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer plain.Close()
+	plain.Get(1)
+	require.Zero(t, plain.Metrics.Latency(PhaseMapLookup).Count)
+	require.NotContains(t, scrapeText(plain), "cache_latency_seconds")
+	require.NotContains(t, debugGet(t, plain, "/debug/cache", 200), "latency")
+}
+
+func scrapeText(c *Cache) string {
+	rec := httptest.NewRecorder()
+	c.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestCacheSampleLatencyAllocs(t *testing.T) {
+	allocs := func(sampleLatency int) (float64, float64) {
+		c, err := NewCache(&Config{
+			NumCounters:   1000,
+			MaxCost:       1 << 20,
+			BufferItems:   64,
+			Metrics:       true,
+			SampleLatency: sampleLatency,
+		})
+		require.NoError(t, err)
+		defer c.Close()
+		c.Set(1, 1, 1)
+		c.Wait()
+		get := testing.AllocsPerRun(1000, func() { c.GetUint(1) })
+		set := testing.AllocsPerRun(1000, func() { c.SetUint(1, 1, 1) })
+		return get, set
+	}
+	get, set := allocs(0)
+	// The operations are almost never sampled at this rate.
+	sampledGet, sampledSet := allocs(math.MaxInt32)
+	require.Equal(t, get, sampledGet)
+	require.Equal(t, set, sampledSet)
+}
+
+func TestCacheSampleLatencyConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{NumCounters: 100, MaxCost: 10, BufferItems: 64, Metrics: true, SampleLatency: -1},
+		{NumCounters: 100, MaxCost: 10, BufferItems: 64, SampleLatency: 10},
+	} {
+		_, err := NewCache(config)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+const (
+	// lirsHIRRatio is the share of the cache given to resident HIR keys.
+	lirsHIRRatio = 0.01
+	// lirsMetadataRatio is the default bound on the cost of all the keys a
+	// LIRS policy remembers, resident or not, relative to MaxCost.
+	lirsMetadataRatio = 2
+)
+
+// lirsPolicy is a Low Inter-reference Recency Set policy. Keys are either LIR,
+// with a short distance between their last two accesses, or HIR. The LIR keys
+// take most of the cache and are never evicted while there are resident HIR
+// keys, so a loop over more keys than fit can't flush them out the way it does
+// with LRU.
+//
+// The stack S holds the LIR keys along with the HIR keys, resident or not,
+// accessed more recently than the least recently used LIR key. The queue Q holds
+// the resident HIR keys, and victims are taken from its tail. A key accessed
+// again while it's in S, including a non-resident ghost, has a shorter reuse
+// distance than the LIR key at the bottom of S, so it becomes LIR and that key
+// is demoted to HIR.
+type lirsPolicy struct {
+	entries map[uint64]*lirsEntry
+	// s and q have the most recent key at the front.
+	s *list.List
+	q *list.List
+	// ghosts has the keys that aren't resident, the most recently evicted at
+	// the front, so that the oldest can be forgotten first.
+	ghosts *list.List
+	// lirCost is the cost of the LIR keys, and lirCap the cost they may hold.
+	lirCost int64
+	lirCap  int64
+	// ghostCost is the cost the ghosts had when they were evicted.
+	ghostCost     int64
+	maxCost       int64
+	metadataRatio float64
+}
+
+type lirsState byte
+
+const (
+	lirsLIR lirsState = iota
+	lirsHIR
+	// lirsGhost is a HIR key that's been evicted but is still in S.
+	lirsGhost
+)
+
+type lirsEntry struct {
+	key   uint64
+	cost  int64
+	state lirsState
+	// inS, inQ and inGhosts are the elements of the key in each list, if it's
+	// in them.
+	inS      *list.Element
+	inQ      *list.Element
+	inGhosts *list.Element
+}
+
+// NewLIRSPolicy returns a LIRS Policy that remembers evicted keys until the
+// costs of all the keys it knows of add up to twice MaxCost. It can be used as
+// Config.Policy.
+func NewLIRSPolicy(numCounters, maxCost int64) Policy {
+	return newLIRSPolicy(maxCost, lirsMetadataRatio)
+}
+
+// NewLIRSPolicyWithMetadata returns a Config.Policy constructor for LIRS
+// policies that remember evicted keys until the costs of all the keys they know
+// of add up to metadataRatio times MaxCost. metadataRatio must be at least 1;
+// at 1, no evicted key is remembered.
+func NewLIRSPolicyWithMetadata(metadataRatio float64) func(numCounters, maxCost int64) Policy {
+	if metadataRatio < 1 {
+		panic("ristretto: LIRS metadata ratio must be at least 1")
+	}
+	return func(numCounters, maxCost int64) Policy {
+		return newLIRSPolicy(maxCost, metadataRatio)
+	}
+}
+
+func newLIRSPolicy(maxCost int64, metadataRatio float64) *lirsPolicy {
+	p := &lirsPolicy{
+		entries:       make(map[uint64]*lirsEntry),
+		s:             list.New(),
+		q:             list.New(),
+		ghosts:        list.New(),
+		metadataRatio: metadataRatio,
+	}
+	p.Resize(maxCost)
+	return p
+}
+
+func (p *lirsPolicy) Add(key uint64, cost int64) {
+	e, ok := p.entries[key]
+	if ok && e.state != lirsGhost {
+		p.Update(key, cost)
+		p.Access([]uint64{key})
+		return
+	}
+	if ok {
+		// A ghost is back before it left S: its reuse distance makes it LIR.
+		p.ghosts.Remove(e.inGhosts)
+		e.inGhosts = nil
+		p.ghostCost -= e.cost
+		e.cost = cost
+		p.makeLIR(e)
+		p.s.MoveToFront(e.inS)
+		p.demote()
+		p.forget()
+		return
+	}
+	e = &lirsEntry{key: key, cost: cost}
+	p.entries[key] = e
+	e.inS = p.s.PushFront(e)
+	if p.lirCost+cost <= p.lirCap {
+		// The LIR keys don't fill their share yet.
+		e.state = lirsLIR
+		p.lirCost += cost
+	} else {
+		e.state = lirsHIR
+		e.inQ = p.q.PushFront(e)
+	}
+}
+
+func (p *lirsPolicy) Update(key uint64, cost int64) {
+	e, ok := p.entries[key]
+	if !ok || e.state == lirsGhost {
+		return
+	}
+	if e.state == lirsLIR {
+		p.lirCost += cost - e.cost
+	}
+	e.cost = cost
+	p.demote()
+}
+
+func (p *lirsPolicy) Del(key uint64) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	p.remove(e)
+	p.prune()
+}
+
+// remove forgets the key, whatever its state.
+func (p *lirsPolicy) remove(e *lirsEntry) {
+	if e.inS != nil {
+		p.s.Remove(e.inS)
+	}
+	if e.inQ != nil {
+		p.q.Remove(e.inQ)
+	}
+	if e.inGhosts != nil {
+		p.ghosts.Remove(e.inGhosts)
+	}
+	switch e.state {
+	case lirsLIR:
+		p.lirCost -= e.cost
+	case lirsGhost:
+		p.ghostCost -= e.cost
+	}
+	delete(p.entries, e.key)
+}
+
+func (p *lirsPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		e, ok := p.entries[key]
+		if !ok || e.state == lirsGhost {
+			// Misses are handled by Add, if the key is admitted.
+			continue
+		}
+		switch {
+		case e.state == lirsLIR:
+			p.s.MoveToFront(e.inS)
+			p.prune()
+		case e.inS != nil:
+			// A resident HIR key accessed again while in S becomes LIR.
+			p.q.Remove(e.inQ)
+			e.inQ = nil
+			p.makeLIR(e)
+			p.s.MoveToFront(e.inS)
+			p.demote()
+		default:
+			e.inS = p.s.PushFront(e)
+			p.q.MoveToFront(e.inQ)
+		}
+	}
+}
+
+func (p *lirsPolicy) makeLIR(e *lirsEntry) {
+	e.state = lirsLIR
+	p.lirCost += e.cost
+}
+
+// demote turns the LIR keys at the bottom of S into resident HIR keys until
+// the LIR keys fit their share of the cache. The most recent LIR key is never
+// demoted, even if it doesn't fit on its own.
+func (p *lirsPolicy) demote() {
+	for p.lirCost > p.lirCap {
+		p.prune()
+		elem := p.s.Back()
+		if elem == nil || elem == p.s.Front() {
+			return
+		}
+		e := elem.Value.(*lirsEntry)
+		p.s.Remove(elem)
+		e.inS = nil
+		e.state = lirsHIR
+		p.lirCost -= e.cost
+		e.inQ = p.q.PushFront(e)
+	}
+	p.prune()
+}
+
+// prune removes the HIR keys from the bottom of S, so that it ends with a LIR
+// key. Ghosts leaving S are forgotten altogether.
+func (p *lirsPolicy) prune() {
+	for elem := p.s.Back(); elem != nil; elem = p.s.Back() {
+		e := elem.Value.(*lirsEntry)
+		if e.state == lirsLIR {
+			return
+		}
+		p.s.Remove(elem)
+		e.inS = nil
+		if e.state == lirsGhost {
+			p.remove(e)
+		}
+	}
+}
+
+// forget drops the oldest ghosts until their cost fits in the metadata left
+// once MaxCost is taken by the resident keys.
+func (p *lirsPolicy) forget() {
+	for p.ghosts.Len() > 0 && p.ghostCost > p.ghostCap() {
+		p.remove(p.ghosts.Back().Value.(*lirsEntry))
+	}
+}
+
+func (p *lirsPolicy) ghostCap() int64 {
+	return int64(float64(p.maxCost) * (p.metadataRatio - 1))
+}
+
+func (p *lirsPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+func (p *lirsPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	var e *lirsEntry
+	if elem := lastUnskipped(p.q, func(elem *list.Element) uint64 {
+		return elem.Value.(*lirsEntry).key
+	}, skip); elem != nil {
+		e = elem.Value.(*lirsEntry)
+		p.q.Remove(elem)
+		e.inQ = nil
+	} else {
+		// No resident HIR key is left, so the least recent LIR key goes.
+		for elem := p.s.Back(); elem != nil; elem = elem.Prev() {
+			e = elem.Value.(*lirsEntry)
+			if e.state == lirsLIR && (skip == nil || !skip(e.key)) {
+				p.remove(e)
+				p.prune()
+				return e.key, true
+			}
+		}
+		return 0, false
+	}
+	if e.inS == nil || p.ghostCap() == 0 {
+		p.remove(e)
+		return e.key, true
+	}
+	e.state = lirsGhost
+	e.inGhosts = p.ghosts.PushFront(e)
+	p.ghostCost += e.cost
+	p.forget()
+	return e.key, true
+}
+
+func (p *lirsPolicy) Resize(maxCost int64) {
+	p.maxCost = maxCost
+	p.lirCap = int64(float64(maxCost) * (1 - lirsHIRRatio))
+	p.demote()
+	p.forget()
+}
+
+func (p *lirsPolicy) Clear() {
+	p.entries = make(map[uint64]*lirsEntry)
+	p.s.Init()
+	p.q.Init()
+	p.ghosts.Init()
+	p.lirCost = 0
+	p.ghostCost = 0
+}
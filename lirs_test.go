@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLIRSPolicy(t *testing.T) {
+	p := NewLIRSPolicyWithMetadata(2)(100, 3).(*lirsPolicy)
+	p.lirCap = 2
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Add(3, 1)
+	require.Equal(t, lirsLIR, p.entries[1].state)
+	require.Equal(t, lirsLIR, p.entries[2].state)
+	require.Equal(t, lirsHIR, p.entries[3].state)
+
+	// 3 goes first, but stays in S as a ghost.
+	victim, ok := p.Evict(4)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	require.Equal(t, lirsGhost, p.entries[3].state)
+	p.Add(4, 1)
+
+	// Back while in S, 3 becomes LIR and 1, the least recent LIR key, is
+	// demoted to HIR.
+	p.Add(3, 1)
+	require.Equal(t, lirsLIR, p.entries[3].state)
+	require.Equal(t, lirsHIR, p.entries[1].state)
+	require.Equal(t, int64(2), p.lirCost)
+
+	// Resident HIR keys go before any LIR key, the oldest first.
+	for _, want := range []uint64{4, 1} {
+		victim, ok := p.Evict(5)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	// Then the LIR keys, from the bottom of S.
+	for _, want := range []uint64{2, 3} {
+		victim, ok := p.Evict(5)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	_, ok = p.Evict(5)
+	require.False(t, ok)
+}
+
+func TestLIRSPolicyDel(t *testing.T) {
+	p := NewLIRSPolicy(100, 4).(*lirsPolicy)
+	p.lirCap = 2
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+	}
+	victim, ok := p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	// 3 comes back as LIR, and 1 is demoted to a HIR key not in S.
+	p.Add(3, 1)
+	victim, ok = p.Evict(5)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), victim)
+	require.Equal(t, lirsHIR, p.entries[1].state)
+	require.Nil(t, p.entries[1].inS)
+	require.Equal(t, lirsGhost, p.entries[4].state)
+	require.Equal(t, lirsLIR, p.entries[3].state)
+
+	// Delete keys in every state, and one that's unknown.
+	for _, key := range []uint64{1, 3, 4, 6} {
+		p.Del(key)
+	}
+	require.Len(t, p.entries, 1)
+	require.Equal(t, 1, p.s.Len())
+	require.Zero(t, p.q.Len())
+	require.Zero(t, p.ghosts.Len())
+	require.Equal(t, int64(1), p.lirCost)
+	require.Zero(t, p.ghostCost)
+
+	p.Clear()
+	require.Empty(t, p.entries)
+	_, ok = p.Evict(5)
+	require.False(t, ok)
+}
+
+func TestLIRSPolicyMetadata(t *testing.T) {
+	require.Panics(t, func() { NewLIRSPolicyWithMetadata(0.5) })
+	for _, ratio := range []float64{1, 1.5, 3} {
+		p := NewLIRSPolicyWithMetadata(ratio)(100, 100).(*lirsPolicy)
+		// Keys seen once are all ghosts after their eviction.
+		policyHitRatio(p, 100, loopTrace(1000, 3))
+		require.True(t, p.ghostCost <= p.ghostCap())
+		require.True(t, len(p.entries) <= int(100*ratio), "entries: %d", len(p.entries))
+		require.Equal(t, p.ghostCost, int64(p.ghosts.Len()))
+	}
+}
+
+func TestLIRSPolicyHitRatio(t *testing.T) {
+	for name, keys := range map[string][]uint64{
+		// A loop over a few more keys than fit: LRU always misses.
+		"loop": loopTrace(120, 20),
+		// A hot set interrupted by scans of keys never seen again.
+		"scan": scanTrace(50, 100, 200),
+		// A hot set accessed at random alongside a loop over a larger set.
+		"mixed": mixedTrace(30, 150, 20000),
+	} {
+		lru := policyHitRatio(NewLRUPolicy(100, 100), 100, keys)
+		lirs := policyHitRatio(NewLIRSPolicy(100, 100), 100, keys)
+		require.True(t, lirs > lru+0.1, "%s: lirs: %.3f, lru: %.3f", name, lirs, lru)
+	}
+}
+
+func TestCacheLIRSPolicy(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Policy:             NewLIRSPolicy,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	hits := 0
+	keys := loopTrace(120, 20)
+	for _, key := range keys {
+		if _, ok := c.GetUint(key); ok {
+			hits++
+		} else {
+			c.SetUint(key, key, 1)
+		}
+		c.Flush()
+		c.Wait()
+	}
+	require.True(t, hits > len(keys)/2, "hits: %d", hits)
+	require.True(t, c.UsedCost() <= 100)
+}
+
+// loopTrace returns rounds of accesses to the keys from 0 to n, in order.
+func loopTrace(n, rounds int) []uint64 {
+	keys := make([]uint64, 0, n*rounds)
+	for i := 0; i < rounds; i++ {
+		for key := 0; key < n; key++ {
+			keys = append(keys, uint64(key))
+		}
+	}
+	return keys
+}
+
+// mixedTrace returns accesses that alternate between hot keys picked at random
+// and a loop over other keys.
+func mixedTrace(hot, loop, n int) []uint64 {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]uint64, 0, n)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			keys = append(keys, uint64(r.Intn(hot)))
+		} else {
+			keys = append(keys, uint64(hot+i/2%loop))
+		}
+	}
+	return keys
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+// LogLevel is the level of an event given to a Logger.
+type LogLevel int
+
+const (
+	// LogDebug events can be frequent, and some happen while serving Gets and
+	// Sets. They're only logged with Config.LogDebug.
+	LogDebug LogLevel = iota
+	// LogInfo events are changes made to the cache, such as a new MaxCost.
+	LogInfo
+	// LogWarn events are problems the cache worked around.
+	LogWarn
+	// LogError events are operations that failed.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Logger receives the noteworthy events of a cache, set as Config.Logger. msg
+// is a constant describing the event, and keyvals alternate the names and the
+// values of its details, to be formatted only by the Logger. Log is called
+// from the goroutines of the cache and of its callers, so it has to be safe
+// for concurrent use, and shouldn't block.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+// Log calls f.
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// nopLogger is the Logger of the caches without Config.Logger.
+type nopLogger struct{}
+
+func (nopLogger) Log(LogLevel, string, ...interface{}) {}
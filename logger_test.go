@@ -0,0 +1,170 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// logEvent is an event given to a captureLogger.
+type logEvent struct {
+	level   LogLevel
+	msg     string
+	keyvals []interface{}
+}
+
+// captureLogger is a Logger keeping the events it's given.
+type captureLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+func (l *captureLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, logEvent{level, msg, keyvals})
+}
+
+// find returns the events with the given message.
+func (l *captureLogger) find(msg string) []logEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var found []logEvent
+	for _, e := range l.events {
+		if e.msg == msg {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func newLoggedCache(t *testing.T, logger Logger, debug bool, clock Clock) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        1,
+		IgnoreInternalCost: true,
+		Logger:             logger,
+		LogDebug:           debug,
+		Clock:              clock,
+		// Keys 1 and 2 share a hash.
+		KeyToHash: func(key interface{}) (uint64, uint64) {
+			if k := uint64(key.(int)); k > 0 {
+				return 1, k
+			}
+			return 0, 0
+		},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheLogger(t *testing.T) {
+	logger := &captureLogger{}
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c := newLoggedCache(t, logger, false, clock)
+	defer c.Close()
+
+	c.UpdateMaxCost(20)
+	events := logger.find("max cost updated")
+	require.Len(t, events, 1)
+	require.Equal(t, LogInfo, events[0].level)
+	require.Equal(t, []interface{}{"from", int64(10), "to", int64(20)}, events[0].keyvals)
+
+	// The debug events are skipped.
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	c.Get(2)
+	require.True(t, c.SetWithTTL(0, 0, 1, time.Second))
+	c.Wait()
+	clock.Add(time.Duration(bucketDurationSecs+2) * time.Second)
+	c.Wait()
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, e := range logger.events {
+		require.NotEqual(t, LogDebug, e.level, e.msg)
+	}
+}
+
+func TestCacheLoggerDebug(t *testing.T) {
+	logger := &captureLogger{}
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c := newLoggedCache(t, logger, true, clock)
+	defer c.Close()
+
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	_, ok := c.Get(2)
+	require.False(t, ok)
+	events := logger.find("key conflict")
+	require.Len(t, events, 1)
+	require.Equal(t, LogDebug, events[0].level)
+	require.Equal(t, []interface{}{"key", uint64(1)}, events[0].keyvals)
+
+	require.True(t, c.SetWithTTL(0, 0, 1, time.Second))
+	c.Wait()
+	clock.Add(time.Duration(bucketDurationSecs+2) * time.Second)
+	var expired int
+	for start := time.Now(); expired == 0; time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < time.Second, "no cleanup pass logged")
+		for _, e := range logger.find("expired items cleaned up") {
+			expired += e.keyvals[1].(int)
+		}
+	}
+	require.Equal(t, 1, expired)
+
+	// Hold the policy lock so that the Get buffer fills up.
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	for i := 0; i < 100; i++ {
+		c.Get(1)
+	}
+	p.Unlock()
+	require.NotEmpty(t, logger.find("get buffer full, accesses dropped"))
+}
+
+func TestCacheLoggerSnapshot(t *testing.T) {
+	snapshot := saveSnapshot(t, 3)
+	logger := &captureLogger{}
+	config := newSnapshotConfig()
+	config.Logger = logger
+	_, err := LoadCache(config, bytes.NewReader(snapshot[:len(snapshot)/2]))
+	require.Error(t, err)
+	events := logger.find("loading snapshot failed")
+	require.Len(t, events, 1)
+	require.Equal(t, LogError, events[0].level)
+	require.Equal(t, []interface{}{"error", err}, events[0].keyvals)
+
+	c, err := LoadCache(config, bytes.NewReader(snapshot))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Len(t, logger.find("loading snapshot failed"), 1)
+}
+
+func TestLoggerFunc(t *testing.T) {
+	var got []interface{}
+	var logger Logger = LoggerFunc(func(level LogLevel, msg string, keyvals ...interface{}) {
+		got = append([]interface{}{level.String(), msg}, keyvals...)
+	})
+	logger.Log(LogWarn, "hello", "a", 1)
+	require.Equal(t, []interface{}{"warn", "hello", "a", 1}, got)
+}
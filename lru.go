@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+// lruPolicy is an exact LRU policy: keys are kept in a list ordered by their
+// last access, and the least recently used one is always the victim. Every
+// candidate is admitted.
+//
+// Like every Policy, it's called under the lock of the cache policy, and the
+// Gets are handed to Access a whole buffer at a time, so the list is reordered
+// in batches rather than taking a lock per Get.
+type lruPolicy struct {
+	// list has the most recently used key at the front.
+	list  *list.List
+	elems map[uint64]*list.Element
+}
+
+// NewLRUPolicy returns an exact LRU Policy, to compare the other policies
+// against. It can be used as Config.Policy. The order of the keys is only exact
+// as far as the Gets reach the policy: lossy Get buffers drop some of them, and
+// the others are applied in batches, so use BufferLossless and Cache.Flush when
+// the order matters.
+func NewLRUPolicy(numCounters, maxCost int64) Policy {
+	return &lruPolicy{
+		list:  list.New(),
+		elems: make(map[uint64]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Add(key uint64, cost int64) {
+	if elem, ok := p.elems[key]; ok {
+		p.list.MoveToFront(elem)
+		return
+	}
+	p.elems[key] = p.list.PushFront(key)
+}
+
+func (p *lruPolicy) Update(key uint64, cost int64) {}
+
+func (p *lruPolicy) Del(key uint64) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	p.list.Remove(elem)
+	delete(p.elems, key)
+}
+
+func (p *lruPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		if elem, ok := p.elems[key]; ok {
+			p.list.MoveToFront(elem)
+		}
+	}
+}
+
+func (p *lruPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+func (p *lruPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	elem := lastUnskipped(p.list, func(elem *list.Element) uint64 {
+		return elem.Value.(uint64)
+	}, skip)
+	if elem == nil {
+		return 0, false
+	}
+	victim := elem.Value.(uint64)
+	p.Del(victim)
+	return victim, true
+}
+
+// lastUnskipped returns the element of l closest to its back whose key, given
+// by keyOf, isn't skipped, or nil if there's none. A nil skip skips nothing.
+func lastUnskipped(l *list.List, keyOf func(*list.Element) uint64,
+	skip func(uint64) bool) *list.Element {
+	for elem := l.Back(); elem != nil; elem = elem.Prev() {
+		if skip == nil || !skip(keyOf(elem)) {
+			return elem
+		}
+	}
+	return nil
+}
+
+func (p *lruPolicy) Resize(maxCost int64) {}
+
+func (p *lruPolicy) Clear() {
+	p.list.Init()
+	p.elems = make(map[uint64]*list.Element)
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUPolicy(t *testing.T) {
+	p := NewLRUPolicy(100, 4).(*lruPolicy)
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+	}
+	p.Access([]uint64{2, 1, 5})
+	p.Access([]uint64{3})
+
+	// From the least recently used: 4 was never accessed, then 2, 1 and 3.
+	for _, want := range []uint64{4, 2, 1, 3} {
+		victim, ok := p.Evict(6)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	_, ok := p.Evict(6)
+	require.False(t, ok)
+	require.Empty(t, p.elems)
+}
+
+func TestLRUPolicyDel(t *testing.T) {
+	p := NewLRUPolicy(100, 4).(*lruPolicy)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Add(3, 1)
+	p.Del(2)
+	p.Del(4)
+	require.Equal(t, 2, p.list.Len())
+	victim, ok := p.Evict(4)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+
+	p.Clear()
+	require.Empty(t, p.elems)
+	_, ok = p.Evict(4)
+	require.False(t, ok)
+}
+
+func TestCacheLRUPolicy(t *testing.T) {
+	var evicted []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            3,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Policy:             NewLRUPolicy,
+		OnEvict: func(item *Item) {
+			evicted = append(evicted, item.Key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Every step either sets a key, which evicts the least recently used one
+	// once the cache is full, or gets one, which makes it the most recent.
+	for _, step := range []struct {
+		set bool
+		key uint64
+	}{
+		{true, 1}, {true, 2}, {true, 3},
+		{false, 1},
+		{true, 4}, // Evicts 2.
+		{false, 3},
+		{true, 5}, // Evicts 1.
+		{false, 4},
+		{false, 3},
+		{true, 6}, // Evicts 5.
+		{true, 7}, // Evicts 4.
+		{false, 6},
+		{true, 8}, // Evicts 3.
+	} {
+		if step.set {
+			require.True(t, c.SetUint(step.key, step.key, 1))
+			c.Wait()
+		} else {
+			_, ok := c.GetUint(step.key)
+			require.True(t, ok, "key %d", step.key)
+			c.Flush()
+		}
+	}
+	require.Equal(t, []uint64{2, 1, 5, 4, 3}, evicted)
+}
@@ -0,0 +1,392 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Map holds the items of a cache by key hash, in place of the default sharded
+// map, when returned by Config.NewMap. Every method has to be safe for
+// concurrent use, but the cache serializes the writes to the same key itself,
+// so Set and Del don't have to be atomic with a Get of the key before them.
+// Range doesn't have to be a snapshot: it may or may not see the items set or
+// deleted while it runs, and f may call the other methods.
+//
+// Items are returned as they were set, whatever their key and value, nil
+// included. The cache never asks a Map to sample its items, as the policies
+// keep track of the keys themselves. TestMapImplementation in the
+// ristrettotest package checks an implementation against this contract.
+type Map interface {
+	// Get returns the item of the key, and whether there's one.
+	Get(key uint64) (MapItem, bool)
+	// Set adds the item, or replaces the one of the same key.
+	Set(item MapItem)
+	// Del deletes the item of the key, if there's one.
+	Del(key uint64)
+	// Len returns the number of items.
+	Len() int
+	// Range calls f for every item until f returns false.
+	Range(f func(MapItem) bool)
+}
+
+// MapItem is an item as held by a Map.
+type MapItem struct {
+	Key      uint64
+	Conflict uint64
+	Value    interface{}
+	// Expiration is the Unix time, in seconds, the item expires at, or 0 if
+	// it doesn't.
+	Expiration int64
+}
+
+func (i MapItem) storeItem() storeItem {
+	return storeItem{
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		expiration: i.Expiration,
+	}
+}
+
+// syncMap is the Map returned by NewSyncMap.
+type syncMap struct {
+	m sync.Map
+	n int64
+}
+
+// NewSyncMap returns a Map backed by a sync.Map, for read-mostly workloads on
+// a stable set of keys, for Config.NewMap. Gets of keys that haven't changed
+// lately don't take any lock, which beats the default sharded map when reads
+// far outnumber writes. In exchange, every Set allocates, adding a key is
+// slower and takes more memory than in the default map, and a sync.Map
+// whose keys keep changing spends its time promoting them to its read-only
+// part; BenchmarkStoreReadRatio compares both at several read/write ratios.
+func NewSyncMap() Map {
+	return &syncMap{}
+}
+
+func (m *syncMap) Get(key uint64) (MapItem, bool) {
+	v, ok := m.m.Load(key)
+	if !ok {
+		return MapItem{}, false
+	}
+	return v.(MapItem), true
+}
+
+func (m *syncMap) Set(item MapItem) {
+	if _, loaded := m.m.LoadOrStore(item.Key, item); loaded {
+		m.m.Store(item.Key, item)
+		return
+	}
+	atomic.AddInt64(&m.n, 1)
+}
+
+func (m *syncMap) Del(key uint64) {
+	if _, ok := m.m.Load(key); !ok {
+		return
+	}
+	m.m.Delete(key)
+	atomic.AddInt64(&m.n, -1)
+}
+
+func (m *syncMap) Len() int {
+	return int(atomic.LoadInt64(&m.n))
+}
+
+func (m *syncMap) Range(f func(MapItem) bool) {
+	m.m.Range(func(_, v interface{}) bool {
+		return f(v.(MapItem))
+	})
+}
+
+// mapLockStripes is the number of locks the writes of a mapStore are spread
+// over.
+const mapLockStripes = 256
+
+// mapStore is the store over a Map from Config.NewMap. Reads go straight to
+// the Map, while the writes to a key are serialized by one of a fixed set of
+// locks, so that a Map doesn't have to offer compound operations of its own.
+type mapStore struct {
+	// fingerprints come first to be 64-bit aligned. They hold the fingerprint
+	// of the keys under every lock, written with it held.
+	fingerprints [mapLockStripes]uint64
+	m            Map
+	locks        [mapLockStripes]sync.Mutex
+	em           *expirationMap
+	clock        Clock
+	onConflict   func(key uint64)
+}
+
+func newMapStore(m Map, clock Clock, onConflict func(key uint64)) *mapStore {
+	return &mapStore{
+		m:          m,
+		em:         newExpirationMap(),
+		clock:      clock,
+		onConflict: onConflict,
+	}
+}
+
+// lock locks the writes to the key, and returns the lock to unlock.
+func (s *mapStore) lock(key uint64) *sync.Mutex {
+	mu := &s.locks[key%mapLockStripes]
+	mu.Lock()
+	return mu
+}
+
+// checkConflict works like lockedMap.checkConflict.
+func (s *mapStore) checkConflict(item MapItem, conflict uint64) {
+	if s.onConflict != nil && conflict != 0 && conflict != item.Conflict {
+		s.onConflict(item.Key)
+	}
+}
+
+func (s *mapStore) Get(key, conflict uint64) (interface{}, bool) {
+	item, ok := s.m.Get(key)
+	if !ok {
+		return nil, false
+	}
+	s.checkConflict(item, conflict)
+	return item.storeItem().valueFor(conflict, s.clock.Now().Unix())
+}
+
+func (s *mapStore) GetMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	for i := range keys {
+		values[i], found[i] = s.Get(keys[i], conflicts[i])
+	}
+}
+
+func (s *mapStore) Expiration(key uint64) int64 {
+	item, _ := s.m.Get(key)
+	return item.Expiration
+}
+
+func (s *mapStore) Has(key uint64) bool {
+	_, ok := s.m.Get(key)
+	return ok
+}
+
+func (s *mapStore) Conflicts(key, conflict uint64) bool {
+	item, ok := s.m.Get(key)
+	return ok && conflict != 0 && conflict != item.Conflict
+}
+
+func (s *mapStore) Set(i *Item) {
+	if i == nil {
+		return
+	}
+	mu := s.lock(i.Key)
+	defer mu.Unlock()
+	if item, ok := s.m.Get(i.Key); ok {
+		if i.Conflict != 0 && i.Conflict != item.Conflict {
+			return
+		}
+		s.em.update(i.Key, i.Conflict, item.Expiration, i.Expiration)
+		s.addFingerprint(i.Key, -fingerprintOf(item.Key, item.Conflict))
+	} else {
+		s.em.add(i.Key, i.Conflict, i.Expiration)
+	}
+	s.addFingerprint(i.Key, fingerprintOf(i.Key, i.Conflict))
+	s.m.Set(MapItem{
+		Key:        i.Key,
+		Conflict:   i.Conflict,
+		Value:      i.Value,
+		Expiration: i.Expiration,
+	})
+}
+
+func (s *mapStore) SetMulti(items []*Item) {
+	for _, i := range items {
+		s.Set(i)
+	}
+}
+
+// SetGroup never sets the items, as the Gets of a Map don't wait for the
+// writes of the cache.
+func (s *mapStore) SetGroup(items []*Item, prev []interface{}, replaced []bool,
+	admit func() bool) bool {
+	return false
+}
+
+func (s *mapStore) Del(key, conflict uint64) (uint64, interface{}, bool) {
+	mu := s.lock(key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(key)
+	if !ok || (conflict != 0 && conflict != item.Conflict) {
+		return 0, nil, false
+	}
+	if item.Expiration != 0 {
+		s.em.del(key, item.Expiration)
+	}
+	s.m.Del(key)
+	s.addFingerprint(key, -fingerprintOf(item.Key, item.Conflict))
+	return item.Conflict, item.Value, true
+}
+
+func (s *mapStore) DelMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	for i := range keys {
+		_, values[i], found[i] = s.Del(keys[i], conflicts[i])
+	}
+}
+
+func (s *mapStore) Update(newItem *Item) (interface{}, bool) {
+	mu := s.lock(newItem.Key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(newItem.Key)
+	if !ok || (newItem.Conflict != 0 && newItem.Conflict != item.Conflict) {
+		return nil, false
+	}
+	s.em.update(newItem.Key, newItem.Conflict, item.Expiration, newItem.Expiration)
+	s.addFingerprint(newItem.Key,
+		fingerprintOf(newItem.Key, newItem.Conflict)-fingerprintOf(item.Key, item.Conflict))
+	s.m.Set(MapItem{
+		Key:        newItem.Key,
+		Conflict:   newItem.Conflict,
+		Value:      newItem.Value,
+		Expiration: newItem.Expiration,
+	})
+	return item.Value, true
+}
+
+func (s *mapStore) Compute(key, conflict uint64,
+	f func(value interface{}, ok bool) (interface{}, bool)) (interface{}, bool) {
+	mu := s.lock(key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(key)
+	var value interface{}
+	if ok {
+		value, ok = item.storeItem().valueFor(conflict, s.clock.Now().Unix())
+	}
+	newValue, write := f(value, ok)
+	if !ok || !write {
+		return nil, false
+	}
+	item.Value = newValue
+	s.m.Set(item)
+	return value, true
+}
+
+func (s *mapStore) Cleanup(policy policy, onExpire itemCallback) {
+	s.em.cleanup(s, policy, onExpire, s.clock.Now().Unix())
+}
+
+func (s *mapStore) Clear(onEvict itemCallback) {
+	var keys []uint64
+	s.m.Range(func(item MapItem) bool {
+		keys = append(keys, item.Key)
+		return true
+	})
+	i := &Item{}
+	for _, key := range keys {
+		mu := s.lock(key)
+		item, ok := s.m.Get(key)
+		if ok {
+			s.m.Del(key)
+			s.addFingerprint(key, -fingerprintOf(item.Key, item.Conflict))
+		}
+		mu.Unlock()
+		if ok && onEvict != nil {
+			i.Key = item.Key
+			i.Conflict = item.Conflict
+			i.Value = item.Value
+			onEvict(i)
+		}
+	}
+	s.em.clear()
+}
+
+func (s *mapStore) Len() int {
+	return s.m.Len()
+}
+
+func (s *mapStore) Touch(key, conflict uint64, expiration int64) bool {
+	mu := s.lock(key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(key)
+	if !ok {
+		return false
+	}
+	if _, ok := item.storeItem().valueFor(conflict, s.clock.Now().Unix()); !ok {
+		return false
+	}
+	s.setExpiration(item, expiration)
+	return true
+}
+
+func (s *mapStore) GetAndTouch(key, conflict uint64, expiration int64) (interface{}, bool) {
+	mu := s.lock(key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(key)
+	if !ok {
+		return nil, false
+	}
+	s.checkConflict(item, conflict)
+	value, ok := item.storeItem().valueFor(conflict, s.clock.Now().Unix())
+	if !ok {
+		return nil, false
+	}
+	s.setExpiration(item, expiration)
+	return value, true
+}
+
+// setExpiration works like lockedMap.setExpiration, with the lock of the key
+// held.
+func (s *mapStore) setExpiration(item MapItem, expiration int64) {
+	if item.Expiration != 0 {
+		s.em.del(item.Key, item.Expiration)
+	}
+	s.em.add(item.Key, item.Conflict, expiration)
+	item.Expiration = expiration
+	s.m.Set(item)
+}
+
+func (s *mapStore) DelExpired(key, conflict uint64, now int64) (interface{}, bool) {
+	mu := s.lock(key)
+	defer mu.Unlock()
+	item, ok := s.m.Get(key)
+	if !ok || item.Expiration == 0 || item.Expiration > now {
+		return nil, false
+	}
+	if conflict != 0 && conflict != item.Conflict {
+		return nil, false
+	}
+	s.em.del(key, item.Expiration)
+	s.m.Del(key)
+	s.addFingerprint(key, -fingerprintOf(item.Key, item.Conflict))
+	return item.Value, true
+}
+
+// addFingerprint adds delta to the fingerprint of the keys under the lock of
+// key, which must be held.
+func (s *mapStore) addFingerprint(key, delta uint64) {
+	atomic.AddUint64(&s.fingerprints[key%mapLockStripes], delta)
+}
+
+func (s *mapStore) Fingerprint() uint64 {
+	var sum uint64
+	for i := range s.fingerprints {
+		sum += atomic.LoadUint64(&s.fingerprints[i])
+	}
+	return sum
+}
+
+func (s *mapStore) Range(f func(storeItem) bool) {
+	s.m.Range(func(item MapItem) bool {
+		return f(item.storeItem())
+	})
+}
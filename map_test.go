@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMapStore() *mapStore {
+	return newMapStore(NewSyncMap(), systemClock{}, nil)
+}
+
+func TestMapStore(t *testing.T) {
+	s := newTestMapStore()
+	now := time.Now().Unix()
+	s.Set(&Item{Key: 1, Conflict: 1, Value: 1})
+	s.Set(&Item{Key: 2, Conflict: 2, Value: 2, Expiration: now + 10})
+	val, ok := s.Get(1, 1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	_, ok = s.Get(1, 2)
+	require.False(t, ok)
+	require.True(t, s.Conflicts(1, 2))
+	require.Equal(t, now+10, s.Expiration(2))
+	require.Equal(t, 2, s.Len())
+
+	// A Set with another conflict hash doesn't replace the item.
+	s.Set(&Item{Key: 1, Conflict: 3, Value: 3})
+	val, _ = s.Get(1, 0)
+	require.Equal(t, 1, val)
+	prev, ok := s.Update(&Item{Key: 1, Conflict: 1, Value: 4})
+	require.True(t, ok)
+	require.Equal(t, 1, prev)
+	_, ok = s.Update(&Item{Key: 3, Value: 3})
+	require.False(t, ok)
+
+	require.True(t, s.Touch(2, 2, now+100))
+	require.Equal(t, now+100, s.Expiration(2))
+	val, ok = s.GetAndTouch(2, 2, 0)
+	require.True(t, ok)
+	require.Equal(t, 2, val)
+	require.Zero(t, s.Expiration(2))
+
+	prev, ok = s.Compute(1, 1, func(value interface{}, ok bool) (interface{}, bool) {
+		return value.(int) + 1, true
+	})
+	require.True(t, ok)
+	require.Equal(t, 4, prev)
+	val, _ = s.Get(1, 1)
+	require.Equal(t, 5, val)
+
+	conflict, val, ok := s.Del(1, 1)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), conflict)
+	require.Equal(t, 5, val)
+	require.False(t, s.Has(1))
+	require.Equal(t, 1, s.Len())
+
+	s.Set(&Item{Key: 3, Value: 3, Expiration: now - 1})
+	_, ok = s.Get(3, 0)
+	require.False(t, ok)
+	val, ok = s.DelExpired(3, 0, now)
+	require.True(t, ok)
+	require.Equal(t, 3, val)
+
+	evicted := 0
+	s.Clear(func(*Item) { evicted++ })
+	require.Equal(t, 1, evicted)
+	require.Zero(t, s.Len())
+	s.Range(func(storeItem) bool {
+		t.Fatal("the store should be empty")
+		return false
+	})
+}
+
+func TestMapStoreConcurrent(t *testing.T) {
+	s := newTestMapStore()
+	now := time.Now().Unix()
+	var wrong int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 5000; i++ {
+				key := uint64(r.Intn(200))
+				switch r.Intn(8) {
+				case 0:
+					s.Set(&Item{Key: key, Value: key, Expiration: now + 60})
+				case 1:
+					s.Del(key, 0)
+				case 2:
+					s.Update(&Item{Key: key, Value: key})
+				case 3:
+					s.Touch(key, 0, now+120)
+				case 4:
+					s.Len()
+				case 5:
+					// Range may see the items changed while it runs.
+					s.Range(func(item storeItem) bool {
+						if item.value.(uint64) != item.key {
+							atomic.AddInt32(&wrong, 1)
+						}
+						s.Get(item.key, 0)
+						return true
+					})
+				default:
+					if val, ok := s.Get(key, 0); ok && val != key {
+						atomic.AddInt32(&wrong, 1)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Zero(t, atomic.LoadInt32(&wrong))
+	n := 0
+	s.Range(func(storeItem) bool {
+		n++
+		return true
+	})
+	require.Equal(t, n, s.Len())
+}
+
+func TestCacheNewMap(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		NewMap:             NewSyncMap,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 20; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	require.Equal(t, 10, c.Len())
+	found := 0
+	for i := 0; i < 20; i++ {
+		if val, ok := c.Get(i); ok {
+			require.Equal(t, i, val)
+			found++
+		}
+	}
+	require.Equal(t, 10, found)
+	c.Clear()
+	require.Zero(t, c.Len())
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		StoreShards: 16,
+		NewMap:      NewSyncMap,
+	})
+	require.Error(t, err)
+}
+
+// BenchmarkStoreReadRatio compares the default store with one over NewSyncMap
+// at several ratios of Gets to Sets over a fixed set of keys.
+func BenchmarkStoreReadRatio(b *testing.B) {
+	for _, ratio := range []struct {
+		name string
+		// reads is how many operations out of per are Gets.
+		reads, per int
+	}{
+		{"50%", 50, 100},
+		{"90%", 90, 100},
+		{"99%", 99, 100},
+		{"99.9%", 999, 1000},
+	} {
+		reads, per := ratio.reads, ratio.per
+		for _, impl := range []struct {
+			name  string
+			store func() store
+		}{
+			{"sharded", newStore},
+			{"syncmap", func() store { return newTestMapStore() }},
+		} {
+			name := fmt.Sprintf("reads=%s/%s", ratio.name, impl.name)
+			b.Run(name, func(b *testing.B) {
+				s := impl.store()
+				for key := uint64(0); key < 1<<12; key++ {
+					s.Set(&Item{Key: key, Value: key})
+				}
+				var seed int64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+					for pb.Next() {
+						key := uint64(r.Intn(1 << 12))
+						if r.Intn(per) < reads {
+							s.Get(key, 0)
+						} else {
+							s.Set(&Item{Key: key, Value: key})
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// multiScratch holds the buffers of a GetMultiMap, reused across calls so
+// that large batches don't allocate them every time.
+type multiScratch struct {
+	hashes, conflicts []uint64
+	// seen is an open-addressing set of the keys met so far, holding their
+	// index plus one, and repeat marks the keys given at an earlier index.
+	seen   []int
+	repeat []bool
+	// batch and batchConflicts hold the hashes of the distinct keys that
+	// aren't nil, in the order they were given, values and found what the
+	// lookups of these keys found.
+	batch, batchConflicts []uint64
+	values                []interface{}
+	found                 []bool
+}
+
+var multiScratchPool = sync.Pool{
+	New: func() interface{} { return new(multiScratch) },
+}
+
+// reset sizes the buffers for n keys.
+func (s *multiScratch) reset(n int) {
+	if cap(s.hashes) < n {
+		s.hashes = make([]uint64, n)
+		s.conflicts = make([]uint64, n)
+		s.repeat = make([]bool, n)
+		s.batch = make([]uint64, 0, n)
+		s.batchConflicts = make([]uint64, 0, n)
+		s.values = make([]interface{}, n)
+		s.found = make([]bool, n)
+	}
+	// The set is kept at most half full.
+	size := 1
+	for size < 2*n {
+		size <<= 1
+	}
+	if cap(s.seen) < size {
+		s.seen = make([]int, size)
+	}
+	s.seen = s.seen[:size]
+	for i := range s.seen {
+		s.seen[i] = 0
+	}
+	s.hashes, s.conflicts, s.repeat = s.hashes[:n], s.conflicts[:n], s.repeat[:n]
+	s.batch, s.batchConflicts = s.batch[:0], s.batchConflicts[:0]
+}
+
+// release drops the references to the values and clears what was found, as
+// the store only fills in the hits, and puts the buffers back in the pool.
+func (s *multiScratch) release() {
+	for i := range s.values[:len(s.batch)] {
+		s.values[i], s.found[i] = nil, false
+	}
+	multiScratchPool.Put(s)
+}
+
+// markRepeats sets repeat for the keys given at an earlier index too, going by
+// their hashes, and gathers the others that aren't nil in batch.
+func (s *multiScratch) markRepeats(keys []interface{}) {
+	mask := uint64(len(s.seen) - 1)
+	seenNil := false
+	for i, key := range keys {
+		if key == nil {
+			s.repeat[i], seenNil = seenNil, true
+			continue
+		}
+		s.repeat[i] = false
+		for slot := mixHash(s.hashes[i]) & mask; ; slot = (slot + 1) & mask {
+			j := s.seen[slot] - 1
+			if j < 0 {
+				s.seen[slot] = i + 1
+				break
+			}
+			if s.hashes[j] == s.hashes[i] && s.conflicts[j] == s.conflicts[i] {
+				s.repeat[i] = true
+				break
+			}
+		}
+		if !s.repeat[i] {
+			s.batch = append(s.batch, s.hashes[i])
+			s.batchConflicts = append(s.batchConflicts, s.conflicts[i])
+		}
+	}
+}
+
+// GetMultiMap works like GetMulti, but returns the values found by key, along
+// with the keys missed in the order they were given. A key given several times
+// is only looked up once, and appears once in either, and so its access, hit
+// or miss is only recorded once: the accesses are pushed as a single batch of
+// distinct keys. Like GetMulti, it doesn't consult Config.Backing.
+//
+// It's meant for large batches that mostly hit: the map is sized for the hits
+// once they're known, and the buffers used along the way are reused, so the
+// map and the misses are the only allocations. The keys have to be
+// comparable to be keys of the map, so []byte keys panic; use GetMulti for
+// them.
+func (c *Cache) GetMultiMap(keys []interface{}) (map[interface{}]interface{}, []interface{}) {
+	if c == nil || c.isClosed() {
+		var misses []interface{}
+		seen := make(map[interface{}]struct{}, len(keys))
+		for _, key := range keys {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				misses = append(misses, key)
+			}
+		}
+		return map[interface{}]interface{}{}, misses
+	}
+	s := multiScratchPool.Get().(*multiScratch)
+	defer s.release()
+	s.reset(len(keys))
+	for i, key := range keys {
+		s.hashes[i], s.conflicts[i] = 0, 0
+		if key != nil {
+			s.hashes[i], s.conflicts[i] = c.keyToHash(key)
+		}
+	}
+	s.markRepeats(keys)
+
+	// Look every distinct key up, and count the hits.
+	values, found := s.values[:len(s.batch)], s.found[:len(s.batch)]
+	frozen := c.isFrozen()
+	if !frozen {
+		c.store.GetMulti(s.batch, s.batchConflicts, values, found)
+		c.pushMulti(s.batch)
+	}
+	hits := 0
+	for j, keyHash := range s.batch {
+		var presence Presence
+		if frozen {
+			values[j], presence = c.lookup(keyHash, s.batchConflicts[j])
+		} else {
+			values[j], presence = c.found(keyHash, s.batchConflicts[j], values[j], found[j])
+		}
+		found[j] = presence == Present
+		if found[j] {
+			hits++
+		}
+	}
+
+	result := make(map[interface{}]interface{}, hits)
+	var misses []interface{}
+	distinct := 0
+	for i := range keys {
+		if !s.repeat[i] {
+			distinct++
+		}
+	}
+	if distinct > hits {
+		misses = make([]interface{}, 0, distinct-hits)
+	}
+	j := 0
+	for i, key := range keys {
+		switch {
+		case s.repeat[i]:
+		case key == nil:
+			misses = append(misses, nil)
+		default:
+			if found[j] {
+				result[key] = values[j]
+			} else {
+				misses = append(misses, key)
+			}
+			j++
+		}
+	}
+	return result, misses
+}
+
+// delBatch holds the hashes of the distinct keys of a DelMulti.
+type delBatch struct {
+	keys, conflicts []uint64
+}
+
+// DelMulti deletes several keys at once, like Del, and returns the number of
+// keys that were present. The hashmap shards are locked only once each, and the
+// policy stops tracking the keys as a single batch, so deleting many keys costs
+// much less than a Del per key. A key given several times is only deleted and
+// counted once, and nil keys are skipped. OnExit is called for every removed
+// value before DelMulti returns, and the keys are also deleted from
+// Config.Backing, if set.
+func (c *Cache) DelMulti(keys []interface{}) int {
+	if c == nil || c.isClosed() || len(keys) == 0 {
+		return 0
+	}
+	s := multiScratchPool.Get().(*multiScratch)
+	s.reset(len(keys))
+	for i, key := range keys {
+		s.hashes[i], s.conflicts[i] = 0, 0
+		if key != nil {
+			s.hashes[i], s.conflicts[i] = c.keyToHash(key)
+		}
+	}
+	s.markRepeats(keys)
+	// The batch outlives the scratch buffers, as the Set buffer applies it
+	// later on.
+	b := &delBatch{
+		keys:      append([]uint64(nil), s.batch...),
+		conflicts: append([]uint64(nil), s.batchConflicts...),
+	}
+	if c.backing != nil {
+		for i, key := range keys {
+			if key != nil && !s.repeat[i] {
+				c.backing.store.Del(key)
+			}
+		}
+	}
+	s.release()
+	if len(b.keys) == 0 || !c.beginWrite() {
+		return 0
+	}
+	defer c.endWrite()
+	for _, key := range b.keys {
+		c.victims.forget(key)
+		c.pending.del(key)
+	}
+	values := make([]interface{}, len(b.keys))
+	found := make([]bool, len(b.keys))
+	c.store.DelMulti(b.keys, b.conflicts, values, found)
+	deleted := 0
+	for i, ok := range found {
+		if ok {
+			c.onExit(values[i])
+			deleted++
+		}
+	}
+	// Like Del, push the batch through the Set buffer, so that it's applied
+	// after the Sets of the keys made before it.
+	select {
+	case c.setBuf <- &Item{flag: itemDelete, batch: b}:
+		c.waitSynchronous()
+	case <-c.done:
+	}
+	return deleted
+}
+
+// applyDelBatch applies a DelMulti like an itemDelete for each of its keys,
+// with a single call to the policy and to the store.
+func (c *Cache) applyDelBatch(b *delBatch) {
+	keys := make([]uint64, 0, len(b.keys))
+	conflicts := make([]uint64, 0, len(b.keys))
+	for j, key := range b.keys {
+		conflict := b.conflicts[j]
+		if c.store.Conflicts(key, conflict) {
+			continue
+		}
+		if c.events.active() {
+			i := &Item{flag: itemDelete, Key: key, Conflict: conflict}
+			if i.Cost = c.policy.Cost(key); i.Cost >= 0 {
+				c.publish(EventDelete, i)
+			}
+		}
+		c.shadow.del(key)
+		c.tags.del(key)
+		c.ages.del(key)
+		c.backing.forget(key)
+		keys, conflicts = append(keys, key), append(conflicts, conflict)
+	}
+	if len(keys) > 0 {
+		c.policy.DelMulti(keys)
+		values := make([]interface{}, len(keys))
+		found := make([]bool, len(keys))
+		c.store.DelMulti(keys, conflicts, values, found)
+		for j, ok := range found {
+			if ok {
+				c.onExit(values[j])
+			}
+		}
+	}
+	for _, key := range b.keys {
+		c.victims.deleted(key)
+	}
+}
+
+// applySetBatch applies the items of a SetMulti like an itemNew each, writing
+// the ones the policy admits to the store with a single call. The victims are
+// only evicted once they're written, as the policy can pick one of them. It's
+// called by processItems, which passes its evictVictims and trackAdmission.
+func (c *Cache) applySetBatch(items []*Item, evictVictims func([]*Item) []*Item,
+	trackAdmission func(uint64)) {
+	admitted := make([]*Item, 0, len(items))
+	var victims []*Item
+	for _, i := range items {
+		if c.store.Conflicts(i.Key, i.Conflict) {
+			c.countConflict(i.Key)
+			c.publish(EventReject, i)
+			c.onReject(i)
+			continue
+		}
+		c.shadow.set(i.Key, i.Cost)
+		prev, updated, present := c.order.stripe(i.Key).updateIfLatest(c.store, i)
+		if present && !updated {
+			// The key has been updated since, and the newer value stays.
+			c.onExit(i.Value)
+			continue
+		}
+		if updated {
+			// A Set buffered before the batch has admitted the key already.
+			c.onExit(prev)
+			evicted, _ := c.policy.UpdateCost(i.Key, i.Cost)
+			victims = append(victims, evicted...)
+			c.tags.set(i.Key, i.Conflict, nil)
+			c.ages.set(i.Key, c.idleSeconds(0))
+			c.backing.remember(i)
+			c.publish(EventUpdate, i)
+			continue
+		}
+		var evicted []*Item
+		var added bool
+		if class := c.classOf(i); class != "" {
+			evicted, added = c.policy.AddClass(i.Key, i.Cost, class, false)
+		} else {
+			evicted, added = c.policy.Add(i.Key, i.Cost)
+		}
+		victims = append(victims, evicted...)
+		if !added {
+			c.publish(EventReject, i)
+			c.onReject(i)
+			continue
+		}
+		admitted = append(admitted, i)
+	}
+	c.store.SetMulti(admitted)
+	for _, i := range admitted {
+		c.tags.set(i.Key, i.Conflict, nil)
+		c.ages.set(i.Key, c.idleSeconds(0))
+		c.backing.remember(i)
+		c.Metrics.add(keyAdd, i.Key, 1)
+		trackAdmission(i.Key)
+		c.publish(EventAdmit, i)
+	}
+	evictVictims(victims)
+	for _, i := range items {
+		c.pending.done(i)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !race
+// +build !race
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The race detector allocates on its own, so the allocations are only counted
+// without it.
+
+func TestCacheGetMultiMapAllocs(t *testing.T) {
+	c := newMultiCache(t)
+	defer c.Close()
+	keys := multiKeys(c, 500, 480)
+	c.GetMultiMap(keys)
+	allocs := testing.AllocsPerRun(100, func() {
+		c.GetMultiMap(keys)
+	})
+	// The map takes a few allocations of its own, which GetMultiMap can't do
+	// without.
+	mapAllocs := testing.AllocsPerRun(100, func() {
+		_ = make(map[interface{}]interface{}, 480)
+	})
+	require.LessOrEqual(t, allocs-mapAllocs, float64(2))
+}
@@ -0,0 +1,479 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newMultiCache(t testing.TB) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            1000,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheGetMultiMap(t *testing.T) {
+	c := newMultiCache(t)
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		require.True(t, c.Set(i, i*10, 1))
+	}
+	c.Wait()
+
+	keys := []interface{}{100, 1, 2, nil, 1, 101, 3, 100, nil, "2"}
+	pushes := c.BufferStats().Pushes
+	hits, misses := c.GetMultiMap(keys)
+	require.Equal(t, map[interface{}]interface{}{1: 10, 2: 20, 3: 30}, hits)
+	require.Equal(t, []interface{}{100, nil, 101, "2"}, misses)
+	// The keys given twice are only counted and pushed once, and nil keys
+	// never are.
+	require.Equal(t, uint64(3), c.Metrics.Hits())
+	require.Equal(t, uint64(3), c.Metrics.Misses())
+	require.Equal(t, pushes+6, c.BufferStats().Pushes)
+
+	// Every key hits.
+	hits, misses = c.GetMultiMap([]interface{}{4, 5})
+	require.Equal(t, map[interface{}]interface{}{4: 40, 5: 50}, hits)
+	require.Nil(t, misses)
+	hits, misses = c.GetMultiMap(nil)
+	require.Empty(t, hits)
+	require.Nil(t, misses)
+
+	// Once frozen, the keys are still found.
+	c.Freeze()
+	hits, misses = c.GetMultiMap([]interface{}{6, 106, 6})
+	require.Equal(t, map[interface{}]interface{}{6: 60}, hits)
+	require.Equal(t, []interface{}{106}, misses)
+}
+
+// multiKeys Sets hits of n distinct keys, and returns them boxed, the misses
+// last.
+func multiKeys(c *Cache, n, hits int) []interface{} {
+	keys := make([]interface{}, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		if i < hits {
+			c.Set(keys[i], i, 1)
+		}
+	}
+	c.Wait()
+	return keys
+}
+
+func BenchmarkCacheGetMultiMap(b *testing.B) {
+	c := newMultiCache(b)
+	defer c.Close()
+	keys := multiKeys(c, 500, 480)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetMultiMap(keys)
+	}
+}
+
+func BenchmarkCacheGetMulti(b *testing.B) {
+	c := newMultiCache(b)
+	defer c.Close()
+	keys := multiKeys(c, 500, 480)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetMulti(keys)
+	}
+}
+
+func TestCacheSetMultiBatch(t *testing.T) {
+	for name, newMap := range map[string]func() Map{
+		"sharded": nil,
+		"syncmap": func() Map { return NewSyncMap() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Metrics:            true,
+				NewMap:             newMap,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			require.True(t, c.Set(1, "old", 1))
+			c.Wait()
+
+			// The key in the cache is updated, and the one given twice
+			// keeps its last value.
+			added := c.SetMulti([]interface{}{1, 2, 3, 2, nil},
+				[]interface{}{"a", "b", "c", "d", "e"}, []int64{1, 2, 3, 4, 5})
+			require.Equal(t, []bool{true, true, true, true, false}, added)
+			c.Wait()
+			for key, want := range map[int]string{1: "a", 2: "d", 3: "c"} {
+				val, ok := c.GetLocal(key)
+				require.True(t, ok, "key %d", key)
+				require.Equal(t, want, val, "key %d", key)
+			}
+			require.Equal(t, 3, c.Len())
+			require.Equal(t, int64(1+4+3), c.UsedCost())
+			require.Equal(t, uint64(3), c.Metrics.KeysAdded())
+		})
+	}
+}
+
+func TestCacheSetMultiEncoded(t *testing.T) {
+	c := newEncodedCache(t, nil)
+	defer c.Close()
+	require.Equal(t, []bool{true, true}, c.SetMulti([]interface{}{1, 2},
+		[]interface{}{"ab", "cd"}, []int64{0, 0}))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "ab", val)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestCacheSetMultiSubscribe(t *testing.T) {
+	c := newMultiCache(t)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	events, unsubscribe := c.Subscribe(8)
+	defer unsubscribe()
+	c.SetMulti([]interface{}{1, 2}, []interface{}{10, 20}, []int64{1, 1})
+	c.Wait()
+	types := map[EventType]int{}
+	for len(events) > 0 {
+		types[(<-events).Type]++
+	}
+	require.Equal(t, map[EventType]int{EventUpdate: 1, EventAdmit: 1}, types)
+}
+
+func TestCacheSetMultiConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            200,
+		MaxItemCost:        40,
+		BufferItems:        64,
+		BlockingSets:       true,
+		IgnoreInternalCost: true,
+		Cost: func(value interface{}) int64 {
+			return int64(len(value.(string)))
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			keys := make([]interface{}, 4)
+			values := make([]interface{}, len(keys))
+			costs := make([]int64, len(keys))
+			for i := 0; i < 500; i++ {
+				for n := range keys {
+					keys[n], values[n] = r.Intn(20), strings.Repeat("x", r.Intn(50))
+				}
+				if g%2 == 0 {
+					c.SetMulti(keys, values, costs)
+					continue
+				}
+				for n := range keys {
+					c.Set(keys[n], values[n], 0)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+
+	// Every value left is charged its own cost, and they fit.
+	var total int64
+	c.Range(func(item *Item) bool {
+		value := item.Value.(string)
+		require.Equal(t, int64(len(value)), c.policy.Cost(item.Key))
+		total += int64(len(value))
+		return true
+	})
+	require.Equal(t, c.UsedCost(), total)
+	require.LessOrEqual(t, total, int64(200))
+}
+
+// Only the calls are timed, as the policy applies the Sets in the background
+// either way.
+func BenchmarkCacheSetMulti(b *testing.B) {
+	const n, set = 100000, 200
+	b.Run("SetMulti", func(b *testing.B) {
+		c, keys := newDelMultiBench(b, n, set)
+		defer c.Close()
+		c.DelMulti(keys)
+		c.Wait()
+		costs := make([]int64, len(keys))
+		for i := range costs {
+			costs[i] = 1
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.SetMulti(keys, keys, costs)
+			b.StopTimer()
+			c.Wait()
+			c.DelMulti(keys)
+			c.Wait()
+			b.StartTimer()
+		}
+	})
+	b.Run("Set", func(b *testing.B) {
+		c, keys := newDelMultiBench(b, n, set)
+		defer c.Close()
+		c.DelMulti(keys)
+		c.Wait()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				c.Set(key, key, 1)
+			}
+			b.StopTimer()
+			c.Wait()
+			c.DelMulti(keys)
+			c.Wait()
+			b.StartTimer()
+		}
+	})
+}
+
+func TestCacheDelMulti(t *testing.T) {
+	for name, newMap := range map[string]func() Map{
+		"sharded": nil,
+		"syncmap": func() Map { return NewSyncMap() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var exits int32
+			l2 := NewMapBackingStore()
+			c, err := NewCache(&Config{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Metrics:            true,
+				Backing:            l2,
+				NewMap:             newMap,
+				OnExit:             func(interface{}) { atomic.AddInt32(&exits, 1) },
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 10; i++ {
+				require.True(t, c.Set(i, i*10, int64(i+1)))
+				l2.Set(i, i*10)
+			}
+			c.Wait()
+
+			// Missing and nil keys are skipped, and keys given twice are
+			// only counted once.
+			require.Equal(t, 3, c.DelMulti([]interface{}{1, 2, nil, 2, 100, 3}))
+			require.Equal(t, int32(3), atomic.LoadInt32(&exits))
+			c.Wait()
+			for i := 0; i < 10; i++ {
+				_, ok := c.GetLocal(i)
+				require.Equal(t, i < 1 || i > 3, ok, "key %d", i)
+				_, ok = l2.Get(i)
+				require.Equal(t, i < 1 || i > 3, ok, "key %d", i)
+			}
+			require.Equal(t, 7, c.Len())
+			require.Equal(t, int64(55-2-3-4), c.UsedCost())
+			require.Equal(t, uint64(3), c.Metrics.KeysEvicted())
+			require.Equal(t, uint64(2+3+4), c.Metrics.CostEvicted())
+
+			require.Zero(t, c.DelMulti([]interface{}{1, 2, 3}))
+			require.Zero(t, c.DelMulti(nil))
+			c.Wait()
+			require.Equal(t, uint64(3), c.Metrics.KeysEvicted())
+			require.Equal(t, int32(3), atomic.LoadInt32(&exits))
+		})
+	}
+}
+
+func TestCacheDelMultiEncoded(t *testing.T) {
+	c := newEncodedCache(t, nil)
+	defer c.Close()
+	require.True(t, c.Set(1, "ab", 0))
+	require.True(t, c.Set(2, "cd", 0))
+	c.Wait()
+	require.Equal(t, 2, c.DelMulti([]interface{}{1, 2}))
+	c.Wait()
+	require.Zero(t, c.Len())
+	require.Zero(t, c.UsedCost())
+}
+
+func TestCacheDelMultiSubscribe(t *testing.T) {
+	c := newMultiCache(t)
+	defer c.Close()
+	events, cancel := c.Subscribe(16)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	require.Equal(t, 2, c.DelMulti([]interface{}{0, 2, 2}))
+	c.Wait()
+	deleted := map[uint64]bool{}
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventDelete {
+			deleted[e.Key] = true
+		}
+	}
+	k0, _ := c.keyToHash(0)
+	k2, _ := c.keyToHash(2)
+	require.Equal(t, map[uint64]bool{k0: true, k2: true}, deleted)
+}
+
+// TestCacheDelMultiConcurrent deletes batches of keys while they're being Set
+// again and evicted, and checks that the store and the policy agree once it's
+// all applied.
+func TestCacheDelMultiConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        10000,
+		MaxCost:            500,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The keys from 1000 on are Set once and deleted, while the ones below
+	// are Set over and over, evicting each other and the rest.
+	for i := 1000; i < 1300; i++ {
+		require.True(t, c.Set(i, i, 1))
+	}
+	c.Wait()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.Set(i%1000, i, 1)
+			}
+		}(g)
+	}
+	keys := make([]interface{}, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, i)
+	}
+	for i := 1000; i < 1300; i++ {
+		keys = append(keys, i)
+	}
+	for n := 0; n < 50; n++ {
+		c.DelMulti(keys)
+	}
+	close(stop)
+	wg.Wait()
+	c.Wait()
+
+	for i := 1000; i < 1300; i++ {
+		_, ok := c.Get(i)
+		require.False(t, ok, "key %d", i)
+	}
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	defer p.Unlock()
+	var used int64
+	for key, cost := range p.evict.keyCosts {
+		require.True(t, c.store.Has(key), "ghost %d", key)
+		used += cost
+	}
+	require.Equal(t, used, p.evict.used)
+	require.Equal(t, len(p.evict.keyCosts), c.store.Len())
+}
+
+// newDelMultiBench returns a cache holding n keys, and the keys to delete.
+func newDelMultiBench(b testing.TB, n, del int) (*Cache, []interface{}) {
+	c, err := NewCache(&Config{
+		NumCounters:        int64(10 * n),
+		MaxCost:            int64(n),
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(b, err)
+	for i := 0; i < n; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	keys := make([]interface{}, del)
+	for i := range keys {
+		keys[i] = i * (n / del)
+	}
+	return c, keys
+}
+
+func BenchmarkCacheDelMulti(b *testing.B) {
+	const n, del = 1000000, 200000
+	b.Run("DelMulti", func(b *testing.B) {
+		c, keys := newDelMultiBench(b, n, del)
+		defer c.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			c.DelMulti(keys)
+			c.Wait()
+			b.StopTimer()
+			for _, key := range keys {
+				c.Set(key, key, 1)
+			}
+			c.Wait()
+			b.StartTimer()
+		}
+	})
+	b.Run("Del", func(b *testing.B) {
+		c, keys := newDelMultiBench(b, n, del)
+		defer c.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, key := range keys {
+				c.Del(key)
+			}
+			c.Wait()
+			b.StopTimer()
+			for _, key := range keys {
+				c.Set(key, key, 1)
+			}
+			c.Wait()
+			b.StartTimer()
+		}
+	})
+}
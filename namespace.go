@@ -0,0 +1,276 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// namespaceTagPrefix starts the tag marking the keys of a namespace. Tags
+// given to SetWithOptions shouldn't start with it.
+const namespaceTagPrefix = "\x00ns\x00"
+
+// Namespace is a view of a cache whose keys are kept apart from the keys of
+// the cache itself and of other namespaces, while sharing its MaxCost and
+// policy. See Cache.Namespace. The namespace of a nil cache is nil, and
+// behaves like it.
+type Namespace struct {
+	// hits, misses and evictions come first to be 64-bit aligned.
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	c         *Cache
+	name      string
+	// seed and conflictSeed are mixed into the hashes of the keys.
+	seed         uint64
+	conflictSeed uint64
+	// tags holds the tag marking the keys of the namespace, so that Sets
+	// without tags of their own don't build a slice.
+	tags    []string
+	onEvict atomic.Value
+}
+
+// namespaces holds the namespaces of a cache by name.
+type namespaces struct {
+	sync.Mutex
+	m map[string]*Namespace
+}
+
+// Namespace returns the view of the cache for the namespace with the given
+// name, creating it the first time. Keys set in a namespace are mixed with the
+// name before being hashed, so they don't clash with the same keys in the
+// cache or in other namespaces, short of a hash collision, and no key is
+// built for it. The items are otherwise like any other: they count against
+// MaxCost and compete with the rest for admission, and Range, Len and the
+// cache-wide metrics include them.
+//
+// Under the hood, the items of a namespace carry a reserved tag, so a Set in a
+// namespace updating a key waits for room in the Set buffer like a tagged Set.
+// Namespaces skip Config.Backing.
+func (c *Cache) Namespace(name string) *Namespace {
+	if c == nil {
+		return nil
+	}
+	c.namespaces.Lock()
+	defer c.namespaces.Unlock()
+	if c.namespaces.m == nil {
+		c.namespaces.m = make(map[string]*Namespace)
+	}
+	if ns, ok := c.namespaces.m[name]; ok {
+		return ns
+	}
+	seed, conflictSeed := z.KeyToHash(namespaceTagPrefix + name)
+	ns := &Namespace{
+		c:            c,
+		name:         name,
+		seed:         seed,
+		conflictSeed: conflictSeed,
+		tags:         []string{namespaceTagPrefix + name},
+	}
+	c.namespaces.m[name] = ns
+	return ns
+}
+
+// namespaceOf returns the namespace of the key, going by its tags.
+func (c *Cache) namespaceOf(key uint64) *Namespace {
+	for _, tag := range c.tags.of(key) {
+		if strings.HasPrefix(tag, namespaceTagPrefix) {
+			c.namespaces.Lock()
+			ns := c.namespaces.m[tag[len(namespaceTagPrefix):]]
+			c.namespaces.Unlock()
+			return ns
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the namespace.
+func (n *Namespace) Name() string {
+	if n == nil {
+		return ""
+	}
+	return n.name
+}
+
+// keyToHash hashes the key with the cache's Config.KeyToHash, and mixes it
+// with the namespace.
+func (n *Namespace) keyToHash(key interface{}) (uint64, uint64) {
+	keyHash, conflictHash := n.c.keyToHash(key)
+	return mixHash(keyHash ^ n.seed), mixHash(conflictHash ^ n.conflictSeed)
+}
+
+// mixHash is the finalizer of SplitMix64, spreading every bit of h over the
+// result.
+func mixHash(h uint64) uint64 {
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+// Get works like Cache.Get for the key of the namespace.
+func (n *Namespace) Get(key interface{}) (interface{}, bool) {
+	if n == nil || n.c.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := n.keyToHash(key)
+	value, ok := n.c.get(keyHash, conflictHash)
+	if n.c.Metrics != nil {
+		if ok {
+			atomic.AddUint64(&n.hits, 1)
+		} else {
+			atomic.AddUint64(&n.misses, 1)
+		}
+	}
+	return value, ok
+}
+
+// Set works like Cache.Set for the key of the namespace.
+func (n *Namespace) Set(key, value interface{}, cost int64) bool {
+	if n == nil {
+		return false
+	}
+	return n.SetWithOptions(key, value, cost, SetOptions{})
+}
+
+// SetWithTTL works like Cache.SetWithTTL for the key of the namespace.
+func (n *Namespace) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	if n == nil || ttl < 0 {
+		return false
+	}
+	if ttl == 0 {
+		// SetWithOptions would take this for the default TTL.
+		return n.set(key, value, cost, 0, SetOptions{})
+	}
+	return n.SetWithOptions(key, value, cost, SetOptions{TTL: ttl})
+}
+
+// SetWithOptions works like Cache.SetWithOptions for the key of the namespace.
+// The tags are only seen by InvalidateTag on the cache, as namespaces don't
+// keep their tags apart.
+func (n *Namespace) SetWithOptions(key, value interface{}, cost int64, opts SetOptions) bool {
+	if n == nil {
+		return false
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = n.c.defaultTTL
+	}
+	return n.set(key, value, cost, ttl, opts)
+}
+
+func (n *Namespace) set(key, value interface{}, cost int64, ttl time.Duration, opts SetOptions) bool {
+	if n.c.isClosed() || key == nil {
+		return false
+	}
+	opts.ns = n
+	keyHash, conflictHash := n.keyToHash(key)
+	return n.c.setHashed(nil, keyHash, conflictHash, value, cost, ttl, false, opts)
+}
+
+// withTags returns the tags of a Set in the namespace, given the ones passed
+// to SetWithOptions.
+func (n *Namespace) withTags(tags []string) []string {
+	if len(tags) == 0 {
+		return n.tags
+	}
+	return append(append(make([]string, 0, len(tags)+1), tags...), n.tags[0])
+}
+
+// Del works like Cache.Del for the key of the namespace.
+func (n *Namespace) Del(key interface{}) (interface{}, bool) {
+	if n == nil || n.c.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := n.keyToHash(key)
+	return n.c.del(keyHash, conflictHash)
+}
+
+// DropAll deletes every item of the namespace, like InvalidateTag, and returns
+// the number of items deleted.
+func (n *Namespace) DropAll() int {
+	if n == nil {
+		return 0
+	}
+	return n.c.InvalidateTag(n.tags[0])
+}
+
+// Len returns the number of items of the namespace in the cache.
+func (n *Namespace) Len() int {
+	if n == nil || n.c.isClosed() {
+		return 0
+	}
+	return n.c.tags.count(n.tags[0])
+}
+
+// OnEvict sets the function called for every eviction of an item of the
+// namespace, on top of Config.OnEvict, like it. Passing nil stops the calls.
+func (n *Namespace) OnEvict(f func(item *Item)) {
+	if n == nil {
+		return
+	}
+	n.onEvict.Store(f)
+}
+
+// evicted calls the OnEvict function of the namespace for the item, if any,
+// and counts the eviction.
+func (n *Namespace) evicted(item *Item) {
+	if n.c.Metrics != nil {
+		atomic.AddUint64(&n.evictions, 1)
+	}
+	if f, _ := n.onEvict.Load().(func(*Item)); f != nil {
+		n.c.guard("Namespace.OnEvict", func() { f(item) })
+	}
+}
+
+// UsedCost returns the sum of the costs of the items of the namespace admitted
+// by the policy, like Cache.UsedCost.
+func (n *Namespace) UsedCost() int64 {
+	if n == nil || n.c.isClosed() {
+		return 0
+	}
+	return n.c.policy.ClassUsed(n.name)
+}
+
+// Hits is the number of Gets of the namespace that found their key. Like the
+// counters below, it's only kept if Config.Metrics is set.
+func (n *Namespace) Hits() uint64 {
+	if n == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&n.hits)
+}
+
+// Misses is the number of Gets of the namespace that didn't find their key.
+func (n *Namespace) Misses() uint64 {
+	if n == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&n.misses)
+}
+
+// Evictions is the number of items of the namespace evicted.
+func (n *Namespace) Evictions() uint64 {
+	if n == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&n.evictions)
+}
@@ -0,0 +1,49 @@
+//go:build !race
+// +build !race
+
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The race detector drops items from the pools on purpose, so the allocations
+// are only compared without it.
+
+func TestCacheNamespaceAllocs(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	ns := c.Namespace("ns")
+	require.True(t, ns.Set("key", 1, 1))
+	require.True(t, c.Set("key", 1, 1))
+	c.Wait()
+	key := interface{}("key")
+	base := testing.AllocsPerRun(100, func() { c.Get(key) })
+	// Namespaced keys are mixed into the hash rather than joined.
+	require.Equal(t, base, testing.AllocsPerRun(100, func() { ns.Get(key) }))
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheNamespace(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	a, b := c.Namespace("a"), c.Namespace("b")
+	require.True(t, a == c.Namespace("a"))
+	require.Equal(t, "a", a.Name())
+	require.True(t, a.Set("key", "a", 1))
+	require.True(t, b.Set("key", "b", 1))
+	require.True(t, c.Set("key", "c", 1))
+	require.True(t, a.Set(1, "a1", 1))
+	c.Wait()
+
+	// The same key is kept apart in every namespace.
+	val, ok := a.Get("key")
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	val, _ = b.Get("key")
+	require.Equal(t, "b", val)
+	val, _ = c.Get("key")
+	require.Equal(t, "c", val)
+	_, ok = b.Get(1)
+	require.False(t, ok)
+	require.Equal(t, uint64(1), a.Hits())
+	require.Equal(t, uint64(1), b.Hits())
+	require.Equal(t, uint64(1), b.Misses())
+
+	require.Equal(t, 2, a.Len())
+	require.Equal(t, 1, b.Len())
+	require.Equal(t, 2, a.DropAll())
+	_, ok = a.Get("key")
+	require.False(t, ok)
+	_, ok = b.Get("key")
+	require.True(t, ok)
+	_, ok = c.Get("key")
+	require.True(t, ok)
+
+	val, ok = b.Del("key")
+	require.True(t, ok)
+	require.Equal(t, "b", val)
+	_, ok = c.Get("key")
+	require.True(t, ok)
+}
+
+func TestCacheNamespaceOnEvict(t *testing.T) {
+	var mu sync.Mutex
+	var cacheEvictions int
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		OnEvict: func(*Item) {
+			mu.Lock()
+			cacheEvictions++
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	a, b := c.Namespace("a"), c.Namespace("b")
+	var aEvicted, bEvicted []*Item
+	a.OnEvict(func(item *Item) { aEvicted = append(aEvicted, item) })
+	b.OnEvict(func(item *Item) { bEvicted = append(bEvicted, item) })
+	for i := 0; i < 4; i++ {
+		require.True(t, a.SetWithTTL(i, i, 1, 0))
+	}
+	c.Wait()
+	// The items of b make room by evicting those of a.
+	for i := 0; i < 4; i++ {
+		require.True(t, b.Set(i, i, 1))
+		c.Wait()
+	}
+	// Each namespace only hears of its own items.
+	owns := func(ns *Namespace, items []*Item) {
+		keys := make(map[uint64]bool)
+		for i := 0; i < 4; i++ {
+			key, _ := ns.keyToHash(i)
+			keys[key] = true
+		}
+		for _, item := range items {
+			require.True(t, keys[item.Key])
+		}
+	}
+	owns(a, aEvicted)
+	owns(b, bEvicted)
+	require.NotEmpty(t, aEvicted)
+	require.Equal(t, uint64(len(aEvicted)), a.Evictions())
+	require.Equal(t, cacheEvictions, len(aEvicted)+len(bEvicted))
+	require.Equal(t, 4, a.Len()+b.Len())
+	require.Equal(t, 4-len(aEvicted), a.Len())
+
+	a.OnEvict(nil)
+	c.Clear()
+	require.Zero(t, a.Len())
+}
+
+func TestCacheNamespaceQuota(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"lru":     NewLRUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        1000,
+				MaxCost:            100,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+
+			quiet, noisy := c.Namespace("quiet"), c.Namespace("noisy")
+			c.UpdateQuota("noisy", 0.6)
+			for i := 0; i < 40; i++ {
+				require.True(t, quiet.Set(i, i, 1))
+			}
+			c.Wait()
+			require.Equal(t, int64(40), quiet.UsedCost())
+
+			// The noisy tenant floods the cache with keys it reads a lot.
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 1000; i++ {
+					noisy.Set(i, i, 1)
+					noisy.Get(i)
+					noisy.Get(i)
+				}
+				c.Wait()
+				require.LessOrEqual(t, noisy.UsedCost(), int64(60))
+				require.Equal(t, int64(40), quiet.UsedCost())
+			}
+			require.Equal(t, 40, quiet.Len())
+
+			// Lowering the quota shrinks the tenant without touching the
+			// other one.
+			c.UpdateQuota("noisy", 0.2)
+			for start := time.Now(); noisy.UsedCost() > 20; time.Sleep(time.Millisecond) {
+				require.True(t, time.Since(start) < time.Second, "namespace didn't shrink")
+			}
+			c.Wait()
+			require.Equal(t, int64(20), noisy.UsedCost())
+			require.Equal(t, int64(40), quiet.UsedCost())
+			require.Equal(t, int64(60), c.UsedCost())
+		})
+	}
+}
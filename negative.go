@@ -0,0 +1,77 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "time"
+
+// negativeValue is the type of Negative.
+type negativeValue struct{}
+
+// Negative is the value of the entries added by SetNegative, which record
+// that a key is known to be absent from the data behind the cache. Get and its
+// like report these entries missing, but Range, Config.OnEvict and the other
+// callbacks get them with this value.
+var Negative interface{} = negativeValue{}
+
+// Presence is what the cache knows about a key, as returned by Lookup.
+type Presence int
+
+const (
+	// Unknown is a key the cache has no entry for.
+	Unknown Presence = iota
+	// Present is a key with a value in the cache.
+	Present
+	// KnownAbsent is a key set by SetNegative.
+	KnownAbsent
+)
+
+// SetNegative records that the key is known to be absent from the data behind
+// the cache, for instance after a lookup in a database found nothing, so that
+// Lookup can tell so without going to the database again. The entry replaces
+// the value of the key, if any, and is a normal item otherwise: it costs
+// Config.NegativeCost, goes through admission, and is evicted and expires like
+// the others. A ttl of 0 means Config.NegativeTTL. SetNegative returns false,
+// like Set, if the entry was dropped, and also if ttl is negative or the cache
+// has Config.StoreEncoded, whose stores only hold encoded values.
+func (c *Cache) SetNegative(key interface{}, ttl time.Duration) bool {
+	if c == nil || c.isClosed() || key == nil || ttl < 0 || c.storeEncoded {
+		return false
+	}
+	if ttl == 0 {
+		ttl = c.negativeTTL
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	return c.setHashed(key, keyHash, conflictHash, Negative, c.negativeCost, ttl, false, SetOptions{})
+}
+
+// Lookup works like Get, but also tells apart the keys set by SetNegative,
+// returned as KnownAbsent with a nil value. Finding one counts in
+// Metrics.NegativeHits rather than as a hit or a miss. As with Get, a key the
+// cache has no entry for is looked up in Config.Backing, if set.
+func (c *Cache) Lookup(key interface{}) (interface{}, Presence) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, Unknown
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	value, presence := c.lookup(keyHash, conflictHash)
+	if presence == Unknown && c.backing != nil {
+		if value, ok := c.getBacking(key); ok {
+			return value, Present
+		}
+	}
+	return value, presence
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSetNegative(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	var evicted []interface{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+		DefaultTTL:         time.Hour,
+		NegativeTTL:        time.Minute,
+		OnEvict:            func(item *Item) { evicted = append(evicted, item.Value) },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetNegative(1, 0))
+	require.True(t, c.Set(2, "two", 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.False(t, ok)
+	require.Nil(t, val)
+	val, presence := c.Lookup(1)
+	require.Equal(t, KnownAbsent, presence)
+	require.Nil(t, val)
+	val, presence = c.Lookup(2)
+	require.Equal(t, Present, presence)
+	require.Equal(t, "two", val)
+	_, presence = c.Lookup(3)
+	require.Equal(t, Unknown, presence)
+	_, ok = c.Peek(1)
+	require.False(t, ok)
+	require.Equal(t, uint64(2), c.Metrics.NegativeHits())
+	require.Equal(t, uint64(1), c.Metrics.Hits())
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+	// Negative entries cost 1 by default, and expire after NegativeTTL.
+	require.Equal(t, int64(2), c.UsedCost())
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, ttl)
+
+	// A Set replaces a negative entry, and the other way around.
+	require.True(t, c.Set(1, "one", 1))
+	c.Wait()
+	_, presence = c.Lookup(1)
+	require.Equal(t, Present, presence)
+	require.True(t, c.SetNegative(2, time.Hour))
+	c.Wait()
+	_, presence = c.Lookup(2)
+	require.Equal(t, KnownAbsent, presence)
+	values, found := c.GetMulti([]interface{}{1, 2})
+	require.Equal(t, []interface{}{"one", nil}, values)
+	require.Equal(t, []bool{true, false}, found)
+
+	// GetOrCompute loads values over negative entries.
+	val, err = c.GetOrCompute(2, func() (interface{}, int64, error) {
+		return "loaded", 1, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "loaded", val)
+
+	// Negative entries are evicted like the others.
+	require.True(t, c.SetNegative(3, 0))
+	c.Wait()
+	require.Equal(t, 3, c.EvictN(10))
+	require.Contains(t, evicted, Negative)
+}
+
+func TestCacheNegativeConfig(t *testing.T) {
+	l2 := NewMapBackingStore()
+	l2.Set(1, "one")
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Backing:            l2,
+		Clock:              clock,
+		DefaultTTL:         time.Hour,
+		NegativeCost:       3,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// The backing store isn't asked about keys known to be absent.
+	require.True(t, c.SetNegative(1, 0))
+	c.Wait()
+	_, ok := c.Get(1)
+	require.False(t, ok)
+	_, presence := c.Lookup(1)
+	require.Equal(t, KnownAbsent, presence)
+	require.Equal(t, int64(3), c.UsedCost())
+	// Without NegativeTTL, negative entries expire after DefaultTTL.
+	ttl, _ := c.GetTTL(1)
+	require.Equal(t, time.Hour, ttl)
+	clock.Add(2 * time.Hour)
+	val, presence := c.Lookup(1)
+	require.Equal(t, Present, presence)
+	require.Equal(t, "one", val)
+
+	require.False(t, c.SetNegative(2, -time.Second))
+	require.False(t, c.SetNegative(nil, 0))
+	encoded, err := NewCache(&Config{
+		NumCounters:  100,
+		MaxCost:      10,
+		StoreEncoded: true,
+		EncodeValue:  func(value interface{}) ([]byte, error) { return nil, nil },
+		DecodeValue:  func(data []byte) (interface{}, error) { return nil, nil },
+	})
+	require.NoError(t, err)
+	defer encoded.Close()
+	require.False(t, encoded.SetNegative(1, 0))
+}
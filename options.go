@@ -0,0 +1,253 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	// defaultMaxCounters caps the NumCounters NewDefaultCache picks, so that
+	// the frequency sketch of a large cache of small items stays at a few
+	// tens of megabytes.
+	defaultMaxCounters = 1 << 24
+	// defaultMinCounters is the least NumCounters NewDefaultCache picks.
+	defaultMinCounters = 100
+	// defaultSetBufferPerProc is the room for Sets NewDefaultCache gives the
+	// Set buffer for every P.
+	defaultSetBufferPerProc = 4096
+)
+
+// Option configures a cache built by NewCacheWithOptions. It fills in a field
+// of Config, and returns an error for an argument the field can't take.
+type Option func(config *Config) error
+
+// NewCacheWithOptions returns a new cache built from the options, applied in
+// order to an empty Config, so a later option overrides an earlier one. The
+// Config is then handed to NewCache, which checks how the fields go together
+// and fills in the defaults, so both constructors build the same cache from the
+// same settings. WithNumCounters and WithCacheSize are required.
+func NewCacheWithOptions(opts ...Option) (*Cache, error) {
+	config := &Config{}
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			return nil, err
+		}
+	}
+	return NewCache(config)
+}
+
+// NewDefaultCache returns a new cache holding items up to a total cost of
+// maxCost, with the settings recommended for most uses: the default policy,
+// metrics, and the internal cost of the items added to their cost, so that
+// maxCost is about the memory the cache takes, in bytes, if the costs given to
+// Set are the sizes of the values. NumCounters is sized for the most items
+// that fit, and the Set buffer from GOMAXPROCS.
+//
+// The settings picked may change in later releases, to follow what works
+// best, without callers having to change. opts are applied on top of them,
+// like in NewCacheWithOptions, and the sizes are only picked if they don't
+// set them.
+func NewDefaultCache(maxCost int64, opts ...Option) (*Cache, error) {
+	all := make([]Option, 0, len(opts)+3)
+	all = append(all, WithCacheSize(maxCost), WithMetrics())
+	all = append(all, opts...)
+	return NewCacheWithOptions(append(all, withDefaultSizes())...)
+}
+
+// withDefaultSizes sets the sizes NewDefaultCache picks, unless they're set:
+// NumCounters for 10 times the number of items of cost 1 that fit, along with
+// their internal cost, and SetBufferItems from GOMAXPROCS.
+func withDefaultSizes() Option {
+	return func(config *Config) error {
+		if config.NumCounters == 0 {
+			items := config.MaxCost / (internalCost(config) + 1)
+			switch {
+			case items > defaultMaxCounters/10:
+				config.NumCounters = defaultMaxCounters
+			case items < defaultMinCounters/10:
+				config.NumCounters = defaultMinCounters
+			default:
+				config.NumCounters = 10 * items
+			}
+		}
+		if config.SetBufferItems == 0 {
+			config.SetBufferItems = defaultSetBufferPerProc * runtime.GOMAXPROCS(0)
+		}
+		return nil
+	}
+}
+
+// WithNumCounters sets Config.NumCounters, the number of keys whose frequency
+// is tracked. It should be about 10 times the number of items expected when
+// the cache is full.
+func WithNumCounters(n int64) Option {
+	return func(config *Config) error {
+		if n <= 0 {
+			return fmt.Errorf("WithNumCounters must be positive, got %d", n)
+		}
+		config.NumCounters = n
+		return nil
+	}
+}
+
+// WithCacheSize sets Config.MaxCost, the sum of the costs the cache holds
+// before evicting.
+func WithCacheSize(maxCost int64) Option {
+	return func(config *Config) error {
+		if maxCost <= 0 {
+			return fmt.Errorf("WithCacheSize must be positive, got %d", maxCost)
+		}
+		config.MaxCost = maxCost
+		return nil
+	}
+}
+
+// WithMaxEntries sets Config.MaxEntries, the number of items the cache holds
+// before evicting, whatever their cost.
+func WithMaxEntries(n int64) Option {
+	return func(config *Config) error {
+		if n <= 0 {
+			return fmt.Errorf("WithMaxEntries must be positive, got %d", n)
+		}
+		config.MaxEntries = n
+		return nil
+	}
+}
+
+// WithPolicy sets Config.Policy, the constructor of the admission and eviction
+// policy used instead of the default one.
+func WithPolicy(policy func(numCounters, maxCost int64) Policy) Option {
+	return func(config *Config) error {
+		if policy == nil {
+			return errors.New("WithPolicy can't be nil")
+		}
+		config.Policy = policy
+		return nil
+	}
+}
+
+// WithOnEvict sets Config.OnEvict, called for every eviction.
+func WithOnEvict(f func(item *Item)) Option {
+	return func(config *Config) error {
+		if f == nil {
+			return errors.New("WithOnEvict can't be nil")
+		}
+		config.OnEvict = f
+		return nil
+	}
+}
+
+// WithOnReject sets Config.OnReject, called for every rejection by the policy.
+func WithOnReject(f func(item *Item)) Option {
+	return func(config *Config) error {
+		if f == nil {
+			return errors.New("WithOnReject can't be nil")
+		}
+		config.OnReject = f
+		return nil
+	}
+}
+
+// WithBufferSize sets Config.BufferItems, the size of the Get buffers. Without
+// it, the buffers hold 64 keys.
+func WithBufferSize(n int64) Option {
+	return func(config *Config) error {
+		if n <= 0 {
+			return fmt.Errorf("WithBufferSize must be positive, got %d", n)
+		}
+		config.BufferItems = n
+		return nil
+	}
+}
+
+// WithDefaultTTL sets Config.DefaultTTL, the TTL of the items set without one.
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(config *Config) error {
+		if ttl <= 0 {
+			return fmt.Errorf("WithDefaultTTL must be positive, got %v", ttl)
+		}
+		config.DefaultTTL = ttl
+		return nil
+	}
+}
+
+// WithKeyToHash sets Config.KeyToHash, the hash function of the keys.
+func WithKeyToHash(f func(key interface{}) (uint64, uint64)) Option {
+	return func(config *Config) error {
+		if f == nil {
+			return errors.New("WithKeyToHash can't be nil")
+		}
+		config.KeyToHash = f
+		return nil
+	}
+}
+
+// WithCost sets Config.Cost, which works out the cost of the values set with
+// a cost of 0.
+func WithCost(f func(value interface{}) int64) Option {
+	return func(config *Config) error {
+		if f == nil {
+			return errors.New("WithCost can't be nil")
+		}
+		config.Cost = f
+		return nil
+	}
+}
+
+// WithStoreShards sets Config.StoreShards, the number of shards of the store,
+// a power of two.
+func WithStoreShards(n int) Option {
+	return func(config *Config) error {
+		if n <= 0 || n&(n-1) != 0 {
+			return fmt.Errorf("WithStoreShards must be a power of two, got %d", n)
+		}
+		config.StoreShards = n
+		return nil
+	}
+}
+
+// WithMetrics sets Config.Metrics, so that the cache keeps its metrics.
+func WithMetrics() Option {
+	return func(config *Config) error {
+		config.Metrics = true
+		return nil
+	}
+}
+
+// WithIgnoreInternalCost sets Config.IgnoreInternalCost, so that the costs of
+// the items are only the ones given to Set.
+func WithIgnoreInternalCost() Option {
+	return func(config *Config) error {
+		config.IgnoreInternalCost = true
+		return nil
+	}
+}
+
+// WithClock sets Config.Clock, the source of the time of the cache.
+func WithClock(clock Clock) Option {
+	return func(config *Config) error {
+		if clock == nil {
+			return errors.New("WithClock can't be nil")
+		}
+		config.Clock = clock
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto_test
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+func ExampleNewDefaultCache() {
+	// The cache holds about 1MB of values, their costs being their sizes.
+	cache, err := ristretto.NewDefaultCache(1 << 20)
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+
+	value := make([]byte, 64<<10)
+	cache.Set("a", value, int64(len(value)))
+	cache.Wait()
+	_, ok := cache.Get("a")
+	fmt.Println("found a:", ok)
+
+	// 1MB can't take 32 more values of 64KB, so some are evicted.
+	for i := 0; i < 32; i++ {
+		cache.Set(i, value, int64(len(value)))
+		cache.Wait()
+	}
+	fmt.Println("evicted:", cache.Metrics.KeysEvicted() > 0)
+	fmt.Println("within 1MB:", cache.UsedCost() <= 1<<20)
+	// Output:
+	// found a: true
+	// evicted: true
+	// within 1MB: true
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCacheWithOptions(t *testing.T) {
+	var evicted int
+	c, err := NewCacheWithOptions(
+		WithNumCounters(100),
+		WithCacheSize(10),
+		WithBufferSize(1),
+		WithDefaultTTL(time.Hour),
+		WithIgnoreInternalCost(),
+		WithMetrics(),
+		WithOnEvict(func(item *Item) { evicted++ }),
+	)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NotNil(t, c.Metrics)
+	require.Equal(t, int64(10), c.MaxCost())
+	require.Equal(t, time.Hour, c.defaultTTL)
+
+	for i := 0; i < 20; i++ {
+		c.Set(i, i, 1)
+		c.Wait()
+	}
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, 10, evicted)
+	ttl, ok := c.GetTTL(19)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, ttl, float64(time.Minute))
+}
+
+func TestNewDefaultCache(t *testing.T) {
+	c, err := NewDefaultCache(1 << 20)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NotNil(t, c.Metrics)
+	require.Equal(t, int64(1<<20), c.MaxCost())
+	require.NotZero(t, c.internalCost)
+
+	// Options override the defaults, and the sizes are only picked if unset.
+	c, err = NewDefaultCache(1<<20, WithIgnoreInternalCost(), WithCacheSize(10))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, int64(10), c.MaxCost())
+	require.Zero(t, c.internalCost)
+
+	for _, tc := range []struct {
+		config   Config
+		counters int64
+	}{
+		{Config{MaxCost: 1 << 20, IgnoreInternalCost: true}, 10 << 20},
+		{Config{MaxCost: 1 << 40, IgnoreInternalCost: true}, defaultMaxCounters},
+		{Config{MaxCost: 10}, defaultMinCounters},
+		{Config{MaxCost: 1 << 20, NumCounters: 7}, 7},
+	} {
+		config := tc.config
+		require.NoError(t, withDefaultSizes()(&config))
+		require.Equal(t, tc.counters, config.NumCounters)
+		require.NotZero(t, config.SetBufferItems)
+	}
+
+	_, err = NewDefaultCache(0)
+	require.Error(t, err)
+}
+
+func TestNewCacheWithOptionsErrors(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		err  string
+	}{
+		{nil, "NumCounters must be positive, got 0"},
+		{[]Option{WithNumCounters(100)}, "MaxCost must be positive, got 0"},
+		{[]Option{WithNumCounters(0)}, "WithNumCounters must be positive, got 0"},
+		{[]Option{WithCacheSize(-1)}, "WithCacheSize must be positive, got -1"},
+		{[]Option{WithMaxEntries(0)}, "WithMaxEntries must be positive, got 0"},
+		{[]Option{WithPolicy(nil)}, "WithPolicy can't be nil"},
+		{[]Option{WithOnEvict(nil)}, "WithOnEvict can't be nil"},
+		{[]Option{WithOnReject(nil)}, "WithOnReject can't be nil"},
+		{[]Option{WithBufferSize(0)}, "WithBufferSize must be positive, got 0"},
+		{[]Option{WithDefaultTTL(-time.Second)}, "WithDefaultTTL must be positive, got -1s"},
+		{[]Option{WithKeyToHash(nil)}, "WithKeyToHash can't be nil"},
+		{[]Option{WithCost(nil)}, "WithCost can't be nil"},
+		{[]Option{WithStoreShards(3)}, "WithStoreShards must be a power of two, got 3"},
+		{[]Option{WithClock(nil)}, "WithClock can't be nil"},
+		// The first bad option is reported.
+		{[]Option{WithCacheSize(0), WithNumCounters(0)}, "WithCacheSize must be positive, got 0"},
+	}
+	for _, test := range tests {
+		c, err := NewCacheWithOptions(test.opts...)
+		require.EqualError(t, err, test.err)
+		require.Nil(t, c)
+	}
+}
+
+func ExampleNewCacheWithOptions() {
+	cache, err := NewCacheWithOptions(
+		WithNumCounters(1e4), // about 10 times the items expected
+		WithCacheSize(1<<20),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+
+	cache.Set("key", "value", 1)
+	// Sets go through a buffer: wait for the value to be stored.
+	cache.Wait()
+	value, ok := cache.Get("key")
+	fmt.Println(value, ok)
+	// Output: value true
+}
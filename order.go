@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// setOrderStripes is the number of locks the updates of the keys are spread
+// over.
+const setOrderStripes = 64
+
+// setOrder keeps the value of a key in the store and its cost in the policy
+// from the same Set. A Set of a key already in the cache writes the value to
+// the store right away, and hands the cost over to the policy through the Set
+// buffer, so both happen in the same order for the Sets of a key only as long
+// as nothing else writes in between.
+type setOrder [setOrderStripes]setOrderStripe
+
+type setOrderStripe struct {
+	// writes serializes the updates of the keys of the stripe, from the
+	// store write to the Set buffer.
+	writes sync.Mutex
+	// mu guards pending, which counts the updates of every key written to the
+	// store but not yet applied by processItems, and stale, which counts those
+	// of them whose value left the store before the key was admitted again.
+	mu      sync.Mutex
+	pending map[uint64]int
+	stale   map[uint64]int
+}
+
+func (o *setOrder) stripe(key uint64) *setOrderStripe {
+	return &o[key%setOrderStripes]
+}
+
+// update writes the item to the store if its key is there, and counts it as
+// pending until done is called for it. It returns the previous value, and
+// whether there was one. The caller holds writes.
+func (s *setOrderStripe) update(st store, i *Item) (interface{}, bool) {
+	// Count the update along with writing it, so that a Set applied by
+	// processItems in the meantime can't overwrite it.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, ok := st.Update(i)
+	if ok {
+		if s.pending == nil {
+			s.pending = make(map[uint64]int)
+		}
+		s.pending[i.Key]++
+	}
+	return prev, ok
+}
+
+// done tells that an update of the key has been applied. It returns whether
+// the update is stale, and so must not touch the policy.
+func (s *setOrderStripe) done(key uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.pending[key]; n > 1 {
+		s.pending[key] = n - 1
+	} else {
+		delete(s.pending, key)
+	}
+	n := s.stale[key]
+	if n == 0 {
+		return false
+	}
+	if n > 1 {
+		s.stale[key] = n - 1
+	} else {
+		delete(s.stale, key)
+	}
+	return true
+}
+
+// updateIfLatest writes the item, a Set buffered before the key was admitted,
+// over the value of the key in the store, unless an update written since is
+// still pending and so is the latest value. If the value of the pending
+// updates has left the store since, the key is admitted again with the item,
+// and the updates turn stale.
+func (s *setOrderStripe) updateIfLatest(st store, i *Item) (prev interface{}, updated, present bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := s.pending[i.Key]; n > 0 {
+		if st.Has(i.Key) {
+			return nil, false, true
+		}
+		if s.stale == nil {
+			s.stale = make(map[uint64]int)
+		}
+		s.stale[i.Key] = n
+		return nil, false, false
+	}
+	prev, updated = st.Update(i)
+	return prev, updated, updated
+}
+
+// delIfLatest deletes the key from the store, unless an update written since
+// the deletion was ordered is still pending and so is the latest value. It
+// returns the value deleted, and whether there was one.
+func (s *setOrderStripe) delIfLatest(st store, key, conflict uint64) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[key] > 0 {
+		return nil, false
+	}
+	_, value, ok := st.Del(key, conflict)
+	return value, ok
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetOrder(t *testing.T) {
+	s := newStore()
+	var o setOrder
+	stripe := o.stripe(1)
+
+	// Nothing to update.
+	_, ok := stripe.update(s, &Item{Key: 1, Value: "a"})
+	require.False(t, ok)
+	require.Empty(t, stripe.pending)
+
+	s.Set(&Item{Key: 1, Value: "a"})
+	prev, ok := stripe.update(s, &Item{Key: 1, Value: "b"})
+	require.True(t, ok)
+	require.Equal(t, "a", prev)
+	require.Equal(t, 1, stripe.pending[1])
+
+	// A Set buffered before the update loses to it while it's pending.
+	_, updated, present := stripe.updateIfLatest(s, &Item{Key: 1, Value: "c"})
+	require.False(t, updated)
+	require.True(t, present)
+	val, _ := s.Get(1, 0)
+	require.Equal(t, "b", val)
+
+	stripe.done(1)
+	require.Empty(t, stripe.pending)
+	prev, updated, present = stripe.updateIfLatest(s, &Item{Key: 1, Value: "c"})
+	require.True(t, updated)
+	require.True(t, present)
+	require.Equal(t, "b", prev)
+	_, updated, present = stripe.updateIfLatest(s, &Item{Key: 2, Value: "c"})
+	require.False(t, updated)
+	require.False(t, present)
+}
@@ -0,0 +1,330 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultPolicyName is the name of the built-in TinyLFU policy, used when
+// Config.Policy is nil.
+const defaultPolicyName = "tinylfu"
+
+// policies holds the constructors of the policies that ConfigParams can name,
+// by name.
+var policies = struct {
+	sync.RWMutex
+	m map[string]func(numCounters, maxCost int64) Policy
+}{m: map[string]func(numCounters, maxCost int64) Policy{
+	"lru":        NewLRUPolicy,
+	"clock":      NewClockPolicy,
+	"slru":       NewSLRUPolicy,
+	"2q":         NewTwoQueuePolicy,
+	"arc":        NewARCPolicy,
+	"lirs":       NewLIRSPolicy,
+	"hyperbolic": NewHyperbolicPolicy,
+	"wtinylfu":   NewWTinyLFUPolicy,
+	"random":     newRandomPolicy,
+}}
+
+// RegisterPolicy makes the policy returned by newPolicy available to
+// ConfigParams under name, like the built-in ones: "tinylfu" for the default
+// policy, and "lru", "clock", "slru", "2q", "arc", "lirs", "hyperbolic",
+// "wtinylfu" and "random" for the others. It's meant to be called from an init function,
+// and panics if the name is empty or taken, or newPolicy is nil.
+func RegisterPolicy(name string, newPolicy func(numCounters, maxCost int64) Policy) {
+	if name == "" || newPolicy == nil {
+		panic("ristretto: RegisterPolicy needs a name and a constructor")
+	}
+	policies.Lock()
+	defer policies.Unlock()
+	if _, dup := policies.m[name]; dup || name == defaultPolicyName {
+		panic("ristretto: RegisterPolicy called twice for policy " + name)
+	}
+	policies.m[name] = newPolicy
+}
+
+// lookupPolicy returns the constructor of the policy registered under name,
+// which is nil for the default policy.
+func lookupPolicy(name string) (func(numCounters, maxCost int64) Policy, error) {
+	if name == "" || name == defaultPolicyName {
+		return nil, nil
+	}
+	policies.RLock()
+	defer policies.RUnlock()
+	newPolicy, ok := policies.m[name]
+	if !ok {
+		return nil, fmt.Errorf("ristretto: policy: unknown policy %q", name)
+	}
+	return newPolicy, nil
+}
+
+// policyNames returns the names of the registered policies, sorted, including
+// the default one.
+func policyNames() []string {
+	policies.RLock()
+	defer policies.RUnlock()
+	names := []string{defaultPolicyName}
+	for name := range policies.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// policyName returns the name newPolicy is registered under.
+func policyName(newPolicy func(numCounters, maxCost int64) Policy) (string, error) {
+	if newPolicy == nil {
+		return defaultPolicyName, nil
+	}
+	ptr := reflect.ValueOf(newPolicy).Pointer()
+	policies.RLock()
+	defer policies.RUnlock()
+	for name, f := range policies.m {
+		if reflect.ValueOf(f).Pointer() == ptr {
+			return name, nil
+		}
+	}
+	return "", errors.New("ristretto: policy: Config.Policy isn't registered")
+}
+
+var bufferModeNames = map[BufferMode]string{
+	BufferLossy:    "lossy",
+	BufferLossless: "lossless",
+	BufferBlocking: "blocking",
+}
+
+// ConfigParams holds the parameters of a Config that can be written down,
+// such as its sizes, TTLs and the name of its policy, leaving out the
+// callbacks and the other values only known at run time. It's marshaled to
+// and from JSON with the field names of its tags; durations are strings like
+// "1m30s", BufferMode is one of "lossy", "lossless" and "blocking", and Policy
+// is the name of a policy registered with RegisterPolicy. Zero values are left
+// out, as they stand for the defaults.
+//
+// Every field works like the Config field of the same name. Unmarshaling only
+// checks the names and types of the fields, and that the policies exist:
+// NewCache checks the values.
+type ConfigParams struct {
+	NumCounters              int64             `json:"num_counters"`
+	DoorkeeperBits           int64             `json:"doorkeeper_bits"`
+	AgingFactor              float64           `json:"aging_factor"`
+	MaxCost                  int64             `json:"max_cost"`
+	MaxEntries               int64             `json:"max_entries"`
+	HighWatermark            float64           `json:"high_watermark"`
+	LowWatermark             float64           `json:"low_watermark"`
+	MinResidency             time.Duration     `json:"min_residency"`
+	MinResidencyAdmissions   int64             `json:"min_residency_admissions"`
+	StoreShards              int               `json:"store_shards"`
+	MaxItemCost              int64             `json:"max_item_cost"`
+	EvictionSamples          int               `json:"eviction_samples"`
+	TraceAdmissions          int               `json:"trace_admissions"`
+	Policy                   string            `json:"policy"`
+	Classes                  []KeyClass        `json:"classes"`
+	BufferItems              int64             `json:"buffer_items"`
+	BufferStripes            int               `json:"buffer_stripes"`
+	BufferMode               BufferMode        `json:"buffer_mode"`
+	BufferTimeout            time.Duration     `json:"buffer_timeout"`
+	SetBufferItems           int               `json:"set_buffer_items"`
+	BlockingSets             bool              `json:"blocking_sets"`
+	ReadYourWrites           bool              `json:"read_your_writes"`
+	Synchronous              bool              `json:"synchronous"`
+	Seed                     int64             `json:"seed"`
+	Metrics                  bool              `json:"metrics"`
+	LifeExpectancyKeys       int               `json:"life_expectancy_keys"`
+	LifeExpectancySampleRate int               `json:"life_expectancy_sample_rate"`
+	LogDebug                 bool              `json:"log_debug"`
+	RatioWindow              time.Duration     `json:"ratio_window"`
+	RatioWindowBuckets       int               `json:"ratio_window_buckets"`
+	CostBuckets              []int64           `json:"cost_buckets"`
+	SampleLatency            int               `json:"sample_latency"`
+	MetricsLabels            map[string]string `json:"metrics_labels"`
+	MetricsName              string            `json:"metrics_name"`
+	EvictWorkers             int               `json:"evict_workers"`
+	EvictQueueSize           int               `json:"evict_queue_size"`
+	DropEvictCallbacks       bool              `json:"drop_evict_callbacks"`
+	IgnoreInternalCost       bool              `json:"ignore_internal_cost"`
+	ClockPrecision           time.Duration     `json:"clock_precision"`
+	DefaultTTL               time.Duration     `json:"default_ttl"`
+	NegativeTTL              time.Duration     `json:"negative_ttl"`
+	NegativeCost             int64             `json:"negative_cost"`
+	VictimCacheSize          int               `json:"victim_cache_size"`
+	HintWeight               int64             `json:"hint_weight"`
+	TrackAge                 bool              `json:"track_age"`
+	MaxIdle                  time.Duration     `json:"max_idle"`
+	PropagateLoaderCancel    bool              `json:"propagate_loader_cancel"`
+	FreshFor                 time.Duration     `json:"fresh_for"`
+	StaleFor                 time.Duration     `json:"stale_for"`
+	StoreEncoded             bool              `json:"store_encoded"`
+	OffHeap                  bool              `json:"off_heap"`
+	CopyOnRead               bool              `json:"copy_on_read"`
+	WriteBack                bool              `json:"write_back"`
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	bufferModeType = reflect.TypeOf(BufferMode(0))
+)
+
+// Params returns the parameters of the config. It fails if Config.Policy
+// isn't the constructor of a registered policy.
+func (c *Config) Params() (ConfigParams, error) {
+	var p ConfigParams
+	name, err := policyName(c.Policy)
+	if err != nil {
+		return p, err
+	}
+	copyParams(reflect.ValueOf(&p).Elem(), reflect.ValueOf(c).Elem())
+	if name != defaultPolicyName {
+		p.Policy = name
+	}
+	return p, nil
+}
+
+// Apply sets the fields of config to the parameters, leaving its callbacks
+// and other run-time values alone, and sets Config.Policy to the constructor
+// of the policy named by p.Policy.
+func (p *ConfigParams) Apply(config *Config) error {
+	newPolicy, err := lookupPolicy(p.Policy)
+	if err != nil {
+		return err
+	}
+	copyParams(reflect.ValueOf(config).Elem(), reflect.ValueOf(p).Elem())
+	config.Policy = newPolicy
+	return nil
+}
+
+// copyParams copies the fields of ConfigParams between a ConfigParams and a
+// Config, by name, other than Policy.
+func copyParams(dst, src reflect.Value) {
+	t := reflect.TypeOf(ConfigParams{})
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "Policy" {
+			continue
+		}
+		dst.FieldByName(name).Set(src.FieldByName(name))
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p ConfigParams) MarshalJSON() ([]byte, error) {
+	v := reflect.ValueOf(p)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if reflect.DeepEqual(field.Interface(), reflect.Zero(field.Type()).Interface()) {
+			continue
+		}
+		var value interface{}
+		switch field.Type() {
+		case durationType:
+			value = time.Duration(field.Int()).String()
+		case bufferModeType:
+			name, ok := bufferModeNames[BufferMode(field.Int())]
+			if !ok {
+				return nil, fmt.Errorf("ristretto: buffer_mode: unknown BufferMode %d", field.Int())
+			}
+			value = name
+		default:
+			value = field.Interface()
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", v.Type().Field(i).Tag.Get("json"))
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Unknown fields are errors, so
+// that misspelled parameters don't go unnoticed.
+func (p *ConfigParams) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("ristretto: config params: %v", err)
+	}
+	v := reflect.ValueOf(p).Elem()
+	fields := make(map[string]int, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		fields[v.Type().Field(i).Tag.Get("json")] = i
+	}
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	// Report the same error for the same input.
+	sort.Strings(names)
+	for _, name := range names {
+		i, ok := fields[name]
+		if !ok {
+			return fmt.Errorf("ristretto: unknown config field %q", name)
+		}
+		if err := unmarshalParam(v.Field(i), raw[name]); err != nil {
+			return fmt.Errorf("ristretto: %s: %v", name, err)
+		}
+	}
+	if _, err := lookupPolicy(p.Policy); err != nil {
+		return err
+	}
+	for _, class := range p.Classes {
+		if _, err := lookupPolicy(class.Policy); err != nil {
+			return fmt.Errorf("ristretto: classes: unknown policy %q", class.Policy)
+		}
+	}
+	return nil
+}
+
+func unmarshalParam(field reflect.Value, data json.RawMessage) error {
+	switch field.Type() {
+	case durationType, bufferModeType:
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if field.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+		for mode, name := range bufferModeNames {
+			if name == s {
+				field.SetInt(int64(mode))
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown buffer mode %q", s)
+	}
+	return json.Unmarshal(data, field.Addr().Interface())
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigParamsJSON(t *testing.T) {
+	p := ConfigParams{
+		NumCounters: 100,
+		MaxCost:     10,
+		Policy:      "lru",
+		BufferMode:  BufferLossless,
+		DefaultTTL:  time.Minute,
+	}
+	data, err := json.Marshal(p)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"num_counters": 100, "max_cost": 10, "policy": "lru",
+		"buffer_mode": "lossless", "default_ttl": "1m0s"}`, string(data))
+
+	// Every field makes the round trip.
+	p = ConfigParams{
+		NumCounters:              1000,
+		DoorkeeperBits:           64,
+		AgingFactor:              0.5,
+		MaxCost:                  100,
+		MaxEntries:               50,
+		HighWatermark:            1,
+		LowWatermark:             0.9,
+		MinResidency:             100 * time.Millisecond,
+		MinResidencyAdmissions:   10,
+		StoreShards:              16,
+		MaxItemCost:              10,
+		EvictionSamples:          3,
+		TraceAdmissions:          1000,
+		Policy:                   "wtinylfu",
+		Classes:                  []KeyClass{{Share: 0.2}, {Share: 0.8, Policy: "lru"}},
+		BufferItems:              64,
+		BufferStripes:            4,
+		BufferMode:               BufferBlocking,
+		BufferTimeout:            time.Millisecond,
+		SetBufferItems:           1024,
+		BlockingSets:             true,
+		ReadYourWrites:           true,
+		Synchronous:              true,
+		Seed:                     42,
+		Metrics:                  true,
+		LifeExpectancyKeys:       10,
+		LifeExpectancySampleRate: 2,
+		LogDebug:                 true,
+		RatioWindow:              time.Minute,
+		RatioWindowBuckets:       6,
+		CostBuckets:              []int64{1, 10},
+		SampleLatency:            100,
+		MetricsLabels:            map[string]string{"name": "users"},
+		MetricsName:              "users",
+		EvictWorkers:             2,
+		EvictQueueSize:           8,
+		DropEvictCallbacks:       true,
+		IgnoreInternalCost:       true,
+		ClockPrecision:           time.Millisecond,
+		DefaultTTL:               time.Hour,
+		NegativeTTL:              time.Second,
+		NegativeCost:             2,
+		VictimCacheSize:          4,
+		HintWeight:               2,
+		TrackAge:                 true,
+		MaxIdle:                  90 * time.Second,
+		PropagateLoaderCancel:    true,
+		FreshFor:                 time.Second,
+		StaleFor:                 2 * time.Second,
+		StoreEncoded:             true,
+		OffHeap:                  true,
+		CopyOnRead:               true,
+		WriteBack:                true,
+	}
+	v := reflect.ValueOf(p)
+	for i := 0; i < v.NumField(); i++ {
+		require.False(t, reflect.DeepEqual(v.Field(i).Interface(), reflect.Zero(v.Field(i).Type()).Interface()),
+			"%s isn't set", v.Type().Field(i).Name)
+	}
+	data, err = json.Marshal(p)
+	require.NoError(t, err)
+	var got ConfigParams
+	require.NoError(t, json.Unmarshal(data, &got))
+	require.Equal(t, p, got)
+}
+
+func TestConfigParamsJSONErrors(t *testing.T) {
+	// The errors of encoding/json and time vary between Go versions, so
+	// only the start of those is checked.
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`[]`, "ristretto: config params: "},
+		{`{"num_countres": 1}`, `ristretto: unknown config field "num_countres"`},
+		{`{"num_counters": "100"}`, "ristretto: num_counters: "},
+		{`{"default_ttl": 60}`, "ristretto: default_ttl: "},
+		{`{"default_ttl": "1 hour"}`, `ristretto: default_ttl: time: `},
+		{`{"buffer_mode": "lossier"}`, `ristretto: buffer_mode: unknown buffer mode "lossier"`},
+		{`{"policy": "lfu"}`, `ristretto: policy: unknown policy "lfu"`},
+		{`{"classes": [{"share": 1, "policy": "lfu"}]}`, `ristretto: classes: unknown policy "lfu"`},
+	}
+	for _, test := range tests {
+		var p ConfigParams
+		err := json.Unmarshal([]byte(test.json), &p)
+		require.Error(t, err, test.json)
+		require.True(t, strings.HasPrefix(err.Error(), test.err), "%s: %v", test.json, err)
+	}
+}
+
+func TestConfigParamsApply(t *testing.T) {
+	var p ConfigParams
+	require.NoError(t, json.Unmarshal([]byte(`{"num_counters": 100, "max_cost": 10,
+		"buffer_items": 64, "ignore_internal_cost": true, "policy": "lru",
+		"default_ttl": "1h"}`), &p))
+	config := &Config{OnEvict: func(*Item) {}}
+	require.NoError(t, p.Apply(config))
+	require.Equal(t, int64(100), config.NumCounters)
+	require.Equal(t, time.Hour, config.DefaultTTL)
+	require.NotNil(t, config.OnEvict)
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	ttl, ok := c.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > time.Hour-time.Minute, "ttl %v", ttl)
+
+	// Params and Apply are the inverse of each other.
+	back, err := config.Params()
+	require.NoError(t, err)
+	require.Equal(t, p, back)
+	back, err = (&Config{NumCounters: 1}).Params()
+	require.NoError(t, err)
+	require.Equal(t, ConfigParams{NumCounters: 1}, back)
+	require.NoError(t, json.Unmarshal([]byte(`{"policy": "tinylfu"}`), &p))
+	require.NoError(t, p.Apply(config))
+	require.Nil(t, config.Policy)
+
+	// Values are checked by NewCache, naming the field.
+	require.NoError(t, json.Unmarshal([]byte(`{"num_counters": -1}`), &p))
+	require.NoError(t, p.Apply(config))
+	_, err = NewCache(config)
+	require.EqualError(t, err, "NumCounters must be positive, got -1")
+}
+
+func TestRegisterPolicy(t *testing.T) {
+	newPolicy := func(numCounters, maxCost int64) Policy { return NewLRUPolicy(numCounters, maxCost) }
+	RegisterPolicy("test-lru", newPolicy)
+	defer func() {
+		policies.Lock()
+		delete(policies.m, "test-lru")
+		policies.Unlock()
+	}()
+	require.Panics(t, func() { RegisterPolicy("test-lru", newPolicy) })
+	require.Panics(t, func() { RegisterPolicy("tinylfu", newPolicy) })
+	require.Panics(t, func() { RegisterPolicy("", newPolicy) })
+
+	var p ConfigParams
+	require.NoError(t, json.Unmarshal([]byte(`{"policy": "test-lru"}`), &p))
+	config := &Config{}
+	require.NoError(t, p.Apply(config))
+	back, err := config.Params()
+	require.NoError(t, err)
+	require.Equal(t, "test-lru", back.Policy)
+
+	config.Policy = func(numCounters, maxCost int64) Policy { return nil }
+	_, err = config.Params()
+	require.EqualError(t, err, "ristretto: policy: Config.Policy isn't registered")
+}
+
+// TestConfigParamsFields checks that ConfigParams has every field of Config
+// but the ones only known at run time, with the same types.
+func TestConfigParamsFields(t *testing.T) {
+	params := reflect.TypeOf(ConfigParams{})
+	config := reflect.TypeOf(Config{})
+	for i := 0; i < params.NumField(); i++ {
+		f := params.Field(i)
+		cf, ok := config.FieldByName(f.Name)
+		require.True(t, ok, f.Name)
+		if f.Name != "Policy" {
+			require.Equal(t, cf.Type, f.Type, f.Name)
+		}
+	}
+	for i := 0; i < config.NumField(); i++ {
+		f := config.Field(i)
+		if _, ok := params.FieldByName(f.Name); ok {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Func, reflect.Interface:
+		default:
+			t.Errorf("Config.%s is missing from ConfigParams", f.Name)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// PartitionedCache is a cache split into independent partitions, each a Cache
+// of its own with its own store, policy and buffers, holding the keys whose
+// hash falls into it. Partitions share nothing, so that cores reading and
+// writing different keys don't touch the same memory, at the cost of every
+// partition admitting and evicting on its own: a key competes only with the
+// keys of its partition. It's meant for read rates at which the buffers and
+// counters of a single cache see too much traffic between cores.
+//
+// This is experimental, and only covers the core of the Cache API. Knobs
+// applying to the whole cache, such as UpdateMaxCost, Clear and Close, are
+// applied to every partition while holding a lock, so that they don't
+// interleave. A nil or closed PartitionedCache behaves like a nil Cache.
+type PartitionedCache struct {
+	closed    uint32
+	parts     []*Cache
+	keyToHash func(key interface{}) (uint64, uint64)
+	// mu serializes the knobs applied to every partition.
+	mu          sync.Mutex
+	maxCost     int64
+	metricsName string
+}
+
+// NewPartitionedCache returns a cache split into n partitions, or
+// GOMAXPROCS if n isn't positive, each created with the config along with
+// its share of NumCounters, MaxCost, MaxEntries, DoorkeeperBits and
+// VictimCacheSize. The Metrics of the partitions are summed by
+// PartitionedCache.Metrics, which is what is published as
+// Config.MetricsName.
+func NewPartitionedCache(config *Config, n int) (*PartitionedCache, error) {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if config.MaxCost < int64(n) {
+		return nil, fmt.Errorf("MaxCost can't be less than the %d partitions, got %v",
+			n, config.MaxCost)
+	}
+	p := &PartitionedCache{
+		parts:       make([]*Cache, n),
+		maxCost:     config.MaxCost,
+		metricsName: config.MetricsName,
+	}
+	for i := range p.parts {
+		part := *config
+		part.NumCounters = ceilShare(config.NumCounters, n)
+		part.MaxCost = partitionShare(config.MaxCost, n, i)
+		part.MaxEntries = ceilShare(config.MaxEntries, n)
+		part.DoorkeeperBits = ceilShare(config.DoorkeeperBits, n)
+		part.VictimCacheSize = int(ceilShare(int64(config.VictimCacheSize), n))
+		part.MetricsName = ""
+		c, err := NewCache(&part)
+		if err != nil {
+			for _, c := range p.parts[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+		p.parts[i] = c
+	}
+	p.keyToHash = p.parts[0].keyToHash
+	if p.metricsName != "" {
+		if err := publishMetrics(p.metricsName, p.Metrics); err != nil {
+			for _, c := range p.parts {
+				c.Close()
+			}
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ceilShare returns the share of every one of n partitions of v, rounded up
+// so that small values don't end up 0.
+func ceilShare(v int64, n int) int64 {
+	return (v + int64(n) - 1) / int64(n)
+}
+
+// partitionShare returns the share of v of the partition i out of n, the first
+// ones taking the remainder, so that the shares add up to v.
+func partitionShare(v int64, n, i int) int64 {
+	share := v / int64(n)
+	if int64(i) < v%int64(n) {
+		share++
+	}
+	return share
+}
+
+// part returns the partition holding the key with the given hash. The hash
+// is mixed first, as the stores shard their keys by its low bits.
+func (p *PartitionedCache) part(keyHash uint64) *Cache {
+	return p.parts[mixHash(keyHash)%uint64(len(p.parts))]
+}
+
+func (p *PartitionedCache) isClosed() bool {
+	return atomic.LoadUint32(&p.closed) == 1
+}
+
+// Partitions returns the partitions of the cache, for the calls it doesn't
+// cover. Keys given to a partition other than their own are cached there, but
+// not found by the calls of PartitionedCache.
+func (p *PartitionedCache) Partitions() []*Cache {
+	if p == nil {
+		return nil
+	}
+	return append([]*Cache(nil), p.parts...)
+}
+
+// Get works like Cache.Get, in the partition of the key.
+func (p *PartitionedCache) Get(key interface{}) (interface{}, bool) {
+	if p == nil || p.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := p.keyToHash(key)
+	return p.part(keyHash).getHashed(key, keyHash, conflictHash)
+}
+
+// Set works like Cache.Set, in the partition of the key.
+func (p *PartitionedCache) Set(key, value interface{}, cost int64) bool {
+	if p == nil {
+		return false
+	}
+	return p.SetWithOptions(key, value, cost, SetOptions{})
+}
+
+// SetWithTTL works like Cache.SetWithTTL, in the partition of the key.
+func (p *PartitionedCache) SetWithTTL(key, value interface{}, cost int64, ttl time.Duration) bool {
+	if p == nil || p.isClosed() || key == nil {
+		return false
+	}
+	keyHash, conflictHash := p.keyToHash(key)
+	return p.part(keyHash).setHashed(key, keyHash, conflictHash, value, cost, ttl, false, SetOptions{})
+}
+
+// SetWithOptions works like Cache.SetWithOptions, in the partition of the key.
+func (p *PartitionedCache) SetWithOptions(key, value interface{}, cost int64, opts SetOptions) bool {
+	if p == nil || p.isClosed() || key == nil {
+		return false
+	}
+	keyHash, conflictHash := p.keyToHash(key)
+	c := p.part(keyHash)
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = c.defaultTTL
+	}
+	return c.setHashed(key, keyHash, conflictHash, value, cost, ttl, false, opts)
+}
+
+// Del works like Cache.Del, in the partition of the key.
+func (p *PartitionedCache) Del(key interface{}) (interface{}, bool) {
+	if p == nil || p.isClosed() || key == nil {
+		return nil, false
+	}
+	keyHash, conflictHash := p.keyToHash(key)
+	return p.part(keyHash).delHashed(key, keyHash, conflictHash)
+}
+
+// Wait blocks until the Sets and Dels issued before it have been applied, in
+// every partition.
+func (p *PartitionedCache) Wait() {
+	if p == nil || p.isClosed() {
+		return
+	}
+	for _, c := range p.parts {
+		c.Wait()
+	}
+}
+
+// Len returns the number of items in the cache, in every partition.
+func (p *PartitionedCache) Len() int {
+	if p == nil || p.isClosed() {
+		return 0
+	}
+	n := 0
+	for _, c := range p.parts {
+		n += c.Len()
+	}
+	return n
+}
+
+// Range works like Cache.Range, visiting the partitions one after the other.
+func (p *PartitionedCache) Range(f func(item *Item) bool) {
+	if p == nil || p.isClosed() {
+		return
+	}
+	more := true
+	for _, c := range p.parts {
+		c.Range(func(item *Item) bool {
+			more = f(item)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// MaxCost returns the max cost of the cache, the sum of the max costs of its
+// partitions.
+func (p *PartitionedCache) MaxCost() int64 {
+	if p == nil || p.isClosed() {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.maxCost
+}
+
+// UsedCost returns the sum of the costs of the items in every partition.
+func (p *PartitionedCache) UsedCost() int64 {
+	if p == nil || p.isClosed() {
+		return 0
+	}
+	var used int64
+	for _, c := range p.parts {
+		used += c.UsedCost()
+	}
+	return used
+}
+
+// UpdateMaxCost splits the new max cost over the partitions like
+// NewPartitionedCache. Each partition keeps a max cost of at least 1.
+func (p *PartitionedCache) UpdateMaxCost(maxCost int64) {
+	if p == nil || p.isClosed() {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if maxCost < int64(len(p.parts)) {
+		maxCost = int64(len(p.parts))
+	}
+	for i, c := range p.parts {
+		c.UpdateMaxCost(partitionShare(maxCost, len(p.parts), i))
+	}
+	p.maxCost = maxCost
+}
+
+// Clear empties every partition, like Cache.Clear.
+func (p *PartitionedCache) Clear() {
+	if p == nil || p.isClosed() {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.parts {
+		c.Clear()
+	}
+}
+
+// Close stops every partition, like Cache.Close.
+func (p *PartitionedCache) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
+		return
+	}
+	for _, c := range p.parts {
+		c.Close()
+	}
+	if p.metricsName != "" {
+		unpublishMetrics(p.metricsName)
+	}
+}
+
+// Metrics returns the sum of the Metrics of the partitions at the time of the
+// call, or nil if Config.Metrics isn't set. The ratio windows and latency
+// samples of the partitions aren't summed.
+func (p *PartitionedCache) Metrics() *Metrics {
+	if p == nil || p.parts[0].Metrics == nil {
+		return nil
+	}
+	sum := newMetrics()
+	sum.internalCost = p.parts[0].Metrics.internalCost
+	sum.costs = newCostHistogram(p.parts[0].Metrics.costs.bounds)
+	life := sum.life
+	for _, c := range p.parts {
+		m := c.Metrics
+		for t := 0; t < doNotUse; t++ {
+			sum.all[t][0].n += m.get(metricType(t))
+		}
+		costs := m.costs.get()
+		for i, n := range costs.Counts {
+			sum.costs.counts[i] += n
+		}
+		sum.costs.sum += costs.Sum
+		addHistogram(life, m.LifeExpectancySeconds())
+	}
+	return sum
+}
+
+// addHistogram adds the counts of from to h, which have the same bounds.
+func addHistogram(h, from *z.HistogramData) {
+	if from.Count == 0 {
+		return
+	}
+	for i, n := range from.CountPerBucket {
+		h.CountPerBucket[i] += n
+	}
+	h.Count += from.Count
+	h.Sum += from.Sum
+	if from.Min < h.Min {
+		h.Min = from.Min
+	}
+	if from.Max > h.Max {
+		h.Max = from.Max
+	}
+}
+
+// SaveTo works like Cache.SaveTo, writing the items of every partition to a
+// single snapshot. The states of the policies aren't saved, only the access
+// frequencies of the items. The snapshot can be loaded by
+// LoadPartitionedCache, into any number of partitions, or by LoadCache.
+func (p *PartitionedCache) SaveTo(w io.Writer) error {
+	if p == nil || p.isClosed() {
+		return ErrClosed
+	}
+	if p.parts[0].encodeValue == nil {
+		return errors.New("SaveTo requires Config.EncodeValue")
+	}
+	return writeSnapshot(w, p.parts, nil)
+}
+
+// LoadPartitionedCache works like LoadCache, returning a cache split into n
+// partitions like NewPartitionedCache. The items are restored into the
+// partitions of their keys, and the state of the policy, if the snapshot
+// holds one, is left out.
+func LoadPartitionedCache(config *Config, n int, r io.Reader) (*PartitionedCache, error) {
+	if config.DecodeValue == nil {
+		return nil, errors.New("LoadCache requires Config.DecodeValue")
+	}
+	entries, _, err := readSnapshot(r)
+	if err != nil {
+		logLoadError(config, err)
+		return nil, err
+	}
+	p, err := NewPartitionedCache(config, n)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([][]snapshotEntry, len(p.parts))
+	for _, e := range entries {
+		i := mixHash(e.key) % uint64(len(p.parts))
+		parts[i] = append(parts[i], e)
+	}
+	for i, c := range p.parts {
+		if err := c.restore(parts[i]); err != nil {
+			p.Close()
+			logLoadError(config, err)
+			return nil, err
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newPartitionedCache(t testing.TB, n int) *PartitionedCache {
+	p, err := NewPartitionedCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+	}, n)
+	require.NoError(t, err)
+	return p
+}
+
+func TestPartitionedCache(t *testing.T) {
+	p := newPartitionedCache(t, 4)
+	defer p.Close()
+	require.Len(t, p.Partitions(), 4)
+	require.Equal(t, int64(100), p.MaxCost())
+	for _, c := range p.Partitions() {
+		require.Equal(t, int64(25), c.MaxCost())
+	}
+
+	for i := 0; i < 40; i++ {
+		require.True(t, p.Set(i, i*10, 1))
+	}
+	p.Wait()
+	require.Equal(t, 40, p.Len())
+	require.Equal(t, int64(40), p.UsedCost())
+	// Every partition gets some of the keys, and only finds its own.
+	seen := 0
+	for _, c := range p.Partitions() {
+		require.NotZero(t, c.Len())
+		seen += c.Len()
+	}
+	require.Equal(t, 40, seen)
+	for i := 0; i < 40; i++ {
+		val, ok := p.Get(i)
+		require.True(t, ok)
+		require.Equal(t, i*10, val)
+	}
+	n := 0
+	p.Range(func(item *Item) bool {
+		n++
+		return n < 5
+	})
+	require.Equal(t, 5, n)
+
+	val, ok := p.Del(3)
+	require.True(t, ok)
+	require.Equal(t, 30, val)
+	_, ok = p.Get(3)
+	require.False(t, ok)
+
+	// The metrics of the partitions add up.
+	m := p.Metrics()
+	require.Equal(t, uint64(40), m.Hits())
+	require.Equal(t, uint64(1), m.Misses())
+	require.Equal(t, uint64(40), m.KeysAdded())
+	require.Equal(t, uint64(40), m.CostHistogram().Count)
+
+	p.UpdateMaxCost(10)
+	require.Equal(t, int64(10), p.MaxCost())
+	p.Wait()
+	for i, c := range p.Partitions() {
+		require.Equal(t, partitionShare(10, 4, i), c.MaxCost())
+		require.LessOrEqual(t, c.UsedCost(), c.MaxCost())
+	}
+	// Every partition keeps room for an item.
+	p.UpdateMaxCost(0)
+	require.Equal(t, int64(4), p.MaxCost())
+
+	p.Clear()
+	require.Zero(t, p.Len())
+	p.Close()
+	require.False(t, p.Set(1, 1, 1))
+	_, ok = p.Get(1)
+	require.False(t, ok)
+	p.Close()
+}
+
+func TestPartitionedCacheUnusable(t *testing.T) {
+	closed := newPartitionedCache(t, 2)
+	require.True(t, closed.Set(1, 1, 1))
+	closed.Wait()
+	closed.Close()
+	for name, p := range map[string]*PartitionedCache{"nil": nil, "closed": closed} {
+		t.Run(name, func(t *testing.T) {
+			_, ok := p.Get(1)
+			require.False(t, ok)
+			require.False(t, p.Set(1, 1, 1))
+			require.False(t, p.SetWithTTL(1, 1, 1, time.Second))
+			require.False(t, p.SetWithOptions(1, 1, 1, SetOptions{}))
+			_, ok = p.Del(1)
+			require.False(t, ok)
+			p.Range(func(*Item) bool {
+				t.Fatal("called back")
+				return true
+			})
+			require.Zero(t, p.Len())
+			require.Zero(t, p.MaxCost())
+			require.Zero(t, p.UsedCost())
+			require.Equal(t, ErrClosed, p.SaveTo(&bytes.Buffer{}))
+			p.UpdateMaxCost(10)
+			p.Wait()
+			p.Clear()
+			p.Close()
+		})
+	}
+	require.Nil(t, (*PartitionedCache)(nil).Partitions())
+	require.Nil(t, (*PartitionedCache)(nil).Metrics())
+	// Close resets the counters, like Clear.
+	require.Zero(t, closed.Metrics().KeysAdded())
+}
+
+func TestPartitionedCacheConfig(t *testing.T) {
+	_, err := NewPartitionedCache(&Config{
+		NumCounters: 100,
+		MaxCost:     3,
+		BufferItems: 64,
+	}, 4)
+	require.Error(t, err)
+	_, err = NewPartitionedCache(&Config{
+		NumCounters: 100,
+		MaxCost:     -1,
+		BufferItems: 64,
+	}, 1)
+	require.Error(t, err)
+
+	config := &Config{
+		NumCounters: 100,
+		MaxCost:     100,
+		BufferItems: 64,
+		Metrics:     true,
+		MetricsName: "partitioned_test",
+	}
+	p, err := NewPartitionedCache(config, 0)
+	require.NoError(t, err)
+	require.Len(t, p.Partitions(), runtime.GOMAXPROCS(0))
+	require.NotNil(t, expvar.Get("partitioned_test"))
+	_, err = NewPartitionedCache(config, 2)
+	require.Error(t, err)
+	// Closing frees the name.
+	p.Close()
+	p, err = NewPartitionedCache(config, 2)
+	require.NoError(t, err)
+	defer p.Close()
+	require.Len(t, p.Partitions(), 2)
+
+	var nilCache *PartitionedCache
+	require.Nil(t, nilCache.Metrics())
+	require.False(t, nilCache.Set(1, 1, 1))
+}
+
+func TestPartitionedCacheSnapshot(t *testing.T) {
+	p, err := NewPartitionedCache(newSnapshotConfig(), 4)
+	require.NoError(t, err)
+	defer p.Close()
+	for i := 0; i < 20; i++ {
+		require.True(t, p.Set(i, fmt.Sprint(i), 1))
+	}
+	p.Wait()
+	var buf bytes.Buffer
+	require.NoError(t, p.SaveTo(&buf))
+
+	// Into another number of partitions, or a single cache.
+	loaded, err := LoadPartitionedCache(newSnapshotConfig(), 3, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer loaded.Close()
+	c, err := LoadCache(newSnapshotConfig(), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 20, loaded.Len())
+	require.Equal(t, 20, c.Len())
+	for i := 0; i < 20; i++ {
+		val, ok := loaded.Get(i)
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprint(i), val)
+		val, ok = c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprint(i), val)
+	}
+
+	_, err = LoadPartitionedCache(newSnapshotConfig(), 2, bytes.NewReader(buf.Bytes()[:10]))
+	require.Error(t, err)
+	p.Close()
+	require.Equal(t, ErrClosed, p.SaveTo(&buf))
+}
+
+// BenchmarkPartitionedCacheGet compares the Gets of 64 goroutines on a single
+// cache with the same on a cache split into GOMAXPROCS partitions.
+func BenchmarkPartitionedCacheGet(b *testing.B) {
+	config := func() *Config {
+		return &Config{
+			NumCounters: 1e6,
+			MaxCost:     1e5,
+			BufferItems: 64,
+			Metrics:     true,
+		}
+	}
+	run := func(b *testing.B, get func(key interface{}) (interface{}, bool)) {
+		parallelism := 64 / runtime.GOMAXPROCS(0)
+		if parallelism < 1 {
+			parallelism = 1
+		}
+		b.SetParallelism(parallelism)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				get(i % 10000)
+			}
+		})
+	}
+	b.Run("single", func(b *testing.B) {
+		c, err := NewCache(config())
+		require.NoError(b, err)
+		defer c.Close()
+		for i := 0; i < 10000; i++ {
+			c.Set(i, i, 1)
+		}
+		c.Wait()
+		run(b, c.Get)
+	})
+	b.Run("partitioned", func(b *testing.B) {
+		p, err := NewPartitionedCache(config(), 0)
+		require.NoError(b, err)
+		defer p.Close()
+		for i := 0; i < 10000; i++ {
+			p.Set(i, i, 1)
+		}
+		p.Wait()
+		run(b, p.Get)
+	})
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// pendingShards is the number of shards the pending Sets are spread over.
+const pendingShards = 64
+
+// pendingSets holds the items of the Sets of new keys still in the Set buffer,
+// for Config.ReadYourWrites, so that a Get finds them before the policy
+// applies them. Items are removed once the policy is done with them, whether
+// it admitted them or not.
+type pendingSets struct {
+	shards [pendingShards]pendingShard
+}
+
+type pendingShard struct {
+	sync.RWMutex
+	items map[uint64]*Item
+}
+
+func newPendingSets(enabled bool) *pendingSets {
+	if !enabled {
+		return nil
+	}
+	p := &pendingSets{}
+	for i := range p.shards {
+		p.shards[i].items = make(map[uint64]*Item)
+	}
+	return p
+}
+
+// add records the item of a Set about to enter the Set buffer.
+func (p *pendingSets) add(i *Item) {
+	if p == nil {
+		return
+	}
+	s := &p.shards[i.Key%pendingShards]
+	s.Lock()
+	s.items[i.Key] = i
+	s.Unlock()
+}
+
+// get returns the value of the pending Set of the key, if any.
+func (p *pendingSets) get(keyHash, conflictHash uint64) (interface{}, bool) {
+	if p == nil {
+		return nil, false
+	}
+	s := &p.shards[keyHash%pendingShards]
+	s.RLock()
+	i, ok := s.items[keyHash]
+	s.RUnlock()
+	if !ok || (conflictHash != 0 && i.Conflict != conflictHash) {
+		return nil, false
+	}
+	return i.Value, true
+}
+
+// done removes the item once the policy has applied it, unless a later Set of
+// the key replaced it.
+func (p *pendingSets) done(i *Item) {
+	if p == nil {
+		return
+	}
+	s := &p.shards[i.Key%pendingShards]
+	s.Lock()
+	if s.items[i.Key] == i {
+		delete(s.items, i.Key)
+	}
+	s.Unlock()
+}
+
+// del removes the pending Set of the key, if any.
+func (p *pendingSets) del(keyHash uint64) {
+	if p == nil {
+		return
+	}
+	s := &p.shards[keyHash%pendingShards]
+	s.Lock()
+	delete(s.items, keyHash)
+	s.Unlock()
+}
+
+func (p *pendingSets) clear() {
+	if p == nil {
+		return
+	}
+	for i := range p.shards {
+		s := &p.shards[i]
+		s.Lock()
+		s.items = make(map[uint64]*Item)
+		s.Unlock()
+	}
+}
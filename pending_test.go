@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheReadYourWrites(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	c, err := NewCache(&Config{
+		NumCounters:        1e5,
+		MaxCost:            1e4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		ReadYourWrites:     true,
+		Cost: func(value interface{}) int64 {
+			if value == "stall" {
+				close(started)
+				<-release
+			}
+			return 1
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// With the policy held up, the Sets are only in the buffer.
+	require.True(t, c.Set("stall", "stall", 0))
+	<-started
+	require.True(t, c.Set(1, "one", 0))
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	values, found := c.GetMulti([]interface{}{1, 2})
+	require.Equal(t, []bool{true, false}, found)
+	require.Equal(t, "one", values[0])
+	// A Del drops the pending Set.
+	require.True(t, c.Set(2, "two", 0))
+	c.Del(2)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	close(release)
+	c.Wait()
+	val, ok = c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	// The pending Sets are gone once applied.
+	for i := range c.pending.shards {
+		require.Empty(t, c.pending.shards[i].items)
+	}
+
+	var wg sync.WaitGroup
+	var misses uint64
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := g*1000 + i
+				if !c.Set(key, key, 1) {
+					continue
+				}
+				if _, ok := c.Get(key); !ok {
+					atomic.AddUint64(&misses, 1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Zero(t, misses)
+}
@@ -17,25 +17,121 @@
 package ristretto
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math"
+	"math/rand"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/ristretto/z"
 )
 
 const (
-	// lfuSample is the number of items to sample when looking at eviction
-	// candidates. 5 seems to be the most optimal number [citation needed].
+	// lfuSample is the default number of items to sample when looking at
+	// eviction candidates. 5 seems to be the most optimal number [citation
+	// needed].
 	lfuSample = 5
+	// maxGhostVictims is how many victims a custom Policy may pick among the
+	// keys the cache doesn't have before the cache stops asking it for one.
+	maxGhostVictims = 128
 )
 
+// Policy decides which keys are evicted to make room for new ones, in place of
+// the default TinyLFU admission and Sampled LFU eviction. The cache itself keeps
+// track of key costs and of the room left, and only asks the Policy for a
+// victim when a new key doesn't fit.
+//
+// Keys are the hashes the cache uses internally. All calls are serialized by
+// the cache, so implementations don't need to be safe for concurrent use.
+// TestPolicyImplementation, in the ristrettotest package, runs
+// an implementation against the rules below.
+type Policy interface {
+	// Add starts tracking a key that has just been admitted with the given
+	// cost.
+	Add(key uint64, cost int64)
+	// Update is called when the cost of a tracked key changes.
+	Update(key uint64, cost int64)
+	// Del stops tracking a key that has been removed from the cache.
+	Del(key uint64)
+	// Access records Gets of the given keys, in batches. The keys may or may
+	// not be tracked, and may have been deleted since they were read, so
+	// Access shouldn't start tracking them. Untracked keys picked by Evict
+	// anyway are skipped and counted by Metrics.GhostsRemoved. The slice is
+	// reused once Access returns, so it must not be retained. Access must not
+	// Get from the cache, which with BufferBlocking could wait on Access
+	// itself.
+	Access(keys []uint64)
+	// Evict returns a tracked key to evict to make room for candidate, which
+	// isn't tracked yet, and stops tracking it. It returns false if candidate
+	// should be rejected instead. Evict is called repeatedly for the same
+	// candidate until there's enough room for it, both in cost and, if the
+	// cache has a MaxEntries, in number of keys. After the cache shrinks, it's
+	// called with a candidate of 0 until the tracked keys fit again, and for
+	// Cache.EvictN and Cache.EvictCost, and should return a victim as long as
+	// there's one. A key hashing to 0 is
+	// also a candidate of 0, so admitting it shouldn't depend on that value.
+	Evict(candidate uint64) (victim uint64, ok bool)
+	// Resize is called when the MaxCost of the cache changes. Keys are evicted
+	// afterwards if the cache shrank.
+	Resize(maxCost int64)
+	// Clear stops tracking all keys.
+	Clear()
+}
+
+// PriorityPolicy is a Policy that also weighs keys by the priority given to
+// Cache.SetWithOptions. SetPriority is called, like the other methods, once
+// the key has been admitted or updated with a priority, and only for tracked
+// keys.
+type PriorityPolicy interface {
+	Policy
+	SetPriority(key uint64, priority float64)
+}
+
+// StatefulPolicy is a Policy whose state, such as the access frequencies it
+// learned, can be saved by Cache.SaveTo and restored by LoadCache, so that a
+// restarted cache doesn't start from scratch. LoadState is called on a new
+// policy, before the items of the snapshot are added, with what SaveState
+// wrote for a policy of the same type, though possibly with other NumCounters
+// and MaxCost.
+type StatefulPolicy interface {
+	Policy
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// BatchPolicy is a Policy that can stop tracking several keys at once, for
+// Cache.DelMulti. DelMulti is called in place of Del for every key, with the
+// tracked keys only.
+type BatchPolicy interface {
+	Policy
+	DelMulti(keys []uint64)
+}
+
+// SkippingPolicy is a Policy that can pass over keys when picking a victim,
+// such as the pinned keys and the young ones of Config.MinResidency, leaving
+// them where they are. Without it, the cache has the policy evict the keys it
+// can't take, and adds them back once it has found a victim, which loses their
+// standing. EvictSkipping works like Evict, but never returns a key for which
+// skip returns true, and returns false if every key is skipped.
+type SkippingPolicy interface {
+	Policy
+	EvictSkipping(candidate uint64, skip func(key uint64) bool) (victim uint64, ok bool)
+}
+
+// policyStateVersion is the version of the format of the state written by
+// policy.SaveState.
+const policyStateVersion = 1
+
 // policy is the interface encapsulating eviction/admission behavior.
 //
 // TODO: remove this interface and just rename defaultPolicy to policy, as we
 //       are probably only going to use/implement/maintain one policy.
 type policy interface {
-	ringConsumer
+	waitConsumer
 	// Add attempts to Add the key-cost pair to the Policy. It returns a slice
 	// of evicted keys and a bool denoting whether or not the key-cost pair
 	// was added. If it returns true, the key should be stored in cache.
@@ -44,8 +140,13 @@ type policy interface {
 	Has(uint64) bool
 	// Del deletes the key from the Policy.
 	Del(uint64)
+	// DelMulti deletes the keys from the Policy, taking the lock and counting
+	// the keys in the metrics once.
+	DelMulti([]uint64)
 	// Cap returns the available capacity.
 	Cap() int64
+	// Used returns the sum of the costs of all the keys in the Policy.
+	Used() int64
 	// Close stops all goroutines and closes all channels.
 	Close()
 	// Update updates the cost value for the key.
@@ -54,34 +155,199 @@ type policy interface {
 	Cost(uint64) int64
 	// Optionally, set stats object to track how policy is performing.
 	CollectMetrics(*Metrics)
+	// TraceAdmissions sets the ring the admission decisions sampled by
+	// Config.TraceAdmissions are kept in. Custom policies record none.
+	TraceAdmissions(*admissionTrace)
+	// SetAdmissionMargin sets how many more estimated accesses than the keys
+	// they'd evict new keys need to be admitted. Custom policies ignore it.
+	SetAdmissionMargin(int64)
+	// AdmissionMargin returns the margin set by SetAdmissionMargin.
+	AdmissionMargin() int64
+	// SetShadow sets the Config.ShadowPolicy told about the batches of
+	// accesses applied. It's called before any is pushed.
+	SetShadow(*shadowPolicy)
+	// SetWatermarks sets the shares of the max cost new keys can take before
+	// evictions start, and that the evictions go down to, see
+	// Config.HighWatermark.
+	SetWatermarks(high, low float64)
+	// SetMinResidency keeps the keys admitted less than minResidency ago, as
+	// told by clock, or less than admissions keys ago, from being picked as
+	// victims while there are others, see Config.MinResidency.
+	SetMinResidency(minResidency time.Duration, admissions int64, clock Clock)
+	// SetSeed makes the seeds of the frequency sketch and the picks of the
+	// eviction candidates derive from seed, see Config.Seed. It's called
+	// before any key is added.
+	SetSeed(seed int64)
 	// Clear zeroes out all counters and clears hashmaps.
 	Clear()
 	// MaxCost returns the current max cost of the cache policy.
 	MaxCost() int64
+	// MaxEntries returns the max number of keys of the cache policy, or 0 if
+	// it's unlimited.
+	MaxEntries() int64
 	// UpdateMaxCost updates the max cost of the cache policy.
 	UpdateMaxCost(int64)
+	// Trim evicts up to n keys while the costs of the keys add up to more than
+	// the max cost, and returns them.
+	Trim(n int) []*Item
+	// Shed evicts up to n keys, whether or not they fit, stopping early once
+	// their costs add up to cost if it's positive, and returns them.
+	Shed(n int, cost int64) []*Item
+	// Sample returns up to n of the keys in the Policy, in no particular
+	// order.
+	Sample(n int) []uint64
+	// UpdateCost updates the cost of a key, and then evicts other keys until
+	// the costs fit in the max cost again. It returns the evicted keys, and
+	// false if the key isn't in the Policy.
+	UpdateCost(uint64, int64) ([]*Item, bool)
+	// Frequency returns the estimated access frequency of a key, or 0 if the
+	// policy doesn't keep track of frequencies.
+	Frequency(uint64) int64
+	// Estimate works like Frequency, but doesn't take the lock of the default
+	// policy, and asks a custom InspectablePolicy for its frequency.
+	Estimate(uint64) int64
+	// SetFrequency raises the estimated access frequency of a key up to freq.
+	SetFrequency(uint64, int64)
+	// Hint raises the estimated access frequency of each key by one, unless
+	// it's already max or more, and returns the number of keys raised.
+	Hint([]uint64, int64) int
+	// Inspect fills in what the policy knows about a key, for
+	// Cache.EntryInfo.
+	Inspect(uint64, *EntryInfo)
+	// TopKeys returns the k tracked keys with the highest estimated access
+	// frequency, or nil if the policy has no frequencies.
+	TopKeys(int) []KeyFreq
+	// Ranked returns every tracked key, the most valuable first, for
+	// Cache.Drain.
+	Ranked() []uint64
+	// Pending returns the number of access batches waiting to be applied,
+	// and how many can wait before Push drops them.
+	Pending() (int, int)
+	// AddIfRoom adds a new key-cost pair of the given cost class, if any, only
+	// if it fits without evicting anything, and returns whether it was added.
+	AddIfRoom(uint64, int64, string) bool
+	// Flush applies the given accesses and every batch pushed before them,
+	// and then returns.
+	Flush([]uint64)
+	// AddForce works like Add but always admits the key-cost pair, as long as
+	// it fits in the max cost.
+	AddForce(uint64, int64) ([]*Item, bool)
+	// Pin keeps a key from being picked as an eviction victim until it's
+	// unpinned or deleted. It returns false if the key isn't in the Policy.
+	Pin(uint64) bool
+	// Unpin makes a pinned key evictable again. It returns false if the key
+	// wasn't pinned.
+	Unpin(uint64) bool
+	// SetPriority passes the priority of a key on to a custom PriorityPolicy,
+	// and does nothing otherwise.
+	SetPriority(uint64, float64)
+	// WindowRatio returns the share of the max cost given to the window of a
+	// W-TinyLFU policy, or 0 for other policies.
+	WindowRatio() float64
+	// SketchCounters returns the number of counters in each row of the
+	// frequency sketch, or 0 if the policy has none.
+	SketchCounters() int64
+	// SaveState writes the version of the format, the type of the policy and
+	// its state, if it has any, to w.
+	SaveState(io.Writer) error
+	// LoadState restores the state written by SaveState. It fails if the
+	// state belongs to another type of policy.
+	LoadState(io.Reader) error
+	// AddClass works like Add, or AddForce if force is set, for a key of the
+	// given cost class. If the class is at its quota, only keys of the same
+	// class are evicted for it, picked by the policy of the class if it has
+	// one.
+	AddClass(key uint64, cost int64, class string, force bool) ([]*Item, bool)
+	// AddGroup admits the keys of a SetGroup with their costs, putting them in
+	// the cost classes at the same index of classes, if not nil, or admits
+	// none of them. Keys already tracked have their cost updated. It returns
+	// the victims evicted to make room, none of them from the group.
+	AddGroup(keys []uint64, costs []int64, classes []string) ([]*Item, bool)
+	// SetQuota sets the share of the max cost a cost class can take, or
+	// removes its quota if fraction isn't positive. Trim evicts the keys of
+	// the classes over their quota.
+	SetQuota(class string, fraction float64)
+	// ClassUsed returns the sum of the costs of the keys of a cost class.
+	ClassUsed(class string) int64
+	// SetKeyClasses sets up the cost classes of Config.Classes, named by
+	// keyClassName, with their shares of the max cost and their policies,
+	// nil for the ones sampled by estimate. It's called before any key is
+	// added.
+	SetKeyClasses(policies []Policy, shares []float64)
+	// KeyClass returns the index of the key class of a tracked key, or 0.
+	KeyClass(uint64) int
+}
+
+func newPolicy(numCounters, maxCost, maxEntries, doorkeeperBits int64, samples int,
+	agingFactor float64) policy {
+	admit := newTinyLFU(numCounters, doorkeeperBits)
+	if agingFactor > 0 {
+		admit.resetAt = int64(math.Ceil(float64(numCounters) * agingFactor))
+	}
+	evict := newSampledLFU(maxCost)
+	evict.maxEntries = maxEntries
+	if samples > 0 {
+		evict.samples = samples
+	}
+	return newDefaultPolicyWith(admit, evict)
 }
 
-func newPolicy(numCounters, maxCost int64) policy {
-	return newDefaultPolicy(numCounters, maxCost)
+// newCustomPolicy returns a policy that keeps the cost accounting of the
+// default one but leaves admission and eviction decisions to custom.
+func newCustomPolicy(custom Policy, maxCost, maxEntries int64) policy {
+	evict := newSampledLFU(maxCost)
+	evict.maxEntries = maxEntries
+	p := newDefaultPolicyWith(nil, evict)
+	p.custom = custom
+	return p
 }
 
 type defaultPolicy struct {
 	sync.Mutex
-	admit    *tinyLFU
-	evict    *sampledLFU
-	itemsCh  chan []uint64
-	stop     chan struct{}
-	isClosed bool
-	metrics  *Metrics
+	admit *tinyLFU
+	evict *sampledLFU
+	// custom, if set, replaces admit and the sampling done by evict. evict is
+	// still used to keep track of costs.
+	custom  Policy
+	itemsCh chan []uint64
+	// flushCh asks processItems to apply the batches left in itemsCh and
+	// close the channel it's sent.
+	flushCh chan chan struct{}
+	stop    chan struct{}
+	// done is closed once processItems returns.
+	done    chan struct{}
+	closed  uint32
+	metrics *Metrics
+	// recycle, if set, takes back the batches of accesses once applied.
+	recycle func([]uint64)
+	// shadow, if set, is passed the batches of accesses too.
+	shadow *shadowPolicy
+	// trace keeps the admission decisions sampled by Config.TraceAdmissions.
+	trace *admissionTrace
+	// margin is how many more estimated accesses than its victims a new key
+	// needs to be admitted, raised by Cache.SetPressure.
+	margin int64
+	// applyMu is held while a batch of accesses is applied to admit, so that
+	// Clear and LoadState, which also take the main lock, can wait for it.
+	applyMu sync.Mutex
+	// classes are the cost classes of Config.Classes, by index, and
+	// classPolicies whether any has a policy of its own.
+	classes       []*costClass
+	classPolicies bool
 }
 
 func newDefaultPolicy(numCounters, maxCost int64) *defaultPolicy {
+	return newDefaultPolicyWith(newTinyLFU(numCounters, 0), newSampledLFU(maxCost))
+}
+
+func newDefaultPolicyWith(admit *tinyLFU, evict *sampledLFU) *defaultPolicy {
 	p := &defaultPolicy{
-		admit:   newTinyLFU(numCounters),
-		evict:   newSampledLFU(maxCost),
+		admit:   admit,
+		evict:   evict,
 		itemsCh: make(chan []uint64, 3),
+		flushCh: make(chan chan struct{}),
 		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 	go p.processItems()
 	return p
@@ -92,26 +358,145 @@ func (p *defaultPolicy) CollectMetrics(metrics *Metrics) {
 	p.evict.metrics = metrics
 }
 
+func (p *defaultPolicy) TraceAdmissions(trace *admissionTrace) {
+	if p.custom == nil {
+		p.trace = trace
+	}
+}
+
+func (p *defaultPolicy) SetAdmissionMargin(margin int64) {
+	p.Lock()
+	defer p.Unlock()
+	if p.custom == nil {
+		p.margin = margin
+	}
+}
+
+func (p *defaultPolicy) SetWatermarks(high, low float64) {
+	p.Lock()
+	defer p.Unlock()
+	p.evict.high, p.evict.low = high, low
+}
+
+func (p *defaultPolicy) SetMinResidency(minResidency time.Duration, admissions int64, clock Clock) {
+	p.Lock()
+	defer p.Unlock()
+	e := p.evict
+	e.minResidency, e.minAdmissions, e.clock = int64(minResidency), admissions, clock
+	e.young = make(map[uint64]int64)
+}
+
+func (p *defaultPolicy) SetSeed(seed int64) {
+	p.Lock()
+	defer p.Unlock()
+	source := rand.New(rand.NewSource(seed))
+	if p.admit != nil {
+		p.admit.freq.reseed(source)
+	}
+	e := p.evict
+	e.rng = rand.New(rand.NewSource(source.Int63()))
+	e.slots = make(map[uint64]int)
+}
+
+func (p *defaultPolicy) AdmissionMargin() int64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.margin
+}
+
 type policyPair struct {
 	key  uint64
 	cost int64
 }
 
 func (p *defaultPolicy) processItems() {
+	defer close(p.done)
 	for {
 		select {
 		case items := <-p.itemsCh:
-			p.Lock()
-			p.admit.Push(items)
-			p.Unlock()
+			p.apply(items)
+		case flushed := <-p.flushCh:
+			// itemsCh only has this consumer, so every batch pushed before
+			// the flush was requested has been applied once it's empty.
+		drain:
+			for {
+				select {
+				case items := <-p.itemsCh:
+					p.apply(items)
+				default:
+					break drain
+				}
+			}
+			close(flushed)
 		case <-p.stop:
 			return
 		}
 	}
 }
 
+// apply records a batch of accesses, and then gives the batch back. The
+// counters of the default policy are updated atomically, so it only takes
+// applyMu rather than the lock the Sets are admitted under.
+func (p *defaultPolicy) apply(items []uint64) {
+	if p.custom != nil {
+		p.Lock()
+		p.custom.Access(items)
+		p.Unlock()
+	} else {
+		p.applyMu.Lock()
+		p.admit.Push(items)
+		p.applyMu.Unlock()
+	}
+	if p.classPolicies {
+		p.accessClasses(items)
+	}
+	p.shadow.access(items)
+	p.release(items)
+}
+
+func (p *defaultPolicy) SetShadow(shadow *shadowPolicy) {
+	p.shadow = shadow
+}
+
+func (p *defaultPolicy) setRecycle(recycle func([]uint64)) {
+	p.recycle = recycle
+}
+
+// release gives a batch the policy is done with back to the Get buffer.
+func (p *defaultPolicy) release(items []uint64) {
+	if p.recycle != nil {
+		p.recycle(items)
+	}
+}
+
+// Flush pushes keys, waiting for room in the queue if needed, and returns once
+// they have been applied along with every batch pushed before them.
+func (p *defaultPolicy) Flush(keys []uint64) {
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return
+	}
+	if len(keys) > 0 {
+		select {
+		case p.itemsCh <- keys:
+			p.metrics.add(keepGets, keys[0], uint64(len(keys)))
+		case <-p.done:
+			return
+		}
+	}
+	flushed := make(chan struct{})
+	select {
+	case p.flushCh <- flushed:
+	case <-p.done:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-p.done:
+	}
+}
+
 func (p *defaultPolicy) Push(keys []uint64) bool {
-	if p.isClosed {
+	if atomic.LoadUint32(&p.closed) == 1 {
 		return false
 	}
 
@@ -119,12 +504,42 @@ func (p *defaultPolicy) Push(keys []uint64) bool {
 		return true
 	}
 
+	// The batch may be recycled as soon as it's sent, so it's not read after.
+	key, n := keys[0], uint64(len(keys))
 	select {
 	case p.itemsCh <- keys:
-		p.metrics.add(keepGets, keys[0], uint64(len(keys)))
+		p.metrics.add(keepGets, key, n)
 		return true
 	default:
-		p.metrics.add(dropGets, keys[0], uint64(len(keys)))
+		return false
+	}
+}
+
+// PushWait works like Push, but waits up to timeout for room in itemsCh, and
+// for as long as it takes if timeout is 0, for BufferBlocking. processItems
+// never waits on the Get buffer, so the wait always ends, at the latest when
+// the policy is closed.
+func (p *defaultPolicy) PushWait(keys []uint64, timeout time.Duration) bool {
+	if p.Push(keys) {
+		return true
+	}
+	if atomic.LoadUint32(&p.closed) == 1 {
+		return false
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	key, n := keys[0], uint64(len(keys))
+	select {
+	case p.itemsCh <- keys:
+		p.metrics.add(keepGets, key, n)
+		return true
+	case <-p.done:
+		return false
+	case <-expired:
 		return false
 	}
 }
@@ -133,63 +548,135 @@ func (p *defaultPolicy) Push(keys []uint64) bool {
 // the policy. It returns the list of victims that have been evicted and a boolean
 // indicating whether the incoming item should be accepted.
 func (p *defaultPolicy) Add(key uint64, cost int64) ([]*Item, bool) {
+	return p.add(key, cost, false, "")
+}
+
+func (p *defaultPolicy) AddForce(key uint64, cost int64) ([]*Item, bool) {
+	return p.add(key, cost, true, "")
+}
+
+func (p *defaultPolicy) AddClass(key uint64, cost int64, class string, force bool) ([]*Item, bool) {
+	return p.add(key, cost, force, class)
+}
+
+// add implements Add, AddForce if force is set, and AddClass if class isn't
+// empty.
+func (p *defaultPolicy) add(key uint64, cost int64, force bool, class string) ([]*Item, bool) {
 	p.Lock()
 	defer p.Unlock()
+	var cls *costClass
+	if class != "" {
+		cls = p.evict.class(class)
+	}
+	victims, added := p.admitKey(key, cost, force, cls)
+	if added {
+		p.assign(key, cost, cls)
+	}
+	return victims, added
+}
+
+// assign puts a key just tracked in the cost class cls, if not nil, and adds
+// it to the policy of the class, if it has one.
+func (p *defaultPolicy) assign(key uint64, cost int64, cls *costClass) {
+	if cls == nil {
+		return
+	}
+	p.evict.assign(key, cls)
+	if cls.policy != nil {
+		cls.policy.Add(key, cost)
+	}
+}
+
+// admitKey implements add for a key of the cost class cls, if not nil.
+func (p *defaultPolicy) admitKey(key uint64, cost int64, force bool,
+	cls *costClass) ([]*Item, bool) {
 
 	// Cannot add an item bigger than entire cache.
 	if cost > p.evict.getMaxCost() {
+		p.metrics.add(rejectSets, key, 1)
 		return nil, false
 	}
 
 	// No need to go any further if the item is already in the cache.
 	if has := p.evict.updateIfHas(key, cost); has {
+		p.updatePolicies(key, cost)
 		// An update does not count as an addition, so return false.
 		return nil, false
 	}
 
+	// As items are evicted they will be appended to victims.
+	var victims []*Item
+	if cls != nil && p.evict.overQuota(cls, cost) {
+		// A class at its quota only makes room among its own keys.
+		var ok bool
+		if victims, ok = p.evictClass(key, cost, force, cls); !ok {
+			p.metrics.add(rejectSets, key, 1)
+			return victims, false
+		}
+	}
+
 	// If the execution reaches this point, the key doesn't exist in the cache.
-	// Calculate the remaining room in the cache (usually bytes).
-	room := p.evict.roomLeft(cost)
-	if room >= 0 {
+	// Check whether there's room left in the cache for it.
+	if !p.evict.full(cost, 1) {
 		// There's enough room in the cache to store the new item without
 		// overflowing. Do that now and stop here.
-		p.evict.add(key, cost)
-		p.metrics.add(costAdd, key, uint64(cost))
-		return nil, true
+		p.track(key, cost)
+		return victims, true
+	}
+	if p.custom != nil {
+		more, ok := p.addCustom(key, cost, force)
+		return append(victims, more...), ok
 	}
 
 	// incHits is the hit count for the incoming item.
 	incHits := p.admit.Estimate(key)
+	// trace, if set, records the decision for Config.TraceAdmissions.
+	var trace *AdmissionRecord
+	if p.trace.sample() {
+		trace = &AdmissionRecord{Key: key, Cost: cost, Estimate: incHits, Forced: force,
+			Used: p.evict.used, MaxCost: p.evict.getMaxCost()}
+		defer func() { p.trace.add(trace) }()
+	}
 	// sample is the eviction candidate pool to be filled via random sampling.
 	// TODO: perhaps we should use a min heap here. Right now our time
 	// complexity is N for finding the min. Min heap should bring it down to
 	// O(lg N).
-	sample := make([]*policyPair, 0, lfuSample)
-	// As items are evicted they will be appended to victims.
-	victims := make([]*Item, 0)
+	sample := make([]*policyPair, 0, p.evict.samples)
+	if victims == nil {
+		victims = make([]*Item, 0)
+	}
 
 	// Delete victims until there's enough space or a minKey is found that has
 	// more hits than incoming item.
-	for ; room < 0; room = p.evict.roomLeft(cost) {
+	for p.evict.full(cost, 1) {
 		// Fill up empty slots in sample.
 		sample = p.evict.fillSample(sample)
+		if len(sample) == 0 {
+			// Everything left is pinned.
+			p.metrics.add(rejectSets, key, 1)
+			return victims, false
+		}
 
 		// Find minimally used item in sample.
-		minKey, minHits, minId, minCost := uint64(0), int64(math.MaxInt64), 0, int64(0)
-		for i, pair := range sample {
-			// Look up hit count for sample key.
-			if hits := p.admit.Estimate(pair.key); hits < minHits {
-				minKey, minHits, minId, minCost = pair.key, hits, i, pair.cost
-			}
-		}
+		minId, minHits := p.minSample(sample)
+		minKey, minCost := sample[minId].key, sample[minId].cost
 
 		// If the incoming item isn't worth keeping in the policy, reject.
-		if incHits < minHits {
+		if !force && incHits < minHits+p.margin {
+			if trace != nil {
+				trace.Victims = append(trace.Victims,
+					AdmissionVictim{Key: minKey, Cost: minCost, Estimate: minHits})
+			}
 			p.metrics.add(rejectSets, key, 1)
 			return victims, false
 		}
+		if trace != nil {
+			trace.Victims = append(trace.Victims,
+				AdmissionVictim{Key: minKey, Cost: minCost, Estimate: minHits, Evicted: true})
+		}
 
 		// Delete the victim from metadata.
+		p.delClass(minKey)
 		p.evict.del(minKey)
 
 		// Delete the victim from sample.
@@ -202,12 +689,501 @@ func (p *defaultPolicy) Add(key uint64, cost int64) ([]*Item, bool) {
 			Cost:     minCost,
 		})
 	}
+	victims = append(victims, p.evictToLow(cost)...)
 
 	p.evict.add(key, cost)
 	p.metrics.add(costAdd, key, uint64(cost))
+	p.metrics.trackCost(cost)
+	if trace != nil {
+		trace.Admitted = true
+	}
+	return victims, true
+}
+
+// minSample returns the index and the hit count of the least frequently used
+// key in sample, which mustn't be empty.
+func (p *defaultPolicy) minSample(sample []*policyPair) (int, int64) {
+	minId, minHits := 0, int64(math.MaxInt64)
+	for i, pair := range sample {
+		// Look up hit count for sample key.
+		if hits := p.admit.Estimate(pair.key); hits < minHits {
+			minId, minHits = i, hits
+		}
+	}
+	return minId, minHits
+}
+
+func (p *defaultPolicy) Trim(n int) []*Item {
+	p.Lock()
+	defer p.Unlock()
+	return p.trim(n)
+}
+
+// trim implements Trim, evicting as many keys as needed if n is negative. The
+// classes over their quota are trimmed first.
+func (p *defaultPolicy) trim(n int) []*Item {
+	victims := p.trimClasses(n)
+	if n >= 0 {
+		if n -= len(victims); n == 0 {
+			return victims
+		}
+	}
+	more := p.evictWhile(n, func(*Item) bool { return p.evict.full(0, 0) })
+	return append(victims, more...)
+}
+
+// trimClasses evicts up to n keys, or any number if n is negative, of the cost
+// classes over their quota.
+func (p *defaultPolicy) trimClasses(n int) []*Item {
+	victims := make([]*Item, 0)
+	for _, cls := range p.evict.classes {
+		for (n < 0 || len(victims) < n) && p.evict.overQuota(cls, 0) {
+			victim, _, ok := p.classVictim(cls, 0)
+			if !ok {
+				break
+			}
+			victims = append(victims, p.evictKey(victim))
+		}
+	}
+	return victims
+}
+
+// evictClass evicts keys of the cost class cls until a new key of the class
+// fits in its quota, unless the new key isn't worth one of them and force
+// isn't set. It returns the victims, and whether there's room.
+func (p *defaultPolicy) evictClass(key uint64, cost int64, force bool,
+	cls *costClass) ([]*Item, bool) {
+	var incHits int64
+	if p.admit != nil {
+		incHits = p.admit.Estimate(key)
+	}
+	candidate := key
+	if force {
+		candidate = 0
+	}
+	victims := make([]*Item, 0)
+	for p.evict.overQuota(cls, cost) {
+		victim, hits, ok := p.classVictim(cls, candidate)
+		if !ok || (!force && incHits < hits) {
+			return victims, false
+		}
+		victims = append(victims, p.evictKey(victim))
+	}
 	return victims, true
 }
 
+// classVictim returns a key of the cost class to evict, along with its
+// estimated frequency. The policy of the class picks it, if it has one, and
+// may reject candidate instead, like Policy.Evict; its victims come with the
+// lowest frequency. Otherwise it's the least frequently used key out of a
+// sample of the keys of the class. Pinned keys aren't picked. Without a
+// frequency sketch, any of them is.
+func (p *defaultPolicy) classVictim(cls *costClass, candidate uint64) (uint64, int64, bool) {
+	if cls.policy != nil {
+		victim, ok := p.policyVictim(cls.policy, candidate)
+		return victim, math.MinInt64, ok
+	}
+	var victim, young uint64
+	minHits, sampled, hasYoung := int64(math.MaxInt64), 0, false
+	p.evict.expireYoung()
+	for key := range cls.keys {
+		if _, pinned := p.evict.pinned[key]; pinned {
+			continue
+		}
+		if p.evict.isYoung(key) {
+			if !hasYoung {
+				young, hasYoung = key, true
+			}
+			continue
+		}
+		var hits int64
+		if p.admit != nil {
+			hits = p.admit.Estimate(key)
+		}
+		if hits < minHits {
+			victim, minHits = key, hits
+		}
+		if sampled++; sampled >= p.evict.samples || p.admit == nil {
+			break
+		}
+	}
+	if sampled == 0 && hasYoung {
+		// Every key left is young.
+		var hits int64
+		if p.admit != nil {
+			hits = p.admit.Estimate(young)
+		}
+		return young, hits, true
+	}
+	return victim, minHits, sampled > 0
+}
+
+// evictKey stops tracking a key of a cost class picked as a victim outside of
+// the custom policy, and returns it as one. The policy of the class, if any,
+// has picked it.
+func (p *defaultPolicy) evictKey(key uint64) *Item {
+	if p.custom != nil {
+		p.custom.Del(key)
+	}
+	cost := p.evict.keyCosts[key]
+	p.evict.del(key)
+	return &Item{Key: key, Cost: cost}
+}
+
+func (p *defaultPolicy) SetQuota(class string, fraction float64) {
+	p.Lock()
+	defer p.Unlock()
+	if fraction > 1 {
+		fraction = 1
+	}
+	p.evict.class(class).quota = fraction
+}
+
+func (p *defaultPolicy) ClassUsed(class string) int64 {
+	p.Lock()
+	defer p.Unlock()
+	if cls, ok := p.evict.classes[class]; ok {
+		return cls.used
+	}
+	return 0
+}
+
+func (p *defaultPolicy) Shed(n int, cost int64) []*Item {
+	p.Lock()
+	defer p.Unlock()
+	var freed int64
+	return p.evictWhile(n, func(last *Item) bool {
+		if last != nil {
+			freed += last.Cost
+		}
+		return cost <= 0 || freed < cost
+	})
+}
+
+// evictWhile evicts up to n keys, or any number if n is negative, as long as
+// more returns true, picking the victims as when making room for a new key.
+// more is passed the last victim, or nil before the first one.
+func (p *defaultPolicy) evictWhile(n int, more func(last *Item) bool) []*Item {
+	victims := make([]*Item, 0)
+	sample := make([]*policyPair, 0, p.evict.samples)
+	var last *Item
+	for (n < 0 || len(victims) < n) && more(last) {
+		last = nil
+		var victim uint64
+		if p.custom != nil {
+			var ok bool
+			if victim, ok = p.policyVictim(p.custom, 0); !ok {
+				break
+			}
+		} else {
+			if sample = p.evict.fillSample(sample); len(sample) == 0 {
+				break
+			}
+			i, _ := p.minSample(sample)
+			victim = sample[i].key
+			sample[i] = sample[len(sample)-1]
+			sample = sample[:len(sample)-1]
+		}
+		cost, tracked := p.evict.keyCosts[victim]
+		if !tracked {
+			if p.custom != nil {
+				break
+			}
+			// The sample may hold the same key more than once.
+			continue
+		}
+		p.delClass(victim)
+		p.evict.del(victim)
+		last = &Item{Key: victim, Cost: cost}
+		victims = append(victims, last)
+	}
+	return victims
+}
+
+// addCustom evicts the victims picked by the custom policy until there's room
+// for the key, unless the custom policy rejects it first. If force is set, the
+// custom policy is asked for victims as when shrinking, so it can't reject the
+// key.
+func (p *defaultPolicy) addCustom(key uint64, cost int64, force bool) ([]*Item, bool) {
+	candidate := key
+	if force {
+		candidate = 0
+	}
+	victims := make([]*Item, 0)
+	for p.evict.full(cost, 1) {
+		victim, ok := p.policyVictim(p.custom, candidate)
+		victimCost, tracked := p.evict.keyCosts[victim]
+		if !ok || !tracked {
+			p.metrics.add(rejectSets, key, 1)
+			return victims, false
+		}
+		p.delClass(victim)
+		p.evict.del(victim)
+		victims = append(victims, &Item{Key: victim, Cost: victimCost})
+	}
+	victims = append(victims, p.evictToLow(cost)...)
+	p.track(key, cost)
+	return victims, true
+}
+
+// evictToLow evicts keys, once room has been made for a new key of the given
+// cost at the high watermark, until the key would take the cost of the keys
+// to the low watermark, if it's lower. Pinned keys stop it short.
+func (p *defaultPolicy) evictToLow(cost int64) []*Item {
+	if p.evict.low >= p.evict.high {
+		return nil
+	}
+	low := p.evict.watermark(p.evict.low)
+	return p.evictWhile(-1, func(*Item) bool { return p.evict.used+cost > low })
+}
+
+// policyVictim asks a custom policy, or the policy of a cost class, for a
+// victim that isn't pinned or young, see Config.MinResidency. A SkippingPolicy
+// passes over those keys in place, and falls back to a young one if it only has
+// those left. Any other policy has the keys it can't take handed back once a
+// victim is found, so that it can't pick them again in the meantime; it gets
+// one more try per pinned key, and per young one up to the number of samples
+// the sampled path looks at, before giving up, the first young key it picked
+// being the victim then. Victims the cache doesn't have are skipped, up to
+// maxGhostVictims of them.
+func (p *defaultPolicy) policyVictim(policy Policy, candidate uint64) (uint64, bool) {
+	p.evict.expireYoung()
+	if sp, ok := policy.(SkippingPolicy); ok {
+		return p.skippingVictim(sp, candidate)
+	}
+	var skipped []uint64
+	defer func() {
+		for _, key := range skipped {
+			policy.Add(key, p.evict.keyCosts[key])
+		}
+	}()
+	young := len(p.evict.young)
+	if young > p.evict.samples {
+		young = p.evict.samples
+	}
+	ghosts := 0
+	for len(skipped) <= len(p.evict.pinned)+young {
+		victim, ok := policy.Evict(candidate)
+		if !ok {
+			break
+		}
+		if !p.tracks(victim) {
+			if ghosts++; ghosts > maxGhostVictims {
+				return 0, false
+			}
+			continue
+		}
+		if _, pinned := p.evict.pinned[victim]; !pinned && !p.evict.isYoung(victim) {
+			return victim, true
+		}
+		skipped = append(skipped, victim)
+	}
+	for i, key := range skipped {
+		if _, pinned := p.evict.pinned[key]; !pinned {
+			skipped = append(skipped[:i], skipped[i+1:]...)
+			return key, true
+		}
+	}
+	return 0, false
+}
+
+// skippingVictim is policyVictim for a SkippingPolicy.
+func (p *defaultPolicy) skippingVictim(policy SkippingPolicy, candidate uint64) (uint64, bool) {
+	skipYoung := len(p.evict.young) > 0
+	skip := func(key uint64) bool {
+		if _, pinned := p.evict.pinned[key]; pinned {
+			return true
+		}
+		return skipYoung && p.evict.isYoung(key)
+	}
+	ghosts := 0
+	for {
+		victim, ok := policy.EvictSkipping(candidate, skip)
+		if !ok {
+			if !skipYoung {
+				return 0, false
+			}
+			// Every key left is pinned or young.
+			skipYoung = false
+			continue
+		}
+		if !p.tracks(victim) {
+			if ghosts++; ghosts > maxGhostVictims {
+				return 0, false
+			}
+			continue
+		}
+		return victim, true
+	}
+}
+
+// tracks reports whether the cache has the key a policy picked as a victim. If
+// not, the policy has a key that has left the cache, such as one it was told
+// about by a Get that raced with its Del. It has dropped it now, and freeing it
+// frees nothing.
+func (p *defaultPolicy) tracks(key uint64) bool {
+	if _, ok := p.evict.keyCosts[key]; ok {
+		return true
+	}
+	p.metrics.add(ghostsRemoved, key, 1)
+	return false
+}
+
+func (p *defaultPolicy) Pin(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.evict.keyCosts[key]; !ok {
+		return false
+	}
+	p.evict.pinned[key] = struct{}{}
+	return true
+}
+
+func (p *defaultPolicy) Unpin(key uint64) bool {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.evict.pinned[key]; !ok {
+		return false
+	}
+	delete(p.evict.pinned, key)
+	return true
+}
+
+func (p *defaultPolicy) AddIfRoom(key uint64, cost int64, class string) bool {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.evict.keyCosts[key]; ok || p.evict.full(cost, 1) {
+		return false
+	}
+	var cls *costClass
+	if class != "" {
+		if cls = p.evict.class(class); p.evict.overQuota(cls, cost) {
+			return false
+		}
+	}
+	p.track(key, cost)
+	p.assign(key, cost, cls)
+	return true
+}
+
+// AddGroup makes one admission decision for the whole group, as for its most
+// frequently used key: the group is only rejected if the victim sampled, or
+// picked by the custom policy for the first new key, is worth more. Once
+// admitted, victims are evicted as for a forced key until the group fits.
+// The keys of the group already tracked are pinned in the meantime, so that
+// none of them is picked, and the group is rejected up front if the pinned
+// keys would leave it no room. Cost class quotas are left to the next keys of
+// the classes.
+func (p *defaultPolicy) AddGroup(keys []uint64, costs []int64, classes []string) ([]*Item, bool) {
+	p.Lock()
+	defer p.Unlock()
+	// added is the cost the group adds, net of the costs it replaces.
+	var total, added int64
+	var newKeys int
+	var candidate uint64
+	incHits := int64(math.MinInt64)
+	for i, key := range keys {
+		total += costs[i]
+		added += costs[i]
+		if prev, ok := p.evict.keyCosts[key]; ok {
+			added -= prev
+		} else {
+			if newKeys == 0 {
+				candidate = key
+			}
+			newKeys++
+		}
+		if p.admit != nil {
+			if hits := p.admit.Estimate(key); hits > incHits {
+				incHits = hits
+			}
+		}
+	}
+	reject := func(victims []*Item) ([]*Item, bool) {
+		for _, key := range keys {
+			p.metrics.add(rejectSets, key, 1)
+		}
+		return victims, false
+	}
+	if total > p.evict.getMaxCost() {
+		return reject(nil)
+	}
+
+	var pinned []uint64
+	for _, key := range keys {
+		if _, ok := p.evict.keyCosts[key]; !ok {
+			continue
+		}
+		if _, ok := p.evict.pinned[key]; !ok {
+			p.evict.pinned[key] = struct{}{}
+			pinned = append(pinned, key)
+		}
+	}
+	defer func() {
+		for _, key := range pinned {
+			delete(p.evict.pinned, key)
+		}
+	}()
+	victims := make([]*Item, 0)
+	if p.evict.full(added, newKeys) {
+		var pinnedCost int64
+		for key := range p.evict.pinned {
+			pinnedCost += p.evict.keyCosts[key]
+		}
+		if p.evict.watermark(p.evict.high) < pinnedCost+added ||
+			p.evict.maxEntries > 0 && int64(len(p.evict.pinned)+newKeys) > p.evict.maxEntries {
+			return reject(nil)
+		}
+		switch {
+		case p.custom != nil:
+			victim, ok := p.policyVictim(p.custom, candidate)
+			victimCost, tracked := p.evict.keyCosts[victim]
+			if !ok || !tracked {
+				return reject(nil)
+			}
+			p.delClass(victim)
+			p.evict.del(victim)
+			victims = append(victims, &Item{Key: victim, Cost: victimCost})
+		case p.admit != nil:
+			sample := p.evict.fillSample(make([]*policyPair, 0, p.evict.samples))
+			if len(sample) > 0 {
+				if _, minHits := p.minSample(sample); incHits < minHits+p.margin {
+					return reject(nil)
+				}
+			}
+		}
+		victims = append(victims, p.evictWhile(-1, func(*Item) bool {
+			return p.evict.full(added, newKeys)
+		})...)
+		if p.evict.full(added, newKeys) {
+			return reject(victims)
+		}
+		victims = append(victims, p.evictToLow(added)...)
+	}
+
+	for i, key := range keys {
+		if p.evict.updateIfHas(key, costs[i]) {
+			p.updatePolicies(key, costs[i])
+			continue
+		}
+		p.track(key, costs[i])
+		if classes != nil && classes[i] != "" {
+			p.assign(key, costs[i], p.evict.class(classes[i]))
+		}
+	}
+	return victims, true
+}
+
+// track starts accounting for a key that has been admitted.
+func (p *defaultPolicy) track(key uint64, cost int64) {
+	p.evict.add(key, cost)
+	if p.custom != nil {
+		p.custom.Add(key, cost)
+	}
+	p.metrics.add(costAdd, key, uint64(cost))
+	p.metrics.trackCost(cost)
+}
+
 func (p *defaultPolicy) Has(key uint64) bool {
 	p.Lock()
 	_, exists := p.evict.keyCosts[key]
@@ -217,10 +1193,130 @@ func (p *defaultPolicy) Has(key uint64) bool {
 
 func (p *defaultPolicy) Del(key uint64) {
 	p.Lock()
+	if _, ok := p.evict.keyCosts[key]; ok && p.custom != nil {
+		p.custom.Del(key)
+	}
+	p.delClass(key)
 	p.evict.del(key)
 	p.Unlock()
 }
 
+func (p *defaultPolicy) DelMulti(keys []uint64) {
+	p.Lock()
+	defer p.Unlock()
+	var tracked []uint64
+	var cost, n uint64
+	for _, key := range keys {
+		p.delClass(key)
+		c, ok := p.evict.remove(key)
+		if !ok {
+			continue
+		}
+		cost += uint64(c)
+		n++
+		if p.custom != nil {
+			tracked = append(tracked, key)
+		}
+	}
+	if n == 0 {
+		return
+	}
+	p.metrics.add(costEvict, keys[0], cost)
+	p.metrics.add(keyEvict, keys[0], n)
+	if batch, ok := p.custom.(BatchPolicy); ok {
+		batch.DelMulti(tracked)
+	} else if p.custom != nil {
+		for _, key := range tracked {
+			p.custom.Del(key)
+		}
+	}
+}
+
+func (p *defaultPolicy) WindowRatio() float64 {
+	custom, ok := p.custom.(interface{ WindowRatio() float64 })
+	if !ok {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return custom.WindowRatio()
+}
+
+func (p *defaultPolicy) SketchCounters() int64 {
+	if p.admit != nil {
+		return p.admit.freq.counters()
+	}
+	if custom, ok := p.custom.(interface{ sketchCounters() int64 }); ok {
+		return custom.sketchCounters()
+	}
+	return 0
+}
+
+// name identifies the type of the policy in its saved state.
+func (p *defaultPolicy) name() string {
+	if p.custom != nil {
+		return fmt.Sprintf("%T", p.custom)
+	}
+	return "tinylfu"
+}
+
+func (p *defaultPolicy) SaveState(w io.Writer) error {
+	p.Lock()
+	defer p.Unlock()
+	name := p.name()
+	header := []byte{policyStateVersion, byte(len(name))}
+	if _, err := w.Write(append(header, name...)); err != nil {
+		return err
+	}
+	if p.admit != nil {
+		return p.admit.writeTo(w)
+	}
+	if custom, ok := p.custom.(StatefulPolicy); ok {
+		return custom.SaveState(w)
+	}
+	return nil
+}
+
+func (p *defaultPolicy) LoadState(r io.Reader) error {
+	p.Lock()
+	defer p.Unlock()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if header[0] != policyStateVersion {
+		return fmt.Errorf("unsupported policy state version %d", header[0])
+	}
+	name := make([]byte, header[1])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return err
+	}
+	if want := p.name(); string(name) != want {
+		return fmt.Errorf("policy state saved by %s, not %s", name, want)
+	}
+	if p.admit != nil {
+		p.applyMu.Lock()
+		defer p.applyMu.Unlock()
+		return p.admit.readFrom(r)
+	}
+	if custom, ok := p.custom.(StatefulPolicy); ok {
+		return custom.LoadState(r)
+	}
+	return nil
+}
+
+func (p *defaultPolicy) SetPriority(key uint64, priority float64) {
+	custom, ok := p.custom.(PriorityPolicy)
+	if !ok {
+		return
+	}
+	p.Lock()
+	if _, tracked := p.evict.keyCosts[key]; tracked {
+		custom.SetPriority(key, priority)
+	}
+	p.Unlock()
+}
+
 func (p *defaultPolicy) Cap() int64 {
 	p.Lock()
 	capacity := int64(p.evict.getMaxCost() - p.evict.used)
@@ -228,12 +1324,60 @@ func (p *defaultPolicy) Cap() int64 {
 	return capacity
 }
 
+func (p *defaultPolicy) Used() int64 {
+	p.Lock()
+	used := p.evict.used
+	p.Unlock()
+	return used
+}
+
 func (p *defaultPolicy) Update(key uint64, cost int64) {
 	p.Lock()
-	p.evict.updateIfHas(key, cost)
+	if p.evict.updateIfHas(key, cost) {
+		p.updatePolicies(key, cost)
+	}
 	p.Unlock()
 }
 
+// updatePolicies passes the new cost of a tracked key on to the custom policy
+// and to the policy of its class, if any.
+func (p *defaultPolicy) updatePolicies(key uint64, cost int64) {
+	if p.custom != nil {
+		p.custom.Update(key, cost)
+	}
+	if cls, ok := p.evict.keyClasses[key]; ok && cls.policy != nil {
+		cls.policy.Update(key, cost)
+	}
+}
+
+func (p *defaultPolicy) UpdateCost(key uint64, cost int64) ([]*Item, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.evict.updateIfHas(key, cost) {
+		return nil, false
+	}
+	p.updatePolicies(key, cost)
+	// Pin the key while making room, so that it isn't its own victim.
+	if _, pinned := p.evict.pinned[key]; !pinned {
+		p.evict.pinned[key] = struct{}{}
+		defer delete(p.evict.pinned, key)
+	}
+	return p.trim(-1), true
+}
+
+func (p *defaultPolicy) Sample(n int) []uint64 {
+	p.Lock()
+	defer p.Unlock()
+	keys := make([]uint64, 0, n)
+	for key := range p.evict.keyCosts {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 func (p *defaultPolicy) Cost(key uint64) int64 {
 	p.Lock()
 	if cost, found := p.evict.keyCosts[key]; found {
@@ -244,23 +1388,86 @@ func (p *defaultPolicy) Cost(key uint64) int64 {
 	return -1
 }
 
+func (p *defaultPolicy) Frequency(key uint64) int64 {
+	if p.admit == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.admit.Estimate(key)
+}
+
+func (p *defaultPolicy) SetFrequency(key uint64, freq int64) {
+	if p.admit == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	// The counters saturate, so this takes a bounded number of increments.
+	for i := 0; i < 16 && p.admit.Estimate(key) < freq; i++ {
+		p.admit.Increment(key)
+	}
+}
+
+func (p *defaultPolicy) Hint(keys []uint64, max int64) int {
+	if p.admit == nil {
+		return 0
+	}
+	p.Lock()
+	defer p.Unlock()
+	var raised int
+	for _, key := range keys {
+		if p.admit.Estimate(key) < max {
+			p.admit.Increment(key)
+			raised++
+		}
+	}
+	return raised
+}
+
+func (p *defaultPolicy) Pending() (int, int) {
+	return len(p.itemsCh), cap(p.itemsCh)
+}
+
 func (p *defaultPolicy) Clear() {
 	p.Lock()
-	p.admit.clear()
+	p.applyMu.Lock()
+	// Drop the pending access batches so they aren't applied to the fresh
+	// counters.
+loop:
+	for {
+		select {
+		case items := <-p.itemsCh:
+			p.release(items)
+		default:
+			break loop
+		}
+	}
+	if p.custom != nil {
+		p.custom.Clear()
+	} else {
+		p.admit.clear()
+	}
+	for _, cls := range p.classes {
+		if cls.policy != nil {
+			cls.policy.Clear()
+		}
+	}
 	p.evict.clear()
+	p.applyMu.Unlock()
 	p.Unlock()
 }
 
+// Close stops the processItems goroutine. itemsCh is left open so that a
+// concurrent Push can't panic, it just won't be processed anymore.
 func (p *defaultPolicy) Close() {
-	if p.isClosed {
+	if !atomic.CompareAndSwapUint32(&p.closed, 0, 1) {
 		return
 	}
 
 	// Block until the p.processItems goroutine returns.
 	p.stop <- struct{}{}
 	close(p.stop)
-	close(p.itemsCh)
-	p.isClosed = true
 }
 
 func (p *defaultPolicy) MaxCost() int64 {
@@ -270,11 +1477,30 @@ func (p *defaultPolicy) MaxCost() int64 {
 	return p.evict.getMaxCost()
 }
 
+func (p *defaultPolicy) MaxEntries() int64 {
+	if p == nil || p.evict == nil {
+		return 0
+	}
+	return p.evict.maxEntries
+}
+
 func (p *defaultPolicy) UpdateMaxCost(maxCost int64) {
 	if p == nil || p.evict == nil {
 		return
 	}
 	p.evict.updateMaxCost(maxCost)
+	if p.custom != nil || p.classPolicies {
+		p.Lock()
+		if p.custom != nil {
+			p.custom.Resize(maxCost)
+		}
+		for _, cls := range p.classes {
+			if cls.policy != nil {
+				cls.policy.Resize(cls.maxCost(maxCost))
+			}
+		}
+		p.Unlock()
+	}
 }
 
 // sampledLFU is an eviction helper storing key-cost pairs.
@@ -289,13 +1515,105 @@ type sampledLFU struct {
 	used     int64
 	metrics  *Metrics
 	keyCosts map[uint64]int64
+	// samples is the number of eviction candidates to look at.
+	samples int
+	// pinned holds the keys that must not be picked as eviction victims.
+	pinned map[uint64]struct{}
+	// maxEntries is the max number of keys, if not 0.
+	maxEntries int64
+	// classes are the cost classes by name, and keyClasses the class of every
+	// key that has one.
+	classes    map[string]*costClass
+	keyClasses map[uint64]*costClass
+	// high and low are the watermarks, as shares of the max cost. See
+	// Config.HighWatermark.
+	high, low float64
+	// minResidency, in nanoseconds, and minAdmissions are Config.MinResidency
+	// and MinResidencyAdmissions. With either set, young maps the keys
+	// admitted within them to their admission number, and residents queues
+	// the admissions in order, to find the ones that have grown old.
+	minResidency  int64
+	minAdmissions int64
+	clock         Clock
+	admissions    int64
+	young         map[uint64]int64
+	residents     []residency
+	// rng, set by Config.Seed, picks where fillSample starts looking for
+	// candidates in order, rather than following the order of keyCosts,
+	// which Go randomizes. order holds the keys in the order they were
+	// added, slots the index of every key in it, and holes the number of
+	// indexes left behind by the keys deleted since, until order is
+	// compacted. Keeping the order of the keys, rather than moving the last
+	// one into a hole, makes it independent of the order of the deletions.
+	rng   *rand.Rand
+	order []uint64
+	slots map[uint64]int
+	holes int
+}
+
+// residency is the admission of a key, by number and time.
+type residency struct {
+	key       uint64
+	admission int64
+	nanos     int64
+}
+
+// costClass is a set of keys, such as those of a Namespace, whose costs may be
+// limited to a share of the max cost.
+type costClass struct {
+	used int64
+	// quota is the share of the max cost the keys can take, if positive.
+	quota float64
+	keys  map[uint64]struct{}
+	// policy, if set, picks the victims among the keys of the class, which
+	// is then one of Config.Classes, and batch holds the accesses of a batch
+	// passed on to it.
+	policy Policy
+	batch  []uint64
+}
+
+// maxCost returns the cost the keys of the class can take, out of maxCost.
+func (cls *costClass) maxCost(maxCost int64) int64 {
+	return int64(cls.quota * float64(maxCost))
 }
 
 func newSampledLFU(maxCost int64) *sampledLFU {
 	return &sampledLFU{
-		keyCosts: make(map[uint64]int64),
-		maxCost:  maxCost,
+		keyCosts:   make(map[uint64]int64),
+		maxCost:    maxCost,
+		samples:    lfuSample,
+		pinned:     make(map[uint64]struct{}),
+		classes:    make(map[string]*costClass),
+		keyClasses: make(map[uint64]*costClass),
+		high:       1,
+		low:        1,
+	}
+}
+
+// class returns the cost class with the given name, creating it if needed.
+func (p *sampledLFU) class(name string) *costClass {
+	cls, ok := p.classes[name]
+	if !ok {
+		cls = &costClass{keys: make(map[uint64]struct{})}
+		p.classes[name] = cls
+	}
+	return cls
+}
+
+// assign puts a tracked key in the cost class cls, if not nil.
+func (p *sampledLFU) assign(key uint64, cls *costClass) {
+	if cls == nil {
+		return
 	}
+	p.keyClasses[key] = cls
+	cls.keys[key] = struct{}{}
+	cls.used += p.keyCosts[key]
+}
+
+// overQuota returns whether adding cost to the cost class would take it over
+// its quota.
+func (p *sampledLFU) overQuota(cls *costClass, cost int64) bool {
+	return cls.quota > 0 && cls.used+cost > cls.maxCost(p.getMaxCost())
 }
 
 func (p *sampledLFU) getMaxCost() int64 {
@@ -306,37 +1624,194 @@ func (p *sampledLFU) updateMaxCost(maxCost int64) {
 	atomic.StoreInt64(&p.maxCost, maxCost)
 }
 
+// roomLeft returns the cost left below the high watermark once cost is added.
 func (p *sampledLFU) roomLeft(cost int64) int64 {
-	return p.getMaxCost() - (p.used + cost)
+	return p.watermark(p.high) - (p.used + cost)
 }
 
+// watermark returns the given share of the max cost.
+func (p *sampledLFU) watermark(share float64) int64 {
+	maxCost := p.getMaxCost()
+	if share >= 1 {
+		return maxCost
+	}
+	return int64(share * float64(maxCost))
+}
+
+// full returns whether adding the given number of keys, with the given total
+// cost, would go over the max cost or the max number of keys.
+func (p *sampledLFU) full(cost int64, keys int) bool {
+	if p.roomLeft(cost) < 0 {
+		return true
+	}
+	return p.maxEntries > 0 && int64(len(p.keyCosts)+keys) > p.maxEntries
+}
+
+// fillSample adds keys to the sample until it's full, leaving out the pinned
+// keys, and the young ones unless every key left is young.
 func (p *sampledLFU) fillSample(in []*policyPair) []*policyPair {
-	if len(in) >= lfuSample {
+	if len(in) >= p.samples {
 		return in
 	}
+	p.expireYoung()
+	skipYoung := len(p.young) > 0 && len(p.young) < len(p.keyCosts)
+	if p.rng != nil {
+		return p.fillSampleSeeded(in, skipYoung)
+	}
 	for key, cost := range p.keyCosts {
+		if _, ok := p.pinned[key]; ok {
+			continue
+		}
+		if skipYoung && p.isYoung(key) {
+			continue
+		}
 		in = append(in, &policyPair{key, cost})
-		if len(in) >= lfuSample {
+		if len(in) >= p.samples {
 			return in
 		}
 	}
+	if len(in) == 0 && skipYoung {
+		// The keys that aren't young are all pinned.
+		for key, cost := range p.keyCosts {
+			if _, ok := p.pinned[key]; !ok {
+				in = append(in, &policyPair{key, cost})
+				if len(in) >= p.samples {
+					return in
+				}
+			}
+		}
+	}
+	return in
+}
+
+// fillSampleSeeded implements fillSample with rng, going through order from a
+// random index.
+func (p *sampledLFU) fillSampleSeeded(in []*policyPair, skipYoung bool) []*policyPair {
+	if len(p.order) == 0 {
+		return in
+	}
+	start := p.rng.Intn(len(p.order))
+	for pass := 0; pass < 2; pass++ {
+		for n := range p.order {
+			i := (start + n) % len(p.order)
+			key := p.order[i]
+			if slot, ok := p.slots[key]; !ok || slot != i {
+				continue
+			}
+			if _, ok := p.pinned[key]; ok {
+				continue
+			}
+			if skipYoung && p.isYoung(key) {
+				continue
+			}
+			in = append(in, &policyPair{key, p.keyCosts[key]})
+			if len(in) >= p.samples {
+				return in
+			}
+		}
+		if len(in) > 0 || !skipYoung {
+			break
+		}
+		// The keys that aren't young are all pinned.
+		skipYoung = false
+	}
 	return in
 }
 
+// isYoung returns whether the key is within Config.MinResidency, as of the
+// last expireYoung.
+func (p *sampledLFU) isYoung(key uint64) bool {
+	_, ok := p.young[key]
+	return ok
+}
+
+// expireYoung forgets the admissions that aren't within Config.MinResidency
+// anymore.
+func (p *sampledLFU) expireYoung() {
+	if p.young == nil {
+		return
+	}
+	var now int64
+	if p.minResidency > 0 {
+		now = p.clock.Now().UnixNano()
+	}
+	for len(p.residents) > 0 {
+		r := p.residents[0]
+		if p.minResidency > 0 && now-r.nanos < p.minResidency ||
+			p.minAdmissions > 0 && p.admissions-r.admission < p.minAdmissions {
+			break
+		}
+		if p.young[r.key] == r.admission {
+			delete(p.young, r.key)
+		}
+		p.residents = p.residents[1:]
+	}
+}
+
 func (p *sampledLFU) del(key uint64) {
+	if cost, ok := p.remove(key); ok {
+		p.metrics.add(costEvict, key, uint64(cost))
+		p.metrics.add(keyEvict, key, 1)
+	}
+}
+
+// remove stops tracking the key, without counting it in the metrics, and
+// returns its cost and whether it was tracked.
+func (p *sampledLFU) remove(key uint64) (int64, bool) {
 	cost, ok := p.keyCosts[key]
 	if !ok {
-		return
+		return 0, false
 	}
 	p.used -= cost
 	delete(p.keyCosts, key)
-	p.metrics.add(costEvict, key, uint64(cost))
-	p.metrics.add(keyEvict, key, 1)
+	delete(p.pinned, key)
+	if p.slots != nil {
+		delete(p.slots, key)
+		p.holes++
+		if p.holes > len(p.order)/2 {
+			p.compact()
+		}
+	}
+	if p.young != nil {
+		delete(p.young, key)
+	}
+	if cls, ok := p.keyClasses[key]; ok {
+		cls.used -= cost
+		delete(cls.keys, key)
+		delete(p.keyClasses, key)
+	}
+	return cost, true
 }
 
 func (p *sampledLFU) add(key uint64, cost int64) {
 	p.keyCosts[key] = cost
 	p.used += cost
+	if p.slots != nil {
+		p.slots[key] = len(p.order)
+		p.order = append(p.order, key)
+	}
+	if p.young != nil {
+		p.admissions++
+		r := residency{key: key, admission: p.admissions}
+		if p.minResidency > 0 {
+			r.nanos = p.clock.Now().UnixNano()
+		}
+		p.young[key] = r.admission
+		p.residents = append(p.residents, r)
+		p.expireYoung()
+	}
+}
+
+// compact drops the holes from order, keeping the order of the keys left.
+func (p *sampledLFU) compact() {
+	order := p.order[:0]
+	for i, key := range p.order {
+		if slot, ok := p.slots[key]; ok && slot == i {
+			p.slots[key] = len(order)
+			order = append(order, key)
+		}
+	}
+	p.order, p.holes = order, 0
 }
 
 func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
@@ -353,6 +1828,9 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 		}
 		p.used += cost - prev
 		p.keyCosts[key] = cost
+		if cls, ok := p.keyClasses[key]; ok {
+			cls.used += cost - prev
+		}
 		return true
 	}
 	return false
@@ -361,35 +1839,107 @@ func (p *sampledLFU) updateIfHas(key uint64, cost int64) bool {
 func (p *sampledLFU) clear() {
 	p.used = 0
 	p.keyCosts = make(map[uint64]int64)
+	p.pinned = make(map[uint64]struct{})
+	if p.slots != nil {
+		p.order, p.slots, p.holes = nil, make(map[uint64]int), 0
+	}
+	if p.young != nil {
+		p.young = make(map[uint64]int64)
+		p.residents = nil
+	}
+	// The classes keep their quota.
+	for _, cls := range p.classes {
+		cls.used = 0
+		cls.keys = make(map[uint64]struct{})
+	}
+	p.keyClasses = make(map[uint64]*costClass)
 }
 
 // tinyLFU is an admission helper that keeps track of access frequency using
-// tiny (4-bit) counters in the form of a count-min sketch.
-// tinyLFU is NOT thread safe.
+// tiny (4-bit) counters in the form of a count-min sketch. Increments and
+// estimates are atomic, so the accesses can be applied without holding the
+// lock of the policy while it admits keys; the other methods must not run
+// concurrently with each other.
 type tinyLFU struct {
-	freq    *cmSketch
-	door    *z.Bloom
-	incrs   int64
+	// incrs is the number of increments since the last reset. It comes first
+	// to be 64-bit aligned.
+	incrs int64
+	freq  *cmSketch
+	// door is the doorkeeper, a bloom filter that absorbs the first access to
+	// each key so that keys seen only once don't take up sketch counters. It's
+	// nil when the doorkeeper is disabled.
+	door *z.Bloom
+	// resetAt is the number of increments after which the counters are
+	// halved, so that estimates reflect recent traffic.
 	resetAt int64
 }
 
-func newTinyLFU(numCounters int64) *tinyLFU {
+// newTinyLFU returns a tinyLFU tracking numCounters keys. A doorkeeperBits of
+// zero sizes the doorkeeper for numCounters keys with a 1% false positive
+// rate, a positive value sets its size in bits, and a negative one disables it.
+func newTinyLFU(numCounters, doorkeeperBits int64) *tinyLFU {
 	return &tinyLFU{
 		freq:    newCmSketch(numCounters),
-		door:    z.NewBloomFilter(float64(numCounters), 0.01),
+		door:    newDoorkeeper(numCounters, doorkeeperBits),
 		resetAt: numCounters,
 	}
 }
 
+func newDoorkeeper(numCounters, bits int64) *z.Bloom {
+	switch {
+	case bits < 0:
+		return nil
+	case bits == 0:
+		return z.NewBloomFilter(float64(numCounters), 0.01)
+	}
+	// Use the optimal number of hash locations for numCounters keys.
+	locs := math.Round(float64(bits) / float64(numCounters) * math.Ln2)
+	if locs < 1 {
+		locs = 1
+	}
+	return z.NewBloomFilter(float64(bits), locs)
+}
+
+// maxMergedBatch is the largest batch whose duplicate keys are merged by
+// tinyLFU.Push.
+const maxMergedBatch = 64
+
+// keyCounts counts the occurrences of the keys of a batch, in a table twice
+// the size of the largest batch merged.
+type keyCounts [2 * maxMergedBatch]struct {
+	key uint64
+	n   int
+}
+
 func (p *tinyLFU) Push(keys []uint64) {
+	if len(keys) > maxMergedBatch || len(keys) < 2 {
+		for _, key := range keys {
+			p.Increment(key)
+		}
+		return
+	}
+	// Hot keys repeat a lot within a batch, so every key is only counted once
+	// for all of its occurrences. The table is open addressed with linear
+	// probing; a count of 0 marks an empty slot.
+	var counts keyCounts
 	for _, key := range keys {
-		p.Increment(key)
+		i := key & (uint64(len(counts)) - 1)
+		for counts[i].n != 0 && counts[i].key != key {
+			i = (i + 1) & (uint64(len(counts)) - 1)
+		}
+		counts[i].key = key
+		counts[i].n++
+	}
+	for i := range counts {
+		if counts[i].n != 0 {
+			p.IncrementBy(counts[i].key, counts[i].n)
+		}
 	}
 }
 
 func (p *tinyLFU) Estimate(key uint64) int64 {
 	hits := p.freq.Estimate(key)
-	if p.door.Has(key) {
+	if p.door != nil && p.door.HasAtomic(key) {
 		hits++
 	}
 	return hits
@@ -397,27 +1947,80 @@ func (p *tinyLFU) Estimate(key uint64) int64 {
 
 func (p *tinyLFU) Increment(key uint64) {
 	// Flip doorkeeper bit if not already done.
-	if added := p.door.AddIfNotHas(key); !added {
+	if p.door == nil || !p.door.AddIfNotHasAtomic(key) {
 		// Increment count-min counter if doorkeeper bit is already set.
 		p.freq.Increment(key)
 	}
-	p.incrs++
-	if p.incrs >= p.resetAt {
+	p.count(1)
+}
+
+// IncrementBy works like n calls to Increment, but only touches the counters
+// once.
+func (p *tinyLFU) IncrementBy(key uint64, n int) {
+	if p.door == nil || !p.door.AddIfNotHasAtomic(key) {
+		p.freq.IncrementBy(key, n)
+	} else if n > 1 {
+		p.freq.IncrementBy(key, n-1)
+	}
+	p.count(int64(n))
+}
+
+// count adds n to the increments, and resets the counters once there are
+// resetAt of them.
+func (p *tinyLFU) count(n int64) {
+	if atomic.AddInt64(&p.incrs, n) >= p.resetAt {
 		p.reset()
 	}
 }
 
 func (p *tinyLFU) reset() {
-	// Zero out incrs.
-	p.incrs = 0
+	// Zero out incrs. Only the increment that does it resets the counters,
+	// should several of them get there at once.
+	incrs := atomic.LoadInt64(&p.incrs)
+	if incrs < p.resetAt || !atomic.CompareAndSwapInt64(&p.incrs, incrs, 0) {
+		return
+	}
 	// clears doorkeeper bits
-	p.door.Clear()
+	if p.door != nil {
+		p.door.ClearAtomic()
+	}
 	// halves count-min counters
 	p.freq.Reset()
 }
 
+// writeTo writes the counters and the number of increments since the last
+// reset to w. The doorkeeper isn't saved, as it's cleared at every reset.
+func (p *tinyLFU) writeTo(w io.Writer) error {
+	if err := p.freq.writeTo(w); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, atomic.LoadInt64(&p.incrs))
+}
+
+// readFrom restores the state written by writeTo.
+func (p *tinyLFU) readFrom(r io.Reader) error {
+	if err := p.freq.readFrom(r); err != nil {
+		return err
+	}
+	var incrs int64
+	if err := binary.Read(r, binary.LittleEndian, &incrs); err != nil {
+		return err
+	}
+	if incrs < 0 {
+		return errors.New("corrupt policy state")
+	}
+	// The counters are halved on the next increment if resetAt got lower.
+	atomic.StoreInt64(&p.incrs, incrs)
+	if p.door != nil {
+		p.door.ClearAtomic()
+	}
+	return nil
+}
+
 func (p *tinyLFU) clear() {
-	p.incrs = 0
-	p.door.Clear()
+	atomic.StoreInt64(&p.incrs, 0)
+	if p.door != nil {
+		p.door.ClearAtomic()
+	}
 	p.freq.Clear()
 }
@@ -1,9 +1,12 @@
 package ristretto
 
 import (
+	"math/rand"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/ristretto/z"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,7 +14,7 @@ func TestPolicy(t *testing.T) {
 	defer func() {
 		require.Nil(t, recover())
 	}()
-	newPolicy(100, 10)
+	newPolicy(100, 10, 0, 0, 0, 0)
 }
 
 func TestPolicyMetrics(t *testing.T) {
@@ -38,6 +41,25 @@ func TestPolicyProcessItems(t *testing.T) {
 	p.Unlock()
 }
 
+func TestPolicyFlush(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	p.itemsCh <- []uint64{1, 2, 2}
+	p.itemsCh <- []uint64{2}
+	p.Flush([]uint64{1, 3})
+	p.Lock()
+	require.Equal(t, int64(2), p.admit.Estimate(1))
+	require.Equal(t, int64(3), p.admit.Estimate(2))
+	require.Equal(t, int64(1), p.admit.Estimate(3))
+	p.Unlock()
+
+	// Flushing a closed policy doesn't block.
+	p.Close()
+	p.Flush([]uint64{1})
+	p = newDefaultPolicy(100, 10)
+	p.stop <- struct{}{}
+	p.Flush(nil)
+}
+
 func TestPolicyPush(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	require.True(t, p.Push([]uint64{}))
@@ -80,6 +102,263 @@ func TestPolicyAdd(t *testing.T) {
 	require.False(t, added)
 }
 
+func TestPolicyMaxEntries(t *testing.T) {
+	// Only the number of keys is limiting.
+	p := newPolicy(1000, 100, 4, 0, 0, 0).(*defaultPolicy)
+	defer p.Close()
+	for key := uint64(1); key <= 4; key++ {
+		p.SetFrequency(key, 2)
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	// A cold key doesn't replace a hot one.
+	victims, added := p.Add(5, 1)
+	require.False(t, added)
+	require.Empty(t, victims)
+	p.SetFrequency(6, 5)
+	victims, added = p.Add(6, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, int64(4), p.Used())
+	require.Equal(t, int64(4), p.MaxEntries())
+	// Updates don't add keys.
+	p.Update(6, 50)
+	require.Equal(t, int64(53), p.Used())
+
+	// Only the cost is limiting.
+	p = newPolicy(1000, 10, 100, 0, 0, 0).(*defaultPolicy)
+	defer p.Close()
+	for key := uint64(1); key <= 5; key++ {
+		_, added := p.Add(key, 2)
+		require.True(t, added)
+	}
+	victims, added = p.AddForce(6, 2)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Len(t, p.evict.keyCosts, 5)
+
+	// Both are limiting: the new key needs room for its cost and for itself.
+	p = newPolicy(1000, 10, 3, 0, 0, 0).(*defaultPolicy)
+	defer p.Close()
+	for key := uint64(1); key <= 3; key++ {
+		_, added := p.Add(key, 3)
+		require.True(t, added)
+	}
+	require.False(t, p.AddIfRoom(4, 1, ""))
+	victims, added = p.AddForce(4, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	victims, added = p.AddForce(5, 7)
+	require.True(t, added)
+	require.Len(t, victims, 2)
+	require.Equal(t, 2, len(p.evict.keyCosts))
+	require.True(t, p.Used() <= 10)
+}
+
+func TestPolicyMaxEntriesCustom(t *testing.T) {
+	p := newCustomPolicy(NewSLRUPolicy(100, 100), 100, 2)
+	defer p.Close()
+	for key := uint64(1); key <= 3; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	require.Equal(t, int64(2), p.Used())
+	require.False(t, p.Has(1))
+}
+
+func TestPolicyUpdateCost(t *testing.T) {
+	p := newDefaultPolicy(1000, 10)
+	defer p.Close()
+	for key := uint64(1); key <= 5; key++ {
+		p.SetFrequency(key, 10)
+		_, added := p.Add(key, 2)
+		require.True(t, added)
+	}
+	victims, ok := p.UpdateCost(100, 1)
+	require.False(t, ok)
+	require.Empty(t, victims)
+
+	// The key outgrowing the cache evicts others, never itself, whatever its
+	// frequency.
+	victims, ok = p.UpdateCost(1, 7)
+	require.True(t, ok)
+	require.Len(t, victims, 3)
+	for _, victim := range victims {
+		require.NotEqual(t, uint64(1), victim.Key)
+	}
+	require.Equal(t, int64(9), p.Used())
+	require.Equal(t, int64(7), p.Cost(1))
+	require.False(t, p.Unpin(1))
+
+	victims, ok = p.UpdateCost(1, 100)
+	require.True(t, ok)
+	require.Len(t, victims, 1)
+	require.True(t, p.Has(1))
+}
+
+func TestPolicyUpdateCostCustom(t *testing.T) {
+	p := newCustomPolicy(NewSLRUPolicy(100, 10), 10, 0)
+	defer p.Close()
+	for key := uint64(1); key <= 5; key++ {
+		_, added := p.Add(key, 2)
+		require.True(t, added)
+	}
+	victims, ok := p.UpdateCost(1, 6)
+	require.True(t, ok)
+	require.Len(t, victims, 2)
+	require.True(t, p.Has(1))
+	require.Equal(t, int64(10), p.Used())
+}
+
+func TestPolicyAddForce(t *testing.T) {
+	p := newDefaultPolicy(1000, 10)
+	for key := uint64(1); key <= 10; key++ {
+		p.SetFrequency(key, 5)
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	// A cold key loses against the hot ones unless forced.
+	_, added := p.Add(100, 2)
+	require.False(t, added)
+	victims, added := p.AddForce(100, 2)
+	require.True(t, added)
+	require.Len(t, victims, 2)
+	require.True(t, p.Has(100))
+	require.Equal(t, int64(10), p.Used())
+
+	_, added = p.AddForce(200, 11)
+	require.False(t, added)
+}
+
+func TestPolicyPin(t *testing.T) {
+	p := newDefaultPolicy(1000, 10)
+	require.False(t, p.Pin(1))
+	for key := uint64(1); key <= 10; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	for key := uint64(1); key <= 9; key++ {
+		require.True(t, p.Pin(key))
+	}
+	// Only the unpinned key can make room.
+	victims, added := p.AddForce(100, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(10), victims[0].Key)
+
+	// Once everything is pinned, new keys are rejected.
+	require.True(t, p.Pin(100))
+	_, added = p.AddForce(200, 1)
+	require.False(t, added)
+	_, added = p.Add(200, 1)
+	require.False(t, added)
+	p.UpdateMaxCost(5)
+	require.Empty(t, p.Trim(10))
+
+	require.True(t, p.Unpin(1))
+	require.False(t, p.Unpin(1))
+	require.Len(t, p.Trim(10), 1)
+	require.False(t, p.Has(1))
+	// Deleting a key unpins it.
+	p.Del(2)
+	require.False(t, p.Unpin(2))
+}
+
+func TestPolicyPinCustom(t *testing.T) {
+	p := newCustomPolicy(NewSLRUPolicy(100, 10), 10, 0)
+	for key := uint64(1); key <= 10; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	for key := uint64(1); key <= 9; key++ {
+		require.True(t, p.Pin(key))
+	}
+	victims, added := p.Add(100, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(10), victims[0].Key)
+
+	require.True(t, p.Pin(100))
+	_, added = p.AddForce(200, 1)
+	require.False(t, added)
+	for key := uint64(1); key <= 9; key++ {
+		require.True(t, p.Has(key))
+	}
+}
+
+func TestPolicyAddScanResistant(t *testing.T) {
+	p := newDefaultPolicy(1000, 10)
+	// Fill the policy with hot keys.
+	for key := uint64(1); key <= 10; key++ {
+		p.Lock()
+		for i := 0; i < 5; i++ {
+			p.admit.Increment(key)
+		}
+		p.Unlock()
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	// A scan of one-hit-wonders must not displace any of them.
+	for key := uint64(100); key < 200; key++ {
+		p.Lock()
+		p.admit.Increment(key)
+		p.Unlock()
+		victims, added := p.Add(key, 1)
+		require.False(t, added)
+		require.Empty(t, victims)
+	}
+	for key := uint64(1); key <= 10; key++ {
+		require.True(t, p.Has(key))
+	}
+}
+
+func TestPolicyTrim(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	for key := uint64(1); key <= 10; key++ {
+		p.Add(key, 1)
+	}
+	require.Empty(t, p.Trim(10))
+	p.UpdateMaxCost(5)
+	require.Len(t, p.Trim(2), 2)
+	require.Len(t, p.Trim(10), 3)
+	require.Empty(t, p.Trim(10))
+	require.Equal(t, int64(5), p.Used())
+}
+
+func TestPolicyAging(t *testing.T) {
+	// shift returns whether 2 replaces 1 once traffic has shifted from 1 to 2.
+	shift := func(agingFactor float64) bool {
+		p := newPolicy(1024, 1, 0, 0, 0, agingFactor).(*defaultPolicy)
+		defer p.Close()
+		access := func(keys ...uint64) {
+			p.Lock()
+			p.admit.Push(keys)
+			p.Unlock()
+		}
+		repeat := func(key uint64, n int) {
+			for i := 0; i < n; i++ {
+				access(key)
+			}
+		}
+		// 1 was hot, and keeps 2 out while 2 is only warming up.
+		repeat(1, 15)
+		_, added := p.Add(1, 1)
+		require.True(t, added)
+		repeat(2, 5)
+		_, added = p.Add(2, 1)
+		require.False(t, added)
+		// Then 1 goes cold while 2 keeps being accessed, among other keys.
+		for key := uint64(100); key < 120; key++ {
+			access(key)
+		}
+		repeat(2, 5)
+		_, added = p.Add(2, 1)
+		return added
+	}
+	require.False(t, shift(0))
+	require.True(t, shift(1.0/32))
+}
+
 func TestPolicyHas(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
@@ -102,6 +381,15 @@ func TestPolicyCap(t *testing.T) {
 	require.Equal(t, int64(9), p.Cap())
 }
 
+func TestPolicyUsed(t *testing.T) {
+	p := newDefaultPolicy(100, 10)
+	p.Add(1, 1)
+	p.Add(2, 3)
+	require.Equal(t, int64(4), p.Used())
+	p.Del(2)
+	require.Equal(t, int64(1), p.Used())
+}
+
 func TestPolicyUpdate(t *testing.T) {
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
@@ -132,13 +420,14 @@ func TestPolicyClear(t *testing.T) {
 
 func TestPolicyClose(t *testing.T) {
 	defer func() {
-		require.NotNil(t, recover())
+		require.Nil(t, recover())
 	}()
 
 	p := newDefaultPolicy(100, 10)
 	p.Add(1, 1)
 	p.Close()
-	p.itemsCh <- []uint64{1}
+	p.Close()
+	require.False(t, p.Push([]uint64{1}))
 }
 
 func TestPushAfterClose(t *testing.T) {
@@ -153,6 +442,132 @@ func TestAddAfterClose(t *testing.T) {
 	p.Add(1, 1)
 }
 
+func TestTinyLFUPushMerged(t *testing.T) {
+	// Merging the duplicates of a batch counts like pushing the keys one by
+	// one. The doorkeeper is left out, as its false positives depend on the
+	// order of the keys, and so are resets, as the counters are only halved
+	// at the end of a batch rather than in the middle.
+	merged := newTinyLFU(1e5, -1)
+	single := newTinyLFU(1e5, -1)
+	single.freq.seed = merged.freq.seed
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 200)
+	batch := make([]uint64, maxMergedBatch)
+	for round := 0; round < 100; round++ {
+		for i := range batch {
+			batch[i] = zipf.Uint64()
+		}
+		merged.Push(batch)
+		for _, key := range batch {
+			single.Increment(key)
+		}
+	}
+	require.Equal(t, single.incrs, merged.incrs)
+	for key := uint64(0); key <= 200; key++ {
+		require.Equal(t, single.Estimate(key), merged.Estimate(key), "key %d", key)
+	}
+	// The order of the batch is left alone.
+	batch = []uint64{3, 1, 3, 2}
+	merged.Push(batch)
+	require.Equal(t, []uint64{3, 1, 3, 2}, batch)
+
+	// The first occurrence of a key only goes to the doorkeeper.
+	p := newTinyLFU(1e5, 0)
+	p.Push([]uint64{7, 7, 7, 8})
+	require.Equal(t, int64(3), p.Estimate(7))
+	require.Equal(t, int64(2), p.freq.Estimate(7))
+	require.Equal(t, int64(1), p.Estimate(8))
+	require.Equal(t, int64(4), p.incrs)
+}
+
+// zipfBatches returns batches of keys skewed like Gets of hot keys.
+func zipfBatches(n, size int) [][]uint64 {
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.1, 1, 1e5)
+	batches := make([][]uint64, n)
+	for i := range batches {
+		batches[i] = make([]uint64, size)
+		for j := range batches[i] {
+			batches[i][j] = z.MemHash([]byte(strconv.FormatUint(zipf.Uint64(), 10)))
+		}
+	}
+	return batches
+}
+
+// BenchmarkPolicyAccess applies skewed Gets to a policy one key at a time, with
+// a lock for every key, and a batch at a time, with a lock for the batch and
+// duplicate keys merged. The per-key mode goes through keyConsumer like a
+// consumer taking one key at a time would.
+func BenchmarkPolicyAccess(b *testing.B) {
+	batches := zipfBatches(1024, 64)
+	p := newDefaultPolicy(1e5, 1e4)
+	defer p.Close()
+	locks := 0
+	perKey := keyConsumer(func(key uint64) {
+		p.Lock()
+		locks++
+		p.admit.Increment(key)
+		p.Unlock()
+	})
+	batched := consumerFunc(func(keys []uint64) bool {
+		p.Lock()
+		locks++
+		p.admit.Push(keys)
+		p.Unlock()
+		return true
+	})
+	for _, bench := range []struct {
+		name string
+		cons ringConsumer
+	}{
+		{"perKey", perKey},
+		{"batched", batched},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			locks = 0
+			for i := 0; i < b.N; i++ {
+				bench.cons.Push(batches[i%len(batches)])
+			}
+			b.ReportMetric(float64(locks)/float64(b.N), "locks/batch")
+		})
+	}
+}
+
+func TestPolicySampledEviction(t *testing.T) {
+	hitRatio := func(samples int) float64 {
+		evict := newSampledLFU(200)
+		evict.samples = samples
+		p := newDefaultPolicyWith(newTinyLFU(2000, 0), evict)
+		defer p.Close()
+		r := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(r, 1.1, 1, 1e5)
+		hits := 0
+		for i := 0; i < 50000; i++ {
+			key := z.MemHash([]byte(strconv.FormatUint(zipf.Uint64(), 10)))
+			p.Lock()
+			p.admit.Increment(key)
+			p.Unlock()
+			if p.Has(key) {
+				hits++
+				continue
+			}
+			p.Add(key, 1)
+		}
+		return float64(hits) / 50000
+	}
+	// Sampling a handful of keys is about as good as looking at all of them.
+	require.InDelta(t, hitRatio(200), hitRatio(lfuSample), 0.02)
+}
+
+func TestSampledLFUSamples(t *testing.T) {
+	e := newSampledLFU(16)
+	e.samples = 2
+	e.add(1, 1)
+	e.add(2, 1)
+	e.add(3, 1)
+	require.Len(t, e.fillSample(nil), 2)
+}
+
 func TestSampledLFUAdd(t *testing.T) {
 	e := newSampledLFU(4)
 	e.add(1, 1)
@@ -220,20 +635,121 @@ func TestSampledLFUSample(t *testing.T) {
 }
 
 func TestTinyLFUIncrement(t *testing.T) {
-	a := newTinyLFU(4)
+	a := newTinyLFU(4, 0)
 	a.Increment(1)
 	a.Increment(1)
 	a.Increment(1)
-	require.True(t, a.door.Has(1))
+	require.True(t, a.door.HasAtomic(1))
 	require.Equal(t, int64(2), a.freq.Estimate(1))
 
 	a.Increment(1)
-	require.False(t, a.door.Has(1))
+	require.False(t, a.door.HasAtomic(1))
 	require.Equal(t, int64(1), a.freq.Estimate(1))
 }
 
+func TestTinyLFUNoDoorkeeper(t *testing.T) {
+	a := newTinyLFU(4, -1)
+	require.Nil(t, a.door)
+	a.Increment(1)
+	a.Increment(1)
+	require.Equal(t, int64(2), a.Estimate(1))
+	a.Increment(1)
+	a.Increment(1)
+	require.Equal(t, int64(2), a.Estimate(1))
+	a.clear()
+	require.Equal(t, int64(0), a.Estimate(1))
+}
+
+func TestTinyLFUDoorkeeperOneHitWonders(t *testing.T) {
+	const keys = 1000
+	hashes := make([]uint64, keys)
+	r := rand.New(rand.NewSource(1))
+	for i := range hashes {
+		hashes[i] = r.Uint64()
+	}
+	sketched := func(doorkeeperBits int64) (sum int64) {
+		a := newTinyLFU(1<<14, doorkeeperBits)
+		for _, key := range hashes {
+			a.Increment(key)
+		}
+		for _, key := range hashes {
+			sum += a.freq.Estimate(key)
+		}
+		return sum
+	}
+	// Only the doorkeeper's false positives reach the sketch.
+	require.True(t, sketched(0) < keys/20)
+	require.True(t, sketched(1<<14) < keys/20)
+	require.True(t, sketched(-1) >= keys)
+}
+
+func TestTinyLFUDoorkeeperHitRatio(t *testing.T) {
+	hitRatio := func(doorkeeperBits int64) float64 {
+		p := newDefaultPolicyWith(newTinyLFU(512, doorkeeperBits), newSampledLFU(100))
+		defer p.Close()
+		r := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(r, 1.2, 1, 1e4)
+		// 60% of the accesses are to keys that are never seen again.
+		oneHit := uint64(1 << 32)
+		hits := 0
+		for i := 0; i < 100000; i++ {
+			key := zipf.Uint64() + 1
+			if r.Intn(10) < 6 {
+				oneHit++
+				key = oneHit
+			}
+			key = z.MemHash([]byte(strconv.FormatUint(key, 10)))
+			p.Lock()
+			p.admit.Increment(key)
+			p.Unlock()
+			if p.Has(key) {
+				hits++
+				continue
+			}
+			p.Add(key, 1)
+		}
+		return float64(hits) / 100000
+	}
+	// The doorkeeper keeps one-hit-wonders out of the sketch without costing
+	// hit ratio.
+	require.InDelta(t, hitRatio(-1), hitRatio(0), 0.02)
+}
+
+func TestTinyLFUSketchHitRatio(t *testing.T) {
+	hitRatio := func(numCounters int64) float64 {
+		p := newDefaultPolicyWith(newTinyLFU(numCounters, -1), newSampledLFU(200))
+		defer p.Close()
+		r := rand.New(rand.NewSource(1))
+		zipf := rand.NewZipf(r, 1.1, 1, 1e5)
+		hits := 0
+		for i := 0; i < 50000; i++ {
+			key := z.MemHash([]byte(strconv.FormatUint(zipf.Uint64(), 10)))
+			p.Lock()
+			p.admit.Increment(key)
+			p.Unlock()
+			if p.Has(key) {
+				hits++
+				continue
+			}
+			p.Add(key, 1)
+		}
+		return float64(hits) / 50000
+	}
+	// With 10x more counters than keys, estimates collide less than with as
+	// many counters as keys.
+	small, large := hitRatio(200), hitRatio(2000)
+	require.True(t, large > small+0.05, "large: %.3f, small: %.3f", large, small)
+
+	p := newPolicy(1000, 100, 0, 0, 0, 0)
+	defer p.Close()
+	require.Equal(t, int64(1024), p.SketchCounters())
+	custom := newCustomPolicy(NewLRUPolicy(1000, 100), 100, 0)
+	defer custom.Close()
+	require.Zero(t, custom.SketchCounters())
+}
+
 func TestTinyLFUEstimate(t *testing.T) {
-	a := newTinyLFU(8)
+	a := newTinyLFU(8, 0)
 	a.Increment(1)
 	a.Increment(1)
 	a.Increment(1)
@@ -242,7 +758,7 @@ func TestTinyLFUEstimate(t *testing.T) {
 }
 
 func TestTinyLFUPush(t *testing.T) {
-	a := newTinyLFU(16)
+	a := newTinyLFU(16, 0)
 	a.Push([]uint64{1, 2, 2, 3, 3, 3})
 	require.Equal(t, int64(1), a.Estimate(1))
 	require.Equal(t, int64(2), a.Estimate(2))
@@ -250,10 +766,177 @@ func TestTinyLFUPush(t *testing.T) {
 	require.Equal(t, int64(6), a.incrs)
 }
 
+func TestPolicyApplyWhileAdmitting(t *testing.T) {
+	// Batches of accesses are applied without the policy's lock, while keys
+	// are admitted and the counters estimated.
+	p := newDefaultPolicy(1000, 100)
+	defer p.Close()
+	batches := zipfBatches(64, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			p.Flush(batches[i%len(batches)])
+		}
+	}()
+	for key := uint64(0); key < 2000; key++ {
+		p.Add(key, 1)
+		p.Frequency(key)
+		if key%500 == 0 {
+			p.Clear()
+		}
+	}
+	<-done
+	require.True(t, p.Used() <= 100)
+	// Nothing is lost once the batches are applied.
+	p.Clear()
+	p.Flush([]uint64{1, 1, 1})
+	require.Equal(t, int64(3), p.Frequency(1))
+}
+
 func TestTinyLFUClear(t *testing.T) {
-	a := newTinyLFU(16)
+	a := newTinyLFU(16, 0)
 	a.Push([]uint64{1, 3, 3, 3})
 	a.clear()
 	require.Equal(t, int64(0), a.incrs)
 	require.Equal(t, int64(0), a.Estimate(3))
 }
+
+// policyHitRatio replays keys against the custom policy, adding every missed
+// key with a cost of 1, and returns the hit ratio.
+func policyHitRatio(custom Policy, maxCost int64, keys []uint64) float64 {
+	p := newCustomPolicy(custom, maxCost, 0).(*defaultPolicy)
+	defer p.Close()
+	hits := 0
+	for _, key := range keys {
+		p.Lock()
+		p.custom.Access([]uint64{key})
+		p.Unlock()
+		if p.Has(key) {
+			hits++
+			continue
+		}
+		p.Add(key, 1)
+	}
+	return float64(hits) / float64(len(keys))
+}
+
+// scanTrace returns accesses to a hot set of keys, interrupted by scans of keys
+// that are never seen again.
+func scanTrace(hot, scan, rounds int) []uint64 {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]uint64, 0, rounds*(2*hot+scan))
+	next := uint64(hot)
+	for i := 0; i < rounds; i++ {
+		for j := 0; j < 2*hot; j++ {
+			keys = append(keys, uint64(r.Intn(hot)))
+		}
+		for j := 0; j < scan; j++ {
+			next++
+			keys = append(keys, next)
+		}
+	}
+	return keys
+}
+
+func TestSkippingPolicies(t *testing.T) {
+	// ordered is whether the key skipped is the next victim, rather than one
+	// picked at random or by sampling, or passed by a clock hand.
+	for name, test := range map[string]struct {
+		newPolicy func(int64, int64) Policy
+		ordered   bool
+	}{
+		"lru":        {NewLRUPolicy, true},
+		"slru":       {NewSLRUPolicy, true},
+		"arc":        {NewARCPolicy, true},
+		"2q":         {NewTwoQueuePolicy, true},
+		"lirs":       {NewLIRSPolicy, true},
+		"clock":      {NewClockPolicy, false},
+		"hyperbolic": {NewHyperbolicPolicy, false},
+		"random":     {NewRandomPolicy(1, 1), false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fill := func() SkippingPolicy {
+				p := test.newPolicy(100, 10).(SkippingPolicy)
+				for key := uint64(1); key <= 5; key++ {
+					p.Add(key, 1)
+				}
+				return p
+			}
+			first, ok := fill().Evict(0)
+			require.True(t, ok)
+
+			// The key skipped stays where it was.
+			p := fill()
+			victim, ok := p.EvictSkipping(0, func(key uint64) bool { return key == first })
+			require.True(t, ok)
+			require.NotEqual(t, first, victim)
+			if test.ordered {
+				next, ok := p.Evict(0)
+				require.True(t, ok)
+				require.Equal(t, first, next)
+			}
+
+			_, ok = fill().EvictSkipping(0, func(uint64) bool { return true })
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestPolicySkippingYoung(t *testing.T) {
+	p := newCustomPolicy(NewLRUPolicy(100, 4), 4, 0).(*defaultPolicy)
+	p.SetMinResidency(0, 2, nil)
+	for key := uint64(1); key <= 4; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	// 3 and 4 are young, and the least recently used.
+	p.custom.Access([]uint64{1, 2})
+	victims, added := p.Add(10, 1)
+	require.True(t, added)
+	require.Len(t, victims, 1)
+	require.Equal(t, uint64(1), victims[0].Key)
+	// They keep their standing in the custom policy, rather than being added
+	// back as the most recently used.
+	victim, ok := p.custom.Evict(0)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+}
+
+// BenchmarkPolicyEvictYoung picks the victim of a custom policy whose least
+// recently used keys are young. A SkippingPolicy passes over all of them in
+// place to find an old key; any other policy evicts and adds back as many of
+// them as the sampled path takes samples, and then settles for a young one.
+func BenchmarkPolicyEvictYoung(b *testing.B) {
+	const old, young = 1000, 10000
+	for name, custom := range map[string]func() Policy{
+		"skipping": func() Policy { return NewLRUPolicy(1e5, old+young) },
+		"readding": func() Policy { return struct{ Policy }{NewLRUPolicy(1e5, old+young)} },
+	} {
+		b.Run(name, func(b *testing.B) {
+			p := newCustomPolicy(custom(), old+young, 0).(*defaultPolicy)
+			defer p.Close()
+			for key := uint64(1); key <= old; key++ {
+				p.Add(key, 1)
+			}
+			p.SetMinResidency(time.Hour, 0, NewMockClock(time.Unix(1e9, 0)))
+			for key := uint64(old + 1); key <= old+young; key++ {
+				p.Add(key, 1)
+			}
+			for key := uint64(1); key <= old; key++ {
+				p.custom.Access([]uint64{key})
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Lock()
+				victim, ok := p.policyVictim(p.custom, 0)
+				if !ok {
+					b.Fatal("no victim")
+				}
+				// Back in the policy for the next iteration.
+				p.custom.Add(victim, 1)
+				p.Unlock()
+			}
+		})
+	}
+}
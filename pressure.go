@@ -0,0 +1,124 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	// pressureThreshold is the level of SetPressure above which the cache
+	// degrades.
+	pressureThreshold = 0.5
+	// pressureFloor is the share of the max cost left at full pressure.
+	pressureFloor = 0.1
+	// pressureMargin is the admission margin at full pressure.
+	pressureMargin = 4
+)
+
+// PressureState tells how the cache is degraded by SetPressure.
+type PressureState struct {
+	// Level is the last level passed to SetPressure.
+	Level float64
+	// MaxCost is the max cost the cache was given, by Config.MaxCost or
+	// UpdateMaxCost, which it goes back to once the pressure subsides.
+	// Cache.MaxCost returns the max cost lowered by the pressure.
+	MaxCost int64
+	// AdmissionMargin is how many more estimated accesses than the item it
+	// would evict a new item needs to be admitted.
+	AdmissionMargin int64
+}
+
+// pressureState holds the state of SetPressure.
+type pressureState struct {
+	sync.Mutex
+	level float64
+	// active is set while the level is above pressureThreshold, maxCost then
+	// being the max cost to go back to.
+	active  bool
+	maxCost int64
+}
+
+// pressureEffects returns the max cost kept out of maxCost at the given level,
+// and the admission margin.
+func pressureEffects(maxCost int64, level float64) (int64, int64) {
+	if level <= pressureThreshold {
+		return maxCost, 0
+	}
+	over := (level - pressureThreshold) / (1 - pressureThreshold)
+	share := 1 - over*(1-pressureFloor)
+	return int64(math.Round(float64(maxCost) * share)), int64(math.Ceil(over * pressureMargin))
+}
+
+// SetPressure tells the cache how much pressure the heap is under, from 0 for
+// none to 1 for the most, such as the share of a memory limit in use. Levels
+// outside of it are clamped. Above 0.5, the cache degrades in proportion: its
+// max cost is lowered, down to a tenth of it at 1, items being evicted in the
+// background like after UpdateMaxCost, and new items need up to 4 more
+// estimated accesses than the item they'd evict to be admitted. The max cost
+// and the admission bar go back to normal once the level is 0.5 or less.
+//
+// The admission margin only applies to the default policy; custom policies
+// are only shrunk. The state is returned by Pressure, and exported with the
+// metrics.
+func (c *Cache) SetPressure(level float64) {
+	if c == nil || c.isClosed() || c.isFrozen() {
+		return
+	}
+	switch {
+	case level < 0 || math.IsNaN(level):
+		level = 0
+	case level > 1:
+		level = 1
+	}
+	c.pressure.Lock()
+	defer c.pressure.Unlock()
+	c.pressure.level = level
+	_, margin := pressureEffects(0, level)
+	switch {
+	case margin > 0 && !c.pressure.active:
+		c.pressure.active, c.pressure.maxCost = true, c.policy.MaxCost()
+		c.logger.Log(LogInfo, "heap under pressure, cache degraded", "level", level)
+	case margin == 0 && !c.pressure.active:
+		return
+	case margin == 0:
+		c.pressure.active = false
+		c.logger.Log(LogInfo, "heap pressure subsided, cache restored", "level", level)
+	}
+	maxCost, _ := pressureEffects(c.pressure.maxCost, level)
+	c.policy.SetAdmissionMargin(margin)
+	c.setMaxCost(maxCost)
+}
+
+// Pressure returns the state set by SetPressure.
+func (c *Cache) Pressure() PressureState {
+	if c == nil || c.isClosed() {
+		return PressureState{}
+	}
+	c.pressure.Lock()
+	defer c.pressure.Unlock()
+	s := PressureState{
+		Level:           c.pressure.level,
+		MaxCost:         c.policy.MaxCost(),
+		AdmissionMargin: c.policy.AdmissionMargin(),
+	}
+	if c.pressure.active {
+		s.MaxCost = c.pressure.maxCost
+	}
+	return s
+}
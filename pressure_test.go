@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitUsedCost waits for the cache to shrink to at most cost.
+func waitUsedCost(t *testing.T, c *Cache, cost int64) {
+	for start := time.Now(); c.UsedCost() > cost; time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < time.Second, "cache didn't shrink")
+	}
+	c.Wait()
+}
+
+func TestCacheSetPressure(t *testing.T) {
+	for name, policy := range map[string]func(int64, int64) Policy{
+		"default": nil,
+		"lru":     NewLRUPolicy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewCache(&Config{
+				NumCounters:        10000,
+				MaxCost:            1000,
+				BufferItems:        64,
+				IgnoreInternalCost: true,
+				Policy:             policy,
+			})
+			require.NoError(t, err)
+			defer c.Close()
+			for i := 0; i < 1000; i++ {
+				require.True(t, c.Set(i, i, 1))
+			}
+			c.Wait()
+
+			// Up to the threshold, nothing changes.
+			c.SetPressure(0.5)
+			require.Equal(t, PressureState{Level: 0.5, MaxCost: 1000}, c.Pressure())
+			require.Equal(t, int64(1000), c.MaxCost())
+
+			// Full pressure keeps a tenth of the cost.
+			margin := int64(4)
+			if policy != nil {
+				margin = 0
+			}
+			c.SetPressure(2)
+			require.Equal(t, PressureState{Level: 1, MaxCost: 1000, AdmissionMargin: margin},
+				c.Pressure())
+			require.Equal(t, int64(100), c.MaxCost())
+			waitUsedCost(t, c, 100)
+			require.Equal(t, int64(100), c.UsedCost())
+
+			// Easing off grows the cache again, in proportion.
+			c.SetPressure(0.75)
+			require.Equal(t, int64(550), c.MaxCost())
+			if policy == nil {
+				require.Equal(t, int64(2), c.Pressure().AdmissionMargin)
+			}
+
+			// A new max cost is lowered until the pressure subsides.
+			c.UpdateMaxCost(2000)
+			require.Equal(t, int64(1100), c.MaxCost())
+			require.Equal(t, int64(2000), c.Pressure().MaxCost)
+			c.SetPressure(0.25)
+			require.Equal(t, PressureState{Level: 0.25, MaxCost: 2000}, c.Pressure())
+			require.Equal(t, int64(2000), c.MaxCost())
+			c.SetPressure(-1)
+			require.Equal(t, PressureState{MaxCost: 2000}, c.Pressure())
+		})
+	}
+}
+
+func TestPolicyAdmissionMargin(t *testing.T) {
+	p := newDefaultPolicy(1000, 10)
+	defer p.Close()
+	for key := uint64(1); key <= 10; key++ {
+		_, added := p.Add(key, 1)
+		require.True(t, added)
+	}
+	// A key as rarely seen as the ones it would evict is admitted, unless it
+	// needs a margin over them.
+	p.SetAdmissionMargin(1)
+	require.Equal(t, int64(1), p.AdmissionMargin())
+	_, added := p.Add(100, 1)
+	require.False(t, added)
+	_, added = p.AddForce(100, 1)
+	require.True(t, added)
+	p.SetAdmissionMargin(0)
+	_, added = p.Add(200, 1)
+	require.True(t, added)
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "math/rand"
+
+// randomPolicy admits the candidates needing room with a fixed probability,
+// and evicts resident keys picked uniformly at random. It knows nothing of the
+// accesses, which makes it a baseline telling how much the other policies get
+// out of them.
+type randomPolicy struct {
+	admit float64
+	rng   *rand.Rand
+	// keys holds the tracked keys densely, so that a victim can be drawn in
+	// constant time, and index maps each of them to its position.
+	keys  []uint64
+	index map[uint64]int
+	// candidate is the key the coin was last tossed for, which Evict is
+	// called with until there's room for it.
+	candidate uint64
+	tossed    bool
+}
+
+// NewRandomPolicy returns the constructor of a Policy admitting each candidate
+// that needs room with probability admit, clamped to [0, 1], and evicting
+// resident keys chosen uniformly at random at no cost per key beyond a couple
+// of words. The coins and victims are drawn from a source seeded with seed, so
+// that replays are reproducible. Candidates that fit are always admitted.
+//
+// It's meant as a naive baseline for the other policies, and is registered as
+// "random" with an admit of 1 and a seed of 1.
+func NewRandomPolicy(admit float64, seed int64) func(numCounters, maxCost int64) Policy {
+	switch {
+	case admit < 0:
+		admit = 0
+	case admit > 1:
+		admit = 1
+	}
+	return func(numCounters, maxCost int64) Policy {
+		return &randomPolicy{
+			admit: admit,
+			rng:   rand.New(rand.NewSource(seed)),
+			index: make(map[uint64]int),
+		}
+	}
+}
+
+// newRandomPolicy is the policy registered as "random".
+func newRandomPolicy(numCounters, maxCost int64) Policy {
+	return NewRandomPolicy(1, 1)(numCounters, maxCost)
+}
+
+func (p *randomPolicy) Add(key uint64, cost int64) {
+	if p.tossed && key == p.candidate {
+		p.tossed = false
+	}
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) Update(key uint64, cost int64) {}
+
+func (p *randomPolicy) Del(key uint64) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) Access(keys []uint64) {}
+
+func (p *randomPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+// EvictSkipping takes the first key that isn't skipped from where the victim
+// drawn is.
+func (p *randomPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	if len(p.keys) == 0 {
+		return 0, false
+	}
+	if candidate != 0 && (!p.tossed || candidate != p.candidate) {
+		// Toss once per candidate, however many victims it takes.
+		if p.rng.Float64() >= p.admit {
+			p.tossed = false
+			return 0, false
+		}
+		p.candidate, p.tossed = candidate, true
+	}
+	start := p.rng.Intn(len(p.keys))
+	for n := range p.keys {
+		victim := p.keys[(start+n)%len(p.keys)]
+		if skip == nil || !skip(victim) {
+			p.Del(victim)
+			return victim, true
+		}
+	}
+	return 0, false
+}
+
+func (p *randomPolicy) Resize(maxCost int64) {}
+
+func (p *randomPolicy) Clear() {
+	p.keys = p.keys[:0]
+	p.index = make(map[uint64]int)
+	p.tossed = false
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomPolicy(t *testing.T) {
+	victims := func(seed int64) []uint64 {
+		p := NewRandomPolicy(1, seed)(100, 10)
+		for key := uint64(1); key <= 10; key++ {
+			p.Add(key, 1)
+		}
+		p.Del(3)
+		var victims []uint64
+		for {
+			victim, ok := p.Evict(0)
+			if !ok {
+				break
+			}
+			victims = append(victims, victim)
+		}
+		return victims
+	}
+	// Every key but the deleted one is evicted once, in an order that only
+	// depends on the seed.
+	got := victims(1)
+	require.ElementsMatch(t, []uint64{1, 2, 4, 5, 6, 7, 8, 9, 10}, got)
+	require.Equal(t, got, victims(1))
+	require.NotEqual(t, got, victims(2))
+}
+
+func TestRandomPolicyAdmit(t *testing.T) {
+	for _, admit := range []float64{0, 0.25, 1} {
+		p := NewRandomPolicy(admit, 1)(100, 10).(*randomPolicy)
+		p.Add(1, 1)
+		admitted := 0
+		for candidate := uint64(2); candidate < 10002; candidate++ {
+			victim, ok := p.Evict(candidate)
+			if !ok {
+				continue
+			}
+			// The coin is tossed once per candidate, so a second victim
+			// is there for the taking.
+			p.Add(victim, 1)
+			_, ok = p.Evict(candidate)
+			require.True(t, ok)
+			admitted++
+			p.Add(candidate, 1)
+		}
+		require.InDelta(t, admit, float64(admitted)/10000, 0.02, "admit %v", admit)
+	}
+	// The probability is clamped.
+	require.Equal(t, float64(1), NewRandomPolicy(2, 1)(100, 10).(*randomPolicy).admit)
+	require.Zero(t, NewRandomPolicy(-1, 1)(100, 10).(*randomPolicy).admit)
+}
+
+func TestCacheRandomPolicy(t *testing.T) {
+	hits := func(admit float64) uint64 {
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            100,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Metrics:            true,
+			Synchronous:        true,
+			Policy:             NewRandomPolicy(admit, 7),
+		})
+		require.NoError(t, err)
+		defer c.Close()
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			key := r.Intn(500)
+			if _, ok := c.Get(key); !ok {
+				c.Set(key, key, 1+int64(key%7))
+			}
+		}
+		// The costs of the items left add up to the cost used.
+		var used int64
+		c.Range(func(item *Item) bool {
+			used += item.Cost
+			return true
+		})
+		require.Equal(t, used, c.UsedCost())
+		require.LessOrEqual(t, used, c.MaxCost())
+		return c.Metrics.Hits()
+	}
+	// The same seed gives the same hits.
+	require.Equal(t, hits(0.5), hits(0.5))
+	require.NotZero(t, hits(1))
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync/atomic"
+
+// RefCounted is a value whose memory is reclaimed once nothing uses it any
+// more, rather than as soon as it leaves the cache. The cache holds one
+// reference to every RefCounted value it stores, and releases it wherever it
+// would pass the value to Config.OnExit: on eviction, expiry, deletion,
+// replacement, rejection and Clear. GetRef takes another reference for its
+// caller, so that the value stays usable after it's evicted until the caller
+// is done with it.
+//
+// Set takes over the reference of the caller, but a Set returning false leaves
+// it with the caller, except for a value over Config.MaxItemCost, which is
+// rejected and released like the rejections of the policy. Retain and Release
+// have to be safe for concurrent use. RefValue implements RefCounted for any
+// value.
+type RefCounted interface {
+	// Retain takes a reference to the value.
+	Retain()
+	// Release drops a reference taken by Retain, or the one the value was
+	// created with, reclaiming the value once none is left.
+	Release()
+}
+
+// RefValue is a RefCounted value, calling a function to free Value once every
+// reference to it is released.
+type RefValue struct {
+	Value interface{}
+	refs  int32
+	free  func(value interface{})
+}
+
+// NewRefValue returns a RefValue holding value, with a single reference meant
+// to be handed over to the cache by Set. free is called with value, once,
+// when the last reference is released, and may be nil.
+func NewRefValue(value interface{}, free func(value interface{})) *RefValue {
+	return &RefValue{Value: value, refs: 1, free: free}
+}
+
+// Retain takes a reference to the value. It panics if the value was already
+// freed.
+func (v *RefValue) Retain() {
+	if atomic.AddInt32(&v.refs, 1) <= 1 {
+		panic("ristretto: RefValue retained after being freed")
+	}
+}
+
+// Release drops a reference to the value, and frees it if it was the last
+// one. It panics if the value is released more times than it was retained.
+func (v *RefValue) Release() {
+	switch refs := atomic.AddInt32(&v.refs, -1); {
+	case refs < 0:
+		panic("ristretto: RefValue released more times than retained")
+	case refs == 0 && v.free != nil:
+		v.free(v.Value)
+	}
+}
+
+// Refs returns the number of references to the value left.
+func (v *RefValue) Refs() int32 {
+	return atomic.LoadInt32(&v.refs)
+}
+
+// GetRef works like Get, and retains the value found if it's RefCounted, so
+// that it isn't reclaimed while the caller uses it, even if it's evicted or
+// deleted meanwhile. The returned function releases it, and has to be called
+// once done with the value; calling it again does nothing. It's a no-op for
+// other values and for misses, but is never nil.
+//
+// The value is retained while the hashmap shard holding it is locked, so it
+// can't be released by the cache in between. Unlike Get, GetRef only looks in
+// the hashmap: it misses the Sets still buffered, the victim cache and
+// Config.Backing.
+func (c *Cache) GetRef(key interface{}) (interface{}, func(), bool) {
+	if c == nil || c.isClosed() || key == nil {
+		return nil, func() {}, false
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	c.push(keyHash)
+	var (
+		value interface{}
+		found bool
+	)
+	c.store.Compute(keyHash, conflictHash, func(v interface{}, ok bool) (interface{}, bool) {
+		if ok {
+			if rc, isRef := v.(RefCounted); isRef {
+				rc.Retain()
+			}
+			value, found = v, true
+		}
+		return nil, false
+	})
+	release := func() {}
+	if rc, ok := value.(RefCounted); ok && found {
+		var once int32
+		release = func() {
+			if atomic.CompareAndSwapInt32(&once, 0, 1) {
+				rc.Release()
+			}
+		}
+	}
+	value, presence := c.presence(keyHash, value, found)
+	if presence != Present {
+		release()
+		return nil, func() {}, false
+	}
+	return value, release, true
+}
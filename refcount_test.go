@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheGetRef(t *testing.T) {
+	var freed []interface{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	v := NewRefValue("one", func(value interface{}) { freed = append(freed, value) })
+	require.True(t, c.Set(1, v, 1))
+	c.Wait()
+	val, release, ok := c.GetRef(1)
+	require.True(t, ok)
+	require.Equal(t, v, val)
+	require.Equal(t, int32(2), v.Refs())
+
+	// The deleted value outlives the cache's reference until it's released.
+	_, ok = c.Del(1)
+	require.True(t, ok)
+	require.Equal(t, int32(1), v.Refs())
+	require.Empty(t, freed)
+	release()
+	require.Equal(t, []interface{}{"one"}, freed)
+	release()
+	require.Zero(t, v.Refs())
+
+	// Misses and plain values get a release doing nothing.
+	_, release, ok = c.GetRef(1)
+	require.False(t, ok)
+	release()
+	require.True(t, c.Set(2, "two", 1))
+	c.Wait()
+	val, release, ok = c.GetRef(2)
+	require.True(t, ok)
+	require.Equal(t, "two", val)
+	release()
+
+	// Replacing a value releases the old one.
+	v = NewRefValue("three", func(value interface{}) { freed = append(freed, value) })
+	require.True(t, c.Set(3, v, 1))
+	c.Wait()
+	require.True(t, c.Set(3, "four", 1))
+	c.Wait()
+	require.Equal(t, []interface{}{"one", "three"}, freed)
+}
+
+// refBuf is a value freed by the cache in TestCacheRefCountedEviction.
+type refBuf struct {
+	freed   int32
+	evicted int32
+}
+
+func TestCacheRefCountedEviction(t *testing.T) {
+	const keys = 200
+	var violations, frees int32
+	c, err := NewCache(&Config{
+		NumCounters:        keys * 10,
+		MaxCost:            keys / 4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		BlockingSets:       true,
+		Metrics:            true,
+		OnEvict: func(item *Item) {
+			buf := item.Value.(*RefValue).Value.(*refBuf)
+			// The value is evicted before being freed, never after.
+			if atomic.LoadInt32(&buf.freed) != 0 {
+				atomic.AddInt32(&violations, 1)
+			}
+			atomic.AddInt32(&buf.evicted, 1)
+		},
+	})
+	require.NoError(t, err)
+
+	var (
+		mu     sync.Mutex
+		values []*RefValue
+	)
+	free := func(value interface{}) {
+		if !atomic.CompareAndSwapInt32(&value.(*refBuf).freed, 0, 1) {
+			atomic.AddInt32(&violations, 1)
+		}
+		atomic.AddInt32(&frees, 1)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				v := NewRefValue(&refBuf{}, free)
+				mu.Lock()
+				values = append(values, v)
+				mu.Unlock()
+				if !c.Set((g*2000+i)%keys, v, 1) {
+					v.Release()
+				}
+			}
+		}(g)
+	}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 4000; i++ {
+				val, release, ok := c.GetRef((g + i) % keys)
+				if !ok {
+					continue
+				}
+				buf := val.(*RefValue).Value.(*refBuf)
+				for j := 0; j < 2; j++ {
+					if atomic.LoadInt32(&buf.freed) != 0 {
+						atomic.AddInt32(&violations, 1)
+					}
+					runtime.Gosched()
+				}
+				release()
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+	require.NotZero(t, c.Metrics.KeysEvicted())
+	c.Close()
+
+	// Every value was freed exactly once, after its last reader.
+	require.Zero(t, atomic.LoadInt32(&violations))
+	require.Equal(t, int32(len(values)), atomic.LoadInt32(&frees))
+	for _, v := range values {
+		require.Zero(t, v.Refs())
+		require.Equal(t, int32(1), v.Value.(*refBuf).freed)
+	}
+}
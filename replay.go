@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ReplayResult is the outcome of replaying a trace against a cache.
+type ReplayResult struct {
+	// Name identifies the configuration the trace was replayed against.
+	Name      string
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Duration is the time it took to replay the whole trace.
+	Duration time.Duration
+}
+
+// HitRatio returns the share of the Gets that were hits.
+func (r *ReplayResult) HitRatio() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Hits) / float64(r.Hits+r.Misses)
+}
+
+// Replay replays keys against a new cache created from config: each key is
+// looked up with Get and, if it's missing, Set with a cost of 1. Each Set is
+// waited for, so that the results don't depend on timing. Metrics are always
+// collected, whatever config says. Use the ReadAll function of the sim package
+// to read keys from a trace file.
+func Replay(name string, config *Config, keys []uint64) (*ReplayResult, error) {
+	c, err := newReplayCache(config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return replay(name, c, keys), nil
+}
+
+// newReplayCache creates the cache keys are replayed against, from config
+// with Metrics set.
+func newReplayCache(config *Config) (*Cache, error) {
+	cfg := *config
+	cfg.Metrics = true
+	return NewCache(&cfg)
+}
+
+func replay(name string, c *Cache, keys []uint64) *ReplayResult {
+	start := time.Now()
+	for _, key := range keys {
+		if _, ok := c.Get(key); ok {
+			continue
+		}
+		c.Set(key, nil, 1)
+		c.Wait()
+	}
+	return &ReplayResult{
+		Name:      name,
+		Hits:      c.Metrics.Hits(),
+		Misses:    c.Metrics.Misses(),
+		Evictions: c.Metrics.KeysEvicted(),
+		Duration:  time.Since(start),
+	}
+}
+
+// ComparePolicies replays keys against one cache per policy, all created from
+// config with Config.Policy replaced, and returns the results sorted by name.
+// A nil policy stands for the default one.
+func ComparePolicies(config *Config, policies map[string]func(numCounters,
+	maxCost int64) Policy, keys []uint64) ([]*ReplayResult, error) {
+	results := make([]*ReplayResult, 0, len(policies))
+	for name, policy := range policies {
+		cfg := *config
+		cfg.Policy = policy
+		result, err := Replay(name, &cfg, keys)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// WriteReplayResults writes results to w as an aligned table.
+func WriteReplayResults(w io.Writer, results []*ReplayResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "name\thit ratio\thits\tmisses\tevictions\tduration")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%.4f\t%d\t%d\t%d\t%v\n", r.Name, r.HitRatio(), r.Hits,
+			r.Misses, r.Evictions, r.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,110 @@
+package ristretto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/sim"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplay(t *testing.T) {
+	keys, err := sim.ReadAll(sim.NewReader(sim.ParseLIRS,
+		strings.NewReader("1\n2\n1\n3\n1\n2\n")))
+	require.NoError(t, err)
+	result, err := Replay("default", &Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}, keys)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), result.Hits)
+	require.Equal(t, uint64(3), result.Misses)
+	require.Zero(t, result.Evictions)
+	require.Equal(t, 0.5, result.HitRatio())
+
+	_, err = Replay("broken", &Config{}, keys)
+	require.Error(t, err)
+}
+
+func TestComparePolicies(t *testing.T) {
+	keys := scanTrace(50, 100, 50)
+	results, err := ComparePolicies(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	}, map[string]func(int64, int64) Policy{
+		"slru":    NewSLRUPolicy,
+		"lru":     NewSLRUPolicyWithRatio(1),
+		"default": nil,
+	}, keys)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Equal(t, "default", results[0].Name)
+	require.Equal(t, "lru", results[1].Name)
+	require.Equal(t, "slru", results[2].Name)
+	for _, r := range results {
+		require.Equal(t, uint64(len(keys)), r.Hits+r.Misses)
+		require.NotZero(t, r.Evictions)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteReplayResults(&buf, results))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[0], "name"))
+	require.True(t, strings.HasPrefix(lines[3], "slru"))
+}
+
+// seededDecisions replays keys against a synchronous cache with the given
+// seed, deleting some of them, and returns the events of the decisions made.
+func seededDecisions(t *testing.T, seed int64, keys []uint64) []Event {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            50,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Synchronous:        true,
+		Seed:               seed,
+		Metrics:            true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	ch, unsubscribe := c.Subscribe(len(keys) * 3)
+	for n, key := range keys {
+		if _, ok := c.Get(key); !ok {
+			c.Set(key, nil, 1)
+		}
+		if n%7 == 0 {
+			c.Del(key / 2)
+		}
+	}
+	unsubscribe()
+	var events []Event
+	for e := range ch {
+		e.Time = time.Time{}
+		events = append(events, e)
+	}
+	require.Zero(t, c.Metrics.EventsDropped())
+	return events
+}
+
+func TestReplaySeed(t *testing.T) {
+	keys := scanTrace(50, 100, 50)
+	first := seededDecisions(t, 1, keys)
+	require.NotEmpty(t, first)
+	var evictions int
+	for _, e := range first {
+		if e.Type == EventEvict {
+			evictions++
+		}
+	}
+	require.NotZero(t, evictions)
+	// The same seed makes the same decisions, and another one doesn't.
+	require.Equal(t, first, seededDecisions(t, 1, keys))
+	require.NotEqual(t, first, seededDecisions(t, 2, keys))
+}
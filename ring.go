@@ -17,20 +17,166 @@
 package ristretto
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// BufferMode determines what the Get buffers do with access records when the
+// policy is too busy to take them.
+type BufferMode int
+
+const (
+	// BufferLossy drops the access records the policy can't take. This is the
+	// default and the fastest mode, as a few lost records barely affect hit
+	// ratios.
+	BufferLossy BufferMode = iota
+	// BufferLossless keeps the access records the policy couldn't take and
+	// hands them over again with the next batch, so the policy eventually sees
+	// every Get. The buffers may grow while the policy is busy.
+	BufferLossless
+	// BufferBlocking makes a Get whose stripe is full wait for the policy to
+	// take the batch, up to Config.BufferTimeout, so the policy sees every Get
+	// without the buffers growing. Past the timeout, the batch is kept like
+	// with BufferLossless. Gets get slower when the policy falls behind.
+	BufferBlocking
 )
 
 // ringConsumer is the user-defined object responsible for receiving and
-// processing items in batches when buffers are drained.
+// processing items in batches when buffers are drained. A consumer that takes
+// a batch, by returning true, owns it.
 type ringConsumer interface {
 	Push([]uint64) bool
 }
 
+// keyConsumer adapts a function taking one key at a time to the batches of a
+// ring buffer.
+type keyConsumer func(key uint64)
+
+func (f keyConsumer) Push(keys []uint64) bool {
+	for _, key := range keys {
+		f(key)
+	}
+	return true
+}
+
+// waitConsumer is a consumer that can also wait for room to take a batch.
+type waitConsumer interface {
+	ringConsumer
+	// PushWait works like Push, but waits up to timeout for the batch to be
+	// taken, or for as long as it takes if timeout is 0. The batches are
+	// taken by another goroutine, which must never Push itself.
+	PushWait(items []uint64, timeout time.Duration) bool
+}
+
+// waitingConsumer hands the batches of a blocking buffer over to PushWait.
+type waitingConsumer struct {
+	cons    waitConsumer
+	timeout time.Duration
+}
+
+func (w waitingConsumer) Push(items []uint64) bool {
+	return w.cons.PushWait(items, w.timeout)
+}
+
+// batchRecycler is implemented by the consumers that hand the batches they're
+// done with back to the buffer, so that stripes don't allocate a new batch
+// every time they're drained. The buffer calls setRecycle once, with the
+// function taking the batches back; a consumer must not touch a batch after
+// passing it on.
+type batchRecycler interface {
+	setRecycle(func([]uint64))
+}
+
+// batchPool holds the batches given back by the consumer for the stripes to
+// reuse. It's a buffered channel rather than a sync.Pool, as putting a slice in
+// an interface would allocate.
+type batchPool struct {
+	free chan []uint64
+	capa int
+}
+
+func newBatchPool(capa int64) *batchPool {
+	return &batchPool{
+		// A batch is being filled by every stripe, and a few more are waiting
+		// for the consumer.
+		free: make(chan []uint64, runtime.GOMAXPROCS(0)+4),
+		capa: int(capa),
+	}
+}
+
+// get returns an empty batch, reusing one if there's any.
+func (p *batchPool) get() []uint64 {
+	if p != nil {
+		select {
+		case batch := <-p.free:
+			return batch[:0]
+		default:
+		}
+	}
+	return make([]uint64, 0, p.size())
+}
+
+func (p *batchPool) size() int {
+	if p == nil {
+		return 0
+	}
+	return p.capa
+}
+
+// put keeps a batch for reuse, unless there are enough already or it has grown
+// past the size of the stripes.
+func (p *batchPool) put(batch []uint64) {
+	if cap(batch) != p.capa {
+		return
+	}
+	select {
+	case p.free <- batch:
+	default:
+	}
+}
+
+// bufferCounters counts what became of the elements of a buffer. The stripes
+// only update them when they're drained or drop their elements, so that Pushes
+// don't write to shared memory.
+type bufferCounters struct {
+	// drained is the number of elements handed to the consumer, in drains
+	// batches.
+	drained uint64
+	drains  uint64
+	dropped uint64
+}
+
+func (c *bufferCounters) drain(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.drained, uint64(n))
+		atomic.AddUint64(&c.drains, 1)
+	}
+}
+
+func (c *bufferCounters) drop(n int) {
+	if c != nil {
+		atomic.AddUint64(&c.dropped, uint64(n))
+	}
+}
+
 // ringStripe is a singular ring buffer that is not concurrent safe.
 type ringStripe struct {
-	cons ringConsumer
-	data []uint64
-	capa int
+	// fill is the number of elements held by a lossless stripe, kept
+	// atomically for Stats, which doesn't take the locks of the stripes.
+	fill     int64
+	counters *bufferCounters
+	cons     ringConsumer
+	data     []uint64
+	capa     int
+	lossless bool
+	// batches, if set, provides the batch filled after one is handed over.
+	batches *batchPool
+	// onDrop, if set, is called with the elements a lossy stripe drops.
+	onDrop func([]uint64)
 }
 
 func newRingStripe(cons ringConsumer, capa int64) *ringStripe {
@@ -48,11 +194,25 @@ func (s *ringStripe) Push(item uint64) {
 	// Decide if the ring buffer should be drained.
 	if len(s.data) >= s.capa {
 		// Send elements to consumer and create a new ring stripe.
-		if s.cons.Push(s.data) {
-			s.data = make([]uint64, 0, s.capa)
-		} else {
+		if n := len(s.data); s.cons.Push(s.data) {
+			s.counters.drain(n)
+			if s.batches != nil {
+				s.data = s.batches.get()
+			} else {
+				s.data = make([]uint64, 0, s.capa)
+			}
+		} else if !s.lossless {
+			s.counters.drop(len(s.data))
+			if s.onDrop != nil {
+				s.onDrop(s.data)
+			}
 			s.data = s.data[:0]
 		}
+		// Lossless stripes keep the refused elements and offer them to the
+		// consumer again on the next Push.
+	}
+	if s.lossless {
+		atomic.StoreInt64(&s.fill, int64(len(s.data)))
 	}
 }
 
@@ -62,7 +222,30 @@ func (s *ringStripe) Push(item uint64) {
 // This implements the "batching" process described in the BP-Wrapper paper
 // (section III part A).
 type ringBuffer struct {
-	pool *sync.Pool
+	// counters comes first to be 64-bit aligned.
+	counters bufferCounters
+	pool     *sync.Pool
+	// stripes are used instead of pool by lossless buffers, because sync.Pool
+	// may drop stripes (and the elements they hold) during garbage collection.
+	stripes []lockedStripe
+	// onDrop, if set, is called with the elements dropped whenever the
+	// consumer refuses a batch of a lossy buffer. Nothing is done on the
+	// success path, so it adds no cost to Pushes that aren't dropped. The
+	// slice is reused by the stripe and must not be retained.
+	onDrop func([]uint64)
+	// batches holds the batches the consumer is done with, if it gives them
+	// back.
+	batches *batchPool
+	// capa is the number of elements a stripe holds before it's drained.
+	capa int
+}
+
+type lockedStripe struct {
+	sync.Mutex
+	*ringStripe
+	// Pad each stripe to a full cache line so that stripes used by different
+	// processors don't share one.
+	_ [cacheLineSize - 16]byte
 }
 
 // newRingBuffer returns a striped ring buffer. The Consumer in ringConfig will
@@ -74,18 +257,206 @@ func newRingBuffer(cons ringConsumer, capa int64) *ringBuffer {
 	// percentage of elements lost. The performance primarily comes from
 	// low-level runtime functions used in the standard library that aren't
 	// available to us (such as runtime_procPin()).
-	return &ringBuffer{
-		pool: &sync.Pool{
-			New: func() interface{} { return newRingStripe(cons, capa) },
+	b := &ringBuffer{batches: recycleBatches(cons, capa), capa: int(capa)}
+	b.pool = &sync.Pool{
+		New: func() interface{} {
+			s := newRingStripe(cons, capa)
+			s.onDrop = b.drop
+			s.batches = b.batches
+			s.counters = &b.counters
+			return s
 		},
 	}
+	return b
+}
+
+// recycleBatches returns the pool of batches shared by the stripes of a
+// buffer, if cons gives them back.
+func recycleBatches(cons ringConsumer, capa int64) *batchPool {
+	r, ok := cons.(batchRecycler)
+	if !ok {
+		return nil
+	}
+	p := newBatchPool(capa)
+	r.setRecycle(p.put)
+	return p
+}
+
+func (b *ringBuffer) drop(items []uint64) {
+	if b.onDrop != nil {
+		b.onDrop(items)
+	}
+}
+
+// newLosslessRingBuffer returns a striped ring buffer that never drops
+// elements. Each Push is routed to one of a fixed set of locked stripes, which
+// makes it slower than the sync.Pool based lossy buffer. If numStripes isn't
+// positive, one stripe per GOMAXPROCS is used.
+func newLosslessRingBuffer(cons ringConsumer, capa int64, numStripes int) *ringBuffer {
+	if numStripes <= 0 {
+		numStripes = runtime.GOMAXPROCS(0)
+	}
+	b := &ringBuffer{
+		stripes: make([]lockedStripe, numStripes),
+		batches: recycleBatches(cons, capa),
+		capa:    int(capa),
+	}
+	for i := range b.stripes {
+		b.stripes[i].ringStripe = newRingStripe(cons, capa)
+		b.stripes[i].lossless = true
+		b.stripes[i].batches = b.batches
+		b.stripes[i].counters = &b.counters
+	}
+	return b
+}
+
+// newBlockingRingBuffer returns a lossless buffer whose Pushes wait up to
+// timeout for the consumer to take a full stripe, see BufferBlocking. The
+// stripe stays locked meanwhile, so the other Pushes to it wait as well.
+func newBlockingRingBuffer(cons waitConsumer, capa int64, numStripes int,
+	timeout time.Duration) *ringBuffer {
+	b := newLosslessRingBuffer(waitingConsumer{cons: cons, timeout: timeout}, capa, numStripes)
+	b.batches = recycleBatches(cons, capa)
+	for i := range b.stripes {
+		b.stripes[i].batches = b.batches
+	}
+	return b
 }
 
 // Push adds an element to one of the internal stripes and possibly drains if
 // the stripe becomes full.
 func (b *ringBuffer) Push(item uint64) {
+	if b.stripes != nil {
+		stripe := b.nextStripe()
+		stripe.Push(item)
+		stripe.Unlock()
+		return
+	}
 	// Reuse or create a new stripe.
 	stripe := b.pool.Get().(*ringStripe)
 	stripe.Push(item)
 	b.pool.Put(stripe)
 }
+
+// nextStripe returns a random lossless stripe, locked. The stripe is picked
+// with the runtime's per-thread random source rather than a shared counter, so
+// concurrent Pushes from different processors don't contend on anything but
+// the (rare) collisions on the same stripe.
+func (b *ringBuffer) nextStripe() *lockedStripe {
+	stripe := &b.stripes[z.FastRand()%uint32(len(b.stripes))]
+	stripe.Lock()
+	return stripe
+}
+
+// PushMulti adds several elements to a single stripe, so the stripe only has to
+// be acquired once for the whole batch.
+func (b *ringBuffer) PushMulti(items []uint64) {
+	if b.stripes != nil {
+		stripe := b.nextStripe()
+		for _, item := range items {
+			stripe.Push(item)
+		}
+		stripe.Unlock()
+		return
+	}
+	stripe := b.pool.Get().(*ringStripe)
+	for _, item := range items {
+		stripe.Push(item)
+	}
+	b.pool.Put(stripe)
+}
+
+// Flush takes the elements held by the stripes and returns them, without
+// handing them to the consumer. Lossless stripes are all emptied. The stripes
+// of a lossy buffer can't be enumerated, so only the ones that can be taken
+// from the pool are, which is all of them unless other goroutines are using
+// them.
+func (b *ringBuffer) Flush() []uint64 {
+	var items []uint64
+	// The elements flushed are handed to the consumer by the caller.
+	defer func() { b.counters.drain(len(items)) }()
+	if b.stripes != nil {
+		for i := range b.stripes {
+			stripe := &b.stripes[i]
+			stripe.Lock()
+			items = append(items, stripe.data...)
+			stripe.data = stripe.data[:0]
+			atomic.StoreInt64(&stripe.fill, 0)
+			stripe.Unlock()
+		}
+		return items
+	}
+	// Hold on to the stripes taken, or Get would keep returning the same one.
+	taken := make([]*ringStripe, runtime.GOMAXPROCS(0))
+	for i := range taken {
+		taken[i] = b.pool.Get().(*ringStripe)
+		items = append(items, taken[i].data...)
+		taken[i].data = taken[i].data[:0]
+	}
+	for _, stripe := range taken {
+		b.pool.Put(stripe)
+	}
+	return items
+}
+
+// BufferStats is a snapshot of the Get buffer of a cache, where Gets record
+// their keys until a stripe is full and its batch is handed to the policy. See
+// Cache.BufferStats.
+type BufferStats struct {
+	// Stripes holds the number of keys held by each stripe. A stripe is
+	// drained once it holds StripeSize keys; a lossless or blocking one whose
+	// batch the policy couldn't take keeps growing past it. Lossy buffers
+	// keep their stripes in a sync.Pool, which can't be enumerated, so
+	// Stripes is nil for them.
+	Stripes    []int
+	StripeSize int
+	// Pushes is the number of keys pushed. For lossy buffers, keys are only
+	// counted once their stripe is drained or drops them, and the ones held
+	// by stripes dropped by the garbage collector never are.
+	Pushes uint64
+	// Drains is the number of batches handed to the policy, and Drained the
+	// number of keys in them.
+	Drains  uint64
+	Drained uint64
+	// Drops is the number of keys dropped by lossy stripes, as the policy
+	// was too busy to take them.
+	Drops uint64
+}
+
+// fill returns the number of keys held by the stripes.
+func (s BufferStats) fill() int {
+	n := 0
+	for _, fill := range s.Stripes {
+		n += fill
+	}
+	return n
+}
+
+// stats reads the counters and the fill of the stripes atomically, without
+// locking them, so the values may be slightly stale.
+func (b *ringBuffer) stats() BufferStats {
+	s := BufferStats{
+		StripeSize: b.capa,
+		Drained:    atomic.LoadUint64(&b.counters.drained),
+		Drains:     atomic.LoadUint64(&b.counters.drains),
+		Drops:      atomic.LoadUint64(&b.counters.dropped),
+	}
+	s.Pushes = s.Drained + s.Drops
+	if b.stripes != nil {
+		s.Stripes = make([]int, len(b.stripes))
+		for i := range b.stripes {
+			s.Stripes[i] = int(atomic.LoadInt64(&b.stripes[i].fill))
+			s.Pushes += uint64(s.Stripes[i])
+		}
+	}
+	return s
+}
+
+// BufferStats returns how full the stripes of the Get buffer are, and how many
+// keys went through it, to tune BufferItems and BufferStripes.
+func (c *Cache) BufferStats() BufferStats {
+	if c == nil || c.isClosed() {
+		return BufferStats{}
+	}
+	return c.getBuf.stats()
+}
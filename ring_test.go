@@ -1,8 +1,12 @@
 package ristretto
 
 import (
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/require"
 )
@@ -48,6 +52,41 @@ func TestRingReset(t *testing.T) {
 	require.Equal(t, 0, drains, "testConsumer shouldn't be draining")
 }
 
+func TestRingDrop(t *testing.T) {
+	dropped := 0
+	r := newRingBuffer(&testConsumer{save: false}, 4)
+	r.onDrop = func(items []uint64) {
+		require.Len(t, items, 4)
+		dropped += len(items)
+	}
+	for i := 0; i < 100; i++ {
+		r.Push(uint64(i))
+	}
+	// Stripes lost by the pool take their elements with them without ever
+	// offering them to the consumer, so only whole batches are counted.
+	require.NotZero(t, dropped)
+	require.True(t, dropped <= 100)
+	require.Zero(t, dropped%4)
+}
+
+func TestRingFlush(t *testing.T) {
+	r := newLosslessRingBuffer(&testConsumer{save: true}, 64, 4)
+	for i := 0; i < 10; i++ {
+		r.Push(uint64(i))
+	}
+	require.ElementsMatch(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, r.Flush())
+	require.Empty(t, r.Flush())
+
+	// The pool may lose stripes, so a lossy buffer can't promise to return
+	// everything.
+	r = newRingBuffer(&testConsumer{save: true}, 64)
+	for i := 0; i < 10; i++ {
+		r.Push(uint64(i))
+	}
+	require.True(t, len(r.Flush()) <= 10)
+	require.Empty(t, r.Flush())
+}
+
 func TestRingConsumer(t *testing.T) {
 	mu := &sync.Mutex{}
 	drainItems := make(map[uint64]struct{})
@@ -68,3 +107,379 @@ func TestRingConsumer(t *testing.T) {
 	require.NotEqual(t, 0, l)
 	require.True(t, l <= 100)
 }
+
+func TestRingPushMulti(t *testing.T) {
+	drained := 0
+	r := newRingBuffer(&testConsumer{
+		push: func(items []uint64) {
+			drained += len(items)
+		},
+		save: true,
+	}, 4)
+	r.PushMulti([]uint64{1, 2, 3, 4, 5, 6, 7, 8})
+	require.Equal(t, 8, drained)
+}
+
+func TestRingLossless(t *testing.T) {
+	mu := &sync.Mutex{}
+	drained := 0
+	accept := false
+	cons := &testConsumer{
+		push: func(items []uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			drained += len(items)
+		},
+		save: true,
+	}
+	r := newLosslessRingBuffer(consumerFunc(func(items []uint64) bool {
+		// Refuse every other batch, which a lossy buffer would drop.
+		mu.Lock()
+		accept = !accept
+		refuse := !accept
+		mu.Unlock()
+		if refuse {
+			return false
+		}
+		return cons.Push(items)
+	}), 4, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.Push(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	// Collect whatever is still buffered in the stripes.
+	leftover := 0
+	for i := range r.stripes {
+		leftover += len(r.stripes[i].data)
+	}
+	require.Equal(t, 4000, drained+leftover)
+}
+
+func TestRingStats(t *testing.T) {
+	// A consumer taking nothing keeps the keys in lossless stripes.
+	r := newLosslessRingBuffer(&testConsumer{save: false}, 4, 4)
+	for i := 0; i < 30; i++ {
+		r.Push(uint64(i))
+	}
+	r.PushMulti([]uint64{1, 2, 3})
+	stats := r.stats()
+	require.Len(t, stats.Stripes, 4)
+	require.Equal(t, 4, stats.StripeSize)
+	require.Equal(t, 33, stats.fill())
+	require.Equal(t, BufferStats{Stripes: stats.Stripes, StripeSize: 4, Pushes: 33}, stats)
+	r.Flush()
+	require.Equal(t, BufferStats{Stripes: []int{0, 0, 0, 0}, StripeSize: 4, Pushes: 33,
+		Drains: 1, Drained: 33}, r.stats())
+
+	// One that takes everything drains every full stripe.
+	r = newLosslessRingBuffer(&testConsumer{push: func([]uint64) {}, save: true}, 4, 4)
+	for i := 0; i < 30; i++ {
+		r.Push(uint64(i))
+	}
+	stats = r.stats()
+	require.Equal(t, uint64(30), stats.Pushes)
+	require.Equal(t, stats.Drained, 4*stats.Drains)
+	require.Equal(t, 30, int(stats.Drained)+stats.fill())
+
+	// Lossy stripes count the keys they drop.
+	r = newRingBuffer(&testConsumer{save: false}, 4)
+	for i := 0; i < 32; i++ {
+		r.Push(uint64(i))
+	}
+	stats = r.stats()
+	require.Nil(t, stats.Stripes)
+	require.Zero(t, stats.Drains)
+	require.Equal(t, stats.Drops, stats.Pushes)
+	require.True(t, stats.Drops <= 32 && stats.Drops%4 == 0, "dropped %d", stats.Drops)
+}
+
+func TestCacheBufferStats(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:   100,
+		MaxCost:       10,
+		BufferItems:   64,
+		BufferMode:    BufferLossless,
+		BufferStripes: 2,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		c.Get(i)
+	}
+	stats := c.BufferStats()
+	require.Equal(t, uint64(1000), stats.Pushes)
+	require.Len(t, stats.Stripes, 2)
+	require.Equal(t, 1000, int(stats.Drained)+stats.fill())
+	c.Close()
+	require.Equal(t, BufferStats{}, c.BufferStats())
+}
+
+func TestRingStripeSize(t *testing.T) {
+	require.Equal(t, uintptr(cacheLineSize), unsafe.Sizeof(lockedStripe{}))
+}
+
+func TestRingStripes(t *testing.T) {
+	mu := &sync.Mutex{}
+	batches := 0
+	r := newLosslessRingBuffer(consumerFunc(func(items []uint64) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, items, 8)
+		batches++
+		return true
+	}), 8, 3)
+	require.Len(t, r.stripes, 3)
+	for i := 0; i < 100; i++ {
+		r.Push(uint64(i))
+	}
+	// Every stripe holds less than a full batch, and nothing was lost.
+	leftover := 0
+	for i := range r.stripes {
+		require.Less(t, len(r.stripes[i].data), 8)
+		leftover += len(r.stripes[i].data)
+	}
+	require.Equal(t, 100, batches*8+leftover)
+}
+
+// slowConsumer takes one batch at a time, through a channel drained by a
+// goroutine taking its time with every batch, like the policy.
+type slowConsumer struct {
+	ch      chan []uint64
+	done    chan struct{}
+	drained int64
+}
+
+func newSlowConsumer(delay time.Duration) *slowConsumer {
+	c := &slowConsumer{ch: make(chan []uint64, 1), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case items := <-c.ch:
+				time.Sleep(delay)
+				atomic.AddInt64(&c.drained, int64(len(items)))
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *slowConsumer) Push(items []uint64) bool {
+	select {
+	case c.ch <- items:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *slowConsumer) PushWait(items []uint64, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case c.ch <- items:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+func TestRingBlocking(t *testing.T) {
+	cons := newSlowConsumer(time.Millisecond)
+	defer close(cons.done)
+	r := newBlockingRingBuffer(cons, 16, 2, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				r.Push(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	// The stripes never held more than a batch, and nothing was lost.
+	leftover := 0
+	for i := range r.stripes {
+		require.True(t, len(r.stripes[i].data) < 16)
+		require.Equal(t, 16, cap(r.stripes[i].data))
+		leftover += len(r.stripes[i].data)
+	}
+	for start := time.Now(); atomic.LoadInt64(&cons.drained)+int64(leftover) < 16*200; time.Sleep(time.Millisecond) {
+		require.True(t, time.Since(start) < time.Second, "the consumer lost records")
+	}
+	require.Equal(t, int64(16*200-leftover), atomic.LoadInt64(&cons.drained))
+}
+
+func TestRingBlockingTimeout(t *testing.T) {
+	// A consumer that never takes anything only holds the Pushes up for the
+	// timeout, after which the records are kept like in a lossless buffer.
+	cons := &slowConsumer{ch: make(chan []uint64)}
+	r := newBlockingRingBuffer(cons, 4, 1, time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		r.Push(uint64(i))
+	}
+	require.True(t, time.Since(start) >= 5*time.Millisecond)
+	require.Len(t, r.Flush(), 8)
+}
+
+type consumerFunc func([]uint64) bool
+
+func (f consumerFunc) Push(items []uint64) bool {
+	return f(items)
+}
+
+// recyclingConsumer hands the batches it's pushed back to the buffer, once it
+// has copied them, unless keep is set.
+type recyclingConsumer struct {
+	mu      sync.Mutex
+	recycle func([]uint64)
+	keep    bool
+	batches [][]uint64
+	copies  [][]uint64
+}
+
+func (c *recyclingConsumer) setRecycle(recycle func([]uint64)) {
+	c.recycle = recycle
+}
+
+func (c *recyclingConsumer) Push(items []uint64) bool {
+	c.mu.Lock()
+	c.batches = append(c.batches, items)
+	c.copies = append(c.copies, append([]uint64(nil), items...))
+	c.mu.Unlock()
+	if !c.keep {
+		c.recycle(items)
+	}
+	return true
+}
+
+func TestRingRecycle(t *testing.T) {
+	cons := &recyclingConsumer{}
+	r := newLosslessRingBuffer(cons, 4, 2)
+	require.NotNil(t, cons.recycle)
+	for i := 0; i < 100; i++ {
+		r.Push(uint64(i))
+	}
+	seen := make([]uint64, 0, 100)
+	for _, batch := range cons.copies {
+		seen = append(seen, batch...)
+	}
+	seen = append(seen, r.Flush()...)
+	require.Len(t, seen, 100)
+	for i := 0; i < 100; i++ {
+		require.Contains(t, seen, uint64(i))
+	}
+	// The batches were reused, so the ones the consumer held on to have been
+	// written over since.
+	distinct := make(map[*uint64]struct{})
+	for _, batch := range cons.batches {
+		distinct[&batch[:1][0]] = struct{}{}
+	}
+	require.Less(t, len(distinct), len(cons.batches))
+}
+
+func TestRingRecycleMisbehaving(t *testing.T) {
+	// A consumer that keeps its batches without giving them back isn't
+	// affected by the reuse of the others.
+	cons := &recyclingConsumer{keep: true}
+	r := newRingBuffer(cons, 4)
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.Push(uint64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	require.NotEmpty(t, cons.batches)
+	for i, batch := range cons.batches {
+		require.Equal(t, cons.copies[i], batch)
+	}
+
+	// Batches given back after growing, or that the buffer doesn't know, are
+	// left alone.
+	p := newBatchPool(4)
+	grown := append(make([]uint64, 4, 4), 1)
+	p.put(grown)
+	p.put(make([]uint64, 0, 2))
+	require.Len(t, p.free, 0)
+	p.put(make([]uint64, 3, 4))
+	require.Len(t, p.get(), 0)
+	require.Equal(t, 4, cap(p.get()))
+}
+
+func BenchmarkRingBuffer(b *testing.B) {
+	cons := consumerFunc(func(items []uint64) bool { return true })
+	for _, bench := range []struct {
+		name string
+		buf  *ringBuffer
+	}{
+		{"lossy", newRingBuffer(cons, 64)},
+		{"lossless", newLosslessRingBuffer(cons, 64, 0)},
+	} {
+		buf := bench.buf
+		b.Run(bench.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := uint64(0); pb.Next(); i++ {
+					buf.Push(i)
+				}
+			})
+		})
+	}
+}
+
+// recycler is a consumer giving every batch straight back.
+type recycler struct {
+	recycle func([]uint64)
+}
+
+func (r *recycler) setRecycle(recycle func([]uint64)) {
+	r.recycle = recycle
+}
+
+func (r *recycler) Push(items []uint64) bool {
+	r.recycle(items)
+	return true
+}
+
+// BenchmarkRingBufferAllocs reports the allocations of a million Pushes, so of
+// a million Gets, with and without the batches being given back.
+func BenchmarkRingBufferAllocs(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		cons ringConsumer
+	}{
+		{"fresh", consumerFunc(func(items []uint64) bool { return true })},
+		{"recycled", &recycler{}},
+	} {
+		buf := newRingBuffer(bench.cons, 64)
+		b.Run(bench.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := uint64(0); pb.Next(); i++ {
+					buf.Push(i)
+				}
+			})
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)*1e6/float64(b.N), "allocs/1M")
+		})
+	}
+}
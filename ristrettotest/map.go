@@ -0,0 +1,291 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ristrettotest checks implementations of the extension points of
+// ristretto, such as a Map passed as Config.NewMap, against the contract the
+// cache relies on.
+package ristrettotest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// TestMapImplementation runs the conformance tests of the Map contract
+// against the maps returned by newMap, each subtest with a new one: Gets,
+// Sets and Dels of single keys, Len, Range and its early stop, calls into the
+// map from within Range, concurrent use, and a cache over the map. Call it
+// from a test of the implementation:
+//
+//	func TestMyMap(t *testing.T) {
+//		ristrettotest.TestMapImplementation(t, NewMyMap)
+//	}
+func TestMapImplementation(t *testing.T, newMap func() ristretto.Map) {
+	t.Run("Empty", func(t *testing.T) { testMapEmpty(t, newMap()) })
+	t.Run("SetGet", func(t *testing.T) { testMapSetGet(t, newMap()) })
+	t.Run("Del", func(t *testing.T) { testMapDel(t, newMap()) })
+	t.Run("Range", func(t *testing.T) { testMapRange(t, newMap()) })
+	t.Run("RangeReentrant", func(t *testing.T) { testMapRangeReentrant(t, newMap()) })
+	t.Run("Concurrent", func(t *testing.T) { testMapConcurrent(t, newMap()) })
+	t.Run("Cache", func(t *testing.T) { testMapCache(t, newMap) })
+}
+
+// checkMap fails t unless m holds exactly the items of want.
+func checkMap(t *testing.T, m ristretto.Map, want map[uint64]ristretto.MapItem) {
+	t.Helper()
+	if n := m.Len(); n != len(want) {
+		t.Fatalf("Len() = %d, want %d", n, len(want))
+	}
+	for key, item := range want {
+		got, ok := m.Get(key)
+		if !ok || got != item {
+			t.Fatalf("Get(%d) = %+v, %v, want %+v, true", key, got, ok, item)
+		}
+	}
+	seen := make(map[uint64]bool)
+	m.Range(func(item ristretto.MapItem) bool {
+		if seen[item.Key] {
+			t.Fatalf("Range visited key %d twice", item.Key)
+		}
+		seen[item.Key] = true
+		if w, ok := want[item.Key]; !ok || w != item {
+			t.Fatalf("Range visited %+v, want %+v, %v", item, w, ok)
+		}
+		return true
+	})
+	if len(seen) != len(want) {
+		t.Fatalf("Range visited %d items, want %d", len(seen), len(want))
+	}
+}
+
+func testMapEmpty(t *testing.T, m ristretto.Map) {
+	checkMap(t, m, nil)
+	if _, ok := m.Get(0); ok {
+		t.Fatal("Get(0) found an item in an empty map")
+	}
+	// Deleting a missing key is a no-op.
+	m.Del(1)
+	checkMap(t, m, nil)
+}
+
+func testMapSetGet(t *testing.T, m ristretto.Map) {
+	want := make(map[uint64]ristretto.MapItem)
+	for _, item := range []ristretto.MapItem{
+		// Any key is valid, nil values are values too, and values are kept
+		// as is.
+		{Key: 0, Conflict: 0, Value: nil},
+		{Key: 1, Conflict: 11, Value: "one"},
+		{Key: 1 << 63, Conflict: 2, Value: 2, Expiration: 1e9},
+		{Key: ^uint64(0), Conflict: ^uint64(0), Value: new(int), Expiration: -1},
+	} {
+		m.Set(item)
+		want[item.Key] = item
+		checkMap(t, m, want)
+	}
+	// A Set of a key replaces its item, whatever its fields.
+	replaced := ristretto.MapItem{Key: 1, Conflict: 12, Value: "uno", Expiration: 5}
+	m.Set(replaced)
+	want[1] = replaced
+	checkMap(t, m, want)
+}
+
+func testMapDel(t *testing.T, m ristretto.Map) {
+	want := make(map[uint64]ristretto.MapItem)
+	for key := uint64(0); key < 10; key++ {
+		item := ristretto.MapItem{Key: key, Conflict: key + 1, Value: key}
+		m.Set(item)
+		want[key] = item
+	}
+	for key := uint64(0); key < 10; key += 2 {
+		m.Del(key)
+		delete(want, key)
+		checkMap(t, m, want)
+		// Dels are idempotent.
+		m.Del(key)
+		checkMap(t, m, want)
+	}
+	// A deleted key can be set again.
+	item := ristretto.MapItem{Key: 4, Value: "again"}
+	m.Set(item)
+	want[4] = item
+	checkMap(t, m, want)
+}
+
+func testMapRange(t *testing.T, m ristretto.Map) {
+	for key := uint64(0); key < 100; key++ {
+		m.Set(ristretto.MapItem{Key: key, Value: key})
+	}
+	for _, stop := range []int{1, 10, 99} {
+		visited := 0
+		m.Range(func(ristretto.MapItem) bool {
+			visited++
+			return visited < stop
+		})
+		if visited != stop {
+			t.Fatalf("Range went on for %d items after f returned false at %d", visited, stop)
+		}
+	}
+}
+
+func testMapRangeReentrant(t *testing.T, m ristretto.Map) {
+	for key := uint64(0); key < 100; key++ {
+		m.Set(ristretto.MapItem{Key: key, Value: key})
+	}
+	// f may use the map, which mustn't deadlock. Range may or may not visit
+	// the items set meanwhile, but visits the others exactly once.
+	seen := make(map[uint64]int)
+	m.Range(func(item ristretto.MapItem) bool {
+		seen[item.Key]++
+		if item.Key < 100 {
+			if _, ok := m.Get(item.Key); !ok {
+				t.Fatalf("Get(%d) within Range found nothing", item.Key)
+			}
+			m.Del(item.Key)
+			m.Set(ristretto.MapItem{Key: item.Key + 1000, Value: item.Key})
+			m.Len()
+		}
+		return true
+	})
+	for key := uint64(0); key < 100; key++ {
+		if seen[key] != 1 {
+			t.Fatalf("Range visited key %d %d times, want once", key, seen[key])
+		}
+	}
+	want := make(map[uint64]ristretto.MapItem)
+	for key := uint64(0); key < 100; key++ {
+		want[key+1000] = ristretto.MapItem{Key: key + 1000, Value: key}
+	}
+	checkMap(t, m, want)
+}
+
+// testMapConcurrent has goroutines each write their own keys, as the cache
+// serializes the writes to a key, while reading everyone's.
+func testMapConcurrent(t *testing.T, m ristretto.Map) {
+	const (
+		writers = 8
+		keys    = 64
+		ops     = 5000
+	)
+	models := make([]map[uint64]ristretto.MapItem, writers)
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		models[g] = make(map[uint64]ristretto.MapItem)
+		wg.Add(1)
+		go func(g int, model map[uint64]ristretto.MapItem) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < ops; i++ {
+				key := uint64(r.Intn(keys)*writers + g)
+				switch r.Intn(6) {
+				case 0, 1:
+					item := ristretto.MapItem{Key: key, Conflict: key, Value: i}
+					m.Set(item)
+					model[key] = item
+				case 2:
+					m.Del(key)
+					delete(model, key)
+				case 3:
+					m.Len()
+				case 4:
+					var err error
+					m.Range(func(item ristretto.MapItem) bool {
+						if item.Conflict != item.Key {
+							err = fmt.Errorf("Range visited a torn item %+v", item)
+							return false
+						}
+						return r.Intn(8) != 0
+					})
+					if err != nil {
+						errs <- err
+						return
+					}
+				default:
+					got, ok := m.Get(key)
+					want, wantOK := model[key]
+					if ok != wantOK || got != want {
+						errs <- fmt.Errorf("Get(%d) = %+v, %v, want %+v, %v", key, got, ok, want, wantOK)
+						return
+					}
+					// Other goroutines' keys may be anything, but whole.
+					other := uint64(r.Intn(keys * writers))
+					if got, ok := m.Get(other); ok && (got.Key != other || got.Conflict != other) {
+						errs <- fmt.Errorf("Get(%d) returned a torn item %+v", other, got)
+						return
+					}
+				}
+			}
+		}(g, models[g])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	want := make(map[uint64]ristretto.MapItem)
+	for _, model := range models {
+		for key, item := range model {
+			want[key] = item
+		}
+	}
+	checkMap(t, m, want)
+}
+
+// testMapCache runs a cache over a map, to check it holds up the way the cache
+// uses it.
+func testMapCache(t *testing.T, newMap func() ristretto.Map) {
+	c, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters:        1000,
+		MaxCost:            50,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		NewMap:             newMap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		c.Set(i, i, 1)
+	}
+	c.Wait()
+	if n := c.Len(); n != 50 {
+		t.Fatalf("Len() = %d after filling the cache, want 50", n)
+	}
+	found := 0
+	for i := 0; i < 100; i++ {
+		if value, ok := c.Get(i); ok {
+			if value != i {
+				t.Fatalf("Get(%d) = %v", i, value)
+			}
+			found++
+		}
+	}
+	if found != 50 {
+		t.Fatalf("found %d keys, want 50", found)
+	}
+	for i := 0; i < 100; i++ {
+		c.Del(i)
+	}
+	c.Wait()
+	if n := c.Len(); n != 0 {
+		t.Fatalf("Len() = %d after deleting every key, want 0", n)
+	}
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristrettotest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+const (
+	policyNumCounters = 1000
+	policyMaxCost     = 100
+)
+
+// TestPolicyImplementation runs the conformance tests of the Policy contract
+// against the policies returned by newPolicy, each subtest with a new one. It
+// plays the part of the cache, keeping track of the keys admitted and their
+// costs, and throws a fixed and then a random sequence of operations at the
+// policy, checking that:
+//
+//   - Evict only returns keys that are tracked, never the candidate, and
+//     stops tracking them, so that the cost accounted for never goes
+//     negative;
+//   - Evict returns a victim for a candidate of 0 as long as keys are
+//     tracked, as needed to shrink the cache;
+//   - Del is idempotent and Del, Access and Clear never make a key tracked;
+//   - the optional interfaces, PriorityPolicy, StatefulPolicy,
+//     InspectablePolicy and SkippingPolicy, keep to these rules too, when
+//     implemented, EvictSkipping never returning a key skipped and returning
+//     a victim for a candidate of 0 as long as keys that aren't are tracked.
+//
+// Call it from a test of the implementation:
+//
+//	func TestMyPolicy(t *testing.T) {
+//		ristrettotest.TestPolicyImplementation(t, NewMyPolicy)
+//	}
+func TestPolicyImplementation(t *testing.T, newPolicy func(numCounters, maxCost int64) ristretto.Policy) {
+	t.Run("Empty", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		d.shrink()
+		d.p.Del(1)
+		d.access(1, 2, 3)
+		d.shrink()
+	})
+	t.Run("Sequence", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		for key := uint64(1); key <= 200; key++ {
+			d.add(key, 1+int64(key%7))
+			d.access(key, key/2, key+1000)
+		}
+		for key := uint64(1); key <= 200; key += 3 {
+			d.del(key)
+			d.del(key)
+		}
+		for key := uint64(1); key <= 200; key += 5 {
+			d.update(key, 1+int64(key%3))
+		}
+		d.resize(policyMaxCost / 4)
+		d.resize(policyMaxCost)
+		for key := uint64(1000); key < 1100; key++ {
+			d.add(key, 3)
+		}
+		d.clear()
+		d.add(7, 1)
+		d.shrink()
+	})
+	t.Run("Random", func(t *testing.T) {
+		for seed := int64(1); seed <= 4; seed++ {
+			d := newPolicyDriver(t, newPolicy)
+			d.random(seed, 5000)
+		}
+	})
+	t.Run("Priority", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		if _, ok := d.p.(ristretto.PriorityPolicy); !ok {
+			t.Skip("not a PriorityPolicy")
+		}
+		d.random(5, 5000)
+	})
+	t.Run("State", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		p, ok := d.p.(ristretto.StatefulPolicy)
+		if !ok {
+			t.Skip("not a StatefulPolicy")
+		}
+		d.random(6, 2000)
+		var state bytes.Buffer
+		if err := p.SaveState(&state); err != nil {
+			t.Fatalf("SaveState: %v", err)
+		}
+		// The state is loaded before any key is added, and brings none.
+		restored := newPolicyDriver(t, newPolicy)
+		if err := restored.p.(ristretto.StatefulPolicy).LoadState(&state); err != nil {
+			t.Fatalf("LoadState: %v", err)
+		}
+		restored.shrink()
+		restored.random(7, 2000)
+	})
+	t.Run("Inspect", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		if _, ok := d.p.(ristretto.InspectablePolicy); !ok {
+			t.Skip("not an InspectablePolicy")
+		}
+		d.random(8, 2000)
+	})
+	t.Run("Skip", func(t *testing.T) {
+		d := newPolicyDriver(t, newPolicy)
+		if _, ok := d.p.(ristretto.SkippingPolicy); !ok {
+			t.Skip("not a SkippingPolicy")
+		}
+		d.skip = func(key uint64) bool { return key%3 == 0 }
+		d.random(9, 5000)
+	})
+}
+
+// policyDriver stands for the cache in front of a policy.
+type policyDriver struct {
+	t       *testing.T
+	p       ristretto.Policy
+	maxCost int64
+	used    int64
+	costs   map[uint64]int64
+	// skip, if set, is the keys evict passes over, as the cache does with the
+	// pinned ones, evicting them only once no other key is left.
+	skip func(key uint64) bool
+}
+
+func newPolicyDriver(t *testing.T, newPolicy func(numCounters, maxCost int64) ristretto.Policy) *policyDriver {
+	return &policyDriver{
+		t:       t,
+		p:       newPolicy(policyNumCounters, policyMaxCost),
+		maxCost: policyMaxCost,
+		costs:   make(map[uint64]int64),
+	}
+}
+
+// evict asks for a victim to make room for candidate, and checks it.
+func (d *policyDriver) evict(candidate uint64) bool {
+	d.t.Helper()
+	victim, ok := d.evictSkipping(candidate)
+	if !ok {
+		return false
+	}
+	if candidate != 0 && victim == candidate {
+		d.t.Fatalf("Evict(%d) returned the candidate", candidate)
+	}
+	cost, tracked := d.costs[victim]
+	if !tracked {
+		d.t.Fatalf("Evict(%d) returned key %d, which isn't tracked", candidate, victim)
+	}
+	delete(d.costs, victim)
+	d.used -= cost
+	if d.used < 0 {
+		d.t.Fatalf("the cost accounted for went negative: %d", d.used)
+	}
+	return true
+}
+
+// evictSkipping asks for a victim that isn't skipped, if the policy is a
+// SkippingPolicy and d.skip is set, and for any victim if every key tracked is
+// skipped.
+func (d *policyDriver) evictSkipping(candidate uint64) (uint64, bool) {
+	d.t.Helper()
+	p, ok := d.p.(ristretto.SkippingPolicy)
+	if !ok || d.skip == nil {
+		return d.p.Evict(candidate)
+	}
+	victim, ok := p.EvictSkipping(candidate, d.skip)
+	if ok {
+		if d.skip(victim) {
+			d.t.Fatalf("EvictSkipping(%d) returned key %d, which is skipped", candidate, victim)
+		}
+		return victim, true
+	}
+	for key := range d.costs {
+		if candidate == 0 && !d.skip(key) {
+			d.t.Fatalf("EvictSkipping(0) returned no victim with key %d tracked", key)
+		}
+	}
+	return d.p.Evict(candidate)
+}
+
+// add admits key if the policy makes room for it, as the cache does.
+func (d *policyDriver) add(key uint64, cost int64) {
+	d.t.Helper()
+	if _, tracked := d.costs[key]; tracked || key == 0 {
+		return
+	}
+	for d.used+cost > d.maxCost {
+		if !d.evict(key) {
+			return
+		}
+	}
+	d.p.Add(key, cost)
+	d.costs[key] = cost
+	d.used += cost
+}
+
+func (d *policyDriver) update(key uint64, cost int64) {
+	d.t.Helper()
+	old, tracked := d.costs[key]
+	if !tracked {
+		return
+	}
+	d.p.Update(key, cost)
+	d.costs[key] = cost
+	d.used += cost - old
+	// Growing keys make room like a shrinking cache, without evicting the
+	// key itself.
+	for d.used > d.maxCost {
+		victim, ok := d.p.Evict(0)
+		if !ok {
+			d.t.Fatalf("Evict(0) returned no victim with %d keys tracked", len(d.costs))
+		}
+		if victim == key {
+			// The cache would skip it, as the policy still tracks it.
+			d.p.Add(key, cost)
+			return
+		}
+		cost, tracked := d.costs[victim]
+		if !tracked {
+			d.t.Fatalf("Evict(0) returned key %d, which isn't tracked", victim)
+		}
+		delete(d.costs, victim)
+		d.used -= cost
+	}
+}
+
+func (d *policyDriver) del(key uint64) {
+	d.p.Del(key)
+	if cost, tracked := d.costs[key]; tracked {
+		delete(d.costs, key)
+		d.used -= cost
+	}
+}
+
+func (d *policyDriver) access(keys ...uint64) {
+	d.p.Access(keys)
+}
+
+func (d *policyDriver) resize(maxCost int64) {
+	d.t.Helper()
+	d.p.Resize(maxCost)
+	d.maxCost = maxCost
+	for d.used > d.maxCost {
+		if !d.evict(0) {
+			d.t.Fatalf("Evict(0) returned no victim with %d keys tracked", len(d.costs))
+		}
+	}
+}
+
+// shrink evicts every key, as Cache.EvictN would, and checks none is left.
+func (d *policyDriver) shrink() {
+	d.t.Helper()
+	for len(d.costs) > 0 {
+		if !d.evict(0) {
+			d.t.Fatalf("Evict(0) returned no victim with %d keys tracked", len(d.costs))
+		}
+	}
+	d.evict(0)
+}
+
+func (d *policyDriver) clear() {
+	d.p.Clear()
+	d.costs = make(map[uint64]int64)
+	d.used = 0
+}
+
+// random runs n random operations, seeded with seed, over a small set of keys
+// so that they keep coming back.
+func (d *policyDriver) random(seed int64, n int) {
+	d.t.Helper()
+	r := rand.New(rand.NewSource(seed))
+	key := func() uint64 { return 1 + uint64(r.Intn(300)) }
+	priority, _ := d.p.(ristretto.PriorityPolicy)
+	inspect, _ := d.p.(ristretto.InspectablePolicy)
+	for i := 0; i < n; i++ {
+		switch op := r.Intn(100); {
+		case op < 40:
+			d.add(key(), 1+r.Int63n(10))
+		case op < 70:
+			keys := make([]uint64, 1+r.Intn(16))
+			for j := range keys {
+				keys[j] = key()
+			}
+			d.access(keys...)
+		case op < 80:
+			d.del(key())
+		case op < 87:
+			d.update(key(), 1+r.Int63n(10))
+		case op < 90:
+			d.resize(policyMaxCost/2 + r.Int63n(policyMaxCost))
+		case op < 91:
+			d.clear()
+		case op < 96 && priority != nil:
+			if k := key(); d.costs[k] > 0 {
+				priority.SetPriority(k, r.Float64()*10)
+			}
+		case op < 100 && inspect != nil:
+			k := key()
+			var info ristretto.EntryInfo
+			inspect.Inspect(k, &info)
+			if info.HasPosition && (info.Position < 0 || info.Position >= info.Positions) {
+				d.t.Fatalf("Inspect(%d) gave position %d of %d", k, info.Position, info.Positions)
+			}
+		}
+	}
+	d.shrink()
+}
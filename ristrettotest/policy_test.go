@@ -0,0 +1,42 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristrettotest
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+func TestBuiltinPolicies(t *testing.T) {
+	for name, newPolicy := range map[string]func(int64, int64) ristretto.Policy{
+		"lru":        ristretto.NewLRUPolicy,
+		"clock":      ristretto.NewClockPolicy,
+		"slru":       ristretto.NewSLRUPolicy,
+		"2q":         ristretto.NewTwoQueuePolicy,
+		"arc":        ristretto.NewARCPolicy,
+		"lirs":       ristretto.NewLIRSPolicy,
+		"hyperbolic": ristretto.NewHyperbolicPolicy,
+		"wtinylfu":   ristretto.NewWTinyLFUPolicy,
+		"random":     ristretto.NewRandomPolicy(1, 1),
+		"random(.5)": ristretto.NewRandomPolicy(0.5, 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			TestPolicyImplementation(t, newPolicy)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "sync"
+
+// shadowPolicy runs the Config.ShadowPolicy of a cache next to its own policy.
+// It's told about the same accesses, and the same Sets, Dels and expirations,
+// and keeps the keys it would have let in, with their costs, to count the hits
+// it would have had. Its victims are only dropped from those keys, which it
+// holds no more of than fit in the max cost, and no values.
+type shadowPolicy struct {
+	mu         sync.RWMutex
+	policy     Policy
+	keys       map[uint64]int64
+	used       int64
+	maxCost    int64
+	maxEntries int64
+	metrics    *Metrics
+}
+
+func newShadowPolicy(policy Policy, maxCost, maxEntries int64, metrics *Metrics) *shadowPolicy {
+	return &shadowPolicy{
+		policy:     policy,
+		keys:       make(map[uint64]int64),
+		maxCost:    maxCost,
+		maxEntries: maxEntries,
+		metrics:    metrics,
+	}
+}
+
+// lookup counts a Get of the key as a hit or a miss of the shadow.
+func (s *shadowPolicy) lookup(key uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	_, ok := s.keys[key]
+	s.mu.RUnlock()
+	if ok {
+		s.metrics.add(shadowHit, key, 1)
+	} else {
+		s.metrics.add(shadowMiss, key, 1)
+	}
+}
+
+// access passes a batch of accesses on to the shadow.
+func (s *shadowPolicy) access(keys []uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.policy.Access(keys)
+	s.mu.Unlock()
+}
+
+// set admits a key of the given cost, or updates its cost, as the cache would
+// with the shadow as its policy.
+func (s *shadowPolicy) set(key uint64, cost int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; ok {
+		s.updateLocked(key, cost)
+		return
+	}
+	if cost > s.maxCost {
+		return
+	}
+	if !s.makeRoom(key, cost, 1) {
+		return
+	}
+	s.keys[key] = cost
+	s.used += cost
+	s.policy.Add(key, cost)
+}
+
+// update changes the cost of the key, if the shadow has it.
+func (s *shadowPolicy) update(key uint64, cost int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key]; ok {
+		s.updateLocked(key, cost)
+	}
+}
+
+// updateLocked implements update. A costlier key may take the shadow over
+// the max cost, until the next key it admits makes room.
+func (s *shadowPolicy) updateLocked(key uint64, cost int64) {
+	s.used += cost - s.keys[key]
+	s.keys[key] = cost
+	s.policy.Update(key, cost)
+}
+
+// makeRoom evicts the victims of the shadow until keys more keys of the given
+// cost fit, and tells whether they do. A candidate of 0 can't be rejected.
+func (s *shadowPolicy) makeRoom(candidate uint64, cost int64, keys int) bool {
+	ghosts := 0
+	for s.used+cost > s.maxCost ||
+		(s.maxEntries > 0 && int64(len(s.keys)+keys) > s.maxEntries) {
+		victim, ok := s.policy.Evict(candidate)
+		if !ok {
+			return false
+		}
+		victimCost, tracked := s.keys[victim]
+		if !tracked {
+			if ghosts++; ghosts > maxGhostVictims {
+				return false
+			}
+			continue
+		}
+		delete(s.keys, victim)
+		s.used -= victimCost
+	}
+	return true
+}
+
+// del drops a key that left the cache other than by being evicted.
+func (s *shadowPolicy) del(key uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cost, ok := s.keys[key]; ok {
+		delete(s.keys, key)
+		s.used -= cost
+		s.policy.Del(key)
+	}
+}
+
+// resize follows a change of the max cost of the cache.
+func (s *shadowPolicy) resize(maxCost int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxCost = maxCost
+	s.policy.Resize(maxCost)
+	s.makeRoom(0, 0, 0)
+}
+
+func (s *shadowPolicy) clear() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = make(map[uint64]int64)
+	s.used = 0
+	s.policy.Clear()
+}
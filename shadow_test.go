@@ -0,0 +1,148 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newShadowCache(t testing.TB, shadow func(numCounters, maxCost int64) Policy) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		BufferMode:         BufferLossless,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Policy:             NewLRUPolicy,
+		ShadowPolicy:       shadow,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheShadowPolicy(t *testing.T) {
+	c := newShadowCache(t, NewWTinyLFUPolicy)
+	defer c.Close()
+	z := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 2, 1000)
+	for i := 0; i < 20000; i++ {
+		key := z.Uint64()
+		if _, ok := c.GetUint(key); !ok {
+			c.SetUint(key, key, 1)
+		}
+		if i%100 == 0 {
+			c.Wait()
+		}
+	}
+	c.Wait()
+	m := c.Metrics
+	// Every Get is counted by both.
+	require.Equal(t, m.Hits()+m.Misses(), m.ShadowHits()+m.ShadowMisses())
+	require.NotZero(t, m.ShadowHits())
+	require.NotEqual(t, m.Ratio(), m.ShadowRatio())
+
+	samples := scrape(t, c, "")
+	require.Equal(t, m.Ratio(), samples["cache_hit_ratio"])
+	require.Equal(t, m.ShadowRatio(), samples["cache_shadow_hit_ratio"])
+	require.Equal(t, float64(m.ShadowHits()), samples["cache_shadow_hits_total"])
+
+	// The shadow forgets the keys deleted or cleared.
+	c.shadow.mu.RLock()
+	_, ok := c.shadow.keys[1]
+	c.shadow.mu.RUnlock()
+	require.True(t, ok)
+	c.DelUint(1)
+	c.Wait()
+	hits := m.ShadowHits()
+	c.GetUint(1)
+	require.Equal(t, hits, m.ShadowHits())
+	c.Clear()
+	require.Empty(t, c.shadow.keys)
+	require.Zero(t, c.shadow.used)
+}
+
+func TestCacheShadowPolicyBounded(t *testing.T) {
+	// A shadow admitting everything holds as many keys as fit.
+	c := newShadowCache(t, NewClockPolicy)
+	defer c.Close()
+	for i := uint64(0); i < 1000; i++ {
+		c.SetUint(i, i, 1+int64(i%3))
+	}
+	c.Wait()
+	c.shadow.mu.RLock()
+	used, n := c.shadow.used, len(c.shadow.keys)
+	c.shadow.mu.RUnlock()
+	require.LessOrEqual(t, used, int64(100))
+	require.Greater(t, used, int64(90))
+	require.Less(t, n, 100)
+
+	// And follows the max cost down.
+	c.UpdateMaxCost(10)
+	c.shadow.mu.RLock()
+	require.LessOrEqual(t, c.shadow.used, int64(10))
+	c.shadow.mu.RUnlock()
+}
+
+func TestCacheShadowPolicyConfig(t *testing.T) {
+	_, err := NewCache(&Config{
+		NumCounters:  100,
+		MaxCost:      10,
+		BufferItems:  64,
+		ShadowPolicy: NewLRUPolicy,
+	})
+	require.EqualError(t, err, "ShadowPolicy requires Metrics")
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+		ShadowPolicy: func(numCounters, maxCost int64) Policy {
+			return nil
+		},
+	})
+	require.EqualError(t, err, "ShadowPolicy returned a nil Policy")
+}
+
+func BenchmarkCacheShadowPolicy(b *testing.B) {
+	shadows := map[string]func(numCounters, maxCost int64) Policy{
+		"none": nil,
+		"lru":  NewLRUPolicy,
+	}
+	for _, name := range []string{"none", "lru"} {
+		b.Run(fmt.Sprintf("shadow=%s", name), func(b *testing.B) {
+			c := newShadowCache(b, shadows[name])
+			defer c.Close()
+			z := rand.NewZipf(rand.New(rand.NewSource(1)), 1.1, 2, 1000)
+			keys := make([]uint64, 1<<12)
+			for i := range keys {
+				keys[i] = z.Uint64()
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := keys[i&(len(keys)-1)]
+				if _, ok := c.GetUint(key); !ok {
+					c.SetUint(key, key, 1)
+				}
+			}
+		})
+	}
+}
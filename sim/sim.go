@@ -156,6 +156,23 @@ func Collection(simulator Simulator, size uint64) []uint64 {
 	return collection
 }
 
+// ReadAll evaluates the Simulator until it returns ErrDone and returns all the
+// items it returned before that. It's meant for Simulators created with
+// NewReader, as generated ones never run out of items.
+func ReadAll(simulator Simulator) ([]uint64, error) {
+	collection := make([]uint64, 0)
+	for {
+		item, err := simulator()
+		if err == ErrDone {
+			return collection, nil
+		}
+		if err != nil {
+			return collection, err
+		}
+		collection = append(collection, item)
+	}
+}
+
 // StringCollection evaluates the Simulator size times and saves each item to
 // the returned slice, after converting it to a string.
 func StringCollection(simulator Simulator, size uint64) []string {
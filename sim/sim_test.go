@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"compress/gzip"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -81,6 +83,21 @@ func TestReadLIRS(t *testing.T) {
 	}
 }
 
+func TestReadAll(t *testing.T) {
+	s := NewReader(ParseLIRS, strings.NewReader("1\n2\n3\n\n"))
+	keys, err := ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []uint64{1, 2, 3}) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	s = NewReader(ParseLIRS, strings.NewReader("1\nfoo\n"))
+	if _, err = ReadAll(s); err == nil {
+		t.Fatal("bad line should fail")
+	}
+}
+
 func TestParseARC(t *testing.T) {
 	s := NewReader(ParseARC, bytes.NewReader([]byte{
 		'1', '2', '7', ' ', '6', '4', ' ', '0', ' ', '0', '\r', '\n',
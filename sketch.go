@@ -25,14 +25,24 @@
 package ristretto
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
+	"sync/atomic"
 	"time"
 )
 
 // cmSketch is a Count-Min sketch implementation with 4-bit counters, heavily
 // based on Damian Gryski's CM4 [1].
 //
+// The counters are packed in words updated atomically, so that increments and
+// estimates can run concurrently without a lock. An increment racing with a
+// reset or a readFrom may be lost, or counted for another key, but none racing
+// with other increments or estimates is.
+//
 // [1]: https://github.com/dgryski/go-tinylfu/blob/master/cm4.go
 type cmSketch struct {
 	rows [cmDepth]cmRow
@@ -61,18 +71,42 @@ func newCmSketch(numCounters int64) *cmSketch {
 	return sketch
 }
 
+// reseed replaces the seeds of the rows with ones drawn from source, before
+// any key is counted.
+func (s *cmSketch) reseed(source *rand.Rand) {
+	for i := range s.seed {
+		atomic.StoreUint64(&s.seed[i], source.Uint64())
+	}
+}
+
 // Increment increments the count(ers) for the specified key.
 func (s *cmSketch) Increment(hashed uint64) {
 	for i := range s.rows {
-		s.rows[i].increment((hashed ^ s.seed[i]) & s.mask)
+		s.rows[i].increment((hashed ^ atomic.LoadUint64(&s.seed[i])) & s.mask)
+	}
+}
+
+// IncrementBy works like n calls to Increment.
+func (s *cmSketch) IncrementBy(hashed uint64, n int) {
+	if n > 15 {
+		// The counters saturate at 15 anyway.
+		n = 15
+	}
+	for i := range s.rows {
+		s.rows[i].add((hashed^atomic.LoadUint64(&s.seed[i]))&s.mask, uint64(n))
 	}
 }
 
+// counters returns the number of counters in each row.
+func (s *cmSketch) counters() int64 {
+	return int64(s.mask) + 1
+}
+
 // Estimate returns the value of the specified key.
 func (s *cmSketch) Estimate(hashed uint64) int64 {
-	min := byte(255)
+	min := uint64(255)
 	for i := range s.rows {
-		val := s.rows[i].get((hashed ^ s.seed[i]) & s.mask)
+		val := s.rows[i].get((hashed ^ atomic.LoadUint64(&s.seed[i])) & s.mask)
 		if val < min {
 			min = val
 		}
@@ -94,48 +128,164 @@ func (s *cmSketch) Clear() {
 	}
 }
 
-// cmRow is a row of bytes, with each byte holding two counters.
-type cmRow []byte
+// writeTo writes the number of counters in each row, the seeds and the rows
+// of the sketch to w.
+func (s *cmSketch) writeTo(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, uint64(s.counters())); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, s.seed); err != nil {
+		return err
+	}
+	for _, r := range s.rows {
+		if _, err := w.Write(r.bytes(s.counters())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFrom replaces the seeds and counters of the sketch with the ones written
+// by writeTo. If the sketch that was written had a different number of
+// counters, the counters are rescaled: as a key's counter is picked by the low
+// bits of its hash, the counters sharing those bits are merged, keeping the
+// highest, for a smaller sketch, and copied over for a larger one.
+func (s *cmSketch) readFrom(r io.Reader) error {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return err
+	}
+	if n < 2 || n&(n-1) != 0 {
+		return errors.New("corrupt sketch")
+	}
+	var seed [cmDepth]uint64
+	if err := binary.Read(r, binary.LittleEndian, &seed); err != nil {
+		return err
+	}
+	var rows [cmDepth]cmRow
+	for i := range rows {
+		// Copy rather than allocate the row upfront, so that a corrupt size
+		// fails on the end of the input instead of exhausting memory.
+		var row bytes.Buffer
+		if _, err := io.CopyN(&row, r, int64(n/2)); err != nil {
+			return err
+		}
+		rows[i] = cmRowFromBytes(row.Bytes())
+	}
+	for i := range seed {
+		atomic.StoreUint64(&s.seed[i], seed[i])
+	}
+	for i, row := range rows {
+		if n == uint64(s.counters()) {
+			for j := range row {
+				atomic.StoreUint64(&s.rows[i][j], row[j])
+			}
+			continue
+		}
+		s.rows[i].clear()
+		for j := uint64(0); j < n; j++ {
+			s.rows[i].merge(j&s.mask, row.get(j))
+		}
+		for j := n; j <= s.mask; j++ {
+			s.rows[i].merge(j, row.get(j&(n-1)))
+		}
+	}
+	return nil
+}
+
+// cmRow is a row of words, with each word holding 16 counters, the first in
+// the lowest bits.
+type cmRow []uint64
 
 func newCmRow(numCounters int64) cmRow {
-	return make(cmRow, numCounters/2)
+	return make(cmRow, (numCounters+15)/16)
+}
+
+// cmRowFromBytes returns the row of the counters of b, with two counters in
+// each byte, the first in the lowest bits, as written by cmRow.bytes.
+func cmRowFromBytes(b []byte) cmRow {
+	r := newCmRow(int64(len(b)) * 2)
+	for i, c := range b {
+		r[i/8] |= uint64(c) << (uint(i%8) * 8)
+	}
+	return r
+}
+
+// bytes returns the first n counters of the row, two in each byte.
+func (r cmRow) bytes(n int64) []byte {
+	b := make([]byte, n/2)
+	for i := range b {
+		b[i] = byte(atomic.LoadUint64(&r[i/8]) >> (uint(i%8) * 8))
+	}
+	return b
 }
 
-func (r cmRow) get(n uint64) byte {
-	return byte(r[n/2]>>((n&1)*4)) & 0x0f
+func (r cmRow) get(n uint64) uint64 {
+	return atomic.LoadUint64(&r[n/16]) >> ((n & 15) * 4) & 0x0f
 }
 
 func (r cmRow) increment(n uint64) {
-	// Index of the counter.
-	i := n / 2
-	// Shift distance (even 0, odd 4).
-	s := (n & 1) * 4
-	// Counter value.
-	v := (r[i] >> s) & 0x0f
-	// Only increment if not max value (overflow wrap is bad for LFU).
-	if v < 15 {
-		r[i] += 1 << s
+	// Shift distance of the counter in its word.
+	s := (n & 15) * 4
+	for {
+		w := atomic.LoadUint64(&r[n/16])
+		// Only increment if not max value (overflow wrap is bad for LFU).
+		if (w>>s)&0x0f == 15 || atomic.CompareAndSwapUint64(&r[n/16], w, w+1<<s) {
+			return
+		}
+	}
+}
+
+// add adds d to counter n, up to the max value.
+func (r cmRow) add(n uint64, d uint64) {
+	s := (n & 15) * 4
+	for {
+		w := atomic.LoadUint64(&r[n/16])
+		v := (w >> s) & 0x0f
+		if v+d > 15 {
+			d = 15 - v
+		}
+		if d == 0 || atomic.CompareAndSwapUint64(&r[n/16], w, w+d<<s) {
+			return
+		}
+	}
+}
+
+// merge raises counter n to v if it's lower.
+func (r cmRow) merge(n uint64, v uint64) {
+	s := (n & 15) * 4
+	for {
+		w := atomic.LoadUint64(&r[n/16])
+		if (w>>s)&0x0f >= v ||
+			atomic.CompareAndSwapUint64(&r[n/16], w, w&^(0x0f<<s)|v<<s) {
+			return
+		}
 	}
 }
 
 func (r cmRow) reset() {
 	// Halve each counter.
 	for i := range r {
-		r[i] = (r[i] >> 1) & 0x77
+		for {
+			w := atomic.LoadUint64(&r[i])
+			if atomic.CompareAndSwapUint64(&r[i], w, (w>>1)&0x7777777777777777) {
+				break
+			}
+		}
 	}
 }
 
 func (r cmRow) clear() {
 	// Zero each counter.
 	for i := range r {
-		r[i] = 0
+		atomic.StoreUint64(&r[i], 0)
 	}
 }
 
 func (r cmRow) string() string {
 	s := ""
-	for i := uint64(0); i < uint64(len(r)*2); i++ {
-		s += fmt.Sprintf("%02d ", (r[(i/2)]>>((i&1)*4))&0x0f)
+	for i := uint64(0); i < uint64(len(r)*16); i++ {
+		s += fmt.Sprintf("%02d ", r.get(i))
 	}
 	s = s[:len(s)-1]
 	return s
@@ -1,6 +1,8 @@
 package ristretto
 
 import (
+	"bytes"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -58,6 +60,60 @@ func TestSketchClear(t *testing.T) {
 	}
 }
 
+func TestSketchState(t *testing.T) {
+	s := newCmSketch(64)
+	for key := uint64(0); key < 32; key++ {
+		for i := uint64(0); i <= key%8; i++ {
+			s.Increment(key)
+		}
+	}
+	var state bytes.Buffer
+	require.NoError(t, s.writeTo(&state))
+	// Rescaled sketches never estimate less than the original one, and one of
+	// the same size estimates exactly as much.
+	for _, n := range []int64{16, 64, 256} {
+		restored := newCmSketch(n)
+		require.NoError(t, restored.readFrom(bytes.NewReader(state.Bytes())))
+		require.Equal(t, n, restored.counters())
+		for key := uint64(0); key < 32; key++ {
+			if n == 64 {
+				require.Equal(t, s.Estimate(key), restored.Estimate(key))
+			} else {
+				require.True(t, restored.Estimate(key) >= s.Estimate(key))
+			}
+		}
+	}
+	for n := 0; n < state.Len(); n++ {
+		require.Error(t, newCmSketch(64).readFrom(bytes.NewReader(state.Bytes()[:n])))
+	}
+}
+
+func TestSketchConcurrentIncrements(t *testing.T) {
+	// Increments racing for the same counters, and the words they share, are
+	// never lost: the estimates only ever err on the high side, by collisions.
+	const goroutines, keys = 8, 10000
+	s := newCmSketch(1 << 16)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for key := uint64(0); key < keys; key++ {
+				if g%2 == 0 {
+					s.Increment(key)
+				} else {
+					s.IncrementBy(key, 1)
+				}
+				s.Estimate(key + 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+	for key := uint64(0); key < keys; key++ {
+		require.True(t, s.Estimate(key) >= goroutines, "key %d: %d", key, s.Estimate(key))
+	}
+}
+
 func TestNext2Power(t *testing.T) {
 	sz := 12 << 30
 	szf := float64(sz) * 0.01
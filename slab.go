@@ -0,0 +1,380 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+const (
+	// minSlotSize and maxSlotSize bound the slot sizes of the slab classes,
+	// which are the powers of two in between. Bigger values get a block of
+	// their own.
+	minSlotSize = 16
+	maxSlotSize = 1 << 20
+	numClasses  = 17
+	// slabSize is the size of the blocks the slots of a class are cut from,
+	// unless a single slot is bigger.
+	slabSize = 1 << 16
+	// largeClass marks the entries of the values bigger than maxSlotSize.
+	largeClass = numClasses
+)
+
+// slabEntry locates a value held by a slabMap. Like arenaEntry, it holds no
+// pointers.
+type slabEntry struct {
+	conflict   uint64
+	expiration int64
+	slab       uint32
+	slot       uint32
+	n          uint32
+	class      uint8
+}
+
+// slab is a block of memory cut into slots of the same size.
+type slab struct {
+	data []byte
+	// free holds the slots given back, and next is the first slot never
+	// handed out.
+	free    []uint32
+	next    uint32
+	used    int
+	partial bool
+}
+
+// slabClass allocates the slots of one size.
+type slabClass struct {
+	size  int
+	slots int
+	// slabs holds the slabs by id, with nil for the ids of the ones released,
+	// which are kept in idle for reuse. partial holds the ids of the slabs
+	// with free slots.
+	slabs   []*slab
+	idle    []uint32
+	partial []uint32
+}
+
+func (c *slabClass) alloc() (uint32, uint32, int) {
+	for len(c.partial) > 0 {
+		id := c.partial[len(c.partial)-1]
+		s := c.slabs[id]
+		var slot uint32
+		switch {
+		case len(s.free) > 0:
+			slot = s.free[len(s.free)-1]
+			s.free = s.free[:len(s.free)-1]
+		case int(s.next) < c.slots:
+			slot = s.next
+			s.next++
+		default:
+			// Full, so off the partial list.
+			s.partial = false
+			c.partial = c.partial[:len(c.partial)-1]
+			continue
+		}
+		s.used++
+		return id, slot, 0
+	}
+	s := &slab{
+		data:    z.Calloc(c.size*c.slots, "ristretto.slab"),
+		next:    1,
+		used:    1,
+		partial: true,
+	}
+	var id uint32
+	if len(c.idle) > 0 {
+		id = c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		c.slabs[id] = s
+	} else {
+		id = uint32(len(c.slabs))
+		c.slabs = append(c.slabs, s)
+	}
+	c.partial = append(c.partial, id)
+	return id, 0, len(s.data)
+}
+
+// free gives a slot back, releasing its slab if it's left empty while another
+// one has room, and returns the number of bytes released.
+func (c *slabClass) free(id, slot uint32) int {
+	s := c.slabs[id]
+	s.used--
+	s.free = append(s.free, slot)
+	if !s.partial {
+		s.partial = true
+		c.partial = append(c.partial, id)
+	}
+	if s.used > 0 || len(c.partial) == 1 {
+		return 0
+	}
+	for i, p := range c.partial {
+		if p == id {
+			c.partial = append(c.partial[:i], c.partial[i+1:]...)
+			break
+		}
+	}
+	return c.release(id)
+}
+
+func (c *slabClass) release(id uint32) int {
+	s := c.slabs[id]
+	z.Free(s.data)
+	c.slabs[id] = nil
+	c.idle = append(c.idle, id)
+	return len(s.data)
+}
+
+// reset releases every slab, once there are no values left.
+func (c *slabClass) reset() int {
+	released := 0
+	for id, s := range c.slabs {
+		if s != nil {
+			released += c.release(uint32(id))
+		}
+	}
+	c.slabs, c.idle, c.partial = nil, nil, nil
+	return released
+}
+
+func (c *slabClass) bytes(id, slot uint32, n uint32) []byte {
+	off := int(slot) * c.size
+	return c.slabs[id].data[off : off+int(n)]
+}
+
+// slabShard holds the values of its keys in slots of slab classes, and the
+// values too big for any class in blocks of their own.
+type slabShard struct {
+	sync.RWMutex
+	entries map[uint64]slabEntry
+	classes [numClasses]slabClass
+	large   [][]byte
+	idle    []uint32
+	// allocated is the number of bytes of all the blocks of the shard.
+	allocated int
+}
+
+// slabMap is the Map of a cache with Config.OffHeap. Its values live in slabs
+// allocated with z.Calloc, which are outside the Go heap when built with
+// jemalloc, and are plain byte slices, never scanned by the garbage
+// collector, otherwise. A deleted value gives its slot back to its class, and
+// slabs left empty are released, so churn doesn't fragment the memory beyond
+// the rounding of the values to their class. Get and Range copy the values
+// out, so that the slots can be reused as soon as the lock is released.
+type slabMap struct {
+	shards []slabShard
+	mask   uint64
+	seed   uint64
+}
+
+// slabShards returns the number of shards of a slabMap: a power of two no
+// smaller than GOMAXPROCS, and at least 16. It's lower than for the default
+// store, as every shard keeps a slab per class.
+func slabShards() int {
+	shards := 16
+	for shards < runtime.GOMAXPROCS(0) {
+		shards <<= 1
+	}
+	return shards
+}
+
+func newSlabMap(shards int) *slabMap {
+	m := &slabMap{
+		shards: make([]slabShard, shards),
+		mask:   uint64(shards - 1),
+		seed:   randomSeed(),
+	}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.entries = make(map[uint64]slabEntry)
+		for class := range s.classes {
+			size := minSlotSize << uint(class)
+			slots := slabSize / size
+			if slots < 1 {
+				slots = 1
+			}
+			s.classes[class] = slabClass{size: size, slots: slots}
+		}
+	}
+	return m
+}
+
+// classOf returns the class of the values of n bytes.
+func classOf(n int) int {
+	class := 0
+	for size := minSlotSize; size < n; size <<= 1 {
+		class++
+	}
+	if class >= numClasses {
+		return largeClass
+	}
+	return class
+}
+
+func (m *slabMap) shard(key uint64) *slabShard {
+	return &m.shards[mixHash(key^m.seed)&m.mask]
+}
+
+// bytes returns the bytes of the entry, in place. It must be called with the
+// lock held.
+func (s *slabShard) bytes(e slabEntry) []byte {
+	if e.class == largeClass {
+		return s.large[e.slab]
+	}
+	return s.classes[e.class].bytes(e.slab, e.slot, e.n)
+}
+
+// store copies the data in a new slot, and returns its entry. It must be called
+// with the lock held.
+func (s *slabShard) store(data []byte) slabEntry {
+	e := slabEntry{n: uint32(len(data)), class: uint8(classOf(len(data)))}
+	if e.class == largeClass {
+		block := z.Calloc(len(data), "ristretto.slab")
+		s.allocated += len(block)
+		if len(s.idle) > 0 {
+			e.slab = s.idle[len(s.idle)-1]
+			s.idle = s.idle[:len(s.idle)-1]
+			s.large[e.slab] = block
+		} else {
+			e.slab = uint32(len(s.large))
+			s.large = append(s.large, block)
+		}
+	} else {
+		var allocated int
+		e.slab, e.slot, allocated = s.classes[e.class].alloc()
+		s.allocated += allocated
+	}
+	copy(s.bytes(e), data)
+	return e
+}
+
+// release gives the memory of the entry back. It must be called with the lock
+// held.
+func (s *slabShard) release(e slabEntry) {
+	if e.class == largeClass {
+		s.allocated -= len(s.large[e.slab])
+		z.Free(s.large[e.slab])
+		s.large[e.slab] = nil
+		s.idle = append(s.idle, e.slab)
+		return
+	}
+	s.allocated -= s.classes[e.class].free(e.slab, e.slot)
+}
+
+// item returns the item of the entry, with a copy of its bytes. It must be
+// called with the lock held.
+func (s *slabShard) item(key uint64, e slabEntry) MapItem {
+	data := make([]byte, e.n)
+	copy(data, s.bytes(e))
+	return MapItem{
+		Key:        key,
+		Conflict:   e.conflict,
+		Value:      data,
+		Expiration: e.expiration,
+	}
+}
+
+func (m *slabMap) Get(key uint64) (MapItem, bool) {
+	s := m.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return MapItem{}, false
+	}
+	return s.item(key, e), true
+}
+
+func (m *slabMap) Set(item MapItem) {
+	data, _ := item.Value.([]byte)
+	s := m.shard(item.Key)
+	s.Lock()
+	defer s.Unlock()
+	old, ok := s.entries[item.Key]
+	if ok && old.n == uint32(len(data)) && string(s.bytes(old)) == string(data) {
+		// Only the metadata changed, as for a new expiration.
+		old.conflict, old.expiration = item.Conflict, item.Expiration
+		s.entries[item.Key] = old
+		return
+	}
+	e := s.store(data)
+	e.conflict, e.expiration = item.Conflict, item.Expiration
+	if ok {
+		s.release(old)
+	}
+	s.entries[item.Key] = e
+}
+
+func (m *slabMap) Del(key uint64) {
+	s := m.shard(key)
+	s.Lock()
+	if e, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.release(e)
+	}
+	if len(s.entries) == 0 {
+		// Don't hold on to the last slabs of an empty shard, as after Clear.
+		for class := range s.classes {
+			s.allocated -= s.classes[class].reset()
+		}
+		s.large, s.idle = nil, nil
+	}
+	s.Unlock()
+}
+
+func (m *slabMap) Len() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.entries)
+		s.RUnlock()
+	}
+	return n
+}
+
+func (m *slabMap) Range(f func(MapItem) bool) {
+	var items []MapItem
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		items = items[:0]
+		for key, e := range s.entries {
+			items = append(items, s.item(key, e))
+		}
+		s.RUnlock()
+		for _, item := range items {
+			if !f(item) {
+				return
+			}
+		}
+	}
+}
+
+// allocated returns the number of bytes of all the blocks of the map.
+func (m *slabMap) allocated() int {
+	n := 0
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += s.allocated
+		s.RUnlock()
+	}
+	return n
+}
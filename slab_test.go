@@ -0,0 +1,175 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlabClassOf(t *testing.T) {
+	require.Equal(t, 0, classOf(0))
+	require.Equal(t, 0, classOf(16))
+	require.Equal(t, 1, classOf(17))
+	require.Equal(t, numClasses-1, classOf(maxSlotSize))
+	require.Equal(t, largeClass, classOf(maxSlotSize+1))
+}
+
+// churnValue returns the value of the key for the given generation, filled with
+// a byte of both so that a slot reused too early shows. Some are bigger than
+// any slot.
+func churnValue(r *rand.Rand, key uint64, gen int) []byte {
+	n := r.Intn(3000)
+	switch r.Intn(500) {
+	case 0:
+		n = maxSlotSize + r.Intn(1000)
+	case 1, 2, 3, 4, 5:
+		n = 0
+	}
+	return bytes.Repeat([]byte{byte(key) ^ byte(gen)}, n)
+}
+
+func TestSlabMapChurn(t *testing.T) {
+	m := newSlabMap(4)
+	r := rand.New(rand.NewSource(1))
+	model := make(map[uint64][]byte)
+	for i := 0; i < 20000; i++ {
+		key := uint64(r.Intn(500))
+		switch r.Intn(4) {
+		case 0:
+			m.Del(key)
+			delete(model, key)
+		case 1:
+			item, ok := m.Get(key)
+			want, found := model[key]
+			require.Equal(t, found, ok)
+			if ok {
+				require.Equal(t, want, item.Value)
+				// The copy is the caller's to change.
+				if len(want) > 0 {
+					item.Value.([]byte)[0]++
+				}
+			}
+		default:
+			value := churnValue(r, key, i)
+			m.Set(MapItem{Key: key, Conflict: key, Value: value})
+			model[key] = value
+		}
+	}
+	require.Equal(t, len(model), m.Len())
+	n := 0
+	m.Range(func(item MapItem) bool {
+		require.Equal(t, model[item.Key], item.Value)
+		require.Equal(t, item.Key, item.Conflict)
+		n++
+		return true
+	})
+	require.Equal(t, len(model), n)
+
+	// The slots are reused: the memory stays within a few slabs per class of
+	// what the live values need.
+	live := 0
+	for _, value := range model {
+		live += len(value)
+	}
+	require.True(t, m.allocated() < 2*live+4*numClasses*slabSize*len(m.shards),
+		"%d bytes allocated for %d live", m.allocated(), live)
+
+	for key := range model {
+		m.Del(key)
+	}
+	require.Zero(t, m.Len())
+	require.Zero(t, m.allocated())
+}
+
+func TestSlabMapConcurrent(t *testing.T) {
+	m := newSlabMap(2)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 3000; i++ {
+				// Every goroutine has keys of its own, so it knows what they
+				// hold, while sharing the slabs with the others.
+				key := uint64(r.Intn(50)*8 + g)
+				value := churnValue(r, key, i)
+				m.Set(MapItem{Key: key, Value: value})
+				item, ok := m.Get(key)
+				if !ok || !bytes.Equal(value, item.Value.([]byte)) {
+					t.Errorf("key %d doesn't hold its value", key)
+					return
+				}
+				if r.Intn(3) == 0 {
+					m.Del(key)
+				}
+				if i%500 != 0 {
+					continue
+				}
+				m.Range(func(item MapItem) bool {
+					data := item.Value.([]byte)
+					if len(data) > 0 && data[0] != data[len(data)-1] {
+						t.Errorf("key %d holds a mix of values", item.Key)
+						return false
+					}
+					return true
+				})
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestCacheOffHeap(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            1 << 20,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		EncodeValue:        encodeTestValue,
+		DecodeValue:        decodeTestValue,
+		StoreEncoded:       true,
+		OffHeap:            true,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.True(t, c.Set(i, string(bytes.Repeat([]byte{'a' + byte(i%26)}, i*10)), 0))
+	}
+	c.Wait()
+	for i := 0; i < 50; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, string(bytes.Repeat([]byte{'a' + byte(i%26)}, i*10)), val)
+	}
+	m := c.store.(*codecStore).store.(*mapStore).m.(*slabMap)
+	require.NotZero(t, m.allocated())
+	c.Close()
+	require.Zero(t, m.allocated())
+
+	_, err = NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		OffHeap:     true,
+	})
+	require.Error(t, err)
+}
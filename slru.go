@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+// slruProbationRatio is the default share of the cache given to the probation
+// segment of an SLRU policy.
+const slruProbationRatio = 0.2
+
+// slruPolicy is a Segmented LRU policy. New keys land in the probation segment
+// and are promoted to the protected segment when accessed again, so a scan of
+// keys seen only once can't push out the keys that are in use. When the
+// protected segment overflows, its least recently used keys are demoted back
+// to probation. Victims are taken from the probation tail first.
+type slruPolicy struct {
+	probation slruSegment
+	protected slruSegment
+	// protectedCap is the cost the protected segment may hold.
+	protectedCap   int64
+	probationRatio float64
+	elems          map[uint64]*list.Element
+}
+
+type slruSegment struct {
+	list *list.List
+	cost int64
+}
+
+type slruEntry struct {
+	key       uint64
+	cost      int64
+	protected bool
+}
+
+// NewSLRUPolicy returns a Segmented LRU Policy that gives 20% of MaxCost to
+// its probation segment. It can be used as Config.Policy.
+func NewSLRUPolicy(numCounters, maxCost int64) Policy {
+	return newSLRUPolicy(maxCost, slruProbationRatio)
+}
+
+// NewSLRUPolicyWithRatio returns a Config.Policy constructor for Segmented LRU
+// policies giving probationRatio, between 0 and 1, of MaxCost to the probation
+// segment.
+func NewSLRUPolicyWithRatio(probationRatio float64) func(numCounters, maxCost int64) Policy {
+	if probationRatio < 0 || probationRatio > 1 {
+		panic("ristretto: SLRU probation ratio must be between 0 and 1")
+	}
+	return func(numCounters, maxCost int64) Policy {
+		return newSLRUPolicy(maxCost, probationRatio)
+	}
+}
+
+func newSLRUPolicy(maxCost int64, probationRatio float64) *slruPolicy {
+	p := &slruPolicy{
+		probation:      slruSegment{list: list.New()},
+		protected:      slruSegment{list: list.New()},
+		probationRatio: probationRatio,
+		elems:          make(map[uint64]*list.Element),
+	}
+	p.Resize(maxCost)
+	return p
+}
+
+func (p *slruPolicy) segment(e *slruEntry) *slruSegment {
+	if e.protected {
+		return &p.protected
+	}
+	return &p.probation
+}
+
+func (p *slruPolicy) Add(key uint64, cost int64) {
+	p.elems[key] = p.probation.list.PushFront(&slruEntry{key: key, cost: cost})
+	p.probation.cost += cost
+}
+
+func (p *slruPolicy) Update(key uint64, cost int64) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*slruEntry)
+	p.segment(e).cost += cost - e.cost
+	e.cost = cost
+}
+
+func (p *slruPolicy) Del(key uint64) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*slruEntry)
+	seg := p.segment(e)
+	seg.list.Remove(elem)
+	seg.cost -= e.cost
+	delete(p.elems, key)
+}
+
+func (p *slruPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		elem, ok := p.elems[key]
+		if !ok {
+			continue
+		}
+		e := elem.Value.(*slruEntry)
+		if e.protected {
+			p.protected.list.MoveToFront(elem)
+			continue
+		}
+		// Promote the key to the protected segment.
+		p.probation.list.Remove(elem)
+		p.probation.cost -= e.cost
+		e.protected = true
+		p.elems[key] = p.protected.list.PushFront(e)
+		p.protected.cost += e.cost
+		p.demote()
+	}
+}
+
+// demote moves the least recently used protected keys back to probation until
+// the protected segment fits its share of the cache. The most recently used
+// protected key is never demoted, even if it doesn't fit on its own.
+func (p *slruPolicy) demote() {
+	for p.protected.cost > p.protectedCap && p.protected.list.Len() > 1 {
+		elem := p.protected.list.Back()
+		e := elem.Value.(*slruEntry)
+		p.protected.list.Remove(elem)
+		p.protected.cost -= e.cost
+		e.protected = false
+		p.elems[e.key] = p.probation.list.PushFront(e)
+		p.probation.cost += e.cost
+	}
+}
+
+func (p *slruPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+func (p *slruPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	keyOf := func(elem *list.Element) uint64 {
+		return elem.Value.(*slruEntry).key
+	}
+	elem := lastUnskipped(p.probation.list, keyOf, skip)
+	if elem == nil {
+		elem = lastUnskipped(p.protected.list, keyOf, skip)
+	}
+	if elem == nil {
+		return 0, false
+	}
+	victim := elem.Value.(*slruEntry).key
+	p.Del(victim)
+	return victim, true
+}
+
+// victim returns the element of the next key to evict, or nil if there are no
+// keys.
+func (p *slruPolicy) victim() *list.Element {
+	if elem := p.probation.list.Back(); elem != nil {
+		return elem
+	}
+	return p.protected.list.Back()
+}
+
+func (p *slruPolicy) Resize(maxCost int64) {
+	p.protectedCap = int64(float64(maxCost) * (1 - p.probationRatio))
+	// Demoted keys are the first to go if the cache shrank.
+	p.demote()
+}
+
+func (p *slruPolicy) Clear() {
+	p.probation = slruSegment{list: list.New()}
+	p.protected = slruSegment{list: list.New()}
+	p.elems = make(map[uint64]*list.Element)
+}
@@ -0,0 +1,78 @@
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLRUPolicyPromote(t *testing.T) {
+	p := NewSLRUPolicyWithRatio(0.5)(100, 4).(*slruPolicy)
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+	}
+	// Promoting 1, 2 and 3 overflows the protected segment, so 1 is demoted.
+	p.Access([]uint64{1, 2, 3})
+	require.Equal(t, int64(2), p.protected.cost)
+	require.Equal(t, int64(2), p.probation.cost)
+	require.Equal(t, 2, p.protected.list.Len())
+	require.False(t, p.elems[1].Value.(*slruEntry).protected)
+
+	// Victims come from the probation tail, then the protected one.
+	for _, want := range []uint64{4, 1, 2, 3} {
+		victim, ok := p.Evict(5)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	_, ok := p.Evict(5)
+	require.False(t, ok)
+}
+
+func TestSLRUPolicyDel(t *testing.T) {
+	p := NewSLRUPolicy(100, 10).(*slruPolicy)
+	p.Add(1, 2)
+	p.Add(2, 3)
+	p.Access([]uint64{2})
+	p.Update(2, 4)
+	require.Equal(t, int64(4), p.protected.cost)
+	p.Del(1)
+	p.Del(2)
+	p.Del(3)
+	require.Zero(t, p.probation.cost)
+	require.Zero(t, p.protected.cost)
+	require.Empty(t, p.elems)
+
+	p.Add(3, 1)
+	p.Clear()
+	require.Empty(t, p.elems)
+	_, ok := p.Evict(4)
+	require.False(t, ok)
+}
+
+func TestSLRUPolicyRatio(t *testing.T) {
+	require.Panics(t, func() { NewSLRUPolicyWithRatio(1.5) })
+	require.Equal(t, int64(80), NewSLRUPolicy(100, 100).(*slruPolicy).protectedCap)
+}
+
+func TestSLRUPolicyHitRatio(t *testing.T) {
+	keys := scanTrace(50, 100, 200)
+	// With the whole cache given to probation, SLRU is a plain LRU.
+	lru := policyHitRatio(NewSLRUPolicyWithRatio(1)(100, 100), 100, keys)
+	slru := policyHitRatio(NewSLRUPolicy(100, 100), 100, keys)
+	require.True(t, slru > lru+0.1, "slru: %.3f, lru: %.3f", slru, lru)
+}
+
+func TestSLRUPolicyResize(t *testing.T) {
+	p := NewSLRUPolicyWithRatio(0.5)(100, 8).(*slruPolicy)
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+		p.Access([]uint64{key})
+	}
+	require.Equal(t, int64(4), p.protected.cost)
+	p.Resize(4)
+	require.Equal(t, int64(2), p.protectedCap)
+	require.Equal(t, int64(2), p.protected.cost)
+	victim, ok := p.Evict(0)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+}
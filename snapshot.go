@@ -0,0 +1,349 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// A snapshot starts with snapshotMagic and the format version. Every entry is
+// then preceded by a 1 byte, the last one is followed by a 0 byte, then comes
+// the length of the policy state as a varint and the state itself, and the
+// snapshot ends with the big-endian CRC-32 (IEEE) of everything before it.
+// Version 1 snapshots have no policy state, and neither do the snapshots of
+// a PartitionedCache, whose state is empty.
+//
+// An entry is made of the key and conflict hashes as 8 little-endian bytes
+// each, followed by the cost, the expiration, the access frequency, the index
+// of the key class in Config.Classes (from version 3) and the length of the
+// encoded value as varints, and finally the encoded value.
+const (
+	snapshotMagic   = "RSTR"
+	snapshotVersion = 3
+)
+
+type snapshotEntry struct {
+	key        uint64
+	conflict   uint64
+	cost       int64
+	expiration int64
+	freq       int64
+	class      int64
+	data       []byte
+}
+
+// SaveTo writes the items in the cache, along with their costs and access
+// frequencies, to w so that LoadCache can restore them later. Values are
+// encoded with Config.EncodeValue. Items that have expired or whose Sets are
+// still buffered are left out. The state of the policy is saved as well: the
+// access counters of the default and W-TinyLFU policies, or whatever a custom
+// StatefulPolicy saves.
+func (c *Cache) SaveTo(w io.Writer) error {
+	if c == nil || c.isClosed() {
+		return ErrClosed
+	}
+	if c.encodeValue == nil {
+		return errors.New("SaveTo requires Config.EncodeValue")
+	}
+	return writeSnapshot(w, []*Cache{c}, c.policy.SaveState)
+}
+
+// writeSnapshot implements SaveTo for the items of the caches, followed by the
+// policy state written by saveState, or an empty one if it's nil.
+func writeSnapshot(w io.Writer, caches []*Cache, saveState func(io.Writer) error) error {
+	sum := crc32.NewIEEE()
+	sw := &snapshotWriter{w: bufio.NewWriter(io.MultiWriter(w, sum))}
+	sw.w.WriteString(snapshotMagic)
+	sw.w.WriteByte(snapshotVersion)
+
+	var err error
+	for _, c := range caches {
+		c.Range(func(item *Item) bool {
+			var data []byte
+			if data, err = c.encodeValue(item.Value); err != nil {
+				err = fmt.Errorf("encoding value: %v", err)
+				return false
+			}
+			sw.w.WriteByte(1)
+			sw.fixed(item.Key)
+			sw.fixed(item.Conflict)
+			sw.varint(item.Cost)
+			sw.varint(item.Expiration)
+			sw.varint(c.policy.Frequency(item.Key))
+			sw.varint(int64(c.policy.KeyClass(item.Key)))
+			sw.varint(int64(len(data)))
+			sw.w.Write(data)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sw.w.WriteByte(0)
+	var state bytes.Buffer
+	if saveState != nil {
+		if err := saveState(&state); err != nil {
+			return fmt.Errorf("saving policy state: %v", err)
+		}
+	}
+	sw.varint(int64(state.Len()))
+	sw.w.Write(state.Bytes())
+	if err := sw.w.Flush(); err != nil {
+		return err
+	}
+	_, err = w.Write(sum.Sum(nil))
+	return err
+}
+
+// LoadCache returns a new cache holding the items written by Cache.SaveTo to r.
+// Values are decoded with Config.DecodeValue. The items are admitted through
+// the policy in order of decreasing access frequency, and the ones that
+// don't fit in MaxCost or have expired are skipped. Nothing is restored, and
+// an error is returned, if r doesn't hold a complete snapshot.
+//
+// The state of the policy is restored first, even if NumCounters changed, in
+// which case the access counters are scaled to the new size. It's an error for
+// the snapshot to come from a cache with another type of policy.
+func LoadCache(config *Config, r io.Reader) (*Cache, error) {
+	if config.DecodeValue == nil {
+		return nil, errors.New("LoadCache requires Config.DecodeValue")
+	}
+	entries, state, err := readSnapshot(r)
+	if err != nil {
+		logLoadError(config, err)
+		return nil, err
+	}
+	c, err := NewCache(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(state) > 0 {
+		if err := c.policy.LoadState(bytes.NewReader(state)); err != nil {
+			c.Close()
+			err = fmt.Errorf("loading policy state: %v", snapshotEOF(err))
+			logLoadError(config, err)
+			return nil, err
+		}
+	}
+	if err := c.restore(entries); err != nil {
+		c.Close()
+		logLoadError(config, err)
+		return nil, err
+	}
+	return c, nil
+}
+
+// logLoadError gives the error of LoadCache reading a snapshot to
+// Config.Logger.
+func logLoadError(config *Config, err error) {
+	if config.Logger != nil {
+		config.Logger.Log(LogError, "loading snapshot failed", "error", err)
+	}
+}
+
+func (c *Cache) restore(entries []snapshotEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].freq > entries[j].freq
+	})
+	now := c.clock.Now().Unix()
+	for _, e := range entries {
+		if e.expiration != 0 && e.expiration <= now {
+			continue
+		}
+		value, err := c.decodeValue(e.data)
+		if err != nil {
+			return fmt.Errorf("decoding value: %v", err)
+		}
+		if c.insert(&Item{
+			Key:        e.key,
+			Conflict:   e.conflict,
+			Value:      value,
+			Cost:       e.cost,
+			Expiration: e.expiration,
+		}, c.className(int(e.class))) {
+			c.policy.SetFrequency(e.key, e.freq)
+		}
+	}
+	return nil
+}
+
+func readSnapshot(r io.Reader) ([]snapshotEntry, []byte, error) {
+	sum := crc32.NewIEEE()
+	sr := &snapshotReader{r: bufio.NewReader(r), sum: sum}
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(sr, header); err != nil {
+		return nil, nil, snapshotError(err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, nil, errors.New("not a cache snapshot")
+	}
+	version := header[len(snapshotMagic)]
+	if version < 1 || version > snapshotVersion {
+		return nil, nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	var entries []snapshotEntry
+	for {
+		more, err := sr.ReadByte()
+		if err != nil {
+			return nil, nil, snapshotError(err)
+		}
+		if more == 0 {
+			break
+		}
+		if more != 1 {
+			return nil, nil, errors.New("corrupt snapshot")
+		}
+		e, err := sr.entry(version)
+		if err != nil {
+			return nil, nil, snapshotError(err)
+		}
+		entries = append(entries, e)
+	}
+	var state []byte
+	if version >= 2 {
+		var err error
+		if state, err = sr.bytes(); err != nil {
+			return nil, nil, snapshotError(err)
+		}
+	}
+
+	want := sum.Sum(nil)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(sr.r, got); err != nil {
+		return nil, nil, snapshotError(err)
+	}
+	if !bytes.Equal(got, want) {
+		return nil, nil, errors.New("corrupt snapshot: checksum mismatch")
+	}
+	return entries, state, nil
+}
+
+func snapshotError(err error) error {
+	return fmt.Errorf("reading snapshot: %v", snapshotEOF(err))
+}
+
+// snapshotEOF turns the end of the input in the middle of a snapshot into
+// io.ErrUnexpectedEOF.
+func snapshotEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// snapshotWriter writes the fields of a snapshot. Errors stick to the
+// underlying bufio.Writer and are returned by Flush.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapshotWriter) fixed(v uint64) {
+	binary.LittleEndian.PutUint64(sw.buf[:8], v)
+	sw.w.Write(sw.buf[:8])
+}
+
+func (sw *snapshotWriter) varint(v int64) {
+	n := binary.PutVarint(sw.buf[:], v)
+	sw.w.Write(sw.buf[:n])
+}
+
+// snapshotReader reads the fields of a snapshot, feeding everything it reads
+// to the checksum.
+type snapshotReader struct {
+	r   *bufio.Reader
+	sum hash.Hash32
+}
+
+func (sr *snapshotReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	sr.sum.Write(p[:n])
+	return n, err
+}
+
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	b, err := sr.r.ReadByte()
+	if err == nil {
+		sr.sum.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (sr *snapshotReader) fixed() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(sr, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (sr *snapshotReader) entry(version byte) (snapshotEntry, error) {
+	var e snapshotEntry
+	var err error
+	if e.key, err = sr.fixed(); err != nil {
+		return e, err
+	}
+	if e.conflict, err = sr.fixed(); err != nil {
+		return e, err
+	}
+	if e.cost, err = binary.ReadVarint(sr); err != nil {
+		return e, err
+	}
+	if e.expiration, err = binary.ReadVarint(sr); err != nil {
+		return e, err
+	}
+	if e.freq, err = binary.ReadVarint(sr); err != nil {
+		return e, err
+	}
+	if version >= 3 {
+		if e.class, err = binary.ReadVarint(sr); err != nil {
+			return e, err
+		}
+	}
+	if e.cost < 0 || e.class < 0 {
+		return e, errors.New("corrupt snapshot")
+	}
+	e.data, err = sr.bytes()
+	return e, err
+}
+
+// bytes reads a varint length, and that many bytes.
+func (sr *snapshotReader) bytes() ([]byte, error) {
+	size, err := binary.ReadVarint(sr)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, errors.New("corrupt snapshot")
+	}
+	// Copy rather than allocate size bytes upfront, so that a corrupt size
+	// fails on the end of the input instead of exhausting memory.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, sr, size); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
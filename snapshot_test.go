@@ -0,0 +1,252 @@
+package ristretto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotConfig() *Config {
+	return &Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		EncodeValue: func(value interface{}) ([]byte, error) {
+			return []byte(value.(string)), nil
+		},
+		DecodeValue: func(data []byte) (interface{}, error) {
+			return string(data), nil
+		},
+	}
+}
+
+func saveSnapshot(t *testing.T, n int) []byte {
+	c, err := NewCache(newSnapshotConfig())
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < n; i++ {
+		require.True(t, c.Set(i, string(rune('a'+i)), 1))
+		c.Wait()
+	}
+	c.policy.SetFrequency(0, 10)
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+	return buf.Bytes()
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	snapshot := saveSnapshot(t, 10)
+
+	c, err := LoadCache(newSnapshotConfig(), bytes.NewReader(snapshot))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 10, c.Len())
+	require.Equal(t, int64(10), c.UsedCost())
+	for i := 0; i < 10; i++ {
+		val, ok := c.Get(i)
+		require.True(t, ok)
+		require.Equal(t, string(rune('a'+i)), val)
+	}
+	require.Equal(t, int64(10), c.policy.Frequency(0))
+
+	// The restored items are tracked by the policy like any other.
+	c.Del(3)
+	c.Wait()
+	require.Equal(t, int64(9), c.UsedCost())
+}
+
+func TestCacheSnapshotSkipsWhatDoesntFit(t *testing.T) {
+	snapshot := saveSnapshot(t, 10)
+
+	config := newSnapshotConfig()
+	config.MaxCost = 4
+	c, err := LoadCache(config, bytes.NewReader(snapshot))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 4, c.Len())
+	require.Equal(t, int64(4), c.UsedCost())
+	// The most frequently accessed key goes first.
+	_, ok := c.Get(0)
+	require.True(t, ok)
+}
+
+func TestCacheSnapshotSkipsExpired(t *testing.T) {
+	c, err := NewCache(newSnapshotConfig())
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.SetWithTTL(1, "a", 1, time.Hour))
+	require.True(t, c.Set(2, "b", 1))
+	c.Wait()
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+
+	c2, err := LoadCache(newSnapshotConfig(), &buf)
+	require.NoError(t, err)
+	defer c2.Close()
+	require.Equal(t, 2, c2.Len())
+	ttl, ok := c2.GetTTL(1)
+	require.True(t, ok)
+	require.True(t, ttl > 59*time.Minute)
+
+	expired := snapshotEntry{key: 3, cost: 1, expiration: time.Now().Unix() - 1}
+	require.NoError(t, c2.restore([]snapshotEntry{expired}))
+	require.Equal(t, 2, c2.Len())
+}
+
+func TestCacheSnapshotKeepsExpiration(t *testing.T) {
+	c, err := NewCache(newSnapshotConfig())
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.SetWithTTL(1, "a", 1, time.Minute))
+	require.True(t, c.Set(2, "b", 1))
+	c.Wait()
+	want := c.store.Expiration(1)
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+
+	// A default TTL doesn't restart the clock of restored items, nor give
+	// one to the items that had none.
+	config := newSnapshotConfig()
+	config.DefaultTTL = time.Hour
+	c2, err := LoadCache(config, &buf)
+	require.NoError(t, err)
+	defer c2.Close()
+	require.Equal(t, want, c2.store.Expiration(1))
+	require.Zero(t, c2.store.Expiration(2))
+}
+
+func TestCacheSnapshotTruncated(t *testing.T) {
+	snapshot := saveSnapshot(t, 3)
+	for n := 0; n < len(snapshot); n++ {
+		_, err := LoadCache(newSnapshotConfig(), bytes.NewReader(snapshot[:n]))
+		require.Error(t, err, "truncated to %d bytes", n)
+	}
+}
+
+func TestCacheSnapshotCorrupt(t *testing.T) {
+	snapshot := saveSnapshot(t, 3)
+	for i := range snapshot {
+		corrupt := append([]byte(nil), snapshot...)
+		corrupt[i] ^= 0xff
+		_, err := LoadCache(newSnapshotConfig(), bytes.NewReader(corrupt))
+		require.Error(t, err, "byte %d flipped", i)
+	}
+}
+
+func TestCacheSnapshotVersion(t *testing.T) {
+	snapshot := saveSnapshot(t, 1)
+	snapshot[len(snapshotMagic)] = snapshotVersion + 1
+	_, err := LoadCache(newSnapshotConfig(), bytes.NewReader(snapshot))
+	require.EqualError(t, err, "unsupported snapshot version 4")
+}
+
+func TestCacheSnapshotCodecs(t *testing.T) {
+	config := newSnapshotConfig()
+	config.EncodeValue = nil
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Error(t, c.SaveTo(&bytes.Buffer{}))
+
+	config = newSnapshotConfig()
+	config.EncodeValue = func(interface{}) ([]byte, error) {
+		return nil, errors.New("boom")
+	}
+	c, err = NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	c.Set(1, "a", 1)
+	c.Wait()
+	require.Error(t, c.SaveTo(&bytes.Buffer{}))
+
+	c, err = NewCache(newSnapshotConfig())
+	require.NoError(t, err)
+	c.Close()
+	require.Equal(t, ErrClosed, c.SaveTo(&bytes.Buffer{}))
+
+	snapshot := saveSnapshot(t, 1)
+	config = newSnapshotConfig()
+	config.DecodeValue = nil
+	_, err = LoadCache(config, bytes.NewReader(snapshot))
+	require.Error(t, err)
+	config.DecodeValue = func([]byte) (interface{}, error) {
+		return nil, errors.New("boom")
+	}
+	_, err = LoadCache(config, bytes.NewReader(snapshot))
+	require.Error(t, err)
+}
+
+func TestCacheSnapshotPolicyState(t *testing.T) {
+	config := newSnapshotConfig()
+	// The Gets below have to reach the sketch.
+	config.BufferMode = BufferLossless
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	// Keys that aren't in the cache have access frequencies too.
+	for i := 0; i < 5; i++ {
+		c.Get(99)
+	}
+	c.Flush()
+	key, _ := z.KeyToHash(99)
+	// The doorkeeper isn't saved, only the counters behind it.
+	freq := c.policy.(*defaultPolicy).admit.freq.Estimate(key)
+	require.True(t, freq > 0)
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+
+	for _, numCounters := range []int64{100, 1000, 10000} {
+		config := newSnapshotConfig()
+		config.NumCounters = numCounters
+		restored, err := LoadCache(config, bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.True(t, restored.policy.Frequency(key) >= freq)
+		restored.Close()
+	}
+
+	config = newSnapshotConfig()
+	config.Policy = NewLRUPolicy
+	_, err = LoadCache(config, bytes.NewReader(buf.Bytes()))
+	require.EqualError(t, err,
+		"loading policy state: policy state saved by tinylfu, not *ristretto.lruPolicy")
+}
+
+func TestCacheSnapshotCustomPolicyState(t *testing.T) {
+	config := newSnapshotConfig()
+	config.Policy = NewWTinyLFUPolicy
+	config.BufferMode = BufferLossless
+	c, err := NewCache(config)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		c.Get(99)
+	}
+	c.Flush()
+	key, _ := z.KeyToHash(99)
+	var buf bytes.Buffer
+	require.NoError(t, c.SaveTo(&buf))
+
+	restored, err := LoadCache(config, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	defer restored.Close()
+	w := restored.policy.(*defaultPolicy).custom.(*wtinyLFUPolicy)
+	require.True(t, w.admit.Estimate(key) > 0)
+}
+
+func TestCacheSnapshotVersion1(t *testing.T) {
+	// Snapshots written before the policy state was saved still load.
+	snapshot := append([]byte(snapshotMagic), 1, 0)
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(snapshot))
+	c, err := LoadCache(newSnapshotConfig(), bytes.NewReader(append(snapshot, sum...)))
+	require.NoError(t, err)
+	defer c.Close()
+	require.Zero(t, c.Len())
+}
@@ -17,7 +17,12 @@
 package ristretto
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,52 +43,241 @@ type storeItem struct {
 type store interface {
 	// Get returns the value associated with the key parameter.
 	Get(uint64, uint64) (interface{}, bool)
+	// GetMulti looks up several keys at once, filling values and found at the
+	// index of each key.
+	GetMulti(keys, conflicts []uint64, values []interface{}, found []bool)
 	// Expiration returns the expiration time for this key.
 	Expiration(uint64) int64
+	// Has returns whether the key is in the store, even if it has expired.
+	Has(uint64) bool
+	// Conflicts returns whether the key is held by another item, one with a
+	// different conflict hash. It's always false for a conflict hash of 0.
+	Conflicts(key, conflict uint64) bool
 	// Set adds the key-value pair to the Map or updates the value if it's
 	// already present. The key-value pair is passed as a pointer to an
 	// item object.
 	Set(*Item)
-	// Del deletes the key-value pair from the Map.
-	Del(uint64, uint64) (uint64, interface{})
+	// SetGroup sets the items so that Gets see the values of either none or
+	// all of them. It calls admit while none of the keys can be read, and
+	// only sets the items if it returns true, unless a key is held by
+	// another item. The previous value of every key already there is put in
+	// prev at its index, with replaced set. It returns whether the items
+	// were set.
+	SetGroup(items []*Item, prev []interface{}, replaced []bool, admit func() bool) bool
+	// SetMulti sets several items at once, like Set.
+	SetMulti(items []*Item)
+	// Del deletes the key-value pair from the Map. It returns the conflict hash
+	// and value of the deleted item, and whether the key was present.
+	Del(uint64, uint64) (uint64, interface{}, bool)
+	// DelMulti deletes several keys at once, like Del, filling values and
+	// found at the index of every key with the value deleted, if any.
+	DelMulti(keys, conflicts []uint64, values []interface{}, found []bool)
 	// Update attempts to update the key with a new value and returns true if
 	// successful.
 	Update(*Item) (interface{}, bool)
+	// Compute calls f with the value of the key, and whether it's there and
+	// hasn't expired, while holding the lock of its shard. If the key is there
+	// and f returns true, the value f returns replaces the old one, keeping its
+	// expiration. A missing key isn't added. Compute returns the old value and
+	// whether it was replaced.
+	Compute(key, conflict uint64, f func(value interface{}, ok bool) (interface{}, bool)) (interface{}, bool)
 	// Cleanup removes items that have an expired TTL.
-	Cleanup(policy policy, onEvict itemCallback)
+	Cleanup(policy policy, onExpire itemCallback)
 	// Clear clears all contents of the store.
 	Clear(onEvict itemCallback)
+	// Len returns the number of items in the store.
+	Len() int
+	// Touch sets the expiration of the key, unless it's missing or has already
+	// expired, and returns whether it did.
+	Touch(key, conflict uint64, expiration int64) bool
+	// GetAndTouch works like Touch, but also returns the value of the key. Both
+	// happen under the same lock, so the key can't expire in between.
+	GetAndTouch(key, conflict uint64, expiration int64) (interface{}, bool)
+	// DelExpired deletes the key only if it had expired by now, and returns
+	// its value and whether it was deleted.
+	DelExpired(key, conflict uint64, now int64) (interface{}, bool)
+	// Range calls f for every item in the store until f returns false, and f
+	// may use the store. It isn't a snapshot: the default store copies one
+	// shard at a time, and a store over a Map may or may not see the items
+	// changed while it runs.
+	Range(f func(storeItem) bool)
+	// Fingerprint returns the sum of the fingerprintOf every item in the
+	// store, kept up to date by the writes rather than computed.
+	Fingerprint() uint64
 }
 
 // newStore returns the default store implementation.
 func newStore() store {
-	return newShardedMap()
+	return newStoreWith(systemClock{}, defaultShards(), nil)
 }
 
-const numShards uint64 = 256
+// newStoreWith returns the default store implementation with the given number
+// of shards, which must be a power of two, telling whether items have expired
+// with clock. onConflict, if set, is called with the key of every Get that
+// finds its key held by another item.
+func newStoreWith(clock Clock, shards int, onConflict func(key uint64)) store {
+	sm := newShardedMapWith(clock, shards)
+	for _, shard := range sm.shards {
+		shard.onConflict = onConflict
+	}
+	return sm
+}
 
+// minShards is the least number of shards used by default.
+const minShards = 256
+
+// defaultShards returns the number of shards used unless Config.StoreShards is
+// set: the power of two at or above 4 shards per P, and at least minShards.
+func defaultShards() int {
+	shards := minShards
+	for shards < 4*runtime.GOMAXPROCS(0) {
+		shards *= 2
+	}
+	return shards
+}
+
+// shardedMap spreads the items over independently locked maps, so that
+// operations on a key only lock one shard. A key is routed to a shard by
+// mixing it with a seed picked at random for every map, so that keys colliding
+// on the same shard can't be made on purpose.
 type shardedMap struct {
 	shards    []*lockedMap
+	mask      uint64
+	seed      uint64
 	expiryMap *expirationMap
+	clock     Clock
+}
+
+// randomSeed returns a seed that can't be guessed, if possible.
+func randomSeed() uint64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return uint64(time.Now().UnixNano())
+	}
+	return binary.LittleEndian.Uint64(b[:])
 }
 
 func newShardedMap() *shardedMap {
+	return newShardedMapWith(systemClock{}, defaultShards())
+}
+
+func newShardedMapWith(clock Clock, shards int) *shardedMap {
 	sm := &shardedMap{
-		shards:    make([]*lockedMap, int(numShards)),
+		shards:    make([]*lockedMap, shards),
+		mask:      uint64(shards - 1),
+		seed:      randomSeed(),
 		expiryMap: newExpirationMap(),
+		clock:     clock,
 	}
 	for i := range sm.shards {
-		sm.shards[i] = newLockedMap(sm.expiryMap)
+		sm.shards[i] = newLockedMap(sm.expiryMap, clock)
 	}
 	return sm
 }
 
+// index returns the index of the shard of key.
+func (sm *shardedMap) index(key uint64) uint64 {
+	// The finalizer of SplitMix64, so that every bit of the key and the seed
+	// goes into the low bits.
+	h := key ^ sm.seed
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return (h ^ (h >> 31)) & sm.mask
+}
+
+func (sm *shardedMap) shard(key uint64) *lockedMap {
+	return sm.shards[sm.index(key)]
+}
+
 func (sm *shardedMap) Get(key, conflict uint64) (interface{}, bool) {
-	return sm.shards[key%numShards].get(key, conflict)
+	return sm.shard(key).get(key, conflict)
+}
+
+func (sm *shardedMap) GetMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	// Visit the keys shard by shard so that every shard lock is only taken
+	// once per call.
+	so := sm.shardOrderOf(keys)
+	defer so.release()
+	start := 0
+	for shard, end := range so.ends(len(sm.shards)) {
+		if end > start {
+			sm.shards[shard].getMulti(so.order[start:end], keys, conflicts, values, found)
+		}
+		start = end
+	}
+}
+
+// DelMulti visits the keys shard by shard, like GetMulti.
+func (sm *shardedMap) DelMulti(keys, conflicts []uint64, values []interface{}, found []bool) {
+	so := sm.shardOrderOf(keys)
+	defer so.release()
+	start := 0
+	for shard, end := range so.ends(len(sm.shards)) {
+		if end > start {
+			sm.shards[shard].delMulti(so.order[start:end], keys, conflicts, values, found)
+		}
+		start = end
+	}
+}
+
+// shardOrderOf returns a shardOrder holding the indexes of the keys sorted by
+// shard, to release once done with them. The indexes are counting sorted, so
+// that large batches take linear time, and stay in order within a shard.
+func (sm *shardedMap) shardOrderOf(keys []uint64) *shardOrder {
+	so := shardOrders.Get().(*shardOrder)
+	if cap(so.order) < len(keys) {
+		so.order = make([]int, len(keys))
+	}
+	so.order = so.order[:len(keys)]
+	if cap(so.starts) < len(sm.shards)+1 {
+		so.starts = make([]int, len(sm.shards)+1)
+	}
+	starts := so.starts[:len(sm.shards)+1]
+	for i := range starts {
+		starts[i] = 0
+	}
+	for _, key := range keys {
+		starts[sm.index(key)+1]++
+	}
+	for i := 1; i < len(starts); i++ {
+		starts[i] += starts[i-1]
+	}
+	for i, key := range keys {
+		shard := sm.index(key)
+		so.order[starts[shard]] = i
+		starts[shard]++
+	}
+	return so
+}
+
+// shardOrder holds the indexes of the keys of a GetMulti, a SetMulti or a
+// DelMulti sorted by shard. They're pooled, so that GetMulti doesn't allocate.
+type shardOrder struct {
+	order []int
+	// starts counts the keys of every shard while sorting, after which it
+	// holds where the indexes of every shard end.
+	starts []int
+}
+
+var shardOrders = sync.Pool{
+	New: func() interface{} { return new(shardOrder) },
+}
+
+// ends returns where the indexes of each of the n shards end in order.
+func (so *shardOrder) ends(n int) []int {
+	return so.starts[:n]
+}
+
+func (so *shardOrder) release() {
+	shardOrders.Put(so)
 }
 
 func (sm *shardedMap) Expiration(key uint64) int64 {
-	return sm.shards[key%numShards].Expiration(key)
+	return sm.shard(key).Expiration(key)
+}
+
+func (sm *shardedMap) Has(key uint64) bool {
+	return sm.shard(key).Has(key)
 }
 
 func (sm *shardedMap) Set(i *Item) {
@@ -92,37 +286,146 @@ func (sm *shardedMap) Set(i *Item) {
 		return
 	}
 
-	sm.shards[i.Key%numShards].Set(i)
+	sm.shard(i.Key).Set(i)
+}
+
+// SetMulti visits the items shard by shard, like GetMulti.
+func (sm *shardedMap) SetMulti(items []*Item) {
+	keys := make([]uint64, len(items))
+	for n, i := range items {
+		keys[n] = i.Key
+	}
+	so := sm.shardOrderOf(keys)
+	defer so.release()
+	start := 0
+	for shard, end := range so.ends(len(sm.shards)) {
+		if end > start {
+			sm.shards[shard].setMulti(so.order[start:end], items)
+		}
+		start = end
+	}
+}
+
+// SetGroup locks the shards of the items in the order of their index, each
+// once, so that concurrent groups can't deadlock.
+func (sm *shardedMap) SetGroup(items []*Item, prev []interface{}, replaced []bool,
+	admit func() bool) bool {
+	indexes := make([]int, 0, len(items))
+	for _, i := range items {
+		indexes = append(indexes, int(sm.index(i.Key)))
+	}
+	sort.Ints(indexes)
+	locked := indexes[:0]
+	for n, index := range indexes {
+		if n == 0 || index != indexes[n-1] {
+			locked = append(locked, index)
+		}
+	}
+	for _, index := range locked {
+		sm.shards[index].Lock()
+	}
+	defer func() {
+		for n := len(locked) - 1; n >= 0; n-- {
+			sm.shards[locked[n]].Unlock()
+		}
+	}()
+	for _, i := range items {
+		item, ok := sm.shard(i.Key).data[i.Key]
+		if ok && i.Conflict != 0 && i.Conflict != item.conflict {
+			return false
+		}
+	}
+	if !admit() {
+		return false
+	}
+	for n, i := range items {
+		prev[n], replaced[n] = sm.shard(i.Key).set(i)
+	}
+	return true
+}
+
+func (sm *shardedMap) Conflicts(key, conflict uint64) bool {
+	return sm.shard(key).Conflicts(key, conflict)
 }
 
-func (sm *shardedMap) Del(key, conflict uint64) (uint64, interface{}) {
-	return sm.shards[key%numShards].Del(key, conflict)
+func (sm *shardedMap) Del(key, conflict uint64) (uint64, interface{}, bool) {
+	return sm.shard(key).Del(key, conflict)
+}
+
+func (sm *shardedMap) Touch(key, conflict uint64, expiration int64) bool {
+	return sm.shard(key).Touch(key, conflict, expiration)
+}
+
+func (sm *shardedMap) GetAndTouch(key, conflict uint64, expiration int64) (interface{}, bool) {
+	return sm.shard(key).GetAndTouch(key, conflict, expiration)
+}
+
+func (sm *shardedMap) DelExpired(key, conflict uint64, now int64) (interface{}, bool) {
+	return sm.shard(key).DelExpired(key, conflict, now)
 }
 
 func (sm *shardedMap) Update(newItem *Item) (interface{}, bool) {
-	return sm.shards[newItem.Key%numShards].Update(newItem)
+	return sm.shard(newItem.Key).Update(newItem)
+}
+
+func (sm *shardedMap) Compute(key, conflict uint64,
+	f func(value interface{}, ok bool) (interface{}, bool)) (interface{}, bool) {
+	return sm.shard(key).Compute(key, conflict, f)
 }
 
-func (sm *shardedMap) Cleanup(policy policy, onEvict itemCallback) {
-	sm.expiryMap.cleanup(sm, policy, onEvict)
+func (sm *shardedMap) Cleanup(policy policy, onExpire itemCallback) {
+	sm.expiryMap.cleanup(sm, policy, onExpire, sm.clock.Now().Unix())
 }
 
 func (sm *shardedMap) Clear(onEvict itemCallback) {
-	for i := uint64(0); i < numShards; i++ {
-		sm.shards[i].Clear(onEvict)
+	for _, shard := range sm.shards {
+		shard.Clear(onEvict)
+	}
+	sm.expiryMap.clear()
+}
+
+func (sm *shardedMap) Len() int {
+	l := 0
+	for _, shard := range sm.shards {
+		l += shard.Len()
+	}
+	return l
+}
+
+func (sm *shardedMap) Fingerprint() uint64 {
+	var sum uint64
+	for _, shard := range sm.shards {
+		sum += atomic.LoadUint64(&shard.fingerprint)
+	}
+	return sum
+}
+
+func (sm *shardedMap) Range(f func(storeItem) bool) {
+	for _, shard := range sm.shards {
+		for _, item := range shard.items() {
+			if !f(item) {
+				return
+			}
+		}
 	}
 }
 
 type lockedMap struct {
+	// fingerprint comes first to be 64-bit aligned. It's the sum of the
+	// fingerprintOf the items, written with the lock held but read without.
+	fingerprint uint64
 	sync.RWMutex
-	data map[uint64]storeItem
-	em   *expirationMap
+	data       map[uint64]storeItem
+	em         *expirationMap
+	clock      Clock
+	onConflict func(key uint64)
 }
 
-func newLockedMap(em *expirationMap) *lockedMap {
+func newLockedMap(em *expirationMap, clock Clock) *lockedMap {
 	return &lockedMap{
-		data: make(map[uint64]storeItem),
-		em:   em,
+		data:  make(map[uint64]storeItem),
+		em:    em,
+		clock: clock,
 	}
 }
 
@@ -133,12 +436,42 @@ func (m *lockedMap) get(key, conflict uint64) (interface{}, bool) {
 	if !ok {
 		return nil, false
 	}
+	m.checkConflict(item, conflict)
+	return item.valueFor(conflict, m.clock.Now().Unix())
+}
+
+// getMulti looks up the keys at the given indexes while holding the read lock
+// once.
+func (m *lockedMap) getMulti(idx []int, keys, conflicts []uint64,
+	values []interface{}, found []bool) {
+	now := m.clock.Now().Unix()
+	m.RLock()
+	for _, i := range idx {
+		if item, ok := m.data[keys[i]]; ok {
+			m.checkConflict(item, conflicts[i])
+			values[i], found[i] = item.valueFor(conflicts[i], now)
+		}
+	}
+	m.RUnlock()
+}
+
+// checkConflict reports the item to onConflict if it's another key than the
+// one with the given conflict hash.
+func (m *lockedMap) checkConflict(item storeItem, conflict uint64) {
+	if m.onConflict != nil && conflict != 0 && conflict != item.conflict {
+		m.onConflict(item.key)
+	}
+}
+
+// valueFor returns the value of the item if it matches the conflict hash and
+// hasn't expired at the given time.
+func (item storeItem) valueFor(conflict uint64, now int64) (interface{}, bool) {
 	if conflict != 0 && (conflict != item.conflict) {
 		return nil, false
 	}
 
 	// Handle expired items.
-	if item.expiration != 0 && time.Now().Unix() > item.expiration {
+	if item.expiration != 0 && now > item.expiration {
 		return nil, false
 	}
 	return item.value, true
@@ -150,6 +483,20 @@ func (m *lockedMap) Expiration(key uint64) int64 {
 	return m.data[key].expiration
 }
 
+func (m *lockedMap) Has(key uint64) bool {
+	m.RLock()
+	defer m.RUnlock()
+	_, ok := m.data[key]
+	return ok
+}
+
+func (m *lockedMap) Conflicts(key, conflict uint64) bool {
+	m.RLock()
+	defer m.RUnlock()
+	item, ok := m.data[key]
+	return ok && conflict != 0 && conflict != item.conflict
+}
+
 func (m *lockedMap) Set(i *Item) {
 	if i == nil {
 		// If the item is nil make this Set a no-op.
@@ -158,39 +505,56 @@ func (m *lockedMap) Set(i *Item) {
 
 	m.Lock()
 	defer m.Unlock()
+	m.set(i)
+}
+
+// set implements Set with the lock held, and returns the previous value of
+// the key, and whether it had one.
+func (m *lockedMap) set(i *Item) (interface{}, bool) {
 	item, ok := m.data[i.Key]
 
 	if ok {
 		// The item existed already. We need to check the conflict key and reject the
 		// update if they do not match. Only after that the expiration map is updated.
 		if i.Conflict != 0 && (i.Conflict != item.conflict) {
-			return
+			return nil, false
 		}
 		m.em.update(i.Key, i.Conflict, item.expiration, i.Expiration)
 	} else {
-		// The value is not in the map already. There's no need to return anything.
-		// Simply add the expiration map.
+		// The value is not in the map already. Simply add it to the expiration
+		// map.
 		m.em.add(i.Key, i.Conflict, i.Expiration)
 	}
 
+	m.replaced(item, ok, i.Key, i.Conflict)
 	m.data[i.Key] = storeItem{
 		key:        i.Key,
 		conflict:   i.Conflict,
 		value:      i.Value,
 		expiration: i.Expiration,
 	}
+	return item.value, ok
 }
 
-func (m *lockedMap) Del(key, conflict uint64) (uint64, interface{}) {
+// setMulti sets the items at the given indexes while holding the lock once.
+func (m *lockedMap) setMulti(idx []int, items []*Item) {
+	m.Lock()
+	defer m.Unlock()
+	for _, i := range idx {
+		m.set(items[i])
+	}
+}
+
+func (m *lockedMap) Del(key, conflict uint64) (uint64, interface{}, bool) {
 	m.Lock()
 	item, ok := m.data[key]
 	if !ok {
 		m.Unlock()
-		return 0, nil
+		return 0, nil, false
 	}
 	if conflict != 0 && (conflict != item.conflict) {
 		m.Unlock()
-		return 0, nil
+		return 0, nil, false
 	}
 
 	if item.expiration != 0 {
@@ -198,8 +562,87 @@ func (m *lockedMap) Del(key, conflict uint64) (uint64, interface{}) {
 	}
 
 	delete(m.data, key)
+	m.removed(item)
 	m.Unlock()
-	return item.conflict, item.value
+	return item.conflict, item.value, true
+}
+
+// delMulti deletes the keys at the given indexes while holding the lock once.
+func (m *lockedMap) delMulti(idx []int, keys, conflicts []uint64,
+	values []interface{}, found []bool) {
+	m.Lock()
+	defer m.Unlock()
+	for _, i := range idx {
+		key, conflict := keys[i], conflicts[i]
+		item, ok := m.data[key]
+		if !ok || (conflict != 0 && conflict != item.conflict) {
+			continue
+		}
+		if item.expiration != 0 {
+			m.em.del(key, item.expiration)
+		}
+		delete(m.data, key)
+		m.removed(item)
+		values[i], found[i] = item.value, true
+	}
+}
+
+func (m *lockedMap) Touch(key, conflict uint64, expiration int64) bool {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if !ok {
+		return false
+	}
+	if _, ok := item.valueFor(conflict, m.clock.Now().Unix()); !ok {
+		return false
+	}
+	m.setExpiration(item, expiration)
+	return true
+}
+
+// GetAndTouch also reports key conflicts, as it's a lookup like Get.
+func (m *lockedMap) GetAndTouch(key, conflict uint64, expiration int64) (interface{}, bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if !ok {
+		return nil, false
+	}
+	m.checkConflict(item, conflict)
+	value, ok := item.valueFor(conflict, m.clock.Now().Unix())
+	if !ok {
+		return nil, false
+	}
+	m.setExpiration(item, expiration)
+	return value, true
+}
+
+// setExpiration moves the item to the given expiration. It must be called with
+// the lock held.
+func (m *lockedMap) setExpiration(item storeItem, expiration int64) {
+	if item.expiration != 0 {
+		m.em.del(item.key, item.expiration)
+	}
+	m.em.add(item.key, item.conflict, expiration)
+	item.expiration = expiration
+	m.data[item.key] = item
+}
+
+func (m *lockedMap) DelExpired(key, conflict uint64, now int64) (interface{}, bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	if !ok || item.expiration == 0 || item.expiration > now {
+		return nil, false
+	}
+	if conflict != 0 && (conflict != item.conflict) {
+		return nil, false
+	}
+	m.em.del(key, item.expiration)
+	delete(m.data, key)
+	m.removed(item)
+	return item.value, true
 }
 
 func (m *lockedMap) Update(newItem *Item) (interface{}, bool) {
@@ -215,6 +658,7 @@ func (m *lockedMap) Update(newItem *Item) (interface{}, bool) {
 	}
 
 	m.em.update(newItem.Key, newItem.Conflict, item.expiration, newItem.Expiration)
+	m.replaced(item, true, newItem.Key, newItem.Conflict)
 	m.data[newItem.Key] = storeItem{
 		key:        newItem.Key,
 		conflict:   newItem.Conflict,
@@ -226,6 +670,24 @@ func (m *lockedMap) Update(newItem *Item) (interface{}, bool) {
 	return item.value, true
 }
 
+func (m *lockedMap) Compute(key, conflict uint64,
+	f func(value interface{}, ok bool) (interface{}, bool)) (interface{}, bool) {
+	m.Lock()
+	defer m.Unlock()
+	item, ok := m.data[key]
+	var value interface{}
+	if ok {
+		value, ok = item.valueFor(conflict, m.clock.Now().Unix())
+	}
+	newValue, write := f(value, ok)
+	if !ok || !write {
+		return nil, false
+	}
+	item.value = newValue
+	m.data[key] = item
+	return value, true
+}
+
 func (m *lockedMap) Clear(onEvict itemCallback) {
 	m.Lock()
 	i := &Item{}
@@ -238,5 +700,41 @@ func (m *lockedMap) Clear(onEvict itemCallback) {
 		}
 	}
 	m.data = make(map[uint64]storeItem)
+	atomic.StoreUint64(&m.fingerprint, 0)
 	m.Unlock()
 }
+
+// replaced accounts in the fingerprint for the key and conflict hash taking
+// the place of old, if ok. It must be called with the lock held.
+func (m *lockedMap) replaced(old storeItem, ok bool, key, conflict uint64) {
+	delta := fingerprintOf(key, conflict)
+	if ok {
+		delta -= fingerprintOf(old.key, old.conflict)
+	}
+	if delta != 0 {
+		atomic.AddUint64(&m.fingerprint, delta)
+	}
+}
+
+// removed accounts in the fingerprint for the item leaving. It must be called
+// with the lock held.
+func (m *lockedMap) removed(item storeItem) {
+	atomic.AddUint64(&m.fingerprint, -fingerprintOf(item.key, item.conflict))
+}
+
+func (m *lockedMap) Len() int {
+	m.RLock()
+	l := len(m.data)
+	m.RUnlock()
+	return l
+}
+
+func (m *lockedMap) items() []storeItem {
+	m.RLock()
+	defer m.RUnlock()
+	items := make([]storeItem, 0, len(m.data))
+	for _, item := range m.data {
+		items = append(items, item)
+	}
+	return items
+}
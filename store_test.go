@@ -1,6 +1,11 @@
 package ristretto
 
 import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -76,6 +81,68 @@ func TestStoreClear(t *testing.T) {
 	}
 }
 
+func TestStoreGetMulti(t *testing.T) {
+	s := newStore()
+	for i := 0; i < 1000; i += 2 {
+		key, conflict := z.KeyToHash(i)
+		s.Set(&Item{Key: key, Conflict: conflict, Value: i})
+	}
+	keys := make([]uint64, 1000)
+	conflicts := make([]uint64, 1000)
+	for i := range keys {
+		keys[i], conflicts[i] = z.KeyToHash(i)
+	}
+	values := make([]interface{}, 1000)
+	found := make([]bool, 1000)
+	s.GetMulti(keys, conflicts, values, found)
+	for i := range keys {
+		require.Equal(t, i%2 == 0, found[i])
+		if found[i] {
+			require.Equal(t, i, values[i])
+		}
+	}
+}
+
+func TestStoreLen(t *testing.T) {
+	s := newStore()
+	for i := 0; i < 1000; i++ {
+		key, conflict := z.KeyToHash(i)
+		s.Set(&Item{Key: key, Conflict: conflict, Value: i})
+	}
+	require.Equal(t, 1000, s.Len())
+	key, conflict := z.KeyToHash(1)
+	s.Del(key, conflict)
+	require.Equal(t, 999, s.Len())
+	s.Clear(nil)
+	require.Equal(t, 0, s.Len())
+}
+
+func TestStoreRange(t *testing.T) {
+	s := newStore()
+	for i := 0; i < 1000; i++ {
+		s.Set(&Item{Key: uint64(i), Value: i})
+	}
+	seen := make(map[uint64]bool)
+	s.Range(func(item storeItem) bool {
+		require.Equal(t, int(item.key), item.value)
+		seen[item.key] = true
+		// The shard being visited isn't locked.
+		s.Del(item.key, 0)
+		return true
+	})
+	require.Len(t, seen, 1000)
+	require.Zero(t, s.Len())
+
+	s.Set(&Item{Key: 1})
+	s.Set(&Item{Key: 2})
+	visited := 0
+	s.Range(func(item storeItem) bool {
+		visited++
+		return false
+	})
+	require.Equal(t, 1, visited)
+}
+
 func TestStoreUpdate(t *testing.T) {
 	s := newStore()
 	key, conflict := z.KeyToHash(1)
@@ -120,13 +187,13 @@ func TestStoreUpdate(t *testing.T) {
 
 func TestStoreCollision(t *testing.T) {
 	s := newShardedMap()
-	s.shards[1].Lock()
-	s.shards[1].data[1] = storeItem{
+	s.shard(1).Lock()
+	s.shard(1).data[1] = storeItem{
 		key:      1,
 		conflict: 0,
 		value:    1,
 	}
-	s.shards[1].Unlock()
+	s.shard(1).Unlock()
 	val, ok := s.Get(1, 1)
 	require.False(t, ok)
 	require.Nil(t, val)
@@ -183,6 +250,217 @@ func TestStoreExpiration(t *testing.T) {
 	require.Equal(t, int64(0), ttl)
 }
 
+func TestStoreTouch(t *testing.T) {
+	s := newStore()
+	require.False(t, s.Touch(1, 0, 0))
+
+	now := time.Now().Unix()
+	s.Set(&Item{Key: 1, Conflict: 1, Value: 1, Expiration: now + 10})
+	require.False(t, s.Touch(1, 2, now+100))
+	require.True(t, s.Touch(1, 1, now+100))
+	require.Equal(t, now+100, s.Expiration(1))
+	val, ok := s.Get(1, 1)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.True(t, s.Touch(1, 1, 0))
+	require.Equal(t, int64(0), s.Expiration(1))
+
+	// Expired items stay expired.
+	s.Set(&Item{Key: 2, Value: 2, Expiration: now - 10})
+	require.False(t, s.Touch(2, 0, now+100))
+	_, ok = s.Get(2, 0)
+	require.False(t, ok)
+}
+
+func TestStoreGetAndTouch(t *testing.T) {
+	s := newStore()
+	_, ok := s.GetAndTouch(1, 0, 0)
+	require.False(t, ok)
+
+	now := time.Now().Unix()
+	s.Set(&Item{Key: 1, Conflict: 1, Value: 1, Expiration: now + 10})
+	_, ok = s.GetAndTouch(1, 2, now+100)
+	require.False(t, ok)
+	require.Equal(t, now+10, s.Expiration(1))
+	val, ok := s.GetAndTouch(1, 1, now+100)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, now+100, s.Expiration(1))
+
+	s.Set(&Item{Key: 2, Value: 2, Expiration: now - 10})
+	_, ok = s.GetAndTouch(2, 0, now+100)
+	require.False(t, ok)
+	require.Equal(t, now-10, s.Expiration(2))
+}
+
+func TestStoreDelExpired(t *testing.T) {
+	s := newStore()
+	now := time.Now().Unix()
+	s.Set(&Item{Key: 1, Value: 1, Expiration: now - 1})
+	s.Set(&Item{Key: 2, Value: 2, Expiration: now + 10})
+	s.Set(&Item{Key: 3, Value: 3})
+
+	_, ok := s.DelExpired(2, 0, now)
+	require.False(t, ok)
+	_, ok = s.DelExpired(3, 0, now)
+	require.False(t, ok)
+	val, ok := s.DelExpired(1, 0, now)
+	require.True(t, ok)
+	require.Equal(t, 1, val)
+	require.Equal(t, 2, s.Len())
+}
+
+func TestStoreShards(t *testing.T) {
+	require.True(t, defaultShards() >= minShards)
+	require.True(t, defaultShards() >= 4*runtime.GOMAXPROCS(0))
+	require.Zero(t, defaultShards()&(defaultShards()-1))
+
+	for _, shards := range []int{1, 4, 256} {
+		s := newShardedMapWith(systemClock{}, shards)
+		for key := uint64(0); key < 100; key++ {
+			s.Set(&Item{Key: key, Value: key})
+		}
+		for i, shard := range s.shards {
+			for key := range shard.data {
+				require.Equal(t, uint64(i), s.index(key))
+			}
+		}
+		require.Equal(t, 100, s.Len())
+		seen := make(map[uint64]bool)
+		s.Range(func(item storeItem) bool {
+			seen[item.key] = true
+			return true
+		})
+		require.Len(t, seen, 100)
+	}
+}
+
+func TestStoreShardSeed(t *testing.T) {
+	// Keys with the same low bits don't end up in the same shard.
+	s := newShardedMapWith(systemClock{}, 256)
+	used := make(map[uint64]bool)
+	for key := uint64(0); key < 100; key++ {
+		used[s.index(key<<8)] = true
+	}
+	require.True(t, len(used) > 50)
+
+	// And stores pick different seeds.
+	other := newShardedMapWith(systemClock{}, 256)
+	require.NotEqual(t, s.seed, other.seed)
+	same := 0
+	for key := uint64(0); key < 100; key++ {
+		if s.index(key) == other.index(key) {
+			same++
+		}
+	}
+	require.True(t, same < 50)
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	s := newShardedMapWith(systemClock{}, 16)
+	now := time.Now().Unix()
+	var wrong int32
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 5000; i++ {
+				key := uint64(r.Intn(200))
+				switch r.Intn(8) {
+				case 0:
+					s.Set(&Item{Key: key, Value: key, Expiration: now + 60})
+				case 1:
+					s.Del(key, 0)
+				case 2:
+					s.Update(&Item{Key: key, Value: key})
+				case 3:
+					s.Touch(key, 0, now+120)
+				case 4:
+					s.Len()
+				case 5:
+					s.Range(func(item storeItem) bool {
+						return item.value.(uint64) == item.key
+					})
+				default:
+					if val, ok := s.Get(key, 0); ok && val != key {
+						atomic.AddInt32(&wrong, 1)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Zero(t, atomic.LoadInt32(&wrong))
+}
+
+func TestStoreCleanupAfterTouch(t *testing.T) {
+	s := newShardedMap()
+	p := newDefaultPolicy(100, 10)
+	defer p.Close()
+	p.Add(1, 1)
+	now := time.Now().Unix()
+	s.Set(&Item{Key: 1, Value: 1, Expiration: now + 3600})
+	// The key is still in the bucket being cleaned up, as after a Touch
+	// racing the cleanup.
+	s.expiryMap.shard(1).add(1, 0, cleanupBucket(now))
+
+	evicted := 0
+	s.Cleanup(p, func(*Item) { evicted++ })
+	require.Zero(t, evicted)
+	_, ok := s.Get(1, 0)
+	require.True(t, ok)
+	require.True(t, p.Has(1))
+}
+
+func TestStoreCleanupOnce(t *testing.T) {
+	s := newShardedMap()
+	p := newDefaultPolicy(1000, 1000)
+	defer p.Close()
+	now := time.Now().Unix()
+	expired := now - bucketDurationSecs
+	for key := uint64(1); key <= 100; key++ {
+		p.Add(key, 1)
+		s.Set(&Item{Key: key, Value: key, Expiration: expired})
+		s.expiryMap.shard(key).add(key, 0, cleanupBucket(now))
+	}
+
+	var mu sync.Mutex
+	expirations := make(map[uint64]int)
+	onExpire := func(i *Item) {
+		mu.Lock()
+		expirations[i.Key]++
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Cleanup(p, onExpire)
+		}()
+	}
+	// Renew the even keys while they're being cleaned up.
+	renewed := make(map[uint64]bool)
+	for key := uint64(2); key <= 100; key += 2 {
+		if _, ok := s.Update(&Item{Key: key, Value: key}); ok {
+			renewed[key] = true
+		}
+	}
+	wg.Wait()
+
+	for key := uint64(1); key <= 100; key++ {
+		_, ok := s.Get(key, 0)
+		if renewed[key] && ok {
+			require.Zero(t, expirations[key], "key %d", key)
+		} else {
+			require.False(t, ok)
+			require.Equal(t, 1, expirations[key], "key %d", key)
+		}
+	}
+}
+
 func BenchmarkStoreGet(b *testing.B) {
 	s := newStore()
 	key, conflict := z.KeyToHash(1)
@@ -236,3 +514,23 @@ func BenchmarkStoreUpdate(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkStoreShards(b *testing.B) {
+	for _, shards := range []int{1, 16, 256, 1024} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s := newStoreWith(systemClock{}, shards, nil)
+			var seed int64
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+				for pb.Next() {
+					key := uint64(r.Intn(1 << 16))
+					if r.Intn(4) == 0 {
+						s.Set(&Item{Key: key, Value: key})
+					} else {
+						s.Get(key, 0)
+					}
+				}
+			})
+		})
+	}
+}
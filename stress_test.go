@@ -50,6 +50,71 @@ func TestStressSetGet(t *testing.T) {
 	require.Equal(t, 1.0, c.Metrics.Ratio())
 }
 
+func TestStressPanickingCallbacks(t *testing.T) {
+	panicky := func() {
+		if rand.Intn(2) == 0 {
+			panic("callback")
+		}
+	}
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            100,
+		IgnoreInternalCost: true,
+		BufferItems:        64,
+		Metrics:            true,
+		OnEvict:            func(item *Item) { panicky() },
+		OnReject:           func(item *Item) { panicky() },
+		OnExit:             func(val interface{}) { panicky() },
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	wg := &sync.WaitGroup{}
+	for g := 0; g < runtime.GOMAXPROCS(0); g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for a := 0; a < 5000; a++ {
+				k := r.Intn(500)
+				switch r.Intn(4) {
+				case 0:
+					c.Del(k)
+				default:
+					c.Set(k, k, int64(r.Intn(5)+1))
+				}
+			}
+		}(g)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for a := 0; a < 5000; a++ {
+				k := r.Intn(500)
+				if val, ok := c.Get(k); ok && val.(int) != k {
+					err = fmt.Errorf("expected %d but got %d", k, val.(int))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.NoError(t, err)
+	c.Wait()
+	require.NotZero(t, c.Metrics.CallbackPanics())
+
+	// The policy and the store hold the same keys, and the used cost is the
+	// sum of their costs.
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	defer p.Unlock()
+	var used int64
+	for key, cost := range p.evict.keyCosts {
+		require.True(t, c.store.Has(key), "ghost %d", key)
+		used += cost
+	}
+	require.Equal(t, used, p.evict.used)
+	require.Equal(t, len(p.evict.keyCosts), c.store.Len())
+}
+
 func TestStressHitRatio(t *testing.T) {
 	key := sim.NewZipfian(1.0001, 1, 1000)
 	c, err := NewCache(&Config{
@@ -149,3 +214,82 @@ func (h *clairvoyantHeap) Pop() interface{} {
 	*h = old[0 : n-1]
 	return x
 }
+
+// resurrectingPolicy is an LRU Policy that, against the contract of Access,
+// starts tracking the keys it's told about, even the ones deleted from the
+// cache after their Get.
+type resurrectingPolicy struct {
+	*lruPolicy
+}
+
+func (p resurrectingPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		p.Add(key, 1)
+	}
+}
+
+func TestStressDelAccess(t *testing.T) {
+	// The Gets of a key reach the policy after the Dels racing with them.
+	// Whatever the policy makes of them, the costs of the policy stay those
+	// of the items in the store.
+	tests := []struct {
+		name   string
+		policy func(numCounters, maxCost int64) Policy
+	}{
+		{"default", nil},
+		{"lru", NewLRUPolicy},
+		{"lirs", NewLIRSPolicy},
+		{"wtinylfu", NewWTinyLFUPolicy},
+		{"resurrecting", func(numCounters, maxCost int64) Policy {
+			return resurrectingPolicy{NewLRUPolicy(numCounters, maxCost).(*lruPolicy)}
+		}},
+	}
+	cost := func(key int) int64 { return int64(key%4 + 1) }
+	for _, test := range tests {
+		c, err := NewCache(&Config{
+			NumCounters:        1000,
+			MaxCost:            20,
+			IgnoreInternalCost: true,
+			BufferItems:        4,
+			Policy:             test.policy,
+		})
+		require.NoError(t, err)
+
+		wg := &sync.WaitGroup{}
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(int64(g)))
+				for a := 0; a < 5000; a++ {
+					k := r.Intn(16)
+					switch r.Intn(3) {
+					case 0:
+						c.Del(k)
+					case 1:
+						c.Set(k, k, cost(k))
+					default:
+						c.Get(k)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		c.Wait()
+		c.Flush()
+
+		p := c.policy.(*defaultPolicy)
+		p.Lock()
+		var used int64
+		for key, keyCost := range p.evict.keyCosts {
+			require.True(t, c.store.Has(key), "%s: ghost %d", test.name, key)
+			require.Equal(t, cost(int(key)), keyCost, test.name)
+			used += keyCost
+		}
+		require.Equal(t, used, p.evict.used, test.name)
+		require.Equal(t, len(p.evict.keyCosts), c.store.Len(), test.name)
+		require.LessOrEqual(t, used, int64(20), test.name)
+		p.Unlock()
+		c.Close()
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// tagIndex maps the tags given to SetWithOptions to the keys in the cache that
+// carry them, and back. It holds one entry per tag of every key, and a key is
+// only in it while it's in the store.
+type tagIndex struct {
+	// n is the number of keys in tags, read without the lock so that caches
+	// not using tags don't take it. It comes first to be 64-bit aligned.
+	n int64
+	sync.Mutex
+	// keys has the key and conflict hashes of the keys with every tag.
+	keys map[string]map[uint64]uint64
+	// tags has the tags of every key with any.
+	tags map[uint64][]string
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[uint64]uint64),
+		tags: make(map[uint64][]string),
+	}
+}
+
+// set replaces the tags of the key with tags.
+func (t *tagIndex) set(key, conflict uint64, tags []string) {
+	if len(tags) == 0 && atomic.LoadInt64(&t.n) == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.remove(key)
+	if len(tags) == 0 {
+		return
+	}
+	own := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			keys = make(map[uint64]uint64)
+			t.keys[tag] = keys
+		}
+		if _, dup := keys[key]; dup {
+			continue
+		}
+		keys[key] = conflict
+		own = append(own, tag)
+	}
+	t.tags[key] = own
+	atomic.AddInt64(&t.n, 1)
+}
+
+// has returns whether the key has any tags.
+func (t *tagIndex) has(key uint64) bool {
+	if atomic.LoadInt64(&t.n) == 0 {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	_, ok := t.tags[key]
+	return ok
+}
+
+// del removes the key and its tags.
+func (t *tagIndex) del(key uint64) {
+	if atomic.LoadInt64(&t.n) == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.remove(key)
+}
+
+// remove implements del. The caller must hold the lock.
+func (t *tagIndex) remove(key uint64) {
+	tags, ok := t.tags[key]
+	if !ok {
+		return
+	}
+	for _, tag := range tags {
+		keys := t.keys[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.tags, key)
+	atomic.AddInt64(&t.n, -1)
+}
+
+// of returns the tags of the key.
+func (t *tagIndex) of(key uint64) []string {
+	if atomic.LoadInt64(&t.n) == 0 {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.tags[key]
+}
+
+// count returns the number of keys with the tag.
+func (t *tagIndex) count(tag string) int {
+	if atomic.LoadInt64(&t.n) == 0 {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	return len(t.keys[tag])
+}
+
+// tagged returns the key and conflict hashes of the keys with the tag.
+func (t *tagIndex) tagged(tag string) (keys, conflicts []uint64) {
+	t.Lock()
+	defer t.Unlock()
+	for key, conflict := range t.keys[tag] {
+		keys = append(keys, key)
+		conflicts = append(conflicts, conflict)
+	}
+	return keys, conflicts
+}
+
+// pairs returns the number of tags of all the keys.
+func (t *tagIndex) pairs() int {
+	t.Lock()
+	defer t.Unlock()
+	n := 0
+	for _, tags := range t.tags {
+		n += len(tags)
+	}
+	return n
+}
+
+func (t *tagIndex) clear() {
+	t.Lock()
+	defer t.Unlock()
+	t.keys = make(map[string]map[uint64]uint64)
+	t.tags = make(map[uint64][]string)
+	atomic.StoreInt64(&t.n, 0)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTagIndex(t *testing.T) {
+	idx := newTagIndex()
+	idx.set(1, 10, []string{"a", "b", "a"})
+	idx.set(2, 20, []string{"b"})
+	require.Equal(t, 3, idx.pairs())
+	require.True(t, idx.has(1))
+
+	keys, conflicts := idx.tagged("b")
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i] < conflicts[j] })
+	require.Equal(t, []uint64{1, 2}, keys)
+	require.Equal(t, []uint64{10, 20}, conflicts)
+
+	// Setting the tags again replaces them.
+	idx.set(1, 10, []string{"c"})
+	keys, _ = idx.tagged("a")
+	require.Empty(t, keys)
+	require.Equal(t, 2, idx.pairs())
+
+	idx.set(1, 10, nil)
+	require.False(t, idx.has(1))
+	idx.del(2)
+	idx.del(3)
+	require.Zero(t, idx.pairs())
+	require.Empty(t, idx.keys)
+}
+
+func TestCacheInvalidateTag(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{Tags: []string{"tenant:1", "schema:v7"}}))
+	require.True(t, c.SetWithOptions(2, 2, 1, SetOptions{Tags: []string{"tenant:1"}}))
+	require.True(t, c.SetWithOptions(3, 3, 1, SetOptions{Tags: []string{"tenant:2", "schema:v7"}}))
+	require.True(t, c.Set(4, 4, 1))
+	c.Wait()
+	require.Equal(t, 5, c.tags.pairs())
+
+	require.Equal(t, 2, c.InvalidateTag("tenant:1"))
+	c.Wait()
+	for key, ok := range map[int]bool{1: false, 2: false, 3: true, 4: true} {
+		_, found := c.Get(key)
+		require.Equal(t, ok, found, "key %d", key)
+	}
+	require.Equal(t, int64(2), c.UsedCost())
+	require.Equal(t, 2, c.tags.pairs())
+	require.Zero(t, c.InvalidateTag("tenant:1"))
+
+	// A Set without tags removes the ones the key had.
+	require.True(t, c.Set(3, 3, 1))
+	c.Wait()
+	require.Zero(t, c.InvalidateTag("schema:v7"))
+	require.Zero(t, c.tags.pairs())
+
+	c.Close()
+	require.False(t, c.SetWithOptions(5, 5, 1, SetOptions{Tags: []string{"tenant:1"}}))
+	require.Zero(t, c.InvalidateTag("tenant:1"))
+}
+
+func TestCacheTagsLeaveWithItems(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Evicted items don't keep their tags.
+	for i := 0; i < 100; i++ {
+		c.SetWithOptions(i, i, 1, SetOptions{Tags: []string{"a", "b"}})
+	}
+	c.Wait()
+	require.Equal(t, 2*c.Len(), c.tags.pairs())
+	require.True(t, c.Len() <= 10)
+
+	// Neither do deleted or expired ones.
+	c.Clear()
+	require.Zero(t, c.tags.pairs())
+	require.True(t, c.SetWithOptions(1, 1, 1, SetOptions{Tags: []string{"a"}}))
+	require.True(t, c.SetWithOptions(2, 2, 1, SetOptions{TTL: time.Second, Tags: []string{"a"}}))
+	c.Wait()
+	c.Del(1)
+	clock.Add(10 * time.Second)
+	c.Wait()
+	require.Zero(t, c.tags.pairs())
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotFound is returned by a Config.Loader for a key that isn't in the
+// underlying store. ReadThrough reports it as a miss rather than an error.
+var ErrNotFound = errors.New("ristretto: not found")
+
+// writeLockStripes is the number of locks the keys of SetThrough are spread
+// over.
+const writeLockStripes = 64
+
+// writeLocks serializes the SetThroughs of the same key, so that the cache and
+// the underlying store end up with the same value.
+type writeLocks [writeLockStripes]sync.Mutex
+
+func (l *writeLocks) lock(key uint64) *sync.Mutex {
+	return &l[key%writeLockStripes]
+}
+
+// ReadThrough returns the value of the key if it's in the cache. Otherwise it
+// calls Config.Loader, Sets the value it returns along with its cost, and
+// returns the value, sharing the load with concurrent calls like
+// GetOrCompute. It returns false and no error if the loader returns
+// ErrNotFound, and false along with a *LoadError for any other; neither
+// outcome is cached. A nil key gets ErrInvalidKey.
+func (c *Cache) ReadThrough(key interface{}) (interface{}, bool, error) {
+	switch {
+	case c == nil || c.loader == nil:
+		return nil, false, errors.New("ristretto: ReadThrough requires Config.Loader")
+	case key == nil:
+		return nil, false, ErrInvalidKey
+	}
+	value, err := c.GetOrCompute(key, func() (interface{}, int64, error) {
+		return c.loader(key)
+	})
+	if le, ok := err.(*LoadError); ok && le.Err == ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// SetThrough writes the key-value pair to the underlying store with
+// Config.Writer, and then Sets it in the cache. If the writer fails, the value
+// isn't cached and the key is deleted from the cache, as the store may or may
+// not have changed, and the error is returned as a *WriteError. The
+// SetThroughs of the same key are serialized, so that the last value written
+// is also the one cached. Set and Del don't go through the writer, and aren't
+// serialized with SetThrough.
+//
+// Like Set, the value still has to be admitted by the policy, so a successful
+// SetThrough may leave the key out of the cache: the next ReadThrough loads
+// it. A closed cache only writes the value, and a nil key gets ErrInvalidKey.
+func (c *Cache) SetThrough(key, value interface{}, cost int64) error {
+	switch {
+	case c == nil || c.writer == nil:
+		return errors.New("ristretto: SetThrough requires Config.Writer")
+	case key == nil:
+		return ErrInvalidKey
+	case c.isFrozen():
+		return ErrFrozen
+	case c.isClosed():
+		return c.write(key, value)
+	}
+	keyHash, conflictHash := c.keyToHash(key)
+	mu := c.writeLocks.lock(keyHash)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := c.write(key, value); err != nil {
+		c.del(keyHash, conflictHash)
+		return err
+	}
+	setOK := c.setHashed(key, keyHash, conflictHash, value, cost, c.defaultTTL, false, SetOptions{})
+	if !setOK {
+		// Don't leave an older value behind.
+		c.del(keyHash, conflictHash)
+	}
+	return nil
+}
+
+// write writes the key-value pair with Config.Writer, returning its error as a
+// WriteError.
+func (c *Cache) write(key, value interface{}) error {
+	if err := c.writer(key, value); err != nil {
+		return &WriteError{Key: key, Err: err}
+	}
+	return nil
+}
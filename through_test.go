@@ -0,0 +1,172 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// throughStore is the store behind a cache in the tests of ReadThrough and
+// SetThrough. Writes fail while fail is set.
+type throughStore struct {
+	MapBackingStore
+	fail  int32
+	loads int32
+}
+
+func newThroughCache(t *testing.T, s *throughStore) *Cache {
+	s.data = make(map[interface{}]interface{})
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			atomic.AddInt32(&s.loads, 1)
+			if key == "broken" {
+				return nil, 0, errors.New("load failed")
+			}
+			value, ok := s.Get(key)
+			if !ok {
+				return nil, 0, ErrNotFound
+			}
+			return value, 1, nil
+		},
+		Writer: func(key, value interface{}) error {
+			if atomic.LoadInt32(&s.fail) == 1 {
+				return errors.New("write failed")
+			}
+			s.Set(key, value)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheReadThrough(t *testing.T) {
+	s := &throughStore{}
+	c := newThroughCache(t, s)
+	defer c.Close()
+	s.Set(1, "one")
+
+	val, ok, err := c.ReadThrough(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	// The value is cached.
+	val, ok, err = c.ReadThrough(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "one", val)
+	require.Equal(t, int32(1), atomic.LoadInt32(&s.loads))
+
+	// Missing keys and errors are told apart, and neither is cached.
+	for i := 0; i < 2; i++ {
+		_, ok, err = c.ReadThrough(2)
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, ok, err = c.ReadThrough("broken")
+		var le *LoadError
+		require.True(t, errors.As(err, &le))
+		require.Equal(t, "broken", le.Key)
+		require.EqualError(t, le.Err, "load failed")
+		require.False(t, ok)
+	}
+	require.Equal(t, int32(5), atomic.LoadInt32(&s.loads))
+}
+
+func TestCacheSetThrough(t *testing.T) {
+	s := &throughStore{}
+	c := newThroughCache(t, s)
+	defer c.Close()
+
+	require.NoError(t, c.SetThrough(1, "a", 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+	val, _ = s.Get(1)
+	require.Equal(t, "a", val)
+
+	// A failed write caches nothing and drops the cached value.
+	atomic.StoreInt32(&s.fail, 1)
+	for _, key := range []int{1, 2} {
+		err := c.SetThrough(key, "b", 1)
+		var we *WriteError
+		require.True(t, errors.As(err, &we))
+		require.Equal(t, key, we.Key)
+		require.EqualError(t, we.Err, "write failed")
+	}
+	c.Wait()
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	atomic.StoreInt32(&s.fail, 0)
+	val, ok, err := c.ReadThrough(1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "a", val)
+
+	// The cache and the store agree on the last value written.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				require.NoError(t, c.SetThrough(3, g*1000+i, 1))
+			}
+		}(g)
+	}
+	wg.Wait()
+	c.Wait()
+	cached, ok := c.Get(3)
+	require.True(t, ok)
+	stored, _ := s.Get(3)
+	require.Equal(t, stored, cached)
+}
+
+func TestCacheThroughConfig(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	_, _, err = c.ReadThrough(1)
+	require.Error(t, err)
+	require.Error(t, c.SetThrough(1, 1, 1))
+}
+
+func TestCacheThroughInvalidKey(t *testing.T) {
+	s := &throughStore{}
+	c := newThroughCache(t, s)
+	defer c.Close()
+	_, _, err := c.ReadThrough(nil)
+	require.Equal(t, ErrInvalidKey, err)
+	require.Equal(t, ErrInvalidKey, c.SetThrough(nil, 1, 1))
+	require.Zero(t, s.Len())
+	require.Zero(t, atomic.LoadInt32(&s.loads))
+}
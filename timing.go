@@ -0,0 +1,238 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is where a cache gets the time from, both to tell when items expire and
+// to pace the cleanup of expired items. See Config.Clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTicker returns a Ticker that ticks every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers the ticks of a Clock, like a time.Ticker.
+type Ticker interface {
+	// C returns the channel the ticks are delivered on.
+	C() <-chan time.Time
+	// Stop turns off the ticker. No more ticks are sent after Stop returns.
+	Stop()
+}
+
+// systemClock is the Clock used by default, which reads the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// defaultClockPrecision is how often the time read by the cache is refreshed,
+// unless Config.ClockPrecision is set.
+const defaultClockPrecision = 10 * time.Millisecond
+
+// coarseClock is the Clock the cache reads on the paths of Get and Set. For the
+// system clock, it caches the time, refreshed by a ticker every precision, so
+// that reading it is an atomic load rather than a call to time.Now; other
+// clocks, such as a MockClock, or a precision that isn't positive, are read as
+// is. Tickers come from the underlying clock.
+type coarseClock struct {
+	clock Clock
+	// nanos is the time of the last tick in Unix nanoseconds, if ticker is
+	// set.
+	nanos  int64
+	ticker Ticker
+	stop   chan struct{}
+}
+
+func newCoarseClock(clock Clock, precision time.Duration) *coarseClock {
+	cc := &coarseClock{clock: clock}
+	if _, ok := clock.(systemClock); ok && precision > 0 {
+		cc.nanos = clock.Now().UnixNano()
+		cc.ticker = clock.NewTicker(precision)
+		cc.stop = make(chan struct{})
+		go cc.run()
+	}
+	return cc
+}
+
+func (cc *coarseClock) run() {
+	for {
+		select {
+		case <-cc.ticker.C():
+			// The tick itself may have waited in the channel.
+			atomic.StoreInt64(&cc.nanos, cc.clock.Now().UnixNano())
+		case <-cc.stop:
+			return
+		}
+	}
+}
+
+func (cc *coarseClock) Now() time.Time {
+	if cc.ticker == nil {
+		return cc.clock.Now()
+	}
+	return time.Unix(0, atomic.LoadInt64(&cc.nanos))
+}
+
+func (cc *coarseClock) NewTicker(d time.Duration) Ticker {
+	return cc.clock.NewTicker(d)
+}
+
+// now returns the time in Unix seconds.
+func (cc *coarseClock) now() int64 {
+	if cc.ticker == nil {
+		return cc.clock.Now().Unix()
+	}
+	return atomic.LoadInt64(&cc.nanos) / int64(time.Second)
+}
+
+// close stops the ticker. The clock can still be read, but isn't refreshed.
+func (cc *coarseClock) close() {
+	if cc == nil || cc.ticker == nil {
+		return
+	}
+	cc.ticker.Stop()
+	// Wait for run to return, so that the clock doesn't move past close.
+	cc.stop <- struct{}{}
+}
+
+// MockClock is a Clock that only moves forward when Add is called, so that
+// expiration can be tested without waiting for it. It's safe for concurrent
+// use.
+type MockClock struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*mockTicker
+}
+
+// NewMockClock returns a MockClock set to now.
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+// Now returns the time the clock is set to.
+func (c *MockClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+// NewTicker returns a Ticker that ticks whenever the clock moves past a
+// multiple of d from now.
+func (c *MockClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("ristretto: non-positive interval for NewTicker")
+	}
+	c.Lock()
+	defer c.Unlock()
+	t := &mockTicker{
+		clock:  c,
+		c:      make(chan time.Time),
+		stop:   make(chan struct{}),
+		period: d,
+		next:   c.now.Add(d),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Add moves the clock forward by d. The tickers due along the way tick in
+// order, with the clock set to the time of each tick, and Add only returns
+// once every tick has been received, so that a cache has started to act on
+// the last tick by then.
+func (c *MockClock) Add(d time.Duration) {
+	c.Lock()
+	target := c.now.Add(d)
+	c.Unlock()
+	for {
+		c.Lock()
+		var due *mockTicker
+		for _, t := range c.tickers {
+			if !t.next.After(target) && (due == nil || t.next.Before(due.next)) {
+				due = t
+			}
+		}
+		if due == nil {
+			c.now = target
+			c.Unlock()
+			return
+		}
+		c.now = due.next
+		due.next = due.next.Add(due.period)
+		now := c.now
+		c.Unlock()
+		// Block without the lock held, as the receiver is likely to call
+		// Now.
+		select {
+		case due.c <- now:
+		case <-due.stop:
+		}
+	}
+}
+
+func (c *MockClock) remove(t *mockTicker) {
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.tickers {
+		if c.tickers[i] == t {
+			c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type mockTicker struct {
+	clock    *MockClock
+	c        chan time.Time
+	stop     chan struct{}
+	stopOnce sync.Once
+	period   time.Duration
+	next     time.Time
+}
+
+func (t *mockTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *mockTicker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		t.clock.remove(t)
+	})
+}
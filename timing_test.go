@@ -0,0 +1,107 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockClockNow(t *testing.T) {
+	start := time.Unix(1e9, 0)
+	clock := NewMockClock(start)
+	require.Equal(t, start, clock.Now())
+	clock.Add(time.Minute)
+	require.Equal(t, start.Add(time.Minute), clock.Now())
+}
+
+func TestMockClockTicker(t *testing.T) {
+	start := time.Unix(1e9, 0)
+	clock := NewMockClock(start)
+	fast := clock.NewTicker(time.Second)
+	slow := clock.NewTicker(2 * time.Second)
+
+	var ticks []time.Time
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(ticks) < 3 {
+			select {
+			case tick := <-fast.C():
+				require.Equal(t, tick, clock.Now())
+				ticks = append(ticks, tick)
+			case tick := <-slow.C():
+				ticks = append(ticks, tick)
+			}
+		}
+	}()
+	clock.Add(2500 * time.Millisecond)
+	<-done
+	// The ticks at the same time may come in either order.
+	require.Equal(t, start.Add(time.Second), ticks[0])
+	require.Equal(t, start.Add(2*time.Second), ticks[1])
+	require.Equal(t, start.Add(2*time.Second), ticks[2])
+	require.Equal(t, start.Add(2500*time.Millisecond), clock.Now())
+
+	// Stopped tickers don't tick, and don't hold up Add.
+	fast.Stop()
+	slow.Stop()
+	fast.Stop()
+	clock.Add(time.Minute)
+	select {
+	case <-fast.C():
+		t.Fatal("stopped ticker ticked")
+	default:
+	}
+}
+
+func TestCoarseClock(t *testing.T) {
+	cc := newCoarseClock(systemClock{}, time.Millisecond)
+	before := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	now := cc.Now()
+	require.True(t, now.After(before), "the clock didn't move")
+	require.False(t, now.After(time.Now()))
+	require.Equal(t, now.Unix(), cc.now())
+
+	// A closed clock still reads, but stops moving.
+	cc.close()
+	now = cc.Now()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, now, cc.Now())
+
+	// Other clocks, and a negative precision, are read as is.
+	mock := NewMockClock(time.Unix(1e9, 0))
+	cc = newCoarseClock(mock, time.Millisecond)
+	defer cc.close()
+	mock.Add(time.Second)
+	require.Equal(t, mock.Now(), cc.Now())
+	require.Equal(t, int64(1e9+1), cc.now())
+	cc = newCoarseClock(systemClock{}, -1)
+	defer cc.close()
+	before = time.Now()
+	require.False(t, cc.Now().Before(before))
+}
+
+func TestMockClockTickerInterval(t *testing.T) {
+	clock := NewMockClock(time.Unix(1e9, 0))
+	require.Panics(t, func() {
+		clock.NewTicker(0)
+	})
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Tracer is told about the operations of a cache, set as Config.Tracer, to
+// turn them into spans of a tracing library such as OpenTelemetry without the
+// cache depending on it.
+//
+// Start is called when an operation starts, with its name and its key, and
+// returns the function called when it ends. The operations are "get" for Get,
+// GetUint, GetOrCompute and ReadThrough, "set" for the Sets, "del" for Del and
+// DelUint, and "load" for the loaders of GetOrCompute and ReadThrough. A load
+// starts and ends within the get that missed, unless it refreshes a stale
+// value in the background. The end function is passed whether the get found
+// the key in the cache, the Set was accepted, the Del found the key or the
+// load returned a value, along with the error of the get or the load, if any.
+//
+// The key is the string itself for string and []byte keys, formatted with
+// fmt.Sprint for the others, or the decimal hash when the original key isn't
+// known, such as for SetUint. Both functions are called on the goroutine of
+// the operation, other than for loads, and have to be safe for concurrent use.
+type Tracer interface {
+	Start(op string, key string) func(hit bool, err error)
+}
+
+// traceKey returns key as passed to a Tracer, or keyHash if key is nil.
+func traceKey(key interface{}, keyHash uint64) string {
+	switch k := key.(type) {
+	case nil:
+		return strconv.FormatUint(keyHash, 10)
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(key)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto_test
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// printTracer stands for an adapter to a tracing library: it would start a
+// span in Start and end it in the function returned, recording the outcome.
+type printTracer struct{}
+
+func (printTracer) Start(op, key string) func(hit bool, err error) {
+	fmt.Printf("start %s %s\n", op, key)
+	return func(hit bool, err error) {
+		if err != nil {
+			fmt.Printf("end %s %s: %v\n", op, key, err)
+			return
+		}
+		fmt.Printf("end %s %s: hit=%v\n", op, key, hit)
+	}
+}
+
+func ExampleTracer() {
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1 << 20,
+		BufferItems: 64,
+		Tracer:      printTracer{},
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			return "value of " + key.(string), 1, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer cache.Close()
+
+	cache.Get("user:1")
+	cache.ReadThrough("user:1")
+	cache.Wait()
+	cache.Get("user:1")
+	// Output:
+	// start get user:1
+	// end get user:1: hit=false
+	// start get user:1
+	// start load user:1
+	// start set user:1
+	// end set user:1: hit=true
+	// end load user:1: hit=true
+	// end get user:1: hit=false
+	// start get user:1
+	// end get user:1: hit=true
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTracer records the starts and ends of the operations, in order.
+type recordingTracer struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingTracer) Start(op, key string) func(bool, error) {
+	r.record(fmt.Sprintf("start %s %s", op, key))
+	return func(hit bool, err error) {
+		r.record(fmt.Sprintf("end %s %s %v %v", op, key, hit, err))
+	}
+}
+
+func (r *recordingTracer) record(event string) {
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+}
+
+func (r *recordingTracer) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestCacheTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Tracer:             tracer,
+		Loader: func(key interface{}) (interface{}, int64, error) {
+			if key == "missing" {
+				return nil, 0, ErrNotFound
+			}
+			return "loaded", 1, nil
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.Set("a", 1, 1)
+	c.Wait()
+	c.Get("a")
+	c.Get("b")
+	c.SetUint(7, 1, 1)
+	c.Wait()
+	c.GetUint(7)
+	c.Del(42)
+	c.DelUint(7)
+	require.Equal(t, []string{
+		"start set a", "end set a true <nil>",
+		"start get a", "end get a true <nil>",
+		"start get b", "end get b false <nil>",
+		"start set 7", "end set 7 true <nil>",
+		"start get 7", "end get 7 true <nil>",
+		"start del 42", "end del 42 false <nil>",
+		"start del 7", "end del 7 true <nil>",
+	}, tracer.take())
+
+	// The load is nested in the get that missed, and a Set of its own.
+	_, _, err = c.ReadThrough("c")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"start get c",
+		"start load c",
+		"start set c", "end set c true <nil>",
+		"end load c true <nil>",
+		"end get c false <nil>",
+	}, tracer.take())
+	_, ok, err := c.ReadThrough("c")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []string{"start get c", "end get c true <nil>"}, tracer.take())
+
+	_, _, err = c.ReadThrough("missing")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"start get missing",
+		"start load missing",
+		"end load missing false ristretto: loading key missing: ristretto: not found",
+		"end get missing false ristretto: loading key missing: ristretto: not found",
+	}, tracer.take())
+
+	boom := errors.New("boom")
+	_, err = c.GetOrCompute("d", func() (interface{}, int64, error) {
+		return nil, 0, boom
+	})
+	require.True(t, errors.Is(err, boom))
+	require.Equal(t, []string{
+		"start get d",
+		"start load d",
+		"end load d false ristretto: loading key d: boom",
+		"end get d false ristretto: loading key d: boom",
+	}, tracer.take())
+
+	// Nothing is traced for nil keys.
+	c.Get(nil)
+	c.Del(nil)
+	require.Empty(t, tracer.take())
+}
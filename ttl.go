@@ -18,14 +18,19 @@ package ristretto
 
 import (
 	"sync"
-	"time"
 )
 
 var (
-	// TODO: find the optimal value or make it configurable.
-	bucketDurationSecs = int64(5)
+	// bucketDurationSecs is the span of expiration times held by a bucket.
+	// Expired items are cleaned up within one and a half of it.
+	bucketDurationSecs = int64(1)
 )
 
+// expirationShards is the number of independently locked parts the
+// expiration map is split into, so that Sets of different keys don't wait for
+// each other to put them in their bucket.
+const expirationShards = 64
+
 func storageBucket(t int64) int64 {
 	return (t / bucketDurationSecs) + 1
 }
@@ -39,16 +44,33 @@ func cleanupBucket(t int64) int64 {
 // bucket type is a map of key to conflict.
 type bucket map[uint64]uint64
 
-// expirationMap is a map of bucket number to the corresponding bucket.
+// expirationMap is a calendar of the items with an expiration: every item is
+// put in the bucket of its expiration time, so that cleaning up only visits
+// the buckets that have passed, however many items are yet to expire. The
+// buckets are split by key over expirationShards shards.
 type expirationMap struct {
-	sync.RWMutex
+	shards [expirationShards]expirationShard
+}
+
+// expirationShard holds the buckets of the keys of a shard, by bucket number.
+type expirationShard struct {
+	sync.Mutex
 	buckets map[int64]bucket
+	// next is the lowest bucket number that hasn't been cleaned up yet, or 0
+	// before the first cleanup.
+	next int64
 }
 
 func newExpirationMap() *expirationMap {
-	return &expirationMap{
-		buckets: make(map[int64]bucket),
+	m := &expirationMap{}
+	for i := range m.shards {
+		m.shards[i].buckets = make(map[int64]bucket)
 	}
+	return m
+}
+
+func (m *expirationMap) shard(key uint64) *expirationShard {
+	return &m.shards[key%expirationShards]
 }
 
 func (m *expirationMap) add(key, conflict uint64, expiration int64) {
@@ -61,16 +83,10 @@ func (m *expirationMap) add(key, conflict uint64, expiration int64) {
 		return
 	}
 
-	bucketNum := storageBucket(expiration)
-	m.Lock()
-	defer m.Unlock()
-
-	b, ok := m.buckets[bucketNum]
-	if !ok {
-		b = make(bucket)
-		m.buckets[bucketNum] = b
-	}
-	b[key] = conflict
+	s := m.shard(key)
+	s.Lock()
+	s.add(key, conflict, storageBucket(expiration))
+	s.Unlock()
 }
 
 func (m *expirationMap) update(key, conflict uint64, oldExpTime, newExpTime int64) {
@@ -78,66 +94,128 @@ func (m *expirationMap) update(key, conflict uint64, oldExpTime, newExpTime int6
 		return
 	}
 
-	m.Lock()
-	defer m.Unlock()
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if oldExpTime != 0 {
+		s.del(key, storageBucket(oldExpTime))
+	}
+	if newExpTime != 0 {
+		s.add(key, conflict, storageBucket(newExpTime))
+	}
+}
+
+func (m *expirationMap) del(key uint64, expiration int64) {
+	if m == nil || expiration == 0 {
+		return
+	}
+
+	s := m.shard(key)
+	s.Lock()
+	s.del(key, storageBucket(expiration))
+	s.Unlock()
+}
 
-	oldBucketNum := storageBucket(oldExpTime)
-	oldBucket, ok := m.buckets[oldBucketNum]
-	if ok {
-		delete(oldBucket, key)
+func (s *expirationShard) add(key, conflict uint64, bucketNum int64) {
+	b, ok := s.buckets[bucketNum]
+	if !ok {
+		b = make(bucket)
+		s.buckets[bucketNum] = b
 	}
+	b[key] = conflict
+	if bucketNum < s.next {
+		// The key expired before it was added, as when the clock goes back.
+		s.next = bucketNum
+	}
+}
 
-	newBucketNum := storageBucket(newExpTime)
-	newBucket, ok := m.buckets[newBucketNum]
+func (s *expirationShard) del(key uint64, bucketNum int64) {
+	b, ok := s.buckets[bucketNum]
 	if !ok {
-		newBucket = make(bucket)
-		m.buckets[newBucketNum] = newBucket
+		return
+	}
+	delete(b, key)
+	if len(b) == 0 {
+		delete(s.buckets, bucketNum)
 	}
-	newBucket[key] = conflict
 }
 
-func (m *expirationMap) del(key uint64, expiration int64) {
+// takeDue removes the buckets up to last from the shard, and appends them to
+// due. It steps through the bucket numbers since the last cleanup, or goes
+// over the buckets if there are fewer of them, as after a long pause.
+func (s *expirationShard) takeDue(last int64, due []bucket) []bucket {
+	s.Lock()
+	defer s.Unlock()
+	if s.next == 0 || last-s.next >= int64(len(s.buckets)) {
+		for bucketNum, b := range s.buckets {
+			if bucketNum <= last {
+				due = append(due, b)
+				delete(s.buckets, bucketNum)
+			}
+		}
+	} else {
+		for bucketNum := s.next; bucketNum <= last; bucketNum++ {
+			if b, ok := s.buckets[bucketNum]; ok {
+				due = append(due, b)
+				delete(s.buckets, bucketNum)
+			}
+		}
+	}
+	if last >= s.next {
+		s.next = last + 1
+	}
+	return due
+}
+
+// clear removes all the buckets.
+func (m *expirationMap) clear() {
 	if m == nil {
 		return
 	}
 
-	bucketNum := storageBucket(expiration)
-	m.Lock()
-	defer m.Unlock()
-	_, ok := m.buckets[bucketNum]
-	if !ok {
-		return
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		s.buckets = make(map[int64]bucket)
+		s.Unlock()
 	}
-	delete(m.buckets[bucketNum], key)
 }
 
-// cleanup removes all the items in the bucket that was just completed. It deletes
-// those items from the store, and calls the onEvict function on those items.
-// This function is meant to be called periodically.
-func (m *expirationMap) cleanup(store store, policy policy, onEvict itemCallback) {
+// cleanup removes all the items in the buckets that have passed, including
+// the ones a late cleanup skipped. It deletes those items from the store, and
+// calls the onExpire function on those items. This function is meant to be
+// called periodically.
+func (m *expirationMap) cleanup(store store, policy policy, onExpire itemCallback, now int64) {
 	if m == nil {
 		return
 	}
 
-	m.Lock()
-	now := time.Now().Unix()
-	bucketNum := cleanupBucket(now)
-	keys := m.buckets[bucketNum]
-	delete(m.buckets, bucketNum)
-	m.Unlock()
+	last := cleanupBucket(now)
+	var due []bucket
+	for i := range m.shards {
+		due = m.shards[i].takeDue(last, due[:0])
+		for _, keys := range due {
+			cleanupKeys(store, policy, onExpire, keys, now)
+		}
+	}
+}
 
+func cleanupKeys(store store, policy policy, onExpire itemCallback, keys bucket, now int64) {
 	for key, conflict := range keys {
-		// Sanity check. Verify that the store agrees that this key is expired.
-		if store.Expiration(key) > now {
+		// The key may have been deleted or given a new expiration since it was
+		// put in the bucket, so only delete it if the store agrees that it has
+		// expired. DelExpired checks both under the shard lock, which keeps a
+		// concurrent Touch from being undone.
+		value, ok := store.DelExpired(key, conflict, now)
+		if !ok {
 			continue
 		}
 
 		cost := policy.Cost(key)
 		policy.Del(key)
-		_, value := store.Del(key, conflict)
 
-		if onEvict != nil {
-			onEvict(&Item{Key: key,
+		if onExpire != nil {
+			onExpire(&Item{Key: key,
 				Conflict: conflict,
 				Value:    value,
 				Cost:     cost,
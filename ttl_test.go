@@ -0,0 +1,121 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpirationMapCleanup(t *testing.T) {
+	s := newShardedMap()
+	p := newDefaultPolicy(1000, 1000)
+	defer p.Close()
+	now := time.Now().Unix()
+	for key := uint64(1); key <= 300; key++ {
+		p.Add(key, 1)
+		// Keys 1 to 100 expire in 10 seconds, 101 to 200 in 20, and the rest
+		// in an hour.
+		expiration := now + 3600
+		if key <= 200 {
+			expiration = now + 10*int64((key+99)/100)
+		}
+		s.Set(&Item{Key: key, Value: key, Expiration: expiration})
+	}
+	// Moved to a later bucket, and deleted before expiring.
+	require.True(t, s.Touch(1, 0, now+3600))
+	s.Del(2, 0)
+	p.Del(2)
+
+	expired := make(map[uint64]int)
+	onExpire := func(i *Item) { expired[i.Key]++ }
+	s.expiryMap.cleanup(s, p, onExpire, now+5)
+	require.Empty(t, expired)
+
+	// A cleanup late by several buckets catches up with all of them.
+	s.expiryMap.cleanup(s, p, onExpire, now+30)
+	require.Len(t, expired, 198)
+	for key := uint64(3); key <= 200; key++ {
+		require.Equal(t, 1, expired[key], "key %d", key)
+		_, ok := s.Get(key, 0)
+		require.False(t, ok)
+		require.False(t, p.Has(key))
+	}
+	s.expiryMap.cleanup(s, p, onExpire, now+60)
+	require.Len(t, expired, 198)
+	require.Equal(t, 101, expirationLen(s.expiryMap))
+
+	// Keys added behind the cleanup, as when the clock goes back, are still
+	// cleaned up.
+	s.Set(&Item{Key: 2, Value: 2, Expiration: now + 40})
+	s.expiryMap.cleanup(s, p, onExpire, now+60)
+	require.Equal(t, 1, expired[2])
+	require.Equal(t, 101, expirationLen(s.expiryMap))
+
+	s.Clear(nil)
+	require.Zero(t, expirationLen(s.expiryMap))
+}
+
+// expirationLen returns the number of keys in the expiration map.
+func expirationLen(m *expirationMap) int {
+	n := 0
+	for i := range m.shards {
+		for _, b := range m.shards[i].buckets {
+			n += len(b)
+		}
+	}
+	return n
+}
+
+// expiredStore is a store where every key has expired, so that the cleanup of
+// the expiration map can be measured without storing the items.
+type expiredStore struct {
+	store
+}
+
+func (expiredStore) DelExpired(key, conflict uint64, now int64) (interface{}, bool) {
+	return nil, true
+}
+
+// BenchmarkExpirationCleanup cleans up 1000 expired keys per op next to the
+// given number of keys that are yet to expire, with TTLs from an hour to a
+// day. The time taken follows the keys expired, not the keys held.
+func BenchmarkExpirationCleanup(b *testing.B) {
+	p := newDefaultPolicy(100, 10)
+	defer p.Close()
+	for _, size := range []int{1e5, 1e6, 1e7} {
+		m := newExpirationMap()
+		now := int64(1e9)
+		for key := 0; key < size; key++ {
+			m.add(uint64(key), 0, now+3600+int64(key*7919%82800))
+		}
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for key := 0; key < 1000; key++ {
+					m.add(uint64(size+key), 0, now)
+				}
+				now += bucketDurationSecs
+				b.StartTimer()
+				m.cleanup(expiredStore{}, p, nil, now)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import "container/list"
+
+const (
+	// twoQInRatio is the default share of the cache given to A1in.
+	twoQInRatio = 0.25
+	// twoQOutRatio is the default cost of the ghosts in A1out, relative to
+	// MaxCost.
+	twoQOutRatio = 0.5
+)
+
+// twoQPolicy is the full version of the 2Q policy. New keys go to the A1in
+// FIFO, which takes a share of the cache. Keys evicted from A1in are
+// remembered, without their values, in the A1out FIFO, and a key admitted
+// again while it's in A1out goes to the Am LRU instead, where keys accessed
+// repeatedly live. So keys seen only once, like the ones of a scan, never
+// reach Am and can't push out its keys.
+type twoQPolicy struct {
+	// in and main are A1in and Am, with the most recent key at the front.
+	in, main twoQList
+	// out is A1out, which holds up to NumCounters keys.
+	out   *GhostRegistry
+	elems map[uint64]*list.Element
+	// inCap is the cost A1in may hold before it's evicted from first, and
+	// outCap the cost the ghosts in A1out may add up to.
+	inCap, outCap int64
+	inRatio       float64
+	outRatio      float64
+}
+
+type twoQList struct {
+	list *list.List
+	cost int64
+}
+
+type twoQEntry struct {
+	key  uint64
+	cost int64
+	// queue is the list the entry is in.
+	queue *twoQList
+}
+
+// NewTwoQueuePolicy returns a 2Q Policy that gives 25% of MaxCost to A1in and
+// remembers the keys evicted from it until their costs add up to half of
+// MaxCost, or they're NumCounters. It can be used as Config.Policy.
+func NewTwoQueuePolicy(numCounters, maxCost int64) Policy {
+	return newTwoQPolicy(numCounters, maxCost, twoQInRatio, twoQOutRatio)
+}
+
+// NewTwoQueuePolicyWithRatios returns a Config.Policy constructor for 2Q
+// policies. inRatio, between 0 and 1, is the share of MaxCost given to A1in
+// (Kin), and outRatio, at least 0, the cost of the keys remembered in A1out
+// (Kout) relative to MaxCost.
+func NewTwoQueuePolicyWithRatios(inRatio, outRatio float64) func(numCounters, maxCost int64) Policy {
+	if inRatio < 0 || inRatio > 1 {
+		panic("ristretto: 2Q in ratio must be between 0 and 1")
+	}
+	if outRatio < 0 {
+		panic("ristretto: 2Q out ratio must not be negative")
+	}
+	return func(numCounters, maxCost int64) Policy {
+		return newTwoQPolicy(numCounters, maxCost, inRatio, outRatio)
+	}
+}
+
+func newTwoQPolicy(numCounters, maxCost int64, inRatio, outRatio float64) *twoQPolicy {
+	p := &twoQPolicy{
+		in:       twoQList{list: list.New()},
+		out:      NewGhostRegistry(int(numCounters)),
+		main:     twoQList{list: list.New()},
+		elems:    make(map[uint64]*list.Element),
+		inRatio:  inRatio,
+		outRatio: outRatio,
+	}
+	p.Resize(maxCost)
+	return p
+}
+
+// push adds the entry to the front of the queue.
+func (p *twoQPolicy) push(queue *twoQList, e *twoQEntry) {
+	e.queue = queue
+	queue.cost += e.cost
+	p.elems[e.key] = queue.list.PushFront(e)
+}
+
+// remove takes the element out of its queue and forgets its key.
+func (p *twoQPolicy) remove(elem *list.Element) *twoQEntry {
+	e := elem.Value.(*twoQEntry)
+	e.queue.list.Remove(elem)
+	e.queue.cost -= e.cost
+	delete(p.elems, e.key)
+	return e
+}
+
+func (p *twoQPolicy) Add(key uint64, cost int64) {
+	if _, ok := p.elems[key]; ok {
+		p.Update(key, cost)
+		return
+	}
+	queue := &p.in
+	if p.out.Remove(key) {
+		// Seen again since it left A1in: it's used repeatedly.
+		queue = &p.main
+	}
+	p.push(queue, &twoQEntry{key: key, cost: cost})
+}
+
+func (p *twoQPolicy) Update(key uint64, cost int64) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	e := elem.Value.(*twoQEntry)
+	e.queue.cost += cost - e.cost
+	e.cost = cost
+}
+
+func (p *twoQPolicy) Del(key uint64) {
+	if elem, ok := p.elems[key]; ok {
+		p.remove(elem)
+		return
+	}
+	p.out.Remove(key)
+}
+
+func (p *twoQPolicy) Access(keys []uint64) {
+	for _, key := range keys {
+		elem, ok := p.elems[key]
+		if !ok {
+			continue
+		}
+		// A1in is a FIFO.
+		if elem.Value.(*twoQEntry).queue == &p.main {
+			p.main.list.MoveToFront(elem)
+		}
+	}
+}
+
+func (p *twoQPolicy) Evict(candidate uint64) (uint64, bool) {
+	return p.EvictSkipping(candidate, nil)
+}
+
+// EvictSkipping takes the victim from the other queue if every key of the one
+// it would evict from is skipped.
+func (p *twoQPolicy) EvictSkipping(candidate uint64, skip func(uint64) bool) (uint64, bool) {
+	keyOf := func(elem *list.Element) uint64 {
+		return elem.Value.(*twoQEntry).key
+	}
+	fromIn := p.in.cost > p.inCap || p.main.list.Len() == 0
+	for pass := 0; pass < 2; pass++ {
+		if fromIn {
+			if elem := lastUnskipped(p.in.list, keyOf, skip); elem != nil {
+				e := p.remove(elem)
+				if p.outCap > 0 {
+					p.out.Add(e.key, e.cost)
+					p.out.Trim(p.outCap)
+				}
+				return e.key, true
+			}
+		} else if elem := lastUnskipped(p.main.list, keyOf, skip); elem != nil {
+			return p.remove(elem).key, true
+		}
+		fromIn = !fromIn
+	}
+	return 0, false
+}
+
+func (p *twoQPolicy) Resize(maxCost int64) {
+	p.inCap = int64(float64(maxCost) * p.inRatio)
+	p.outCap = int64(float64(maxCost) * p.outRatio)
+	p.out.Trim(p.outCap)
+}
+
+func (p *twoQPolicy) Clear() {
+	p.in = twoQList{list: list.New()}
+	p.out.Clear()
+	p.main = twoQList{list: list.New()}
+	p.elems = make(map[uint64]*list.Element)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoQueuePolicy(t *testing.T) {
+	p := NewTwoQueuePolicyWithRatios(0.5, 0.5)(100, 4).(*twoQPolicy)
+	for key := uint64(1); key <= 4; key++ {
+		p.Add(key, 1)
+	}
+	// A1in is a FIFO, so accesses don't change its order. With Am empty,
+	// victims come from A1in and are remembered in A1out.
+	p.Access([]uint64{1})
+	for _, want := range []uint64{1, 2} {
+		victim, ok := p.Evict(5)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	require.Equal(t, 2, p.out.Len())
+
+	// A key admitted again while in A1out goes to Am.
+	p.Add(1, 1)
+	require.Equal(t, &p.main, p.elems[1].Value.(*twoQEntry).queue)
+	require.Equal(t, 1, p.out.Len())
+
+	// A1in holds more than its share, so it's evicted from first, and A1out
+	// forgets its oldest key to make room.
+	p.Add(5, 1)
+	p.Add(6, 1)
+	victim, ok := p.Evict(7)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+	require.Equal(t, int64(2), p.out.Cost())
+	victim, ok = p.Evict(7)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), victim)
+	_, ok = p.elems[2]
+	require.False(t, ok)
+
+	// Once A1in fits in its share, Am is evicted from.
+	victim, ok = p.Evict(7)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+	require.Equal(t, int64(2), p.in.cost)
+}
+
+func TestTwoQueuePolicyDel(t *testing.T) {
+	p := NewTwoQueuePolicy(100, 8).(*twoQPolicy)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	for _, want := range []uint64{1, 2} {
+		victim, ok := p.Evict(3)
+		require.True(t, ok)
+		require.Equal(t, want, victim)
+	}
+	p.Add(1, 2)
+	p.Add(3, 1)
+	p.Update(1, 3)
+	require.Equal(t, int64(3), p.main.cost)
+
+	// 1 is in Am, 2 in A1out and 3 in A1in.
+	require.Equal(t, int64(1), p.out.Cost())
+	require.Equal(t, int64(1), p.in.cost)
+	for _, key := range []uint64{1, 2, 3, 4} {
+		p.Del(key)
+	}
+	require.Empty(t, p.elems)
+	require.Zero(t, p.in.cost)
+	require.Zero(t, p.out.Cost())
+	require.Zero(t, p.main.cost)
+
+	p.Add(5, 1)
+	p.Clear()
+	require.Empty(t, p.elems)
+	_, ok := p.Evict(6)
+	require.False(t, ok)
+}
+
+func TestTwoQueuePolicyRatios(t *testing.T) {
+	require.Panics(t, func() { NewTwoQueuePolicyWithRatios(1.5, 0.5) })
+	require.Panics(t, func() { NewTwoQueuePolicyWithRatios(0.25, -1) })
+	p := NewTwoQueuePolicy(100, 100).(*twoQPolicy)
+	require.Equal(t, int64(25), p.inCap)
+	require.Equal(t, int64(50), p.outCap)
+
+	// Without A1out, no key ever reaches Am.
+	p = NewTwoQueuePolicyWithRatios(0.25, 0)(100, 2).(*twoQPolicy)
+	p.Add(1, 1)
+	_, ok := p.Evict(2)
+	require.True(t, ok)
+	p.Add(1, 1)
+	require.Equal(t, &p.in, p.elems[1].Value.(*twoQEntry).queue)
+	require.Zero(t, p.out.Len())
+}
+
+func TestTwoQueuePolicyHitRatio(t *testing.T) {
+	keys := scanTrace(50, 100, 200)
+	lru := policyHitRatio(NewLRUPolicy(100, 100), 100, keys)
+	twoQ := policyHitRatio(NewTwoQueuePolicy(100, 100), 100, keys)
+	require.True(t, twoQ > lru+0.1, "2q: %.3f, lru: %.3f", twoQ, lru)
+}
+
+func TestCacheTwoQueuePolicy(t *testing.T) {
+	var evicted []uint64
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            4,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             NewTwoQueuePolicy,
+		OnEvict: func(item *Item) {
+			evicted = append(evicted, item.Key)
+		},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	for key := uint64(1); key <= 6; key++ {
+		require.True(t, c.SetUint(key, key, 1))
+		c.Wait()
+	}
+	require.Equal(t, []uint64{1, 2}, evicted)
+	for _, key := range evicted {
+		_, ok := c.GetUint(key)
+		require.False(t, ok)
+	}
+	require.Equal(t, 4, c.Len())
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// victimEntry is an evicted item held by a victimCache.
+type victimEntry struct {
+	key        uint64
+	conflict   uint64
+	value      interface{}
+	cost       int64
+	expiration int64
+}
+
+// victimCache holds the last items evicted from a cache, for Config.VictimCacheSize,
+// so that a Get soon after the eviction finds the value still. It's a FIFO of
+// evictions: a hit takes the item out, to be admitted again.
+//
+// The values it holds are only passed to Config.OnExit once they leave it for
+// good. Dels leave a tombstone for their key until processItems applies them,
+// so that an eviction racing with a Del can't bring the value back.
+type victimCache struct {
+	mu     sync.Mutex
+	size   int
+	list   *list.List
+	elems  map[uint64]*list.Element
+	tombs  map[uint64]int
+	onExit func(interface{})
+}
+
+func newVictimCache(size int, onExit func(interface{})) *victimCache {
+	if size == 0 {
+		return nil
+	}
+	return &victimCache{
+		size:   size,
+		list:   list.New(),
+		elems:  make(map[uint64]*list.Element),
+		tombs:  make(map[uint64]int),
+		onExit: onExit,
+	}
+}
+
+// add keeps an evicted item, dropping the oldest one if full, and returns
+// whether it did. Items whose key is being deleted aren't kept.
+func (v *victimCache) add(i *Item, cost int64) bool {
+	if v == nil {
+		return false
+	}
+	var dropped []interface{}
+	v.mu.Lock()
+	if v.tombs[i.Key] > 0 {
+		v.mu.Unlock()
+		return false
+	}
+	if elem, ok := v.elems[i.Key]; ok {
+		dropped = append(dropped, v.remove(elem))
+	}
+	v.elems[i.Key] = v.list.PushFront(&victimEntry{
+		key:        i.Key,
+		conflict:   i.Conflict,
+		value:      i.Value,
+		cost:       cost,
+		expiration: i.Expiration,
+	})
+	if v.list.Len() > v.size {
+		dropped = append(dropped, v.remove(v.list.Back()))
+	}
+	v.mu.Unlock()
+	v.exit(dropped...)
+	return true
+}
+
+// take returns the item of the key and stops holding it, unless it has
+// expired by now, a Unix time.
+func (v *victimCache) take(key, conflict uint64, now int64) (*victimEntry, bool) {
+	v.mu.Lock()
+	elem, ok := v.elems[key]
+	if !ok {
+		v.mu.Unlock()
+		return nil, false
+	}
+	e := elem.Value.(*victimEntry)
+	if conflict != 0 && conflict != e.conflict {
+		v.mu.Unlock()
+		return nil, false
+	}
+	v.remove(elem)
+	v.mu.Unlock()
+	if e.expiration != 0 && e.expiration <= now {
+		v.exit(e.value)
+		return nil, false
+	}
+	return e, true
+}
+
+func (v *victimCache) remove(elem *list.Element) interface{} {
+	e := v.list.Remove(elem).(*victimEntry)
+	delete(v.elems, e.key)
+	return e.value
+}
+
+func (v *victimCache) exit(values ...interface{}) {
+	for _, value := range values {
+		v.onExit(value)
+	}
+}
+
+// drop forgets the item of the key, which has a new value.
+func (v *victimCache) drop(key uint64) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	elem, ok := v.elems[key]
+	if !ok {
+		v.mu.Unlock()
+		return
+	}
+	value := v.remove(elem)
+	v.mu.Unlock()
+	v.exit(value)
+}
+
+// forget drops the item of a key being deleted, and keeps the key out until
+// deleted is called for it.
+func (v *victimCache) forget(key uint64) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	v.tombs[key]++
+	v.mu.Unlock()
+	v.drop(key)
+}
+
+// deleted tells that the Del of the key has been applied.
+func (v *victimCache) deleted(key uint64) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	if n := v.tombs[key]; n > 1 {
+		v.tombs[key] = n - 1
+	} else {
+		delete(v.tombs, key)
+	}
+	v.mu.Unlock()
+}
+
+// Len returns the number of items held.
+func (v *victimCache) Len() int {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.list.Len()
+}
+
+func (v *victimCache) clear() {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	var dropped []interface{}
+	for elem := v.list.Front(); elem != nil; elem = elem.Next() {
+		dropped = append(dropped, elem.Value.(*victimEntry).value)
+	}
+	v.list.Init()
+	v.elems = make(map[uint64]*list.Element)
+	v.tombs = make(map[uint64]int)
+	v.mu.Unlock()
+	v.exit(dropped...)
+}
+
+// readmit looks up a key missing from the store in the victim cache. If it's
+// there, the value is Set again, going through admission like any other, and
+// returned.
+func (c *Cache) readmit(keyHash, conflictHash uint64) (interface{}, bool) {
+	e, ok := c.victims.take(keyHash, conflictHash, c.clock.Now().Unix())
+	if !ok {
+		return nil, false
+	}
+	var ttl time.Duration
+	if e.expiration != 0 {
+		ttl = time.Unix(e.expiration, 0).Sub(c.clock.Now())
+	}
+	c.setHashed(nil, e.key, e.conflict, e.value, e.cost-c.internalCost, ttl, false, SetOptions{})
+	return e.value, true
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newVictimsCache(t *testing.T, clock Clock, exited *[]interface{}) *Cache {
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		Clock:              clock,
+		VictimCacheSize:    2,
+		OnExit:             func(val interface{}) { *exited = append(*exited, val) },
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func TestCacheVictims(t *testing.T) {
+	var exited []interface{}
+	c := newVictimsCache(t, NewMockClock(time.Unix(1e9, 0)), &exited)
+	defer c.Close()
+
+	for i := 1; i <= 3; i++ {
+		require.True(t, c.Set(i, i*10, 1))
+	}
+	c.Wait()
+	require.Equal(t, 3, c.EvictN(3))
+	// The victim cache holds the last two, which don't count against MaxCost,
+	// and only the first one evicted has left for good.
+	require.Equal(t, 2, c.victims.Len())
+	require.Len(t, exited, 1)
+	require.Equal(t, int64(0), c.UsedCost())
+
+	var found []int
+	for i := 1; i <= 3; i++ {
+		if val, ok := c.Get(i); ok {
+			require.Equal(t, i*10, val)
+			found = append(found, i)
+		} else {
+			require.Equal(t, i*10, exited[0])
+		}
+	}
+	require.Len(t, found, 2)
+	require.Equal(t, uint64(2), c.Metrics.VictimHits())
+	require.Equal(t, uint64(0), c.Metrics.Hits())
+	require.Equal(t, uint64(1), c.Metrics.Misses())
+	// The items found are admitted again.
+	c.Wait()
+	require.Equal(t, 0, c.victims.Len())
+	for _, key := range found {
+		val, ok := c.Peek(key)
+		require.True(t, ok)
+		require.Equal(t, key*10, val)
+	}
+	require.Len(t, exited, 1)
+}
+
+func TestCacheVictimsGetMulti(t *testing.T) {
+	// GetMulti and GetMultiMap find the last two victims like Get.
+	keys := []interface{}{1, 2, 3, 4}
+	for _, getMulti := range []func(c *Cache) map[interface{}]interface{}{
+		func(c *Cache) map[interface{}]interface{} {
+			hits := make(map[interface{}]interface{})
+			values, found := c.GetMulti(keys)
+			for i, ok := range found {
+				if ok {
+					hits[keys[i]] = values[i]
+				}
+			}
+			return hits
+		},
+		func(c *Cache) map[interface{}]interface{} {
+			hits, _ := c.GetMultiMap(keys)
+			return hits
+		},
+	} {
+		var exited []interface{}
+		c := newVictimsCache(t, NewMockClock(time.Unix(1e9, 0)), &exited)
+		for _, key := range keys {
+			require.True(t, c.Set(key, key.(int)*10, 1))
+		}
+		c.Wait()
+		require.Equal(t, 4, c.EvictN(4))
+		hits := getMulti(c)
+		require.Len(t, hits, 2)
+		for key, val := range hits {
+			require.Equal(t, key.(int)*10, val, "%v", hits)
+		}
+		require.Equal(t, uint64(2), c.Metrics.VictimHits())
+		c.Close()
+	}
+}
+
+func TestCacheVictimsStale(t *testing.T) {
+	var exited []interface{}
+	clock := NewMockClock(time.Unix(1e9, 0))
+	c := newVictimsCache(t, clock, &exited)
+	defer c.Close()
+
+	require.True(t, c.Set(1, "a", 1))
+	require.True(t, c.SetWithTTL(2, "b", 1, 10*time.Second))
+	c.Wait()
+	require.Equal(t, 2, c.EvictN(2))
+	require.Equal(t, 2, c.victims.Len())
+
+	// A Set of an evicted key wins over the value kept.
+	require.True(t, c.Set(1, "c", 1))
+	c.Wait()
+	val, ok := c.Get(1)
+	require.True(t, ok)
+	require.Equal(t, "c", val)
+	require.Equal(t, []interface{}{"a"}, exited)
+	// Expired items aren't brought back.
+	clock.Add(20 * time.Second)
+	_, ok = c.Get(2)
+	require.False(t, ok)
+	require.Equal(t, []interface{}{"a", "b"}, exited)
+
+	// Neither are deleted ones.
+	c.Wait()
+	require.Equal(t, 1, c.EvictN(1))
+	require.Equal(t, 1, c.victims.Len())
+	val, ok = c.Del(1)
+	require.False(t, ok)
+	require.Nil(t, val)
+	require.Equal(t, 0, c.victims.Len())
+	require.Equal(t, []interface{}{"a", "b", "c"}, exited)
+	_, ok = c.Get(1)
+	require.False(t, ok)
+	require.Equal(t, uint64(0), c.Metrics.VictimHits())
+
+	// Clear empties the victim cache too.
+	require.True(t, c.Set(3, "d", 1))
+	c.Wait()
+	require.Equal(t, 1, c.EvictN(1))
+	c.Clear()
+	require.Equal(t, 0, c.victims.Len())
+	require.Equal(t, []interface{}{"a", "b", "c", "d"}, exited)
+}
+
+func TestVictimCache(t *testing.T) {
+	var exited []interface{}
+	v := newVictimCache(2, func(val interface{}) { exited = append(exited, val) })
+	require.Nil(t, newVictimCache(0, nil))
+
+	for i := 1; i <= 3; i++ {
+		require.True(t, v.add(&Item{Key: uint64(i), Value: i}, 1))
+	}
+	// The oldest item leaves first.
+	require.Equal(t, []interface{}{1}, exited)
+	_, ok := v.take(1, 0, 0)
+	require.False(t, ok)
+	e, ok := v.take(2, 0, 0)
+	require.True(t, ok)
+	require.Equal(t, 2, e.value)
+
+	// A Del racing with the eviction of its key keeps the value out until
+	// the Del is applied.
+	v.forget(4)
+	require.False(t, v.add(&Item{Key: 4, Value: 4}, 1))
+	v.forget(4)
+	v.deleted(4)
+	require.False(t, v.add(&Item{Key: 4, Value: 4}, 1))
+	v.deleted(4)
+	require.True(t, v.add(&Item{Key: 4, Value: 4}, 1))
+
+	// Conflicting keys aren't mixed up.
+	require.True(t, v.add(&Item{Key: 5, Conflict: 1, Value: 5}, 1))
+	_, ok = v.take(5, 2, 0)
+	require.False(t, ok)
+	require.Equal(t, 2, v.Len())
+	v.clear()
+	sort.Slice(exited, func(i, j int) bool { return exited[i].(int) < exited[j].(int) })
+	require.Equal(t, []interface{}{1, 3, 4, 5}, exited)
+}
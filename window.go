@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRatioWindowBuckets is the number of buckets of Config.RatioWindow
+// when Config.RatioWindowBuckets is zero.
+const defaultRatioWindowBuckets = 60
+
+// ratioWindow counts the hits and misses of the last intervals of time, for
+// Metrics.RatioWindow. Each interval has a bucket of the ring, which is reset
+// by the first Get counted in it, so there's no goroutine keeping time.
+type ratioWindow struct {
+	clock   Clock
+	width   int64
+	buckets []ratioBucket
+}
+
+type ratioBucket struct {
+	// epoch is the number of the interval counted by the bucket, the clock
+	// divided by the width of the intervals, plus one so that zero is none.
+	epoch uint64
+	// mu serializes the resets of the bucket.
+	mu sync.Mutex
+	// counts holds the hits and the misses, striped like the other metrics.
+	counts [2][]paddedCounter
+}
+
+func newRatioWindow(clock Clock, width time.Duration, buckets int) *ratioWindow {
+	if buckets == 0 {
+		buckets = defaultRatioWindowBuckets
+	}
+	w := &ratioWindow{
+		clock:   clock,
+		width:   int64(width),
+		buckets: make([]ratioBucket, buckets),
+	}
+	slots := metricSlots()
+	for i := range w.buckets {
+		w.buckets[i].counts[hit] = make([]paddedCounter, slots)
+		w.buckets[i].counts[miss] = make([]paddedCounter, slots)
+	}
+	return w
+}
+
+func (w *ratioWindow) epoch() uint64 {
+	return uint64(w.clock.Now().UnixNano()/w.width) + 1
+}
+
+// add counts delta hits or misses in the slot idx of the current interval. A
+// Get counted right as its interval ends may land in the next one.
+func (w *ratioWindow) add(t metricType, idx, delta uint64) {
+	epoch := w.epoch()
+	b := &w.buckets[epoch%uint64(len(w.buckets))]
+	if atomic.LoadUint64(&b.epoch) != epoch {
+		b.mu.Lock()
+		if atomic.LoadUint64(&b.epoch) != epoch {
+			b.reset()
+			atomic.StoreUint64(&b.epoch, epoch)
+		}
+		b.mu.Unlock()
+	}
+	counts := b.counts[t]
+	atomic.AddUint64(&counts[idx&uint64(len(counts)-1)].n, delta)
+}
+
+func (b *ratioBucket) reset() {
+	for _, counts := range b.counts {
+		for i := range counts {
+			atomic.StoreUint64(&counts[i].n, 0)
+		}
+	}
+}
+
+// ratio returns the hit ratio over the intervals covering the last d,
+// including the current one.
+func (w *ratioWindow) ratio(d time.Duration) float64 {
+	n := uint64((int64(d) + w.width - 1) / w.width)
+	if n > uint64(len(w.buckets)) {
+		n = uint64(len(w.buckets))
+	}
+	epoch := w.epoch()
+	var counts [2]uint64
+	for e := epoch; e > 0 && e+n > epoch; e-- {
+		b := &w.buckets[e%uint64(len(w.buckets))]
+		if atomic.LoadUint64(&b.epoch) != e {
+			continue
+		}
+		for t := range counts {
+			for i := range b.counts[t] {
+				counts[t] += atomic.LoadUint64(&b.counts[t][i].n)
+			}
+		}
+	}
+	if counts[hit] == 0 && counts[miss] == 0 {
+		return 0
+	}
+	return float64(counts[hit]) / float64(counts[hit]+counts[miss])
+}
+
+func (w *ratioWindow) clear() {
+	for i := range w.buckets {
+		b := &w.buckets[i]
+		b.mu.Lock()
+		atomic.StoreUint64(&b.epoch, 0)
+		b.reset()
+		b.mu.Unlock()
+	}
+}
+
+// RatioWindow returns the share of the Gets that were hits over the last d, as
+// counted in the intervals of Config.RatioWindow. d is rounded up to a whole
+// number of intervals, the current one included, and capped at the intervals
+// kept. It returns 0 if there were no Gets, or if Config.RatioWindow isn't
+// set.
+func (p *Metrics) RatioWindow(d time.Duration) float64 {
+	if p == nil || p.window == nil || d <= 0 {
+		return 0
+	}
+	return p.window.ratio(d)
+}
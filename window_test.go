@@ -0,0 +1,115 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsRatioWindow(t *testing.T) {
+	clock := NewMockClock(time.Unix(60*1e7, 0))
+	c, err := NewCache(&Config{
+		NumCounters:        100,
+		MaxCost:            10,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Metrics:            true,
+		RatioWindow:        time.Minute,
+		RatioWindowBuckets: 5,
+		Clock:              clock,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	require.True(t, c.Set(1, 1, 1))
+	c.Wait()
+	gets := func(hits, misses int) {
+		for i := 0; i < hits; i++ {
+			_, ok := c.Get(1)
+			require.True(t, ok)
+		}
+		for i := 0; i < misses; i++ {
+			_, ok := c.Get(2)
+			require.False(t, ok)
+		}
+	}
+
+	require.Zero(t, c.Metrics.RatioWindow(time.Minute))
+	gets(3, 1)
+	require.Equal(t, 0.75, c.Metrics.RatioWindow(time.Minute))
+	clock.Add(59 * time.Second)
+	gets(2, 2)
+	require.Equal(t, 5.0/8, c.Metrics.RatioWindow(time.Second))
+
+	// The next interval starts from scratch, and d is rounded up to whole
+	// intervals.
+	clock.Add(time.Second)
+	require.Zero(t, c.Metrics.RatioWindow(time.Minute))
+	gets(0, 2)
+	require.Zero(t, c.Metrics.RatioWindow(time.Minute))
+	require.Equal(t, 0.5, c.Metrics.RatioWindow(61*time.Second))
+	require.Equal(t, 0.5, c.Metrics.RatioWindow(time.Hour))
+
+	// Intervals with no Gets count for nothing.
+	clock.Add(2 * time.Minute)
+	gets(2, 0)
+	require.Equal(t, 1.0, c.Metrics.RatioWindow(time.Minute))
+	require.Equal(t, 0.5, c.Metrics.RatioWindow(3*time.Minute))
+	require.Equal(t, 7.0/12, c.Metrics.RatioWindow(4*time.Minute))
+
+	// The buckets are reused once the window has gone round, forgetting the
+	// intervals that left it, and d is capped at the intervals kept.
+	clock.Add(3 * time.Minute)
+	gets(1, 1)
+	require.Equal(t, 0.5, c.Metrics.RatioWindow(time.Minute))
+	require.Equal(t, 0.75, c.Metrics.RatioWindow(time.Hour))
+	require.Equal(t, uint64(8), c.Metrics.Hits())
+
+	c.Metrics.Clear()
+	require.Zero(t, c.Metrics.RatioWindow(time.Hour))
+	gets(1, 0)
+	require.Equal(t, 1.0, c.Metrics.RatioWindow(time.Hour))
+}
+
+func TestMetricsRatioWindowConfig(t *testing.T) {
+	for _, config := range []*Config{
+		{RatioWindow: -time.Second, Metrics: true},
+		{RatioWindow: time.Second, RatioWindowBuckets: -1, Metrics: true},
+		{RatioWindow: time.Second},
+		{RatioWindowBuckets: 10, Metrics: true},
+	} {
+		config.NumCounters = 100
+		config.MaxCost = 10
+		config.BufferItems = 64
+		_, err := NewCache(config)
+		require.Error(t, err)
+	}
+
+	// Without RatioWindow, there is no window to ask.
+	c, err := NewCache(&Config{
+		NumCounters: 100,
+		MaxCost:     10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	c.Get(1)
+	require.Zero(t, c.Metrics.RatioWindow(time.Hour))
+}
@@ -0,0 +1,272 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// Workload is a synthetic stream of keys, such as the ones returned by
+// UniformWorkload and ZipfWorkload, for RunPolicyComparison.
+type Workload struct {
+	// Name identifies the workload in the report.
+	Name string
+	// Accesses is the number of keys in the stream.
+	Accesses int
+	// next returns the generator of the keys of the stream, drawing from r.
+	next func(r *rand.Rand) (func(i int) uint64, error)
+}
+
+// UniformWorkload returns a workload of keys drawn uniformly from [0, keys).
+func UniformWorkload(keys uint64, accesses int) Workload {
+	return Workload{
+		Name:     "uniform",
+		Accesses: accesses,
+		next: func(r *rand.Rand) (func(int) uint64, error) {
+			if keys == 0 {
+				return nil, errors.New("keys must be positive")
+			}
+			return func(int) uint64 { return uint64(r.Int63n(int64(keys))) }, nil
+		},
+	}
+}
+
+// ZipfWorkload returns a workload of keys of [0, keys) following a Zipfian
+// distribution of exponent s, which must be over 1: the higher, the more
+// skewed.
+func ZipfWorkload(s float64, keys uint64, accesses int) Workload {
+	return Workload{
+		Name:     fmt.Sprintf("zipf(s=%g)", s),
+		Accesses: accesses,
+		next: func(r *rand.Rand) (func(int) uint64, error) {
+			if keys == 0 {
+				return nil, errors.New("keys must be positive")
+			}
+			z := rand.NewZipf(r, s, 1, keys-1)
+			if z == nil {
+				return nil, fmt.Errorf("s must be over 1, got %v", s)
+			}
+			return func(int) uint64 { return z.Uint64() }, nil
+		},
+	}
+}
+
+// ScanWorkload returns a workload looping over the keys of [0, keys) in order,
+// the worst case of LRU once keys don't fit in the cache.
+func ScanWorkload(keys uint64, accesses int) Workload {
+	return Workload{
+		Name:     "scan",
+		Accesses: accesses,
+		next: func(r *rand.Rand) (func(int) uint64, error) {
+			if keys == 0 {
+				return nil, errors.New("keys must be positive")
+			}
+			return func(i int) uint64 { return uint64(i) % keys }, nil
+		},
+	}
+}
+
+// HotspotWorkload returns a workload of keys of [0, keys) where nine accesses
+// out of ten go to a hot set of hot consecutive keys, and the others to any
+// key. The hot set moves on to the next hot keys every shift accesses, to
+// tell how fast a policy forgets the keys that used to be popular.
+func HotspotWorkload(keys, hot uint64, shift, accesses int) Workload {
+	return Workload{
+		Name:     "hotspot",
+		Accesses: accesses,
+		next: func(r *rand.Rand) (func(int) uint64, error) {
+			switch {
+			case hot == 0 || hot > keys:
+				return nil, fmt.Errorf("hot must be in [1, keys], got %d", hot)
+			case shift <= 0:
+				return nil, fmt.Errorf("shift must be positive, got %d", shift)
+			}
+			return func(i int) uint64 {
+				if r.Intn(10) == 0 {
+					return uint64(r.Int63n(int64(keys)))
+				}
+				base := uint64(i/shift) * hot
+				return (base + uint64(r.Int63n(int64(hot)))) % keys
+			}, nil
+		},
+	}
+}
+
+// Keys returns the stream of keys of the workload. The same seed always gives
+// the same stream.
+func (w Workload) Keys(seed int64) ([]uint64, error) {
+	if w.next == nil {
+		return nil, errors.New("workload has no generator")
+	}
+	if w.Accesses < 0 {
+		return nil, fmt.Errorf("Accesses can't be negative, got %d", w.Accesses)
+	}
+	next, err := w.next(rand.New(rand.NewSource(seed)))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]uint64, w.Accesses)
+	for i := range keys {
+		keys[i] = next(i)
+	}
+	return keys, nil
+}
+
+// baselinePolicyName is the policy every RunPolicyComparison reports on.
+const baselinePolicyName = "random"
+
+// ComparisonConfig is the setup of RunPolicyComparison.
+type ComparisonConfig struct {
+	// Config is the config of every cache, with Policy replaced by each of
+	// the policies compared. Metrics are always collected.
+	Config Config
+	// Seed seeds the streams of keys of the workloads.
+	Seed int64
+	// Policies are the names of the policies to compare, as registered with
+	// RegisterPolicy, "tinylfu" being the default policy. Every registered
+	// policy is compared, sorted by name, if it's empty. The "random" policy
+	// is added last if it's missing, so that every report has the baseline.
+	Policies []string
+}
+
+// PolicyResult is the outcome of replaying a workload against a policy. The
+// Name of the ReplayResult is the name of the policy.
+type PolicyResult struct {
+	Workload string
+	*ReplayResult
+	// Allocs and Bytes are the number and size of the heap allocations made
+	// during the replay, by the cache's goroutines too.
+	Allocs uint64
+	Bytes  uint64
+}
+
+// Throughput returns the number of keys replayed per second.
+func (r *PolicyResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Hits+r.Misses) / r.Duration.Seconds()
+}
+
+// AllocsPerAccess returns the number of heap allocations per key replayed.
+func (r *PolicyResult) AllocsPerAccess() float64 {
+	if r.Hits+r.Misses == 0 {
+		return 0
+	}
+	return float64(r.Allocs) / float64(r.Hits+r.Misses)
+}
+
+// Report holds the results of RunPolicyComparison, by workload and then by
+// policy, in the order they were given.
+type Report struct {
+	Seed    int64
+	Results []*PolicyResult
+}
+
+// Result returns the result of the policy on the workload, or nil if there's
+// none.
+func (r *Report) Result(workload, policy string) *PolicyResult {
+	for _, result := range r.Results {
+		if result.Workload == workload && result.Name == policy {
+			return result
+		}
+	}
+	return nil
+}
+
+// Write writes the results to w as an aligned table.
+func (r *Report) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "workload\tpolicy\thit ratio\taccesses/s\tallocs/access\tduration")
+	for _, result := range r.Results {
+		fmt.Fprintf(tw, "%s\t%s\t%.4f\t%.0f\t%.2f\t%v\n", result.Workload, result.Name,
+			result.HitRatio(), result.Throughput(), result.AllocsPerAccess(),
+			result.Duration.Round(time.Millisecond))
+	}
+	return tw.Flush()
+}
+
+// RunPolicyComparison replays every workload against a new cache for each
+// policy, all made from the same config, like Replay, and reports how they
+// did. It's meant for benchmarks, and for acceptance tests checking the hit
+// ratio of a policy.
+//
+// The streams of keys only depend on the seed, and are the same for every
+// policy. With Config.Synchronous set, which slows the replays down, the hit
+// ratios are then reproducible, other than the ones of the policies sampling
+// their victims or hashing with a random seed, such as the default policy,
+// which vary a little from run to run. Without it, the lossy Get buffers may
+// drop accesses. The throughput and allocations depend on the machine.
+func RunPolicyComparison(cfg ComparisonConfig, workloads []Workload) (*Report, error) {
+	names := cfg.Policies
+	if len(names) == 0 {
+		names = policyNames()
+	}
+	if !containsString(names, baselinePolicyName) {
+		names = append(names[:len(names):len(names)], baselinePolicyName)
+	}
+	newPolicies := make([]func(numCounters, maxCost int64) Policy, len(names))
+	for i, name := range names {
+		newPolicy, err := lookupPolicy(name)
+		if err != nil {
+			return nil, err
+		}
+		newPolicies[i] = newPolicy
+	}
+	report := &Report{Seed: cfg.Seed}
+	for _, w := range workloads {
+		keys, err := w.Keys(cfg.Seed)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", w.Name, err)
+		}
+		for i, name := range names {
+			config := cfg.Config
+			config.Policy = newPolicies[i]
+			c, err := newReplayCache(&config)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %v", w.Name, name, err)
+			}
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			result := replay(name, c, keys)
+			runtime.ReadMemStats(&after)
+			c.Close()
+			report.Results = append(report.Results, &PolicyResult{
+				Workload:     w.Name,
+				ReplayResult: result,
+				Allocs:       after.Mallocs - before.Mallocs,
+				Bytes:        after.TotalAlloc - before.TotalAlloc,
+			})
+		}
+	}
+	return report, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadKeys(t *testing.T) {
+	for _, w := range []Workload{
+		UniformWorkload(100, 1000),
+		ZipfWorkload(1.2, 100, 1000),
+		ScanWorkload(100, 1000),
+		HotspotWorkload(100, 10, 200, 1000),
+	} {
+		keys, err := w.Keys(1)
+		require.NoError(t, err, w.Name)
+		require.Len(t, keys, 1000)
+		for _, key := range keys {
+			require.True(t, key < 100, w.Name)
+		}
+		again, err := w.Keys(1)
+		require.NoError(t, err)
+		require.Equal(t, keys, again, w.Name)
+		if w.Name != "scan" {
+			other, err := w.Keys(2)
+			require.NoError(t, err)
+			require.NotEqual(t, keys, other, w.Name)
+		}
+	}
+
+	keys, err := ScanWorkload(3, 7).Keys(0)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2, 0, 1, 2, 0}, keys)
+	// The hot set moves every shift accesses.
+	keys, err = HotspotWorkload(1000, 10, 100, 300).Keys(0)
+	require.NoError(t, err)
+	for part, base := range []uint64{0, 10, 20} {
+		var hot int
+		for _, key := range keys[part*100 : (part+1)*100] {
+			if key >= base && key < base+10 {
+				hot++
+			}
+		}
+		require.True(t, hot >= 75, "part %d: %d", part, hot)
+	}
+
+	for _, w := range []Workload{
+		UniformWorkload(0, 10),
+		ZipfWorkload(1, 100, 10),
+		ScanWorkload(0, 10),
+		HotspotWorkload(10, 20, 10, 10),
+		HotspotWorkload(10, 5, 0, 10),
+		{Name: "empty", Accesses: 10},
+	} {
+		_, err := w.Keys(0)
+		require.Error(t, err, w.Name)
+	}
+}
+
+func TestRunPolicyComparison(t *testing.T) {
+	cfg := ComparisonConfig{
+		Config: Config{
+			NumCounters:        1000,
+			MaxCost:            100,
+			BufferItems:        64,
+			IgnoreInternalCost: true,
+			Synchronous:        true,
+		},
+		Seed:     42,
+		Policies: []string{"lru", "tinylfu", "lirs"},
+	}
+	workloads := []Workload{
+		ZipfWorkload(1.01, 1000, 5000),
+		ScanWorkload(150, 3000),
+	}
+	report, err := RunPolicyComparison(cfg, workloads)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), report.Seed)
+	// The baseline is added to the policies asked for.
+	require.Len(t, report.Results, 8)
+	require.Equal(t, "zipf(s=1.01)", report.Results[0].Workload)
+	require.Equal(t, "lru", report.Results[0].Name)
+	require.Equal(t, "lirs", report.Results[6].Name)
+	require.Equal(t, "random", report.Results[7].Name)
+	require.Equal(t, []string{"lru", "tinylfu", "lirs"}, cfg.Policies)
+	for i, r := range report.Results {
+		require.Equal(t, uint64(workloads[i/4].Accesses), r.Hits+r.Misses)
+		require.True(t, r.Throughput() > 0)
+	}
+	// LRU gets nothing out of a loop over more keys than it holds.
+	require.Zero(t, report.Result("scan", "lru").Hits)
+	require.True(t, report.Result("scan", "lirs").HitRatio() > 0.5)
+	require.True(t, report.Result("scan", "random").Hits > 0)
+	require.Nil(t, report.Result("scan", "arc"))
+
+	// The same seed gives the same hit ratios for the deterministic policies.
+	again, err := RunPolicyComparison(cfg, workloads)
+	require.NoError(t, err)
+	for _, w := range workloads {
+		for _, policy := range []string{"lru", "lirs", "random"} {
+			require.Equal(t, report.Result(w.Name, policy).Hits,
+				again.Result(w.Name, policy).Hits, "%s: %s", w.Name, policy)
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, report.Write(&buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 9)
+	require.True(t, strings.HasPrefix(lines[0], "workload"))
+
+	// Every registered policy is compared by default.
+	cfg.Policies = nil
+	report, err = RunPolicyComparison(cfg, workloads[1:])
+	require.NoError(t, err)
+	require.Len(t, report.Results, len(policyNames()))
+
+	cfg.Policies = []string{"nope"}
+	_, err = RunPolicyComparison(cfg, workloads)
+	require.Error(t, err)
+	cfg.Policies = nil
+	_, err = RunPolicyComparison(cfg, []Workload{ZipfWorkload(0.5, 10, 10)})
+	require.Error(t, err)
+	cfg.Config.MaxCost = 0
+	_, err = RunPolicyComparison(cfg, workloads)
+	require.Error(t, err)
+}
+
+// BenchmarkPolicies runs every registered policy through the synthetic
+// workloads, reporting the hit ratio along with the time and allocations per
+// access. Unlike RunPolicyComparison, Sets aren't waited for, so the hit
+// ratio also accounts for the Sets the buffers drop or haven't applied yet.
+func BenchmarkPolicies(b *testing.B) {
+	const keys = 10000
+	workloads := []Workload{
+		UniformWorkload(keys, 1<<16),
+		ZipfWorkload(1.01, keys, 1<<16),
+		ZipfWorkload(1.5, keys, 1<<16),
+		ScanWorkload(keys/5, 1<<16),
+		HotspotWorkload(keys, keys/20, 1<<13, 1<<16),
+	}
+	for _, w := range workloads {
+		stream, err := w.Keys(1)
+		require.NoError(b, err)
+		for _, name := range policyNames() {
+			newPolicy, err := lookupPolicy(name)
+			require.NoError(b, err)
+			b.Run(fmt.Sprintf("%s/%s", w.Name, name), func(b *testing.B) {
+				c, err := NewCache(&Config{
+					NumCounters:        keys * 10,
+					MaxCost:            keys / 10,
+					BufferItems:        64,
+					IgnoreInternalCost: true,
+					Metrics:            true,
+					Policy:             newPolicy,
+				})
+				require.NoError(b, err)
+				defer c.Close()
+				// Start from the cache the stream leaves behind, so that the
+				// hit ratio is the one of the steady state.
+				replay(name, c, stream)
+				c.Metrics.Clear()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					key := stream[i%len(stream)]
+					if _, ok := c.Get(key); !ok {
+						c.Set(key, nil, 1)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(c.Metrics.Ratio(), "hit-ratio")
+			})
+		}
+	}
+}
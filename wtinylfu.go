@@ -0,0 +1,314 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ristretto
+
+import (
+	"container/list"
+	"io"
+	"math"
+)
+
+// wtinyLFUWindowRatio is the default share of the cache given to the window of
+// a W-TinyLFU policy.
+const wtinyLFUWindowRatio = 0.01
+
+// The defaults of WTinyLFUAdaptation.
+const (
+	wtinyLFUStep      = 0.05
+	wtinyLFUMinWindow = 0.01
+	wtinyLFUMaxWindow = 0.8
+)
+
+// wtinyLFUPolicy is a Window TinyLFU policy. New keys are always admitted to a
+// small LRU window, so that a burst of accesses to a new key can be served
+// before its frequency builds up. Keys pushed out of the window move to a
+// Segmented LRU main space, and while the cache is full each of them has to
+// duel the main space's next victim: the key with the lower TinyLFU frequency
+// estimate is evicted.
+type wtinyLFUPolicy struct {
+	window      *list.List
+	windowRatio float64
+	windowCap   int64
+	// windowCost is the sum of the costs of the keys in the window.
+	windowCost int64
+	// windowElems maps the keys in the window to their list elements.
+	windowElems map[uint64]*list.Element
+	main        *slruPolicy
+	admit       *tinyLFU
+	maxCost     int64
+	// adapt is set to move windowRatio by hill climbing.
+	adapt *wtinyLFUClimber
+}
+
+// WTinyLFUAdaptation configures a W-TinyLFU policy that adapts the size of its
+// window to the workload. See NewAdaptiveWTinyLFUPolicy.
+type WTinyLFUAdaptation struct {
+	// Epoch is the number of accesses the hit ratio is measured over between
+	// adjustments of the window. It's NumCounters if 0.
+	Epoch int64
+	// Step is how much the share of MaxCost given to the window changes at
+	// every adjustment. It's 0.05 if 0.
+	Step float64
+	// MinWindow and MaxWindow bound the share of MaxCost given to the window.
+	// They're 0.01 and 0.8 if both are 0.
+	MinWindow float64
+	MaxWindow float64
+}
+
+// wtinyLFUClimber adjusts the window of a W-TinyLFU policy by hill climbing:
+// after every epoch, the window keeps moving in the same direction if the hit
+// ratio improved over the previous epoch, and turns around otherwise.
+type wtinyLFUClimber struct {
+	WTinyLFUAdaptation
+	hits     int64
+	accesses int64
+	// last is the hit ratio of the previous epoch, and direction the sign of
+	// the last adjustment.
+	last      float64
+	direction float64
+}
+
+// NewWTinyLFUPolicy returns a Window TinyLFU Policy that gives 1% of MaxCost
+// to its window. It can be used as Config.Policy.
+func NewWTinyLFUPolicy(numCounters, maxCost int64) Policy {
+	return newWTinyLFUPolicy(numCounters, maxCost, wtinyLFUWindowRatio)
+}
+
+// NewWTinyLFUPolicyWithWindow returns a Config.Policy constructor for Window
+// TinyLFU policies giving windowRatio, between 0 and 1, of MaxCost to the
+// window.
+func NewWTinyLFUPolicyWithWindow(windowRatio float64) func(numCounters, maxCost int64) Policy {
+	if windowRatio < 0 || windowRatio > 1 {
+		panic("ristretto: W-TinyLFU window ratio must be between 0 and 1")
+	}
+	return func(numCounters, maxCost int64) Policy {
+		return newWTinyLFUPolicy(numCounters, maxCost, windowRatio)
+	}
+}
+
+// NewAdaptiveWTinyLFUPolicy returns a Config.Policy constructor for Window
+// TinyLFU policies that start with 1% of MaxCost in the window, or MinWindow if
+// higher, and grow or shrink it by hill climbing on the hit ratio. Growing the
+// window favors recently used keys, and shrinking it frequently used ones.
+// Cache.WindowRatio returns the current share of the window.
+func NewAdaptiveWTinyLFUPolicy(adaptation WTinyLFUAdaptation) func(numCounters, maxCost int64) Policy {
+	if adaptation.Step == 0 {
+		adaptation.Step = wtinyLFUStep
+	}
+	if adaptation.MinWindow == 0 && adaptation.MaxWindow == 0 {
+		adaptation.MinWindow = wtinyLFUMinWindow
+		adaptation.MaxWindow = wtinyLFUMaxWindow
+	}
+	switch {
+	case adaptation.Epoch < 0:
+		panic("ristretto: W-TinyLFU epoch must not be negative")
+	case adaptation.Step < 0 || adaptation.Step > 1:
+		panic("ristretto: W-TinyLFU step must be between 0 and 1")
+	case adaptation.MinWindow < 0 || adaptation.MaxWindow > 1 ||
+		adaptation.MinWindow > adaptation.MaxWindow:
+		panic("ristretto: W-TinyLFU window bounds must be between 0 and 1, in order")
+	}
+	return func(numCounters, maxCost int64) Policy {
+		a := adaptation
+		if a.Epoch == 0 {
+			a.Epoch = numCounters
+		}
+		ratio := math.Max(wtinyLFUWindowRatio, a.MinWindow)
+		p := newWTinyLFUPolicy(numCounters, maxCost, math.Min(ratio, a.MaxWindow))
+		p.adapt = &wtinyLFUClimber{WTinyLFUAdaptation: a, direction: 1}
+		return p
+	}
+}
+
+func newWTinyLFUPolicy(numCounters, maxCost int64, windowRatio float64) *wtinyLFUPolicy {
+	p := &wtinyLFUPolicy{
+		window:      list.New(),
+		windowRatio: windowRatio,
+		windowElems: make(map[uint64]*list.Element),
+		main:        newSLRUPolicy(maxCost, slruProbationRatio),
+		admit:       newTinyLFU(numCounters, 0),
+	}
+	p.Resize(maxCost)
+	return p
+}
+
+func (p *wtinyLFUPolicy) Resize(maxCost int64) {
+	p.maxCost = maxCost
+	p.windowCap = int64(float64(maxCost) * p.windowRatio)
+	if p.windowCap < 1 {
+		p.windowCap = 1
+	}
+	p.main.Resize(maxCost - p.windowCap)
+	for p.windowCost > p.windowCap && p.window.Len() > 1 {
+		p.demote()
+	}
+	// A larger window takes the keys the main space would evict first, as
+	// the least recently used keys of the window.
+	for elem := p.main.victim(); elem != nil; elem = p.main.victim() {
+		e := elem.Value.(*slruEntry)
+		if p.windowCost+e.cost > p.windowCap || p.mainCost() <= maxCost-p.windowCap {
+			break
+		}
+		p.main.Del(e.key)
+		p.windowElems[e.key] = p.window.PushBack(&slruEntry{key: e.key, cost: e.cost})
+		p.windowCost += e.cost
+	}
+}
+
+func (p *wtinyLFUPolicy) mainCost() int64 {
+	return p.main.probation.cost + p.main.protected.cost
+}
+
+func (p *wtinyLFUPolicy) SaveState(w io.Writer) error {
+	return p.admit.writeTo(w)
+}
+
+func (p *wtinyLFUPolicy) LoadState(r io.Reader) error {
+	return p.admit.readFrom(r)
+}
+
+func (p *wtinyLFUPolicy) sketchCounters() int64 {
+	return p.admit.freq.counters()
+}
+
+// WindowRatio returns the share of MaxCost given to the window.
+func (p *wtinyLFUPolicy) WindowRatio() float64 {
+	return p.windowRatio
+}
+
+// climb records an access for the hill climbing, and adjusts the window at the
+// end of every epoch.
+func (p *wtinyLFUPolicy) climb(hit bool) {
+	a := p.adapt
+	a.accesses++
+	if hit {
+		a.hits++
+	}
+	if a.accesses < a.Epoch {
+		return
+	}
+	ratio := float64(a.hits) / float64(a.accesses)
+	a.hits, a.accesses = 0, 0
+	if ratio <= a.last {
+		a.direction = -a.direction
+	}
+	a.last = ratio
+	window := p.windowRatio + a.direction*a.Step
+	window = math.Max(a.MinWindow, math.Min(a.MaxWindow, window))
+	if window != p.windowRatio {
+		p.windowRatio = window
+		p.Resize(p.maxCost)
+	}
+}
+
+func (p *wtinyLFUPolicy) Add(key uint64, cost int64) {
+	p.windowElems[key] = p.window.PushFront(&slruEntry{key: key, cost: cost})
+	p.windowCost += cost
+	// There's room in the cache, otherwise Evict would have made some, so the
+	// keys that overflow the window can go to the main space without a duel.
+	for p.windowCost > p.windowCap && p.window.Len() > 1 {
+		p.demote()
+	}
+}
+
+// demote moves the least recently used key of the window to the main space.
+func (p *wtinyLFUPolicy) demote() {
+	e := p.removeFromWindow(p.window.Back())
+	p.main.Add(e.key, e.cost)
+}
+
+func (p *wtinyLFUPolicy) removeFromWindow(elem *list.Element) *slruEntry {
+	e := elem.Value.(*slruEntry)
+	p.window.Remove(elem)
+	p.windowCost -= e.cost
+	delete(p.windowElems, e.key)
+	return e
+}
+
+func (p *wtinyLFUPolicy) Update(key uint64, cost int64) {
+	if elem, ok := p.windowElems[key]; ok {
+		e := elem.Value.(*slruEntry)
+		p.windowCost += cost - e.cost
+		e.cost = cost
+		return
+	}
+	p.main.Update(key, cost)
+}
+
+func (p *wtinyLFUPolicy) Del(key uint64) {
+	if elem, ok := p.windowElems[key]; ok {
+		p.removeFromWindow(elem)
+		return
+	}
+	p.main.Del(key)
+}
+
+func (p *wtinyLFUPolicy) Access(keys []uint64) {
+	p.admit.Push(keys)
+	for _, key := range keys {
+		elem, ok := p.windowElems[key]
+		if ok {
+			p.window.MoveToFront(elem)
+		}
+		if p.adapt != nil {
+			_, inMain := p.main.elems[key]
+			p.climb(ok || inMain)
+		}
+	}
+	p.main.Access(keys)
+}
+
+func (p *wtinyLFUPolicy) Evict(candidate uint64) (uint64, bool) {
+	mainVictim := p.main.victim()
+	windowVictim := p.window.Back()
+	switch {
+	case windowVictim == nil && mainVictim == nil:
+		return 0, false
+	case windowVictim == nil:
+		return p.evictMain(mainVictim), true
+	case mainVictim == nil:
+		return p.removeFromWindow(windowVictim).key, true
+	}
+	// The window's least recently used key makes room for candidate in the
+	// window, and only makes it to the main space if it's more frequently used
+	// than the key it would replace there.
+	windowKey := windowVictim.Value.(*slruEntry).key
+	mainKey := mainVictim.Value.(*slruEntry).key
+	if p.admit.Estimate(windowKey) > p.admit.Estimate(mainKey) {
+		victim := p.evictMain(mainVictim)
+		p.demote()
+		return victim, true
+	}
+	return p.removeFromWindow(windowVictim).key, true
+}
+
+func (p *wtinyLFUPolicy) evictMain(elem *list.Element) uint64 {
+	key := elem.Value.(*slruEntry).key
+	p.main.Del(key)
+	return key
+}
+
+func (p *wtinyLFUPolicy) Clear() {
+	p.window = list.New()
+	p.windowCost = 0
+	p.windowElems = make(map[uint64]*list.Element)
+	p.main.Clear()
+	p.admit.clear()
+	if p.adapt != nil {
+		p.adapt.hits, p.adapt.accesses, p.adapt.last = 0, 0, 0
+	}
+}
@@ -0,0 +1,156 @@
+package ristretto
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWTinyLFUPolicyDuel(t *testing.T) {
+	p := NewWTinyLFUPolicyWithWindow(0.1)(100, 10).(*wtinyLFUPolicy)
+	require.Equal(t, int64(1), p.windowCap)
+	for key := uint64(1); key <= 10; key++ {
+		p.Add(key, 1)
+	}
+	// Only the last key fits in the window.
+	require.Equal(t, 1, p.window.Len())
+	require.Equal(t, 9, len(p.main.elems))
+
+	// A frequently used window key replaces the main space's victim.
+	p.Access([]uint64{10, 10, 10})
+	victim, ok := p.Evict(11)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), victim)
+	require.Contains(t, p.main.elems, uint64(10))
+	require.Zero(t, p.window.Len())
+	p.Add(11, 1)
+
+	// An unpopular one is evicted itself.
+	p.Access([]uint64{2, 2, 2})
+	victim, ok = p.Evict(12)
+	require.True(t, ok)
+	require.Equal(t, uint64(11), victim)
+	require.Zero(t, p.windowCost)
+
+	// With an empty window, the main space's victim is evicted.
+	victim, ok = p.Evict(12)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), victim)
+}
+
+func TestWTinyLFUPolicyDel(t *testing.T) {
+	p := NewWTinyLFUPolicy(100, 100).(*wtinyLFUPolicy)
+	require.Equal(t, int64(1), p.windowCap)
+	p.Add(1, 1)
+	p.Add(2, 1)
+	p.Update(2, 3)
+	p.Update(1, 2)
+	require.Equal(t, int64(3), p.windowCost)
+	require.Equal(t, int64(2), p.main.probation.cost)
+	p.Del(1)
+	p.Del(2)
+	require.Zero(t, p.windowCost)
+	require.Zero(t, p.main.probation.cost)
+
+	p.Add(3, 1)
+	p.Clear()
+	_, ok := p.Evict(4)
+	require.False(t, ok)
+	require.Panics(t, func() { NewWTinyLFUPolicyWithWindow(-1) })
+}
+
+func TestWTinyLFUPolicyAdaptive(t *testing.T) {
+	require.Panics(t, func() { NewAdaptiveWTinyLFUPolicy(WTinyLFUAdaptation{Step: 2}) })
+	require.Panics(t, func() {
+		NewAdaptiveWTinyLFUPolicy(WTinyLFUAdaptation{MinWindow: 0.5, MaxWindow: 0.2})
+	})
+	p := NewAdaptiveWTinyLFUPolicy(WTinyLFUAdaptation{Epoch: 1800})(1000, 100).(*wtinyLFUPolicy)
+	require.Equal(t, 0.01, p.WindowRatio())
+
+	// Keys used again shortly after being added want a large window.
+	static := policyHitRatio(NewWTinyLFUPolicy(1000, 100), 100, reuseTrace(100000, 150))
+	adaptive := policyHitRatio(p, 100, reuseTrace(100000, 150))
+	require.True(t, adaptive > static+0.1, "adaptive: %.3f, static: %.3f", adaptive, static)
+	grown := p.WindowRatio()
+	require.True(t, grown >= 0.3, "window: %.2f", grown)
+
+	// A hot set interrupted by scans wants a small one.
+	policyHitRatio(p, 100, scanTrace(80, 200, 400))
+	require.True(t, p.WindowRatio() < grown, "window: %.2f", p.WindowRatio())
+
+	// Moving keys between the window and the main space keeps their costs.
+	require.Equal(t, int64(100), p.windowCost+p.mainCost())
+	require.True(t, p.windowCost <= p.windowCap)
+}
+
+func TestCacheWTinyLFUPolicyConcurrent(t *testing.T) {
+	c, err := NewCache(&Config{
+		NumCounters:        1000,
+		MaxCost:            50,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+		Policy:             NewWTinyLFUPolicyWithWindow(0.2),
+	})
+	require.NoError(t, err)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 2000; i++ {
+				key := r.Intn(200)
+				switch r.Intn(4) {
+				case 0:
+					c.Del(key)
+				case 1:
+					c.Set(key, key, int64(1+r.Intn(3)))
+				default:
+					c.Get(key)
+				}
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+	c.Wait()
+
+	require.Equal(t, 0.2, c.WindowRatio())
+	require.Equal(t, int64(1024), c.SketchCounters())
+
+	// The policy must track exactly the keys the cache accounts for.
+	p := c.policy.(*defaultPolicy)
+	p.Lock()
+	defer p.Unlock()
+	w := p.custom.(*wtinyLFUPolicy)
+	require.Equal(t, len(p.evict.keyCosts), len(w.windowElems)+len(w.main.elems))
+	require.Equal(t, p.evict.used, w.windowCost+w.main.probation.cost+w.main.protected.cost)
+	for key, cost := range p.evict.keyCosts {
+		elem, ok := w.windowElems[key]
+		if !ok {
+			elem, ok = w.main.elems[key]
+		}
+		require.True(t, ok)
+		require.Equal(t, cost, elem.Value.(*slruEntry).cost)
+	}
+}
+
+// reuseTrace returns accesses to new keys, half of the time, and otherwise to
+// one of the last dist keys accessed, picked at random.
+func reuseTrace(n, dist int) []uint64 {
+	r := rand.New(rand.NewSource(1))
+	keys := make([]uint64, 0, n)
+	next := uint64(0)
+	for i := 0; i < n; i++ {
+		if i < dist || r.Intn(2) == 0 {
+			next++
+			keys = append(keys, next)
+			continue
+		}
+		keys = append(keys, keys[i-1-r.Intn(dist)])
+	}
+	return keys
+}
@@ -24,6 +24,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"math"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/golang/glog"
@@ -132,6 +133,52 @@ func (bl *Bloom) AddIfNotHas(hash uint64) bool {
 	return true
 }
 
+// HasAtomic works like Has, but can run concurrently with AddIfNotHasAtomic
+// and ClearAtomic. The atomic methods keep to themselves: they shouldn't be
+// used on a Bloom filter along with the others.
+func (bl *Bloom) HasAtomic(hash uint64) bool {
+	h := hash >> bl.shift
+	l := hash << bl.shift >> bl.shift
+	for i := uint64(0); i < bl.setLocs; i++ {
+		idx := (h + i*l) & bl.size
+		if atomic.LoadUint64(&bl.bitset[idx>>6])&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AddIfNotHasAtomic works like AddIfNotHas, but can run concurrently with
+// HasAtomic, ClearAtomic and itself. It doesn't count the entries in ElemNum.
+func (bl *Bloom) AddIfNotHasAtomic(hash uint64) bool {
+	h := hash >> bl.shift
+	l := hash << bl.shift >> bl.shift
+	added := false
+	for i := uint64(0); i < bl.setLocs; i++ {
+		idx := (h + i*l) & bl.size
+		word, bit := &bl.bitset[idx>>6], uint64(1)<<(idx%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&bit != 0 {
+				break
+			}
+			if atomic.CompareAndSwapUint64(word, old, old|bit) {
+				added = true
+				break
+			}
+		}
+	}
+	return added
+}
+
+// ClearAtomic works like Clear, but can run concurrently with HasAtomic and
+// AddIfNotHasAtomic.
+func (bl *Bloom) ClearAtomic() {
+	for i := range bl.bitset {
+		atomic.StoreUint64(&bl.bitset[i], 0)
+	}
+}
+
 // TotalSize returns the total size of the bloom filter.
 func (bl *Bloom) TotalSize() int {
 	// The bl struct has 5 members and each one is 8 byte. The bitset is a
@@ -3,6 +3,7 @@ package z
 import (
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -110,3 +111,25 @@ func BenchmarkM_Has(b *testing.B) {
 		}
 	}
 }
+
+func TestAtomic(t *testing.T) {
+	bf := NewBloomFilter(float64(n*10), float64(7))
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < len(wordlist1); i += 4 {
+				bf.AddIfNotHasAtomic(MemHash(wordlist1[i]))
+			}
+		}(g)
+	}
+	wg.Wait()
+	for i := range wordlist1 {
+		hash := MemHash(wordlist1[i])
+		require.True(t, bf.HasAtomic(hash))
+		require.False(t, bf.AddIfNotHasAtomic(hash))
+	}
+	bf.ClearAtomic()
+	require.False(t, bf.HasAtomic(MemHash(wordlist1[0])))
+}